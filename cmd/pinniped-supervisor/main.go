@@ -5,9 +5,12 @@ package main
 
 import (
 	"context"
+	"crypto"
 	"crypto/rand"
 	"crypto/tls"
+	"database/sql"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
@@ -15,9 +18,13 @@ import (
 	"strings"
 	"time"
 
+	_ "github.com/lib/pq" // register the "postgres" driver for the sql storage backend, which does not require cgo
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
 	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/pkg/version"
@@ -35,15 +42,23 @@ import (
 	"go.pinniped.dev/internal/controller/supervisorconfig/upstreamwatcher"
 	"go.pinniped.dev/internal/controller/supervisorstorage"
 	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/crud"
 	"go.pinniped.dev/internal/deploymentref"
 	"go.pinniped.dev/internal/downward"
+	"go.pinniped.dev/internal/fositestorage/accesstoken"
+	"go.pinniped.dev/internal/fositestorage/openidconnect"
+	"go.pinniped.dev/internal/fositestorage/pkce"
+	"go.pinniped.dev/internal/fositestorage/refreshtoken"
 	"go.pinniped.dev/internal/groupsuffix"
 	"go.pinniped.dev/internal/kubeclient"
+	"go.pinniped.dev/internal/oidc"
 	"go.pinniped.dev/internal/oidc/jwks"
+	"go.pinniped.dev/internal/oidc/pages"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/oidc/provider/manager"
 	"go.pinniped.dev/internal/plog"
 	"go.pinniped.dev/internal/secret"
+	"go.pinniped.dev/internal/signer"
 )
 
 const (
@@ -84,9 +99,11 @@ func startControllers(
 	cfg *supervisor.Config,
 	issuerManager *manager.Manager,
 	dynamicJWKSProvider jwks.DynamicJWKSProvider,
+	dynamicBrandingProvider pages.DynamicBrandingProvider,
 	dynamicTLSCertProvider provider.DynamicTLSCertProvider,
 	dynamicUpstreamIDPProvider provider.DynamicUpstreamIDPProvider,
 	secretCache *secret.Cache,
+	storageBackend crud.Backend,
 	supervisorDeployment *appsv1.Deployment,
 	kubeClient kubernetes.Interface,
 	pinnipedClient pinnipedclientset.Interface,
@@ -96,6 +113,21 @@ func startControllers(
 	federationDomainInformer := pinnipedInformers.Config().V1alpha1().FederationDomains()
 	secretInformer := kubeInformers.Core().V1().Secrets()
 
+	// The token HMAC keys are never rotated, since rotating them would invalidate all of the stored sessions.
+	var keyRotation generator.KeyRotation
+	if cfg.KeyRotation.IntervalSeconds != nil {
+		keyRotation = generator.KeyRotation{
+			Interval:    time.Duration(*cfg.KeyRotation.IntervalSeconds) * time.Second,
+			GracePeriod: time.Duration(*cfg.KeyRotation.GracePeriodSeconds) * time.Second,
+		}
+	}
+
+	// No signing keys are generated for the FederationDomains which sign their ID tokens with an external signer.
+	externalSignerIssuers := sets.NewString()
+	for _, idTokenSigner := range cfg.IDTokenSigners {
+		externalSignerIssuers.Insert(idTokenSigner.Issuer)
+	}
+
 	// Create controller manager.
 	controllerManager := controllerlib.
 		NewManager().
@@ -104,6 +136,10 @@ func startControllers(
 				clock.RealClock{},
 				kubeClient,
 				secretInformer,
+				federationDomainInformer,
+				pinnipedInformers.IDP().V1alpha1().OIDCIdentityProviders(),
+				time.Duration(*cfg.StorageConfig.GarbageCollection.SweepIntervalSeconds)*time.Second,
+				int(*cfg.StorageConfig.GarbageCollection.BatchSize),
 				controllerlib.WithInformer,
 			),
 			singletonWorker,
@@ -114,6 +150,7 @@ func startControllers(
 				clock.RealClock{},
 				pinnipedClient,
 				federationDomainInformer,
+				pinnipedInformers.IDP().V1alpha1().OIDCIdentityProviders(),
 				controllerlib.WithInformer,
 			),
 			singletonWorker,
@@ -121,6 +158,7 @@ func startControllers(
 		WithController(
 			supervisorconfig.NewJWKSWriterController(
 				cfg.Labels,
+				externalSignerIssuers,
 				kubeClient,
 				pinnipedClient,
 				secretInformer,
@@ -138,6 +176,15 @@ func startControllers(
 			),
 			singletonWorker,
 		).
+		WithController(
+			supervisorconfig.NewBrandingObserverController(
+				dynamicBrandingProvider,
+				kubeInformers.Core().V1().ConfigMaps(),
+				federationDomainInformer,
+				controllerlib.WithInformer,
+			),
+			singletonWorker,
+		).
 		WithController(
 			supervisorconfig.NewTLSCertObserverController(
 				dynamicTLSCertProvider,
@@ -154,10 +201,12 @@ func startControllers(
 				cfg.Labels,
 				kubeClient,
 				secretInformer,
-				func(secret []byte) {
-					plog.Debug("setting csrf cookie secret")
-					secretCache.SetCSRFCookieEncoderHashKey(secret)
+				func(keys [][]byte) {
+					plog.Debug("setting csrf cookie secret", "keys", len(keys))
+					secretCache.SetCSRFCookieEncoderHashKeys(keys)
 				},
+				keyRotation,
+				clock.RealClock{},
 				controllerlib.WithInformer,
 				controllerlib.WithInitialEvent,
 			),
@@ -170,10 +219,12 @@ func startControllers(
 					cfg.Labels,
 					rand.Reader,
 					generator.SecretUsageTokenSigningKey,
-					func(federationDomainIssuer string, symmetricKey []byte) {
+					func(federationDomainIssuer string, symmetricKeys [][]byte) {
 						plog.Debug("setting hmac secret", "issuer", federationDomainIssuer)
-						secretCache.SetTokenHMACKey(federationDomainIssuer, symmetricKey)
+						secretCache.SetTokenHMACKey(federationDomainIssuer, symmetricKeys[0])
 					},
+					generator.KeyRotation{},
+					clock.RealClock{},
 				),
 				func(fd *configv1alpha1.FederationDomain) *corev1.LocalObjectReference {
 					return &fd.Status.Secrets.TokenSigningKey
@@ -193,10 +244,12 @@ func startControllers(
 					cfg.Labels,
 					rand.Reader,
 					generator.SecretUsageStateSigningKey,
-					func(federationDomainIssuer string, symmetricKey []byte) {
-						plog.Debug("setting state signature key", "issuer", federationDomainIssuer)
-						secretCache.SetStateEncoderHashKey(federationDomainIssuer, symmetricKey)
+					func(federationDomainIssuer string, symmetricKeys [][]byte) {
+						plog.Debug("setting state signature key", "issuer", federationDomainIssuer, "keys", len(symmetricKeys))
+						secretCache.SetStateEncoderHashKeys(federationDomainIssuer, symmetricKeys)
 					},
+					keyRotation,
+					clock.RealClock{},
 				),
 				func(fd *configv1alpha1.FederationDomain) *corev1.LocalObjectReference {
 					return &fd.Status.Secrets.StateSigningKey
@@ -216,10 +269,12 @@ func startControllers(
 					cfg.Labels,
 					rand.Reader,
 					generator.SecretUsageStateEncryptionKey,
-					func(federationDomainIssuer string, symmetricKey []byte) {
-						plog.Debug("setting state encryption key", "issuer", federationDomainIssuer)
-						secretCache.SetStateEncoderBlockKey(federationDomainIssuer, symmetricKey)
+					func(federationDomainIssuer string, symmetricKeys [][]byte) {
+						plog.Debug("setting state encryption key", "issuer", federationDomainIssuer, "keys", len(symmetricKeys))
+						secretCache.SetStateEncoderBlockKeys(federationDomainIssuer, symmetricKeys)
 					},
+					keyRotation,
+					clock.RealClock{},
 				),
 				func(fd *configv1alpha1.FederationDomain) *corev1.LocalObjectReference {
 					return &fd.Status.Secrets.StateEncryptionKey
@@ -251,6 +306,74 @@ func startControllers(
 	pinnipedInformers.WaitForCacheSync(ctx.Done())
 
 	go controllerManager.Start(ctx)
+
+	// The garbage collector controller only watches the session storage Secrets, so the database of the SQL backend
+	// is swept separately.
+	if sqlBackend, ok := storageBackend.(*crud.SQLBackend); ok {
+		sqlGarbageCollector := supervisorstorage.NewSQLGarbageCollector(
+			clock.RealClock{},
+			sqlBackend,
+			federationDomainInformer,
+			pinnipedInformers.IDP().V1alpha1().OIDCIdentityProviders(),
+			int(*cfg.StorageConfig.GarbageCollection.BatchSize),
+		)
+		go wait.UntilWithContext(ctx, sqlGarbageCollector.Sweep, time.Duration(*cfg.StorageConfig.GarbageCollection.SweepIntervalSeconds)*time.Second)
+	}
+}
+
+// newStorageBackend returns the backend in which the downstream sessions are stored, as chosen by the storage config.
+func newStorageBackend(ctx context.Context, cfg *supervisor.Config, kubeClient kubernetes.Interface, namespace string) (crud.Backend, error) {
+	if cfg.StorageConfig.Backend == supervisor.StorageBackendSQL {
+		backend, err := openSQLBackend(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if err := backend.CreateSchema(ctx); err != nil {
+			return nil, fmt.Errorf("could not create sql schema: %w", err)
+		}
+		return backend, nil
+	}
+
+	// Optionally read sessions from an informer which only watches the session storage Secrets. Until the informer
+	// has synced, and for any session which it has not observed yet, the reads fall back to the API server. The
+	// authorization codes are always read from the API server, so that each of them can only be redeemed once. The
+	// refresh tokens are read from the cache, but each rotation writes the refresh token back at the resource version
+	// which was read, so that a stale read cannot rotate it twice. A revoked access token may still be accepted by
+	// other replicas until their informers observe the revocation.
+	sessionSecrets := kubeClient.CoreV1().Secrets(namespace)
+	if cfg.StorageConfig.ReadCache.Enabled {
+		sessionInformers := kubeinformers.NewSharedInformerFactoryWithOptions(
+			kubeClient,
+			defaultResyncInterval,
+			kubeinformers.WithNamespace(namespace),
+			kubeinformers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+				opts.LabelSelector = crud.SecretLabelKey
+			}),
+		)
+		sessionSecretLister := sessionInformers.Core().V1().Secrets().Lister().Secrets(namespace)
+		sessionSecrets = crud.NewCachedSecretInterface(sessionSecrets, sessionSecretLister, []string{
+			pkce.TypeLabelValue,
+			openidconnect.TypeLabelValue,
+			accesstoken.TypeLabelValue,
+			refreshtoken.TypeLabelValue,
+		})
+		sessionInformers.Start(ctx.Done())
+	}
+	return crud.NewSecretsBackend(sessionSecrets), nil
+}
+
+// openSQLBackend returns the SQL backend which is configured by the storage config. It does not connect to the
+// database yet.
+func openSQLBackend(cfg *supervisor.Config) (*crud.SQLBackend, error) {
+	dataSourceName, err := ioutil.ReadFile(cfg.StorageConfig.SQL.DataSourceNameFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read sql data source name: %w", err)
+	}
+	db, err := sql.Open("postgres", strings.TrimSpace(string(dataSourceName)))
+	if err != nil {
+		return nil, fmt.Errorf("could not open sql database: %w", err)
+	}
+	return crud.NewSQLBackend(db), nil
 }
 
 func run(podInfo *downward.PodInfo, cfg *supervisor.Config) error {
@@ -291,17 +414,48 @@ func run(podInfo *downward.PodInfo, cfg *supervisor.Config) error {
 	}))
 
 	dynamicJWKSProvider := jwks.NewDynamicJWKSProvider()
+	if len(cfg.IDTokenSigners) > 0 {
+		issuerToSigner := make(map[string]crypto.Signer, len(cfg.IDTokenSigners))
+		for i := range cfg.IDTokenSigners {
+			idTokenSigner := &cfg.IDTokenSigners[i]
+			issuerSigner, err := signer.New(ctx, &idTokenSigner.Signer)
+			if err != nil {
+				return fmt.Errorf("cannot load ID token signer of issuer %s: %w", idTokenSigner.Issuer, err)
+			}
+			issuerToSigner[idTokenSigner.Issuer] = issuerSigner
+		}
+		dynamicJWKSProvider, err = jwks.NewSignerJWKSProvider(dynamicJWKSProvider, issuerToSigner)
+		if err != nil {
+			return fmt.Errorf("cannot use ID token signers: %w", err)
+		}
+	}
+	dynamicBrandingProvider := pages.NewDynamicBrandingProvider()
 	dynamicTLSCertProvider := provider.NewDynamicTLSCertProvider()
 	dynamicUpstreamIDPProvider := provider.NewDynamicUpstreamIDPProvider()
 	secretCache := secret.Cache{}
 
+	storageBackend, err := newStorageBackend(ctx, cfg, client.Kubernetes, serverInstallationNamespace)
+	if err != nil {
+		return fmt.Errorf("cannot create session storage: %w", err)
+	}
+	if cfg.StorageConfig.Migration.RewriteOnStartup {
+		go func() {
+			migrated, err := oidc.MigrateStoredSessions(ctx, storageBackend)
+			if err != nil {
+				plog.WarningErr("failed to rewrite some stored sessions in the current format", err)
+			}
+			plog.Info("rewrote stored sessions in the current format", "count", migrated)
+		}()
+	}
+
 	// OIDC endpoints will be served by the oidProvidersManager, and any non-OIDC paths will fallback to the healthMux.
 	oidProvidersManager := manager.NewManager(
 		healthMux,
 		dynamicJWKSProvider,
+		dynamicBrandingProvider,
 		dynamicUpstreamIDPProvider,
 		&secretCache,
-		client.Kubernetes.CoreV1().Secrets(serverInstallationNamespace),
+		storageBackend,
 	)
 
 	startControllers(
@@ -309,9 +463,11 @@ func run(podInfo *downward.PodInfo, cfg *supervisor.Config) error {
 		cfg,
 		oidProvidersManager,
 		dynamicJWKSProvider,
+		dynamicBrandingProvider,
 		dynamicTLSCertProvider,
 		dynamicUpstreamIDPProvider,
 		&secretCache,
+		storageBackend,
 		supervisorDeployment,
 		client.Kubernetes,
 		client.PinnipedSupervisor,
@@ -366,6 +522,13 @@ func main() {
 	defer logs.FlushLogs()
 	plog.RemoveKlogGlobalFlags() // move this whenever the below code gets refactored to use cobra
 
+	if len(os.Args) > 1 && os.Args[1] == "sessions" {
+		if err := runSessionsCommand(os.Args[2:], os.Stdout); err != nil {
+			klog.Fatal(err)
+		}
+		return
+	}
+
 	klog.Infof("Running %s at %#v", rest.DefaultKubernetesUserAgent(), version.Get())
 	klog.Infof("Command-line arguments were: %s %s %s", os.Args[0], os.Args[1], os.Args[2])
 
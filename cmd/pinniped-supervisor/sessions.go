@@ -0,0 +1,157 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"go.pinniped.dev/internal/config/supervisor"
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/fositestorage/sessionadmin"
+)
+
+const sessionsUsage = `Usage: pinniped-supervisor sessions (list|revoke) [flags]
+
+List or revoke the active downstream sessions of the Supervisor.
+Revoking requires at least one filter flag.
+
+Flags:
+`
+
+// runSessionsCommand implements the "sessions" admin subcommand. It uses the session storage backend which is
+// selected by the Supervisor's config file. For the Secrets backend, it talks to the Kubernetes API using the usual
+// kubeconfig loading rules, which fall back to the in-cluster config when run inside a pod.
+func runSessionsCommand(args []string, out io.Writer) error {
+	return runSessions(args, out, newSessionsBackend)
+}
+
+// sessionsBackendFunc returns the session storage backend for the given flags.
+type sessionsBackendFunc func(configPath, kubeconfig, namespace string) (crud.Backend, error)
+
+func runSessions(args []string, out io.Writer, newBackend sessionsBackendFunc) error {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "revoke") {
+		_, _ = fmt.Fprint(out, sessionsUsage)
+		return fmt.Errorf("expected a subcommand of list or revoke")
+	}
+	subcommand := args[0]
+
+	flags := pflag.NewFlagSet("sessions "+subcommand, pflag.ContinueOnError)
+	flags.SetOutput(out)
+	var (
+		configPath string
+		kubeconfig string
+		namespace  string
+		filter     sessionadmin.Filter
+	)
+	flags.StringVar(&configPath, "config", "", "Path to the Supervisor's config file, which selects the session storage backend (defaults to the Secrets backend)")
+	flags.StringVar(&kubeconfig, "kubeconfig", "", "Path to the kubeconfig file (defaults to the in-cluster config)")
+	flags.StringVar(&namespace, "namespace", "", "Namespace in which the Supervisor is installed (defaults to the kubeconfig namespace)")
+	flags.StringVar(&filter.RequestID, "request-id", "", "Select the session with this request ID")
+	flags.StringVar(&filter.Subject, "subject", "", "Select sessions with this downstream subject")
+	flags.StringVar(&filter.Username, "username", "", "Select sessions with this downstream username")
+	flags.StringVar(&filter.UpstreamIssuer, "upstream-issuer", "", "Select sessions authenticated by the upstream provider with this issuer")
+	flags.StringVar(&filter.UpstreamName, "upstream-name", "", "Select sessions authenticated by the upstream provider resource with this name")
+	flags.StringVar(&filter.FederationDomainIssuer, "federation-domain-issuer", "", "Select sessions of the FederationDomain with this issuer")
+	flags.Usage = func() {
+		_, _ = fmt.Fprint(out, sessionsUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	backend, err := newBackend(configPath, kubeconfig, namespace)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	admin := sessionadmin.New(backend, time.Now)
+
+	if subcommand == "revoke" {
+		revoked, err := admin.Revoke(ctx, filter)
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(out, "revoked %d session(s)\n", revoked)
+		return nil
+	}
+
+	sessions, err := admin.List(ctx, filter)
+	if err != nil {
+		return err
+	}
+	return printSessions(out, sessions)
+}
+
+// newSessionsBackend returns the session storage backend which is selected by the Supervisor's config file. Without
+// a config file, the sessions are read from the Secrets in the namespace.
+func newSessionsBackend(configPath, kubeconfig, namespace string) (crud.Backend, error) {
+	if configPath != "" {
+		cfg, err := supervisor.FromPath(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not load config: %w", err)
+		}
+		if cfg.StorageConfig.Backend == supervisor.StorageBackendSQL {
+			return openSQLBackend(cfg)
+		}
+	}
+
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeconfig
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		loadingRules,
+		&clientcmd.ConfigOverrides{},
+	)
+	restConfig, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("could not load kubeconfig: %w", err)
+	}
+	if namespace == "" {
+		if namespace, _, err = clientConfig.Namespace(); err != nil {
+			return nil, fmt.Errorf("could not determine namespace: %w", err)
+		}
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create k8s client: %w", err)
+	}
+	return crud.NewSecretsBackend(client.CoreV1().Secrets(namespace)), nil
+}
+
+func printSessions(out io.Writer, sessions []sessionadmin.Session) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "REQUEST ID\tUSERNAME\tSUBJECT\tUPSTREAM\tFEDERATION DOMAIN\tCLIENT\tCREATED\tLAST USED\tEXPIRES")
+	for _, s := range sessions {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			s.RequestID,
+			s.Username,
+			s.Subject,
+			s.UpstreamName,
+			s.FederationDomainIssuer,
+			s.ClientID,
+			formatTime(s.CreatedAt),
+			formatTime(s.LastUsedAt),
+			formatTime(s.ExpiresAt),
+		)
+	}
+	return w.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "<unknown>"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -119,6 +119,7 @@ func runOIDCLogin(cmd *cobra.Command, deps oidcLoginCommandDeps, flags oidcLogin
 		oidcclient.WithContext(cmd.Context()),
 		oidcclient.WithScopes(flags.scopes),
 		oidcclient.WithSessionCache(sessionCache),
+		oidcclient.WithDPoPKeyStore(sessionCache),
 	}
 
 	if flags.listenPort != 0 {
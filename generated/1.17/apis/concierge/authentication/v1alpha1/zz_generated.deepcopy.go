@@ -8,6 +8,7 @@
 package v1alpha1
 
 import (
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -28,6 +29,43 @@ func (in *Condition) DeepCopy() *Condition {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GroupRename) DeepCopyInto(out *GroupRename) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GroupRename.
+func (in *GroupRename) DeepCopy() *GroupRename {
+	if in == nil {
+		return nil
+	}
+	out := new(GroupRename)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IdentityMappingSpec) DeepCopyInto(out *IdentityMappingSpec) {
+	*out = *in
+	if in.GroupRenames != nil {
+		in, out := &in.GroupRenames, &out.GroupRenames
+		*out = make([]GroupRename, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IdentityMappingSpec.
+func (in *IdentityMappingSpec) DeepCopy() *IdentityMappingSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(IdentityMappingSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *JWTAuthenticator) DeepCopyInto(out *JWTAuthenticator) {
 	*out = *in
@@ -98,6 +136,16 @@ func (in *JWTAuthenticatorSpec) DeepCopyInto(out *JWTAuthenticatorSpec) {
 		*out = new(TLSSpec)
 		**out = **in
 	}
+	if in.ClientCertificateTTL != nil {
+		in, out := &in.ClientCertificateTTL, &out.ClientCertificateTTL
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.IdentityMapping != nil {
+		in, out := &in.IdentityMapping, &out.IdentityMapping
+		*out = new(IdentityMappingSpec)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -235,6 +283,16 @@ func (in *WebhookAuthenticatorSpec) DeepCopyInto(out *WebhookAuthenticatorSpec)
 		*out = new(TLSSpec)
 		**out = **in
 	}
+	if in.ClientCertificateTTL != nil {
+		in, out := &in.ClientCertificateTTL, &out.ClientCertificateTTL
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.IdentityMapping != nil {
+		in, out := &in.IdentityMapping, &out.IdentityMapping
+		*out = new(IdentityMappingSpec)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
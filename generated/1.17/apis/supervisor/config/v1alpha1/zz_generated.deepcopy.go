@@ -8,6 +8,7 @@
 package v1alpha1
 
 import (
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -39,6 +40,84 @@ func (in *FederationDomain) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainBrandingSpec) DeepCopyInto(out *FederationDomainBrandingSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainBrandingSpec.
+func (in *FederationDomainBrandingSpec) DeepCopy() *FederationDomainBrandingSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainBrandingSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainClient) DeepCopyInto(out *FederationDomainClient) {
+	*out = *in
+	if in.Groups != nil {
+		in, out := &in.Groups, &out.Groups
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.AllowedScopes != nil {
+		in, out := &in.AllowedScopes, &out.AllowedScopes
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.AllowedAudiences != nil {
+		in, out := &in.AllowedAudiences, &out.AllowedAudiences
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.RedirectURIs != nil {
+		in, out := &in.RedirectURIs, &out.RedirectURIs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainClient.
+func (in *FederationDomainClient) DeepCopy() *FederationDomainClient {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainClient)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainIdentityProvidersSpec) DeepCopyInto(out *FederationDomainIdentityProvidersSpec) {
+	*out = *in
+	if in.Names != nil {
+		in, out := &in.Names, &out.Names
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Selector != nil {
+		in, out := &in.Selector, &out.Selector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainIdentityProvidersSpec.
+func (in *FederationDomainIdentityProvidersSpec) DeepCopy() *FederationDomainIdentityProvidersSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainIdentityProvidersSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *FederationDomainList) DeepCopyInto(out *FederationDomainList) {
 	*out = *in
@@ -72,6 +151,22 @@ func (in *FederationDomainList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainPinnipedCLIClientSpec) DeepCopyInto(out *FederationDomainPinnipedCLIClientSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainPinnipedCLIClientSpec.
+func (in *FederationDomainPinnipedCLIClientSpec) DeepCopy() *FederationDomainPinnipedCLIClientSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainPinnipedCLIClientSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *FederationDomainSecrets) DeepCopyInto(out *FederationDomainSecrets) {
 	*out = *in
@@ -95,11 +190,43 @@ func (in *FederationDomainSecrets) DeepCopy() *FederationDomainSecrets {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *FederationDomainSpec) DeepCopyInto(out *FederationDomainSpec) {
 	*out = *in
+	if in.IssuerAliases != nil {
+		in, out := &in.IssuerAliases, &out.IssuerAliases
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	if in.TLS != nil {
 		in, out := &in.TLS, &out.TLS
 		*out = new(FederationDomainTLSSpec)
 		**out = **in
 	}
+	if in.Branding != nil {
+		in, out := &in.Branding, &out.Branding
+		*out = new(FederationDomainBrandingSpec)
+		**out = **in
+	}
+	if in.TokenExchange != nil {
+		in, out := &in.TokenExchange, &out.TokenExchange
+		*out = new(FederationDomainTokenExchangeSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Clients != nil {
+		in, out := &in.Clients, &out.Clients
+		*out = make([]FederationDomainClient, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.PinnipedCLIClient != nil {
+		in, out := &in.PinnipedCLIClient, &out.PinnipedCLIClient
+		*out = new(FederationDomainPinnipedCLIClientSpec)
+		**out = **in
+	}
+	if in.IdentityProviders != nil {
+		in, out := &in.IdentityProviders, &out.IdentityProviders
+		*out = new(FederationDomainIdentityProvidersSpec)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -149,3 +276,102 @@ func (in *FederationDomainTLSSpec) DeepCopy() *FederationDomainTLSSpec {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainTokenExchangeAudience) DeepCopyInto(out *FederationDomainTokenExchangeAudience) {
+	*out = *in
+	if in.AllowedScopes != nil {
+		in, out := &in.AllowedScopes, &out.AllowedScopes
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainTokenExchangeAudience.
+func (in *FederationDomainTokenExchangeAudience) DeepCopy() *FederationDomainTokenExchangeAudience {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainTokenExchangeAudience)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainTokenExchangeSpec) DeepCopyInto(out *FederationDomainTokenExchangeSpec) {
+	*out = *in
+	if in.Audiences != nil {
+		in, out := &in.Audiences, &out.Audiences
+		*out = make([]FederationDomainTokenExchangeAudience, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.TrustedJWTIssuers != nil {
+		in, out := &in.TrustedJWTIssuers, &out.TrustedJWTIssuers
+		*out = make([]FederationDomainTrustedJWTIssuer, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainTokenExchangeSpec.
+func (in *FederationDomainTokenExchangeSpec) DeepCopy() *FederationDomainTokenExchangeSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainTokenExchangeSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainTrustedJWTIssuer) DeepCopyInto(out *FederationDomainTrustedJWTIssuer) {
+	*out = *in
+	out.Claims = in.Claims
+	if in.UsernamePrefix != nil {
+		in, out := &in.UsernamePrefix, &out.UsernamePrefix
+		*out = new(string)
+		**out = **in
+	}
+	if in.GroupsPrefix != nil {
+		in, out := &in.GroupsPrefix, &out.GroupsPrefix
+		*out = new(string)
+		**out = **in
+	}
+	if in.AllowedSubjects != nil {
+		in, out := &in.AllowedSubjects, &out.AllowedSubjects
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainTrustedJWTIssuer.
+func (in *FederationDomainTrustedJWTIssuer) DeepCopy() *FederationDomainTrustedJWTIssuer {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainTrustedJWTIssuer)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FederationDomainTrustedJWTIssuerClaims) DeepCopyInto(out *FederationDomainTrustedJWTIssuerClaims) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FederationDomainTrustedJWTIssuerClaims.
+func (in *FederationDomainTrustedJWTIssuerClaims) DeepCopy() *FederationDomainTrustedJWTIssuerClaims {
+	if in == nil {
+		return nil
+	}
+	out := new(FederationDomainTrustedJWTIssuerClaims)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -13,6 +13,14 @@ type WebhookAuthenticatorStatus struct {
 	// +listType=map
 	// +listMapKey=type
 	Conditions []Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
+	// UsernamePrefix is the prefix which is currently prepended to the usernames of the users of the authenticator.
+	// +optional
+	UsernamePrefix string `json:"usernamePrefix,omitempty"`
+
+	// GroupsPrefix is the prefix which is currently prepended to the group names of the users of the authenticator.
+	// +optional
+	GroupsPrefix string `json:"groupsPrefix,omitempty"`
 }
 
 // Spec for configuring a webhook authenticator.
@@ -25,6 +33,17 @@ type WebhookAuthenticatorSpec struct {
 	// TLS configuration.
 	// +optional
 	TLS *TLSSpec `json:"tls,omitempty"`
+
+	// ClientCertificateTTL is how long the client certificates which are issued by TokenCredentialRequests for this
+	// authenticator are valid, e.g. "1h". It is capped at the maximum which is configured for the Concierge. When not
+	// specified, it will default to 5 minutes.
+	// +optional
+	ClientCertificateTTL *metav1.Duration `json:"clientCertificateTTL,omitempty"`
+
+	// IdentityMapping changes the usernames and groups of the users of this authenticator before they are put into the
+	// client certificates which are issued by TokenCredentialRequests.
+	// +optional
+	IdentityMapping *IdentityMappingSpec `json:"identityMapping,omitempty"`
 }
 
 // WebhookAuthenticator describes the configuration of a webhook authenticator.
@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package v1alpha1
@@ -8,7 +8,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-// +kubebuilder:validation:Enum=Success;Duplicate;Invalid;SameIssuerHostMustUseSameSecret
+// +kubebuilder:validation:Enum=Success;Duplicate;Invalid;SameIssuerHostMustUseSameSecret;IdentityProvidersNotFound
 type FederationDomainStatusCondition string
 
 const (
@@ -16,6 +16,7 @@ const (
 	DuplicateFederationDomainStatusCondition                       = FederationDomainStatusCondition("Duplicate")
 	SameIssuerHostMustUseSameSecretFederationDomainStatusCondition = FederationDomainStatusCondition("SameIssuerHostMustUseSameSecret")
 	InvalidFederationDomainStatusCondition                         = FederationDomainStatusCondition("Invalid")
+	IdentityProvidersNotFoundFederationDomainStatusCondition       = FederationDomainStatusCondition("IdentityProvidersNotFound")
 )
 
 // FederationDomainTLSSpec is a struct that describes the TLS configuration for an OIDC Provider.
@@ -41,6 +42,187 @@ type FederationDomainTLSSpec struct {
 	SecretName string `json:"secretName,omitempty"`
 }
 
+// FederationDomainBrandingSpec is a struct that describes the branding of the web pages of a FederationDomain.
+type FederationDomainBrandingSpec struct {
+	// ConfigMapName is the name of a ConfigMap in the same namespace which holds the branding of the HTML pages
+	// which are shown in web browsers, for example when a login fails. The ConfigMap may contain the optional keys
+	// `title`, `logoURL`, `primaryColor`, `backgroundColor`, `helpURL` and `helpText`. URLs must use the https
+	// scheme and colors must be hex colors such as `#1a2b3c`. The default branding is used when the ConfigMap
+	// does not exist or is invalid.
+	// +optional
+	ConfigMapName string `json:"configMapName,omitempty"`
+}
+
+// FederationDomainTokenExchangeAudience describes an audience for which tokens may be requested using an RFC 8693
+// token exchange.
+type FederationDomainTokenExchangeAudience struct {
+	// Name is the audience of the issued tokens. A client requests tokens for this audience by sending it as either
+	// the audience parameter or the RFC 8707 resource parameter of the token exchange request.
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+
+	// AllowedScopes are the scopes which may be granted to tokens issued for this audience. The scopes of an issued
+	// token are always a subset of the scopes which were granted to the exchanged token. When the token exchange
+	// request does not name any scopes, then all of the exchanged token's scopes which are allowed here are granted.
+	// +optional
+	AllowedScopes []string `json:"allowedScopes,omitempty"`
+}
+
+// FederationDomainTrustedJWTIssuerClaims provides a mapping from the claims of an externally-issued JWT into
+// identities.
+type FederationDomainTrustedJWTIssuerClaims struct {
+	// Groups provides the name of the token claim that will be used to ascertain the groups to which
+	// an identity belongs.
+	// +optional
+	Groups string `json:"groups"`
+
+	// Username provides the name of the token claim that will be used to ascertain an identity's
+	// username. When it is not set, the username is the same as the subject of the issued ID token.
+	// +optional
+	Username string `json:"username"`
+}
+
+// FederationDomainTrustedJWTIssuer describes an external issuer of JWTs, such as a Kubernetes cluster which issues
+// projected ServiceAccount tokens or a CI system which issues OIDC tokens, whose JWTs may be exchanged for ID tokens
+// using an RFC 8693 token exchange.
+type FederationDomainTrustedJWTIssuer struct {
+	// Issuer is the value of the iss claim of the JWTs which are issued by this issuer.
+	// +kubebuilder:validation:Pattern=`^https://`
+	Issuer string `json:"issuer"`
+
+	// JWKSURL is the URL from which the keys which verify the signatures of the JWTs are fetched.
+	// +kubebuilder:validation:Pattern=`^https://`
+	JWKSURL string `json:"jwksURL"`
+
+	// CertificateAuthorityData is an optional base64 encoded PEM bundle of the certificate authorities which
+	// should be trusted when fetching the keys from the JWKSURL. When it is not set, the system's trusted
+	// certificate authorities are used.
+	// +optional
+	CertificateAuthorityData string `json:"certificateAuthorityData,omitempty"`
+
+	// Audience is the value which the aud claim of the JWTs must contain.
+	// +kubebuilder:validation:MinLength=1
+	Audience string `json:"audience"`
+
+	// Claims provides the names of token claims that will be used when inspecting the JWTs.
+	// +optional
+	Claims FederationDomainTrustedJWTIssuerClaims `json:"claims"`
+
+	// UsernamePrefix is prepended to the usernames which are read from the username claim, so that they cannot
+	// collide with the usernames of other issuers or of upstream identity providers. When it is not set, the prefix
+	// is the issuer followed by `#`. Set it to the empty string to use the usernames unchanged.
+	// +optional
+	UsernamePrefix *string `json:"usernamePrefix,omitempty"`
+
+	// GroupsPrefix is prepended to the groups which are read from the groups claim, so that they cannot collide
+	// with the groups of other issuers or of upstream identity providers. When it is not set, the prefix is the
+	// issuer followed by `#`. Set it to the empty string to use the groups unchanged.
+	// +optional
+	GroupsPrefix *string `json:"groupsPrefix,omitempty"`
+
+	// AllowedSubjects lists the values of the sub claim of the JWTs which may be exchanged. An entry which ends
+	// with `*` allows any subject which starts with the rest of the entry, for example
+	// `system:serviceaccount:ci:*`.
+	// +kubebuilder:validation:MinItems=1
+	AllowedSubjects []string `json:"allowedSubjects"`
+}
+
+// FederationDomainTokenExchangeSpec is a struct that describes how a FederationDomain handles token exchanges.
+type FederationDomainTokenExchangeSpec struct {
+	// Audiences lists the audiences for which access tokens and downscoped ID tokens may be requested. ID tokens
+	// without any requested scopes may still be requested for any audience. An access token which was issued for
+	// one of these audiences may only be exchanged for tokens for the same audience.
+	// +optional
+	Audiences []FederationDomainTokenExchangeAudience `json:"audiences,omitempty"`
+
+	// TrustedJWTIssuers lists the external issuers whose JWTs may be exchanged for ID tokens. The ID token
+	// of such an exchange has a subject of the form `<issuer>?sub=<subject>`, like the ID tokens of users who
+	// log in with an upstream identity provider.
+	// +optional
+	TrustedJWTIssuers []FederationDomainTrustedJWTIssuer `json:"trustedJWTIssuers,omitempty"`
+}
+
+// FederationDomainClient describes a confidential client which may use the OAuth 2.0 client credentials grant to
+// get access tokens which represent a fixed service identity, for example for automation which has no human user.
+// A client which has redirect URIs may also log in users using the authorization code grant.
+type FederationDomainClient struct {
+	// ID is the client_id of the client. The ID `pinniped-cli` is reserved for the Pinniped CLI.
+	// +kubebuilder:validation:MinLength=1
+	ID string `json:"id"`
+
+	// SecretHash is the bcrypt hash of the client secret, for example as generated by
+	// `htpasswd -nbBC 12 "" "$CLIENT_SECRET" | tr -d ':\n'`. The client authenticates to the token endpoint
+	// using HTTP basic authentication with its ID and secret.
+	// +kubebuilder:validation:MinLength=1
+	SecretHash string `json:"secretHash"`
+
+	// Username is the username of the service identity which is represented by the tokens of this client.
+	// +kubebuilder:validation:MinLength=1
+	Username string `json:"username"`
+
+	// Groups are the groups of the service identity which is represented by the tokens of this client.
+	// +optional
+	Groups []string `json:"groups,omitempty"`
+
+	// AllowedScopes are the scopes which this client may request. Include `openid` and
+	// `pinniped:request-audience` to allow the client to exchange its access tokens for cluster-scoped ID tokens.
+	// +optional
+	AllowedScopes []string `json:"allowedScopes,omitempty"`
+
+	// AllowedAudiences are the audiences which this client may request using the audience parameter.
+	// +optional
+	AllowedAudiences []string `json:"allowedAudiences,omitempty"`
+
+	// RequireDPoP requires this client to send a DPoP proof (https://datatracker.ietf.org/doc/html/rfc9449) with
+	// each of its requests to the token endpoint, so that its tokens are always bound to its DPoP key.
+	// +optional
+	RequireDPoP bool `json:"requireDPoP,omitempty"`
+
+	// RedirectURIs are the URIs to which users are sent back with an authorization code after they log in. When
+	// it is set, this client may also use the authorization code grant, with PKCE, and the refresh token grant.
+	// +optional
+	RedirectURIs []string `json:"redirectURIs,omitempty"`
+
+	// SubjectType is the type of the subject identifiers in the ID tokens which are issued to this client for the
+	// users who log in, as described in https://openid.net/specs/openid-connect-core-1_0.html#SubjectIDTypes.
+	// A "public" subject has the form `<upstream issuer>?sub=<upstream subject>` and is the same for all clients.
+	// A "pairwise" subject is derived from the public subject and the sector identifier of this client, so that
+	// clients with different sector identifiers cannot correlate their users. The ID tokens which are issued to
+	// other audiences using a token exchange, e.g. for Kubernetes clusters, always have public subjects, so a client
+	// with pairwise subjects may not use the token exchange and is never granted the "pinniped:request-audience"
+	// scope. Defaults to "public".
+	// +kubebuilder:validation:Enum=public;pairwise
+	// +optional
+	SubjectType string `json:"subjectType,omitempty"`
+
+	// SectorIdentifier groups the clients which see the same pairwise subjects for each user. It may only be set
+	// when SubjectType is "pairwise". Defaults to the ID of this client.
+	// +optional
+	SectorIdentifier string `json:"sectorIdentifier,omitempty"`
+}
+
+// FederationDomainPinnipedCLIClientSpec configures the built-in `pinniped-cli` client which is used by the Pinniped CLI.
+type FederationDomainPinnipedCLIClientSpec struct {
+	// RequireDPoP requires the Pinniped CLI to send a DPoP proof (https://datatracker.ietf.org/doc/html/rfc9449) with
+	// each of its requests to the token endpoint, so that its tokens are always bound to a key which is kept along
+	// with the tokens in the CLI's session cache. When it is false, the CLI still uses DPoP when the FederationDomain
+	// advertises it, but older CLIs which do not support DPoP may still log in.
+	// +optional
+	RequireDPoP bool `json:"requireDPoP,omitempty"`
+}
+
+// FederationDomainIdentityProvidersSpec selects the upstream identity providers which may be used to log in to a
+// FederationDomain. An upstream identity provider is selected when it is listed in Names or when it matches the Selector.
+type FederationDomainIdentityProvidersSpec struct {
+	// Names lists the names of the OIDCIdentityProviders which may be used.
+	// +optional
+	Names []string `json:"names,omitempty"`
+
+	// Selector selects the OIDCIdentityProviders which may be used by their labels.
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
 // FederationDomainSpec is a struct that describes an OIDC Provider.
 type FederationDomainSpec struct {
 	// Issuer is the OIDC Provider's issuer, per the OIDC Discovery Metadata document, as well as the
@@ -54,9 +236,39 @@ type FederationDomainSpec struct {
 	// +kubebuilder:validation:MinLength=1
 	Issuer string `json:"issuer"`
 
+	// IssuerAliases are additional issuers which serve this FederationDomain, e.g. on other hostnames while
+	// clients are migrated from one hostname to another. Each alias has its own discovery document and endpoints,
+	// and is used as the iss claim of the tokens which are issued by its endpoints, but all of the aliases share the
+	// signing keys, the sessions and the upstream configuration of this FederationDomain. When TLS.SecretName is set,
+	// then its certificate must also be valid for the hostnames of the aliases.
+	// +optional
+	IssuerAliases []string `json:"issuerAliases,omitempty"`
+
 	// TLS configures how this FederationDomain is served over Transport Layer Security (TLS).
 	// +optional
 	TLS *FederationDomainTLSSpec `json:"tls,omitempty"`
+
+	// Branding configures the look of the HTML pages which this FederationDomain shows in web browsers.
+	// +optional
+	Branding *FederationDomainBrandingSpec `json:"branding,omitempty"`
+
+	// TokenExchange configures which tokens may be requested using an RFC 8693 token exchange.
+	// +optional
+	TokenExchange *FederationDomainTokenExchangeSpec `json:"tokenExchange,omitempty"`
+
+	// Clients lists the confidential clients which may use the OAuth 2.0 client credentials grant, and which may
+	// also log in users when they have redirect URIs.
+	// +optional
+	Clients []FederationDomainClient `json:"clients,omitempty"`
+
+	// PinnipedCLIClient configures the built-in client which is used by the Pinniped CLI.
+	// +optional
+	PinnipedCLIClient *FederationDomainPinnipedCLIClientSpec `json:"pinnipedCLIClient,omitempty"`
+
+	// IdentityProviders selects the upstream identity providers which may be used to log in to this FederationDomain.
+	// When it is not set, then all of the upstream identity providers may be used.
+	// +optional
+	IdentityProviders *FederationDomainIdentityProvidersSpec `json:"identityProviders,omitempty"`
 }
 
 // FederationDomainSecrets holds information about this OIDC Provider's secrets.
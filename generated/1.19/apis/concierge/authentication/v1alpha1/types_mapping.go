@@ -0,0 +1,39 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package v1alpha1
+
+// IdentityMappingSpec configures how the identities which are authenticated by an authenticator are changed before
+// they are put into the client certificates which are issued by TokenCredentialRequests. Groups are first filtered by
+// their original names, then renamed, and then prefixed.
+type IdentityMappingSpec struct {
+	// UsernamePrefix is prepended to the username of every user of the authenticator, e.g. "my-idp:". It can be used
+	// to keep the usernames of different authenticators from overlapping.
+	// +optional
+	UsernamePrefix string `json:"usernamePrefix,omitempty"`
+
+	// GroupsPrefix is prepended to the name of every group of every user of the authenticator, e.g. "my-idp:". It can
+	// be used to keep the group names of different authenticators from overlapping.
+	// +optional
+	GroupsPrefix string `json:"groupsPrefix,omitempty"`
+
+	// GroupFilter is a regular expression, in RE2 syntax, which the original name of a group must match for the group
+	// to be kept, e.g. "^k8s-". When not specified, all groups are kept.
+	// +optional
+	GroupFilter string `json:"groupFilter,omitempty"`
+
+	// GroupRenames renames the groups which are kept by GroupFilter. The GroupsPrefix is prepended to the new name.
+	// +optional
+	GroupRenames []GroupRename `json:"groupRenames,omitempty"`
+}
+
+// GroupRename renames a group.
+type GroupRename struct {
+	// From is the original name of the group.
+	// +kubebuilder:validation:MinLength=1
+	From string `json:"from"`
+
+	// To is the new name of the group.
+	// +kubebuilder:validation:MinLength=1
+	To string `json:"to"`
+}
@@ -5,23 +5,28 @@ package v1alpha1
 
 import metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
-// +kubebuilder:validation:Enum=KubeClusterSigningCertificate
+// +kubebuilder:validation:Enum=KubeClusterSigningCertificate;ImpersonationProxy
 type StrategyType string
 
 // +kubebuilder:validation:Enum=Success;Error
 type StrategyStatus string
 
-// +kubebuilder:validation:Enum=FetchedKey;CouldNotFetchKey
+// +kubebuilder:validation:Enum=FetchedKey;CouldNotFetchKey;Listening;Pending;Disabled;ErrorDuringSetup
 type StrategyReason string
 
 const (
 	KubeClusterSigningCertificateStrategyType = StrategyType("KubeClusterSigningCertificate")
+	ImpersonationProxyStrategyType            = StrategyType("ImpersonationProxy")
 
 	SuccessStrategyStatus = StrategyStatus("Success")
 	ErrorStrategyStatus   = StrategyStatus("Error")
 
 	CouldNotFetchKeyStrategyReason = StrategyReason("CouldNotFetchKey")
 	FetchedKeyStrategyReason       = StrategyReason("FetchedKey")
+	ListeningStrategyReason        = StrategyReason("Listening")
+	PendingStrategyReason          = StrategyReason("Pending")
+	DisabledStrategyReason         = StrategyReason("Disabled")
+	ErrorDuringSetupStrategyReason = StrategyReason("ErrorDuringSetup")
 )
 
 // Status of a credential issuer.
@@ -46,6 +51,18 @@ type CredentialIssuerKubeConfigInfo struct {
 	CertificateAuthorityData string `json:"certificateAuthorityData"`
 }
 
+// Information needed to connect to the impersonation proxy of the Concierge.
+type ImpersonationProxyInfo struct {
+	// The HTTPS endpoint of the impersonation proxy.
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:Pattern=`^https://`
+	Endpoint string `json:"endpoint"`
+
+	// The base64-encoded PEM CA bundle of the serving certificate of the impersonation proxy.
+	// +kubebuilder:validation:MinLength=1
+	CertificateAuthorityData string `json:"certificateAuthorityData"`
+}
+
 // Status of an integration strategy that was attempted by Pinniped.
 type CredentialIssuerStrategy struct {
 	// Type of integration attempted.
@@ -63,6 +80,11 @@ type CredentialIssuerStrategy struct {
 
 	// When the status was last checked.
 	LastUpdateTime metav1.Time `json:"lastUpdateTime"`
+
+	// Information needed to connect to the impersonation proxy, only set on a successful strategy of type
+	// ImpersonationProxy.
+	// +optional
+	ImpersonationProxyInfo *ImpersonationProxyInfo `json:"impersonationProxyInfo,omitempty"`
 }
 
 // Describes the configuration status of a Pinniped credential issuer.
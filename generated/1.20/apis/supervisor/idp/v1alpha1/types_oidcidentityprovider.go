@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package v1alpha1
@@ -33,6 +33,23 @@ type OIDCIdentityProviderStatus struct {
 	// +listType=map
 	// +listMapKey=type
 	Conditions []Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
+	// Probes record when each of the probed endpoints of the identity provider was last found to be healthy.
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Probes []OIDCProbe `json:"probes,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+// OIDCProbe records the last successful health probe of an endpoint of an OIDC identity provider.
+type OIDCProbe struct {
+	// Type of the condition which reports the health of the probed endpoint, e.g. JWKSReachable.
+	Type string `json:"type"`
+
+	// LastSuccessTime is the last time at which the endpoint was probed successfully.
+	LastSuccessTime metav1.Time `json:"lastSuccessTime"`
 }
 
 // OIDCAuthorizationConfig provides information about how to form the OAuth2 authorization
@@ -42,6 +59,19 @@ type OIDCAuthorizationConfig struct {
 	// request flow with an OIDC identity provider. By default only the "openid" scope will be requested.
 	// +optional
 	AdditionalScopes []string `json:"additionalScopes,omitempty"`
+
+	// RequiredACRValues are the authentication context class references, such as a value which stands for
+	// multi-factor authentication, which the user must have authenticated with. They are requested from the OIDC
+	// identity provider using the acr_values parameter, in order of preference, and the acr claim of the ID token
+	// must be one of them. The acr claim is copied into the downstream ID token.
+	// +optional
+	RequiredACRValues []string `json:"requiredACRValues,omitempty"`
+
+	// RequiredAMRValues are the authentication methods, such as `mfa` or `hwk`, which the user must have used.
+	// The amr claim of the ID token from the OIDC identity provider must contain all of them. The amr claim is
+	// copied into the downstream ID token.
+	// +optional
+	RequiredAMRValues []string `json:"requiredAMRValues,omitempty"`
 }
 
 // OIDCClaims provides a mapping from upstream claims into identities.
@@ -55,6 +85,24 @@ type OIDCClaims struct {
 	// username.
 	// +optional
 	Username string `json:"username"`
+
+	// AdditionalClaims lists the claims of the upstream ID token, or of the upstream userinfo response, which are
+	// copied into the downstream ID token. A claim which is missing upstream is omitted from the downstream ID
+	// token. The claims which are set by the Supervisor itself, such as "sub", "iss", "aud", "exp", "username" and
+	// "groups", cannot be overwritten and are ignored here.
+	// +optional
+	AdditionalClaims []OIDCAdditionalClaim `json:"additionalClaims,omitempty"`
+}
+
+// OIDCAdditionalClaim describes an upstream claim which is copied into the downstream ID token.
+type OIDCAdditionalClaim struct {
+	// Upstream is the name of the claim in the upstream ID token or userinfo response.
+	// +kubebuilder:validation:MinLength=1
+	Upstream string `json:"upstream"`
+
+	// Downstream is the name of the claim in the downstream ID token. Defaults to the name of the upstream claim.
+	// +optional
+	Downstream string `json:"downstream,omitempty"`
 }
 
 // OIDCClient contains information about an OIDC client (e.g., client ID and client
@@ -67,6 +115,43 @@ type OIDCClient struct {
 	SecretName string `json:"secretName"`
 }
 
+// OIDCHealthCheck configures how often the health of an OIDC identity provider is checked.
+type OIDCHealthCheck struct {
+	// IntervalSeconds is how often, in seconds, OIDC discovery is performed again and the JWKS and token
+	// endpoints of the OIDC identity provider are probed. Defaults to 900 (15 minutes).
+	// +kubebuilder:validation:Minimum=10
+	// +optional
+	IntervalSeconds *int64 `json:"intervalSeconds,omitempty"`
+}
+
+// OIDCEgress configures how requests are sent to an OIDC identity provider.
+type OIDCEgress struct {
+	// ProxyURL is the URL of an HTTP proxy, e.g. http://proxy.example.com:3128, through which requests to the OIDC
+	// identity provider are sent. Requests to https URLs are tunneled through the proxy using CONNECT. By default,
+	// no proxy is used.
+	// +kubebuilder:validation:Pattern=`^https?://`
+	// +optional
+	ProxyURL string `json:"proxyURL,omitempty"`
+
+	// NoProxy lists the hosts which are reached directly rather than through the proxy, in the same format as the
+	// entries of the NO_PROXY environment variable: host names (which also match their subdomains), domain names
+	// with a leading "." (which only match subdomains), IP addresses, and CIDR ranges, each with an optional port.
+	// +optional
+	NoProxy []string `json:"noProxy,omitempty"`
+
+	// TimeoutSeconds limits the time, in seconds, taken by each request to the OIDC identity provider, including
+	// connecting, any redirects, and reading the response body. By default, requests are not limited.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	TimeoutSeconds *int64 `json:"timeoutSeconds,omitempty"`
+
+	// ClientCertificateSecretName is the name of a namespace-local Secret of type "kubernetes.io/tls" whose
+	// "tls.crt" and "tls.key" keys hold the client certificate and private key that are presented to the OIDC
+	// identity provider when it requests mutual TLS authentication.
+	// +optional
+	ClientCertificateSecretName string `json:"clientCertificateSecretName,omitempty"`
+}
+
 // Spec for configuring an OIDC identity provider.
 type OIDCIdentityProviderSpec struct {
 	// Issuer is the issuer URL of this OIDC identity provider, i.e., where to fetch
@@ -75,7 +160,7 @@ type OIDCIdentityProviderSpec struct {
 	// +kubebuilder:validation:Pattern=`^https://`
 	Issuer string `json:"issuer"`
 
-	// TLS configuration for discovery/JWKS requests to the issuer.
+	// TLS configuration for requests to the issuer.
 	// +optional
 	TLS *TLSSpec `json:"tls,omitempty"`
 
@@ -92,6 +177,16 @@ type OIDCIdentityProviderSpec struct {
 	// OIDCClient contains OIDC client information to be used used with this OIDC identity
 	// provider.
 	Client OIDCClient `json:"client"`
+
+	// HealthCheck configures how often the health of this OIDC identity provider is checked. The results are
+	// reported by the JWKSReachable and TokenEndpointReachable conditions.
+	// +optional
+	HealthCheck OIDCHealthCheck `json:"healthCheck,omitempty"`
+
+	// Egress configures how requests are sent to this OIDC identity provider. These settings are used for all
+	// requests to it, including OIDC discovery, fetching the JWKS, token exchanges and userinfo requests.
+	// +optional
+	Egress OIDCEgress `json:"egress,omitempty"`
 }
 
 // OIDCIdentityProvider describes the configuration of an upstream OpenID Connect identity provider.
@@ -28,6 +28,22 @@ func (in *Condition) DeepCopy() *Condition {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OIDCAdditionalClaim) DeepCopyInto(out *OIDCAdditionalClaim) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OIDCAdditionalClaim.
+func (in *OIDCAdditionalClaim) DeepCopy() *OIDCAdditionalClaim {
+	if in == nil {
+		return nil
+	}
+	out := new(OIDCAdditionalClaim)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *OIDCAuthorizationConfig) DeepCopyInto(out *OIDCAuthorizationConfig) {
 	*out = *in
@@ -36,6 +52,16 @@ func (in *OIDCAuthorizationConfig) DeepCopyInto(out *OIDCAuthorizationConfig) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.RequiredACRValues != nil {
+		in, out := &in.RequiredACRValues, &out.RequiredACRValues
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.RequiredAMRValues != nil {
+		in, out := &in.RequiredAMRValues, &out.RequiredAMRValues
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	return
 }
 
@@ -52,6 +78,11 @@ func (in *OIDCAuthorizationConfig) DeepCopy() *OIDCAuthorizationConfig {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *OIDCClaims) DeepCopyInto(out *OIDCClaims) {
 	*out = *in
+	if in.AdditionalClaims != nil {
+		in, out := &in.AdditionalClaims, &out.AdditionalClaims
+		*out = make([]OIDCAdditionalClaim, len(*in))
+		copy(*out, *in)
+	}
 	return
 }
 
@@ -81,6 +112,53 @@ func (in *OIDCClient) DeepCopy() *OIDCClient {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OIDCEgress) DeepCopyInto(out *OIDCEgress) {
+	*out = *in
+	if in.NoProxy != nil {
+		in, out := &in.NoProxy, &out.NoProxy
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.TimeoutSeconds != nil {
+		in, out := &in.TimeoutSeconds, &out.TimeoutSeconds
+		*out = new(int64)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OIDCEgress.
+func (in *OIDCEgress) DeepCopy() *OIDCEgress {
+	if in == nil {
+		return nil
+	}
+	out := new(OIDCEgress)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OIDCHealthCheck) DeepCopyInto(out *OIDCHealthCheck) {
+	*out = *in
+	if in.IntervalSeconds != nil {
+		in, out := &in.IntervalSeconds, &out.IntervalSeconds
+		*out = new(int64)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OIDCHealthCheck.
+func (in *OIDCHealthCheck) DeepCopy() *OIDCHealthCheck {
+	if in == nil {
+		return nil
+	}
+	out := new(OIDCHealthCheck)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *OIDCIdentityProvider) DeepCopyInto(out *OIDCIdentityProvider) {
 	*out = *in
@@ -151,8 +229,10 @@ func (in *OIDCIdentityProviderSpec) DeepCopyInto(out *OIDCIdentityProviderSpec)
 		**out = **in
 	}
 	in.AuthorizationConfig.DeepCopyInto(&out.AuthorizationConfig)
-	out.Claims = in.Claims
+	in.Claims.DeepCopyInto(&out.Claims)
 	out.Client = in.Client
+	in.HealthCheck.DeepCopyInto(&out.HealthCheck)
+	in.Egress.DeepCopyInto(&out.Egress)
 	return
 }
 
@@ -176,6 +256,13 @@ func (in *OIDCIdentityProviderStatus) DeepCopyInto(out *OIDCIdentityProviderStat
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.Probes != nil {
+		in, out := &in.Probes, &out.Probes
+		*out = make([]OIDCProbe, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
@@ -189,6 +276,23 @@ func (in *OIDCIdentityProviderStatus) DeepCopy() *OIDCIdentityProviderStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OIDCProbe) DeepCopyInto(out *OIDCProbe) {
+	*out = *in
+	in.LastSuccessTime.DeepCopyInto(&out.LastSuccessTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OIDCProbe.
+func (in *OIDCProbe) DeepCopy() *OIDCProbe {
+	if in == nil {
+		return nil
+	}
+	out := new(OIDCProbe)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TLSSpec) DeepCopyInto(out *TLSSpec) {
 	*out = *in
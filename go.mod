@@ -15,6 +15,8 @@ require (
 	github.com/google/gofuzz v1.2.0
 	github.com/gorilla/securecookie v1.1.1
 	github.com/kr/text v0.2.0 // indirect
+	github.com/lib/pq v1.9.0
+	github.com/mattn/go-sqlite3 v2.0.3+incompatible
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
 	github.com/oleiade/reflections v1.0.1 // indirect
 	github.com/onsi/ginkgo v1.13.0 // indirect
@@ -29,9 +31,11 @@ require (
 	go.pinniped.dev/generated/1.20/apis v0.0.0-00010101000000-000000000000
 	go.pinniped.dev/generated/1.20/client v0.0.0-00010101000000-000000000000
 	golang.org/x/crypto v0.0.0-20201217014255-9d1352758620
+	golang.org/x/net v0.0.0-20201110031124-69a78807bb2b
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 	golang.org/x/sync v0.0.0-20201207232520-09787c993a3a
 	golang.org/x/tools v0.0.0-20200825202427-b303f430e36d // indirect
+	google.golang.org/grpc v1.29.1
 	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
 	gopkg.in/square/go-jose.v2 v2.5.1
 	gopkg.in/yaml.v2 v2.4.0 // indirect
@@ -49,6 +53,8 @@ require (
 )
 
 replace (
+	// v2.0.3+incompatible was retracted upstream, but it is still required by some of the indirect dependencies.
+	github.com/mattn/go-sqlite3 => github.com/mattn/go-sqlite3 v1.14.6
 	go.pinniped.dev/generated/1.20/apis => ./generated/1.20/apis
 	go.pinniped.dev/generated/1.20/client => ./generated/1.20/client
 )
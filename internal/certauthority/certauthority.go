@@ -84,6 +84,51 @@ func Load(certPEM string, keyPEM string) (*CA, error) {
 	}, nil
 }
 
+// LoadWithSigner loads a certificate authority from an existing certificate (in PEM format) and the signer which
+// holds its private key, for example in an external key management service.
+func LoadWithSigner(certPEM string, signer crypto.Signer) (*CA, error) {
+	var certs [][]byte
+	rest := []byte(certPEM)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			certs = append(certs, block.Bytes)
+		}
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("could not load CA: failed to find any PEM certificate")
+	}
+	if certCount := len(certs); certCount != 1 {
+		return nil, fmt.Errorf("%w: expected a single certificate, found %d certificates", ErrInvalidCACertificate, certCount)
+	}
+
+	cert, err := x509.ParseCertificate(certs[0])
+	if err != nil {
+		return nil, fmt.Errorf("could not load CA: %w", err)
+	}
+	certPublicKey, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not load CA: %w", err)
+	}
+	signerPublicKey, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, fmt.Errorf("could not load CA: %w", err)
+	}
+	if !bytes.Equal(certPublicKey, signerPublicKey) {
+		return nil, fmt.Errorf("could not load CA: signer does not match public key")
+	}
+
+	return &CA{
+		caCertBytes: certs[0],
+		signer:      signer,
+		env:         secureEnv(),
+	}, nil
+}
+
 // New generates a fresh certificate authority with the given subject and ttl.
 func New(subject pkix.Name, ttl time.Duration) (*CA, error) {
 	return newInternal(subject, ttl, secureEnv())
@@ -136,6 +181,16 @@ func (c *CA) Bundle() []byte {
 	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.caCertBytes})
 }
 
+// PrivateKeyToPEM returns the private key of the current CA in PEM format. It fails for a CA whose private key is
+// held outside of the process, see LoadWithSigner.
+func (c *CA) PrivateKeyToPEM() ([]byte, error) {
+	privateKeyPKCS8, err := x509.MarshalPKCS8PrivateKey(c.signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal private key into PKCS8: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyPKCS8}), nil
+}
+
 // Pool returns the current CA signing bundle as a *x509.CertPool.
 func (c *CA) Pool() *x509.CertPool {
 	pool := x509.NewCertPool()
@@ -4,6 +4,7 @@
 package certauthority
 
 import (
+	"context"
 	"crypto"
 	"crypto/tls"
 	"crypto/x509"
@@ -17,6 +18,10 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/signer"
+	"go.pinniped.dev/internal/signer/plugin"
+	"go.pinniped.dev/internal/testutil/fakekms"
 )
 
 func loadFromFiles(t *testing.T, certPath string, keyPath string) (*CA, error) {
@@ -84,6 +89,69 @@ func TestLoad(t *testing.T) {
 	}
 }
 
+func TestLoadWithSigner(t *testing.T) {
+	certPEM, err := ioutil.ReadFile("./testdata/test.crt")
+	require.NoError(t, err)
+	multipleCertsPEM, err := ioutil.ReadFile("./testdata/multiple.crt")
+	require.NoError(t, err)
+	key, err := signer.FromFile("./testdata/test.key")
+	require.NoError(t, err)
+	otherKey, err := signer.FromFile("./testdata/test2.key")
+	require.NoError(t, err)
+
+	// The key is held by a signing plugin, like the ones of external key management services.
+	socket := fakekms.New(map[string]crypto.Signer{"ca-key": key}).Start(t)
+	pluginSigner, err := plugin.NewSigner(context.Background(), socket, "ca-key")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		certPEM []byte
+		signer  crypto.Signer
+		wantErr string
+	}{
+		{
+			name:    "no certificate",
+			certPEM: []byte("some data"),
+			signer:  pluginSigner,
+			wantErr: "could not load CA: failed to find any PEM certificate",
+		},
+		{
+			name:    "multiple certs",
+			certPEM: multipleCertsPEM,
+			signer:  pluginSigner,
+			wantErr: "invalid CA certificate: expected a single certificate, found 2 certificates",
+		},
+		{
+			name:    "mismatched cert and signer",
+			certPEM: certPEM,
+			signer:  otherKey,
+			wantErr: "could not load CA: signer does not match public key",
+		},
+		{
+			name:    "success",
+			certPEM: certPEM,
+			signer:  pluginSigner,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ca, err := LoadWithSigner(string(tt.certPEM), tt.signer)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			cert, err := ca.Issue(pkix.Name{CommonName: "some-user"}, nil, nil, time.Hour)
+			require.NoError(t, err)
+			_, err = cert.Leaf.Verify(x509.VerifyOptions{Roots: ca.Pool(), KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+			require.NoError(t, err)
+		})
+	}
+}
+
 func TestNew(t *testing.T) {
 	now := time.Now()
 	got, err := New(pkix.Name{CommonName: "Test CA"}, time.Minute)
@@ -182,6 +250,26 @@ func TestBundle(t *testing.T) {
 	})
 }
 
+func TestPrivateKeyToPEM(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		ca, err := New(pkix.Name{CommonName: "test"}, 1*time.Hour)
+		require.NoError(t, err)
+
+		keyPEM, err := ca.PrivateKeyToPEM()
+		require.NoError(t, err)
+
+		reloaded, err := Load(string(ca.Bundle()), string(keyPEM))
+		require.NoError(t, err)
+		require.Equal(t, ca.Bundle(), reloaded.Bundle())
+	})
+
+	t.Run("private key held outside of the process", func(t *testing.T) {
+		ca := CA{signer: &errSigner{}}
+		_, err := ca.PrivateKeyToPEM()
+		require.EqualError(t, err, "failed to marshal private key into PKCS8: x509: unknown key type while marshaling PKCS#8: *certauthority.errSigner")
+	})
+}
+
 func TestPool(t *testing.T) {
 	t.Run("success", func(t *testing.T) {
 		ca, err := New(pkix.Name{CommonName: "test"}, 1*time.Hour)
@@ -0,0 +1,204 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package impersonator implements the impersonation proxy of the Concierge, an authenticating reverse proxy to the
+// Kubernetes API server which forwards the requests of its users using Kubernetes impersonation headers.
+package impersonator
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/request/bearertoken"
+	"k8s.io/apiserver/pkg/authentication/request/union"
+	x509request "k8s.io/apiserver/pkg/authentication/request/x509"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/rest"
+
+	loginapi "go.pinniped.dev/generated/1.20/apis/concierge/login"
+	loginv1alpha1 "go.pinniped.dev/generated/1.20/apis/concierge/login/v1alpha1"
+	"go.pinniped.dev/internal/dynamiccert"
+	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/registry/credentialrequest"
+)
+
+const (
+	// impersonateHeaderPrefix is the prefix of all Kubernetes impersonation headers.
+	impersonateHeaderPrefix = "Impersonate-"
+
+	impersonateUserHeader      = "Impersonate-User"
+	impersonateGroupHeader     = "Impersonate-Group"
+	impersonateUserExtraHeader = "Impersonate-Extra-"
+)
+
+type proxy struct {
+	authenticator authenticator.Request
+	reverseProxy  *httputil.ReverseProxy
+}
+
+// New returns the http.Handler of the impersonation proxy.
+//
+// The proxy authenticates client certificates which were issued by the CA of clientCertCA, and bearer tokens which
+// are base64-encoded JSON TokenCredentialRequests, which are validated by tokenCredentialRequestAuthenticator. A
+// TokenCredentialRequest without a namespace refers to an authenticator in the given namespace. The proxy forwards
+// the requests of the authenticated users to the Kubernetes API server of restConfig, whose identity must be allowed
+// to impersonate users, groups and user extras.
+func New(
+	tokenCredentialRequestAuthenticator credentialrequest.TokenCredentialRequestAuthenticator,
+	clientCertCA dynamiccert.Provider,
+	namespace string,
+	restConfig *rest.Config,
+) (http.Handler, error) {
+	serverURL, err := url.Parse(restConfig.Host)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse host URL from in-cluster config: %w", err)
+	}
+	if serverURL.Scheme == "" || serverURL.Host == "" {
+		return nil, fmt.Errorf("host of in-cluster config is not a URL: %q", restConfig.Host)
+	}
+
+	transport, err := rest.TransportFor(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("could not get in-cluster transport: %w", err)
+	}
+
+	reverseProxy := httputil.NewSingleHostReverseProxy(serverURL)
+	reverseProxy.Transport = transport
+	// Flush immediately, so that watches and logs are streamed to the client.
+	reverseProxy.FlushInterval = -1
+	reverseProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		plog.WarningErr("could not proxy request to the Kubernetes API server", err, "url", r.URL.String(), "method", r.Method)
+		writeStatus(w, apierrors.NewServiceUnavailable("could not reach the Kubernetes API server"))
+	}
+	director := reverseProxy.Director
+	reverseProxy.Director = func(r *http.Request) {
+		director(r)
+		// Send the host of the Kubernetes API server instead of the host of the impersonation proxy.
+		r.Host = ""
+	}
+
+	return &proxy{
+		authenticator: union.New(
+			x509request.NewDynamic(clientCertVerifyOptions(clientCertCA), x509request.CommonNameUserConversion),
+			bearertoken.New(&tokenCredentialRequestTokenAuthenticator{
+				delegate:  tokenCredentialRequestAuthenticator,
+				namespace: namespace,
+			}),
+		),
+		reverseProxy: reverseProxy,
+	}, nil
+}
+
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for header := range r.Header {
+		if strings.HasPrefix(header, impersonateHeaderPrefix) {
+			plog.Debug("rejecting request with impersonation headers", "url", r.URL.String(), "method", r.Method)
+			writeStatus(w, apierrors.NewBadRequest("impersonation headers are not allowed in requests to the impersonation proxy"))
+			return
+		}
+	}
+
+	// The authenticators may change the headers of the request, so change a copy of it.
+	r = r.Clone(r.Context())
+
+	response, authenticated, err := p.authenticator.AuthenticateRequest(r)
+	if err != nil || !authenticated {
+		plog.DebugErr("could not authenticate request", err, "url", r.URL.String(), "method", r.Method)
+		writeStatus(w, apierrors.NewUnauthorized("Unauthorized"))
+		return
+	}
+
+	// The credentials of the user are only meant for the impersonation proxy. The Kubernetes API server gets the
+	// credentials of the Concierge instead, along with the identity of the user to impersonate.
+	r.Header.Del("Authorization")
+	setImpersonationHeaders(r.Header, response.User)
+
+	plog.Trace("proxying request", "url", r.URL.String(), "method", r.Method, "user", response.User.GetName())
+	p.reverseProxy.ServeHTTP(w, r)
+}
+
+func setImpersonationHeaders(header http.Header, userInfo user.Info) {
+	header.Set(impersonateUserHeader, userInfo.GetName())
+	for _, group := range userInfo.GetGroups() {
+		header.Add(impersonateGroupHeader, group)
+	}
+	for key, values := range userInfo.GetExtra() {
+		for _, value := range values {
+			header.Add(impersonateUserExtraHeader+url.PathEscape(key), value)
+		}
+	}
+}
+
+// clientCertVerifyOptions returns the options to verify the client certificates issued by the current CA of the
+// provider. There are no options while the provider does not have a CA, so that client certificates are ignored.
+func clientCertVerifyOptions(clientCertCA dynamiccert.Provider) x509request.VerifyOptionFunc {
+	return func() (x509.VerifyOptions, bool) {
+		caPEM, _ := clientCertCA.CurrentCertKeyContent()
+		if len(caPEM) == 0 {
+			return x509.VerifyOptions{}, false
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caPEM) {
+			return x509.VerifyOptions{}, false
+		}
+		return x509.VerifyOptions{
+			Roots:     roots,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, true
+	}
+}
+
+// tokenCredentialRequestTokenAuthenticator authenticates bearer tokens which are base64-encoded JSON
+// TokenCredentialRequests.
+type tokenCredentialRequestTokenAuthenticator struct {
+	delegate  credentialrequest.TokenCredentialRequestAuthenticator
+	namespace string
+}
+
+func (a *tokenCredentialRequestTokenAuthenticator) AuthenticateToken(ctx context.Context, token string) (*authenticator.Response, bool, error) {
+	tokenCredentialRequestJSON, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, false, fmt.Errorf("bearer token is not base64-encoded: %w", err)
+	}
+
+	var v1alpha1TokenCredentialRequest loginv1alpha1.TokenCredentialRequest
+	if err := json.Unmarshal(tokenCredentialRequestJSON, &v1alpha1TokenCredentialRequest); err != nil {
+		return nil, false, fmt.Errorf("bearer token is not a TokenCredentialRequest: %w", err)
+	}
+	var tokenCredentialRequest loginapi.TokenCredentialRequest
+	if err := loginv1alpha1.Convert_v1alpha1_TokenCredentialRequest_To_login_TokenCredentialRequest(
+		&v1alpha1TokenCredentialRequest, &tokenCredentialRequest, nil,
+	); err != nil {
+		return nil, false, fmt.Errorf("could not convert TokenCredentialRequest: %w", err)
+	}
+	if tokenCredentialRequest.Namespace == "" {
+		tokenCredentialRequest.Namespace = a.namespace
+	}
+
+	userInfo, _, err := a.delegate.AuthenticateTokenCredentialRequest(ctx, &tokenCredentialRequest)
+	if err != nil {
+		return nil, false, err
+	}
+	if userInfo == nil || userInfo.GetName() == "" {
+		return nil, false, nil
+	}
+	return &authenticator.Response{User: userInfo}, true, nil
+}
+
+func writeStatus(w http.ResponseWriter, err *apierrors.StatusError) {
+	status := err.Status()
+	status.TypeMeta = metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(int(status.Code))
+	_ = json.NewEncoder(w).Encode(&status)
+}
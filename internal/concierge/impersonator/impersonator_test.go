@@ -0,0 +1,267 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package impersonator
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/rest"
+
+	loginapi "go.pinniped.dev/generated/1.20/apis/concierge/login"
+	loginv1alpha1 "go.pinniped.dev/generated/1.20/apis/concierge/login/v1alpha1"
+	"go.pinniped.dev/internal/certauthority"
+	"go.pinniped.dev/internal/dynamiccert"
+	"go.pinniped.dev/internal/testutil"
+)
+
+type fakeTokenCredentialRequestAuthenticator struct{}
+
+func (fakeTokenCredentialRequestAuthenticator) AuthenticateTokenCredentialRequest(_ context.Context, req *loginapi.TokenCredentialRequest) (user.Info, time.Duration, error) {
+	if req.Namespace != "some-namespace" || req.Spec.Authenticator.Name != "some-authenticator" {
+		return nil, 0, errors.New("no such authenticator")
+	}
+	switch req.Spec.Token {
+	case "some-good-token":
+		return &user.DefaultInfo{
+			Name:   "some-token-user",
+			Groups: []string{"some-token-group"},
+			Extra:  map[string][]string{"some/extra": {"some-extra-value"}},
+		}, 0, nil
+	case "some-error-token":
+		return nil, 0, errors.New("some authenticator error")
+	default:
+		return nil, 0, nil
+	}
+}
+
+func tokenCredentialRequestBearerToken(t *testing.T, namespace, authenticatorName, token string) string {
+	t.Helper()
+	tokenCredentialRequestJSON, err := json.Marshal(&loginv1alpha1.TokenCredentialRequest{
+		TypeMeta:   metav1.TypeMeta{APIVersion: loginv1alpha1.SchemeGroupVersion.String(), Kind: "TokenCredentialRequest"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace},
+		Spec: loginv1alpha1.TokenCredentialRequestSpec{
+			Token:         token,
+			Authenticator: corev1.TypedLocalObjectReference{Kind: "WebhookAuthenticator", Name: authenticatorName},
+		},
+	})
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(tokenCredentialRequestJSON)
+}
+
+func TestImpersonator(t *testing.T) {
+	// The fake Kubernetes API server echos the headers of the request, and echos the lines which it reads from
+	// upgraded connections.
+	kubeAPICA, kubeAPIURL := testutil.TLSTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "" {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(r.Header)
+			return
+		}
+		conn, buffer, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = buffer.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + r.Header.Get("Upgrade") + "\r\n\r\n")
+		_ = buffer.Flush()
+		for {
+			line, err := buffer.ReadString('\n')
+			if err != nil {
+				return
+			}
+			_, _ = buffer.WriteString("echo " + r.Header.Get("Impersonate-User") + ": " + line)
+			_ = buffer.Flush()
+		}
+	})
+
+	clientCertCA, err := certauthority.New(pkix.Name{CommonName: "some-client-cert-ca"}, time.Hour)
+	require.NoError(t, err)
+	clientCertCAKeyPEM, err := clientCertCA.PrivateKeyToPEM()
+	require.NoError(t, err)
+	clientCertCAProvider := dynamiccert.New()
+	clientCertCAProvider.Set(clientCertCA.Bundle(), clientCertCAKeyPEM)
+
+	otherCA, err := certauthority.New(pkix.Name{CommonName: "some-other-ca"}, time.Hour)
+	require.NoError(t, err)
+
+	goodClientCert, err := clientCertCA.Issue(pkix.Name{CommonName: "some-cert-user", Organization: []string{"some-cert-group", "other-cert-group"}}, nil, nil, time.Hour)
+	require.NoError(t, err)
+	otherClientCert, err := otherCA.Issue(pkix.Name{CommonName: "some-cert-user"}, nil, nil, time.Hour)
+	require.NoError(t, err)
+
+	handler, err := New(fakeTokenCredentialRequestAuthenticator{}, clientCertCAProvider, "some-namespace", &rest.Config{
+		Host:            kubeAPIURL,
+		BearerToken:     "some-service-account-token",
+		TLSClientConfig: rest.TLSClientConfig{CAData: []byte(kubeAPICA)},
+	})
+	require.NoError(t, err)
+
+	proxyServer := httptest.NewUnstartedServer(handler)
+	proxyServer.TLS = &tls.Config{ClientAuth: tls.RequestClientCert} //nolint: gosec // the test server uses the default minimum version
+	proxyServer.StartTLS()
+	t.Cleanup(proxyServer.Close)
+
+	proxyServerCAs := proxyServer.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	newClient := func(clientCert *tls.Certificate) *http.Client {
+		tlsConfig := &tls.Config{RootCAs: proxyServerCAs} //nolint: gosec // the test server uses the default minimum version
+		if clientCert != nil {
+			tlsConfig.Certificates = []tls.Certificate{*clientCert}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	}
+
+	tests := []struct {
+		name        string
+		clientCert  *tls.Certificate
+		bearerToken string
+		header      http.Header
+
+		wantStatus            int
+		wantForwardedHeaders  http.Header
+		wantResponseBodyMatch string
+	}{
+		{
+			name:       "client certificate issued by the client cert CA",
+			clientCert: goodClientCert,
+			wantStatus: http.StatusOK,
+			wantForwardedHeaders: http.Header{
+				"Authorization":     {"Bearer some-service-account-token"},
+				"Impersonate-User":  {"some-cert-user"},
+				"Impersonate-Group": {"some-cert-group", "other-cert-group"},
+			},
+		},
+		{
+			name:                  "client certificate issued by another CA",
+			clientCert:            otherClientCert,
+			wantStatus:            http.StatusUnauthorized,
+			wantResponseBodyMatch: `"reason":"Unauthorized"`,
+		},
+		{
+			name:        "bearer token which is a valid TokenCredentialRequest",
+			bearerToken: tokenCredentialRequestBearerToken(t, "", "some-authenticator", "some-good-token"),
+			wantStatus:  http.StatusOK,
+			wantForwardedHeaders: http.Header{
+				"Authorization":                  {"Bearer some-service-account-token"},
+				"Impersonate-User":               {"some-token-user"},
+				"Impersonate-Group":              {"some-token-group"},
+				"Impersonate-Extra-Some%2fextra": {"some-extra-value"},
+			},
+		},
+		{
+			name:                  "bearer token which is a TokenCredentialRequest for an authenticator in another namespace",
+			bearerToken:           tokenCredentialRequestBearerToken(t, "other-namespace", "some-authenticator", "some-good-token"),
+			wantStatus:            http.StatusUnauthorized,
+			wantResponseBodyMatch: `"reason":"Unauthorized"`,
+		},
+		{
+			name:                  "bearer token which is a TokenCredentialRequest with an invalid token",
+			bearerToken:           tokenCredentialRequestBearerToken(t, "", "some-authenticator", "some-bad-token"),
+			wantStatus:            http.StatusUnauthorized,
+			wantResponseBodyMatch: `"reason":"Unauthorized"`,
+		},
+		{
+			name:                  "bearer token which is a TokenCredentialRequest which the authenticator fails to validate",
+			bearerToken:           tokenCredentialRequestBearerToken(t, "", "some-authenticator", "some-error-token"),
+			wantStatus:            http.StatusUnauthorized,
+			wantResponseBodyMatch: `"reason":"Unauthorized"`,
+		},
+		{
+			name:                  "bearer token which is not a TokenCredentialRequest",
+			bearerToken:           "some-service-account-token",
+			wantStatus:            http.StatusUnauthorized,
+			wantResponseBodyMatch: `"reason":"Unauthorized"`,
+		},
+		{
+			name:                  "no credentials",
+			wantStatus:            http.StatusUnauthorized,
+			wantResponseBodyMatch: `"reason":"Unauthorized"`,
+		},
+		{
+			name:                  "impersonation headers",
+			clientCert:            goodClientCert,
+			header:                http.Header{"Impersonate-User": {"some-admin"}},
+			wantStatus:            http.StatusBadRequest,
+			wantResponseBodyMatch: `"message":"impersonation headers are not allowed in requests to the impersonation proxy"`,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, proxyServer.URL+"/api/v1/namespaces", nil)
+			require.NoError(t, err)
+			for key, values := range test.header {
+				req.Header[key] = values
+			}
+			if test.bearerToken != "" {
+				req.Header.Set("Authorization", "Bearer "+test.bearerToken)
+			}
+
+			resp, err := newClient(test.clientCert).Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			require.Equal(t, test.wantStatus, resp.StatusCode, string(body))
+			require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			if test.wantResponseBodyMatch != "" {
+				require.Contains(t, string(body), test.wantResponseBodyMatch)
+			}
+			if test.wantForwardedHeaders != nil {
+				var forwardedHeaders http.Header
+				require.NoError(t, json.Unmarshal(body, &forwardedHeaders))
+				for key, values := range test.wantForwardedHeaders {
+					require.Equal(t, values, forwardedHeaders[key], key)
+				}
+			}
+		})
+	}
+
+	t.Run("upgraded connection", func(t *testing.T) {
+		conn, err := tls.Dial("tcp", strings.TrimPrefix(proxyServer.URL, "https://"), &tls.Config{
+			RootCAs:      proxyServerCAs,
+			Certificates: []tls.Certificate{*goodClientCert},
+		})
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = fmt.Fprint(conn, "POST /api/v1/namespaces/some-namespace/pods/some-pod/exec HTTP/1.1\r\nHost: some-host\r\nConnection: Upgrade\r\nUpgrade: some-protocol\r\n\r\n")
+		require.NoError(t, err)
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+		require.Equal(t, "some-protocol", resp.Header.Get("Upgrade"))
+
+		for _, line := range []string{"hello\n", "world\n"} {
+			_, err = fmt.Fprint(conn, line)
+			require.NoError(t, err)
+			echo, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			require.Equal(t, "echo some-cert-user: "+line, echo)
+		}
+	})
+}
+
+func TestNewWithInvalidRestConfig(t *testing.T) {
+	_, err := New(fakeTokenCredentialRequestAuthenticator{}, dynamiccert.New(), "some-namespace", &rest.Config{Host: "some-host"})
+	require.EqualError(t, err, `host of in-cluster config is not a URL: "some-host"`)
+}
@@ -8,6 +8,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -21,6 +22,7 @@ import (
 
 	loginapi "go.pinniped.dev/generated/1.20/apis/concierge/login"
 	loginv1alpha1 "go.pinniped.dev/generated/1.20/apis/concierge/login/v1alpha1"
+	"go.pinniped.dev/internal/certauthority"
 	"go.pinniped.dev/internal/certauthority/dynamiccertauthority"
 	"go.pinniped.dev/internal/concierge/apiserver"
 	"go.pinniped.dev/internal/config/concierge"
@@ -32,6 +34,7 @@ import (
 	"go.pinniped.dev/internal/here"
 	"go.pinniped.dev/internal/plog"
 	"go.pinniped.dev/internal/registry/credentialrequest"
+	"go.pinniped.dev/internal/signer"
 )
 
 // App is an object that represents the pinniped-concierge application.
@@ -123,32 +126,53 @@ func (a *App) runServer(ctx context.Context) error {
 	// cert issuer used to issue certs to Pinniped clients wishing to login.
 	dynamicSigningCertProvider := dynamiccert.New()
 
+	// This cert provider will be used to provide the signing key of the impersonation proxy to the cert issuer
+	// used to issue certs to Pinniped clients wishing to login, when the cluster's signing key is not available.
+	impersonationProxySigningCertProvider := dynamiccert.New()
+
 	// Prepare to start the controllers, but defer actually starting them until the
 	// post start hook of the aggregated API server.
 	startControllersFunc, err := controllermanager.PrepareControllers(
 		&controllermanager.Config{
-			ServerInstallationInfo:     podInfo,
-			APIGroupSuffix:             *cfg.APIGroupSuffix,
-			NamesConfig:                &cfg.NamesConfig,
-			Labels:                     cfg.Labels,
-			KubeCertAgentConfig:        &cfg.KubeCertAgentConfig,
-			DiscoveryURLOverride:       cfg.DiscoveryInfo.URL,
-			DynamicServingCertProvider: dynamicServingCertProvider,
-			DynamicSigningCertProvider: dynamicSigningCertProvider,
-			ServingCertDuration:        time.Duration(*cfg.APIConfig.ServingCertificateConfig.DurationSeconds) * time.Second,
-			ServingCertRenewBefore:     time.Duration(*cfg.APIConfig.ServingCertificateConfig.RenewBeforeSeconds) * time.Second,
-			AuthenticatorCache:         authenticators,
+			ServerInstallationInfo:           podInfo,
+			APIGroupSuffix:                   *cfg.APIGroupSuffix,
+			NamesConfig:                      &cfg.NamesConfig,
+			Labels:                           cfg.Labels,
+			KubeCertAgentConfig:              &cfg.KubeCertAgentConfig,
+			ImpersonationProxyConfig:         &cfg.ImpersonationProxy,
+			DiscoveryURLOverride:             cfg.DiscoveryInfo.URL,
+			DynamicServingCertProvider:       dynamicServingCertProvider,
+			DynamicSigningCertProvider:       dynamicSigningCertProvider,
+			ImpersonationSigningCertProvider: impersonationProxySigningCertProvider,
+			ServingCertDuration:              time.Duration(*cfg.APIConfig.ServingCertificateConfig.DurationSeconds) * time.Second,
+			ServingCertRenewBefore:           time.Duration(*cfg.APIConfig.ServingCertificateConfig.RenewBeforeSeconds) * time.Second,
+			AuthenticatorCache:               authenticators,
 		},
 	)
 	if err != nil {
 		return fmt.Errorf("could not prepare controllers: %w", err)
 	}
 
+	// By default, client certs are issued by the CA of the cluster, which is read by the kube-cert-agent.
+	var primaryIssuer credentialrequest.CertIssuer = dynamiccertauthority.New(dynamicSigningCertProvider)
+	if cfg.ClientCertSigner != nil {
+		primaryIssuer, err = loadClientCertSigner(ctx, cfg.ClientCertSigner)
+		if err != nil {
+			return fmt.Errorf("could not load client cert signer: %w", err)
+		}
+	}
+	// When the primary issuer cannot issue client certs, they are issued by the CA of the impersonation proxy.
+	issuer := credentialrequest.CertIssuers{
+		primaryIssuer,
+		dynamiccertauthority.New(impersonationProxySigningCertProvider),
+	}
+
 	// Get the aggregated API server config.
 	aggregatedAPIServerConfig, err := getAggregatedAPIServerConfig(
 		dynamicServingCertProvider,
 		authenticators,
-		dynamiccertauthority.New(dynamicSigningCertProvider),
+		issuer,
+		time.Duration(*cfg.APIConfig.ClientCertificateConfig.MaxTTLSeconds)*time.Second,
 		startControllersFunc,
 		*cfg.APIGroupSuffix,
 	)
@@ -166,11 +190,25 @@ func (a *App) runServer(ctx context.Context) error {
 	return server.GenericAPIServer.PrepareRun().Run(ctx.Done())
 }
 
+// loadClientCertSigner loads the CA which issues client certs using a key which is held outside of the Concierge.
+func loadClientCertSigner(ctx context.Context, spec *concierge.ClientCertSignerSpec) (*certauthority.CA, error) {
+	certPEM, err := ioutil.ReadFile(spec.CertificateFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA certificate: %w", err)
+	}
+	caSigner, err := signer.New(ctx, &spec.Signer)
+	if err != nil {
+		return nil, err
+	}
+	return certauthority.LoadWithSigner(string(certPEM), caSigner)
+}
+
 // Create a configuration for the aggregated API server.
 func getAggregatedAPIServerConfig(
 	dynamicCertProvider dynamiccert.Provider,
 	authenticator credentialrequest.TokenCredentialRequestAuthenticator,
 	issuer credentialrequest.CertIssuer,
+	maxClientCertificateTTL time.Duration,
 	startControllersPostStartHook func(context.Context),
 	apiGroupSuffix string,
 ) (*apiserver.Config, error) {
@@ -215,6 +253,7 @@ func getAggregatedAPIServerConfig(
 		ExtraConfig: apiserver.ExtraConfig{
 			Authenticator:                 authenticator,
 			Issuer:                        issuer,
+			MaxClientCertificateTTL:       maxClientCertificateTTL,
 			StartControllersPostStartHook: startControllersPostStartHook,
 			Scheme:                        scheme,
 			NegotiatedSerializer:          codecs,
@@ -20,6 +20,7 @@ import (
 const (
 	aboutAYear   = 60 * 60 * 24 * 365
 	about9Months = 60 * 60 * 24 * 30 * 9
+	oneHour      = 60 * 60
 )
 
 // FromPath loads an Config from a provided local file path, inserts any
@@ -43,6 +44,7 @@ func FromPath(path string) (*Config, error) {
 	maybeSetAPIDefaults(&config.APIConfig)
 	maybeSetAPIGroupSuffixDefault(&config.APIGroupSuffix)
 	maybeSetKubeCertAgentDefaults(&config.KubeCertAgentConfig)
+	maybeSetImpersonationProxyDefaults(&config.ImpersonationProxy)
 
 	if err := validateAPI(&config.APIConfig); err != nil {
 		return nil, fmt.Errorf("validate api: %w", err)
@@ -60,6 +62,16 @@ func FromPath(path string) (*Config, error) {
 		return nil, fmt.Errorf("validate log level: %w", err)
 	}
 
+	if err := validateImpersonationProxy(&config.ImpersonationProxy); err != nil {
+		return nil, fmt.Errorf("validate impersonationProxy: %w", err)
+	}
+
+	if config.ClientCertSigner != nil {
+		if err := validateClientCertSigner(config.ClientCertSigner); err != nil {
+			return nil, fmt.Errorf("validate clientCertSigner: %w", err)
+		}
+	}
+
 	if config.Labels == nil {
 		config.Labels = make(map[string]string)
 	}
@@ -75,6 +87,10 @@ func maybeSetAPIDefaults(apiConfig *APIConfigSpec) {
 	if apiConfig.ServingCertificateConfig.RenewBeforeSeconds == nil {
 		apiConfig.ServingCertificateConfig.RenewBeforeSeconds = int64Ptr(about9Months)
 	}
+
+	if apiConfig.ClientCertificateConfig.MaxTTLSeconds == nil {
+		apiConfig.ClientCertificateConfig.MaxTTLSeconds = int64Ptr(oneHour)
+	}
 }
 
 func maybeSetAPIGroupSuffixDefault(apiGroupSuffix **string) {
@@ -93,10 +109,19 @@ func maybeSetKubeCertAgentDefaults(cfg *KubeCertAgentSpec) {
 	}
 }
 
+func maybeSetImpersonationProxyDefaults(cfg *ImpersonationProxySpec) {
+	if cfg.Mode == "" {
+		cfg.Mode = ImpersonationProxyModeAuto
+	}
+}
+
 func validateNames(names *NamesConfigSpec) error {
 	missingNames := []string{}
 	if names == nil {
-		missingNames = append(missingNames, "servingCertificateSecret", "credentialIssuer", "apiService")
+		missingNames = append(missingNames,
+			"servingCertificateSecret", "credentialIssuer", "apiService",
+			"impersonationLoadBalancerService", "impersonationTLSCertificateSecret", "impersonationSignerSecret",
+		)
 	} else {
 		if names.ServingCertificateSecret == "" {
 			missingNames = append(missingNames, "servingCertificateSecret")
@@ -107,6 +132,15 @@ func validateNames(names *NamesConfigSpec) error {
 		if names.APIService == "" {
 			missingNames = append(missingNames, "apiService")
 		}
+		if names.ImpersonationLoadBalancerService == "" {
+			missingNames = append(missingNames, "impersonationLoadBalancerService")
+		}
+		if names.ImpersonationTLSCertificateSecret == "" {
+			missingNames = append(missingNames, "impersonationTLSCertificateSecret")
+		}
+		if names.ImpersonationSignerSecret == "" {
+			missingNames = append(missingNames, "impersonationSignerSecret")
+		}
 	}
 	if len(missingNames) > 0 {
 		return constable.Error("missing required names: " + strings.Join(missingNames, ", "))
@@ -123,6 +157,32 @@ func validateAPI(apiConfig *APIConfigSpec) error {
 		return constable.Error("renewBefore must be positive")
 	}
 
+	if *apiConfig.ClientCertificateConfig.MaxTTLSeconds <= 0 {
+		return constable.Error("clientCertificate.maxTTLSeconds must be positive")
+	}
+
+	return nil
+}
+
+func validateImpersonationProxy(cfg *ImpersonationProxySpec) error {
+	switch cfg.Mode {
+	case ImpersonationProxyModeAuto, ImpersonationProxyModeEnabled, ImpersonationProxyModeDisabled:
+	default:
+		return constable.Error(`mode must be "auto", "enabled" or "disabled"`)
+	}
+	if strings.Contains(cfg.ExternalEndpoint, "/") {
+		return constable.Error("externalEndpoint must be a host with an optional port, not a URL")
+	}
+	return nil
+}
+
+func validateClientCertSigner(clientCertSigner *ClientCertSignerSpec) error {
+	if clientCertSigner.CertificateFile == "" {
+		return constable.Error("certificateFile is required")
+	}
+	if err := clientCertSigner.Signer.Validate(); err != nil {
+		return fmt.Errorf("signer: %w", err)
+	}
 	return nil
 }
 
@@ -11,6 +11,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"go.pinniped.dev/internal/here"
+	"go.pinniped.dev/internal/signer"
 )
 
 func TestFromPath(t *testing.T) {
@@ -30,8 +31,13 @@ func TestFromPath(t *testing.T) {
 				  servingCertificate:
 					durationSeconds: 3600
 					renewBeforeSeconds: 2400
+				  clientCertificate:
+					maxTTLSeconds: 600
 				apiGroupSuffix: some.suffix.com
 				names:
+				  impersonationLoadBalancerService: impersonationLoadBalancerService-value
+				  impersonationTLSCertificateSecret: impersonationTLSCertificateSecret-value
+				  impersonationSignerSecret: impersonationSignerSecret-value
 				  servingCertificateSecret: pinniped-concierge-api-tls-serving-certificate
 				  credentialIssuer: pinniped-config
 				  apiService: pinniped-api
@@ -43,6 +49,9 @@ func TestFromPath(t *testing.T) {
 				  namePrefix: kube-cert-agent-name-prefix-
 				  image: kube-cert-agent-image
 				  imagePullSecrets: [kube-cert-agent-image-pull-secret]
+				impersonationProxy:
+				  mode: enabled
+				  externalEndpoint: some.impersonation.proxy:8443
 			`),
 			wantConfig: &Config{
 				DiscoveryInfo: DiscoveryInfoSpec{
@@ -53,12 +62,18 @@ func TestFromPath(t *testing.T) {
 						DurationSeconds:    int64Ptr(3600),
 						RenewBeforeSeconds: int64Ptr(2400),
 					},
+					ClientCertificateConfig: ClientCertificateConfigSpec{
+						MaxTTLSeconds: int64Ptr(600),
+					},
 				},
 				APIGroupSuffix: stringPtr("some.suffix.com"),
 				NamesConfig: NamesConfigSpec{
-					ServingCertificateSecret: "pinniped-concierge-api-tls-serving-certificate",
-					CredentialIssuer:         "pinniped-config",
-					APIService:               "pinniped-api",
+					ServingCertificateSecret:          "pinniped-concierge-api-tls-serving-certificate",
+					CredentialIssuer:                  "pinniped-config",
+					APIService:                        "pinniped-api",
+					ImpersonationLoadBalancerService:  "impersonationLoadBalancerService-value",
+					ImpersonationTLSCertificateSecret: "impersonationTLSCertificateSecret-value",
+					ImpersonationSignerSecret:         "impersonationSignerSecret-value",
 				},
 				Labels: map[string]string{
 					"myLabelKey1": "myLabelValue1",
@@ -69,6 +84,10 @@ func TestFromPath(t *testing.T) {
 					Image:            stringPtr("kube-cert-agent-image"),
 					ImagePullSecrets: []string{"kube-cert-agent-image-pull-secret"},
 				},
+				ImpersonationProxy: ImpersonationProxySpec{
+					Mode:             ImpersonationProxyModeEnabled,
+					ExternalEndpoint: "some.impersonation.proxy:8443",
+				},
 			},
 		},
 		{
@@ -76,6 +95,9 @@ func TestFromPath(t *testing.T) {
 			yaml: here.Doc(`
 				---
 				names:
+				  impersonationLoadBalancerService: impersonationLoadBalancerService-value
+				  impersonationTLSCertificateSecret: impersonationTLSCertificateSecret-value
+				  impersonationSignerSecret: impersonationSignerSecret-value
 				  servingCertificateSecret: pinniped-concierge-api-tls-serving-certificate
 				  credentialIssuer: pinniped-config
 				  apiService: pinniped-api
@@ -90,29 +112,41 @@ func TestFromPath(t *testing.T) {
 						DurationSeconds:    int64Ptr(60 * 60 * 24 * 365),    // about a year
 						RenewBeforeSeconds: int64Ptr(60 * 60 * 24 * 30 * 9), // about 9 months
 					},
+					ClientCertificateConfig: ClientCertificateConfigSpec{
+						MaxTTLSeconds: int64Ptr(60 * 60), // one hour
+					},
 				},
 				NamesConfig: NamesConfigSpec{
-					ServingCertificateSecret: "pinniped-concierge-api-tls-serving-certificate",
-					CredentialIssuer:         "pinniped-config",
-					APIService:               "pinniped-api",
+					ServingCertificateSecret:          "pinniped-concierge-api-tls-serving-certificate",
+					CredentialIssuer:                  "pinniped-config",
+					APIService:                        "pinniped-api",
+					ImpersonationLoadBalancerService:  "impersonationLoadBalancerService-value",
+					ImpersonationTLSCertificateSecret: "impersonationTLSCertificateSecret-value",
+					ImpersonationSignerSecret:         "impersonationSignerSecret-value",
 				},
 				Labels: map[string]string{},
 				KubeCertAgentConfig: KubeCertAgentSpec{
 					NamePrefix: stringPtr("pinniped-kube-cert-agent-"),
 					Image:      stringPtr("debian:latest"),
 				},
+				ImpersonationProxy: ImpersonationProxySpec{
+					Mode: ImpersonationProxyModeAuto,
+				},
 			},
 		},
 		{
 			name:      "Empty",
 			yaml:      here.Doc(``),
-			wantError: "validate names: missing required names: servingCertificateSecret, credentialIssuer, apiService",
+			wantError: "validate names: missing required names: servingCertificateSecret, credentialIssuer, apiService, impersonationLoadBalancerService, impersonationTLSCertificateSecret, impersonationSignerSecret",
 		},
 		{
 			name: "Missing apiService name",
 			yaml: here.Doc(`
 				---
 				names:
+				  impersonationLoadBalancerService: impersonationLoadBalancerService-value
+				  impersonationTLSCertificateSecret: impersonationTLSCertificateSecret-value
+				  impersonationSignerSecret: impersonationSignerSecret-value
 				  servingCertificateSecret: pinniped-concierge-api-tls-serving-certificate
 				  credentialIssuer: pinniped-config
 			`),
@@ -123,6 +157,9 @@ func TestFromPath(t *testing.T) {
 			yaml: here.Doc(`
 				---
 				names:
+				  impersonationLoadBalancerService: impersonationLoadBalancerService-value
+				  impersonationTLSCertificateSecret: impersonationTLSCertificateSecret-value
+				  impersonationSignerSecret: impersonationSignerSecret-value
 				  servingCertificateSecret: pinniped-concierge-api-tls-serving-certificate
 				  apiService: pinniped-api
 			`),
@@ -133,11 +170,57 @@ func TestFromPath(t *testing.T) {
 			yaml: here.Doc(`
 				---
 				names:
+				  impersonationLoadBalancerService: impersonationLoadBalancerService-value
+				  impersonationTLSCertificateSecret: impersonationTLSCertificateSecret-value
+				  impersonationSignerSecret: impersonationSignerSecret-value
 				  credentialIssuer: pinniped-config
 				  apiService: pinniped-api
 			`),
 			wantError: "validate names: missing required names: servingCertificateSecret",
 		},
+		{
+			name: "Missing impersonation names",
+			yaml: here.Doc(`
+				---
+				names:
+				  servingCertificateSecret: pinniped-concierge-api-tls-serving-certificate
+				  credentialIssuer: pinniped-config
+				  apiService: pinniped-api
+			`),
+			wantError: "validate names: missing required names: impersonationLoadBalancerService, impersonationTLSCertificateSecret, impersonationSignerSecret",
+		},
+		{
+			name: "Invalid impersonation proxy mode",
+			yaml: here.Doc(`
+				---
+				names:
+				  impersonationLoadBalancerService: impersonationLoadBalancerService-value
+				  impersonationTLSCertificateSecret: impersonationTLSCertificateSecret-value
+				  impersonationSignerSecret: impersonationSignerSecret-value
+				  servingCertificateSecret: pinniped-concierge-api-tls-serving-certificate
+				  credentialIssuer: pinniped-config
+				  apiService: pinniped-api
+				impersonationProxy:
+				  mode: sometimes
+			`),
+			wantError: `validate impersonationProxy: mode must be "auto", "enabled" or "disabled"`,
+		},
+		{
+			name: "Impersonation proxy external endpoint is a URL",
+			yaml: here.Doc(`
+				---
+				names:
+				  impersonationLoadBalancerService: impersonationLoadBalancerService-value
+				  impersonationTLSCertificateSecret: impersonationTLSCertificateSecret-value
+				  impersonationSignerSecret: impersonationSignerSecret-value
+				  servingCertificateSecret: pinniped-concierge-api-tls-serving-certificate
+				  credentialIssuer: pinniped-config
+				  apiService: pinniped-api
+				impersonationProxy:
+				  externalEndpoint: https://some.impersonation.proxy
+			`),
+			wantError: "validate impersonationProxy: externalEndpoint must be a host with an optional port, not a URL",
+		},
 		{
 			name: "InvalidDurationRenewBefore",
 			yaml: here.Doc(`
@@ -147,6 +230,9 @@ func TestFromPath(t *testing.T) {
 					durationSeconds: 2400
 					renewBeforeSeconds: 3600
 				names:
+				  impersonationLoadBalancerService: impersonationLoadBalancerService-value
+				  impersonationTLSCertificateSecret: impersonationTLSCertificateSecret-value
+				  impersonationSignerSecret: impersonationSignerSecret-value
 				  servingCertificateSecret: pinniped-concierge-api-tls-serving-certificate
 				  credentialIssuer: pinniped-config
 				  apiService: pinniped-api
@@ -162,12 +248,32 @@ func TestFromPath(t *testing.T) {
 					durationSeconds: 2400
 					renewBeforeSeconds: -10
 				names:
+				  impersonationLoadBalancerService: impersonationLoadBalancerService-value
+				  impersonationTLSCertificateSecret: impersonationTLSCertificateSecret-value
+				  impersonationSignerSecret: impersonationSignerSecret-value
 				  servingCertificateSecret: pinniped-concierge-api-tls-serving-certificate
 				  credentialIssuer: pinniped-config
 				  apiService: pinniped-api
 			`),
 			wantError: "validate api: renewBefore must be positive",
 		},
+		{
+			name: "ZeroClientCertificateMaxTTL",
+			yaml: here.Doc(`
+				---
+				api:
+				  clientCertificate:
+					maxTTLSeconds: 0
+				names:
+				  impersonationLoadBalancerService: impersonationLoadBalancerService-value
+				  impersonationTLSCertificateSecret: impersonationTLSCertificateSecret-value
+				  impersonationSignerSecret: impersonationSignerSecret-value
+				  servingCertificateSecret: pinniped-concierge-api-tls-serving-certificate
+				  credentialIssuer: pinniped-config
+				  apiService: pinniped-api
+			`),
+			wantError: "validate api: clientCertificate.maxTTLSeconds must be positive",
+		},
 		{
 			name: "ZeroRenewBefore",
 			yaml: here.Doc(`
@@ -177,6 +283,9 @@ func TestFromPath(t *testing.T) {
 					durationSeconds: 2400
 					renewBeforeSeconds: 0
 				names:
+				  impersonationLoadBalancerService: impersonationLoadBalancerService-value
+				  impersonationTLSCertificateSecret: impersonationTLSCertificateSecret-value
+				  impersonationSignerSecret: impersonationSignerSecret-value
 				  servingCertificateSecret: pinniped-concierge-api-tls-serving-certificate
 				  credentialIssuer: pinniped-config
 				  apiService: pinniped-api
@@ -193,12 +302,104 @@ func TestFromPath(t *testing.T) {
 					renewBeforeSeconds: 2400
 				apiGroupSuffix: .starts.with.dot
 				names:
+				  impersonationLoadBalancerService: impersonationLoadBalancerService-value
+				  impersonationTLSCertificateSecret: impersonationTLSCertificateSecret-value
+				  impersonationSignerSecret: impersonationSignerSecret-value
 				  servingCertificateSecret: pinniped-concierge-api-tls-serving-certificate
 				  credentialIssuer: pinniped-config
 				  apiService: pinniped-api
 			`),
 			wantError: "validate apiGroupSuffix: a lowercase RFC 1123 subdomain must consist of lower case alphanumeric characters, '-' or '.', and must start and end with an alphanumeric character (e.g. 'example.com', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?(\\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*')",
 		},
+		{
+			name: "Client certificate signer held by a signing plugin",
+			yaml: here.Doc(`
+				---
+				names:
+				  impersonationLoadBalancerService: impersonationLoadBalancerService-value
+				  impersonationTLSCertificateSecret: impersonationTLSCertificateSecret-value
+				  impersonationSignerSecret: impersonationSignerSecret-value
+				  servingCertificateSecret: pinniped-concierge-api-tls-serving-certificate
+				  credentialIssuer: pinniped-config
+				  apiService: pinniped-api
+				clientCertSigner:
+				  certificateFile: /etc/client-cert-signer/ca.crt
+				  signer:
+				    plugin:
+				      socket: /var/run/kms/plugin.sock
+				      keyID: some-key
+			`),
+			wantConfig: &Config{
+				DiscoveryInfo: DiscoveryInfoSpec{
+					URL: nil,
+				},
+				APIGroupSuffix: stringPtr("pinniped.dev"),
+				APIConfig: APIConfigSpec{
+					ServingCertificateConfig: ServingCertificateConfigSpec{
+						DurationSeconds:    int64Ptr(60 * 60 * 24 * 365),    // about a year
+						RenewBeforeSeconds: int64Ptr(60 * 60 * 24 * 30 * 9), // about 9 months
+					},
+					ClientCertificateConfig: ClientCertificateConfigSpec{
+						MaxTTLSeconds: int64Ptr(60 * 60), // one hour
+					},
+				},
+				NamesConfig: NamesConfigSpec{
+					ServingCertificateSecret:          "pinniped-concierge-api-tls-serving-certificate",
+					CredentialIssuer:                  "pinniped-config",
+					APIService:                        "pinniped-api",
+					ImpersonationLoadBalancerService:  "impersonationLoadBalancerService-value",
+					ImpersonationTLSCertificateSecret: "impersonationTLSCertificateSecret-value",
+					ImpersonationSignerSecret:         "impersonationSignerSecret-value",
+				},
+				Labels: map[string]string{},
+				KubeCertAgentConfig: KubeCertAgentSpec{
+					NamePrefix: stringPtr("pinniped-kube-cert-agent-"),
+					Image:      stringPtr("debian:latest"),
+				},
+				ImpersonationProxy: ImpersonationProxySpec{
+					Mode: ImpersonationProxyModeAuto,
+				},
+				ClientCertSigner: &ClientCertSignerSpec{
+					CertificateFile: "/etc/client-cert-signer/ca.crt",
+					Signer: signer.Reference{
+						Plugin: &signer.PluginReference{Socket: "/var/run/kms/plugin.sock", KeyID: "some-key"},
+					},
+				},
+			},
+		},
+		{
+			name: "Client certificate signer without a certificate",
+			yaml: here.Doc(`
+				---
+				names:
+				  impersonationLoadBalancerService: impersonationLoadBalancerService-value
+				  impersonationTLSCertificateSecret: impersonationTLSCertificateSecret-value
+				  impersonationSignerSecret: impersonationSignerSecret-value
+				  servingCertificateSecret: pinniped-concierge-api-tls-serving-certificate
+				  credentialIssuer: pinniped-config
+				  apiService: pinniped-api
+				clientCertSigner:
+				  signer:
+				    file: /etc/client-cert-signer/ca.key
+			`),
+			wantError: "validate clientCertSigner: certificateFile is required",
+		},
+		{
+			name: "Client certificate signer without a signer",
+			yaml: here.Doc(`
+				---
+				names:
+				  impersonationLoadBalancerService: impersonationLoadBalancerService-value
+				  impersonationTLSCertificateSecret: impersonationTLSCertificateSecret-value
+				  impersonationSignerSecret: impersonationSignerSecret-value
+				  servingCertificateSecret: pinniped-concierge-api-tls-serving-certificate
+				  credentialIssuer: pinniped-config
+				  apiService: pinniped-api
+				clientCertSigner:
+				  certificateFile: /etc/client-cert-signer/ca.crt
+			`),
+			wantError: "validate clientCertSigner: signer: one of file or plugin must be set",
+		},
 	}
 	for _, test := range tests {
 		test := test
@@ -3,7 +3,10 @@
 
 package concierge
 
-import "go.pinniped.dev/internal/plog"
+import (
+	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/signer"
+)
 
 // Config contains knobs to setup an instance of the Pinniped Concierge.
 type Config struct {
@@ -14,6 +17,51 @@ type Config struct {
 	KubeCertAgentConfig KubeCertAgentSpec `json:"kubeCertAgent"`
 	Labels              map[string]string `json:"labels"`
 	LogLevel            plog.LogLevel     `json:"logLevel"`
+
+	// ClientCertSigner optionally configures the CA which issues the client certificates of
+	// TokenCredentialRequests, instead of the CA of the Kubernetes cluster which is read by the kube-cert-agent.
+	ClientCertSigner *ClientCertSignerSpec `json:"clientCertSigner,omitempty"`
+
+	// ImpersonationProxy configures the impersonation proxy, which lets users authenticate to clusters where the
+	// kube-cert-agent cannot read the signing key of the cluster.
+	ImpersonationProxy ImpersonationProxySpec `json:"impersonationProxy"`
+}
+
+// ImpersonationProxyMode decides whether the impersonation proxy runs.
+type ImpersonationProxyMode string
+
+const (
+	// ImpersonationProxyModeAuto runs the impersonation proxy only when the cluster has no visible control plane
+	// nodes, as is the case on most managed Kubernetes services.
+	ImpersonationProxyModeAuto = ImpersonationProxyMode("auto")
+
+	// ImpersonationProxyModeEnabled always runs the impersonation proxy.
+	ImpersonationProxyModeEnabled = ImpersonationProxyMode("enabled")
+
+	// ImpersonationProxyModeDisabled never runs the impersonation proxy.
+	ImpersonationProxyModeDisabled = ImpersonationProxyMode("disabled")
+)
+
+// ImpersonationProxySpec configures the impersonation proxy, an authenticating reverse proxy to the Kubernetes API
+// server which forwards the requests of users using Kubernetes impersonation headers.
+type ImpersonationProxySpec struct {
+	// Mode is "auto", "enabled" or "disabled". The default is "auto".
+	Mode ImpersonationProxyMode `json:"mode,omitempty"`
+
+	// ExternalEndpoint is the host, with an optional port, at which clients can reach the impersonation proxy. When
+	// it is not set, the Concierge creates a LoadBalancer Service for the impersonation proxy and uses the address
+	// of its load balancer.
+	ExternalEndpoint string `json:"externalEndpoint,omitempty"`
+}
+
+// ClientCertSignerSpec configures a CA whose private key is kept outside of the Concierge, for example in an
+// external key management service. The Kubernetes API server must trust this CA for client authentication.
+type ClientCertSignerSpec struct {
+	// CertificateFile is the path of the PEM-encoded certificate of the CA.
+	CertificateFile string `json:"certificateFile"`
+
+	// Signer refers to the private key of the CA.
+	Signer signer.Reference `json:"signer"`
 }
 
 // DiscoveryInfoSpec contains configuration knobs specific to
@@ -29,13 +77,17 @@ type DiscoveryInfoSpec struct {
 //nolint: golint
 type APIConfigSpec struct {
 	ServingCertificateConfig ServingCertificateConfigSpec `json:"servingCertificate"`
+	ClientCertificateConfig  ClientCertificateConfigSpec  `json:"clientCertificate"`
 }
 
 // NamesConfigSpec configures the names of some Kubernetes resources for the Concierge.
 type NamesConfigSpec struct {
-	ServingCertificateSecret string `json:"servingCertificateSecret"`
-	CredentialIssuer         string `json:"credentialIssuer"`
-	APIService               string `json:"apiService"`
+	ServingCertificateSecret          string `json:"servingCertificateSecret"`
+	CredentialIssuer                  string `json:"credentialIssuer"`
+	APIService                        string `json:"apiService"`
+	ImpersonationLoadBalancerService  string `json:"impersonationLoadBalancerService"`
+	ImpersonationTLSCertificateSecret string `json:"impersonationTLSCertificateSecret"`
+	ImpersonationSignerSecret         string `json:"impersonationSignerSecret"`
 }
 
 // ServingCertificateConfigSpec contains the configuration knobs for the API's
@@ -56,6 +108,16 @@ type ServingCertificateConfigSpec struct {
 	RenewBeforeSeconds *int64 `json:"renewBeforeSeconds,omitempty"`
 }
 
+// ClientCertificateConfigSpec contains the configuration knobs for the client
+// certificates which are issued by TokenCredentialRequests.
+type ClientCertificateConfigSpec struct {
+	// MaxTTLSeconds is the longest validity period, in seconds, of the client
+	// certificates. The clientCertificateTTL of an authenticator is capped at
+	// this value, and so is the default of 5 minutes. By default, client
+	// certificates are valid for at most 3600 seconds (1 hour).
+	MaxTTLSeconds *int64 `json:"maxTTLSeconds,omitempty"`
+}
+
 type KubeCertAgentSpec struct {
 	// NamePrefix is the prefix of the name of the kube-cert-agent pods. For example, if this field is
 	// set to "some-prefix-", then the name of the pods will look like "some-prefix-blah". The default
@@ -17,6 +17,12 @@ import (
 	"go.pinniped.dev/internal/plog"
 )
 
+const (
+	defaultGarbageCollectionSweepIntervalSeconds = 30
+	defaultGarbageCollectionBatchSize            = 500
+	defaultKeyRotationGracePeriodSeconds         = 60 * 60 * 24
+)
+
 // FromPath loads an Config from a provided local file path, inserts any
 // defaults (from the Config documentation), and verifies that the config is
 // valid (Config documentation).
@@ -36,6 +42,8 @@ func FromPath(path string) (*Config, error) {
 	}
 
 	maybeSetAPIGroupSuffixDefault(&config.APIGroupSuffix)
+	maybeSetStorageDefaults(&config.StorageConfig)
+	maybeSetKeyRotationDefaults(&config.KeyRotation)
 
 	if err := validateAPIGroupSuffix(*config.APIGroupSuffix); err != nil {
 		return nil, fmt.Errorf("validate apiGroupSuffix: %w", err)
@@ -45,6 +53,18 @@ func FromPath(path string) (*Config, error) {
 		return nil, fmt.Errorf("validate names: %w", err)
 	}
 
+	if err := validateStorage(&config.StorageConfig); err != nil {
+		return nil, fmt.Errorf("validate storage: %w", err)
+	}
+
+	if err := validateKeyRotation(&config.KeyRotation); err != nil {
+		return nil, fmt.Errorf("validate keyRotation: %w", err)
+	}
+
+	if err := validateIDTokenSigners(config.IDTokenSigners); err != nil {
+		return nil, fmt.Errorf("validate idTokenSigners: %w", err)
+	}
+
 	if err := plog.ValidateAndSetLogLevelGlobally(config.LogLevel); err != nil {
 		return nil, fmt.Errorf("validate log level: %w", err)
 	}
@@ -58,6 +78,88 @@ func maybeSetAPIGroupSuffixDefault(apiGroupSuffix **string) {
 	}
 }
 
+func maybeSetStorageDefaults(storage *StorageConfigSpec) {
+	if storage.Backend == "" {
+		storage.Backend = StorageBackendSecrets
+	}
+
+	if storage.GarbageCollection.SweepIntervalSeconds == nil {
+		storage.GarbageCollection.SweepIntervalSeconds = int64Ptr(defaultGarbageCollectionSweepIntervalSeconds)
+	}
+
+	if storage.GarbageCollection.BatchSize == nil {
+		storage.GarbageCollection.BatchSize = int64Ptr(defaultGarbageCollectionBatchSize)
+	}
+}
+
+func validateStorage(storage *StorageConfigSpec) error {
+	if *storage.GarbageCollection.SweepIntervalSeconds <= 0 {
+		return constable.Error("garbageCollection.sweepIntervalSeconds must be positive")
+	}
+
+	if *storage.GarbageCollection.BatchSize <= 0 {
+		return constable.Error("garbageCollection.batchSize must be positive")
+	}
+
+	switch storage.Backend {
+	case StorageBackendSecrets:
+	case StorageBackendSQL:
+		if storage.SQL.DataSourceNameFile == "" {
+			return constable.Error("sql.dataSourceNameFile is required when backend is sql")
+		}
+		if storage.ReadCache.Enabled {
+			return constable.Error("readCache cannot be enabled when backend is sql")
+		}
+	default:
+		return fmt.Errorf("backend must be one of %q or %q", StorageBackendSecrets, StorageBackendSQL)
+	}
+
+	return nil
+}
+
+func maybeSetKeyRotationDefaults(keyRotation *KeyRotationSpec) {
+	if keyRotation.GracePeriodSeconds == nil {
+		keyRotation.GracePeriodSeconds = int64Ptr(defaultKeyRotationGracePeriodSeconds)
+	}
+}
+
+func validateKeyRotation(keyRotation *KeyRotationSpec) error {
+	if *keyRotation.GracePeriodSeconds < 0 {
+		return constable.Error("gracePeriodSeconds must not be negative")
+	}
+
+	if keyRotation.IntervalSeconds == nil {
+		return nil
+	}
+
+	if *keyRotation.IntervalSeconds <= 0 {
+		return constable.Error("intervalSeconds must be positive")
+	}
+
+	if *keyRotation.GracePeriodSeconds >= *keyRotation.IntervalSeconds {
+		return constable.Error("gracePeriodSeconds must be less than intervalSeconds")
+	}
+
+	return nil
+}
+
+func validateIDTokenSigners(idTokenSigners []IDTokenSignerSpec) error {
+	issuers := map[string]bool{}
+	for i, idTokenSigner := range idTokenSigners {
+		if idTokenSigner.Issuer == "" {
+			return fmt.Errorf("[%d]: issuer is required", i)
+		}
+		if issuers[idTokenSigner.Issuer] {
+			return fmt.Errorf("[%d]: issuer %q has more than one signer", i, idTokenSigner.Issuer)
+		}
+		issuers[idTokenSigner.Issuer] = true
+		if err := idTokenSigner.Signer.Validate(); err != nil {
+			return fmt.Errorf("[%d].signer: %w", i, err)
+		}
+	}
+	return nil
+}
+
 func validateAPIGroupSuffix(apiGroupSuffix string) error {
 	return groupsuffix.Validate(apiGroupSuffix)
 }
@@ -76,3 +178,7 @@ func validateNames(names *NamesConfigSpec) error {
 func stringPtr(s string) *string {
 	return &s
 }
+
+func int64Ptr(i int64) *int64 {
+	return &i
+}
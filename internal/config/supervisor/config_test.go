@@ -11,6 +11,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"go.pinniped.dev/internal/here"
+	"go.pinniped.dev/internal/signer"
 )
 
 func TestFromPath(t *testing.T) {
@@ -30,6 +31,17 @@ func TestFromPath(t *testing.T) {
 				  myLabelKey2: myLabelValue2
 				names:
 				  defaultTLSCertificateSecret: my-secret-name
+				storage:
+				  garbageCollection:
+				    sweepIntervalSeconds: 120
+				    batchSize: 50
+				  readCache:
+				    enabled: true
+				  migration:
+				    rewriteOnStartup: true
+				keyRotation:
+				  intervalSeconds: 604800
+				  gracePeriodSeconds: 3600
 			`),
 			wantConfig: &Config{
 				APIGroupSuffix: stringPtr("some.suffix.com"),
@@ -40,6 +52,23 @@ func TestFromPath(t *testing.T) {
 				NamesConfig: NamesConfigSpec{
 					DefaultTLSCertificateSecret: "my-secret-name",
 				},
+				StorageConfig: StorageConfigSpec{
+					Backend: StorageBackendSecrets,
+					GarbageCollection: GarbageCollectionSpec{
+						SweepIntervalSeconds: int64Ptr(120),
+						BatchSize:            int64Ptr(50),
+					},
+					ReadCache: ReadCacheSpec{
+						Enabled: true,
+					},
+					Migration: MigrationSpec{
+						RewriteOnStartup: true,
+					},
+				},
+				KeyRotation: KeyRotationSpec{
+					IntervalSeconds:    int64Ptr(604800),
+					GracePeriodSeconds: int64Ptr(3600),
+				},
 			},
 		},
 		{
@@ -55,6 +84,16 @@ func TestFromPath(t *testing.T) {
 				NamesConfig: NamesConfigSpec{
 					DefaultTLSCertificateSecret: "my-secret-name",
 				},
+				StorageConfig: StorageConfigSpec{
+					Backend: StorageBackendSecrets,
+					GarbageCollection: GarbageCollectionSpec{
+						SweepIntervalSeconds: int64Ptr(30),
+						BatchSize:            int64Ptr(500),
+					},
+				},
+				KeyRotation: KeyRotationSpec{
+					GracePeriodSeconds: int64Ptr(86400),
+				},
 			},
 		},
 		{
@@ -74,6 +113,222 @@ func TestFromPath(t *testing.T) {
 			`),
 			wantError: "validate apiGroupSuffix: a lowercase RFC 1123 subdomain must consist of lower case alphanumeric characters, '-' or '.', and must start and end with an alphanumeric character (e.g. 'example.com', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?(\\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*')",
 		},
+		{
+			name: "Non-positive garbage collection sweep interval",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				storage:
+				  garbageCollection:
+				    sweepIntervalSeconds: 0
+			`),
+			wantError: "validate storage: garbageCollection.sweepIntervalSeconds must be positive",
+		},
+		{
+			name: "Non-positive garbage collection batch size",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				storage:
+				  garbageCollection:
+				    batchSize: -1
+			`),
+			wantError: "validate storage: garbageCollection.batchSize must be positive",
+		},
+		{
+			name: "SQL storage backend",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				storage:
+				  backend: sql
+				  sql:
+				    dataSourceNameFile: /etc/pinniped/dsn
+			`),
+			wantConfig: &Config{
+				APIGroupSuffix: stringPtr("pinniped.dev"),
+				Labels:         map[string]string{},
+				NamesConfig: NamesConfigSpec{
+					DefaultTLSCertificateSecret: "my-secret-name",
+				},
+				StorageConfig: StorageConfigSpec{
+					Backend: StorageBackendSQL,
+					GarbageCollection: GarbageCollectionSpec{
+						SweepIntervalSeconds: int64Ptr(30),
+						BatchSize:            int64Ptr(500),
+					},
+					SQL: SQLStorageSpec{
+						DataSourceNameFile: "/etc/pinniped/dsn",
+					},
+				},
+				KeyRotation: KeyRotationSpec{
+					GracePeriodSeconds: int64Ptr(86400),
+				},
+			},
+		},
+		{
+			name: "Unknown storage backend",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				storage:
+				  backend: etcd
+			`),
+			wantError: `validate storage: backend must be one of "secrets" or "sql"`,
+		},
+		{
+			name: "SQL storage backend without a data source name",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				storage:
+				  backend: sql
+			`),
+			wantError: "validate storage: sql.dataSourceNameFile is required when backend is sql",
+		},
+		{
+			name: "SQL storage backend with the read cache",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				storage:
+				  backend: sql
+				  sql:
+				    dataSourceNameFile: /etc/pinniped/dsn
+				  readCache:
+				    enabled: true
+			`),
+			wantError: "validate storage: readCache cannot be enabled when backend is sql",
+		},
+		{
+			name: "Non-positive key rotation interval",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				keyRotation:
+				  intervalSeconds: 0
+			`),
+			wantError: "validate keyRotation: intervalSeconds must be positive",
+		},
+		{
+			name: "Negative key rotation grace period",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				keyRotation:
+				  gracePeriodSeconds: -1
+			`),
+			wantError: "validate keyRotation: gracePeriodSeconds must not be negative",
+		},
+		{
+			name: "Key rotation grace period is not less than the interval",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				keyRotation:
+				  intervalSeconds: 3600
+			`),
+			wantError: "validate keyRotation: gracePeriodSeconds must be less than intervalSeconds",
+		},
+		{
+			name: "ID token signers of some issuers",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				idTokenSigners:
+				- issuer: https://issuer.example.com/some/path
+				  signer:
+				    plugin:
+				      socket: /var/run/kms/plugin.sock
+				      keyID: some-key
+				- issuer: https://other-issuer.example.com
+				  signer:
+				    file: /etc/id-token-signers/other-issuer/tls.key
+			`),
+			wantConfig: &Config{
+				APIGroupSuffix: stringPtr("pinniped.dev"),
+				Labels:         map[string]string{},
+				NamesConfig: NamesConfigSpec{
+					DefaultTLSCertificateSecret: "my-secret-name",
+				},
+				StorageConfig: StorageConfigSpec{
+					Backend: StorageBackendSecrets,
+					GarbageCollection: GarbageCollectionSpec{
+						SweepIntervalSeconds: int64Ptr(30),
+						BatchSize:            int64Ptr(500),
+					},
+				},
+				KeyRotation: KeyRotationSpec{
+					GracePeriodSeconds: int64Ptr(86400),
+				},
+				IDTokenSigners: []IDTokenSignerSpec{
+					{
+						Issuer: "https://issuer.example.com/some/path",
+						Signer: signer.Reference{
+							Plugin: &signer.PluginReference{Socket: "/var/run/kms/plugin.sock", KeyID: "some-key"},
+						},
+					},
+					{
+						Issuer: "https://other-issuer.example.com",
+						Signer: signer.Reference{File: "/etc/id-token-signers/other-issuer/tls.key"},
+					},
+				},
+			},
+		},
+		{
+			name: "Invalid ID token signer",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				idTokenSigners:
+				- issuer: https://issuer.example.com
+				  signer:
+				    file: /etc/signer/key.pem
+				    plugin:
+				      socket: /var/run/kms/plugin.sock
+				      keyID: some-key
+			`),
+			wantError: "validate idTokenSigners: [0].signer: only one of file or plugin may be set",
+		},
+		{
+			name: "ID token signer without issuer",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				idTokenSigners:
+				- signer:
+				    file: /etc/signer/key.pem
+			`),
+			wantError: "validate idTokenSigners: [0]: issuer is required",
+		},
+		{
+			name: "Several ID token signers for the same issuer",
+			yaml: here.Doc(`
+				---
+				names:
+				  defaultTLSCertificateSecret: my-secret-name
+				idTokenSigners:
+				- issuer: https://issuer.example.com
+				  signer:
+				    file: /etc/signer/key.pem
+				- issuer: https://issuer.example.com
+				  signer:
+				    file: /etc/signer/other-key.pem
+			`),
+			wantError: `validate idTokenSigners: [1]: issuer "https://issuer.example.com" has more than one signer`,
+		},
 	}
 	for _, test := range tests {
 		test := test
@@ -6,6 +6,9 @@ package authenticator
 
 import (
 	"encoding/base64"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	auth1alpha1 "go.pinniped.dev/generated/1.20/apis/concierge/authentication/v1alpha1"
 )
@@ -27,3 +30,11 @@ func CABundle(spec *auth1alpha1.TLSSpec) ([]byte, error) {
 	}
 	return base64.StdEncoding.DecodeString(spec.CertificateAuthorityData)
 }
+
+// ClientCertificateTTL returns the client certificate TTL from the provided spec field, or zero when it is not set.
+func ClientCertificateTTL(ttl *metav1.Duration) time.Duration {
+	if ttl == nil {
+		return 0
+	}
+	return ttl.Duration
+}
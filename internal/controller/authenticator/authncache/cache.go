@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"sort"
 	"sync"
+	"time"
 
 	"k8s.io/apiserver/pkg/authentication/authenticator"
 	"k8s.io/apiserver/pkg/authentication/user"
@@ -42,6 +43,20 @@ type Value interface {
 	authenticator.Token
 }
 
+// ValueWithClientCertificateTTL is a Value whose authenticator resource asks for a specific TTL of the client
+// certificates which are issued to its users. A zero TTL means the default TTL.
+type ValueWithClientCertificateTTL interface {
+	Value
+	ClientCertificateTTL() time.Duration
+}
+
+// ValueWithIdentityMapping is a Value whose authenticator resource changes the usernames and groups of its users
+// before client certificates are issued to them.
+type ValueWithIdentityMapping interface {
+	Value
+	MapIdentity(user.Info) user.Info
+}
+
 // New returns an empty cache.
 func New(apiGroupSuffix string) *Cache {
 	return &Cache{apiGroupSuffix: apiGroupSuffix}
@@ -84,20 +99,13 @@ func (c *Cache) Keys() []Key {
 	return result
 }
 
-func (c *Cache) AuthenticateTokenCredentialRequest(ctx context.Context, req *loginapi.TokenCredentialRequest) (user.Info, error) {
-	// Map the incoming request to a cache key.
-	key := Key{
-		Namespace: req.Namespace,
-		Name:      req.Spec.Authenticator.Name,
-		Kind:      req.Spec.Authenticator.Kind,
-	}
-	if req.Spec.Authenticator.APIGroup != nil {
-		// The key must always be API group pinniped.dev because that's what the cache filler will always use.
-		apiGroup, replaced := groupsuffix.Unreplace(*req.Spec.Authenticator.APIGroup, c.apiGroupSuffix)
-		if !replaced {
-			return nil, ErrNoSuchAuthenticator
-		}
-		key.APIGroup = apiGroup
+// AuthenticateTokenCredentialRequest authenticates the token of the request with its authenticator. Along with the
+// user, it returns the TTL of the client certificates which the authenticator asks for, or zero when it does not ask
+// for a specific TTL.
+func (c *Cache) AuthenticateTokenCredentialRequest(ctx context.Context, req *loginapi.TokenCredentialRequest) (user.Info, time.Duration, error) {
+	key, ok := c.keyForRequest(req)
+	if !ok {
+		return nil, 0, ErrNoSuchAuthenticator
 	}
 
 	val := c.Get(key)
@@ -108,7 +116,7 @@ func (c *Cache) AuthenticateTokenCredentialRequest(ctx context.Context, req *log
 			"kind", key.Kind,
 			"apiGroup", key.APIGroup,
 		)
-		return nil, ErrNoSuchAuthenticator
+		return nil, 0, ErrNoSuchAuthenticator
 	}
 
 	// The incoming context could have an audience. Since we do not want to handle audiences right now, do not pass it
@@ -118,18 +126,43 @@ func (c *Cache) AuthenticateTokenCredentialRequest(ctx context.Context, req *log
 	// Call the selected authenticator.
 	resp, authenticated, err := val.AuthenticateToken(ctx, req.Spec.Token)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	if !authenticated {
-		return nil, nil
+		return nil, 0, nil
 	}
 
-	// Return the user.Info from the response (if it is non-nil).
+	// Return the user.Info from the response (if it is non-nil), as changed by the identity mapping of the authenticator.
 	var respUser user.Info
 	if resp != nil {
 		respUser = resp.User
 	}
-	return respUser, nil
+	if mapper, ok := val.(ValueWithIdentityMapping); ok && respUser != nil {
+		respUser = mapper.MapIdentity(respUser)
+	}
+	var ttl time.Duration
+	if withTTL, ok := val.(ValueWithClientCertificateTTL); ok {
+		ttl = withTTL.ClientCertificateTTL()
+	}
+	return respUser, ttl, nil
+}
+
+// keyForRequest maps the incoming request to a cache key.
+func (c *Cache) keyForRequest(req *loginapi.TokenCredentialRequest) (Key, bool) {
+	key := Key{
+		Namespace: req.Namespace,
+		Name:      req.Spec.Authenticator.Name,
+		Kind:      req.Spec.Authenticator.Kind,
+	}
+	if req.Spec.Authenticator.APIGroup != nil {
+		// The key must always be API group pinniped.dev because that's what the cache filler will always use.
+		apiGroup, replaced := groupsuffix.Unreplace(*req.Spec.Authenticator.APIGroup, c.apiGroupSuffix)
+		if !replaced {
+			return Key{}, false
+		}
+		key.APIGroup = apiGroup
+	}
+	return key, true
 }
 
 type valuelessContext struct{ context.Context }
@@ -105,35 +105,35 @@ func TestAuthenticateTokenCredentialRequest(t *testing.T) {
 
 	t.Run("no such authenticator", func(t *testing.T) {
 		c := New("pinniped.dev")
-		res, err := c.AuthenticateTokenCredentialRequest(context.Background(), validRequest.DeepCopy())
+		res, _, err := c.AuthenticateTokenCredentialRequest(context.Background(), validRequest.DeepCopy())
 		require.EqualError(t, err, "no such authenticator")
 		require.Nil(t, res)
 	})
 
 	t.Run("authenticator returns error", func(t *testing.T) {
 		c := mockCache(t, "pinniped.dev", true, nil, false, fmt.Errorf("some authenticator error"))
-		res, err := c.AuthenticateTokenCredentialRequest(context.Background(), validRequest.DeepCopy())
+		res, _, err := c.AuthenticateTokenCredentialRequest(context.Background(), validRequest.DeepCopy())
 		require.EqualError(t, err, "some authenticator error")
 		require.Nil(t, res)
 	})
 
 	t.Run("authenticator returns unauthenticated without error", func(t *testing.T) {
 		c := mockCache(t, "pinniped.dev", true, &authenticator.Response{}, false, nil)
-		res, err := c.AuthenticateTokenCredentialRequest(context.Background(), validRequest.DeepCopy())
+		res, _, err := c.AuthenticateTokenCredentialRequest(context.Background(), validRequest.DeepCopy())
 		require.NoError(t, err)
 		require.Nil(t, res)
 	})
 
 	t.Run("authenticator returns nil response without error", func(t *testing.T) {
 		c := mockCache(t, "pinniped.dev", true, nil, true, nil)
-		res, err := c.AuthenticateTokenCredentialRequest(context.Background(), validRequest.DeepCopy())
+		res, _, err := c.AuthenticateTokenCredentialRequest(context.Background(), validRequest.DeepCopy())
 		require.NoError(t, err)
 		require.Nil(t, res)
 	})
 
 	t.Run("authenticator returns response with nil user", func(t *testing.T) {
 		c := mockCache(t, "pinniped.dev", true, &authenticator.Response{}, true, nil)
-		res, err := c.AuthenticateTokenCredentialRequest(context.Background(), validRequest.DeepCopy())
+		res, _, err := c.AuthenticateTokenCredentialRequest(context.Background(), validRequest.DeepCopy())
 		require.NoError(t, err)
 		require.Nil(t, res)
 	})
@@ -159,7 +159,7 @@ func TestAuthenticateTokenCredentialRequest(t *testing.T) {
 		ctx, cancel := context.WithCancel(context.Background())
 		errchan := make(chan error)
 		go func() {
-			_, err := c.AuthenticateTokenCredentialRequest(ctx, validRequest.DeepCopy())
+			_, _, err := c.AuthenticateTokenCredentialRequest(ctx, validRequest.DeepCopy())
 			errchan <- err
 		}()
 		cancel()
@@ -176,7 +176,7 @@ func TestAuthenticateTokenCredentialRequest(t *testing.T) {
 		c := mockCache(t, "pinniped.dev", true, &authenticator.Response{User: &userInfo}, true, nil)
 
 		audienceCtx := authenticator.WithAudiences(context.Background(), authenticator.Audiences{"test-audience-1"})
-		res, err := c.AuthenticateTokenCredentialRequest(audienceCtx, validRequest.DeepCopy())
+		res, _, err := c.AuthenticateTokenCredentialRequest(audienceCtx, validRequest.DeepCopy())
 		require.NoError(t, err)
 		require.NotNil(t, res)
 		require.Equal(t, "test-user", res.GetName())
@@ -211,7 +211,7 @@ func TestAuthenticateTokenCredentialRequest(t *testing.T) {
 		c := mockCache(t, "custom-suffix.com", true, &authenticator.Response{User: &userInfo}, true, nil)
 
 		audienceCtx := authenticator.WithAudiences(context.Background(), authenticator.Audiences{"test-audience-1"})
-		res, err := c.AuthenticateTokenCredentialRequest(audienceCtx, validRequestForAlternateAPIGroup.DeepCopy())
+		res, _, err := c.AuthenticateTokenCredentialRequest(audienceCtx, validRequestForAlternateAPIGroup.DeepCopy())
 		require.NoError(t, err)
 		require.NotNil(t, res)
 		require.Equal(t, "test-user", res.GetName())
@@ -224,7 +224,7 @@ func TestAuthenticateTokenCredentialRequest(t *testing.T) {
 		c := mockCache(t, "custom-suffix.com", false, &authenticator.Response{User: &user.DefaultInfo{Name: "someone"}}, true, nil)
 
 		// Note that the validRequest.Spec.Authenticator.APIGroup value uses "pinniped.dev", not "custom-suffix.com"
-		res, err := c.AuthenticateTokenCredentialRequest(context.Background(), validRequest.DeepCopy())
+		res, _, err := c.AuthenticateTokenCredentialRequest(context.Background(), validRequest.DeepCopy())
 		require.EqualError(t, err, "no such authenticator")
 		require.Nil(t, res)
 	})
@@ -244,3 +244,88 @@ func (audienceFreeContext) Matches(in interface{}) bool {
 func (audienceFreeContext) String() string {
 	return "is a context without authenticator audiences"
 }
+
+type tokenWithClientCertificateTTL struct {
+	authenticator.Token
+	ttl time.Duration
+}
+
+func (t *tokenWithClientCertificateTTL) ClientCertificateTTL() time.Duration { return t.ttl }
+
+func TestClientCertificateTTL(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	request := func(name string) *loginapi.TokenCredentialRequest {
+		return &loginapi.TokenCredentialRequest{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test-namespace"},
+			Spec: loginapi.TokenCredentialRequestSpec{
+				Authenticator: corev1.TypedLocalObjectReference{APIGroup: &authv1alpha.SchemeGroupVersion.Group, Kind: "JWTAuthenticator", Name: name},
+				Token:         "test-token",
+			},
+		}
+	}
+	key := func(name string) Key {
+		return Key{APIGroup: authv1alpha.SchemeGroupVersion.Group, Kind: "JWTAuthenticator", Namespace: "test-namespace", Name: name}
+	}
+	authenticatedToken := func() *mocktokenauthenticator.MockToken {
+		m := mocktokenauthenticator.NewMockToken(ctrl)
+		m.EXPECT().AuthenticateToken(audienceFreeContext{}, "test-token").Return(
+			&authenticator.Response{User: &user.DefaultInfo{Name: "test-user"}}, true, nil,
+		)
+		return m
+	}
+
+	c := New("pinniped.dev")
+	c.Store(key("with-ttl"), &tokenWithClientCertificateTTL{Token: authenticatedToken(), ttl: time.Hour})
+	c.Store(key("without-ttl"), authenticatedToken())
+
+	res, ttl, err := c.AuthenticateTokenCredentialRequest(context.Background(), request("with-ttl"))
+	require.NoError(t, err)
+	require.Equal(t, "test-user", res.GetName())
+	require.Equal(t, time.Hour, ttl)
+
+	res, ttl, err = c.AuthenticateTokenCredentialRequest(context.Background(), request("without-ttl"))
+	require.NoError(t, err)
+	require.Equal(t, "test-user", res.GetName())
+	require.Zero(t, ttl)
+}
+
+type tokenWithIdentityMapping struct {
+	authenticator.Token
+	usernamePrefix string
+}
+
+func (t *tokenWithIdentityMapping) MapIdentity(info user.Info) user.Info {
+	return &user.DefaultInfo{Name: t.usernamePrefix + info.GetName(), Groups: info.GetGroups()}
+}
+
+func TestAuthenticateTokenCredentialRequestWithIdentityMapping(t *testing.T) {
+	t.Parallel()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	request := &loginapi.TokenCredentialRequest{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test-namespace"},
+		Spec: loginapi.TokenCredentialRequestSpec{
+			Authenticator: corev1.TypedLocalObjectReference{APIGroup: &authv1alpha.SchemeGroupVersion.Group, Kind: "JWTAuthenticator", Name: "test-name"},
+			Token:         "test-token",
+		},
+	}
+	key := Key{APIGroup: authv1alpha.SchemeGroupVersion.Group, Kind: "JWTAuthenticator", Namespace: "test-namespace", Name: "test-name"}
+
+	m := mocktokenauthenticator.NewMockToken(ctrl)
+	m.EXPECT().AuthenticateToken(audienceFreeContext{}, "test-token").Return(
+		&authenticator.Response{User: &user.DefaultInfo{Name: "admin", Groups: []string{"some-group"}}}, true, nil,
+	)
+
+	c := New("pinniped.dev")
+	c.Store(key, &tokenWithIdentityMapping{Token: m, usernamePrefix: "some-prefix:"})
+
+	res, _, err := c.AuthenticateTokenCredentialRequest(context.Background(), request)
+	require.NoError(t, err)
+	require.Equal(t, &user.DefaultInfo{Name: "some-prefix:admin", Groups: []string{"some-group"}}, res)
+}
@@ -0,0 +1,100 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package authenticator
+
+import (
+	"fmt"
+	"regexp"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+
+	auth1alpha1 "go.pinniped.dev/generated/1.20/apis/concierge/authentication/v1alpha1"
+)
+
+// IdentityMapping changes the usernames and groups of the users of an authenticator as configured by its
+// IdentityMappingSpec. The zero value leaves identities unchanged.
+type IdentityMapping struct {
+	usernamePrefix string
+	groupsPrefix   string
+	groupFilter    *regexp.Regexp
+	groupRenames   map[string]string
+}
+
+// NewIdentityMapping returns the IdentityMapping of the provided spec. If the provided spec is nil, a mapping which
+// leaves identities unchanged will be returned. If the group filter of the provided spec is not a valid regular
+// expression, or a group is renamed more than once, an error will be returned.
+func NewIdentityMapping(spec *auth1alpha1.IdentityMappingSpec) (*IdentityMapping, error) {
+	if spec == nil {
+		return &IdentityMapping{}, nil
+	}
+
+	m := &IdentityMapping{
+		usernamePrefix: spec.UsernamePrefix,
+		groupsPrefix:   spec.GroupsPrefix,
+	}
+
+	if spec.GroupFilter != "" {
+		groupFilter, err := regexp.Compile(spec.GroupFilter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid group filter: %w", err)
+		}
+		m.groupFilter = groupFilter
+	}
+
+	if len(spec.GroupRenames) > 0 {
+		m.groupRenames = make(map[string]string, len(spec.GroupRenames))
+		for _, rename := range spec.GroupRenames {
+			if _, ok := m.groupRenames[rename.From]; ok {
+				return nil, fmt.Errorf("group %q is renamed more than once", rename.From)
+			}
+			m.groupRenames[rename.From] = rename.To
+		}
+	}
+
+	return m, nil
+}
+
+// UsernamePrefix returns the prefix which is prepended to usernames.
+func (m *IdentityMapping) UsernamePrefix() string {
+	return m.usernamePrefix
+}
+
+// GroupsPrefix returns the prefix which is prepended to group names.
+func (m *IdentityMapping) GroupsPrefix() string {
+	return m.groupsPrefix
+}
+
+// Map returns a copy of the provided user.Info whose username and groups have been changed by this mapping. Groups
+// are first filtered by their original names, then renamed, and then prefixed. An empty username is left empty, so
+// that users without a username are still rejected.
+func (m *IdentityMapping) Map(info user.Info) user.Info {
+	username := info.GetName()
+	if username != "" {
+		username = m.usernamePrefix + username
+	}
+
+	var groups []string
+	seen := map[string]bool{}
+	for _, group := range info.GetGroups() {
+		if m.groupFilter != nil && !m.groupFilter.MatchString(group) {
+			continue
+		}
+		if renamed, ok := m.groupRenames[group]; ok {
+			group = renamed
+		}
+		group = m.groupsPrefix + group
+		if seen[group] {
+			continue
+		}
+		seen[group] = true
+		groups = append(groups, group)
+	}
+
+	return &user.DefaultInfo{
+		Name:   username,
+		UID:    info.GetUID(),
+		Groups: groups,
+		Extra:  info.GetExtra(),
+	}
+}
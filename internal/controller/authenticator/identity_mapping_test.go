@@ -0,0 +1,134 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package authenticator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/apiserver/pkg/authentication/user"
+
+	auth1alpha1 "go.pinniped.dev/generated/1.20/apis/concierge/authentication/v1alpha1"
+)
+
+func TestIdentityMapping(t *testing.T) {
+	t.Parallel()
+
+	testUser := &user.DefaultInfo{
+		Name:   "admin",
+		UID:    "some-uid",
+		Groups: []string{"k8s-admins", "k8s-devs", "everyone"},
+		Extra:  map[string][]string{"some-key": {"some-value"}},
+	}
+
+	tests := []struct {
+		name               string
+		spec               *auth1alpha1.IdentityMappingSpec
+		user               user.Info
+		wantErr            string
+		wantUser           user.Info
+		wantUsernamePrefix string
+		wantGroupsPrefix   string
+	}{
+		{
+			name: "nil spec",
+			user: testUser,
+			wantUser: &user.DefaultInfo{
+				Name:   "admin",
+				UID:    "some-uid",
+				Groups: []string{"k8s-admins", "k8s-devs", "everyone"},
+				Extra:  map[string][]string{"some-key": {"some-value"}},
+			},
+		},
+		{
+			name: "prefixes",
+			spec: &auth1alpha1.IdentityMappingSpec{UsernamePrefix: "idp:", GroupsPrefix: "idp-group:"},
+			user: testUser,
+			wantUser: &user.DefaultInfo{
+				Name:   "idp:admin",
+				UID:    "some-uid",
+				Groups: []string{"idp-group:k8s-admins", "idp-group:k8s-devs", "idp-group:everyone"},
+				Extra:  map[string][]string{"some-key": {"some-value"}},
+			},
+			wantUsernamePrefix: "idp:",
+			wantGroupsPrefix:   "idp-group:",
+		},
+		{
+			name: "empty username is not prefixed",
+			spec: &auth1alpha1.IdentityMappingSpec{UsernamePrefix: "idp:"},
+			user: &user.DefaultInfo{Groups: []string{"some-group"}},
+			wantUser: &user.DefaultInfo{
+				Groups: []string{"some-group"},
+			},
+			wantUsernamePrefix: "idp:",
+		},
+		{
+			name: "filter, rename and prefix",
+			spec: &auth1alpha1.IdentityMappingSpec{
+				GroupsPrefix: "idp:",
+				GroupFilter:  "^k8s-",
+				GroupRenames: []auth1alpha1.GroupRename{
+					{From: "k8s-admins", To: "admins"},
+					{From: "everyone", To: "k8s-everyone"},
+				},
+			},
+			user: testUser,
+			wantUser: &user.DefaultInfo{
+				Name:   "admin",
+				UID:    "some-uid",
+				Groups: []string{"idp:admins", "idp:k8s-devs"},
+				Extra:  map[string][]string{"some-key": {"some-value"}},
+			},
+			wantGroupsPrefix: "idp:",
+		},
+		{
+			name: "renames which collide are deduplicated",
+			spec: &auth1alpha1.IdentityMappingSpec{
+				GroupRenames: []auth1alpha1.GroupRename{
+					{From: "k8s-admins", To: "devs"},
+					{From: "k8s-devs", To: "devs"},
+				},
+			},
+			user: testUser,
+			wantUser: &user.DefaultInfo{
+				Name:   "admin",
+				UID:    "some-uid",
+				Groups: []string{"devs", "everyone"},
+				Extra:  map[string][]string{"some-key": {"some-value"}},
+			},
+		},
+		{
+			name:    "invalid group filter",
+			spec:    &auth1alpha1.IdentityMappingSpec{GroupFilter: "("},
+			wantErr: "invalid group filter: error parsing regexp: missing closing ): `(`",
+		},
+		{
+			name: "group renamed more than once",
+			spec: &auth1alpha1.IdentityMappingSpec{
+				GroupRenames: []auth1alpha1.GroupRename{
+					{From: "some-group", To: "some-new-group"},
+					{From: "some-group", To: "some-other-new-group"},
+				},
+			},
+			wantErr: `group "some-group" is renamed more than once`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			mapping, err := NewIdentityMapping(tt.spec)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				require.Nil(t, mapping)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantUsernamePrefix, mapping.UsernamePrefix())
+			require.Equal(t, tt.wantGroupsPrefix, mapping.GroupsPrefix())
+			require.Equal(t, tt.wantUser, mapping.Map(tt.user))
+		})
+	}
+}
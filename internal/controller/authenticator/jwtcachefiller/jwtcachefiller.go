@@ -6,19 +6,24 @@
 package jwtcachefiller
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"reflect"
+	"time"
 
 	"github.com/go-logr/logr"
 	"gopkg.in/square/go-jose.v2"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
 	"k8s.io/apiserver/plugin/pkg/authenticator/token/oidc"
 	"k8s.io/klog/v2"
 
 	auth1alpha1 "go.pinniped.dev/generated/1.20/apis/concierge/authentication/v1alpha1"
+	pinnipedclientset "go.pinniped.dev/generated/1.20/client/concierge/clientset/versioned"
 	authinformers "go.pinniped.dev/generated/1.20/client/concierge/informers/externalversions/authentication/v1alpha1"
 	pinnipedcontroller "go.pinniped.dev/internal/controller"
 	pinnipedauthenticator "go.pinniped.dev/internal/controller/authenticator"
@@ -54,12 +59,29 @@ type tokenAuthenticatorCloser interface {
 
 type jwtAuthenticator struct {
 	tokenAuthenticatorCloser
-	spec *auth1alpha1.JWTAuthenticatorSpec
+	spec            *auth1alpha1.JWTAuthenticatorSpec
+	identityMapping *pinnipedauthenticator.IdentityMapping
+}
+
+var (
+	_ authncache.ValueWithClientCertificateTTL = (*jwtAuthenticator)(nil)
+	_ authncache.ValueWithIdentityMapping      = (*jwtAuthenticator)(nil)
+)
+
+// ClientCertificateTTL returns the client certificate TTL of the JWTAuthenticator.
+func (a *jwtAuthenticator) ClientCertificateTTL() time.Duration {
+	return pinnipedauthenticator.ClientCertificateTTL(a.spec.ClientCertificateTTL)
+}
+
+// MapIdentity applies the identity mapping of the JWTAuthenticator.
+func (a *jwtAuthenticator) MapIdentity(info user.Info) user.Info {
+	return a.identityMapping.Map(info)
 }
 
 // New instantiates a new controllerlib.Controller which will populate the provided authncache.Cache.
 func New(
 	cache *authncache.Cache,
+	client pinnipedclientset.Interface,
 	jwtAuthenticators authinformers.JWTAuthenticatorInformer,
 	log logr.Logger,
 ) controllerlib.Controller {
@@ -68,6 +90,7 @@ func New(
 			Name: "jwtcachefiller-controller",
 			Syncer: &controller{
 				cache:             cache,
+				client:            client,
 				jwtAuthenticators: jwtAuthenticators,
 				log:               log.WithName("jwtcachefiller-controller"),
 			},
@@ -82,6 +105,7 @@ func New(
 
 type controller struct {
 	cache             *authncache.Cache
+	client            pinnipedclientset.Interface
 	jwtAuthenticators authinformers.JWTAuthenticatorInformer
 	log               logr.Logger
 }
@@ -114,7 +138,7 @@ func (c *controller) Sync(ctx controllerlib.Context) error {
 		if jwtAuthenticator != nil {
 			if reflect.DeepEqual(jwtAuthenticator.spec, &obj.Spec) {
 				c.log.WithValues("jwtAuthenticator", klog.KObj(obj), "issuer", obj.Spec.Issuer).Info("actual jwt authenticator and desired jwt authenticator are the same")
-				return nil
+				return c.updateStatus(ctx.Context, obj, jwtAuthenticator.identityMapping)
 			}
 			jwtAuthenticator.Close()
 		}
@@ -129,6 +153,21 @@ func (c *controller) Sync(ctx controllerlib.Context) error {
 
 	c.cache.Store(cacheKey, jwtAuthenticator)
 	c.log.WithValues("jwtAuthenticator", klog.KObj(obj), "issuer", obj.Spec.Issuer).Info("added new jwt authenticator")
+	return c.updateStatus(ctx.Context, obj, jwtAuthenticator.identityMapping)
+}
+
+// updateStatus reports the prefixes of the identity mapping which is applied to the users of the JWTAuthenticator.
+func (c *controller) updateStatus(ctx context.Context, obj *auth1alpha1.JWTAuthenticator, identityMapping *pinnipedauthenticator.IdentityMapping) error {
+	if obj.Status.UsernamePrefix == identityMapping.UsernamePrefix() && obj.Status.GroupsPrefix == identityMapping.GroupsPrefix() {
+		return nil
+	}
+
+	updated := obj.DeepCopy()
+	updated.Status.UsernamePrefix = identityMapping.UsernamePrefix()
+	updated.Status.GroupsPrefix = identityMapping.GroupsPrefix()
+	if _, err := c.client.AuthenticationV1alpha1().JWTAuthenticators(obj.Namespace).Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update status of JWTAuthenticator %s/%s: %w", obj.Namespace, obj.Name, err)
+	}
 	return nil
 }
 
@@ -147,6 +186,11 @@ func (c *controller) extractValueAsJWTAuthenticator(value authncache.Value) *jwt
 
 // newJWTAuthenticator creates a jwt authenticator from the provided spec.
 func newJWTAuthenticator(spec *auth1alpha1.JWTAuthenticatorSpec) (*jwtAuthenticator, error) {
+	identityMapping, err := pinnipedauthenticator.NewIdentityMapping(spec.IdentityMapping)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity mapping: %w", err)
+	}
+
 	caBundle, err := pinnipedauthenticator.CABundle(spec.TLS)
 	if err != nil {
 		return nil, fmt.Errorf("invalid TLS configuration: %w", err)
@@ -193,5 +237,6 @@ func newJWTAuthenticator(spec *auth1alpha1.JWTAuthenticatorSpec) (*jwtAuthentica
 	return &jwtAuthenticator{
 		tokenAuthenticatorCloser: authenticator,
 		spec:                     spec,
+		identityMapping:          identityMapping,
 	}, nil
 }
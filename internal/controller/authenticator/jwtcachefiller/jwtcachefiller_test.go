@@ -31,6 +31,7 @@ import (
 	auth1alpha1 "go.pinniped.dev/generated/1.20/apis/concierge/authentication/v1alpha1"
 	pinnipedfake "go.pinniped.dev/generated/1.20/client/concierge/clientset/versioned/fake"
 	pinnipedinformers "go.pinniped.dev/generated/1.20/client/concierge/informers/externalversions"
+	pinnipedauthenticator "go.pinniped.dev/internal/controller/authenticator"
 	"go.pinniped.dev/internal/controller/authenticator/authncache"
 	"go.pinniped.dev/internal/controllerlib"
 	"go.pinniped.dev/internal/mocks/mocktokenauthenticatorcloser"
@@ -119,6 +120,19 @@ func TestController(t *testing.T) {
 		Audience: goodAudience,
 		TLS:      &auth1alpha1.TLSSpec{CertificateAuthorityData: "invalid base64-encoded data"},
 	}
+	identityMappingJWTAuthenticatorSpec := &auth1alpha1.JWTAuthenticatorSpec{
+		Issuer:   goodIssuer,
+		Audience: goodAudience,
+		IdentityMapping: &auth1alpha1.IdentityMappingSpec{
+			UsernamePrefix: "some-username-prefix:",
+			GroupsPrefix:   "some-groups-prefix:",
+		},
+	}
+	invalidIdentityMappingJWTAuthenticatorSpec := &auth1alpha1.JWTAuthenticatorSpec{
+		Issuer:          goodIssuer,
+		Audience:        goodAudience,
+		IdentityMapping: &auth1alpha1.IdentityMappingSpec{GroupFilter: "("},
+	}
 
 	tests := []struct {
 		name                             string
@@ -129,6 +143,7 @@ func TestController(t *testing.T) {
 		wantErr                          string
 		wantLogs                         []string
 		wantCacheEntries                 int
+		wantStatus                       *auth1alpha1.JWTAuthenticatorStatus
 		wantUsernameClaim                string
 		wantGroupsClaim                  string
 		runTestsOnResultingAuthenticator bool
@@ -318,6 +333,43 @@ func TestController(t *testing.T) {
 			},
 			wantErr: "failed to build jwt authenticator: invalid TLS configuration: illegal base64 data at input byte 7",
 		},
+		{
+			name:    "valid jwt authenticator with identity mapping",
+			syncKey: controllerlib.Key{Namespace: "test-namespace", Name: "test-name"},
+			jwtAuthenticators: []runtime.Object{
+				&auth1alpha1.JWTAuthenticator{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: "test-namespace",
+						Name:      "test-name",
+					},
+					Spec: *identityMappingJWTAuthenticatorSpec,
+				},
+			},
+			wantLogs: []string{
+				`jwtcachefiller-controller "level"=0 "msg"="added new jwt authenticator" "issuer"="` + goodIssuer + `" "jwtAuthenticator"={"name":"test-name","namespace":"test-namespace"}`,
+			},
+			wantCacheEntries: 1,
+			wantStatus: &auth1alpha1.JWTAuthenticatorStatus{
+				UsernamePrefix: "some-username-prefix:",
+				GroupsPrefix:   "some-groups-prefix:",
+			},
+			runTestsOnResultingAuthenticator: false, // skip the tests because the authenticator left in the cache doesn't have the CA for our test discovery server
+		},
+		{
+			name:    "invalid jwt authenticator identity mapping",
+			syncKey: controllerlib.Key{Namespace: "test-namespace", Name: "test-name"},
+			jwtAuthenticators: []runtime.Object{
+				&auth1alpha1.JWTAuthenticator{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: "test-namespace",
+						Name:      "test-name",
+					},
+					Spec: *invalidIdentityMappingJWTAuthenticatorSpec,
+				},
+			},
+			wantErr:    "failed to build jwt authenticator: invalid identity mapping: invalid group filter: error parsing regexp: missing closing ): `(`",
+			wantStatus: &auth1alpha1.JWTAuthenticatorStatus{},
+		},
 	}
 
 	for _, tt := range tests {
@@ -334,7 +386,7 @@ func TestController(t *testing.T) {
 				tt.cache(t, cache, tt.wantClose)
 			}
 
-			controller := New(cache, informers.Authentication().V1alpha1().JWTAuthenticators(), testLog)
+			controller := New(cache, fakeClient, informers.Authentication().V1alpha1().JWTAuthenticators(), testLog)
 
 			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 			defer cancel()
@@ -352,6 +404,12 @@ func TestController(t *testing.T) {
 			require.Equal(t, tt.wantLogs, testLog.Lines())
 			require.Equal(t, tt.wantCacheEntries, len(cache.Keys()))
 
+			if tt.wantStatus != nil {
+				jwtAuthenticator, err := fakeClient.AuthenticationV1alpha1().JWTAuthenticators(tt.syncKey.Namespace).Get(ctx, tt.syncKey.Name, metav1.GetOptions{})
+				require.NoError(t, err)
+				require.Equal(t, *tt.wantStatus, jwtAuthenticator.Status)
+			}
+
 			if !tt.runTestsOnResultingAuthenticator {
 				return // end of test unless we wanted to run tests on the resulting authenticator from the cache
 			}
@@ -455,6 +513,32 @@ func TestController(t *testing.T) {
 	}
 }
 
+func TestClientCertificateTTL(t *testing.T) {
+	withoutTTL := newCacheValue(t, auth1alpha1.JWTAuthenticatorSpec{}, false)
+	require.Zero(t, withoutTTL.(authncache.ValueWithClientCertificateTTL).ClientCertificateTTL())
+
+	withTTL := newCacheValue(t, auth1alpha1.JWTAuthenticatorSpec{
+		ClientCertificateTTL: &metav1.Duration{Duration: 30 * time.Minute},
+	}, false)
+	require.Equal(t, 30*time.Minute, withTTL.(authncache.ValueWithClientCertificateTTL).ClientCertificateTTL())
+}
+
+func TestMapIdentity(t *testing.T) {
+	withoutMapping := newCacheValue(t, auth1alpha1.JWTAuthenticatorSpec{}, false)
+	require.Equal(t,
+		&user.DefaultInfo{Name: "some-username", Groups: []string{"some-group"}},
+		withoutMapping.(authncache.ValueWithIdentityMapping).MapIdentity(&user.DefaultInfo{Name: "some-username", Groups: []string{"some-group"}}),
+	)
+
+	withMapping := newCacheValue(t, auth1alpha1.JWTAuthenticatorSpec{
+		IdentityMapping: &auth1alpha1.IdentityMappingSpec{UsernamePrefix: "some-username-prefix:", GroupsPrefix: "some-groups-prefix:"},
+	}, false)
+	require.Equal(t,
+		&user.DefaultInfo{Name: "some-username-prefix:some-username", Groups: []string{"some-groups-prefix:some-group"}},
+		withMapping.(authncache.ValueWithIdentityMapping).MapIdentity(&user.DefaultInfo{Name: "some-username", Groups: []string{"some-group"}}),
+	)
+}
+
 func testTableForAuthenticateTokenTests(
 	t *testing.T,
 	goodRSASigningKey *rsa.PrivateKey,
@@ -682,8 +766,12 @@ func newCacheValue(t *testing.T, spec auth1alpha1.JWTAuthenticatorSpec, wantClos
 	}
 	tokenAuthenticatorCloser.EXPECT().Close().Times(wantCloses)
 
+	identityMapping, err := pinnipedauthenticator.NewIdentityMapping(spec.IdentityMapping)
+	require.NoError(t, err)
+
 	return &jwtAuthenticator{
 		tokenAuthenticatorCloser: tokenAuthenticatorCloser,
 		spec:                     &spec,
+		identityMapping:          identityMapping,
 	}
 }
@@ -5,21 +5,26 @@
 package webhookcachefiller
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"time"
 
 	"github.com/go-logr/logr"
 	k8sauthv1beta1 "k8s.io/api/authentication/v1beta1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/net"
 	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
 	"k8s.io/apiserver/plugin/pkg/authenticator/token/webhook"
 	"k8s.io/client-go/tools/clientcmd"
 	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 	"k8s.io/klog/v2"
 
 	auth1alpha1 "go.pinniped.dev/generated/1.20/apis/concierge/authentication/v1alpha1"
+	pinnipedclientset "go.pinniped.dev/generated/1.20/client/concierge/clientset/versioned"
 	authinformers "go.pinniped.dev/generated/1.20/client/concierge/informers/externalversions/authentication/v1alpha1"
 	pinnipedcontroller "go.pinniped.dev/internal/controller"
 	pinnipedauthenticator "go.pinniped.dev/internal/controller/authenticator"
@@ -28,12 +33,13 @@ import (
 )
 
 // New instantiates a new controllerlib.Controller which will populate the provided authncache.Cache.
-func New(cache *authncache.Cache, webhooks authinformers.WebhookAuthenticatorInformer, log logr.Logger) controllerlib.Controller {
+func New(cache *authncache.Cache, client pinnipedclientset.Interface, webhooks authinformers.WebhookAuthenticatorInformer, log logr.Logger) controllerlib.Controller {
 	return controllerlib.New(
 		controllerlib.Config{
 			Name: "webhookcachefiller-controller",
 			Syncer: &controller{
 				cache:    cache,
+				client:   client,
 				webhooks: webhooks,
 				log:      log.WithName("webhookcachefiller-controller"),
 			},
@@ -46,8 +52,32 @@ func New(cache *authncache.Cache, webhooks authinformers.WebhookAuthenticatorInf
 	)
 }
 
+// webhookAuthenticator is a webhook token authenticator which also knows the client certificate TTL and the identity
+// mapping of its WebhookAuthenticator.
+type webhookAuthenticator struct {
+	*webhook.WebhookTokenAuthenticator
+	clientCertificateTTL time.Duration
+	identityMapping      *pinnipedauthenticator.IdentityMapping
+}
+
+var (
+	_ authncache.ValueWithClientCertificateTTL = (*webhookAuthenticator)(nil)
+	_ authncache.ValueWithIdentityMapping      = (*webhookAuthenticator)(nil)
+)
+
+// ClientCertificateTTL returns the client certificate TTL of the WebhookAuthenticator.
+func (a *webhookAuthenticator) ClientCertificateTTL() time.Duration {
+	return a.clientCertificateTTL
+}
+
+// MapIdentity applies the identity mapping of the WebhookAuthenticator.
+func (a *webhookAuthenticator) MapIdentity(info user.Info) user.Info {
+	return a.identityMapping.Map(info)
+}
+
 type controller struct {
 	cache    *authncache.Cache
+	client   pinnipedclientset.Interface
 	webhooks authinformers.WebhookAuthenticatorInformer
 	log      logr.Logger
 }
@@ -63,7 +93,12 @@ func (c *controller) Sync(ctx controllerlib.Context) error {
 		return fmt.Errorf("failed to get WebhookAuthenticator %s/%s: %w", ctx.Key.Namespace, ctx.Key.Name, err)
 	}
 
-	webhookAuthenticator, err := newWebhookAuthenticator(&obj.Spec, ioutil.TempFile, clientcmd.WriteToFile)
+	identityMapping, err := pinnipedauthenticator.NewIdentityMapping(obj.Spec.IdentityMapping)
+	if err != nil {
+		return fmt.Errorf("invalid identity mapping: %w", err)
+	}
+
+	tokenAuthenticator, err := newWebhookAuthenticator(&obj.Spec, ioutil.TempFile, clientcmd.WriteToFile)
 	if err != nil {
 		return fmt.Errorf("failed to build webhook config: %w", err)
 	}
@@ -73,8 +108,27 @@ func (c *controller) Sync(ctx controllerlib.Context) error {
 		Kind:      "WebhookAuthenticator",
 		Namespace: ctx.Key.Namespace,
 		Name:      ctx.Key.Name,
-	}, webhookAuthenticator)
+	}, &webhookAuthenticator{
+		WebhookTokenAuthenticator: tokenAuthenticator,
+		clientCertificateTTL:      pinnipedauthenticator.ClientCertificateTTL(obj.Spec.ClientCertificateTTL),
+		identityMapping:           identityMapping,
+	})
 	c.log.WithValues("webhook", klog.KObj(obj), "endpoint", obj.Spec.Endpoint).Info("added new webhook authenticator")
+	return c.updateStatus(ctx.Context, obj, identityMapping)
+}
+
+// updateStatus reports the prefixes of the identity mapping which is applied to the users of the WebhookAuthenticator.
+func (c *controller) updateStatus(ctx context.Context, obj *auth1alpha1.WebhookAuthenticator, identityMapping *pinnipedauthenticator.IdentityMapping) error {
+	if obj.Status.UsernamePrefix == identityMapping.UsernamePrefix() && obj.Status.GroupsPrefix == identityMapping.GroupsPrefix() {
+		return nil
+	}
+
+	updated := obj.DeepCopy()
+	updated.Status.UsernamePrefix = identityMapping.UsernamePrefix()
+	updated.Status.GroupsPrefix = identityMapping.GroupsPrefix()
+	if _, err := c.client.AuthenticationV1alpha1().WebhookAuthenticators(obj.Namespace).Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update status of WebhookAuthenticator %s/%s: %w", obj.Namespace, obj.Name, err)
+	}
 	return nil
 }
 
@@ -16,6 +16,7 @@ import (
 	"github.com/stretchr/testify/require"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/authentication/user"
 	"k8s.io/client-go/tools/clientcmd"
 	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 
@@ -32,12 +33,15 @@ func TestController(t *testing.T) {
 	t.Parallel()
 
 	tests := []struct {
-		name             string
-		syncKey          controllerlib.Key
-		webhooks         []runtime.Object
-		wantErr          string
-		wantLogs         []string
-		wantCacheEntries int
+		name                     string
+		syncKey                  controllerlib.Key
+		webhooks                 []runtime.Object
+		wantErr                  string
+		wantLogs                 []string
+		wantCacheEntries         int
+		wantClientCertificateTTL time.Duration
+		wantStatus               *auth1alpha1.WebhookAuthenticatorStatus
+		wantMappedUser           user.Info
 	}{
 		{
 			name:    "not found",
@@ -82,6 +86,73 @@ func TestController(t *testing.T) {
 			},
 			wantCacheEntries: 1,
 		},
+		{
+			name:    "valid webhook with a client certificate TTL",
+			syncKey: controllerlib.Key{Namespace: "test-namespace", Name: "test-name"},
+			webhooks: []runtime.Object{
+				&auth1alpha1.WebhookAuthenticator{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: "test-namespace",
+						Name:      "test-name",
+					},
+					Spec: auth1alpha1.WebhookAuthenticatorSpec{
+						Endpoint:             "https://example.com",
+						ClientCertificateTTL: &metav1.Duration{Duration: time.Hour},
+					},
+				},
+			},
+			wantLogs: []string{
+				`webhookcachefiller-controller "level"=0 "msg"="added new webhook authenticator" "endpoint"="https://example.com" "webhook"={"name":"test-name","namespace":"test-namespace"}`,
+			},
+			wantCacheEntries:         1,
+			wantClientCertificateTTL: time.Hour,
+		},
+		{
+			name:    "valid webhook with an identity mapping",
+			syncKey: controllerlib.Key{Namespace: "test-namespace", Name: "test-name"},
+			webhooks: []runtime.Object{
+				&auth1alpha1.WebhookAuthenticator{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: "test-namespace",
+						Name:      "test-name",
+					},
+					Spec: auth1alpha1.WebhookAuthenticatorSpec{
+						Endpoint: "https://example.com",
+						IdentityMapping: &auth1alpha1.IdentityMappingSpec{
+							UsernamePrefix: "some-username-prefix:",
+							GroupsPrefix:   "some-groups-prefix:",
+						},
+					},
+				},
+			},
+			wantLogs: []string{
+				`webhookcachefiller-controller "level"=0 "msg"="added new webhook authenticator" "endpoint"="https://example.com" "webhook"={"name":"test-name","namespace":"test-namespace"}`,
+			},
+			wantCacheEntries: 1,
+			wantStatus: &auth1alpha1.WebhookAuthenticatorStatus{
+				UsernamePrefix: "some-username-prefix:",
+				GroupsPrefix:   "some-groups-prefix:",
+			},
+			wantMappedUser: &user.DefaultInfo{Name: "some-username-prefix:some-username", Groups: []string{"some-groups-prefix:some-group"}},
+		},
+		{
+			name:    "invalid identity mapping",
+			syncKey: controllerlib.Key{Namespace: "test-namespace", Name: "test-name"},
+			webhooks: []runtime.Object{
+				&auth1alpha1.WebhookAuthenticator{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: "test-namespace",
+						Name:      "test-name",
+					},
+					Spec: auth1alpha1.WebhookAuthenticatorSpec{
+						Endpoint:        "https://example.com",
+						IdentityMapping: &auth1alpha1.IdentityMappingSpec{GroupFilter: "("},
+					},
+				},
+			},
+			wantErr:    "invalid identity mapping: invalid group filter: error parsing regexp: missing closing ): `(`",
+			wantStatus: &auth1alpha1.WebhookAuthenticatorStatus{},
+		},
 	}
 	for _, tt := range tests {
 		tt := tt
@@ -93,7 +164,7 @@ func TestController(t *testing.T) {
 			cache := authncache.New("pinniped.dev")
 			testLog := testlogger.New(t)
 
-			controller := New(cache, informers.Authentication().V1alpha1().WebhookAuthenticators(), testLog)
+			controller := New(cache, fakeClient, informers.Authentication().V1alpha1().WebhookAuthenticators(), testLog)
 
 			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 			defer cancel()
@@ -110,6 +181,25 @@ func TestController(t *testing.T) {
 			}
 			require.Equal(t, tt.wantLogs, testLog.Lines())
 			require.Equal(t, tt.wantCacheEntries, len(cache.Keys()))
+			for _, key := range cache.Keys() {
+				value, ok := cache.Get(key).(authncache.ValueWithClientCertificateTTL)
+				require.True(t, ok)
+				require.Equal(t, tt.wantClientCertificateTTL, value.ClientCertificateTTL())
+			}
+
+			if tt.wantStatus != nil {
+				webhook, err := fakeClient.AuthenticationV1alpha1().WebhookAuthenticators(tt.syncKey.Namespace).Get(ctx, tt.syncKey.Name, metav1.GetOptions{})
+				require.NoError(t, err)
+				require.Equal(t, *tt.wantStatus, webhook.Status)
+			}
+
+			if tt.wantMappedUser != nil {
+				for _, key := range cache.Keys() {
+					value, ok := cache.Get(key).(authncache.ValueWithIdentityMapping)
+					require.True(t, ok)
+					require.Equal(t, tt.wantMappedUser, value.MapIdentity(&user.DefaultInfo{Name: "some-username", Groups: []string{"some-group"}}))
+				}
+			}
 		})
 	}
 }
@@ -0,0 +1,526 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package impersonatorconfig contains a controller which runs the impersonation proxy of the Concierge when it is
+// needed, and which publishes how to connect to it in the CredentialIssuer.
+package impersonatorconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	corev1informers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+
+	configv1alpha1 "go.pinniped.dev/generated/1.20/apis/concierge/config/v1alpha1"
+	pinnipedclientset "go.pinniped.dev/generated/1.20/client/concierge/clientset/versioned"
+	"go.pinniped.dev/internal/certauthority"
+	"go.pinniped.dev/internal/config/concierge"
+	pinnipedcontroller "go.pinniped.dev/internal/controller"
+	"go.pinniped.dev/internal/controller/issuerconfig"
+	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/dynamiccert"
+	"go.pinniped.dev/internal/plog"
+)
+
+const (
+	// ListenPort is the port on which the impersonation proxy listens in the Concierge pods.
+	ListenPort = 8444
+
+	caCertificateSecretKey = "ca.crt"
+
+	// certDuration is the lifetime of the CAs and the serving certificate of the impersonation proxy.
+	certDuration = 365 * 24 * time.Hour
+	// certRenewBefore is how long before their expiry the certificates are replaced.
+	certRenewBefore = 30 * 24 * time.Hour
+
+	controlPlaneNodeRoleLabel = "node-role.kubernetes.io/control-plane"
+	masterNodeRoleLabel       = "node-role.kubernetes.io/master"
+)
+
+type impersonatorConfigController struct {
+	namespace                    string
+	credentialIssuerResourceName string
+	labels                       map[string]string
+	mode                         concierge.ImpersonationProxyMode
+	externalEndpoint             string
+	loadBalancerServiceName      string
+	loadBalancerServiceSelector  map[string]string
+	tlsSecretName                string
+	signerSecretName             string
+	listenAddress                string
+	k8sClient                    kubernetes.Interface
+	pinnipedAPIClient            pinnipedclientset.Interface
+	nodesInformer                corev1informers.NodeInformer
+	servicesInformer             corev1informers.ServiceInformer
+	secretsInformer              corev1informers.SecretInformer
+	signerCertProvider           dynamiccert.Provider
+	newHandler                   func() (http.Handler, error)
+	clock                        clock.Clock
+
+	// servingCertProvider holds the serving certificate of the running impersonation proxy.
+	servingCertProvider dynamiccert.Provider
+	// server is the running impersonation proxy, or nil when it is not running.
+	server *http.Server
+}
+
+// NewImpersonatorConfigController returns a controller which starts and stops the impersonation proxy according to
+// its mode, and which manages its load balancer Service, its serving certificate and the CA which issues the client
+// certificates that it accepts. The CA is loaded into signerCertProvider while the impersonation proxy runs. The
+// controller reports the status of the impersonation proxy as a strategy of the CredentialIssuer.
+func NewImpersonatorConfigController(
+	namespace string,
+	credentialIssuerResourceName string,
+	labels map[string]string,
+	mode concierge.ImpersonationProxyMode,
+	externalEndpoint string,
+	loadBalancerServiceName string,
+	loadBalancerServiceSelector map[string]string,
+	tlsSecretName string,
+	signerSecretName string,
+	listenAddress string,
+	k8sClient kubernetes.Interface,
+	pinnipedAPIClient pinnipedclientset.Interface,
+	nodesInformer corev1informers.NodeInformer,
+	servicesInformer corev1informers.ServiceInformer,
+	secretsInformer corev1informers.SecretInformer,
+	withInformer pinnipedcontroller.WithInformerOptionFunc,
+	withInitialEvent pinnipedcontroller.WithInitialEventOptionFunc,
+	signerCertProvider dynamiccert.Provider,
+	newHandler func() (http.Handler, error),
+	clock clock.Clock,
+) controllerlib.Controller {
+	secretNames := map[string]bool{tlsSecretName: true, signerSecretName: true}
+	return controllerlib.New(
+		controllerlib.Config{
+			Name: "impersonator-config-controller",
+			Syncer: &impersonatorConfigController{
+				namespace:                    namespace,
+				credentialIssuerResourceName: credentialIssuerResourceName,
+				labels:                       labels,
+				mode:                         mode,
+				externalEndpoint:             externalEndpoint,
+				loadBalancerServiceName:      loadBalancerServiceName,
+				loadBalancerServiceSelector:  loadBalancerServiceSelector,
+				tlsSecretName:                tlsSecretName,
+				signerSecretName:             signerSecretName,
+				listenAddress:                listenAddress,
+				k8sClient:                    k8sClient,
+				pinnipedAPIClient:            pinnipedAPIClient,
+				nodesInformer:                nodesInformer,
+				servicesInformer:             servicesInformer,
+				secretsInformer:              secretsInformer,
+				signerCertProvider:           signerCertProvider,
+				newHandler:                   newHandler,
+				clock:                        clock,
+				servingCertProvider:          dynamiccert.New(),
+			},
+		},
+		withInformer(
+			nodesInformer,
+			pinnipedcontroller.SimpleFilterWithSingletonQueue(func(obj metav1.Object) bool { return true }),
+			controllerlib.InformerOption{},
+		),
+		withInformer(
+			servicesInformer,
+			pinnipedcontroller.SimpleFilterWithSingletonQueue(func(obj metav1.Object) bool {
+				return obj.GetNamespace() == namespace && obj.GetName() == loadBalancerServiceName
+			}),
+			controllerlib.InformerOption{},
+		),
+		withInformer(
+			secretsInformer,
+			pinnipedcontroller.SimpleFilterWithSingletonQueue(func(obj metav1.Object) bool {
+				return obj.GetNamespace() == namespace && secretNames[obj.GetName()]
+			}),
+			controllerlib.InformerOption{},
+		),
+		// Be sure to run once even if none of the watched objects exist.
+		withInitialEvent(controllerlib.Key{}),
+	)
+}
+
+func (c *impersonatorConfigController) Sync(ctx controllerlib.Context) error {
+	strategy, err := c.doSync(ctx)
+	if err != nil {
+		strategy = c.strategy(configv1alpha1.ErrorStrategyStatus, configv1alpha1.ErrorDuringSetupStrategyReason, err.Error())
+	}
+
+	updateErr := issuerconfig.CreateOrUpdateCredentialIssuer(
+		ctx.Context,
+		c.namespace,
+		c.credentialIssuerResourceName,
+		c.labels,
+		c.pinnipedAPIClient,
+		func(credentialIssuer *configv1alpha1.CredentialIssuer) {
+			issuerconfig.SetStrategy(credentialIssuer, strategy)
+		},
+	)
+
+	return utilerrors.NewAggregate([]error{err, updateErr})
+}
+
+func (c *impersonatorConfigController) doSync(ctx controllerlib.Context) (configv1alpha1.CredentialIssuerStrategy, error) {
+	shouldRun, reason, err := c.shouldRun()
+	if err != nil {
+		return configv1alpha1.CredentialIssuerStrategy{}, err
+	}
+
+	if !shouldRun {
+		c.stopServer()
+		c.servingCertProvider.Set(nil, nil)
+		c.signerCertProvider.Set(nil, nil)
+		if err := c.ensureLoadBalancerServiceIsDeleted(ctx); err != nil {
+			return configv1alpha1.CredentialIssuerStrategy{}, err
+		}
+		return c.strategy(configv1alpha1.ErrorStrategyStatus, configv1alpha1.DisabledStrategyReason, reason), nil
+	}
+
+	if err := c.ensureSignerCA(ctx); err != nil {
+		return configv1alpha1.CredentialIssuerStrategy{}, err
+	}
+
+	if err := c.ensureServerIsRunning(ctx); err != nil {
+		return configv1alpha1.CredentialIssuerStrategy{}, err
+	}
+
+	endpoint, err := c.endpoint(ctx)
+	if err != nil {
+		return configv1alpha1.CredentialIssuerStrategy{}, err
+	}
+	if endpoint == "" {
+		return c.strategy(
+			configv1alpha1.ErrorStrategyStatus,
+			configv1alpha1.PendingStrategyReason,
+			"waiting for the load balancer Service of the impersonation proxy to be assigned an ingress address",
+		), nil
+	}
+
+	caPEM, err := c.ensureTLSSecret(ctx, endpoint)
+	if err != nil {
+		return configv1alpha1.CredentialIssuerStrategy{}, err
+	}
+
+	strategy := c.strategy(
+		configv1alpha1.SuccessStrategyStatus,
+		configv1alpha1.ListeningStrategyReason,
+		"the impersonation proxy is ready to accept client connections",
+	)
+	strategy.ImpersonationProxyInfo = &configv1alpha1.ImpersonationProxyInfo{
+		Endpoint:                 "https://" + endpoint,
+		CertificateAuthorityData: base64.StdEncoding.EncodeToString(caPEM),
+	}
+	return strategy, nil
+}
+
+func (c *impersonatorConfigController) strategy(
+	status configv1alpha1.StrategyStatus,
+	reason configv1alpha1.StrategyReason,
+	message string,
+) configv1alpha1.CredentialIssuerStrategy {
+	return configv1alpha1.CredentialIssuerStrategy{
+		Type:           configv1alpha1.ImpersonationProxyStrategyType,
+		Status:         status,
+		Reason:         reason,
+		Message:        message,
+		LastUpdateTime: metav1.NewTime(c.clock.Now()),
+	}
+}
+
+// shouldRun returns whether the impersonation proxy should run, and the reason when it should not.
+func (c *impersonatorConfigController) shouldRun() (bool, string, error) {
+	switch c.mode {
+	case concierge.ImpersonationProxyModeEnabled:
+		return true, "", nil
+	case concierge.ImpersonationProxyModeDisabled:
+		return false, "the impersonation proxy was explicitly disabled by configuration", nil
+	}
+
+	nodes, err := c.nodesInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return false, "", fmt.Errorf("could not list nodes: %w", err)
+	}
+	if len(nodes) == 0 {
+		return false, "", errors.New("no nodes found")
+	}
+	for _, node := range nodes {
+		_, isControlPlane := node.Labels[controlPlaneNodeRoleLabel]
+		_, isMaster := node.Labels[masterNodeRoleLabel]
+		if isControlPlane || isMaster {
+			return false, "automatically determined that the impersonation proxy should be disabled, because the cluster has visible control plane nodes", nil
+		}
+	}
+	return true, "", nil
+}
+
+func (c *impersonatorConfigController) ensureServerIsRunning(ctx controllerlib.Context) error {
+	if c.server != nil {
+		return nil
+	}
+
+	handler, err := c.newHandler()
+	if err != nil {
+		return fmt.Errorf("could not create the impersonation proxy: %w", err)
+	}
+
+	listener, err := net.Listen("tcp", c.listenAddress)
+	if err != nil {
+		return fmt.Errorf("could not listen for the impersonation proxy: %w", err)
+	}
+	tlsListener := tls.NewListener(listener, &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// The client certificates are verified by the impersonation proxy, using the current CA which issues them.
+		ClientAuth:     tls.RequestClientCert,
+		GetCertificate: c.getServingCertificate,
+	})
+
+	server := &http.Server{Handler: handler}
+	go func() {
+		if err := server.Serve(tlsListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			plog.Error("the impersonation proxy stopped unexpectedly", err)
+		}
+	}()
+	// Stop the impersonation proxy together with the controller.
+	go func() {
+		<-ctx.Context.Done()
+		_ = server.Close()
+	}()
+	c.server = server
+	plog.Info("started the impersonation proxy", "address", c.listenAddress)
+	return nil
+}
+
+func (c *impersonatorConfigController) stopServer() {
+	if c.server == nil {
+		return
+	}
+	if err := c.server.Close(); err != nil {
+		plog.WarningErr("could not stop the impersonation proxy", err)
+	}
+	c.server = nil
+	plog.Info("stopped the impersonation proxy")
+}
+
+func (c *impersonatorConfigController) getServingCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certPEM, keyPEM := c.servingCertProvider.CurrentCertKeyContent()
+	if len(certPEM) == 0 {
+		return nil, errors.New("the impersonation proxy does not have a serving certificate yet")
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the serving certificate of the impersonation proxy: %w", err)
+	}
+	return &cert, nil
+}
+
+// endpoint returns the host and optional port at which clients can reach the impersonation proxy, or an empty
+// string while the load balancer Service does not have an ingress address yet.
+func (c *impersonatorConfigController) endpoint(ctx controllerlib.Context) (string, error) {
+	if c.externalEndpoint != "" {
+		return c.externalEndpoint, c.ensureLoadBalancerServiceIsDeleted(ctx)
+	}
+
+	service, err := c.servicesInformer.Lister().Services(c.namespace).Get(c.loadBalancerServiceName)
+	if k8serrors.IsNotFound(err) {
+		service = &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      c.loadBalancerServiceName,
+				Namespace: c.namespace,
+				Labels:    c.labels,
+			},
+			Spec: corev1.ServiceSpec{
+				Type: corev1.ServiceTypeLoadBalancer,
+				Ports: []corev1.ServicePort{{
+					Protocol:   corev1.ProtocolTCP,
+					Port:       443,
+					TargetPort: intstr.FromInt(ListenPort),
+				}},
+				Selector: c.loadBalancerServiceSelector,
+			},
+		}
+		if _, err := c.k8sClient.CoreV1().Services(c.namespace).Create(ctx.Context, service, metav1.CreateOptions{}); err != nil {
+			return "", fmt.Errorf("could not create load balancer Service: %w", err)
+		}
+		plog.Info("created the load balancer Service of the impersonation proxy", "service", c.loadBalancerServiceName)
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not get load balancer Service: %w", err)
+	}
+
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.Hostname != "" {
+			return ingress.Hostname, nil
+		}
+		if ingress.IP != "" {
+			return ingress.IP, nil
+		}
+	}
+	return "", nil
+}
+
+func (c *impersonatorConfigController) ensureLoadBalancerServiceIsDeleted(ctx controllerlib.Context) error {
+	_, err := c.servicesInformer.Lister().Services(c.namespace).Get(c.loadBalancerServiceName)
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not get load balancer Service: %w", err)
+	}
+	err = c.k8sClient.CoreV1().Services(c.namespace).Delete(ctx.Context, c.loadBalancerServiceName, metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return fmt.Errorf("could not delete load balancer Service: %w", err)
+	}
+	plog.Info("deleted the load balancer Service of the impersonation proxy", "service", c.loadBalancerServiceName)
+	return nil
+}
+
+// ensureSignerCA makes sure that the Secret of the CA which issues the client certificates of the impersonation
+// proxy holds a valid CA, and loads it into the signerCertProvider.
+func (c *impersonatorConfigController) ensureSignerCA(ctx controllerlib.Context) error {
+	secret, err := c.getSecret(c.signerSecretName)
+	if err != nil {
+		return err
+	}
+	if secret != nil && c.isValid(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey], "") {
+		c.signerCertProvider.Set(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+		return nil
+	}
+
+	ca, err := certauthority.New(pkix.Name{CommonName: "Pinniped Impersonation Proxy Client CA"}, certDuration)
+	if err != nil {
+		return fmt.Errorf("could not create client CA: %w", err)
+	}
+	keyPEM, err := ca.PrivateKeyToPEM()
+	if err != nil {
+		return fmt.Errorf("could not encode client CA: %w", err)
+	}
+	if err := c.writeSecret(ctx, secret, c.signerSecretName, map[string][]byte{
+		corev1.TLSCertKey:       ca.Bundle(),
+		corev1.TLSPrivateKeyKey: keyPEM,
+	}); err != nil {
+		return err
+	}
+	c.signerCertProvider.Set(ca.Bundle(), keyPEM)
+	return nil
+}
+
+// ensureTLSSecret makes sure that the Secret of the serving certificate of the impersonation proxy holds a valid
+// certificate for the endpoint, loads it into the servingCertProvider and returns the PEM of its CA.
+func (c *impersonatorConfigController) ensureTLSSecret(ctx controllerlib.Context, endpoint string) ([]byte, error) {
+	hostname := hostnameOf(endpoint)
+
+	secret, err := c.getSecret(c.tlsSecretName)
+	if err != nil {
+		return nil, err
+	}
+	if secret != nil && len(secret.Data[caCertificateSecretKey]) > 0 &&
+		c.isValid(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey], hostname) {
+		c.servingCertProvider.Set(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+		return secret.Data[caCertificateSecretKey], nil
+	}
+
+	ca, err := certauthority.New(pkix.Name{CommonName: "Pinniped Impersonation Proxy CA"}, certDuration)
+	if err != nil {
+		return nil, fmt.Errorf("could not create serving CA: %w", err)
+	}
+	var dnsNames []string
+	var ips []net.IP
+	if ip := net.ParseIP(hostname); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		dnsNames = []string{hostname}
+	}
+	servingCert, err := ca.Issue(pkix.Name{CommonName: hostname}, dnsNames, ips, certDuration)
+	if err != nil {
+		return nil, fmt.Errorf("could not issue serving certificate: %w", err)
+	}
+	certPEM, keyPEM, err := certauthority.ToPEM(servingCert)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode serving certificate: %w", err)
+	}
+	if err := c.writeSecret(ctx, secret, c.tlsSecretName, map[string][]byte{
+		caCertificateSecretKey:  ca.Bundle(),
+		corev1.TLSCertKey:       certPEM,
+		corev1.TLSPrivateKeyKey: keyPEM,
+	}); err != nil {
+		return nil, err
+	}
+	c.servingCertProvider.Set(certPEM, keyPEM)
+	return ca.Bundle(), nil
+}
+
+// isValid returns whether the certificate matches the key, is not about to expire, and is valid for the hostname
+// when it is not empty.
+func (c *impersonatorConfigController) isValid(certPEM, keyPEM []byte, hostname string) bool {
+	keyPair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return false
+	}
+	if c.clock.Now().Add(certRenewBefore).After(cert.NotAfter) {
+		return false
+	}
+	return hostname == "" || cert.VerifyHostname(hostname) == nil
+}
+
+// getSecret returns the Secret with the given name, or nil when it does not exist.
+func (c *impersonatorConfigController) getSecret(name string) (*corev1.Secret, error) {
+	secret, err := c.secretsInformer.Lister().Secrets(c.namespace).Get(name)
+	if k8serrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get %s/%s secret: %w", c.namespace, name, err)
+	}
+	return secret, nil
+}
+
+// writeSecret creates the Secret with the given name when existing is nil, and otherwise replaces its data.
+func (c *impersonatorConfigController) writeSecret(ctx controllerlib.Context, existing *corev1.Secret, name string, data map[string][]byte) error {
+	secrets := c.k8sClient.CoreV1().Secrets(c.namespace)
+	if existing == nil {
+		_, err := secrets.Create(ctx.Context, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: c.namespace, Labels: c.labels},
+			Type:       corev1.SecretTypeTLS,
+			Data:       data,
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("could not create %s/%s secret: %w", c.namespace, name, err)
+		}
+		return nil
+	}
+
+	updated := existing.DeepCopy()
+	updated.Data = data
+	if _, err := secrets.Update(ctx.Context, updated, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("could not update %s/%s secret: %w", c.namespace, name, err)
+	}
+	return nil
+}
+
+// hostnameOf returns the host of an endpoint which is a host with an optional port.
+func hostnameOf(endpoint string) string {
+	if host, _, err := net.SplitHostPort(endpoint); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(endpoint, "["), "]")
+}
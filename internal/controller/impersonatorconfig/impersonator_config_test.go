@@ -0,0 +1,426 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package impersonatorconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	kubeinformers "k8s.io/client-go/informers"
+	kubernetesfake "k8s.io/client-go/kubernetes/fake"
+	coretesting "k8s.io/client-go/testing"
+
+	configv1alpha1 "go.pinniped.dev/generated/1.20/apis/concierge/config/v1alpha1"
+	pinnipedfake "go.pinniped.dev/generated/1.20/client/concierge/clientset/versioned/fake"
+	"go.pinniped.dev/internal/certauthority"
+	"go.pinniped.dev/internal/config/concierge"
+	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/dynamiccert"
+)
+
+const (
+	namespace                    = "some-namespace"
+	credentialIssuerResourceName = "some-credential-issuer"
+	loadBalancerServiceName      = "some-load-balancer"
+	tlsSecretName                = "some-tls-secret"
+	signerSecretName             = "some-signer-secret"
+)
+
+// freeListenAddress returns a local address on which nothing listens at the moment.
+func freeListenAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	require.NoError(t, listener.Close())
+	return address
+}
+
+// tlsSecret returns a TLS Secret of the impersonation proxy which is valid for the hostname until the given time.
+func tlsSecret(t *testing.T, hostname string, notAfter time.Duration) *corev1.Secret {
+	t.Helper()
+	ca, err := certauthority.New(pkix.Name{CommonName: "some-ca"}, notAfter)
+	require.NoError(t, err)
+	cert, err := ca.Issue(pkix.Name{CommonName: hostname}, []string{hostname}, nil, notAfter)
+	require.NoError(t, err)
+	certPEM, keyPEM, err := certauthority.ToPEM(cert)
+	require.NoError(t, err)
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: tlsSecretName, Namespace: namespace},
+		Type:       corev1.SecretTypeTLS,
+		Data:       map[string][]byte{"ca.crt": ca.Bundle(), "tls.crt": certPEM, "tls.key": keyPEM},
+	}
+}
+
+func node(name string, labels map[string]string) *corev1.Node {
+	return &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+}
+
+func loadBalancerService(ingress ...corev1.LoadBalancerIngress) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: loadBalancerServiceName, Namespace: namespace},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+		Status:     corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{Ingress: ingress}},
+	}
+}
+
+// writeActions returns the actions which changed objects, ignoring the reads of the informers.
+func writeActions(client *kubernetesfake.Clientset) []string {
+	var actions []string
+	for _, action := range client.Actions() {
+		switch action.GetVerb() {
+		case "create", "update":
+			object := action.(interface{ GetObject() runtime.Object }).GetObject()
+			actions = append(actions, action.GetVerb()+" "+action.GetResource().Resource+" "+object.(metav1.Object).GetName())
+		case "delete":
+			actions = append(actions, "delete "+action.GetResource().Resource+" "+action.(coretesting.DeleteAction).GetName())
+		}
+	}
+	return actions
+}
+
+func TestImpersonatorConfigController(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	workerNode := node("some-worker", map[string]string{"kubernetes.io/os": "linux"})
+
+	tests := []struct {
+		name             string
+		mode             concierge.ImpersonationProxyMode
+		externalEndpoint string // the listen address is used when it is "listen-address"
+		kubeObjects      []runtime.Object
+
+		wantErr              string
+		wantStatus           configv1alpha1.StrategyStatus
+		wantReason           configv1alpha1.StrategyReason
+		wantMessage          string
+		wantEndpoint         string // the listen address is used when it is "https://listen-address"
+		wantServerRunning    bool
+		wantSignerCA         bool
+		wantActions          []string
+		wantTLSSecretDNSName string
+	}{
+		{
+			name:        "disabled by configuration",
+			mode:        concierge.ImpersonationProxyModeDisabled,
+			kubeObjects: []runtime.Object{workerNode, loadBalancerService()},
+			wantStatus:  configv1alpha1.ErrorStrategyStatus,
+			wantReason:  configv1alpha1.DisabledStrategyReason,
+			wantMessage: "the impersonation proxy was explicitly disabled by configuration",
+			wantActions: []string{"delete services some-load-balancer"},
+		},
+		{
+			name:        "automatically disabled because of a control plane node",
+			mode:        concierge.ImpersonationProxyModeAuto,
+			kubeObjects: []runtime.Object{workerNode, node("some-control-plane", map[string]string{"node-role.kubernetes.io/control-plane": ""})},
+			wantStatus:  configv1alpha1.ErrorStrategyStatus,
+			wantReason:  configv1alpha1.DisabledStrategyReason,
+			wantMessage: "automatically determined that the impersonation proxy should be disabled, because the cluster has visible control plane nodes",
+		},
+		{
+			name:        "automatically disabled because of a master node",
+			mode:        concierge.ImpersonationProxyModeAuto,
+			kubeObjects: []runtime.Object{node("some-master", map[string]string{"node-role.kubernetes.io/master": ""})},
+			wantStatus:  configv1alpha1.ErrorStrategyStatus,
+			wantReason:  configv1alpha1.DisabledStrategyReason,
+			wantMessage: "automatically determined that the impersonation proxy should be disabled, because the cluster has visible control plane nodes",
+		},
+		{
+			name:        "automatic mode without nodes",
+			mode:        concierge.ImpersonationProxyModeAuto,
+			wantErr:     "no nodes found",
+			wantStatus:  configv1alpha1.ErrorStrategyStatus,
+			wantReason:  configv1alpha1.ErrorDuringSetupStrategyReason,
+			wantMessage: "no nodes found",
+		},
+		{
+			name:              "automatically enabled without a load balancer Service yet",
+			mode:              concierge.ImpersonationProxyModeAuto,
+			kubeObjects:       []runtime.Object{workerNode},
+			wantStatus:        configv1alpha1.ErrorStrategyStatus,
+			wantReason:        configv1alpha1.PendingStrategyReason,
+			wantMessage:       "waiting for the load balancer Service of the impersonation proxy to be assigned an ingress address",
+			wantServerRunning: true,
+			wantSignerCA:      true,
+			wantActions:       []string{"create secrets some-signer-secret", "create services some-load-balancer"},
+		},
+		{
+			name:              "enabled with a load balancer Service without an ingress address",
+			mode:              concierge.ImpersonationProxyModeEnabled,
+			kubeObjects:       []runtime.Object{loadBalancerService()},
+			wantStatus:        configv1alpha1.ErrorStrategyStatus,
+			wantReason:        configv1alpha1.PendingStrategyReason,
+			wantMessage:       "waiting for the load balancer Service of the impersonation proxy to be assigned an ingress address",
+			wantServerRunning: true,
+			wantSignerCA:      true,
+			wantActions:       []string{"create secrets some-signer-secret"},
+		},
+		{
+			name:                 "enabled with a load balancer Service with an ingress hostname",
+			mode:                 concierge.ImpersonationProxyModeEnabled,
+			kubeObjects:          []runtime.Object{loadBalancerService(corev1.LoadBalancerIngress{Hostname: "some-hostname.example.com"})},
+			wantStatus:           configv1alpha1.SuccessStrategyStatus,
+			wantReason:           configv1alpha1.ListeningStrategyReason,
+			wantMessage:          "the impersonation proxy is ready to accept client connections",
+			wantEndpoint:         "https://some-hostname.example.com",
+			wantServerRunning:    true,
+			wantSignerCA:         true,
+			wantActions:          []string{"create secrets some-signer-secret", "create secrets some-tls-secret"},
+			wantTLSSecretDNSName: "some-hostname.example.com",
+		},
+		{
+			name: "enabled with a valid TLS Secret",
+			mode: concierge.ImpersonationProxyModeEnabled,
+			kubeObjects: []runtime.Object{
+				loadBalancerService(corev1.LoadBalancerIngress{Hostname: "some-hostname.example.com"}),
+				tlsSecret(t, "some-hostname.example.com", 365*24*time.Hour),
+			},
+			wantStatus:           configv1alpha1.SuccessStrategyStatus,
+			wantReason:           configv1alpha1.ListeningStrategyReason,
+			wantMessage:          "the impersonation proxy is ready to accept client connections",
+			wantEndpoint:         "https://some-hostname.example.com",
+			wantServerRunning:    true,
+			wantSignerCA:         true,
+			wantActions:          []string{"create secrets some-signer-secret"},
+			wantTLSSecretDNSName: "some-hostname.example.com",
+		},
+		{
+			name: "enabled with a TLS Secret for another hostname",
+			mode: concierge.ImpersonationProxyModeEnabled,
+			kubeObjects: []runtime.Object{
+				loadBalancerService(corev1.LoadBalancerIngress{Hostname: "some-hostname.example.com"}),
+				tlsSecret(t, "some-other-hostname.example.com", 365*24*time.Hour),
+			},
+			wantStatus:           configv1alpha1.SuccessStrategyStatus,
+			wantReason:           configv1alpha1.ListeningStrategyReason,
+			wantMessage:          "the impersonation proxy is ready to accept client connections",
+			wantEndpoint:         "https://some-hostname.example.com",
+			wantServerRunning:    true,
+			wantSignerCA:         true,
+			wantActions:          []string{"create secrets some-signer-secret", "update secrets some-tls-secret"},
+			wantTLSSecretDNSName: "some-hostname.example.com",
+		},
+		{
+			name: "enabled with a TLS Secret which is about to expire",
+			mode: concierge.ImpersonationProxyModeEnabled,
+			kubeObjects: []runtime.Object{
+				loadBalancerService(corev1.LoadBalancerIngress{Hostname: "some-hostname.example.com"}),
+				tlsSecret(t, "some-hostname.example.com", 24*time.Hour),
+			},
+			wantStatus:           configv1alpha1.SuccessStrategyStatus,
+			wantReason:           configv1alpha1.ListeningStrategyReason,
+			wantMessage:          "the impersonation proxy is ready to accept client connections",
+			wantEndpoint:         "https://some-hostname.example.com",
+			wantServerRunning:    true,
+			wantSignerCA:         true,
+			wantActions:          []string{"create secrets some-signer-secret", "update secrets some-tls-secret"},
+			wantTLSSecretDNSName: "some-hostname.example.com",
+		},
+		{
+			name:              "enabled with an external endpoint",
+			mode:              concierge.ImpersonationProxyModeEnabled,
+			externalEndpoint:  "listen-address",
+			kubeObjects:       []runtime.Object{loadBalancerService(corev1.LoadBalancerIngress{IP: "1.2.3.4"})},
+			wantStatus:        configv1alpha1.SuccessStrategyStatus,
+			wantReason:        configv1alpha1.ListeningStrategyReason,
+			wantMessage:       "the impersonation proxy is ready to accept client connections",
+			wantEndpoint:      "https://listen-address",
+			wantServerRunning: true,
+			wantSignerCA:      true,
+			wantActions:       []string{"create secrets some-signer-secret", "delete services some-load-balancer", "create secrets some-tls-secret"},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			listenAddress := freeListenAddress(t)
+			externalEndpoint := test.externalEndpoint
+			if externalEndpoint == "listen-address" {
+				externalEndpoint = listenAddress
+			}
+			wantEndpoint := test.wantEndpoint
+			if wantEndpoint == "https://listen-address" {
+				wantEndpoint = "https://" + listenAddress
+			}
+
+			kubeClient := kubernetesfake.NewSimpleClientset(test.kubeObjects...)
+			pinnipedClient := pinnipedfake.NewSimpleClientset()
+			informers := kubeinformers.NewSharedInformerFactory(kubeClient, 0)
+			signerCertProvider := dynamiccert.New()
+
+			controller := NewImpersonatorConfigController(
+				namespace,
+				credentialIssuerResourceName,
+				map[string]string{"app": "some-app"},
+				test.mode,
+				externalEndpoint,
+				loadBalancerServiceName,
+				map[string]string{"app": "some-app"},
+				tlsSecretName,
+				signerSecretName,
+				listenAddress,
+				kubeClient,
+				pinnipedClient,
+				informers.Core().V1().Nodes(),
+				informers.Core().V1().Services(),
+				informers.Core().V1().Secrets(),
+				controllerlib.WithInformer,
+				controllerlib.WithInitialEvent,
+				signerCertProvider,
+				func() (http.Handler, error) {
+					return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						_, _ = w.Write([]byte("hello from the impersonation proxy"))
+					}), nil
+				},
+				clock.NewFakeClock(now),
+			)
+
+			informers.Start(ctx.Done())
+			controllerlib.TestRunSynchronously(t, controller)
+
+			err := controllerlib.TestSync(t, controller, controllerlib.Context{Context: ctx})
+			if test.wantErr != "" {
+				require.EqualError(t, err, test.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			require.Equal(t, test.wantActions, writeActions(kubeClient))
+
+			credentialIssuer, err := pinnipedClient.ConfigV1alpha1().CredentialIssuers(namespace).Get(ctx, credentialIssuerResourceName, metav1.GetOptions{})
+			require.NoError(t, err)
+			require.Len(t, credentialIssuer.Status.Strategies, 1)
+			strategy := credentialIssuer.Status.Strategies[0]
+			require.Equal(t, configv1alpha1.ImpersonationProxyStrategyType, strategy.Type)
+			require.Equal(t, test.wantStatus, strategy.Status)
+			require.Equal(t, test.wantReason, strategy.Reason)
+			require.Equal(t, test.wantMessage, strategy.Message)
+			require.Equal(t, metav1.NewTime(now), strategy.LastUpdateTime)
+
+			if test.wantEndpoint == "" {
+				require.Nil(t, strategy.ImpersonationProxyInfo)
+			} else {
+				require.NotNil(t, strategy.ImpersonationProxyInfo)
+				require.Equal(t, wantEndpoint, strategy.ImpersonationProxyInfo.Endpoint)
+
+				tlsSecret, err := kubeClient.CoreV1().Secrets(namespace).Get(ctx, tlsSecretName, metav1.GetOptions{})
+				require.NoError(t, err)
+				require.Equal(t, base64.StdEncoding.EncodeToString(tlsSecret.Data["ca.crt"]), strategy.ImpersonationProxyInfo.CertificateAuthorityData)
+				if test.wantTLSSecretDNSName != "" {
+					block, _ := pem.Decode(tlsSecret.Data["tls.crt"])
+					cert, err := x509.ParseCertificate(block.Bytes)
+					require.NoError(t, err)
+					require.Equal(t, []string{test.wantTLSSecretDNSName}, cert.DNSNames)
+				}
+			}
+
+			signerCertPEM, _ := signerCertProvider.CurrentCertKeyContent()
+			if test.wantSignerCA {
+				signerSecret, err := kubeClient.CoreV1().Secrets(namespace).Get(ctx, signerSecretName, metav1.GetOptions{})
+				require.NoError(t, err)
+				require.Equal(t, signerSecret.Data["tls.crt"], signerCertPEM)
+			} else {
+				require.Empty(t, signerCertPEM)
+			}
+
+			if !test.wantServerRunning {
+				_, err := net.Dial("tcp", listenAddress)
+				require.Error(t, err)
+				return
+			}
+			if test.wantEndpoint == "" {
+				// The server runs, but it does not have a serving certificate yet.
+				conn, err := tls.Dial("tcp", listenAddress, &tls.Config{InsecureSkipVerify: true}) //nolint: gosec // the handshake is expected to fail
+				if err == nil {
+					_ = conn.Close()
+				}
+				require.Error(t, err)
+				return
+			}
+
+			caData, err := base64.StdEncoding.DecodeString(strategy.ImpersonationProxyInfo.CertificateAuthorityData)
+			require.NoError(t, err)
+			rootCAs := x509.NewCertPool()
+			require.True(t, rootCAs.AppendCertsFromPEM(caData))
+			serverName, _, err := net.SplitHostPort(wantEndpoint[len("https://"):])
+			if err != nil {
+				serverName = wantEndpoint[len("https://"):]
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				MinVersion: tls.VersionTLS12,
+				RootCAs:    rootCAs,
+				ServerName: serverName,
+			}}}
+			resp, err := client.Get("https://" + listenAddress)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, "hello from the impersonation proxy", string(body))
+		})
+	}
+}
+
+func TestImpersonatorConfigControllerCreatesLoadBalancerService(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	kubeClient := kubernetesfake.NewSimpleClientset()
+	informers := kubeinformers.NewSharedInformerFactory(kubeClient, 0)
+	controller := NewImpersonatorConfigController(
+		namespace,
+		credentialIssuerResourceName,
+		map[string]string{"app": "some-app"},
+		concierge.ImpersonationProxyModeEnabled,
+		"",
+		loadBalancerServiceName,
+		map[string]string{"app": "some-selector"},
+		tlsSecretName,
+		signerSecretName,
+		freeListenAddress(t),
+		kubeClient,
+		pinnipedfake.NewSimpleClientset(),
+		informers.Core().V1().Nodes(),
+		informers.Core().V1().Services(),
+		informers.Core().V1().Secrets(),
+		controllerlib.WithInformer,
+		controllerlib.WithInitialEvent,
+		dynamiccert.New(),
+		func() (http.Handler, error) { return http.NotFoundHandler(), nil },
+		clock.RealClock{},
+	)
+	informers.Start(ctx.Done())
+	controllerlib.TestRunSynchronously(t, controller)
+	require.NoError(t, controllerlib.TestSync(t, controller, controllerlib.Context{Context: ctx}))
+
+	service, err := kubeClient.CoreV1().Services(namespace).Get(ctx, loadBalancerServiceName, metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"app": "some-app"}, service.Labels)
+	require.Equal(t, corev1.ServiceSpec{
+		Type: corev1.ServiceTypeLoadBalancer,
+		Ports: []corev1.ServicePort{{
+			Protocol:   corev1.ProtocolTCP,
+			Port:       443,
+			TargetPort: intstr.FromInt(8444),
+		}},
+		Selector: map[string]string{"app": "some-selector"},
+	}, service.Spec)
+}
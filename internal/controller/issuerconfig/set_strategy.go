@@ -0,0 +1,21 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package issuerconfig
+
+import (
+	configv1alpha1 "go.pinniped.dev/generated/1.20/apis/concierge/config/v1alpha1"
+)
+
+// SetStrategy replaces the strategy of the same type in the status of the CredentialIssuer, or appends it when the
+// CredentialIssuer does not have a strategy of its type yet. This lets several controllers each report the status of
+// their own strategy.
+func SetStrategy(credentialIssuer *configv1alpha1.CredentialIssuer, strategy configv1alpha1.CredentialIssuerStrategy) {
+	for i := range credentialIssuer.Status.Strategies {
+		if credentialIssuer.Status.Strategies[i].Type == strategy.Type {
+			credentialIssuer.Status.Strategies[i] = strategy
+			return
+		}
+	}
+	credentialIssuer.Status.Strategies = append(credentialIssuer.Status.Strategies, strategy)
+}
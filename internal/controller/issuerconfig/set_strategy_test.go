@@ -0,0 +1,68 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package issuerconfig
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	configv1alpha1 "go.pinniped.dev/generated/1.20/apis/concierge/config/v1alpha1"
+)
+
+func TestSetStrategy(t *testing.T) {
+	kubeCertAgentStrategy := configv1alpha1.CredentialIssuerStrategy{
+		Type:    configv1alpha1.KubeClusterSigningCertificateStrategyType,
+		Status:  configv1alpha1.ErrorStrategyStatus,
+		Reason:  configv1alpha1.CouldNotFetchKeyStrategyReason,
+		Message: "some error",
+	}
+	oldImpersonationProxyStrategy := configv1alpha1.CredentialIssuerStrategy{
+		Type:    configv1alpha1.ImpersonationProxyStrategyType,
+		Status:  configv1alpha1.ErrorStrategyStatus,
+		Reason:  configv1alpha1.PendingStrategyReason,
+		Message: "some pending message",
+	}
+	newImpersonationProxyStrategy := configv1alpha1.CredentialIssuerStrategy{
+		Type:    configv1alpha1.ImpersonationProxyStrategyType,
+		Status:  configv1alpha1.SuccessStrategyStatus,
+		Reason:  configv1alpha1.ListeningStrategyReason,
+		Message: "some success message",
+	}
+
+	tests := []struct {
+		name           string
+		strategies     []configv1alpha1.CredentialIssuerStrategy
+		strategy       configv1alpha1.CredentialIssuerStrategy
+		wantStrategies []configv1alpha1.CredentialIssuerStrategy
+	}{
+		{
+			name:           "no strategies yet",
+			strategy:       newImpersonationProxyStrategy,
+			wantStrategies: []configv1alpha1.CredentialIssuerStrategy{newImpersonationProxyStrategy},
+		},
+		{
+			name:           "only strategies of other types",
+			strategies:     []configv1alpha1.CredentialIssuerStrategy{kubeCertAgentStrategy},
+			strategy:       newImpersonationProxyStrategy,
+			wantStrategies: []configv1alpha1.CredentialIssuerStrategy{kubeCertAgentStrategy, newImpersonationProxyStrategy},
+		},
+		{
+			name:           "a strategy of the same type",
+			strategies:     []configv1alpha1.CredentialIssuerStrategy{oldImpersonationProxyStrategy, kubeCertAgentStrategy},
+			strategy:       newImpersonationProxyStrategy,
+			wantStrategies: []configv1alpha1.CredentialIssuerStrategy{newImpersonationProxyStrategy, kubeCertAgentStrategy},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			credentialIssuer := &configv1alpha1.CredentialIssuer{
+				Status: configv1alpha1.CredentialIssuerStatus{Strategies: test.strategies},
+			}
+			SetStrategy(credentialIssuer, test.strategy)
+			require.Equal(t, test.wantStrategies, credentialIssuer.Status.Strategies)
+		})
+	}
+}
@@ -303,9 +303,7 @@ func createOrUpdateCredentialIssuer(ctx context.Context,
 			} else {
 				strategyResult = strategyError(clock, err)
 			}
-			configToUpdate.Status.Strategies = []configv1alpha1.CredentialIssuerStrategy{
-				strategyResult,
-			}
+			issuerconfig.SetStrategy(configToUpdate, strategyResult)
 		},
 	)
 }
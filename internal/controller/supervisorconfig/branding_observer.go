@@ -0,0 +1,98 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package supervisorconfig
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/labels"
+	corev1informers "k8s.io/client-go/informers/core/v1"
+
+	"go.pinniped.dev/generated/1.20/client/supervisor/informers/externalversions/config/v1alpha1"
+	pinnipedcontroller "go.pinniped.dev/internal/controller"
+	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/httputil/htmlpage"
+	"go.pinniped.dev/internal/oidc/pages"
+	"go.pinniped.dev/internal/plog"
+)
+
+type brandingObserverController struct {
+	issuerToBrandingSetter   IssuerToBrandingMapSetter
+	federationDomainInformer v1alpha1.FederationDomainInformer
+	configMapInformer        corev1informers.ConfigMapInformer
+}
+
+type IssuerToBrandingMapSetter interface {
+	SetIssuerToBrandingMap(issuerToBrandingMap map[string]*htmlpage.Branding)
+}
+
+// Returns a controller which watches all of the FederationDomains and the ConfigMaps which they name
+// in spec.branding.configMapName, and fills an in-memory cache of the branding of each currently
+// configured issuer. Issuers without valid branding are left out of the cache, so they use the default branding.
+// This controller assumes that the informers passed to it are already scoped down to the
+// appropriate namespace.
+func NewBrandingObserverController(
+	issuerToBrandingSetter IssuerToBrandingMapSetter,
+	configMapInformer corev1informers.ConfigMapInformer,
+	federationDomainInformer v1alpha1.FederationDomainInformer,
+	withInformer pinnipedcontroller.WithInformerOptionFunc,
+) controllerlib.Controller {
+	return controllerlib.New(
+		controllerlib.Config{
+			Name: "branding-observer-controller",
+			Syncer: &brandingObserverController{
+				issuerToBrandingSetter:   issuerToBrandingSetter,
+				federationDomainInformer: federationDomainInformer,
+				configMapInformer:        configMapInformer,
+			},
+		},
+		withInformer(
+			configMapInformer,
+			pinnipedcontroller.MatchAnythingFilter(nil),
+			controllerlib.InformerOption{},
+		),
+		withInformer(
+			federationDomainInformer,
+			pinnipedcontroller.MatchAnythingFilter(nil),
+			controllerlib.InformerOption{},
+		),
+	)
+}
+
+func (c *brandingObserverController) Sync(ctx controllerlib.Context) error {
+	ns := ctx.Key.Namespace
+	allProviders, err := c.federationDomainInformer.Lister().FederationDomains(ns).List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list FederationDomains: %w", err)
+	}
+
+	// Rebuild the whole map on any change to any ConfigMap or FederationDomain, because either can have changes that
+	// can cause the map to need to be updated.
+	issuerToBrandingMap := map[string]*htmlpage.Branding{}
+
+	for _, provider := range allProviders {
+		if provider.Spec.Branding == nil || provider.Spec.Branding.ConfigMapName == "" {
+			continue
+		}
+		configMapName := provider.Spec.Branding.ConfigMapName
+		configMap, err := c.configMapInformer.Lister().ConfigMaps(ns).Get(configMapName)
+		if err != nil {
+			plog.Warning("brandingObserverController Sync could not find branding ConfigMap, so the default branding will be used",
+				"namespace", ns, "configMapName", configMapName, "issuer", provider.Spec.Issuer)
+			continue
+		}
+		branding, err := pages.BrandingFromConfigMapData(configMap.Data)
+		if err != nil {
+			plog.WarningErr("brandingObserverController Sync found an invalid branding ConfigMap, so the default branding will be used", err,
+				"namespace", ns, "configMapName", configMapName, "issuer", provider.Spec.Issuer)
+			continue
+		}
+		issuerToBrandingMap[provider.Spec.Issuer] = branding
+	}
+
+	plog.Debug("brandingObserverController Sync updated the branding cache", "issuerBrandingCount", len(issuerToBrandingMap))
+	c.issuerToBrandingSetter.SetIssuerToBrandingMap(issuerToBrandingMap)
+
+	return nil
+}
@@ -0,0 +1,234 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package supervisorconfig
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sclevine/spec"
+	"github.com/sclevine/spec/report"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeinformers "k8s.io/client-go/informers"
+	kubernetesfake "k8s.io/client-go/kubernetes/fake"
+
+	"go.pinniped.dev/generated/1.20/apis/supervisor/config/v1alpha1"
+	pinnipedfake "go.pinniped.dev/generated/1.20/client/supervisor/clientset/versioned/fake"
+	pinnipedinformers "go.pinniped.dev/generated/1.20/client/supervisor/informers/externalversions"
+	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/httputil/htmlpage"
+	"go.pinniped.dev/internal/testutil"
+)
+
+func TestBrandingObserverControllerInformerFilters(t *testing.T) {
+	spec.Run(t, "informer filters", func(t *testing.T, when spec.G, it spec.S) {
+		var (
+			r                              *require.Assertions
+			observableWithInformerOption   *testutil.ObservableWithInformerOption
+			configMapsInformerFilter       controllerlib.Filter
+			federationDomainInformerFilter controllerlib.Filter
+		)
+
+		it.Before(func() {
+			r = require.New(t)
+			observableWithInformerOption = testutil.NewObservableWithInformerOption()
+			configMapsInformer := kubeinformers.NewSharedInformerFactory(nil, 0).Core().V1().ConfigMaps()
+			federationDomainInformer := pinnipedinformers.NewSharedInformerFactory(nil, 0).Config().V1alpha1().FederationDomains()
+			_ = NewBrandingObserverController(
+				nil,
+				configMapsInformer,
+				federationDomainInformer,
+				observableWithInformerOption.WithInformer, // make it possible to observe the behavior of the Filters
+			)
+			configMapsInformerFilter = observableWithInformerOption.GetFilterForInformer(configMapsInformer)
+			federationDomainInformerFilter = observableWithInformerOption.GetFilterForInformer(federationDomainInformer)
+		})
+
+		when("watching ConfigMap objects", func() {
+			var (
+				subject                   controllerlib.Filter
+				configMap, otherConfigMap *corev1.ConfigMap
+			)
+
+			it.Before(func() {
+				subject = configMapsInformerFilter
+				configMap = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "any-name", Namespace: "any-namespace"}}
+				otherConfigMap = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "any-other-name", Namespace: "any-other-namespace"}}
+			})
+
+			when("any ConfigMap changes", func() {
+				it("returns true to trigger the sync method", func() {
+					r.True(subject.Add(configMap))
+					r.True(subject.Update(configMap, otherConfigMap))
+					r.True(subject.Update(otherConfigMap, configMap))
+					r.True(subject.Delete(configMap))
+				})
+			})
+		})
+
+		when("watching FederationDomain objects", func() {
+			var (
+				subject                 controllerlib.Filter
+				provider, otherProvider *v1alpha1.FederationDomain
+			)
+
+			it.Before(func() {
+				subject = federationDomainInformerFilter
+				provider = &v1alpha1.FederationDomain{ObjectMeta: metav1.ObjectMeta{Name: "any-name", Namespace: "any-namespace"}}
+				otherProvider = &v1alpha1.FederationDomain{ObjectMeta: metav1.ObjectMeta{Name: "any-other-name", Namespace: "any-other-namespace"}}
+			})
+
+			when("any FederationDomain changes", func() {
+				it("returns true to trigger the sync method", func() {
+					r.True(subject.Add(provider))
+					r.True(subject.Update(provider, otherProvider))
+					r.True(subject.Update(otherProvider, provider))
+					r.True(subject.Delete(provider))
+				})
+			})
+		})
+	}, spec.Parallel(), spec.Report(report.Terminal{}))
+}
+
+type fakeIssuerToBrandingMapSetter struct {
+	setIssuerToBrandingMapWasCalled bool
+	issuerToBrandingMapReceived     map[string]*htmlpage.Branding
+}
+
+func (f *fakeIssuerToBrandingMapSetter) SetIssuerToBrandingMap(issuerToBrandingMap map[string]*htmlpage.Branding) {
+	f.setIssuerToBrandingMapWasCalled = true
+	f.issuerToBrandingMapReceived = issuerToBrandingMap
+}
+
+func TestBrandingObserverControllerSync(t *testing.T) {
+	spec.Run(t, "Sync", func(t *testing.T, when spec.G, it spec.S) {
+		const installedInNamespace = "some-namespace"
+
+		var (
+			r                      *require.Assertions
+			subject                controllerlib.Controller
+			pinnipedInformerClient *pinnipedfake.Clientset
+			kubeInformerClient     *kubernetesfake.Clientset
+			pinnipedInformers      pinnipedinformers.SharedInformerFactory
+			kubeInformers          kubeinformers.SharedInformerFactory
+			timeoutContext         context.Context
+			timeoutContextCancel   context.CancelFunc
+			syncContext            *controllerlib.Context
+			issuerToBrandingSetter *fakeIssuerToBrandingMapSetter
+		)
+
+		// Defer starting the informers until the last possible moment so that the
+		// nested Before's can keep adding things to the informer caches.
+		var startInformersAndController = func() {
+			// Set this at the last second to allow for injection of server override.
+			subject = NewBrandingObserverController(
+				issuerToBrandingSetter,
+				kubeInformers.Core().V1().ConfigMaps(),
+				pinnipedInformers.Config().V1alpha1().FederationDomains(),
+				controllerlib.WithInformer,
+			)
+
+			// Set this at the last second to support calling subject.Name().
+			syncContext = &controllerlib.Context{
+				Context: timeoutContext,
+				Name:    subject.Name(),
+				Key: controllerlib.Key{
+					Namespace: installedInNamespace,
+					Name:      "any-name",
+				},
+			}
+
+			// Must start informers before calling TestRunSynchronously()
+			kubeInformers.Start(timeoutContext.Done())
+			pinnipedInformers.Start(timeoutContext.Done())
+			controllerlib.TestRunSynchronously(t, subject)
+		}
+
+		it.Before(func() {
+			r = require.New(t)
+
+			timeoutContext, timeoutContextCancel = context.WithTimeout(context.Background(), time.Second*3)
+
+			kubeInformerClient = kubernetesfake.NewSimpleClientset()
+			kubeInformers = kubeinformers.NewSharedInformerFactory(kubeInformerClient, 0)
+			pinnipedInformerClient = pinnipedfake.NewSimpleClientset()
+			pinnipedInformers = pinnipedinformers.NewSharedInformerFactory(pinnipedInformerClient, 0)
+			issuerToBrandingSetter = &fakeIssuerToBrandingMapSetter{}
+		})
+
+		it.After(func() {
+			timeoutContextCancel()
+		})
+
+		when("there are no FederationDomains", func() {
+			it("sets the issuerToBrandingSetter's map to be empty", func() {
+				startInformersAndController()
+				r.NoError(controllerlib.TestSync(t, subject, *syncContext))
+
+				r.True(issuerToBrandingSetter.setIssuerToBrandingMapWasCalled)
+				r.Empty(issuerToBrandingSetter.issuerToBrandingMapReceived)
+			})
+		})
+
+		when("there are FederationDomains where some have valid branding ConfigMaps and some don't", func() {
+			it.Before(func() {
+				federationDomainWithoutBranding := &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "no-branding-federationdomain", Namespace: installedInNamespace},
+					Spec:       v1alpha1.FederationDomainSpec{Issuer: "https://no-branding-issuer.com"},
+				}
+				federationDomainWithMissingConfigMap := &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "missing-configmap-federationdomain", Namespace: installedInNamespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer:   "https://missing-configmap-issuer.com",
+						Branding: &v1alpha1.FederationDomainBrandingSpec{ConfigMapName: "missing-configmap"},
+					},
+				}
+				federationDomainWithBadConfigMap := &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "bad-configmap-federationdomain", Namespace: installedInNamespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer:   "https://bad-configmap-issuer.com",
+						Branding: &v1alpha1.FederationDomainBrandingSpec{ConfigMapName: "bad-configmap"},
+					},
+				}
+				federationDomainWithGoodConfigMap := &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "good-configmap-federationdomain", Namespace: installedInNamespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer:   "https://good-configmap-issuer.com/path",
+						Branding: &v1alpha1.FederationDomainBrandingSpec{ConfigMapName: "good-configmap"},
+					},
+				}
+				badConfigMap := &corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Name: "bad-configmap", Namespace: installedInNamespace},
+					Data:       map[string]string{"logoURL": "http://insecure.example.com/logo.png"},
+				}
+				goodConfigMap := &corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Name: "good-configmap", Namespace: installedInNamespace},
+					Data:       map[string]string{"title": "Acme Login", "primaryColor": "#ff0000"},
+				}
+				r.NoError(pinnipedInformerClient.Tracker().Add(federationDomainWithoutBranding))
+				r.NoError(pinnipedInformerClient.Tracker().Add(federationDomainWithMissingConfigMap))
+				r.NoError(pinnipedInformerClient.Tracker().Add(federationDomainWithBadConfigMap))
+				r.NoError(pinnipedInformerClient.Tracker().Add(federationDomainWithGoodConfigMap))
+				r.NoError(kubeInformerClient.Tracker().Add(badConfigMap))
+				r.NoError(kubeInformerClient.Tracker().Add(goodConfigMap))
+			})
+
+			it("updates the issuerToBrandingSetter's map to include only the issuers that had valid branding", func() {
+				startInformersAndController()
+				r.NoError(controllerlib.TestSync(t, subject, *syncContext))
+
+				r.True(issuerToBrandingSetter.setIssuerToBrandingMapWasCalled)
+				r.Len(issuerToBrandingSetter.issuerToBrandingMapReceived, 1)
+
+				expectedBranding := htmlpage.DefaultBranding()
+				expectedBranding.Title = "Acme Login"
+				expectedBranding.PrimaryColor = "#ff0000"
+				r.Equal(expectedBranding, issuerToBrandingSetter.issuerToBrandingMapReceived["https://good-configmap-issuer.com/path"])
+			})
+		})
+	}, spec.Parallel(), spec.Report(report.Terminal{}))
+}
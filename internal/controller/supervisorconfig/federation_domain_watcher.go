@@ -5,20 +5,25 @@ package supervisorconfig
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/base64"
 	"fmt"
 	"net/url"
 	"strings"
 
+	"golang.org/x/crypto/bcrypt"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/clock"
 	"k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/util/retry"
 	"k8s.io/klog/v2"
 
 	configv1alpha1 "go.pinniped.dev/generated/1.20/apis/supervisor/config/v1alpha1"
 	pinnipedclientset "go.pinniped.dev/generated/1.20/client/supervisor/clientset/versioned"
 	configinformers "go.pinniped.dev/generated/1.20/client/supervisor/informers/externalversions/config/v1alpha1"
+	idpinformers "go.pinniped.dev/generated/1.20/client/supervisor/informers/externalversions/idp/v1alpha1"
 	pinnipedcontroller "go.pinniped.dev/internal/controller"
 	"go.pinniped.dev/internal/controllerlib"
 	"go.pinniped.dev/internal/oidc/provider"
@@ -33,29 +38,33 @@ type ProvidersSetter interface {
 }
 
 type federationDomainWatcherController struct {
-	providerSetter           ProvidersSetter
-	clock                    clock.Clock
-	client                   pinnipedclientset.Interface
-	federationDomainInformer configinformers.FederationDomainInformer
+	providerSetter               ProvidersSetter
+	clock                        clock.Clock
+	client                       pinnipedclientset.Interface
+	federationDomainInformer     configinformers.FederationDomainInformer
+	oidcIdentityProviderInformer idpinformers.OIDCIdentityProviderInformer
 }
 
 // NewFederationDomainWatcherController creates a controllerlib.Controller that watches
 // FederationDomain objects and notifies a callback object of the collection of provider configs.
+// It also watches OIDCIdentityProvider objects, because the FederationDomains may select them.
 func NewFederationDomainWatcherController(
 	providerSetter ProvidersSetter,
 	clock clock.Clock,
 	client pinnipedclientset.Interface,
 	federationDomainInformer configinformers.FederationDomainInformer,
+	oidcIdentityProviderInformer idpinformers.OIDCIdentityProviderInformer,
 	withInformer pinnipedcontroller.WithInformerOptionFunc,
 ) controllerlib.Controller {
 	return controllerlib.New(
 		controllerlib.Config{
 			Name: "FederationDomainWatcherController",
 			Syncer: &federationDomainWatcherController{
-				providerSetter:           providerSetter,
-				clock:                    clock,
-				client:                   client,
-				federationDomainInformer: federationDomainInformer,
+				providerSetter:               providerSetter,
+				clock:                        clock,
+				client:                       client,
+				federationDomainInformer:     federationDomainInformer,
+				oidcIdentityProviderInformer: oidcIdentityProviderInformer,
 			},
 		},
 		withInformer(
@@ -63,6 +72,11 @@ func NewFederationDomainWatcherController(
 			pinnipedcontroller.MatchAnythingFilter(pinnipedcontroller.SingletonQueue()),
 			controllerlib.InformerOption{},
 		),
+		withInformer(
+			oidcIdentityProviderInformer,
+			pinnipedcontroller.MatchAnythingFilter(pinnipedcontroller.SingletonQueue()),
+			controllerlib.InformerOption{},
+		),
 	)
 }
 
@@ -90,60 +104,125 @@ func (c *federationDomainWatcherController) Sync(ctx controllerlib.Context) erro
 	issuerURLToHostnameKey := lowercaseHostWithoutPort
 
 	for _, federationDomain := range federationDomains {
-		issuerURL, err := url.Parse(federationDomain.Spec.Issuer)
-		if err != nil {
-			continue // Skip url parse errors because they will be validated again below.
-		}
+		// The issuer aliases count as issuers too, so they may not collide with any other issuer or alias.
+		for _, issuer := range issuersAndAliases(federationDomain) {
+			issuerURL, err := url.Parse(issuer)
+			if err != nil {
+				continue // Skip url parse errors because they will be validated again below.
+			}
 
-		issuerCounts[issuerURLToIssuerKey(issuerURL)]++
+			issuerCounts[issuerURLToIssuerKey(issuerURL)]++
 
-		setOfSecretNames := uniqueSecretNamesPerIssuerAddress[issuerURLToHostnameKey(issuerURL)]
-		if setOfSecretNames == nil {
-			setOfSecretNames = make(map[string]bool)
-			uniqueSecretNamesPerIssuerAddress[issuerURLToHostnameKey(issuerURL)] = setOfSecretNames
-		}
-		if federationDomain.Spec.TLS != nil {
-			setOfSecretNames[federationDomain.Spec.TLS.SecretName] = true
+			setOfSecretNames := uniqueSecretNamesPerIssuerAddress[issuerURLToHostnameKey(issuerURL)]
+			if setOfSecretNames == nil {
+				setOfSecretNames = make(map[string]bool)
+				uniqueSecretNamesPerIssuerAddress[issuerURLToHostnameKey(issuerURL)] = setOfSecretNames
+			}
+			if federationDomain.Spec.TLS != nil {
+				setOfSecretNames[federationDomain.Spec.TLS.SecretName] = true
+			}
 		}
 	}
 
 	var errs []error
 
 	federationDomainIssuers := make([]*provider.FederationDomainIssuer, 0)
+federationDomainsLoop:
 	for _, federationDomain := range federationDomains {
-		issuerURL, urlParseErr := url.Parse(federationDomain.Spec.Issuer)
+		for _, issuer := range issuersAndAliases(federationDomain) {
+			issuerURL, urlParseErr := url.Parse(issuer)
+
+			// Skip url parse errors because they will be validated below.
+			if urlParseErr == nil {
+				if issuerCount := issuerCounts[issuerURLToIssuerKey(issuerURL)]; issuerCount > 1 {
+					if err := c.updateStatus(
+						ctx.Context,
+						federationDomain.Namespace,
+						federationDomain.Name,
+						configv1alpha1.DuplicateFederationDomainStatusCondition,
+						"Duplicate issuer: "+issuer,
+					); err != nil {
+						errs = append(errs, fmt.Errorf("could not update status: %w", err))
+					}
+					continue federationDomainsLoop
+				}
+			}
 
-		// Skip url parse errors because they will be validated below.
-		if urlParseErr == nil {
-			if issuerCount := issuerCounts[issuerURLToIssuerKey(issuerURL)]; issuerCount > 1 {
+			// Skip url parse errors because they will be validated below.
+			if urlParseErr == nil && len(uniqueSecretNamesPerIssuerAddress[issuerURLToHostnameKey(issuerURL)]) > 1 {
 				if err := c.updateStatus(
 					ctx.Context,
 					federationDomain.Namespace,
 					federationDomain.Name,
-					configv1alpha1.DuplicateFederationDomainStatusCondition,
-					"Duplicate issuer: "+federationDomain.Spec.Issuer,
+					configv1alpha1.SameIssuerHostMustUseSameSecretFederationDomainStatusCondition,
+					"Issuers with the same DNS hostname (address not including port) must use the same secretName: "+issuerURLToHostnameKey(issuerURL),
 				); err != nil {
 					errs = append(errs, fmt.Errorf("could not update status: %w", err))
 				}
-				continue
+				continue federationDomainsLoop
+			}
+		}
+
+		federationDomainIssuer, err := provider.NewFederationDomainIssuer(federationDomain.Spec.Issuer) // This validates the Issuer URL.
+		if err != nil {
+			if err := c.updateStatus(
+				ctx.Context,
+				federationDomain.Namespace,
+				federationDomain.Name,
+				configv1alpha1.InvalidFederationDomainStatusCondition,
+				"Invalid: "+err.Error(),
+			); err != nil {
+				errs = append(errs, fmt.Errorf("could not update status: %w", err))
 			}
+			continue
 		}
 
-		// Skip url parse errors because they will be validated below.
-		if urlParseErr == nil && len(uniqueSecretNamesPerIssuerAddress[issuerURLToHostnameKey(issuerURL)]) > 1 {
+		aliases, err := issuerAliasesFromSpec(federationDomain.Spec.IssuerAliases)
+		if err != nil {
 			if err := c.updateStatus(
 				ctx.Context,
 				federationDomain.Namespace,
 				federationDomain.Name,
-				configv1alpha1.SameIssuerHostMustUseSameSecretFederationDomainStatusCondition,
-				"Issuers with the same DNS hostname (address not including port) must use the same secretName: "+issuerURLToHostnameKey(issuerURL),
+				configv1alpha1.InvalidFederationDomainStatusCondition,
+				"Invalid: "+err.Error(),
 			); err != nil {
 				errs = append(errs, fmt.Errorf("could not update status: %w", err))
 			}
 			continue
 		}
+		federationDomainIssuer.SetAliases(aliases)
 
-		federationDomainIssuer, err := provider.NewFederationDomainIssuer(federationDomain.Spec.Issuer) // This validates the Issuer URL.
+		tokenExchangeAudiences, err := tokenExchangeAudiencesFromSpec(federationDomain.Spec.TokenExchange)
+		if err != nil {
+			if err := c.updateStatus(
+				ctx.Context,
+				federationDomain.Namespace,
+				federationDomain.Name,
+				configv1alpha1.InvalidFederationDomainStatusCondition,
+				"Invalid: "+err.Error(),
+			); err != nil {
+				errs = append(errs, fmt.Errorf("could not update status: %w", err))
+			}
+			continue
+		}
+		federationDomainIssuer.SetTokenExchangeAudiences(tokenExchangeAudiences)
+
+		trustedJWTIssuers, err := trustedJWTIssuersFromSpec(federationDomain.Spec.TokenExchange)
+		if err != nil {
+			if err := c.updateStatus(
+				ctx.Context,
+				federationDomain.Namespace,
+				federationDomain.Name,
+				configv1alpha1.InvalidFederationDomainStatusCondition,
+				"Invalid: "+err.Error(),
+			); err != nil {
+				errs = append(errs, fmt.Errorf("could not update status: %w", err))
+			}
+			continue
+		}
+		federationDomainIssuer.SetTrustedJWTIssuers(trustedJWTIssuers)
+
+		clients, err := clientsFromSpec(federationDomain.Spec.Clients)
 		if err != nil {
 			if err := c.updateStatus(
 				ctx.Context,
@@ -156,13 +235,39 @@ func (c *federationDomainWatcherController) Sync(ctx controllerlib.Context) erro
 			}
 			continue
 		}
+		federationDomainIssuer.SetClients(clients)
+		if federationDomain.Spec.PinnipedCLIClient != nil {
+			federationDomainIssuer.SetPinnipedCLIClientRequiresDPoP(federationDomain.Spec.PinnipedCLIClient.RequireDPoP)
+		}
 
+		identityProviderNames, notFoundNames, err := c.identityProviderNamesFromSpec(federationDomain)
+		if err != nil {
+			if err := c.updateStatus(
+				ctx.Context,
+				federationDomain.Namespace,
+				federationDomain.Name,
+				configv1alpha1.InvalidFederationDomainStatusCondition,
+				"Invalid: "+err.Error(),
+			); err != nil {
+				errs = append(errs, fmt.Errorf("could not update status: %w", err))
+			}
+			continue
+		}
+		federationDomainIssuer.SetIdentityProviderNames(identityProviderNames)
+
+		// The provider is still created when some of the listed identity providers are not found, so that it can
+		// keep using the others, and so that it does not need to wait for the identity providers to be created.
+		status, message := configv1alpha1.SuccessFederationDomainStatusCondition, "Provider successfully created"
+		if len(notFoundNames) > 0 {
+			status = configv1alpha1.IdentityProvidersNotFoundFederationDomainStatusCondition
+			message = "Provider successfully created, but some identity providers were not found: " + strings.Join(notFoundNames, ", ")
+		}
 		if err := c.updateStatus(
 			ctx.Context,
 			federationDomain.Namespace,
 			federationDomain.Name,
-			configv1alpha1.SuccessFederationDomainStatusCondition,
-			"Provider successfully created",
+			status,
+			message,
 		); err != nil {
 			errs = append(errs, fmt.Errorf("could not update status: %w", err))
 			continue
@@ -176,6 +281,128 @@ func (c *federationDomainWatcherController) Sync(ctx controllerlib.Context) erro
 	return errors.NewAggregate(errs)
 }
 
+// identityProviderNamesFromSpec returns the sorted names of the OIDCIdentityProviders which may be used to log in to
+// the FederationDomain, or nil when all of them may be used. It also returns the sorted names which are listed in the
+// spec but which do not exist.
+func (c *federationDomainWatcherController) identityProviderNamesFromSpec(federationDomain *configv1alpha1.FederationDomain) ([]string, []string, error) {
+	spec := federationDomain.Spec.IdentityProviders
+	if spec == nil {
+		return nil, nil, nil
+	}
+
+	selector := labels.Nothing()
+	if spec.Selector != nil {
+		var err error
+		selector, err = metav1.LabelSelectorAsSelector(spec.Selector)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid identity provider selector: %w", err)
+		}
+	}
+
+	oidcIdentityProviders, err := c.oidcIdentityProviderInformer.Lister().OIDCIdentityProviders(federationDomain.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	names := sets.NewString()
+	existingNames := sets.NewString()
+	for _, oidcIdentityProvider := range oidcIdentityProviders {
+		existingNames.Insert(oidcIdentityProvider.Name)
+		if selector.Matches(labels.Set(oidcIdentityProvider.Labels)) {
+			names.Insert(oidcIdentityProvider.Name)
+		}
+	}
+	notFoundNames := sets.NewString()
+	for _, name := range spec.Names {
+		if existingNames.Has(name) {
+			names.Insert(name)
+		} else {
+			notFoundNames.Insert(name)
+		}
+	}
+
+	return names.List(), notFoundNames.List(), nil
+}
+
+// issuersAndAliases returns the issuer of the FederationDomain followed by all of its issuer aliases.
+func issuersAndAliases(federationDomain *configv1alpha1.FederationDomain) []string {
+	return append([]string{federationDomain.Spec.Issuer}, federationDomain.Spec.IssuerAliases...)
+}
+
+func issuerAliasesFromSpec(issuerAliases []string) ([]*provider.FederationDomainIssuer, error) {
+	var aliases []*provider.FederationDomainIssuer
+	for _, issuerAlias := range issuerAliases {
+		alias, err := provider.NewFederationDomainIssuer(issuerAlias) // This validates the alias the same way as the Issuer URL.
+		if err != nil {
+			return nil, fmt.Errorf("issuer alias %q: %w", issuerAlias, err)
+		}
+		aliases = append(aliases, alias)
+	}
+	return aliases, nil
+}
+
+func tokenExchangeAudiencesFromSpec(spec *configv1alpha1.FederationDomainTokenExchangeSpec) (provider.TokenExchangeAudiences, error) {
+	if spec == nil || len(spec.Audiences) == 0 {
+		return nil, nil
+	}
+	audiences := make(provider.TokenExchangeAudiences, len(spec.Audiences))
+	for _, audience := range spec.Audiences {
+		if _, ok := audiences[audience.Name]; ok {
+			return nil, fmt.Errorf("duplicate token exchange audience %q", audience.Name)
+		}
+		audiences[audience.Name] = audience.AllowedScopes
+	}
+	return audiences, nil
+}
+
+func trustedJWTIssuersFromSpec(spec *configv1alpha1.FederationDomainTokenExchangeSpec) ([]*provider.TrustedJWTIssuer, error) {
+	if spec == nil || len(spec.TrustedJWTIssuers) == 0 {
+		return nil, nil
+	}
+	seenIssuers := make(map[string]bool, len(spec.TrustedJWTIssuers))
+	trustedJWTIssuers := make([]*provider.TrustedJWTIssuer, 0, len(spec.TrustedJWTIssuers))
+	for _, trusted := range spec.TrustedJWTIssuers {
+		if seenIssuers[trusted.Issuer] {
+			return nil, fmt.Errorf("duplicate trusted JWT issuer %q", trusted.Issuer)
+		}
+		seenIssuers[trusted.Issuer] = true
+
+		var caBundle []byte
+		if trusted.CertificateAuthorityData != "" {
+			bundle, err := base64.StdEncoding.DecodeString(trusted.CertificateAuthorityData)
+			if err != nil {
+				return nil, fmt.Errorf("certificateAuthorityData of trusted JWT issuer %q is invalid: %w", trusted.Issuer, err)
+			}
+			if !x509.NewCertPool().AppendCertsFromPEM(bundle) {
+				return nil, fmt.Errorf("certificateAuthorityData of trusted JWT issuer %q is invalid: no certificates found", trusted.Issuer)
+			}
+			caBundle = bundle
+		}
+
+		// Like the Kubernetes API server's OIDC authenticator, namespace the identities under the issuer by default.
+		usernamePrefix, groupsPrefix := trusted.Issuer+"#", trusted.Issuer+"#"
+		if trusted.UsernamePrefix != nil {
+			usernamePrefix = *trusted.UsernamePrefix
+		}
+		if trusted.GroupsPrefix != nil {
+			groupsPrefix = *trusted.GroupsPrefix
+		}
+
+		trustedJWTIssuers = append(trustedJWTIssuers, &provider.TrustedJWTIssuer{
+			Issuer:          trusted.Issuer,
+			JWKSURL:         trusted.JWKSURL,
+			CABundle:        caBundle,
+			Audience:        trusted.Audience,
+			UsernameClaim:   trusted.Claims.Username,
+			GroupsClaim:     trusted.Claims.Groups,
+			UsernamePrefix:  usernamePrefix,
+			GroupsPrefix:    groupsPrefix,
+			AllowedSubjects: trusted.AllowedSubjects,
+		})
+	}
+	return trustedJWTIssuers, nil
+}
+
 func (c *federationDomainWatcherController) updateStatus(
 	ctx context.Context,
 	namespace, name string,
@@ -210,3 +437,67 @@ func (c *federationDomainWatcherController) updateStatus(
 }
 
 func timePtr(t metav1.Time) *metav1.Time { return &t }
+
+func clientsFromSpec(specClients []configv1alpha1.FederationDomainClient) ([]*provider.Client, error) {
+	if len(specClients) == 0 {
+		return nil, nil
+	}
+	seenIDs := map[string]bool{
+		// Reserved for the Pinniped CLI, which is always a client of every FederationDomain.
+		"pinniped-cli": true,
+	}
+	clients := make([]*provider.Client, 0, len(specClients))
+	for _, client := range specClients {
+		if seenIDs[client.ID] {
+			return nil, fmt.Errorf("duplicate or reserved client ID %q", client.ID)
+		}
+		seenIDs[client.ID] = true
+
+		if _, err := bcrypt.Cost([]byte(client.SecretHash)); err != nil {
+			return nil, fmt.Errorf("secretHash of client %q is not a bcrypt hash: %w", client.ID, err)
+		}
+
+		for _, redirectURI := range client.RedirectURIs {
+			if u, err := url.Parse(redirectURI); err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+				return nil, fmt.Errorf("redirect URI %q of client %q must be an absolute URL without a fragment", redirectURI, client.ID)
+			}
+		}
+
+		sectorIdentifier, err := sectorIdentifierFromSpec(client)
+		if err != nil {
+			return nil, err
+		}
+
+		clients = append(clients, &provider.Client{
+			ID:               client.ID,
+			SecretHash:       []byte(client.SecretHash),
+			Username:         client.Username,
+			Groups:           client.Groups,
+			AllowedScopes:    client.AllowedScopes,
+			AllowedAudiences: client.AllowedAudiences,
+			RequireDPoP:      client.RequireDPoP,
+			RedirectURIs:     client.RedirectURIs,
+			SectorIdentifier: sectorIdentifier,
+		})
+	}
+	return clients, nil
+}
+
+// sectorIdentifierFromSpec returns the sector identifier of the pairwise subjects of the client, or an empty string
+// when the client gets public subjects.
+func sectorIdentifierFromSpec(client configv1alpha1.FederationDomainClient) (string, error) {
+	switch client.SubjectType {
+	case "", "public":
+		if client.SectorIdentifier != "" {
+			return "", fmt.Errorf("sectorIdentifier of client %q may only be set when its subjectType is \"pairwise\"", client.ID)
+		}
+		return "", nil
+	case "pairwise":
+		if client.SectorIdentifier == "" {
+			return client.ID, nil
+		}
+		return client.SectorIdentifier, nil
+	default:
+		return "", fmt.Errorf("subjectType of client %q must be \"public\" or \"pairwise\"", client.ID)
+	}
+}
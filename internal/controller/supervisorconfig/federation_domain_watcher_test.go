@@ -24,6 +24,7 @@ import (
 	coretesting "k8s.io/client-go/testing"
 
 	"go.pinniped.dev/generated/1.20/apis/supervisor/config/v1alpha1"
+	idpv1alpha1 "go.pinniped.dev/generated/1.20/apis/supervisor/idp/v1alpha1"
 	pinnipedfake "go.pinniped.dev/generated/1.20/client/supervisor/clientset/versioned/fake"
 	pinnipedinformers "go.pinniped.dev/generated/1.20/client/supervisor/informers/externalversions"
 	"go.pinniped.dev/internal/controllerlib"
@@ -37,19 +38,24 @@ func TestInformerFilters(t *testing.T) {
 		var r *require.Assertions
 		var observableWithInformerOption *testutil.ObservableWithInformerOption
 		var configMapInformerFilter controllerlib.Filter
+		var oidcIdentityProviderInformerFilter controllerlib.Filter
 
 		it.Before(func() {
 			r = require.New(t)
 			observableWithInformerOption = testutil.NewObservableWithInformerOption()
-			federationDomainInformer := pinnipedinformers.NewSharedInformerFactoryWithOptions(nil, 0).Config().V1alpha1().FederationDomains()
+			informerFactory := pinnipedinformers.NewSharedInformerFactoryWithOptions(nil, 0)
+			federationDomainInformer := informerFactory.Config().V1alpha1().FederationDomains()
+			oidcIdentityProviderInformer := informerFactory.IDP().V1alpha1().OIDCIdentityProviders()
 			_ = NewFederationDomainWatcherController(
 				nil,
 				nil,
 				nil,
 				federationDomainInformer,
+				oidcIdentityProviderInformer,
 				observableWithInformerOption.WithInformer, // make it possible to observe the behavior of the Filters
 			)
 			configMapInformerFilter = observableWithInformerOption.GetFilterForInformer(federationDomainInformer)
+			oidcIdentityProviderInformerFilter = observableWithInformerOption.GetFilterForInformer(oidcIdentityProviderInformer)
 		})
 
 		when("watching FederationDomain objects", func() {
@@ -80,6 +86,25 @@ func TestInformerFilters(t *testing.T) {
 				})
 			})
 		})
+
+		when("watching OIDCIdentityProvider objects", func() {
+			var subject controllerlib.Filter
+			var target, otherName *idpv1alpha1.OIDCIdentityProvider
+
+			it.Before(func() {
+				subject = oidcIdentityProviderInformerFilter
+				target = &idpv1alpha1.OIDCIdentityProvider{ObjectMeta: metav1.ObjectMeta{Name: "some-name", Namespace: "some-namespace"}}
+				otherName = &idpv1alpha1.OIDCIdentityProvider{ObjectMeta: metav1.ObjectMeta{Name: "other-name", Namespace: "some-namespace"}}
+			})
+
+			when("any OIDCIdentityProvider changes", func() {
+				it("returns true to trigger the sync method, because FederationDomains may select it", func() {
+					r.True(subject.Add(target))
+					r.True(subject.Update(target, otherName))
+					r.True(subject.Delete(target))
+				})
+			})
+		})
 	}, spec.Parallel(), spec.Report(report.Terminal{}))
 }
 
@@ -119,6 +144,7 @@ func TestSync(t *testing.T) {
 				clock.NewFakeClock(frozenNow),
 				pinnipedAPIClient,
 				federationDomainInformers.Config().V1alpha1().FederationDomains(),
+				federationDomainInformers.IDP().V1alpha1().OIDCIdentityProviders(),
 				controllerlib.WithInformer,
 			)
 
@@ -661,6 +687,599 @@ func TestSync(t *testing.T) {
 			})
 		})
 
+		when("there are FederationDomains with valid and invalid token exchange audiences in the informer", func() {
+			var (
+				validFederationDomain   *v1alpha1.FederationDomain
+				invalidFederationDomain *v1alpha1.FederationDomain
+			)
+
+			it.Before(func() {
+				validFederationDomain = &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "valid-config", Namespace: namespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer: "https://valid-issuer.com",
+						TokenExchange: &v1alpha1.FederationDomainTokenExchangeSpec{
+							Audiences: []v1alpha1.FederationDomainTokenExchangeAudience{
+								{Name: "some-api", AllowedScopes: []string{"openid", "some-scope"}},
+								{Name: "https://other-api.example.com"},
+							},
+						},
+					},
+				}
+				r.NoError(pinnipedAPIClient.Tracker().Add(validFederationDomain))
+				r.NoError(federationDomainInformerClient.Tracker().Add(validFederationDomain))
+
+				invalidFederationDomain = &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "invalid-config", Namespace: namespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer: "https://invalid-issuer.com",
+						TokenExchange: &v1alpha1.FederationDomainTokenExchangeSpec{
+							Audiences: []v1alpha1.FederationDomainTokenExchangeAudience{
+								{Name: "some-api", AllowedScopes: []string{"openid"}},
+								{Name: "some-api", AllowedScopes: []string{"some-scope"}},
+							},
+						},
+					},
+				}
+				r.NoError(pinnipedAPIClient.Tracker().Add(invalidFederationDomain))
+				r.NoError(federationDomainInformerClient.Tracker().Add(invalidFederationDomain))
+			})
+
+			it("calls the ProvidersSetter with the valid provider and its audiences", func() {
+				startInformersAndController()
+				err := controllerlib.TestSync(t, subject, *syncContext)
+				r.NoError(err)
+
+				validProvider, err := provider.NewFederationDomainIssuer(validFederationDomain.Spec.Issuer)
+				r.NoError(err)
+				validProvider.SetTokenExchangeAudiences(provider.TokenExchangeAudiences{
+					"some-api":                      {"openid", "some-scope"},
+					"https://other-api.example.com": nil,
+				})
+
+				r.True(providersSetter.SetProvidersWasCalled)
+				r.Equal(
+					[]*provider.FederationDomainIssuer{
+						validProvider,
+					},
+					providersSetter.FederationDomainsReceived,
+				)
+			})
+
+			it("updates the status to success/invalid in the FederationDomains", func() {
+				startInformersAndController()
+				err := controllerlib.TestSync(t, subject, *syncContext)
+				r.NoError(err)
+
+				validFederationDomain.Status.Status = v1alpha1.SuccessFederationDomainStatusCondition
+				validFederationDomain.Status.Message = "Provider successfully created"
+				validFederationDomain.Status.LastUpdateTime = timePtr(metav1.NewTime(frozenNow))
+
+				invalidFederationDomain.Status.Status = v1alpha1.InvalidFederationDomainStatusCondition
+				invalidFederationDomain.Status.Message = `Invalid: duplicate token exchange audience "some-api"`
+				invalidFederationDomain.Status.LastUpdateTime = timePtr(metav1.NewTime(frozenNow))
+
+				expectedActions := []coretesting.Action{
+					coretesting.NewGetAction(
+						federationDomainGVR,
+						invalidFederationDomain.Namespace,
+						invalidFederationDomain.Name,
+					),
+					coretesting.NewUpdateAction(
+						federationDomainGVR,
+						invalidFederationDomain.Namespace,
+						invalidFederationDomain,
+					),
+					coretesting.NewGetAction(
+						federationDomainGVR,
+						validFederationDomain.Namespace,
+						validFederationDomain.Name,
+					),
+					coretesting.NewUpdateAction(
+						federationDomainGVR,
+						validFederationDomain.Namespace,
+						validFederationDomain,
+					),
+				}
+				r.ElementsMatch(expectedActions, pinnipedAPIClient.Actions())
+			})
+		})
+
+		when("there is a FederationDomain with trusted JWT issuers in the informer", func() {
+			var federationDomain *v1alpha1.FederationDomain
+
+			it.Before(func() {
+				emptyPrefix := ""
+				federationDomain = &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: namespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer: "https://issuer.com",
+						TokenExchange: &v1alpha1.FederationDomainTokenExchangeSpec{
+							TrustedJWTIssuers: []v1alpha1.FederationDomainTrustedJWTIssuer{
+								{
+									Issuer:          "https://ci.example.com",
+									JWKSURL:         "https://ci.example.com/jwks.json",
+									Audience:        "some-audience",
+									Claims:          v1alpha1.FederationDomainTrustedJWTIssuerClaims{Username: "actor", Groups: "teams"},
+									AllowedSubjects: []string{"repo:acme/*"},
+								},
+								{
+									Issuer:          "https://cluster.example.com",
+									JWKSURL:         "https://cluster.example.com/jwks.json",
+									Audience:        "some-audience",
+									Claims:          v1alpha1.FederationDomainTrustedJWTIssuerClaims{Username: "username", Groups: "groups"},
+									UsernamePrefix:  &emptyPrefix,
+									GroupsPrefix:    &emptyPrefix,
+									AllowedSubjects: []string{"system:serviceaccount:ci:*"},
+								},
+							},
+						},
+					},
+				}
+				r.NoError(pinnipedAPIClient.Tracker().Add(federationDomain))
+				r.NoError(federationDomainInformerClient.Tracker().Add(federationDomain))
+			})
+
+			it("calls the ProvidersSetter with the identities of the issuers namespaced under the issuer by default", func() {
+				startInformersAndController()
+				err := controllerlib.TestSync(t, subject, *syncContext)
+				r.NoError(err)
+
+				validProvider, err := provider.NewFederationDomainIssuer(federationDomain.Spec.Issuer)
+				r.NoError(err)
+				validProvider.SetTrustedJWTIssuers([]*provider.TrustedJWTIssuer{
+					{
+						Issuer:          "https://ci.example.com",
+						JWKSURL:         "https://ci.example.com/jwks.json",
+						Audience:        "some-audience",
+						UsernameClaim:   "actor",
+						GroupsClaim:     "teams",
+						UsernamePrefix:  "https://ci.example.com#",
+						GroupsPrefix:    "https://ci.example.com#",
+						AllowedSubjects: []string{"repo:acme/*"},
+					},
+					{
+						Issuer:          "https://cluster.example.com",
+						JWKSURL:         "https://cluster.example.com/jwks.json",
+						Audience:        "some-audience",
+						UsernameClaim:   "username",
+						GroupsClaim:     "groups",
+						AllowedSubjects: []string{"system:serviceaccount:ci:*"},
+					},
+				})
+
+				r.True(providersSetter.SetProvidersWasCalled)
+				r.Equal(
+					[]*provider.FederationDomainIssuer{
+						validProvider,
+					},
+					providersSetter.FederationDomainsReceived,
+				)
+			})
+		})
+
+		when("there are FederationDomains with valid and invalid clients in the informer", func() {
+			const secretHash = "$2a$04$WYkGprPwGt/HDB6meTZqeuyEddBC.PbVNu9puENNJfbbk2FuWxkPe"
+
+			var (
+				validFederationDomain              *v1alpha1.FederationDomain
+				invalidFederationDomain            *v1alpha1.FederationDomain
+				invalidRedirectURIFederationDomain *v1alpha1.FederationDomain
+				invalidSubjectTypeFederationDomain *v1alpha1.FederationDomain
+			)
+
+			it.Before(func() {
+				validFederationDomain = &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "valid-config", Namespace: namespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer: "https://valid-issuer.com",
+						Clients: []v1alpha1.FederationDomainClient{
+							{
+								ID:               "some-client",
+								SecretHash:       secretHash,
+								Username:         "some-service-account",
+								Groups:           []string{"some-group"},
+								AllowedScopes:    []string{"openid"},
+								AllowedAudiences: []string{"some-api"},
+								RequireDPoP:      true,
+							},
+							{
+								ID:           "some-web-app",
+								SecretHash:   secretHash,
+								RedirectURIs: []string{"https://some-web-app.com/callback"},
+								SubjectType:  "pairwise",
+							},
+							{
+								ID:               "some-other-web-app",
+								SecretHash:       secretHash,
+								RedirectURIs:     []string{"https://some-other-web-app.com/callback"},
+								SubjectType:      "pairwise",
+								SectorIdentifier: "some-web-app",
+							},
+						},
+						PinnipedCLIClient: &v1alpha1.FederationDomainPinnipedCLIClientSpec{RequireDPoP: true},
+					},
+				}
+				r.NoError(pinnipedAPIClient.Tracker().Add(validFederationDomain))
+				r.NoError(federationDomainInformerClient.Tracker().Add(validFederationDomain))
+
+				invalidFederationDomain = &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "invalid-config", Namespace: namespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer: "https://invalid-issuer.com",
+						Clients: []v1alpha1.FederationDomainClient{
+							{ID: "pinniped-cli", SecretHash: secretHash, Username: "some-service-account"},
+						},
+					},
+				}
+				r.NoError(pinnipedAPIClient.Tracker().Add(invalidFederationDomain))
+				r.NoError(federationDomainInformerClient.Tracker().Add(invalidFederationDomain))
+
+				invalidRedirectURIFederationDomain = &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "invalid-redirect-uri-config", Namespace: namespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer: "https://invalid-redirect-uri-issuer.com",
+						Clients: []v1alpha1.FederationDomainClient{
+							{ID: "some-web-app", SecretHash: secretHash, RedirectURIs: []string{"https://some-web-app.com/callback#fragment"}},
+						},
+					},
+				}
+				r.NoError(pinnipedAPIClient.Tracker().Add(invalidRedirectURIFederationDomain))
+				r.NoError(federationDomainInformerClient.Tracker().Add(invalidRedirectURIFederationDomain))
+
+				invalidSubjectTypeFederationDomain = &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "invalid-subject-type-config", Namespace: namespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer: "https://invalid-subject-type-issuer.com",
+						Clients: []v1alpha1.FederationDomainClient{
+							{ID: "some-web-app", SecretHash: secretHash, SectorIdentifier: "some-sector"},
+						},
+					},
+				}
+				r.NoError(pinnipedAPIClient.Tracker().Add(invalidSubjectTypeFederationDomain))
+				r.NoError(federationDomainInformerClient.Tracker().Add(invalidSubjectTypeFederationDomain))
+			})
+
+			it("calls the ProvidersSetter with the valid provider and its clients and their DPoP requirements", func() {
+				startInformersAndController()
+				err := controllerlib.TestSync(t, subject, *syncContext)
+				r.NoError(err)
+
+				validProvider, err := provider.NewFederationDomainIssuer(validFederationDomain.Spec.Issuer)
+				r.NoError(err)
+				validProvider.SetClients([]*provider.Client{{
+					ID:               "some-client",
+					SecretHash:       []byte(secretHash),
+					Username:         "some-service-account",
+					Groups:           []string{"some-group"},
+					AllowedScopes:    []string{"openid"},
+					AllowedAudiences: []string{"some-api"},
+					RequireDPoP:      true,
+				}, {
+					ID:               "some-web-app",
+					SecretHash:       []byte(secretHash),
+					RedirectURIs:     []string{"https://some-web-app.com/callback"},
+					SectorIdentifier: "some-web-app",
+				}, {
+					ID:               "some-other-web-app",
+					SecretHash:       []byte(secretHash),
+					RedirectURIs:     []string{"https://some-other-web-app.com/callback"},
+					SectorIdentifier: "some-web-app",
+				}})
+				validProvider.SetPinnipedCLIClientRequiresDPoP(true)
+
+				r.True(providersSetter.SetProvidersWasCalled)
+				r.Equal(
+					[]*provider.FederationDomainIssuer{
+						validProvider,
+					},
+					providersSetter.FederationDomainsReceived,
+				)
+			})
+
+			it("updates the status to success/invalid in the FederationDomains", func() {
+				startInformersAndController()
+				err := controllerlib.TestSync(t, subject, *syncContext)
+				r.NoError(err)
+
+				validFederationDomain.Status.Status = v1alpha1.SuccessFederationDomainStatusCondition
+				validFederationDomain.Status.Message = "Provider successfully created"
+				validFederationDomain.Status.LastUpdateTime = timePtr(metav1.NewTime(frozenNow))
+
+				invalidFederationDomain.Status.Status = v1alpha1.InvalidFederationDomainStatusCondition
+				invalidFederationDomain.Status.Message = `Invalid: duplicate or reserved client ID "pinniped-cli"`
+				invalidFederationDomain.Status.LastUpdateTime = timePtr(metav1.NewTime(frozenNow))
+
+				invalidRedirectURIFederationDomain.Status.Status = v1alpha1.InvalidFederationDomainStatusCondition
+				invalidRedirectURIFederationDomain.Status.Message = `Invalid: redirect URI "https://some-web-app.com/callback#fragment" of client "some-web-app" must be an absolute URL without a fragment`
+				invalidRedirectURIFederationDomain.Status.LastUpdateTime = timePtr(metav1.NewTime(frozenNow))
+
+				invalidSubjectTypeFederationDomain.Status.Status = v1alpha1.InvalidFederationDomainStatusCondition
+				invalidSubjectTypeFederationDomain.Status.Message = `Invalid: sectorIdentifier of client "some-web-app" may only be set when its subjectType is "pairwise"`
+				invalidSubjectTypeFederationDomain.Status.LastUpdateTime = timePtr(metav1.NewTime(frozenNow))
+
+				expectedActions := []coretesting.Action{
+					coretesting.NewGetAction(
+						federationDomainGVR,
+						invalidRedirectURIFederationDomain.Namespace,
+						invalidRedirectURIFederationDomain.Name,
+					),
+					coretesting.NewUpdateAction(
+						federationDomainGVR,
+						invalidRedirectURIFederationDomain.Namespace,
+						invalidRedirectURIFederationDomain,
+					),
+					coretesting.NewGetAction(
+						federationDomainGVR,
+						invalidSubjectTypeFederationDomain.Namespace,
+						invalidSubjectTypeFederationDomain.Name,
+					),
+					coretesting.NewUpdateAction(
+						federationDomainGVR,
+						invalidSubjectTypeFederationDomain.Namespace,
+						invalidSubjectTypeFederationDomain,
+					),
+					coretesting.NewGetAction(
+						federationDomainGVR,
+						invalidFederationDomain.Namespace,
+						invalidFederationDomain.Name,
+					),
+					coretesting.NewUpdateAction(
+						federationDomainGVR,
+						invalidFederationDomain.Namespace,
+						invalidFederationDomain,
+					),
+					coretesting.NewGetAction(
+						federationDomainGVR,
+						validFederationDomain.Namespace,
+						validFederationDomain.Name,
+					),
+					coretesting.NewUpdateAction(
+						federationDomainGVR,
+						validFederationDomain.Namespace,
+						validFederationDomain,
+					),
+				}
+				r.ElementsMatch(expectedActions, pinnipedAPIClient.Actions())
+			})
+		})
+
+		when("there are FederationDomains which select identity providers in the informer", func() {
+			var (
+				allFederationDomain      *v1alpha1.FederationDomain
+				selectFederationDomain   *v1alpha1.FederationDomain
+				notFoundFederationDomain *v1alpha1.FederationDomain
+				invalidFederationDomain  *v1alpha1.FederationDomain
+			)
+
+			it.Before(func() {
+				for _, oidcIdentityProvider := range []*idpv1alpha1.OIDCIdentityProvider{
+					{ObjectMeta: metav1.ObjectMeta{Name: "employees-idp", Namespace: namespace, Labels: map[string]string{"audience": "employees"}}},
+					{ObjectMeta: metav1.ObjectMeta{Name: "contractors-idp", Namespace: namespace, Labels: map[string]string{"audience": "contractors"}}},
+					{ObjectMeta: metav1.ObjectMeta{Name: "other-namespace-idp", Namespace: "other-namespace", Labels: map[string]string{"audience": "employees"}}},
+				} {
+					r.NoError(federationDomainInformerClient.Tracker().Add(oidcIdentityProvider))
+				}
+
+				allFederationDomain = &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "all-config", Namespace: namespace},
+					Spec:       v1alpha1.FederationDomainSpec{Issuer: "https://all-issuer.com"},
+				}
+				selectFederationDomain = &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "select-config", Namespace: namespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer: "https://select-issuer.com",
+						IdentityProviders: &v1alpha1.FederationDomainIdentityProvidersSpec{
+							Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"audience": "employees"}},
+						},
+					},
+				}
+				notFoundFederationDomain = &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "not-found-config", Namespace: namespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer: "https://not-found-issuer.com",
+						IdentityProviders: &v1alpha1.FederationDomainIdentityProvidersSpec{
+							Names: []string{"contractors-idp", "missing-idp2", "missing-idp1", "other-namespace-idp"},
+						},
+					},
+				}
+				invalidFederationDomain = &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "invalid-config", Namespace: namespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer: "https://invalid-issuer.com",
+						IdentityProviders: &v1alpha1.FederationDomainIdentityProvidersSpec{
+							Selector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+								{Key: "audience", Operator: "bad-operator"},
+							}},
+						},
+					},
+				}
+				for _, federationDomain := range []*v1alpha1.FederationDomain{
+					allFederationDomain, selectFederationDomain, notFoundFederationDomain, invalidFederationDomain,
+				} {
+					r.NoError(pinnipedAPIClient.Tracker().Add(federationDomain))
+					r.NoError(federationDomainInformerClient.Tracker().Add(federationDomain))
+				}
+			})
+
+			it("calls the ProvidersSetter with the identity providers of each valid provider", func() {
+				startInformersAndController()
+				err := controllerlib.TestSync(t, subject, *syncContext)
+				r.NoError(err)
+
+				allProvider, err := provider.NewFederationDomainIssuer(allFederationDomain.Spec.Issuer)
+				r.NoError(err)
+				selectProvider, err := provider.NewFederationDomainIssuer(selectFederationDomain.Spec.Issuer)
+				r.NoError(err)
+				selectProvider.SetIdentityProviderNames([]string{"employees-idp"})
+				notFoundProvider, err := provider.NewFederationDomainIssuer(notFoundFederationDomain.Spec.Issuer)
+				r.NoError(err)
+				notFoundProvider.SetIdentityProviderNames([]string{"contractors-idp"})
+
+				r.True(providersSetter.SetProvidersWasCalled)
+				r.ElementsMatch(
+					[]*provider.FederationDomainIssuer{
+						allProvider,
+						selectProvider,
+						notFoundProvider,
+					},
+					providersSetter.FederationDomainsReceived,
+				)
+			})
+
+			it("updates the statuses, reporting the identity providers which were not found", func() {
+				startInformersAndController()
+				err := controllerlib.TestSync(t, subject, *syncContext)
+				r.NoError(err)
+
+				allFederationDomain.Status.Status = v1alpha1.SuccessFederationDomainStatusCondition
+				allFederationDomain.Status.Message = "Provider successfully created"
+				allFederationDomain.Status.LastUpdateTime = timePtr(metav1.NewTime(frozenNow))
+
+				selectFederationDomain.Status.Status = v1alpha1.SuccessFederationDomainStatusCondition
+				selectFederationDomain.Status.Message = "Provider successfully created"
+				selectFederationDomain.Status.LastUpdateTime = timePtr(metav1.NewTime(frozenNow))
+
+				notFoundFederationDomain.Status.Status = v1alpha1.IdentityProvidersNotFoundFederationDomainStatusCondition
+				notFoundFederationDomain.Status.Message = "Provider successfully created, but some identity providers were not found: missing-idp1, missing-idp2, other-namespace-idp"
+				notFoundFederationDomain.Status.LastUpdateTime = timePtr(metav1.NewTime(frozenNow))
+
+				invalidFederationDomain.Status.Status = v1alpha1.InvalidFederationDomainStatusCondition
+				invalidFederationDomain.Status.Message = `Invalid: invalid identity provider selector: "bad-operator" is not a valid pod selector operator`
+				invalidFederationDomain.Status.LastUpdateTime = timePtr(metav1.NewTime(frozenNow))
+
+				expectedActions := []coretesting.Action{}
+				for _, federationDomain := range []*v1alpha1.FederationDomain{
+					allFederationDomain, selectFederationDomain, notFoundFederationDomain, invalidFederationDomain,
+				} {
+					expectedActions = append(expectedActions,
+						coretesting.NewGetAction(
+							federationDomainGVR,
+							federationDomain.Namespace,
+							federationDomain.Name,
+						),
+						coretesting.NewUpdateAction(
+							federationDomainGVR,
+							federationDomain.Namespace,
+							federationDomain,
+						),
+					)
+				}
+				r.ElementsMatch(expectedActions, pinnipedAPIClient.Actions())
+			})
+		})
+
+		when("there are FederationDomains with valid, invalid and duplicate issuer aliases in the informer", func() {
+			var (
+				validFederationDomain      *v1alpha1.FederationDomain
+				invalidFederationDomain    *v1alpha1.FederationDomain
+				federationDomainDuplicate1 *v1alpha1.FederationDomain
+				federationDomainDuplicate2 *v1alpha1.FederationDomain
+			)
+
+			it.Before(func() {
+				validFederationDomain = &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "valid-config", Namespace: namespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer:        "https://valid-issuer.com",
+						IssuerAliases: []string{"https://valid-issuer-alias.com", "https://valid-issuer.com/alias"},
+					},
+				}
+				r.NoError(pinnipedAPIClient.Tracker().Add(validFederationDomain))
+				r.NoError(federationDomainInformerClient.Tracker().Add(validFederationDomain))
+
+				invalidFederationDomain = &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "invalid-config", Namespace: namespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer:        "https://invalid-issuer.com",
+						IssuerAliases: []string{"http://invalid-issuer-alias.com"},
+					},
+				}
+				r.NoError(pinnipedAPIClient.Tracker().Add(invalidFederationDomain))
+				r.NoError(federationDomainInformerClient.Tracker().Add(invalidFederationDomain))
+
+				// An alias of one FederationDomain may not be the issuer of another FederationDomain.
+				federationDomainDuplicate1 = &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "duplicate1", Namespace: namespace},
+					Spec: v1alpha1.FederationDomainSpec{
+						Issuer:        "https://issuer1.com",
+						IssuerAliases: []string{"https://iSSueR-duPlicAte.cOm/a"},
+					},
+				}
+				r.NoError(pinnipedAPIClient.Tracker().Add(federationDomainDuplicate1))
+				r.NoError(federationDomainInformerClient.Tracker().Add(federationDomainDuplicate1))
+				federationDomainDuplicate2 = &v1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "duplicate2", Namespace: namespace},
+					Spec:       v1alpha1.FederationDomainSpec{Issuer: "https://issuer-duplicate.com/a"},
+				}
+				r.NoError(pinnipedAPIClient.Tracker().Add(federationDomainDuplicate2))
+				r.NoError(federationDomainInformerClient.Tracker().Add(federationDomainDuplicate2))
+			})
+
+			it("calls the ProvidersSetter with the valid provider and its aliases", func() {
+				startInformersAndController()
+				err := controllerlib.TestSync(t, subject, *syncContext)
+				r.NoError(err)
+
+				validProvider, err := provider.NewFederationDomainIssuer(validFederationDomain.Spec.Issuer)
+				r.NoError(err)
+				alias1, err := provider.NewFederationDomainIssuer("https://valid-issuer-alias.com")
+				r.NoError(err)
+				alias2, err := provider.NewFederationDomainIssuer("https://valid-issuer.com/alias")
+				r.NoError(err)
+				validProvider.SetAliases([]*provider.FederationDomainIssuer{alias1, alias2})
+
+				r.True(providersSetter.SetProvidersWasCalled)
+				r.Equal(
+					[]*provider.FederationDomainIssuer{
+						validProvider,
+					},
+					providersSetter.FederationDomainsReceived,
+				)
+			})
+
+			it("updates the statuses", func() {
+				startInformersAndController()
+				err := controllerlib.TestSync(t, subject, *syncContext)
+				r.NoError(err)
+
+				validFederationDomain.Status.Status = v1alpha1.SuccessFederationDomainStatusCondition
+				validFederationDomain.Status.Message = "Provider successfully created"
+				validFederationDomain.Status.LastUpdateTime = timePtr(metav1.NewTime(frozenNow))
+
+				invalidFederationDomain.Status.Status = v1alpha1.InvalidFederationDomainStatusCondition
+				invalidFederationDomain.Status.Message = `Invalid: issuer alias "http://invalid-issuer-alias.com": issuer must have "https" scheme`
+				invalidFederationDomain.Status.LastUpdateTime = timePtr(metav1.NewTime(frozenNow))
+
+				federationDomainDuplicate1.Status.Status = v1alpha1.DuplicateFederationDomainStatusCondition
+				federationDomainDuplicate1.Status.Message = "Duplicate issuer: https://iSSueR-duPlicAte.cOm/a"
+				federationDomainDuplicate1.Status.LastUpdateTime = timePtr(metav1.NewTime(frozenNow))
+
+				federationDomainDuplicate2.Status.Status = v1alpha1.DuplicateFederationDomainStatusCondition
+				federationDomainDuplicate2.Status.Message = "Duplicate issuer: https://issuer-duplicate.com/a"
+				federationDomainDuplicate2.Status.LastUpdateTime = timePtr(metav1.NewTime(frozenNow))
+
+				expectedActions := []coretesting.Action{}
+				for _, federationDomain := range []*v1alpha1.FederationDomain{
+					validFederationDomain, invalidFederationDomain, federationDomainDuplicate1, federationDomainDuplicate2,
+				} {
+					expectedActions = append(expectedActions,
+						coretesting.NewGetAction(
+							federationDomainGVR,
+							federationDomain.Namespace,
+							federationDomain.Name,
+						),
+						coretesting.NewUpdateAction(
+							federationDomainGVR,
+							federationDomain.Namespace,
+							federationDomain,
+						),
+					)
+				}
+				r.ElementsMatch(expectedActions, pinnipedAPIClient.Actions())
+			})
+		})
+
 		when("there are FederationDomains with duplicate issuer names in the informer", func() {
 			var (
 				federationDomainDuplicate1 *v1alpha1.FederationDomain
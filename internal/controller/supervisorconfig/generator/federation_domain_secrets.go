@@ -107,6 +107,16 @@ func (c *federationDomainSecretsController) Sync(ctx controllerlib.Context) erro
 		return fmt.Errorf("failed to determine secret status: %w", err)
 	}
 	if !secretNeedsUpdate {
+		// Rotate the key of the secret if it is due, keeping the current key so that the values which were encoded
+		// with it can still be decoded.
+		if rotatedSecret := c.secretHelper.RotateKey(existingSecret, newSecret); rotatedSecret != nil {
+			existingSecret, err = c.kubeClient.CoreV1().Secrets(rotatedSecret.Namespace).Update(ctx.Context, rotatedSecret, metav1.UpdateOptions{})
+			if err != nil {
+				return fmt.Errorf("failed to rotate secret key: %w", err)
+			}
+			plog.Debug("rotated secret key", "federationdomain", klog.KObj(federationDomain), "secret", klog.KObj(existingSecret))
+		}
+
 		// Secret is up to date - we are good to go.
 		plog.Debug(
 			"secret is up to date",
@@ -122,6 +132,7 @@ func (c *federationDomainSecretsController) Sync(ctx controllerlib.Context) erro
 		}
 		plog.Debug("updated federationdomain", "federationdomain", klog.KObj(federationDomain), "secret", klog.KObj(newSecret))
 
+		c.requeueForKeyRotation(ctx, existingSecret)
 		return nil
 	}
 
@@ -138,9 +149,17 @@ func (c *federationDomainSecretsController) Sync(ctx controllerlib.Context) erro
 	}
 	plog.Debug("updated federationdomain", "federationdomain", klog.KObj(federationDomain), "secret", klog.KObj(newSecret))
 
+	c.requeueForKeyRotation(ctx, newSecret)
 	return nil
 }
 
+// requeueForKeyRotation syncs the FederationDomain again when the key ring of its secret next changes.
+func (c *federationDomainSecretsController) requeueForKeyRotation(ctx controllerlib.Context, secret *corev1.Secret) {
+	if wait := c.secretHelper.NextKeyRotationCheck(secret); wait > 0 && ctx.Queue != nil {
+		ctx.Queue.AddAfter(ctx.Key, wait)
+	}
+}
+
 // secretNeedsUpdate returns whether or not the Secret, with name secretName, for the federationDomain param
 // needs to be updated. It returns the existing secret as its second argument.
 func (c *federationDomainSecretsController) secretNeedsUpdate(
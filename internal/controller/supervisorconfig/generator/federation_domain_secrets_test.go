@@ -19,6 +19,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/clock"
 	kubeinformers "k8s.io/client-go/informers"
 	kubernetesfake "k8s.io/client-go/kubernetes/fake"
 	kubetesting "k8s.io/client-go/testing"
@@ -178,7 +179,9 @@ func TestFederationDomainControllerFilterSecret(t *testing.T) {
 				map[string]string{},
 				rand.Reader,
 				SecretUsageTokenSigningKey,
-				func(cacheKey string, cacheValue []byte) {},
+				func(cacheKey string, cacheValues [][]byte) {},
+				KeyRotation{},
+				clock.RealClock{},
 			)
 
 			secretInformer := kubeinformers.NewSharedInformerFactory(
@@ -241,7 +244,9 @@ func TestNewFederationDomainSecretsControllerFilterFederationDomain(t *testing.T
 				map[string]string{},
 				rand.Reader,
 				SecretUsageTokenSigningKey,
-				func(cacheKey string, cacheValue []byte) {},
+				func(cacheKey string, cacheValues [][]byte) {},
+				KeyRotation{},
+				clock.RealClock{},
 			)
 
 			secretInformer := kubeinformers.NewSharedInformerFactory(
@@ -342,6 +347,12 @@ func TestFederationDomainSecretsControllerSync(t *testing.T) {
 	goodFederationDomainWithJWKSAndTokenSigningKey := goodFederationDomainWithJWKS.DeepCopy()
 	goodFederationDomainWithJWKSAndTokenSigningKey.Status.Secrets.TokenSigningKey = goodFederationDomainWithTokenSigningKey.Status.Secrets.TokenSigningKey
 
+	rotatedSecret := goodSecret.DeepCopy()
+	rotatedSecret.Data = map[string][]byte{
+		"some-key":          []byte("some-new-value"),
+		"some-previous-key": []byte("some-value"),
+	}
+
 	invalidSecret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      secretName,
@@ -367,6 +378,7 @@ func TestFederationDomainSecretsControllerSync(t *testing.T) {
 		secretHelper                func(*mocksecrethelper.MockSecretHelper)
 		wantFederationDomainActions []kubetesting.Action
 		wantSecretActions           []kubetesting.Action
+		wantRequeueAfter            time.Duration
 		wantError                   string
 	}{
 		{
@@ -490,6 +502,57 @@ func TestFederationDomainSecretsControllerSync(t *testing.T) {
 				kubetesting.NewGetAction(secretGVR, namespace, goodSecret.Name),
 			},
 		},
+		{
+			name: "FederationDomain exists and valid secret exists",
+			secretHelper: func(secretHelper *mocksecrethelper.MockSecretHelper) {
+				secretHelper.EXPECT().Generate(goodFederationDomain).Times(1).Return(goodSecret, nil)
+				secretHelper.EXPECT().IsValid(goodFederationDomain, goodSecret).Times(1).Return(true)
+				secretHelper.EXPECT().RotateKey(goodSecret, goodSecret).Times(1).Return(nil)
+				secretHelper.EXPECT().ObserveActiveSecretAndUpdateParentFederationDomain(goodFederationDomain, goodSecret).Times(1).Return(goodFederationDomainWithTokenSigningKey)
+				secretHelper.EXPECT().NextKeyRotationCheck(goodSecret).Times(1).Return(time.Hour)
+			},
+			wantFederationDomainActions: []kubetesting.Action{
+				kubetesting.NewGetAction(federationDomainGVR, namespace, goodFederationDomain.Name),
+				kubetesting.NewUpdateAction(federationDomainGVR, namespace, goodFederationDomainWithTokenSigningKey),
+			},
+			wantSecretActions: []kubetesting.Action{},
+			wantRequeueAfter:  time.Hour,
+		},
+		{
+			name: "FederationDomain exists and valid secret exists and its key is due for rotation",
+			secretHelper: func(secretHelper *mocksecrethelper.MockSecretHelper) {
+				secretHelper.EXPECT().Generate(goodFederationDomain).Times(1).Return(goodSecret, nil)
+				secretHelper.EXPECT().IsValid(goodFederationDomain, goodSecret).Times(1).Return(true)
+				secretHelper.EXPECT().RotateKey(goodSecret, goodSecret).Times(1).Return(rotatedSecret)
+				secretHelper.EXPECT().ObserveActiveSecretAndUpdateParentFederationDomain(goodFederationDomain, rotatedSecret).Times(1).Return(goodFederationDomainWithTokenSigningKey)
+				secretHelper.EXPECT().NextKeyRotationCheck(rotatedSecret).Times(1).Return(time.Minute)
+			},
+			wantFederationDomainActions: []kubetesting.Action{
+				kubetesting.NewGetAction(federationDomainGVR, namespace, goodFederationDomain.Name),
+				kubetesting.NewUpdateAction(federationDomainGVR, namespace, goodFederationDomainWithTokenSigningKey),
+			},
+			wantSecretActions: []kubetesting.Action{
+				kubetesting.NewUpdateAction(secretGVR, namespace, rotatedSecret),
+			},
+			wantRequeueAfter: time.Minute,
+		},
+		{
+			name: "FederationDomain exists and valid secret exists and rotating its key fails",
+			secretHelper: func(secretHelper *mocksecrethelper.MockSecretHelper) {
+				secretHelper.EXPECT().Generate(goodFederationDomain).Times(1).Return(goodSecret, nil)
+				secretHelper.EXPECT().IsValid(goodFederationDomain, goodSecret).Times(1).Return(true)
+				secretHelper.EXPECT().RotateKey(goodSecret, goodSecret).Times(1).Return(rotatedSecret)
+			},
+			client: func(_ *pinnipedfake.Clientset, c *kubernetesfake.Clientset) {
+				c.PrependReactor("update", "secrets", func(_ kubetesting.Action) (bool, runtime.Object, error) {
+					return true, nil, errors.New("some update error")
+				})
+			},
+			wantSecretActions: []kubetesting.Action{
+				kubetesting.NewUpdateAction(secretGVR, namespace, rotatedSecret),
+			},
+			wantError: "failed to rotate secret key: some update error",
+		},
 		{
 			name: "FederationDomain exists and invalid secret exists and getting secret fails",
 			secretHelper: func(secretHelper *mocksecrethelper.MockSecretHelper) {
@@ -674,6 +737,8 @@ func TestFederationDomainSecretsControllerSync(t *testing.T) {
 				test.secretHelper(secretHelper)
 			}
 			secretHelper.EXPECT().Handles(gomock.Any()).AnyTimes().Return(true)
+			secretHelper.EXPECT().RotateKey(gomock.Any(), gomock.Any()).AnyTimes().Return(nil)
+			secretHelper.EXPECT().NextKeyRotationCheck(gomock.Any()).AnyTimes().Return(time.Duration(0))
 
 			c := NewFederationDomainSecretsController(
 				secretHelper,
@@ -692,18 +757,21 @@ func TestFederationDomainSecretsControllerSync(t *testing.T) {
 			pinnipedInformers.Start(ctx.Done())
 			controllerlib.TestRunSynchronously(t, c)
 
+			queue := &fakeQueue{}
 			err := controllerlib.TestSync(t, c, controllerlib.Context{
 				Context: ctx,
 				Key: controllerlib.Key{
 					Namespace: namespace,
 					Name:      federationDomainName,
 				},
+				Queue: queue,
 			})
 			if test.wantError != "" {
 				require.EqualError(t, err, test.wantError)
 				return
 			}
 			require.NoError(t, err)
+			require.Equal(t, test.wantRequeueAfter, queue.duration)
 
 			if test.wantFederationDomainActions == nil {
 				test.wantFederationDomainActions = []kubetesting.Action{}
@@ -718,3 +786,14 @@ func TestFederationDomainSecretsControllerSync(t *testing.T) {
 }
 
 func boolPtr(b bool) *bool { return &b }
+
+// fakeQueue records the delay of the most recent key which was added to it with a delay.
+type fakeQueue struct {
+	duration time.Duration
+}
+
+func (q *fakeQueue) Add(key controllerlib.Key)            {}
+func (q *fakeQueue) AddRateLimited(key controllerlib.Key) {}
+func (q *fakeQueue) AddAfter(key controllerlib.Key, duration time.Duration) {
+	q.duration = duration
+}
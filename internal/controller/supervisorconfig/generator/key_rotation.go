@@ -0,0 +1,105 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package generator
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"go.pinniped.dev/internal/controllerlib"
+)
+
+const (
+	// previousSymmetricSecretDataKey is the corev1.Secret.Data key for the symmetric key which was replaced by the
+	// most recent key rotation. It is still used to decode values until the grace period of the rotation ends.
+	previousSymmetricSecretDataKey = "previousKey"
+
+	// keyRotatedAtAnnotation records when the current symmetric key of a Secret was generated, in RFC3339 format.
+	// Secrets without it are considered to have been generated when they were created.
+	keyRotatedAtAnnotation = "secrets.pinniped.dev/key-rotated-at"
+)
+
+// KeyRotation configures the scheduled rotation of a generated symmetric key. The zero value never rotates the key.
+type KeyRotation struct {
+	// Interval is how long a key is used to encode new values before it is replaced by a newly generated key.
+	Interval time.Duration
+
+	// GracePeriod is how long a replaced key is still used to decode the values which were encoded with it.
+	GracePeriod time.Duration
+}
+
+func (r KeyRotation) enabled() bool { return r.Interval > 0 }
+
+// keyRotatedAt returns when the current symmetric key of the provided Secret was generated.
+func keyRotatedAt(secret *corev1.Secret) time.Time {
+	if rotatedAt, err := time.Parse(time.RFC3339, secret.Annotations[keyRotatedAtAnnotation]); err == nil {
+		return rotatedAt
+	}
+	return secret.CreationTimestamp.Time
+}
+
+// keyRotationDue returns whether the symmetric key of the provided valid Secret should be replaced.
+func keyRotationDue(secret *corev1.Secret, rotation KeyRotation, now time.Time) bool {
+	return rotation.enabled() && !now.Before(keyRotatedAt(secret).Add(rotation.Interval))
+}
+
+// nextKeyRotationCheck returns how long until the key ring of the provided valid Secret next changes, either because
+// its key is due for rotation or because the grace period of its previous key ends. It returns zero when the key is
+// never rotated.
+func nextKeyRotationCheck(secret *corev1.Secret, rotation KeyRotation, now time.Time) time.Duration {
+	if !rotation.enabled() {
+		return 0
+	}
+	rotatedAt := keyRotatedAt(secret)
+	next := rotatedAt.Add(rotation.Interval)
+	if gracePeriodEnd := rotatedAt.Add(rotation.GracePeriod); len(secret.Data[previousSymmetricSecretDataKey]) > 0 && gracePeriodEnd.After(now) && gracePeriodEnd.Before(next) {
+		next = gracePeriodEnd
+	}
+	if wait := next.Sub(now); wait > 0 {
+		return wait
+	}
+	// The rotation is already due, so check again soon.
+	return time.Second
+}
+
+// rotateSymmetricKey returns a copy of the provided valid Secret in which newKey has replaced its current key, which
+// is kept as its previous key.
+func rotateSymmetricKey(secret *corev1.Secret, newKey []byte, now time.Time) *corev1.Secret {
+	rotated := secret.DeepCopy()
+	rotated.Data = map[string][]byte{
+		symmetricSecretDataKey:         newKey,
+		previousSymmetricSecretDataKey: secret.Data[symmetricSecretDataKey],
+	}
+	setKeyRotatedAt(rotated, now)
+	return rotated
+}
+
+// setKeyRotatedAt records that the current symmetric key of the provided Secret was generated at the provided time.
+func setKeyRotatedAt(secret *corev1.Secret, now time.Time) {
+	annotations := make(map[string]string, len(secret.Annotations)+1)
+	for key, value := range secret.Annotations {
+		annotations[key] = value
+	}
+	annotations[keyRotatedAtAnnotation] = now.UTC().Format(time.RFC3339)
+	secret.Annotations = annotations
+}
+
+// symmetricKeys returns the key ring of the provided valid Secret, newest first: its current key, followed by its
+// previous key until the grace period of the most recent key rotation ends.
+func symmetricKeys(secret *corev1.Secret, rotation KeyRotation, now time.Time) [][]byte {
+	keys := [][]byte{secret.Data[symmetricSecretDataKey]}
+	previousKey := secret.Data[previousSymmetricSecretDataKey]
+	if len(previousKey) > 0 && now.Before(keyRotatedAt(secret).Add(rotation.GracePeriod)) {
+		keys = append(keys, previousKey)
+	}
+	return keys
+}
+
+// requeueForKeyRotation syncs the key of the provided Secret again when its key ring next changes.
+func requeueForKeyRotation(ctx controllerlib.Context, secret *corev1.Secret, rotation KeyRotation, now time.Time) {
+	if wait := nextKeyRotationCheck(secret, rotation, now); wait > 0 && ctx.Queue != nil {
+		ctx.Queue.AddAfter(ctx.Key, wait)
+	}
+}
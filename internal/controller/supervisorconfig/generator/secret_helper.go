@@ -6,16 +6,19 @@ package generator
 import (
 	"fmt"
 	"io"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/clock"
 
 	configv1alpha1 "go.pinniped.dev/generated/1.20/apis/supervisor/config/v1alpha1"
 )
 
 // SecretHelper describes an object that can Generate() a Secret and determine whether a Secret
-// IsValid(). It can also be Notify()'d about a Secret being persisted.
+// IsValid(). It can also be Notify()'d about a Secret being persisted, and it can RotateKey() of
+// a valid Secret when the key is due for rotation.
 //
 // A SecretHelper has a NamePrefix() that can be used to identify it from other SecretHelper instances.
 type SecretHelper interface {
@@ -24,6 +27,14 @@ type SecretHelper interface {
 	IsValid(*configv1alpha1.FederationDomain, *corev1.Secret) bool
 	ObserveActiveSecretAndUpdateParentFederationDomain(*configv1alpha1.FederationDomain, *corev1.Secret) *configv1alpha1.FederationDomain
 	Handles(metav1.Object) bool
+
+	// RotateKey returns a copy of the existing valid Secret whose key has been replaced by the key of the newly
+	// generated Secret, or nil when the key of the existing Secret is not due for rotation.
+	RotateKey(existing, generated *corev1.Secret) *corev1.Secret
+
+	// NextKeyRotationCheck returns how long until the key ring of the valid Secret next changes, or zero when
+	// its key is never rotated.
+	NextKeyRotationCheck(*corev1.Secret) time.Duration
 }
 
 const (
@@ -61,13 +72,15 @@ const (
 )
 
 // New returns a SecretHelper that has been parameterized with common symmetric secret generation
-// knobs.
+// knobs. The updateCacheFunc is called with the current key ring of the active Secret, newest key first.
 func NewSymmetricSecretHelper(
 	namePrefix string,
 	labels map[string]string,
 	rand io.Reader,
 	secretUsage SecretUsage,
-	updateCacheFunc func(cacheKey string, cacheValue []byte),
+	updateCacheFunc func(cacheKey string, cacheValues [][]byte),
+	keyRotation KeyRotation,
+	clock clock.Clock,
 ) SecretHelper {
 	return &symmetricSecretHelper{
 		namePrefix:      namePrefix,
@@ -75,6 +88,8 @@ func NewSymmetricSecretHelper(
 		rand:            rand,
 		secretUsage:     secretUsage,
 		updateCacheFunc: updateCacheFunc,
+		keyRotation:     keyRotation,
+		clock:           clock,
 	}
 }
 
@@ -83,7 +98,9 @@ type symmetricSecretHelper struct {
 	labels          map[string]string
 	rand            io.Reader
 	secretUsage     SecretUsage
-	updateCacheFunc func(cacheKey string, cacheValue []byte)
+	updateCacheFunc func(cacheKey string, cacheValues [][]byte)
+	keyRotation     KeyRotation
+	clock           clock.Clock
 }
 
 func (s *symmetricSecretHelper) NamePrefix() string { return s.namePrefix }
@@ -95,7 +112,7 @@ func (s *symmetricSecretHelper) Generate(parent *configv1alpha1.FederationDomain
 		return nil, err
 	}
 
-	return &corev1.Secret{
+	secret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      fmt.Sprintf("%s%s", s.namePrefix, parent.UID),
 			Namespace: parent.Namespace,
@@ -112,7 +129,11 @@ func (s *symmetricSecretHelper) Generate(parent *configv1alpha1.FederationDomain
 		Data: map[string][]byte{
 			symmetricSecretDataKey: key,
 		},
-	}, nil
+	}
+	if s.keyRotation.enabled() {
+		setKeyRotatedAt(secret, s.clock.Now())
+	}
+	return secret, nil
 }
 
 // IsValid implements SecretHelper.IsValid().
@@ -141,7 +162,7 @@ func (s *symmetricSecretHelper) ObserveActiveSecretAndUpdateParentFederationDoma
 	federationDomain *configv1alpha1.FederationDomain,
 	secret *corev1.Secret,
 ) *configv1alpha1.FederationDomain {
-	s.updateCacheFunc(federationDomain.Spec.Issuer, secret.Data[symmetricSecretDataKey])
+	s.updateCacheFunc(federationDomain.Spec.Issuer, symmetricKeys(secret, s.keyRotation, s.clock.Now()))
 
 	switch s.secretUsage {
 	case SecretUsageTokenSigningKey:
@@ -157,6 +178,20 @@ func (s *symmetricSecretHelper) ObserveActiveSecretAndUpdateParentFederationDoma
 	return federationDomain
 }
 
+// RotateKey implements SecretHelper.RotateKey().
+func (s *symmetricSecretHelper) RotateKey(existing, generated *corev1.Secret) *corev1.Secret {
+	now := s.clock.Now()
+	if !keyRotationDue(existing, s.keyRotation, now) {
+		return nil
+	}
+	return rotateSymmetricKey(existing, generated.Data[symmetricSecretDataKey], now)
+}
+
+// NextKeyRotationCheck implements SecretHelper.NextKeyRotationCheck().
+func (s *symmetricSecretHelper) NextKeyRotationCheck(secret *corev1.Secret) time.Duration {
+	return nextKeyRotationCheck(secret, s.keyRotation, s.clock.Now())
+}
+
 func (s *symmetricSecretHelper) secretType() corev1.SecretType {
 	switch s.secretUsage {
 	case SecretUsageTokenSigningKey:
@@ -6,11 +6,13 @@ package generator
 import (
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/clock"
 
 	configv1alpha1 "go.pinniped.dev/generated/1.20/apis/supervisor/config/v1alpha1"
 )
@@ -62,17 +64,19 @@ func TestSymmetricSecretHelper(t *testing.T) {
 			}
 			randSource := strings.NewReader(keyWith32Bytes)
 			var federationDomainIssuerValue string
-			var symmetricKeyValue []byte
+			var symmetricKeysValue [][]byte
 			h := NewSymmetricSecretHelper(
 				"some-name-prefix-",
 				labels,
 				randSource,
 				test.secretUsage,
-				func(federationDomainIssuer string, symmetricKey []byte) {
-					require.True(t, federationDomainIssuer == "" && symmetricKeyValue == nil, "expected notify func not to have been called yet")
+				func(federationDomainIssuer string, symmetricKeys [][]byte) {
+					require.True(t, federationDomainIssuer == "" && symmetricKeysValue == nil, "expected notify func not to have been called yet")
 					federationDomainIssuerValue = federationDomainIssuer
-					symmetricKeyValue = symmetricKey
+					symmetricKeysValue = symmetricKeys
 				},
+				KeyRotation{},
+				clock.RealClock{},
 			)
 
 			parent := &configv1alpha1.FederationDomain{
@@ -107,7 +111,7 @@ func TestSymmetricSecretHelper(t *testing.T) {
 			h.ObserveActiveSecretAndUpdateParentFederationDomain(parent, child)
 			require.Equal(t, parent.Spec.Issuer, federationDomainIssuerValue)
 			require.Equal(t, child.Name, test.wantSetFederationDomainField(parent))
-			require.Equal(t, child.Data["key"], symmetricKeyValue)
+			require.Equal(t, [][]byte{child.Data["key"]}, symmetricKeysValue)
 
 			require.True(t, h.Handles(child))
 			wrongTypedChild := child.DeepCopy()
@@ -184,7 +188,7 @@ func TestSymmetricSecretHelperIsValid(t *testing.T) {
 	for _, test := range tests {
 		test := test
 		t.Run(test.name, func(t *testing.T) {
-			h := NewSymmetricSecretHelper("none of these args matter", nil, nil, test.secretUsage, nil)
+			h := NewSymmetricSecretHelper("none of these args matter", nil, nil, test.secretUsage, nil, KeyRotation{}, nil)
 
 			parent := &configv1alpha1.FederationDomain{
 				ObjectMeta: metav1.ObjectMeta{
@@ -221,3 +225,68 @@ func TestSymmetricSecretHelperIsValid(t *testing.T) {
 		})
 	}
 }
+
+func TestSymmetricSecretHelperKeyRotation(t *testing.T) {
+	t.Parallel()
+
+	generatedAt := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFakeClock(generatedAt)
+	rotation := KeyRotation{Interval: 10 * time.Hour, GracePeriod: time.Hour}
+
+	var issuerValue string
+	var keysValue [][]byte
+	h := NewSymmetricSecretHelper(
+		"some-name-prefix-",
+		nil,
+		strings.NewReader(keyWith32Bytes+"abcdef0123456789abcdef0123456789"),
+		SecretUsageStateSigningKey,
+		func(issuer string, keys [][]byte) {
+			issuerValue = issuer
+			keysValue = keys
+		},
+		rotation,
+		fakeClock,
+	)
+
+	parent := &configv1alpha1.FederationDomain{
+		ObjectMeta: metav1.ObjectMeta{UID: "some-uid", Namespace: "some-namespace"},
+		Spec:       configv1alpha1.FederationDomainSpec{Issuer: "https://some-issuer.com"},
+	}
+	existing, err := h.Generate(parent)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"secrets.pinniped.dev/key-rotated-at": "2021-03-01T12:00:00Z"}, existing.Annotations)
+	require.True(t, h.IsValid(parent, existing))
+
+	// The new key is not due for rotation yet.
+	require.Nil(t, h.RotateKey(existing, existing))
+	require.Equal(t, 10*time.Hour, h.NextKeyRotationCheck(existing))
+	h.ObserveActiveSecretAndUpdateParentFederationDomain(parent, existing)
+	require.Equal(t, "https://some-issuer.com", issuerValue)
+	require.Equal(t, [][]byte{[]byte(keyWith32Bytes)}, keysValue)
+
+	// Once the interval has passed, the key is replaced and the replaced key is kept as the previous key.
+	fakeClock.Step(10*time.Hour + time.Minute)
+	require.Equal(t, time.Second, h.NextKeyRotationCheck(existing))
+	generated, err := h.Generate(parent)
+	require.NoError(t, err)
+	rotated := h.RotateKey(existing, generated)
+	require.NotNil(t, rotated)
+	require.Equal(t, "2021-03-01T22:01:00Z", rotated.Annotations["secrets.pinniped.dev/key-rotated-at"])
+	require.Equal(t, map[string][]byte{
+		"key":         []byte("abcdef0123456789abcdef0123456789"),
+		"previousKey": []byte(keyWith32Bytes),
+	}, rotated.Data)
+	require.True(t, h.IsValid(parent, rotated))
+	require.Nil(t, h.RotateKey(rotated, generated))
+
+	// The previous key is still used during the grace period.
+	require.Equal(t, time.Hour, h.NextKeyRotationCheck(rotated))
+	h.ObserveActiveSecretAndUpdateParentFederationDomain(parent, rotated)
+	require.Equal(t, [][]byte{[]byte("abcdef0123456789abcdef0123456789"), []byte(keyWith32Bytes)}, keysValue)
+
+	// The previous key is no longer used after the grace period.
+	fakeClock.Step(time.Hour)
+	require.Equal(t, 9*time.Hour, h.NextKeyRotationCheck(rotated))
+	h.ObserveActiveSecretAndUpdateParentFederationDomain(parent, rotated)
+	require.Equal(t, [][]byte{[]byte("abcdef0123456789abcdef0123456789")}, keysValue)
+}
@@ -8,11 +8,13 @@ import (
 	"context"
 	"crypto/rand"
 	"fmt"
+	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
 	corev1informers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/util/retry"
@@ -24,6 +26,7 @@ import (
 )
 
 // generateKey is stubbed out for the purpose of testing. The default behavior is to generate a symmetric key.
+//
 //nolint:gochecknoglobals
 var generateKey = generateSymmetricKey
 
@@ -31,16 +34,22 @@ type supervisorSecretsController struct {
 	labels         map[string]string
 	kubeClient     kubernetes.Interface
 	secretInformer corev1informers.SecretInformer
-	setCacheFunc   func(secret []byte)
+	setCacheFunc   func(keys [][]byte)
+	keyRotation    KeyRotation
+	clock          clock.Clock
 }
 
 // NewSupervisorSecretsController instantiates a new controllerlib.Controller which will ensure existence of a generated secret.
+// The key in the secret is rotated according to the provided KeyRotation, and setCacheFunc is called with the current key
+// ring of the secret, newest key first.
 func NewSupervisorSecretsController(
 	owner *appsv1.Deployment,
 	labels map[string]string,
 	kubeClient kubernetes.Interface,
 	secretInformer corev1informers.SecretInformer,
-	setCacheFunc func(secret []byte),
+	setCacheFunc func(keys [][]byte),
+	keyRotation KeyRotation,
+	clock clock.Clock,
 	withInformer pinnipedcontroller.WithInformerOptionFunc,
 	initialEventFunc pinnipedcontroller.WithInitialEventOptionFunc,
 ) controllerlib.Controller {
@@ -49,6 +58,8 @@ func NewSupervisorSecretsController(
 		kubeClient:     kubeClient,
 		secretInformer: secretInformer,
 		setCacheFunc:   setCacheFunc,
+		keyRotation:    keyRotation,
+		clock:          clock,
 	}
 	return controllerlib.New(
 		controllerlib.Config{Name: owner.Name + "-secret-generator", Syncer: &c},
@@ -81,10 +92,12 @@ func (c *supervisorSecretsController) Sync(ctx controllerlib.Context) error {
 		return fmt.Errorf("failed to list secret %s/%s: %w", ctx.Key.Namespace, ctx.Key.Name, err)
 	}
 
-	secretNeedsUpdate := isNotFound || !isValid(secret, c.labels)
+	now := c.clock.Now()
+	secretNeedsUpdate := isNotFound || !isValid(secret, c.labels) || keyRotationDue(secret, c.keyRotation, now)
 	if !secretNeedsUpdate {
 		plog.Debug("secret is up to date", "secret", klog.KObj(secret))
-		c.setCacheFunc(secret.Data[symmetricSecretDataKey])
+		c.setCacheFunc(symmetricKeys(secret, c.keyRotation, now))
+		requeueForKeyRotation(ctx, secret, c.keyRotation, now)
 		return nil
 	}
 
@@ -92,17 +105,21 @@ func (c *supervisorSecretsController) Sync(ctx controllerlib.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to generate secret: %w", err)
 	}
+	if c.keyRotation.enabled() {
+		setKeyRotatedAt(newSecret, now)
+	}
 
 	if isNotFound {
 		err = c.createSecret(ctx.Context, newSecret)
 	} else {
-		err = c.updateSecret(ctx.Context, &newSecret, ctx.Key.Name)
+		err = c.updateSecret(ctx.Context, &newSecret, ctx.Key.Name, now)
 	}
 	if err != nil {
 		return fmt.Errorf("failed to create/update secret %s/%s: %w", newSecret.Namespace, newSecret.Name, err)
 	}
 
-	c.setCacheFunc(newSecret.Data[symmetricSecretDataKey])
+	c.setCacheFunc(symmetricKeys(newSecret, c.keyRotation, now))
+	requeueForKeyRotation(ctx, newSecret, c.keyRotation, now)
 
 	return nil
 }
@@ -112,7 +129,7 @@ func (c *supervisorSecretsController) createSecret(ctx context.Context, newSecre
 	return err
 }
 
-func (c *supervisorSecretsController) updateSecret(ctx context.Context, newSecret **corev1.Secret, secretName string) error {
+func (c *supervisorSecretsController) updateSecret(ctx context.Context, newSecret **corev1.Secret, secretName string, now time.Time) error {
 	secrets := c.kubeClient.CoreV1().Secrets((*newSecret).Namespace)
 	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
 		currentSecret, err := secrets.Get(ctx, secretName, metav1.GetOptions{})
@@ -129,7 +146,18 @@ func (c *supervisorSecretsController) updateSecret(ctx context.Context, newSecre
 		}
 
 		if isValid(currentSecret, c.labels) {
-			*newSecret = currentSecret
+			if !keyRotationDue(currentSecret, c.keyRotation, now) {
+				*newSecret = currentSecret
+				return nil
+			}
+
+			// Keep the current key as the previous key, so that the values which were encoded with it can still be decoded.
+			rotatedSecret := rotateSymmetricKey(currentSecret, (*newSecret).Data[symmetricSecretDataKey], now)
+			if _, err := secrets.Update(ctx, rotatedSecret, metav1.UpdateOptions{}); err != nil {
+				return err
+			}
+			plog.Debug("rotated secret key", "secret", klog.KObj(rotatedSecret))
+			*newSecret = rotatedSecret
 			return nil
 		}
 
@@ -138,6 +166,9 @@ func (c *supervisorSecretsController) updateSecret(ctx context.Context, newSecre
 		for key, value := range c.labels {
 			currentSecret.Labels[key] = value
 		}
+		if c.keyRotation.enabled() {
+			setKeyRotatedAt(currentSecret, now)
+		}
 
 		_, err = secrets.Update(ctx, currentSecret, metav1.UpdateOptions{})
 		return err
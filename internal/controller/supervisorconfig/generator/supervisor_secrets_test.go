@@ -17,6 +17,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/clock"
 	kubeinformers "k8s.io/client-go/informers"
 	kubernetesfake "k8s.io/client-go/kubernetes/fake"
 	kubetesting "k8s.io/client-go/testing"
@@ -116,6 +117,8 @@ func TestSupervisorSecretsControllerFilterSecret(t *testing.T) {
 				nil, // kubeClient, not needed
 				secretInformer,
 				nil, // setCache, not needed
+				KeyRotation{},
+				clock.RealClock{},
 				withInformer.WithInformer,
 				testutil.NewObservableWithInitialEventOption().WithInitialEvent,
 			)
@@ -142,6 +145,8 @@ func TestSupervisorSecretsControllerInitialEvent(t *testing.T) {
 		nil, // kubeClient, not needed
 		secretInformer,
 		nil, // setCache, not needed
+		KeyRotation{},
+		clock.RealClock{},
 		testutil.NewObservableWithInformerOption().WithInformer,
 		initialEventOption.WithInitialEvent,
 	)
@@ -192,19 +197,34 @@ func TestSupervisorSecretsControllerSync(t *testing.T) {
 		}
 	)
 
+	now := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+	keyRotation := KeyRotation{Interval: 10 * time.Hour, GracePeriod: time.Hour}
+	withKeyRotatedAt := func(secret *corev1.Secret, rotatedAt time.Time) *corev1.Secret {
+		secret = secret.DeepCopy()
+		secret.Annotations = map[string]string{"secrets.pinniped.dev/key-rotated-at": rotatedAt.Format(time.RFC3339)}
+		return secret
+	}
+	withPreviousKey := func(secret *corev1.Secret, previousKey []byte) *corev1.Secret {
+		secret = secret.DeepCopy()
+		secret.Data["previousKey"] = previousKey
+		return secret
+	}
+
 	// Add an extra label to make sure we don't overwrite existing labels on a Secret.
 	generatedSecret.Labels["extra-label-key"] = "extra-label-value"
 
 	once := sync.Once{}
 
 	tests := []struct {
-		name               string
-		storedSecret       func(**corev1.Secret)
-		generateKey        func() ([]byte, error)
-		apiClient          func(*testing.T, *kubernetesfake.Clientset)
-		wantError          string
-		wantActions        []kubetesting.Action
-		wantCallbackSecret []byte
+		name             string
+		storedSecret     func(**corev1.Secret)
+		generateKey      func() ([]byte, error)
+		apiClient        func(*testing.T, *kubernetesfake.Clientset)
+		wantError        string
+		keyRotation      KeyRotation
+		wantActions      []kubetesting.Action
+		wantCallbackKeys [][]byte
+		wantRequeueAfter time.Duration
 	}{
 		{
 			name: "when the secrets does not exist, it gets generated",
@@ -214,11 +234,11 @@ func TestSupervisorSecretsControllerSync(t *testing.T) {
 			wantActions: []kubetesting.Action{
 				kubetesting.NewCreateAction(secretsGVR, generatedSecretNamespace, generatedSecret),
 			},
-			wantCallbackSecret: generatedSymmetricKey,
+			wantCallbackKeys: [][]byte{generatedSymmetricKey},
 		},
 		{
-			name:               "when a valid secret exists, nothing happens",
-			wantCallbackSecret: generatedSymmetricKey,
+			name:             "when a valid secret exists, nothing happens",
+			wantCallbackKeys: [][]byte{generatedSymmetricKey},
 		},
 		{
 			name: "secret gets updated when the type is wrong",
@@ -229,7 +249,7 @@ func TestSupervisorSecretsControllerSync(t *testing.T) {
 				kubetesting.NewGetAction(secretsGVR, generatedSecretNamespace, generatedSecretName),
 				kubetesting.NewUpdateAction(secretsGVR, generatedSecretNamespace, generatedSecret),
 			},
-			wantCallbackSecret: generatedSymmetricKey,
+			wantCallbackKeys: [][]byte{generatedSymmetricKey},
 		},
 		{
 			name: "secret gets updated when the key data does not exist",
@@ -240,7 +260,7 @@ func TestSupervisorSecretsControllerSync(t *testing.T) {
 				kubetesting.NewGetAction(secretsGVR, generatedSecretNamespace, generatedSecretName),
 				kubetesting.NewUpdateAction(secretsGVR, generatedSecretNamespace, generatedSecret),
 			},
-			wantCallbackSecret: generatedSymmetricKey,
+			wantCallbackKeys: [][]byte{generatedSymmetricKey},
 		},
 		{
 			name: "secret gets updated when the key data is too short",
@@ -251,7 +271,7 @@ func TestSupervisorSecretsControllerSync(t *testing.T) {
 				kubetesting.NewGetAction(secretsGVR, generatedSecretNamespace, generatedSecretName),
 				kubetesting.NewUpdateAction(secretsGVR, generatedSecretNamespace, generatedSecret),
 			},
-			wantCallbackSecret: generatedSymmetricKey,
+			wantCallbackKeys: [][]byte{generatedSymmetricKey},
 		},
 		{
 			name: "an error is returned when creating fails",
@@ -319,7 +339,7 @@ func TestSupervisorSecretsControllerSync(t *testing.T) {
 				kubetesting.NewGetAction(secretsGVR, generatedSecretNamespace, generatedSecretName),
 				kubetesting.NewUpdateAction(secretsGVR, generatedSecretNamespace, generatedSecret),
 			},
-			wantCallbackSecret: generatedSymmetricKey,
+			wantCallbackKeys: [][]byte{generatedSymmetricKey},
 		},
 		{
 			name: "upon updating we discover that a valid secret exists",
@@ -334,7 +354,7 @@ func TestSupervisorSecretsControllerSync(t *testing.T) {
 			wantActions: []kubetesting.Action{
 				kubetesting.NewGetAction(secretsGVR, generatedSecretNamespace, generatedSecretName),
 			},
-			wantCallbackSecret: otherGeneratedSymmetricKey,
+			wantCallbackKeys: [][]byte{otherGeneratedSymmetricKey},
 		},
 		{
 			name: "upon updating we discover that a secret with missing labels exists",
@@ -345,7 +365,7 @@ func TestSupervisorSecretsControllerSync(t *testing.T) {
 				kubetesting.NewGetAction(secretsGVR, generatedSecretNamespace, generatedSecretName),
 				kubetesting.NewUpdateAction(secretsGVR, generatedSecretNamespace, generatedSecret),
 			},
-			wantCallbackSecret: generatedSymmetricKey,
+			wantCallbackKeys: [][]byte{generatedSymmetricKey},
 		},
 		{
 			name: "upon updating we discover that a secret with incorrect labels exists",
@@ -356,7 +376,7 @@ func TestSupervisorSecretsControllerSync(t *testing.T) {
 				kubetesting.NewGetAction(secretsGVR, generatedSecretNamespace, generatedSecretName),
 				kubetesting.NewUpdateAction(secretsGVR, generatedSecretNamespace, generatedSecret),
 			},
-			wantCallbackSecret: generatedSymmetricKey,
+			wantCallbackKeys: [][]byte{generatedSymmetricKey},
 		},
 		{
 			name: "upon updating we discover that the secret has been deleted",
@@ -375,7 +395,7 @@ func TestSupervisorSecretsControllerSync(t *testing.T) {
 				kubetesting.NewGetAction(secretsGVR, generatedSecretNamespace, generatedSecretName),
 				kubetesting.NewCreateAction(secretsGVR, generatedSecretNamespace, generatedSecret),
 			},
-			wantCallbackSecret: generatedSymmetricKey,
+			wantCallbackKeys: [][]byte{generatedSymmetricKey},
 		},
 		{
 			name: "upon updating we discover that the secret has been deleted and our create fails",
@@ -396,6 +416,79 @@ func TestSupervisorSecretsControllerSync(t *testing.T) {
 			},
 			wantError: "failed to create/update secret some-namespace/some-name-abc123: failed to create secret: some create error",
 		},
+		{
+			name: "when the secret does not exist and key rotation is enabled, it gets generated with its rotation time",
+			storedSecret: func(secret **corev1.Secret) {
+				*secret = nil
+			},
+			keyRotation: keyRotation,
+			wantActions: []kubetesting.Action{
+				kubetesting.NewCreateAction(secretsGVR, generatedSecretNamespace, withKeyRotatedAt(generatedSecret, now)),
+			},
+			wantCallbackKeys: [][]byte{generatedSymmetricKey},
+			wantRequeueAfter: 10 * time.Hour,
+		},
+		{
+			name: "when the key of a valid secret is not due for rotation, nothing happens",
+			storedSecret: func(secret **corev1.Secret) {
+				*secret = withKeyRotatedAt(*secret, now.Add(-2*time.Hour))
+			},
+			keyRotation:      keyRotation,
+			wantCallbackKeys: [][]byte{generatedSymmetricKey},
+			wantRequeueAfter: 8 * time.Hour,
+		},
+		{
+			name: "when the key of a valid secret is due for rotation, it gets rotated",
+			storedSecret: func(secret **corev1.Secret) {
+				*secret = withKeyRotatedAt(otherGeneratedSecret, now.Add(-10*time.Hour))
+			},
+			keyRotation: keyRotation,
+			wantActions: []kubetesting.Action{
+				kubetesting.NewGetAction(secretsGVR, generatedSecretNamespace, generatedSecretName),
+				kubetesting.NewUpdateAction(secretsGVR, generatedSecretNamespace,
+					withPreviousKey(withKeyRotatedAt(generatedSecret, now), otherGeneratedSymmetricKey),
+				),
+			},
+			wantCallbackKeys: [][]byte{generatedSymmetricKey, otherGeneratedSymmetricKey},
+			wantRequeueAfter: time.Hour,
+		},
+		{
+			name: "when the key of a valid secret was rotated during the grace period, the previous key is still used",
+			storedSecret: func(secret **corev1.Secret) {
+				*secret = withPreviousKey(withKeyRotatedAt(*secret, now.Add(-30*time.Minute)), otherGeneratedSymmetricKey)
+			},
+			keyRotation:      keyRotation,
+			wantCallbackKeys: [][]byte{generatedSymmetricKey, otherGeneratedSymmetricKey},
+			wantRequeueAfter: 30 * time.Minute,
+		},
+		{
+			name: "when the key of a valid secret was rotated before the grace period, the previous key is not used",
+			storedSecret: func(secret **corev1.Secret) {
+				*secret = withPreviousKey(withKeyRotatedAt(*secret, now.Add(-2*time.Hour)), otherGeneratedSymmetricKey)
+			},
+			keyRotation:      keyRotation,
+			wantCallbackKeys: [][]byte{generatedSymmetricKey},
+			wantRequeueAfter: 8 * time.Hour,
+		},
+		{
+			name: "when the key of a valid secret is due for rotation and updating fails, we return an error",
+			storedSecret: func(secret **corev1.Secret) {
+				*secret = withKeyRotatedAt(otherGeneratedSecret, now.Add(-10*time.Hour))
+			},
+			apiClient: func(t *testing.T, client *kubernetesfake.Clientset) {
+				client.PrependReactor("update", "secrets", func(action kubetesting.Action) (bool, runtime.Object, error) {
+					return true, nil, errors.New("some update error")
+				})
+			},
+			keyRotation: keyRotation,
+			wantActions: []kubetesting.Action{
+				kubetesting.NewGetAction(secretsGVR, generatedSecretNamespace, generatedSecretName),
+				kubetesting.NewUpdateAction(secretsGVR, generatedSecretNamespace,
+					withPreviousKey(withKeyRotatedAt(generatedSecret, now), otherGeneratedSymmetricKey),
+				),
+			},
+			wantError: "failed to create/update secret some-namespace/some-name-abc123: some update error",
+		},
 		{
 			name: "when generating the secret fails, we return an error",
 			storedSecret: func(secret **corev1.Secret) {
@@ -441,16 +534,18 @@ func TestSupervisorSecretsControllerSync(t *testing.T) {
 			informers := kubeinformers.NewSharedInformerFactory(informerClient, 0)
 			secrets := informers.Core().V1().Secrets()
 
-			var callbackSecret []byte
+			var callbackKeys [][]byte
 			c := NewSupervisorSecretsController(
 				owner,
 				labels,
 				apiClient,
 				secrets,
-				func(secret []byte) {
-					require.Nil(t, callbackSecret, "callback was called twice")
-					callbackSecret = secret
+				func(keys [][]byte) {
+					require.Nil(t, callbackKeys, "callback was called twice")
+					callbackKeys = keys
 				},
+				test.keyRotation,
+				clock.NewFakeClock(now),
 				testutil.NewObservableWithInformerOption().WithInformer,
 				testutil.NewObservableWithInitialEventOption().WithInitialEvent,
 			)
@@ -459,12 +554,14 @@ func TestSupervisorSecretsControllerSync(t *testing.T) {
 			informers.Start(ctx.Done())
 			controllerlib.TestRunSynchronously(t, c)
 
+			queue := &fakeQueue{}
 			err := controllerlib.TestSync(t, c, controllerlib.Context{
 				Context: ctx,
 				Key: controllerlib.Key{
 					Namespace: generatedSecretNamespace,
 					Name:      generatedSecretName,
 				},
+				Queue: queue,
 			})
 			if test.wantError != "" {
 				require.EqualError(t, err, test.wantError)
@@ -477,7 +574,8 @@ func TestSupervisorSecretsControllerSync(t *testing.T) {
 			}
 			require.Equal(t, test.wantActions, apiClient.Actions())
 
-			require.Equal(t, test.wantCallbackSecret, callbackSecret)
+			require.Equal(t, test.wantCallbackKeys, callbackKeys)
+			require.Equal(t, test.wantRequeueAfter, queue.duration)
 		})
 	}
 }
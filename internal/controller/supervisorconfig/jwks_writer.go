@@ -17,6 +17,7 @@ import (
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
 	corev1informers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/util/retry"
@@ -61,6 +62,7 @@ func generateECKey(r io.Reader) (interface{}, error) {
 // secrets, both via a cache and via the API.
 type jwksWriterController struct {
 	jwksSecretLabels         map[string]string
+	externalSignerIssuers    sets.String
 	pinnipedClient           pinnipedclientset.Interface
 	kubeClient               kubernetes.Interface
 	federationDomainInformer configinformers.FederationDomainInformer
@@ -68,9 +70,11 @@ type jwksWriterController struct {
 }
 
 // NewJWKSWriterController returns a controllerlib.Controller that ensures a FederationDomain has a corresponding
-// Secret that contains a valid active JWK and JWKS.
+// Secret that contains a valid active JWK and JWKS. The FederationDomains whose issuers are in externalSignerIssuers
+// sign with an external signer, so no keys are generated for them.
 func NewJWKSWriterController(
 	jwksSecretLabels map[string]string,
+	externalSignerIssuers sets.String,
 	kubeClient kubernetes.Interface,
 	pinnipedClient pinnipedclientset.Interface,
 	secretInformer corev1informers.SecretInformer,
@@ -86,6 +90,7 @@ func NewJWKSWriterController(
 			Name: "JWKSController",
 			Syncer: &jwksWriterController{
 				jwksSecretLabels:         jwksSecretLabels,
+				externalSignerIssuers:    externalSignerIssuers,
 				kubeClient:               kubeClient,
 				pinnipedClient:           pinnipedClient,
 				secretInformer:           secretInformer,
@@ -132,6 +137,19 @@ func (c *jwksWriterController) Sync(ctx controllerlib.Context) error {
 		return nil
 	}
 
+	if c.externalSignerIssuers.Has(federationDomain.Spec.Issuer) {
+		// The Secret of this FederationDomain, if it was created before its external signer was configured, is left
+		// alone, so that the ID tokens which were signed with its keys can still be verified.
+		plog.Debug(
+			"FederationDomain uses an external signer",
+			"federationdomain",
+			klog.KRef(ctx.Key.Namespace, ctx.Key.Name),
+			"issuer",
+			federationDomain.Spec.Issuer,
+		)
+		return nil
+	}
+
 	secretNeedsUpdate, err := c.secretNeedsUpdate(federationDomain)
 	if err != nil {
 		return fmt.Errorf("cannot determine secret status: %w", err)
@@ -195,11 +213,8 @@ func (c *jwksWriterController) secretNeedsUpdate(federationDomain *configv1alpha
 }
 
 func (c *jwksWriterController) generateSecret(federationDomain *configv1alpha1.FederationDomain) (*corev1.Secret, error) {
-	// Note! This is where we could potentially add more handling of FederationDomain spec fields which tell us how
-	// this FederationDomain should sign and verify ID tokens (e.g., hardcoded token secret, gRPC
-	// connection to KMS, etc).
-	//
-	// For now, we just generate an new RSA keypair and put that in the secret.
+	// FederationDomains which sign with an external signer, such as a key in a KMS, never get here, so we just
+	// generate a new EC keypair and put that in the secret.
 
 	key, err := generateKey(rand.Reader)
 	if err != nil {
@@ -19,6 +19,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
 	kubeinformers "k8s.io/client-go/informers"
 	kubernetesfake "k8s.io/client-go/kubernetes/fake"
 	kubetesting "k8s.io/client-go/testing"
@@ -183,6 +184,7 @@ func TestJWKSWriterControllerFilterSecret(t *testing.T) {
 			withInformer := testutil.NewObservableWithInformerOption()
 			_ = NewJWKSWriterController(
 				nil, // labels, not needed
+				nil, // externalSignerIssuers, not needed
 				nil, // kubeClient, not needed
 				nil, // pinnipedClient, not needed
 				secretInformer,
@@ -237,6 +239,7 @@ func TestJWKSWriterControllerFilterFederationDomain(t *testing.T) {
 			withInformer := testutil.NewObservableWithInformerOption()
 			_ = NewJWKSWriterController(
 				nil, // labels, not needed
+				nil, // externalSignerIssuers, not needed
 				nil, // kubeClient, not needed
 				nil, // pinnipedClient, not needed
 				secretInformer,
@@ -336,6 +339,7 @@ func TestJWKSWriterControllerSync(t *testing.T) {
 		configKubeClient            func(*kubernetesfake.Clientset)
 		configPinnipedClient        func(*pinnipedfake.Clientset)
 		federationDomains           []*configv1alpha1.FederationDomain
+		externalSignerIssuers       []string
 		generateKeyErr              error
 		wantGenerateKeyCount        int
 		wantSecretActions           []kubetesting.Action
@@ -401,6 +405,29 @@ func TestJWKSWriterControllerSync(t *testing.T) {
 				goodSecret,
 			},
 		},
+		{
+			name: "new federationDomain with an external signer",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				goodFederationDomain,
+			},
+			externalSignerIssuers:       []string{"https://other-issuer.com", goodFederationDomain.Spec.Issuer},
+			wantSecretActions:           []kubetesting.Action{},
+			wantFederationDomainActions: []kubetesting.Action{},
+		},
+		{
+			name: "existing federationDomain with an external signer and an invalid secret",
+			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
+			federationDomains: []*configv1alpha1.FederationDomain{
+				goodFederationDomainWithStatus,
+			},
+			secrets: []*corev1.Secret{
+				secretWithWrongType,
+			},
+			externalSignerIssuers:       []string{goodFederationDomain.Spec.Issuer},
+			wantSecretActions:           []kubetesting.Action{},
+			wantFederationDomainActions: []kubetesting.Action{},
+		},
 		{
 			name: "deleted federationDomain",
 			key:  controllerlib.Key{Namespace: goodFederationDomain.Namespace, Name: goodFederationDomain.Name},
@@ -711,6 +738,7 @@ func TestJWKSWriterControllerSync(t *testing.T) {
 					"myLabelKey1": "myLabelValue1",
 					"myLabelKey2": "myLabelValue2",
 				},
+				sets.NewString(test.externalSignerIssuers...),
 				kubeAPIClient,
 				pinnipedAPIClient,
 				kubeInformers.Core().V1().Secrets(),
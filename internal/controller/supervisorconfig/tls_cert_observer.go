@@ -77,17 +77,20 @@ func (c *tlsCertObserverController) Sync(ctx controllerlib.Context) error {
 		if provider.Spec.TLS != nil {
 			secretName = provider.Spec.TLS.SecretName
 		}
-		issuerURL, err := url.Parse(provider.Spec.Issuer)
-		if err != nil {
-			plog.Debug("tlsCertObserverController Sync found an invalid issuer URL", "namespace", ns, "issuer", provider.Spec.Issuer)
-			continue
-		}
 		certFromSecret, err := c.certFromSecret(ns, secretName)
 		if err != nil {
 			continue
 		}
-		// Lowercase the host part of the URL because hostnames should be treated as case-insensitive.
-		issuerHostToTLSCertMap[lowercaseHostWithoutPort(issuerURL)] = certFromSecret
+		// The issuer aliases are served using the same cert as the issuer.
+		for _, issuer := range issuersAndAliases(provider) {
+			issuerURL, err := url.Parse(issuer)
+			if err != nil {
+				plog.Debug("tlsCertObserverController Sync found an invalid issuer URL", "namespace", ns, "issuer", issuer)
+				continue
+			}
+			// Lowercase the host part of the URL because hostnames should be treated as case-insensitive.
+			issuerHostToTLSCertMap[lowercaseHostWithoutPort(issuerURL)] = certFromSecret
+		}
 	}
 
 	plog.Debug("tlsCertObserverController Sync updated the TLS cert cache", "issuerHostCount", len(issuerHostToTLSCertMap))
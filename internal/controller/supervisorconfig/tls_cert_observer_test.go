@@ -266,7 +266,9 @@ func TestTLSCertObserverControllerSync(t *testing.T) {
 					// Issuer hostname should be treated in a case-insensitive way and SNI ignores port numbers. Test without a port number.
 					Spec: v1alpha1.FederationDomainSpec{
 						Issuer: "https://www.iSSuer-wiTh-goOd-secRet1.cOm/path",
-						TLS:    &v1alpha1.FederationDomainTLSSpec{SecretName: "good-tls-secret-name1"},
+						// The issuer aliases should be served using the same cert as the issuer.
+						IssuerAliases: []string{"https://www.aLIas-wiTh-goOd-secRet1.cOm:443/other-path", invalidIssuerURL},
+						TLS:           &v1alpha1.FederationDomainTLSSpec{SecretName: "good-tls-secret-name1"},
 					},
 				}
 				federationDomainWithGoodSecret2 := &v1alpha1.FederationDomain{
@@ -323,7 +325,7 @@ func TestTLSCertObserverControllerSync(t *testing.T) {
 				r.Nil(issuerTLSCertSetter.setDefaultTLSCertReceived)
 
 				r.True(issuerTLSCertSetter.setIssuerHostToTLSCertMapWasCalled)
-				r.Len(issuerTLSCertSetter.issuerHostToTLSCertMapReceived, 2)
+				r.Len(issuerTLSCertSetter.issuerHostToTLSCertMapReceived, 3)
 
 				// They keys in the map should be lower case and should not include the port numbers, because
 				// TLS SNI says that SNI hostnames must be DNS names (not ports) and must be case insensitive.
@@ -335,6 +337,9 @@ func TestTLSCertObserverControllerSync(t *testing.T) {
 				actualCertificate2 := issuerTLSCertSetter.issuerHostToTLSCertMapReceived["www.issuer-with-good-secret2.com"]
 				r.NotNil(actualCertificate2)
 				r.Equal(expectedCertificate2, *actualCertificate2)
+				actualAliasCertificate1 := issuerTLSCertSetter.issuerHostToTLSCertMapReceived["www.alias-with-good-secret1.com"]
+				r.NotNil(actualAliasCertificate1)
+				r.Equal(expectedCertificate1, *actualAliasCertificate1)
 			})
 
 			when("there is also a default TLS cert secret with the configured default TLS cert secret name", func() {
@@ -367,7 +372,7 @@ func TestTLSCertObserverControllerSync(t *testing.T) {
 					r.Equal(expectedDefaultCertificate, *actualDefaultCertificate)
 
 					r.True(issuerTLSCertSetter.setIssuerHostToTLSCertMapWasCalled)
-					r.Len(issuerTLSCertSetter.issuerHostToTLSCertMapReceived, 2)
+					r.Len(issuerTLSCertSetter.issuerHostToTLSCertMapReceived, 3)
 				})
 			})
 		})
@@ -6,24 +6,33 @@ package upstreamwatcher
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/go-logr/logr"
+	"golang.org/x/net/http/httpproxy"
 	"golang.org/x/oauth2"
+	"gopkg.in/square/go-jose.v2"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/cache"
 	corev1informers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
 
 	"go.pinniped.dev/generated/1.20/apis/supervisor/idp/v1alpha1"
 	pinnipedclientset "go.pinniped.dev/generated/1.20/client/supervisor/clientset/versioned"
@@ -31,7 +40,9 @@ import (
 	"go.pinniped.dev/internal/constable"
 	pinnipedcontroller "go.pinniped.dev/internal/controller"
 	"go.pinniped.dev/internal/controllerlib"
+	pinnipedoidc "go.pinniped.dev/internal/oidc"
 	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/plog"
 	"go.pinniped.dev/internal/upstreamoidc"
 )
 
@@ -45,31 +56,69 @@ const (
 	clientIDDataKey     = "clientID"
 	clientSecretDataKey = "clientSecret"
 
-	// Constants related to the OIDC provider discovery cache. These do not affect the cache of JWKS.
-	validatorCacheTTL = 15 * time.Minute
+	// Constants related to the client certificate Secret.
+	clientCertificateSecretType = corev1.SecretTypeTLS
+
+	// Constants related to the OIDC provider discovery cache and the health probes. These do not affect the cache of JWKS.
+	// The discovery is performed again, and the endpoints are probed again, at the health check interval of each upstream.
+	defaultHealthCheckInterval = 15 * time.Minute
+	probeRetryInterval         = 1 * time.Minute
+	probeTimeout               = 30 * time.Second
 
 	// Constants related to conditions.
-	typeClientCredsValid       = "ClientCredentialsValid"
-	typeOIDCDiscoverySucceeded = "OIDCDiscoverySucceeded"
-	reasonNotFound             = "SecretNotFound"
-	reasonWrongType            = "SecretWrongType"
-	reasonMissingKeys          = "SecretMissingKeys"
-	reasonSuccess              = "Success"
-	reasonUnreachable          = "Unreachable"
-	reasonInvalidTLSConfig     = "InvalidTLSConfig"
-	reasonInvalidResponse      = "InvalidResponse"
+	typeClientCredsValid         = "ClientCredentialsValid"
+	typeOIDCDiscoverySucceeded   = "OIDCDiscoverySucceeded"
+	typeJWKSReachable            = "JWKSReachable"
+	typeTokenEndpointReachable   = "TokenEndpointReachable"
+	reasonNotFound               = "SecretNotFound"
+	reasonWrongType              = "SecretWrongType"
+	reasonMissingKeys            = "SecretMissingKeys"
+	reasonSuccess                = "Success"
+	reasonUnreachable            = "Unreachable"
+	reasonInvalidTLSConfig       = "InvalidTLSConfig"
+	reasonInvalidEgressConfig    = "InvalidEgressConfig"
+	reasonInvalidResponse        = "InvalidResponse"
+	reasonOIDCDiscoveryNotPassed = "OIDCDiscoveryNotPassed"
 
 	// Errors that are generated by our reconcile process.
 	errFailureStatus  = constable.Error("OIDCIdentityProvider has a failing condition")
 	errNoCertificates = constable.Error("no certificates found")
+	errReservedClaim  = constable.Error("additional claim would overwrite a claim which is set by the Supervisor")
+)
+
+//nolint:gochecknoglobals
+var (
+	probeDuration = metrics.NewHistogramVec(&metrics.HistogramOpts{
+		Namespace:      "pinniped_supervisor",
+		Subsystem:      "upstream_oidc",
+		Name:           "probe_duration_seconds",
+		Help:           "How long the health probes of the endpoints of each upstream OIDC identity provider took.",
+		StabilityLevel: metrics.ALPHA,
+	}, []string{"namespace", "name", "type"})
+
+	probeFailures = metrics.NewCounterVec(&metrics.CounterOpts{
+		Namespace:      "pinniped_supervisor",
+		Subsystem:      "upstream_oidc",
+		Name:           "probe_failures_total",
+		Help:           "How many health probes of the endpoints of each upstream OIDC identity provider failed.",
+		StabilityLevel: metrics.ALPHA,
+	}, []string{"namespace", "name", "type", "reason"})
 )
 
+//nolint: gochecknoinits
+func init() {
+	// Register with the registry of the Kubernetes libraries, which is what a metrics endpoint would serve.
+	legacyregistry.MustRegister(probeDuration, probeFailures)
+}
+
 // IDPCache is a thread safe cache that holds a list of validated upstream OIDC IDP configurations.
 type IDPCache interface {
 	SetIDPList([]provider.UpstreamOIDCIdentityProviderI)
 }
 
-// lruValidatorCache caches the *oidc.Provider associated with a particular issuer/TLS configuration.
+// lruValidatorCache caches the *oidc.Provider associated with a particular issuer/TLS/egress configuration, and the
+// results of the health probes of its endpoints. Any change to the issuer, TLS or egress configuration, including
+// the contents of the client certificate Secret, uses new entries.
 type lruValidatorCache struct{ cache *cache.Expiring }
 
 type lruValidatorCacheEntry struct {
@@ -77,27 +126,75 @@ type lruValidatorCacheEntry struct {
 	client   *http.Client
 }
 
-func (c *lruValidatorCache) getProvider(spec *v1alpha1.OIDCIdentityProviderSpec) (*oidc.Provider, *http.Client) {
-	if result, ok := c.cache.Get(c.cacheKey(spec)); ok {
+// probeResults are the conditions which report on the health probes of the endpoints of an upstream, and the
+// time at which the probes were performed.
+type probeResults struct {
+	conditions []*v1alpha1.Condition
+	probedAt   metav1.Time
+}
+
+// clientKeyPair is the PEM encoded client certificate and private key which are presented to an upstream.
+type clientKeyPair struct{ certPEM, keyPEM []byte }
+
+type lruValidatorCacheKey struct {
+	issuer, caBundle  string
+	proxyURL, noProxy string
+	timeoutSeconds    int64
+	clientCertificate string
+}
+
+type lruValidatorCacheProbeKey struct{ lruValidatorCacheKey }
+
+func (c *lruValidatorCache) getProvider(spec *v1alpha1.OIDCIdentityProviderSpec, clientCertificate *clientKeyPair) (*oidc.Provider, *http.Client) {
+	if result, ok := c.cache.Get(c.cacheKey(spec, clientCertificate)); ok {
 		entry := result.(*lruValidatorCacheEntry)
 		return entry.provider, entry.client
 	}
 	return nil, nil
 }
 
-func (c *lruValidatorCache) putProvider(spec *v1alpha1.OIDCIdentityProviderSpec, provider *oidc.Provider, client *http.Client) {
-	c.cache.Set(c.cacheKey(spec), &lruValidatorCacheEntry{provider: provider, client: client}, validatorCacheTTL)
+func (c *lruValidatorCache) putProvider(spec *v1alpha1.OIDCIdentityProviderSpec, clientCertificate *clientKeyPair, provider *oidc.Provider, client *http.Client) {
+	c.cache.Set(c.cacheKey(spec, clientCertificate), &lruValidatorCacheEntry{provider: provider, client: client}, healthCheckInterval(spec))
 }
 
-func (c *lruValidatorCache) cacheKey(spec *v1alpha1.OIDCIdentityProviderSpec) interface{} {
-	var key struct{ issuer, caBundle string }
+func (c *lruValidatorCache) getProbeResults(spec *v1alpha1.OIDCIdentityProviderSpec, clientCertificate *clientKeyPair) *probeResults {
+	if result, ok := c.cache.Get(lruValidatorCacheProbeKey{c.cacheKey(spec, clientCertificate)}); ok {
+		return result.(*probeResults)
+	}
+	return nil
+}
+
+func (c *lruValidatorCache) putProbeResults(spec *v1alpha1.OIDCIdentityProviderSpec, clientCertificate *clientKeyPair, results *probeResults) {
+	c.cache.Set(lruValidatorCacheProbeKey{c.cacheKey(spec, clientCertificate)}, results, healthCheckInterval(spec))
+}
+
+func (c *lruValidatorCache) cacheKey(spec *v1alpha1.OIDCIdentityProviderSpec, clientCertificate *clientKeyPair) lruValidatorCacheKey {
+	var key lruValidatorCacheKey
 	key.issuer = spec.Issuer
 	if spec.TLS != nil {
 		key.caBundle = spec.TLS.CertificateAuthorityData
 	}
+	key.proxyURL = spec.Egress.ProxyURL
+	key.noProxy = strings.Join(spec.Egress.NoProxy, ",")
+	if spec.Egress.TimeoutSeconds != nil {
+		key.timeoutSeconds = *spec.Egress.TimeoutSeconds
+	}
+	if clientCertificate != nil {
+		// Avoid holding on to a copy of the private key in the cache key.
+		sum := sha256.Sum256(append(append(append([]byte{}, clientCertificate.certPEM...), 0), clientCertificate.keyPEM...))
+		key.clientCertificate = hex.EncodeToString(sum[:])
+	}
 	return key
 }
 
+// healthCheckInterval returns how often OIDC discovery is performed again and the endpoints are probed again.
+func healthCheckInterval(spec *v1alpha1.OIDCIdentityProviderSpec) time.Duration {
+	if spec.HealthCheck.IntervalSeconds != nil {
+		return time.Duration(*spec.HealthCheck.IntervalSeconds) * time.Second
+	}
+	return defaultHealthCheckInterval
+}
+
 type controller struct {
 	cache                        IDPCache
 	log                          logr.Logger
@@ -105,8 +202,10 @@ type controller struct {
 	oidcIdentityProviderInformer idpinformers.OIDCIdentityProviderInformer
 	secretInformer               corev1informers.SecretInformer
 	validatorCache               interface {
-		getProvider(*v1alpha1.OIDCIdentityProviderSpec) (*oidc.Provider, *http.Client)
-		putProvider(*v1alpha1.OIDCIdentityProviderSpec, *oidc.Provider, *http.Client)
+		getProvider(*v1alpha1.OIDCIdentityProviderSpec, *clientKeyPair) (*oidc.Provider, *http.Client)
+		putProvider(*v1alpha1.OIDCIdentityProviderSpec, *clientKeyPair, *oidc.Provider, *http.Client)
+		getProbeResults(*v1alpha1.OIDCIdentityProviderSpec, *clientKeyPair) *probeResults
+		putProbeResults(*v1alpha1.OIDCIdentityProviderSpec, *clientKeyPair, *probeResults)
 	}
 }
 
@@ -136,12 +235,22 @@ func New(
 		),
 		withInformer(
 			secretInformer,
-			pinnipedcontroller.MatchAnySecretOfTypeFilter(oidcClientSecretType, pinnipedcontroller.SingletonQueue()),
+			pinnipedcontroller.SimpleFilterWithSingletonQueue(isClientCredentialsOrClientCertificateSecret),
 			controllerlib.InformerOption{},
 		),
 	)
 }
 
+// isClientCredentialsOrClientCertificateSecret matches the types of the Secrets which can be referenced by an
+// OIDCIdentityProvider.
+func isClientCredentialsOrClientCertificateSecret(obj metav1.Object) bool {
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		return false
+	}
+	return secret.Type == oidcClientSecretType || secret.Type == clientCertificateSecretType
+}
+
 // Sync implements controllerlib.Syncer.
 func (c *controller) Sync(ctx controllerlib.Context) error {
 	actualUpstreams, err := c.oidcIdentityProviderInformer.Lister().List(labels.Everything())
@@ -150,16 +259,31 @@ func (c *controller) Sync(ctx controllerlib.Context) error {
 	}
 
 	requeue := false
+	var nextHealthCheck time.Duration
 	validatedUpstreams := make([]provider.UpstreamOIDCIdentityProviderI, 0, len(actualUpstreams))
 	for _, upstream := range actualUpstreams {
-		valid := c.validateUpstream(ctx, upstream)
+		valid, healthy := c.validateUpstream(ctx, upstream)
 		if valid == nil {
 			requeue = true
 		} else {
 			validatedUpstreams = append(validatedUpstreams, provider.UpstreamOIDCIdentityProviderI(valid))
 		}
+
+		interval := healthCheckInterval(&upstream.Spec)
+		if !healthy && interval > probeRetryInterval {
+			interval = probeRetryInterval
+		}
+		if nextHealthCheck == 0 || interval < nextHealthCheck {
+			nextHealthCheck = interval
+		}
 	}
 	c.cache.SetIDPList(validatedUpstreams)
+
+	// Sync again when the next upstream is due for a health check, even when nothing else has changed.
+	if nextHealthCheck > 0 && ctx.Queue != nil {
+		ctx.Queue.AddAfter(ctx.Key, nextHealthCheck)
+	}
+
 	if requeue {
 		return controllerlib.ErrSyntheticRequeue
 	}
@@ -167,21 +291,28 @@ func (c *controller) Sync(ctx controllerlib.Context) error {
 }
 
 // validateUpstream validates the provided v1alpha1.OIDCIdentityProvider and returns the validated configuration as a
-// provider.UpstreamOIDCIdentityProvider. As a side effect, it also updates the status of the v1alpha1.OIDCIdentityProvider.
-func (c *controller) validateUpstream(ctx controllerlib.Context, upstream *v1alpha1.OIDCIdentityProvider) *upstreamoidc.ProviderConfig {
+// provider.UpstreamOIDCIdentityProvider. It also returns whether all of the health probes of its endpoints succeeded.
+// The failed health probes do not make the upstream invalid, because they may be only temporary. As a side effect,
+// it also updates the status of the v1alpha1.OIDCIdentityProvider.
+func (c *controller) validateUpstream(ctx controllerlib.Context, upstream *v1alpha1.OIDCIdentityProvider) (*upstreamoidc.ProviderConfig, bool) {
 	result := upstreamoidc.ProviderConfig{
 		Name: upstream.Name,
 		Config: &oauth2.Config{
 			Scopes: computeScopes(upstream.Spec.AuthorizationConfig.AdditionalScopes),
 		},
-		UsernameClaim: upstream.Spec.Claims.Username,
-		GroupsClaim:   upstream.Spec.Claims.Groups,
+		UsernameClaim:     upstream.Spec.Claims.Username,
+		GroupsClaim:       upstream.Spec.Claims.Groups,
+		AdditionalClaims:  c.computeAdditionalClaims(upstream),
+		RequiredACRValues: upstream.Spec.AuthorizationConfig.RequiredACRValues,
+		RequiredAMRValues: upstream.Spec.AuthorizationConfig.RequiredAMRValues,
 	}
+	clientCertificate, clientCertificateErr := c.getClientCertificate(upstream)
 	conditions := []*v1alpha1.Condition{
 		c.validateSecret(upstream, &result),
-		c.validateIssuer(ctx.Context, upstream, &result),
+		c.validateIssuer(ctx.Context, upstream, clientCertificate, clientCertificateErr, &result),
 	}
-	c.updateStatus(ctx.Context, upstream, conditions)
+	probes := c.probeEndpoints(ctx.Context, upstream, clientCertificate, &result)
+	c.updateStatus(ctx.Context, upstream, append(conditions, probes.conditions...), probes.probedAt)
 
 	valid := true
 	log := c.log.WithValues("namespace", upstream.Namespace, "name", upstream.Name)
@@ -195,10 +326,23 @@ func (c *controller) validateUpstream(ctx controllerlib.Context, upstream *v1alp
 			).Error(errFailureStatus, "found failing condition")
 		}
 	}
+	healthy := true
+	for _, condition := range probes.conditions {
+		if condition.Status != v1alpha1.ConditionTrue {
+			healthy = false
+		}
+		if condition.Status == v1alpha1.ConditionFalse {
+			log.WithValues(
+				"type", condition.Type,
+				"reason", condition.Reason,
+				"message", condition.Message,
+			).Error(errFailureStatus, "found failing health probe")
+		}
+	}
 	if valid {
-		return &result
+		return &result, healthy
 	}
-	return nil
+	return nil, healthy
 }
 
 // validateSecret validates the .spec.client.secretName field and returns the appropriate ClientCredentialsValid condition.
@@ -249,14 +393,53 @@ func (c *controller) validateSecret(upstream *v1alpha1.OIDCIdentityProvider, res
 	}
 }
 
+// getClientCertificate returns the PEM encoded client certificate and private key from the Secret referenced by the
+// .spec.egress.clientCertificateSecretName field, or nil when no client certificate is configured.
+func (c *controller) getClientCertificate(upstream *v1alpha1.OIDCIdentityProvider) (*clientKeyPair, error) {
+	secretName := upstream.Spec.Egress.ClientCertificateSecretName
+	if secretName == "" {
+		return nil, nil
+	}
+
+	secret, err := c.secretInformer.Lister().Secrets(upstream.Namespace).Get(secretName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client certificate Secret: %w", err)
+	}
+	if secret.Type != clientCertificateSecretType {
+		return nil, fmt.Errorf("referenced client certificate Secret %q has wrong type %q (should be %q)", secretName, secret.Type, clientCertificateSecretType)
+	}
+	certPEM := secret.Data[corev1.TLSCertKey]
+	keyPEM := secret.Data[corev1.TLSPrivateKeyKey]
+	if len(certPEM) == 0 || len(keyPEM) == 0 {
+		return nil, fmt.Errorf("referenced client certificate Secret %q is missing required keys %q", secretName, []string{corev1.TLSCertKey, corev1.TLSPrivateKeyKey})
+	}
+
+	return &clientKeyPair{certPEM: certPEM, keyPEM: keyPEM}, nil
+}
+
 // validateIssuer validates the .spec.issuer field, performs OIDC discovery, and returns the appropriate OIDCDiscoverySucceeded condition.
-func (c *controller) validateIssuer(ctx context.Context, upstream *v1alpha1.OIDCIdentityProvider, result *upstreamoidc.ProviderConfig) *v1alpha1.Condition {
+func (c *controller) validateIssuer(
+	ctx context.Context,
+	upstream *v1alpha1.OIDCIdentityProvider,
+	clientCertificate *clientKeyPair,
+	clientCertificateErr error,
+	result *upstreamoidc.ProviderConfig,
+) *v1alpha1.Condition {
+	if clientCertificateErr != nil {
+		return &v1alpha1.Condition{
+			Type:    typeOIDCDiscoverySucceeded,
+			Status:  v1alpha1.ConditionFalse,
+			Reason:  reasonInvalidTLSConfig,
+			Message: clientCertificateErr.Error(),
+		}
+	}
+
 	// Get the provider and HTTP Client from cache if possible.
-	discoveredProvider, httpClient := c.validatorCache.getProvider(&upstream.Spec)
+	discoveredProvider, httpClient := c.validatorCache.getProvider(&upstream.Spec, clientCertificate)
 
 	// If the provider does not exist in the cache, do a fresh discovery lookup and save to the cache.
 	if discoveredProvider == nil {
-		tlsConfig, err := getTLSConfig(upstream)
+		tlsConfig, err := getTLSConfig(upstream, clientCertificate)
 		if err != nil {
 			return &v1alpha1.Condition{
 				Type:    typeOIDCDiscoverySucceeded,
@@ -265,7 +448,19 @@ func (c *controller) validateIssuer(ctx context.Context, upstream *v1alpha1.OIDC
 				Message: err.Error(),
 			}
 		}
-		httpClient = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		proxy, err := getProxy(upstream)
+		if err != nil {
+			return &v1alpha1.Condition{
+				Type:    typeOIDCDiscoverySucceeded,
+				Status:  v1alpha1.ConditionFalse,
+				Reason:  reasonInvalidEgressConfig,
+				Message: err.Error(),
+			}
+		}
+		httpClient = &http.Client{
+			Transport: &http.Transport{Proxy: proxy, TLSClientConfig: tlsConfig},
+			Timeout:   requestTimeout(&upstream.Spec),
+		}
 
 		discoveredProvider, err = oidc.NewProvider(oidc.ClientContext(ctx, httpClient), upstream.Spec.Issuer)
 		if err != nil {
@@ -278,7 +473,7 @@ func (c *controller) validateIssuer(ctx context.Context, upstream *v1alpha1.OIDC
 		}
 
 		// Update the cache with the newly discovered value.
-		c.validatorCache.putProvider(&upstream.Spec, discoveredProvider, httpClient)
+		c.validatorCache.putProvider(&upstream.Spec, clientCertificate, discoveredProvider, httpClient)
 	}
 
 	// Parse out and validate the discovered authorize endpoint.
@@ -312,11 +507,184 @@ func (c *controller) validateIssuer(ctx context.Context, upstream *v1alpha1.OIDC
 	}
 }
 
-func getTLSConfig(upstream *v1alpha1.OIDCIdentityProvider) (*tls.Config, error) {
+// probeEndpoints probes the JWKS and token endpoints which were discovered by validateIssuer, and returns the
+// appropriate JWKSReachable and TokenEndpointReachable conditions. Successful results are cached until the next
+// health check of the upstream is due.
+func (c *controller) probeEndpoints(ctx context.Context, upstream *v1alpha1.OIDCIdentityProvider, clientCertificate *clientKeyPair, result *upstreamoidc.ProviderConfig) *probeResults {
+	discoveredProvider, ok := result.Provider.(*oidc.Provider)
+	if !ok {
+		message := "cannot probe the endpoints until OIDC discovery succeeds"
+		return &probeResults{
+			conditions: []*v1alpha1.Condition{
+				{Type: typeJWKSReachable, Status: v1alpha1.ConditionUnknown, Reason: reasonOIDCDiscoveryNotPassed, Message: message},
+				{Type: typeTokenEndpointReachable, Status: v1alpha1.ConditionUnknown, Reason: reasonOIDCDiscoveryNotPassed, Message: message},
+			},
+		}
+	}
+
+	if cached := c.validatorCache.getProbeResults(&upstream.Spec, clientCertificate); cached != nil {
+		return cached
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	results := &probeResults{
+		conditions: []*v1alpha1.Condition{
+			c.timeProbe(upstream, typeJWKSReachable, func() *v1alpha1.Condition { return probeJWKS(ctx, discoveredProvider, result.Client) }),
+			c.timeProbe(upstream, typeTokenEndpointReachable, func() *v1alpha1.Condition { return probeTokenEndpoint(ctx, discoveredProvider, result.Client) }),
+		},
+		probedAt: metav1.Now(),
+	}
+
+	for _, condition := range results.conditions {
+		if condition.Status != v1alpha1.ConditionTrue {
+			return results // Do not cache failures, so that they are probed again at the next sync.
+		}
+	}
+	c.validatorCache.putProbeResults(&upstream.Spec, clientCertificate, results)
+	return results
+}
+
+// timeProbe runs the probe, and records how long it took and whether it failed in the metrics of the upstream, to
+// help to tell when an upstream is slow or failing.
+func (c *controller) timeProbe(upstream *v1alpha1.OIDCIdentityProvider, probeType string, probe func() *v1alpha1.Condition) *v1alpha1.Condition {
+	start := time.Now()
+	condition := probe()
+	probeDuration.WithLabelValues(upstream.Namespace, upstream.Name, probeType).Observe(time.Since(start).Seconds())
+	if condition.Status != v1alpha1.ConditionTrue {
+		probeFailures.WithLabelValues(upstream.Namespace, upstream.Name, probeType, condition.Reason).Inc()
+	}
+	plog.Debug("probed upstream endpoint",
+		"namespace", upstream.Namespace,
+		"name", upstream.Name,
+		"type", probeType,
+		"status", condition.Status,
+		"reason", condition.Reason,
+		"duration", time.Since(start),
+	)
+	return condition
+}
+
+func probeJWKS(ctx context.Context, discoveredProvider *oidc.Provider, httpClient *http.Client) *v1alpha1.Condition {
+	var discoveryClaims struct {
+		JWKSURL string `json:"jwks_uri"`
+	}
+	if err := discoveredProvider.Claims(&discoveryClaims); err != nil || discoveryClaims.JWKSURL == "" {
+		return &v1alpha1.Condition{
+			Type:    typeJWKSReachable,
+			Status:  v1alpha1.ConditionFalse,
+			Reason:  reasonInvalidResponse,
+			Message: "discovered issuer configuration has no jwks_uri",
+		}
+	}
+
+	response, err := probeRequest(ctx, httpClient, http.MethodGet, discoveryClaims.JWKSURL)
+	if err != nil {
+		return &v1alpha1.Condition{
+			Type:    typeJWKSReachable,
+			Status:  v1alpha1.ConditionFalse,
+			Reason:  reasonUnreachable,
+			Message: fmt.Sprintf("failed to fetch JWKS from %q", discoveryClaims.JWKSURL),
+		}
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	if response.StatusCode != http.StatusOK {
+		return &v1alpha1.Condition{
+			Type:    typeJWKSReachable,
+			Status:  v1alpha1.ConditionFalse,
+			Reason:  reasonUnreachable,
+			Message: fmt.Sprintf("failed to fetch JWKS from %q: unexpected status code %d", discoveryClaims.JWKSURL, response.StatusCode),
+		}
+	}
+
+	var keySet jose.JSONWebKeySet
+	if err := json.NewDecoder(response.Body).Decode(&keySet); err != nil || len(keySet.Keys) == 0 {
+		return &v1alpha1.Condition{
+			Type:    typeJWKSReachable,
+			Status:  v1alpha1.ConditionFalse,
+			Reason:  reasonInvalidResponse,
+			Message: fmt.Sprintf("JWKS from %q contains no valid keys", discoveryClaims.JWKSURL),
+		}
+	}
+
+	return &v1alpha1.Condition{
+		Type:    typeJWKSReachable,
+		Status:  v1alpha1.ConditionTrue,
+		Reason:  reasonSuccess,
+		Message: "fetched JWKS",
+	}
+}
+
+// probeTokenEndpoint sends an empty token request, which the token endpoint should reject without a server error.
+func probeTokenEndpoint(ctx context.Context, discoveredProvider *oidc.Provider, httpClient *http.Client) *v1alpha1.Condition {
+	tokenURL := discoveredProvider.Endpoint().TokenURL
+	if tokenURL == "" {
+		return &v1alpha1.Condition{
+			Type:    typeTokenEndpointReachable,
+			Status:  v1alpha1.ConditionFalse,
+			Reason:  reasonInvalidResponse,
+			Message: "discovered issuer configuration has no token_endpoint",
+		}
+	}
+
+	response, err := probeRequest(ctx, httpClient, http.MethodPost, tokenURL)
+	if err != nil {
+		return &v1alpha1.Condition{
+			Type:    typeTokenEndpointReachable,
+			Status:  v1alpha1.ConditionFalse,
+			Reason:  reasonUnreachable,
+			Message: fmt.Sprintf("failed to reach token endpoint %q", tokenURL),
+		}
+	}
+	_ = response.Body.Close()
+
+	if response.StatusCode >= http.StatusInternalServerError {
+		return &v1alpha1.Condition{
+			Type:    typeTokenEndpointReachable,
+			Status:  v1alpha1.ConditionFalse,
+			Reason:  reasonUnreachable,
+			Message: fmt.Sprintf("token endpoint %q responded with unexpected status code %d", tokenURL, response.StatusCode),
+		}
+	}
+
+	return &v1alpha1.Condition{
+		Type:    typeTokenEndpointReachable,
+		Status:  v1alpha1.ConditionTrue,
+		Reason:  reasonSuccess,
+		Message: "reached token endpoint",
+	}
+}
+
+func probeRequest(ctx context.Context, client *http.Client, method string, endpoint string) (*http.Response, error) {
+	var body io.Reader
+	if method == http.MethodPost {
+		body = strings.NewReader("")
+	}
+	request, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	if method == http.MethodPost {
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return client.Do(request)
+}
+
+func getTLSConfig(upstream *v1alpha1.OIDCIdentityProvider, clientCertificate *clientKeyPair) (*tls.Config, error) {
 	result := tls.Config{
 		MinVersion: tls.VersionTLS12,
 	}
 
+	if clientCertificate != nil {
+		cert, err := tls.X509KeyPair(clientCertificate.certPEM, clientCertificate.keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("spec.egress.clientCertificateSecretName refers to an invalid client certificate: %w", err)
+		}
+		result.Certificates = []tls.Certificate{cert}
+	}
+
 	if upstream.Spec.TLS == nil || upstream.Spec.TLS.CertificateAuthorityData == "" {
 		return &result, nil
 	}
@@ -334,7 +702,38 @@ func getTLSConfig(upstream *v1alpha1.OIDCIdentityProvider) (*tls.Config, error)
 	return &result, nil
 }
 
-func (c *controller) updateStatus(ctx context.Context, upstream *v1alpha1.OIDCIdentityProvider, conditions []*v1alpha1.Condition) {
+// getProxy returns the function which chooses the proxy for each request to the upstream, or nil when no proxy is used.
+func getProxy(upstream *v1alpha1.OIDCIdentityProvider) (func(*http.Request) (*url.URL, error), error) {
+	egress := upstream.Spec.Egress
+	if egress.ProxyURL == "" {
+		return nil, nil
+	}
+
+	proxyURL, err := url.Parse(egress.ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("spec.egress.proxyURL is invalid: %w", err)
+	}
+	if (proxyURL.Scheme != "http" && proxyURL.Scheme != "https") || proxyURL.Host == "" {
+		return nil, fmt.Errorf("spec.egress.proxyURL %q must be an http or https URL with a host", egress.ProxyURL)
+	}
+
+	proxyForURL := (&httpproxy.Config{
+		HTTPProxy:  egress.ProxyURL,
+		HTTPSProxy: egress.ProxyURL,
+		NoProxy:    strings.Join(egress.NoProxy, ","),
+	}).ProxyFunc()
+	return func(r *http.Request) (*url.URL, error) { return proxyForURL(r.URL) }, nil
+}
+
+// requestTimeout returns the time limit of each request to the upstream, or zero when requests are not limited.
+func requestTimeout(spec *v1alpha1.OIDCIdentityProviderSpec) time.Duration {
+	if spec.Egress.TimeoutSeconds != nil {
+		return time.Duration(*spec.Egress.TimeoutSeconds) * time.Second
+	}
+	return 0
+}
+
+func (c *controller) updateStatus(ctx context.Context, upstream *v1alpha1.OIDCIdentityProvider, conditions []*v1alpha1.Condition, probedAt metav1.Time) {
 	log := c.log.WithValues("namespace", upstream.Namespace, "name", upstream.Name)
 	updated := upstream.DeepCopy()
 
@@ -350,11 +749,17 @@ func (c *controller) updateStatus(ctx context.Context, upstream *v1alpha1.OIDCId
 		if cond.Status == v1alpha1.ConditionFalse {
 			updated.Status.Phase = v1alpha1.PhaseError
 		}
+		if (cond.Type == typeJWKSReachable || cond.Type == typeTokenEndpointReachable) && cond.Status == v1alpha1.ConditionTrue {
+			mergeProbe(&updated.Status.Probes, &v1alpha1.OIDCProbe{Type: cond.Type, LastSuccessTime: probedAt})
+		}
 	}
 
 	sort.SliceStable(updated.Status.Conditions, func(i, j int) bool {
 		return updated.Status.Conditions[i].Type < updated.Status.Conditions[j].Type
 	})
+	sort.SliceStable(updated.Status.Probes, func(i, j int) bool {
+		return updated.Status.Probes[i].Type < updated.Status.Probes[j].Type
+	})
 
 	if equality.Semantic.DeepEqual(upstream, updated) {
 		return
@@ -403,6 +808,17 @@ func mergeCondition(existing *[]v1alpha1.Condition, new *v1alpha1.Condition) boo
 	return false
 }
 
+// mergeProbe records the last successful health probe of an endpoint into a slice of existing probes.
+func mergeProbe(existing *[]v1alpha1.OIDCProbe, new *v1alpha1.OIDCProbe) {
+	for i := range *existing {
+		if (*existing)[i].Type == new.Type {
+			(*existing)[i] = *new
+			return
+		}
+	}
+	*existing = append(*existing, *new)
+}
+
 func computeScopes(additionalScopes []string) []string {
 	// First compute the unique set of scopes, including "openid" (de-duplicate).
 	set := make(map[string]bool, len(additionalScopes)+1)
@@ -419,3 +835,30 @@ func computeScopes(additionalScopes []string) []string {
 	sort.Strings(scopes)
 	return scopes
 }
+
+// computeAdditionalClaims returns the upstream claims to copy into the downstream ID token, keyed by the name of the
+// downstream claim. The claims which are set by the Supervisor itself are left out, so that an upstream can never
+// overwrite them.
+func (c *controller) computeAdditionalClaims(upstream *v1alpha1.OIDCIdentityProvider) map[string]string {
+	if len(upstream.Spec.Claims.AdditionalClaims) == 0 {
+		return nil
+	}
+	claims := make(map[string]string, len(upstream.Spec.Claims.AdditionalClaims))
+	for _, claim := range upstream.Spec.Claims.AdditionalClaims {
+		downstream := claim.Downstream
+		if downstream == "" {
+			downstream = claim.Upstream
+		}
+		if pinnipedoidc.IsReservedDownstreamClaim(downstream) {
+			c.log.WithValues(
+				"namespace", upstream.Namespace,
+				"name", upstream.Name,
+				"upstreamClaim", claim.Upstream,
+				"downstreamClaim", downstream,
+			).Error(errReservedClaim, "ignoring additional claim")
+			continue
+		}
+		claims[downstream] = claim.Upstream
+	}
+	return claims
+}
@@ -5,24 +5,37 @@ package upstreamwatcher
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/fake"
+	metricstestutil "k8s.io/component-base/metrics/testutil"
 
 	"go.pinniped.dev/generated/1.20/apis/supervisor/idp/v1alpha1"
 	pinnipedfake "go.pinniped.dev/generated/1.20/client/supervisor/clientset/versioned/fake"
 	pinnipedinformers "go.pinniped.dev/generated/1.20/client/supervisor/informers/externalversions"
+	"go.pinniped.dev/internal/certauthority"
 	"go.pinniped.dev/internal/controllerlib"
 	"go.pinniped.dev/internal/oidc/oidctestutil"
 	"go.pinniped.dev/internal/oidc/provider"
@@ -51,6 +64,16 @@ func TestControllerFilterSecret(t *testing.T) {
 			wantUpdate: true,
 			wantDelete: true,
 		},
+		{
+			name: "a client certificate secret",
+			secret: &corev1.Secret{
+				Type:       "kubernetes.io/tls",
+				ObjectMeta: metav1.ObjectMeta{Name: "some-name", Namespace: "some-namespace"},
+			},
+			wantAdd:    true,
+			wantUpdate: true,
+			wantDelete: true,
+		},
 		{
 			name: "a secret of the wrong type",
 			secret: &corev1.Secret{
@@ -105,6 +128,7 @@ func TestController(t *testing.T) {
 	t.Parallel()
 	now := metav1.NewTime(time.Now().UTC())
 	earlier := metav1.NewTime(now.Add(-1 * time.Hour).UTC())
+	sixtySeconds := int64(60)
 
 	// Start another test server that answers discovery successfully.
 	testIssuerCA, testIssuerURL := newTestIssuer(t)
@@ -112,6 +136,17 @@ func TestController(t *testing.T) {
 	testIssuerAuthorizeURL, err := url.Parse("https://example.com/authorize")
 	require.NoError(t, err)
 
+	// Start a proxy which tunnels all connections to the test server, so that "example.com" reaches the test server.
+	testProxyURL := newTestProxy(t, strings.TrimPrefix(testIssuerURL, "https://"))
+
+	// Start another test server that requires a client certificate issued by the test client CA.
+	testClientCA, err := certauthority.New(pkix.Name{CommonName: "test-client-ca"}, time.Hour)
+	require.NoError(t, err)
+	testClientCertPEM, testClientKeyPEM, err := testClientCA.IssuePEM(pkix.Name{CommonName: "test-client"}, nil, time.Hour)
+	require.NoError(t, err)
+	testMTLSIssuerCA, testMTLSIssuerURL := newTestMTLSIssuer(t, testClientCA.Pool())
+	testMTLSIssuerCABase64 := base64.StdEncoding.EncodeToString([]byte(testMTLSIssuerCA))
+
 	var (
 		testNamespace        = "test-namespace"
 		testName             = "test-name"
@@ -123,6 +158,7 @@ func TestController(t *testing.T) {
 		testValidSecretData  = map[string][]byte{"clientID": []byte(testClientID), "clientSecret": []byte(testClientSecret)}
 		testGroupsClaim      = "test-groups-claim"
 		testUsernameClaim    = "test-username-claim"
+		testClientCertSecret = "test-client-cert"
 	)
 	tests := []struct {
 		name                   string
@@ -152,6 +188,8 @@ func TestController(t *testing.T) {
 			wantLogs: []string{
 				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="secret \"test-client-secret\" not found" "reason"="SecretNotFound" "status"="False" "type"="ClientCredentialsValid"`,
 				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="discovered issuer configuration" "reason"="Success" "status"="True" "type"="OIDCDiscoverySucceeded"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="fetched JWKS" "reason"="Success" "status"="True" "type"="JWKSReachable"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="reached token endpoint" "reason"="Success" "status"="True" "type"="TokenEndpointReachable"`,
 				`upstream-observer "error"="OIDCIdentityProvider has a failing condition" "msg"="found failing condition" "message"="secret \"test-client-secret\" not found" "name"="test-name" "namespace"="test-namespace" "reason"="SecretNotFound" "type"="ClientCredentialsValid"`,
 			},
 			wantResultingCache: []provider.UpstreamOIDCIdentityProviderI{},
@@ -167,6 +205,13 @@ func TestController(t *testing.T) {
 							Reason:             "SecretNotFound",
 							Message:            `secret "test-client-secret" not found`,
 						},
+						{
+							Type:               "JWKSReachable",
+							Status:             "True",
+							LastTransitionTime: now,
+							Reason:             "Success",
+							Message:            "fetched JWKS",
+						},
 						{
 							Type:               "OIDCDiscoverySucceeded",
 							Status:             "True",
@@ -174,6 +219,17 @@ func TestController(t *testing.T) {
 							Reason:             "Success",
 							Message:            "discovered issuer configuration",
 						},
+						{
+							Type:               "TokenEndpointReachable",
+							Status:             "True",
+							LastTransitionTime: now,
+							Reason:             "Success",
+							Message:            "reached token endpoint",
+						},
+					},
+					Probes: []v1alpha1.OIDCProbe{
+						{Type: "JWKSReachable", LastSuccessTime: now},
+						{Type: "TokenEndpointReachable", LastSuccessTime: now},
 					},
 				},
 			}},
@@ -198,6 +254,8 @@ func TestController(t *testing.T) {
 			wantLogs: []string{
 				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="referenced Secret \"test-client-secret\" has wrong type \"some-other-type\" (should be \"secrets.pinniped.dev/oidc-client\")" "reason"="SecretWrongType" "status"="False" "type"="ClientCredentialsValid"`,
 				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="discovered issuer configuration" "reason"="Success" "status"="True" "type"="OIDCDiscoverySucceeded"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="fetched JWKS" "reason"="Success" "status"="True" "type"="JWKSReachable"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="reached token endpoint" "reason"="Success" "status"="True" "type"="TokenEndpointReachable"`,
 				`upstream-observer "error"="OIDCIdentityProvider has a failing condition" "msg"="found failing condition" "message"="referenced Secret \"test-client-secret\" has wrong type \"some-other-type\" (should be \"secrets.pinniped.dev/oidc-client\")" "name"="test-name" "namespace"="test-namespace" "reason"="SecretWrongType" "type"="ClientCredentialsValid"`,
 			},
 			wantResultingCache: []provider.UpstreamOIDCIdentityProviderI{},
@@ -213,6 +271,13 @@ func TestController(t *testing.T) {
 							Reason:             "SecretWrongType",
 							Message:            `referenced Secret "test-client-secret" has wrong type "some-other-type" (should be "secrets.pinniped.dev/oidc-client")`,
 						},
+						{
+							Type:               "JWKSReachable",
+							Status:             "True",
+							LastTransitionTime: now,
+							Reason:             "Success",
+							Message:            "fetched JWKS",
+						},
 						{
 							Type:               "OIDCDiscoverySucceeded",
 							Status:             "True",
@@ -220,6 +285,17 @@ func TestController(t *testing.T) {
 							Reason:             "Success",
 							Message:            "discovered issuer configuration",
 						},
+						{
+							Type:               "TokenEndpointReachable",
+							Status:             "True",
+							LastTransitionTime: now,
+							Reason:             "Success",
+							Message:            "reached token endpoint",
+						},
+					},
+					Probes: []v1alpha1.OIDCProbe{
+						{Type: "JWKSReachable", LastSuccessTime: now},
+						{Type: "TokenEndpointReachable", LastSuccessTime: now},
 					},
 				},
 			}},
@@ -243,6 +319,8 @@ func TestController(t *testing.T) {
 			wantLogs: []string{
 				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="referenced Secret \"test-client-secret\" is missing required keys [\"clientID\" \"clientSecret\"]" "reason"="SecretMissingKeys" "status"="False" "type"="ClientCredentialsValid"`,
 				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="discovered issuer configuration" "reason"="Success" "status"="True" "type"="OIDCDiscoverySucceeded"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="fetched JWKS" "reason"="Success" "status"="True" "type"="JWKSReachable"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="reached token endpoint" "reason"="Success" "status"="True" "type"="TokenEndpointReachable"`,
 				`upstream-observer "error"="OIDCIdentityProvider has a failing condition" "msg"="found failing condition" "message"="referenced Secret \"test-client-secret\" is missing required keys [\"clientID\" \"clientSecret\"]" "name"="test-name" "namespace"="test-namespace" "reason"="SecretMissingKeys" "type"="ClientCredentialsValid"`,
 			},
 			wantResultingCache: []provider.UpstreamOIDCIdentityProviderI{},
@@ -258,6 +336,13 @@ func TestController(t *testing.T) {
 							Reason:             "SecretMissingKeys",
 							Message:            `referenced Secret "test-client-secret" is missing required keys ["clientID" "clientSecret"]`,
 						},
+						{
+							Type:               "JWKSReachable",
+							Status:             "True",
+							LastTransitionTime: now,
+							Reason:             "Success",
+							Message:            "fetched JWKS",
+						},
 						{
 							Type:               "OIDCDiscoverySucceeded",
 							Status:             "True",
@@ -265,6 +350,17 @@ func TestController(t *testing.T) {
 							Reason:             "Success",
 							Message:            "discovered issuer configuration",
 						},
+						{
+							Type:               "TokenEndpointReachable",
+							Status:             "True",
+							LastTransitionTime: now,
+							Reason:             "Success",
+							Message:            "reached token endpoint",
+						},
+					},
+					Probes: []v1alpha1.OIDCProbe{
+						{Type: "JWKSReachable", LastSuccessTime: now},
+						{Type: "TokenEndpointReachable", LastSuccessTime: now},
 					},
 				},
 			}},
@@ -291,6 +387,8 @@ func TestController(t *testing.T) {
 			wantLogs: []string{
 				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="loaded client credentials" "reason"="Success" "status"="True" "type"="ClientCredentialsValid"`,
 				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="spec.certificateAuthorityData is invalid: illegal base64 data at input byte 7" "reason"="InvalidTLSConfig" "status"="False" "type"="OIDCDiscoverySucceeded"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="cannot probe the endpoints until OIDC discovery succeeds" "reason"="OIDCDiscoveryNotPassed" "status"="Unknown" "type"="JWKSReachable"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="cannot probe the endpoints until OIDC discovery succeeds" "reason"="OIDCDiscoveryNotPassed" "status"="Unknown" "type"="TokenEndpointReachable"`,
 				`upstream-observer "error"="OIDCIdentityProvider has a failing condition" "msg"="found failing condition" "message"="spec.certificateAuthorityData is invalid: illegal base64 data at input byte 7" "name"="test-name" "namespace"="test-namespace" "reason"="InvalidTLSConfig" "type"="OIDCDiscoverySucceeded"`,
 			},
 			wantResultingCache: []provider.UpstreamOIDCIdentityProviderI{},
@@ -306,6 +404,13 @@ func TestController(t *testing.T) {
 							Reason:             "Success",
 							Message:            "loaded client credentials",
 						},
+						{
+							Type:               "JWKSReachable",
+							Status:             "Unknown",
+							LastTransitionTime: now,
+							Reason:             "OIDCDiscoveryNotPassed",
+							Message:            "cannot probe the endpoints until OIDC discovery succeeds",
+						},
 						{
 							Type:               "OIDCDiscoverySucceeded",
 							Status:             "False",
@@ -313,6 +418,13 @@ func TestController(t *testing.T) {
 							Reason:             "InvalidTLSConfig",
 							Message:            `spec.certificateAuthorityData is invalid: illegal base64 data at input byte 7`,
 						},
+						{
+							Type:               "TokenEndpointReachable",
+							Status:             "Unknown",
+							LastTransitionTime: now,
+							Reason:             "OIDCDiscoveryNotPassed",
+							Message:            "cannot probe the endpoints until OIDC discovery succeeds",
+						},
 					},
 				},
 			}},
@@ -339,6 +451,8 @@ func TestController(t *testing.T) {
 			wantLogs: []string{
 				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="loaded client credentials" "reason"="Success" "status"="True" "type"="ClientCredentialsValid"`,
 				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="spec.certificateAuthorityData is invalid: no certificates found" "reason"="InvalidTLSConfig" "status"="False" "type"="OIDCDiscoverySucceeded"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="cannot probe the endpoints until OIDC discovery succeeds" "reason"="OIDCDiscoveryNotPassed" "status"="Unknown" "type"="JWKSReachable"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="cannot probe the endpoints until OIDC discovery succeeds" "reason"="OIDCDiscoveryNotPassed" "status"="Unknown" "type"="TokenEndpointReachable"`,
 				`upstream-observer "error"="OIDCIdentityProvider has a failing condition" "msg"="found failing condition" "message"="spec.certificateAuthorityData is invalid: no certificates found" "name"="test-name" "namespace"="test-namespace" "reason"="InvalidTLSConfig" "type"="OIDCDiscoverySucceeded"`,
 			},
 			wantResultingCache: []provider.UpstreamOIDCIdentityProviderI{},
@@ -354,6 +468,13 @@ func TestController(t *testing.T) {
 							Reason:             "Success",
 							Message:            "loaded client credentials",
 						},
+						{
+							Type:               "JWKSReachable",
+							Status:             "Unknown",
+							LastTransitionTime: now,
+							Reason:             "OIDCDiscoveryNotPassed",
+							Message:            "cannot probe the endpoints until OIDC discovery succeeds",
+						},
 						{
 							Type:               "OIDCDiscoverySucceeded",
 							Status:             "False",
@@ -361,6 +482,13 @@ func TestController(t *testing.T) {
 							Reason:             "InvalidTLSConfig",
 							Message:            `spec.certificateAuthorityData is invalid: no certificates found`,
 						},
+						{
+							Type:               "TokenEndpointReachable",
+							Status:             "Unknown",
+							LastTransitionTime: now,
+							Reason:             "OIDCDiscoveryNotPassed",
+							Message:            "cannot probe the endpoints until OIDC discovery succeeds",
+						},
 					},
 				},
 			}},
@@ -384,6 +512,8 @@ func TestController(t *testing.T) {
 			wantLogs: []string{
 				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="loaded client credentials" "reason"="Success" "status"="True" "type"="ClientCredentialsValid"`,
 				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="failed to perform OIDC discovery against \"invalid-url\"" "reason"="Unreachable" "status"="False" "type"="OIDCDiscoverySucceeded"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="cannot probe the endpoints until OIDC discovery succeeds" "reason"="OIDCDiscoveryNotPassed" "status"="Unknown" "type"="JWKSReachable"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="cannot probe the endpoints until OIDC discovery succeeds" "reason"="OIDCDiscoveryNotPassed" "status"="Unknown" "type"="TokenEndpointReachable"`,
 				`upstream-observer "error"="OIDCIdentityProvider has a failing condition" "msg"="found failing condition" "message"="failed to perform OIDC discovery against \"invalid-url\"" "name"="test-name" "namespace"="test-namespace" "reason"="Unreachable" "type"="OIDCDiscoverySucceeded"`,
 			},
 			wantResultingCache: []provider.UpstreamOIDCIdentityProviderI{},
@@ -399,6 +529,13 @@ func TestController(t *testing.T) {
 							Reason:             "Success",
 							Message:            "loaded client credentials",
 						},
+						{
+							Type:               "JWKSReachable",
+							Status:             "Unknown",
+							LastTransitionTime: now,
+							Reason:             "OIDCDiscoveryNotPassed",
+							Message:            "cannot probe the endpoints until OIDC discovery succeeds",
+						},
 						{
 							Type:               "OIDCDiscoverySucceeded",
 							Status:             "False",
@@ -406,6 +543,13 @@ func TestController(t *testing.T) {
 							Reason:             "Unreachable",
 							Message:            `failed to perform OIDC discovery against "invalid-url"`,
 						},
+						{
+							Type:               "TokenEndpointReachable",
+							Status:             "Unknown",
+							LastTransitionTime: now,
+							Reason:             "OIDCDiscoveryNotPassed",
+							Message:            "cannot probe the endpoints until OIDC discovery succeeds",
+						},
 					},
 				},
 			}},
@@ -430,6 +574,8 @@ func TestController(t *testing.T) {
 			wantLogs: []string{
 				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="loaded client credentials" "reason"="Success" "status"="True" "type"="ClientCredentialsValid"`,
 				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="failed to parse authorization endpoint URL: parse \"%\": invalid URL escape \"%\"" "reason"="InvalidResponse" "status"="False" "type"="OIDCDiscoverySucceeded"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="cannot probe the endpoints until OIDC discovery succeeds" "reason"="OIDCDiscoveryNotPassed" "status"="Unknown" "type"="JWKSReachable"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="cannot probe the endpoints until OIDC discovery succeeds" "reason"="OIDCDiscoveryNotPassed" "status"="Unknown" "type"="TokenEndpointReachable"`,
 				`upstream-observer "error"="OIDCIdentityProvider has a failing condition" "msg"="found failing condition" "message"="failed to parse authorization endpoint URL: parse \"%\": invalid URL escape \"%\"" "name"="test-name" "namespace"="test-namespace" "reason"="InvalidResponse" "type"="OIDCDiscoverySucceeded"`,
 			},
 			wantResultingCache: []provider.UpstreamOIDCIdentityProviderI{},
@@ -445,6 +591,13 @@ func TestController(t *testing.T) {
 							Reason:             "Success",
 							Message:            "loaded client credentials",
 						},
+						{
+							Type:               "JWKSReachable",
+							Status:             "Unknown",
+							LastTransitionTime: now,
+							Reason:             "OIDCDiscoveryNotPassed",
+							Message:            "cannot probe the endpoints until OIDC discovery succeeds",
+						},
 						{
 							Type:               "OIDCDiscoverySucceeded",
 							Status:             "False",
@@ -452,6 +605,13 @@ func TestController(t *testing.T) {
 							Reason:             "InvalidResponse",
 							Message:            `failed to parse authorization endpoint URL: parse "%": invalid URL escape "%"`,
 						},
+						{
+							Type:               "TokenEndpointReachable",
+							Status:             "Unknown",
+							LastTransitionTime: now,
+							Reason:             "OIDCDiscoveryNotPassed",
+							Message:            "cannot probe the endpoints until OIDC discovery succeeds",
+						},
 					},
 				},
 			}},
@@ -476,6 +636,8 @@ func TestController(t *testing.T) {
 			wantLogs: []string{
 				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="loaded client credentials" "reason"="Success" "status"="True" "type"="ClientCredentialsValid"`,
 				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="authorization endpoint URL scheme must be \"https\", not \"http\"" "reason"="InvalidResponse" "status"="False" "type"="OIDCDiscoverySucceeded"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="cannot probe the endpoints until OIDC discovery succeeds" "reason"="OIDCDiscoveryNotPassed" "status"="Unknown" "type"="JWKSReachable"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="cannot probe the endpoints until OIDC discovery succeeds" "reason"="OIDCDiscoveryNotPassed" "status"="Unknown" "type"="TokenEndpointReachable"`,
 				`upstream-observer "error"="OIDCIdentityProvider has a failing condition" "msg"="found failing condition" "message"="authorization endpoint URL scheme must be \"https\", not \"http\"" "name"="test-name" "namespace"="test-namespace" "reason"="InvalidResponse" "type"="OIDCDiscoverySucceeded"`,
 			},
 			wantResultingCache: []provider.UpstreamOIDCIdentityProviderI{},
@@ -491,6 +653,13 @@ func TestController(t *testing.T) {
 							Reason:             "Success",
 							Message:            "loaded client credentials",
 						},
+						{
+							Type:               "JWKSReachable",
+							Status:             "Unknown",
+							LastTransitionTime: now,
+							Reason:             "OIDCDiscoveryNotPassed",
+							Message:            "cannot probe the endpoints until OIDC discovery succeeds",
+						},
 						{
 							Type:               "OIDCDiscoverySucceeded",
 							Status:             "False",
@@ -498,6 +667,13 @@ func TestController(t *testing.T) {
 							Reason:             "InvalidResponse",
 							Message:            `authorization endpoint URL scheme must be "https", not "http"`,
 						},
+						{
+							Type:               "TokenEndpointReachable",
+							Status:             "Unknown",
+							LastTransitionTime: now,
+							Reason:             "OIDCDiscoveryNotPassed",
+							Message:            "cannot probe the endpoints until OIDC discovery succeeds",
+						},
 					},
 				},
 			}},
@@ -507,11 +683,15 @@ func TestController(t *testing.T) {
 			inputUpstreams: []runtime.Object{&v1alpha1.OIDCIdentityProvider{
 				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "test-name"},
 				Spec: v1alpha1.OIDCIdentityProviderSpec{
-					Issuer:              testIssuerURL,
-					TLS:                 &v1alpha1.TLSSpec{CertificateAuthorityData: testIssuerCABase64},
-					Client:              v1alpha1.OIDCClient{SecretName: testSecretName},
-					AuthorizationConfig: v1alpha1.OIDCAuthorizationConfig{AdditionalScopes: append(testAdditionalScopes, "xyz", "openid")},
-					Claims:              v1alpha1.OIDCClaims{Groups: testGroupsClaim, Username: testUsernameClaim},
+					Issuer: testIssuerURL,
+					TLS:    &v1alpha1.TLSSpec{CertificateAuthorityData: testIssuerCABase64},
+					Client: v1alpha1.OIDCClient{SecretName: testSecretName},
+					AuthorizationConfig: v1alpha1.OIDCAuthorizationConfig{
+						AdditionalScopes:  append(testAdditionalScopes, "xyz", "openid"),
+						RequiredACRValues: []string{"phrh", "phr"},
+						RequiredAMRValues: []string{"mfa"},
+					},
+					Claims: v1alpha1.OIDCClaims{Groups: testGroupsClaim, Username: testUsernameClaim},
 				},
 				Status: v1alpha1.OIDCIdentityProviderStatus{
 					Phase: "Error",
@@ -529,15 +709,19 @@ func TestController(t *testing.T) {
 			wantLogs: []string{
 				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="loaded client credentials" "reason"="Success" "status"="True" "type"="ClientCredentialsValid"`,
 				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="discovered issuer configuration" "reason"="Success" "status"="True" "type"="OIDCDiscoverySucceeded"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="fetched JWKS" "reason"="Success" "status"="True" "type"="JWKSReachable"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="reached token endpoint" "reason"="Success" "status"="True" "type"="TokenEndpointReachable"`,
 			},
 			wantResultingCache: []provider.UpstreamOIDCIdentityProviderI{
 				&oidctestutil.TestUpstreamOIDCIdentityProvider{
-					Name:             testName,
-					ClientID:         testClientID,
-					AuthorizationURL: *testIssuerAuthorizeURL,
-					Scopes:           append(testExpectedScopes, "xyz"),
-					UsernameClaim:    testUsernameClaim,
-					GroupsClaim:      testGroupsClaim,
+					Name:              testName,
+					ClientID:          testClientID,
+					AuthorizationURL:  *testIssuerAuthorizeURL,
+					Scopes:            append(testExpectedScopes, "xyz"),
+					UsernameClaim:     testUsernameClaim,
+					GroupsClaim:       testGroupsClaim,
+					RequiredACRValues: []string{"phrh", "phr"},
+					RequiredAMRValues: []string{"mfa"},
 				},
 			},
 			wantResultingUpstreams: []v1alpha1.OIDCIdentityProvider{{
@@ -546,7 +730,13 @@ func TestController(t *testing.T) {
 					Phase: "Ready",
 					Conditions: []v1alpha1.Condition{
 						{Type: "ClientCredentialsValid", Status: "True", LastTransitionTime: now, Reason: "Success", Message: "loaded client credentials"},
+						{Type: "JWKSReachable", Status: "True", LastTransitionTime: now, Reason: "Success", Message: "fetched JWKS"},
 						{Type: "OIDCDiscoverySucceeded", Status: "True", LastTransitionTime: now, Reason: "Success", Message: "discovered issuer configuration"},
+						{Type: "TokenEndpointReachable", Status: "True", LastTransitionTime: now, Reason: "Success", Message: "reached token endpoint"},
+					},
+					Probes: []v1alpha1.OIDCProbe{
+						{Type: "JWKSReachable", LastSuccessTime: now},
+						{Type: "TokenEndpointReachable", LastSuccessTime: now},
 					},
 				},
 			}},
@@ -578,6 +768,8 @@ func TestController(t *testing.T) {
 			wantLogs: []string{
 				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="loaded client credentials" "reason"="Success" "status"="True" "type"="ClientCredentialsValid"`,
 				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="discovered issuer configuration" "reason"="Success" "status"="True" "type"="OIDCDiscoverySucceeded"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="fetched JWKS" "reason"="Success" "status"="True" "type"="JWKSReachable"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="reached token endpoint" "reason"="Success" "status"="True" "type"="TokenEndpointReachable"`,
 			},
 			wantResultingCache: []provider.UpstreamOIDCIdentityProviderI{
 				&oidctestutil.TestUpstreamOIDCIdentityProvider{
@@ -595,7 +787,357 @@ func TestController(t *testing.T) {
 					Phase: "Ready",
 					Conditions: []v1alpha1.Condition{
 						{Type: "ClientCredentialsValid", Status: "True", LastTransitionTime: earlier, Reason: "Success", Message: "loaded client credentials", ObservedGeneration: 1234},
+						{Type: "JWKSReachable", Status: "True", LastTransitionTime: now, Reason: "Success", Message: "fetched JWKS", ObservedGeneration: 1234},
+						{Type: "OIDCDiscoverySucceeded", Status: "True", LastTransitionTime: earlier, Reason: "Success", Message: "discovered issuer configuration", ObservedGeneration: 1234},
+						{Type: "TokenEndpointReachable", Status: "True", LastTransitionTime: now, Reason: "Success", Message: "reached token endpoint", ObservedGeneration: 1234},
+					},
+					Probes: []v1alpha1.OIDCProbe{
+						{Type: "JWKSReachable", LastSuccessTime: now},
+						{Type: "TokenEndpointReachable", LastSuccessTime: now},
+					},
+				},
+			}},
+		},
+		{
+			name: "upstream with unhealthy endpoints is still valid",
+			inputUpstreams: []runtime.Object{&v1alpha1.OIDCIdentityProvider{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName, Generation: 1234},
+				Spec: v1alpha1.OIDCIdentityProviderSpec{
+					Issuer:      testIssuerURL + "/unhealthy",
+					TLS:         &v1alpha1.TLSSpec{CertificateAuthorityData: testIssuerCABase64},
+					Client:      v1alpha1.OIDCClient{SecretName: testSecretName},
+					HealthCheck: v1alpha1.OIDCHealthCheck{IntervalSeconds: &sixtySeconds},
+				},
+				Status: v1alpha1.OIDCIdentityProviderStatus{
+					Phase: "Ready",
+					Conditions: []v1alpha1.Condition{
+						{Type: "ClientCredentialsValid", Status: "True", LastTransitionTime: earlier, Reason: "Success", Message: "loaded client credentials", ObservedGeneration: 1234},
+						{Type: "JWKSReachable", Status: "True", LastTransitionTime: earlier, Reason: "Success", Message: "fetched JWKS", ObservedGeneration: 1234},
+						{Type: "OIDCDiscoverySucceeded", Status: "True", LastTransitionTime: earlier, Reason: "Success", Message: "discovered issuer configuration", ObservedGeneration: 1234},
+						{Type: "TokenEndpointReachable", Status: "True", LastTransitionTime: earlier, Reason: "Success", Message: "reached token endpoint", ObservedGeneration: 1234},
+					},
+					Probes: []v1alpha1.OIDCProbe{
+						{Type: "JWKSReachable", LastSuccessTime: earlier},
+						{Type: "TokenEndpointReachable", LastSuccessTime: earlier},
+					},
+				},
+			}},
+			inputSecrets: []runtime.Object{&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testSecretName},
+				Type:       "secrets.pinniped.dev/oidc-client",
+				Data:       testValidSecretData,
+			}},
+			wantLogs: []string{
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="JWKS from \"` + testIssuerURL + `/unhealthy/jwks.json\" contains no valid keys" "reason"="InvalidResponse" "status"="False" "type"="JWKSReachable"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="token endpoint \"` + testIssuerURL + `/unhealthy/token\" responded with unexpected status code 503" "reason"="Unreachable" "status"="False" "type"="TokenEndpointReachable"`,
+				`upstream-observer "error"="OIDCIdentityProvider has a failing condition" "msg"="found failing health probe" "message"="JWKS from \"` + testIssuerURL + `/unhealthy/jwks.json\" contains no valid keys" "name"="test-name" "namespace"="test-namespace" "reason"="InvalidResponse" "type"="JWKSReachable"`,
+				`upstream-observer "error"="OIDCIdentityProvider has a failing condition" "msg"="found failing health probe" "message"="token endpoint \"` + testIssuerURL + `/unhealthy/token\" responded with unexpected status code 503" "name"="test-name" "namespace"="test-namespace" "reason"="Unreachable" "type"="TokenEndpointReachable"`,
+			},
+			wantResultingCache: []provider.UpstreamOIDCIdentityProviderI{
+				&oidctestutil.TestUpstreamOIDCIdentityProvider{
+					Name:             testName,
+					ClientID:         testClientID,
+					AuthorizationURL: *testIssuerAuthorizeURL,
+					Scopes:           []string{"openid"},
+				},
+			},
+			wantResultingUpstreams: []v1alpha1.OIDCIdentityProvider{{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName, Generation: 1234},
+				Status: v1alpha1.OIDCIdentityProviderStatus{
+					Phase: "Error",
+					Conditions: []v1alpha1.Condition{
+						{Type: "ClientCredentialsValid", Status: "True", LastTransitionTime: earlier, Reason: "Success", Message: "loaded client credentials", ObservedGeneration: 1234},
+						{Type: "JWKSReachable", Status: "False", LastTransitionTime: now, Reason: "InvalidResponse", Message: `JWKS from "` + testIssuerURL + `/unhealthy/jwks.json" contains no valid keys`, ObservedGeneration: 1234},
 						{Type: "OIDCDiscoverySucceeded", Status: "True", LastTransitionTime: earlier, Reason: "Success", Message: "discovered issuer configuration", ObservedGeneration: 1234},
+						{Type: "TokenEndpointReachable", Status: "False", LastTransitionTime: now, Reason: "Unreachable", Message: `token endpoint "` + testIssuerURL + `/unhealthy/token" responded with unexpected status code 503`, ObservedGeneration: 1234},
+					},
+					// The last successful probes are still reported.
+					Probes: []v1alpha1.OIDCProbe{
+						{Type: "JWKSReachable", LastSuccessTime: earlier},
+						{Type: "TokenEndpointReachable", LastSuccessTime: earlier},
+					},
+				},
+			}},
+		},
+		{
+			name: "upstream with additional claims, some of which would overwrite reserved claims",
+			inputUpstreams: []runtime.Object{&v1alpha1.OIDCIdentityProvider{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName},
+				Spec: v1alpha1.OIDCIdentityProviderSpec{
+					Issuer: testIssuerURL,
+					TLS:    &v1alpha1.TLSSpec{CertificateAuthorityData: testIssuerCABase64},
+					Client: v1alpha1.OIDCClient{SecretName: testSecretName},
+					Claims: v1alpha1.OIDCClaims{
+						Groups:   testGroupsClaim,
+						Username: testUsernameClaim,
+						AdditionalClaims: []v1alpha1.OIDCAdditionalClaim{
+							{Upstream: "email"},
+							{Upstream: "name", Downstream: "display_name"},
+							{Upstream: "memberOf", Downstream: "groups"},
+							{Upstream: "sub"},
+						},
+					},
+				},
+			}},
+			inputSecrets: []runtime.Object{&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testSecretName},
+				Type:       "secrets.pinniped.dev/oidc-client",
+				Data:       testValidSecretData,
+			}},
+			wantLogs: []string{
+				`upstream-observer "error"="additional claim would overwrite a claim which is set by the Supervisor" "msg"="ignoring additional claim" "downstreamClaim"="groups" "name"="test-name" "namespace"="test-namespace" "upstreamClaim"="memberOf"`,
+				`upstream-observer "error"="additional claim would overwrite a claim which is set by the Supervisor" "msg"="ignoring additional claim" "downstreamClaim"="sub" "name"="test-name" "namespace"="test-namespace" "upstreamClaim"="sub"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="loaded client credentials" "reason"="Success" "status"="True" "type"="ClientCredentialsValid"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="discovered issuer configuration" "reason"="Success" "status"="True" "type"="OIDCDiscoverySucceeded"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="fetched JWKS" "reason"="Success" "status"="True" "type"="JWKSReachable"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="reached token endpoint" "reason"="Success" "status"="True" "type"="TokenEndpointReachable"`,
+			},
+			wantResultingCache: []provider.UpstreamOIDCIdentityProviderI{
+				&oidctestutil.TestUpstreamOIDCIdentityProvider{
+					Name:             testName,
+					ClientID:         testClientID,
+					AuthorizationURL: *testIssuerAuthorizeURL,
+					Scopes:           []string{"openid"},
+					UsernameClaim:    testUsernameClaim,
+					GroupsClaim:      testGroupsClaim,
+					AdditionalClaims: map[string]string{"email": "email", "display_name": "name"},
+				},
+			},
+			wantResultingUpstreams: []v1alpha1.OIDCIdentityProvider{{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName},
+				Status: v1alpha1.OIDCIdentityProviderStatus{
+					Phase: "Ready",
+					Conditions: []v1alpha1.Condition{
+						{Type: "ClientCredentialsValid", Status: "True", LastTransitionTime: now, Reason: "Success", Message: "loaded client credentials"},
+						{Type: "JWKSReachable", Status: "True", LastTransitionTime: now, Reason: "Success", Message: "fetched JWKS"},
+						{Type: "OIDCDiscoverySucceeded", Status: "True", LastTransitionTime: now, Reason: "Success", Message: "discovered issuer configuration"},
+						{Type: "TokenEndpointReachable", Status: "True", LastTransitionTime: now, Reason: "Success", Message: "reached token endpoint"},
+					},
+					Probes: []v1alpha1.OIDCProbe{
+						{Type: "JWKSReachable", LastSuccessTime: now},
+						{Type: "TokenEndpointReachable", LastSuccessTime: now},
+					},
+				},
+			}},
+		},
+		{
+			name: "upstream reached through an HTTP proxy",
+			inputUpstreams: []runtime.Object{&v1alpha1.OIDCIdentityProvider{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName},
+				Spec: v1alpha1.OIDCIdentityProviderSpec{
+					Issuer: "https://example.com/proxied",
+					TLS:    &v1alpha1.TLSSpec{CertificateAuthorityData: testIssuerCABase64},
+					Client: v1alpha1.OIDCClient{SecretName: testSecretName},
+					Egress: v1alpha1.OIDCEgress{ProxyURL: testProxyURL, NoProxy: []string{"other.example.com"}, TimeoutSeconds: &sixtySeconds},
+				},
+			}},
+			inputSecrets: []runtime.Object{&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testSecretName},
+				Type:       "secrets.pinniped.dev/oidc-client",
+				Data:       testValidSecretData,
+			}},
+			wantLogs: []string{
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="loaded client credentials" "reason"="Success" "status"="True" "type"="ClientCredentialsValid"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="discovered issuer configuration" "reason"="Success" "status"="True" "type"="OIDCDiscoverySucceeded"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="fetched JWKS" "reason"="Success" "status"="True" "type"="JWKSReachable"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="reached token endpoint" "reason"="Success" "status"="True" "type"="TokenEndpointReachable"`,
+			},
+			wantResultingCache: []provider.UpstreamOIDCIdentityProviderI{
+				&oidctestutil.TestUpstreamOIDCIdentityProvider{
+					Name:             testName,
+					ClientID:         testClientID,
+					AuthorizationURL: *testIssuerAuthorizeURL,
+					Scopes:           []string{"openid"},
+				},
+			},
+			wantResultingUpstreams: []v1alpha1.OIDCIdentityProvider{{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName},
+				Status: v1alpha1.OIDCIdentityProviderStatus{
+					Phase: "Ready",
+					Conditions: []v1alpha1.Condition{
+						{Type: "ClientCredentialsValid", Status: "True", LastTransitionTime: now, Reason: "Success", Message: "loaded client credentials"},
+						{Type: "JWKSReachable", Status: "True", LastTransitionTime: now, Reason: "Success", Message: "fetched JWKS"},
+						{Type: "OIDCDiscoverySucceeded", Status: "True", LastTransitionTime: now, Reason: "Success", Message: "discovered issuer configuration"},
+						{Type: "TokenEndpointReachable", Status: "True", LastTransitionTime: now, Reason: "Success", Message: "reached token endpoint"},
+					},
+					Probes: []v1alpha1.OIDCProbe{
+						{Type: "JWKSReachable", LastSuccessTime: now},
+						{Type: "TokenEndpointReachable", LastSuccessTime: now},
+					},
+				},
+			}},
+		},
+		{
+			name: "proxy URL is invalid",
+			inputUpstreams: []runtime.Object{&v1alpha1.OIDCIdentityProvider{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName},
+				Spec: v1alpha1.OIDCIdentityProviderSpec{
+					Issuer: testIssuerURL,
+					TLS:    &v1alpha1.TLSSpec{CertificateAuthorityData: testIssuerCABase64},
+					Client: v1alpha1.OIDCClient{SecretName: testSecretName},
+					Egress: v1alpha1.OIDCEgress{ProxyURL: "http://"},
+				},
+			}},
+			inputSecrets: []runtime.Object{&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testSecretName},
+				Type:       "secrets.pinniped.dev/oidc-client",
+				Data:       testValidSecretData,
+			}},
+			wantErr: controllerlib.ErrSyntheticRequeue.Error(),
+			wantLogs: []string{
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="loaded client credentials" "reason"="Success" "status"="True" "type"="ClientCredentialsValid"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="spec.egress.proxyURL \"http://\" must be an http or https URL with a host" "reason"="InvalidEgressConfig" "status"="False" "type"="OIDCDiscoverySucceeded"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="cannot probe the endpoints until OIDC discovery succeeds" "reason"="OIDCDiscoveryNotPassed" "status"="Unknown" "type"="JWKSReachable"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="cannot probe the endpoints until OIDC discovery succeeds" "reason"="OIDCDiscoveryNotPassed" "status"="Unknown" "type"="TokenEndpointReachable"`,
+				`upstream-observer "error"="OIDCIdentityProvider has a failing condition" "msg"="found failing condition" "message"="spec.egress.proxyURL \"http://\" must be an http or https URL with a host" "name"="test-name" "namespace"="test-namespace" "reason"="InvalidEgressConfig" "type"="OIDCDiscoverySucceeded"`,
+			},
+			wantResultingCache: []provider.UpstreamOIDCIdentityProviderI{},
+			wantResultingUpstreams: []v1alpha1.OIDCIdentityProvider{{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName},
+				Status: v1alpha1.OIDCIdentityProviderStatus{
+					Phase: "Error",
+					Conditions: []v1alpha1.Condition{
+						{Type: "ClientCredentialsValid", Status: "True", LastTransitionTime: now, Reason: "Success", Message: "loaded client credentials"},
+						{Type: "JWKSReachable", Status: "Unknown", LastTransitionTime: now, Reason: "OIDCDiscoveryNotPassed", Message: "cannot probe the endpoints until OIDC discovery succeeds"},
+						{Type: "OIDCDiscoverySucceeded", Status: "False", LastTransitionTime: now, Reason: "InvalidEgressConfig", Message: `spec.egress.proxyURL "http://" must be an http or https URL with a host`},
+						{Type: "TokenEndpointReachable", Status: "Unknown", LastTransitionTime: now, Reason: "OIDCDiscoveryNotPassed", Message: "cannot probe the endpoints until OIDC discovery succeeds"},
+					},
+				},
+			}},
+		},
+		{
+			name: "upstream requires a client certificate",
+			inputUpstreams: []runtime.Object{&v1alpha1.OIDCIdentityProvider{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName},
+				Spec: v1alpha1.OIDCIdentityProviderSpec{
+					Issuer: testMTLSIssuerURL,
+					TLS:    &v1alpha1.TLSSpec{CertificateAuthorityData: testMTLSIssuerCABase64},
+					Client: v1alpha1.OIDCClient{SecretName: testSecretName},
+					Egress: v1alpha1.OIDCEgress{ClientCertificateSecretName: testClientCertSecret},
+				},
+			}},
+			inputSecrets: []runtime.Object{
+				&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testSecretName},
+					Type:       "secrets.pinniped.dev/oidc-client",
+					Data:       testValidSecretData,
+				},
+				&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testClientCertSecret},
+					Type:       "kubernetes.io/tls",
+					Data:       map[string][]byte{"tls.crt": testClientCertPEM, "tls.key": testClientKeyPEM},
+				},
+			},
+			wantLogs: []string{
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="loaded client credentials" "reason"="Success" "status"="True" "type"="ClientCredentialsValid"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="discovered issuer configuration" "reason"="Success" "status"="True" "type"="OIDCDiscoverySucceeded"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="fetched JWKS" "reason"="Success" "status"="True" "type"="JWKSReachable"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="reached token endpoint" "reason"="Success" "status"="True" "type"="TokenEndpointReachable"`,
+			},
+			wantResultingCache: []provider.UpstreamOIDCIdentityProviderI{
+				&oidctestutil.TestUpstreamOIDCIdentityProvider{
+					Name:             testName,
+					ClientID:         testClientID,
+					AuthorizationURL: *testIssuerAuthorizeURL,
+					Scopes:           []string{"openid"},
+				},
+			},
+			wantResultingUpstreams: []v1alpha1.OIDCIdentityProvider{{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName},
+				Status: v1alpha1.OIDCIdentityProviderStatus{
+					Phase: "Ready",
+					Conditions: []v1alpha1.Condition{
+						{Type: "ClientCredentialsValid", Status: "True", LastTransitionTime: now, Reason: "Success", Message: "loaded client credentials"},
+						{Type: "JWKSReachable", Status: "True", LastTransitionTime: now, Reason: "Success", Message: "fetched JWKS"},
+						{Type: "OIDCDiscoverySucceeded", Status: "True", LastTransitionTime: now, Reason: "Success", Message: "discovered issuer configuration"},
+						{Type: "TokenEndpointReachable", Status: "True", LastTransitionTime: now, Reason: "Success", Message: "reached token endpoint"},
+					},
+					Probes: []v1alpha1.OIDCProbe{
+						{Type: "JWKSReachable", LastSuccessTime: now},
+						{Type: "TokenEndpointReachable", LastSuccessTime: now},
+					},
+				},
+			}},
+		},
+		{
+			name: "client certificate Secret is missing",
+			inputUpstreams: []runtime.Object{&v1alpha1.OIDCIdentityProvider{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName},
+				Spec: v1alpha1.OIDCIdentityProviderSpec{
+					Issuer: testMTLSIssuerURL,
+					TLS:    &v1alpha1.TLSSpec{CertificateAuthorityData: testMTLSIssuerCABase64},
+					Client: v1alpha1.OIDCClient{SecretName: testSecretName},
+					Egress: v1alpha1.OIDCEgress{ClientCertificateSecretName: testClientCertSecret},
+				},
+			}},
+			inputSecrets: []runtime.Object{&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testSecretName},
+				Type:       "secrets.pinniped.dev/oidc-client",
+				Data:       testValidSecretData,
+			}},
+			wantErr: controllerlib.ErrSyntheticRequeue.Error(),
+			wantLogs: []string{
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="loaded client credentials" "reason"="Success" "status"="True" "type"="ClientCredentialsValid"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="failed to get client certificate Secret: secret \"test-client-cert\" not found" "reason"="InvalidTLSConfig" "status"="False" "type"="OIDCDiscoverySucceeded"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="cannot probe the endpoints until OIDC discovery succeeds" "reason"="OIDCDiscoveryNotPassed" "status"="Unknown" "type"="JWKSReachable"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="cannot probe the endpoints until OIDC discovery succeeds" "reason"="OIDCDiscoveryNotPassed" "status"="Unknown" "type"="TokenEndpointReachable"`,
+				`upstream-observer "error"="OIDCIdentityProvider has a failing condition" "msg"="found failing condition" "message"="failed to get client certificate Secret: secret \"test-client-cert\" not found" "name"="test-name" "namespace"="test-namespace" "reason"="InvalidTLSConfig" "type"="OIDCDiscoverySucceeded"`,
+			},
+			wantResultingCache: []provider.UpstreamOIDCIdentityProviderI{},
+			wantResultingUpstreams: []v1alpha1.OIDCIdentityProvider{{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName},
+				Status: v1alpha1.OIDCIdentityProviderStatus{
+					Phase: "Error",
+					Conditions: []v1alpha1.Condition{
+						{Type: "ClientCredentialsValid", Status: "True", LastTransitionTime: now, Reason: "Success", Message: "loaded client credentials"},
+						{Type: "JWKSReachable", Status: "Unknown", LastTransitionTime: now, Reason: "OIDCDiscoveryNotPassed", Message: "cannot probe the endpoints until OIDC discovery succeeds"},
+						{Type: "OIDCDiscoverySucceeded", Status: "False", LastTransitionTime: now, Reason: "InvalidTLSConfig", Message: `failed to get client certificate Secret: secret "test-client-cert" not found`},
+						{Type: "TokenEndpointReachable", Status: "Unknown", LastTransitionTime: now, Reason: "OIDCDiscoveryNotPassed", Message: "cannot probe the endpoints until OIDC discovery succeeds"},
+					},
+				},
+			}},
+		},
+		{
+			name: "client certificate Secret has an invalid key pair",
+			inputUpstreams: []runtime.Object{&v1alpha1.OIDCIdentityProvider{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName},
+				Spec: v1alpha1.OIDCIdentityProviderSpec{
+					Issuer: testMTLSIssuerURL,
+					TLS:    &v1alpha1.TLSSpec{CertificateAuthorityData: testMTLSIssuerCABase64},
+					Client: v1alpha1.OIDCClient{SecretName: testSecretName},
+					Egress: v1alpha1.OIDCEgress{ClientCertificateSecretName: testClientCertSecret},
+				},
+			}},
+			inputSecrets: []runtime.Object{
+				&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testSecretName},
+					Type:       "secrets.pinniped.dev/oidc-client",
+					Data:       testValidSecretData,
+				},
+				&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testClientCertSecret},
+					Type:       "kubernetes.io/tls",
+					Data:       map[string][]byte{"tls.crt": testClientCertPEM, "tls.key": []byte("not a key")},
+				},
+			},
+			wantErr: controllerlib.ErrSyntheticRequeue.Error(),
+			wantLogs: []string{
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="loaded client credentials" "reason"="Success" "status"="True" "type"="ClientCredentialsValid"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="spec.egress.clientCertificateSecretName refers to an invalid client certificate: tls: failed to find any PEM data in key input" "reason"="InvalidTLSConfig" "status"="False" "type"="OIDCDiscoverySucceeded"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="cannot probe the endpoints until OIDC discovery succeeds" "reason"="OIDCDiscoveryNotPassed" "status"="Unknown" "type"="JWKSReachable"`,
+				`upstream-observer "level"=0 "msg"="updated condition" "name"="test-name" "namespace"="test-namespace" "message"="cannot probe the endpoints until OIDC discovery succeeds" "reason"="OIDCDiscoveryNotPassed" "status"="Unknown" "type"="TokenEndpointReachable"`,
+				`upstream-observer "error"="OIDCIdentityProvider has a failing condition" "msg"="found failing condition" "message"="spec.egress.clientCertificateSecretName refers to an invalid client certificate: tls: failed to find any PEM data in key input" "name"="test-name" "namespace"="test-namespace" "reason"="InvalidTLSConfig" "type"="OIDCDiscoverySucceeded"`,
+			},
+			wantResultingCache: []provider.UpstreamOIDCIdentityProviderI{},
+			wantResultingUpstreams: []v1alpha1.OIDCIdentityProvider{{
+				ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName},
+				Status: v1alpha1.OIDCIdentityProviderStatus{
+					Phase: "Error",
+					Conditions: []v1alpha1.Condition{
+						{Type: "ClientCredentialsValid", Status: "True", LastTransitionTime: now, Reason: "Success", Message: "loaded client credentials"},
+						{Type: "JWKSReachable", Status: "Unknown", LastTransitionTime: now, Reason: "OIDCDiscoveryNotPassed", Message: "cannot probe the endpoints until OIDC discovery succeeds"},
+						{Type: "OIDCDiscoverySucceeded", Status: "False", LastTransitionTime: now, Reason: "InvalidTLSConfig", Message: `spec.egress.clientCertificateSecretName refers to an invalid client certificate: tls: failed to find any PEM data in key input`},
+						{Type: "TokenEndpointReachable", Status: "Unknown", LastTransitionTime: now, Reason: "OIDCDiscoveryNotPassed", Message: "cannot probe the endpoints until OIDC discovery succeeds"},
 					},
 				},
 			}},
@@ -649,6 +1191,9 @@ func TestController(t *testing.T) {
 				require.Equal(t, tt.wantResultingCache[i].GetAuthorizationURL().String(), actualIDP.GetAuthorizationURL().String())
 				require.Equal(t, tt.wantResultingCache[i].GetUsernameClaim(), actualIDP.GetUsernameClaim())
 				require.Equal(t, tt.wantResultingCache[i].GetGroupsClaim(), actualIDP.GetGroupsClaim())
+				require.Equal(t, tt.wantResultingCache[i].GetAdditionalClaims(), actualIDP.GetAdditionalClaims())
+				require.Equal(t, tt.wantResultingCache[i].GetRequiredACRValues(), actualIDP.GetRequiredACRValues())
+				require.Equal(t, tt.wantResultingCache[i].GetRequiredAMRValues(), actualIDP.GetRequiredAMRValues())
 				require.ElementsMatch(t, tt.wantResultingCache[i].GetScopes(), actualIDP.GetScopes())
 			}
 
@@ -669,6 +1214,74 @@ func TestController(t *testing.T) {
 	}
 }
 
+func TestProbeMetrics(t *testing.T) {
+	t.Parallel()
+	testIssuerCA, testIssuerURL := newTestIssuer(t)
+
+	// This upstream has a name which no other test uses, so that the other tests do not change its metrics.
+	const testNamespace, testName = "test-namespace", "test-metrics-name"
+	fakePinnipedClient := pinnipedfake.NewSimpleClientset(&v1alpha1.OIDCIdentityProvider{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testName},
+		Spec: v1alpha1.OIDCIdentityProviderSpec{
+			Issuer: testIssuerURL + "/unhealthy",
+			TLS:    &v1alpha1.TLSSpec{CertificateAuthorityData: base64.StdEncoding.EncodeToString([]byte(testIssuerCA))},
+			Client: v1alpha1.OIDCClient{SecretName: "test-client-secret"},
+		},
+	})
+	pinnipedInformers := pinnipedinformers.NewSharedInformerFactory(fakePinnipedClient, 0)
+	fakeKubeClient := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "test-client-secret"},
+		Type:       "secrets.pinniped.dev/oidc-client",
+		Data:       map[string][]byte{"clientID": []byte("test-client-id"), "clientSecret": []byte("test-client-secret")},
+	})
+	kubeInformers := informers.NewSharedInformerFactory(fakeKubeClient, 0)
+
+	controller := New(
+		provider.NewDynamicUpstreamIDPProvider(),
+		fakePinnipedClient,
+		pinnipedInformers.IDP().V1alpha1().OIDCIdentityProviders(),
+		kubeInformers.Core().V1().Secrets(),
+		testlogger.New(t),
+		controllerlib.WithInformer,
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pinnipedInformers.Start(ctx.Done())
+	kubeInformers.Start(ctx.Done())
+	controllerlib.TestRunSynchronously(t, controller)
+
+	probes := []struct{ probeType, reason string }{
+		{probeType: "JWKSReachable", reason: "InvalidResponse"},
+		{probeType: "TokenEndpointReachable", reason: "Unreachable"},
+	}
+	// The metrics are global, so only compare how much they grow.
+	getMetrics := func(probeType, reason string) (float64, float64) {
+		failures, err := metricstestutil.GetCounterMetricValue(probeFailures.WithLabelValues(testNamespace, testName, probeType, reason))
+		require.NoError(t, err)
+		totalSeconds, err := metricstestutil.GetHistogramMetricValue(probeDuration.WithLabelValues(testNamespace, testName, probeType))
+		require.NoError(t, err)
+		return failures, totalSeconds
+	}
+	failuresBefore := map[string]float64{}
+	totalSecondsBefore := map[string]float64{}
+	for _, probe := range probes {
+		failuresBefore[probe.probeType], totalSecondsBefore[probe.probeType] = getMetrics(probe.probeType, probe.reason)
+	}
+
+	// Failed probes are not cached, so each sync probes the endpoints again.
+	syncCtx := controllerlib.Context{Context: ctx, Key: controllerlib.Key{}}
+	require.NoError(t, controllerlib.TestSync(t, controller, syncCtx))
+	require.NoError(t, controllerlib.TestSync(t, controller, syncCtx))
+
+	for _, probe := range probes {
+		failures, totalSeconds := getMetrics(probe.probeType, probe.reason)
+		require.Equal(t, failuresBefore[probe.probeType]+2, failures, probe.probeType)
+		require.Greater(t, totalSeconds, totalSecondsBefore[probe.probeType], probe.probeType)
+	}
+}
+
 func normalizeUpstreams(upstreams []v1alpha1.OIDCIdentityProvider, now metav1.Time) []v1alpha1.OIDCIdentityProvider {
 	result := make([]v1alpha1.OIDCIdentityProvider, 0, len(upstreams))
 	for _, u := range upstreams {
@@ -684,6 +1297,11 @@ func normalizeUpstreams(upstreams []v1alpha1.OIDCIdentityProvider, now metav1.Ti
 				normalized.Status.Conditions[i].LastTransitionTime = now
 			}
 		}
+		for i := range normalized.Status.Probes {
+			if time.Since(normalized.Status.Probes[i].LastSuccessTime.Time) < 5*time.Second {
+				normalized.Status.Probes[i].LastSuccessTime = now
+			}
+		}
 		result = append(result, *normalized)
 	}
 
@@ -701,14 +1319,48 @@ func newTestIssuer(t *testing.T) (string, string) {
 		JWKSURL  string `json:"jwks_uri"`
 	}
 
-	// At the root of the server, serve an issuer with a valid discovery response.
+	// At the root of the server, serve an issuer with a valid discovery response and healthy endpoints.
 	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("content-type", "application/json")
 		_ = json.NewEncoder(w).Encode(&providerJSON{
-			Issuer:  testURL,
-			AuthURL: "https://example.com/authorize",
+			Issuer:   testURL,
+			AuthURL:  "https://example.com/authorize",
+			TokenURL: testURL + "/token",
+			JWKSURL:  testURL + "/jwks.json",
 		})
 	})
+	mux.HandleFunc("/jwks.json", handleTestJWKS(t))
+	mux.HandleFunc("/token", handleTestToken)
+
+	// At "/proxied", serve an issuer named "example.com" with healthy endpoints, which is reached through the proxy
+	// started by newTestProxy.
+	mux.HandleFunc("/proxied/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(&providerJSON{
+			Issuer:   "https://example.com/proxied",
+			AuthURL:  "https://example.com/authorize",
+			TokenURL: "https://example.com/token",
+			JWKSURL:  "https://example.com/jwks.json",
+		})
+	})
+
+	// At "/unhealthy", serve an issuer with a valid discovery response but with unhealthy endpoints.
+	mux.HandleFunc("/unhealthy/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(&providerJSON{
+			Issuer:   testURL + "/unhealthy",
+			AuthURL:  "https://example.com/authorize",
+			TokenURL: testURL + "/unhealthy/token",
+			JWKSURL:  testURL + "/unhealthy/jwks.json",
+		})
+	})
+	mux.HandleFunc("/unhealthy/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		_, _ = w.Write([]byte(`{"keys":[]}`))
+	})
+	mux.HandleFunc("/unhealthy/token", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
 
 	// At "/invalid", serve an issuer that returns an invalid authorization URL (not parseable).
 	mux.HandleFunc("/invalid/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
@@ -730,3 +1382,151 @@ func newTestIssuer(t *testing.T) (string, string) {
 
 	return caBundlePEM, testURL
 }
+
+// newTestMTLSIssuer starts a test server which requires a client certificate issued by clientCAs, and which serves
+// an issuer with a valid discovery response and healthy endpoints at its root.
+func newTestMTLSIssuer(t *testing.T, clientCAs *x509.CertPool) (string, string) {
+	mux := http.NewServeMux()
+	server := httptest.NewUnstartedServer(mux)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs} //nolint: gosec
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		_, _ = w.Write([]byte(`{"issuer":"` + server.URL + `","authorization_endpoint":"https://example.com/authorize",` +
+			`"token_endpoint":"` + server.URL + `/token","jwks_uri":"` + server.URL + `/jwks.json"}`))
+	})
+	mux.HandleFunc("/jwks.json", handleTestJWKS(t))
+	mux.HandleFunc("/token", handleTestToken)
+
+	caBundle := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	return caBundle, server.URL
+}
+
+// newTestProxy starts an HTTP proxy which tunnels every CONNECT request to the target address, regardless of the
+// requested host.
+func newTestProxy(t *testing.T, target string) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			_ = upstream.Close()
+			return
+		}
+		go func() {
+			_, _ = io.Copy(upstream, conn)
+			_ = upstream.Close()
+		}()
+		_, _ = io.Copy(conn, upstream)
+		_ = conn.Close()
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// handleTestJWKS serves a JWKS containing a single newly generated key.
+func handleTestJWKS(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(&jose.JSONWebKeySet{
+			Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "some-key", Algorithm: "ES256", Use: "sig"}},
+		})
+	}
+}
+
+// handleTestToken serves a token endpoint which rejects every request, like a token endpoint which is reachable.
+func handleTestToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_, _ = w.Write([]byte(`{"error":"invalid_request"}`))
+}
+
+func TestGetProxy(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		egress       v1alpha1.OIDCEgress
+		wantErr      string
+		wantNoProxy  bool
+		wantProxyFor map[string]string
+	}{
+		{
+			name:        "no proxy",
+			wantNoProxy: true,
+		},
+		{
+			name:    "proxy URL without a host",
+			egress:  v1alpha1.OIDCEgress{ProxyURL: "http://"},
+			wantErr: `spec.egress.proxyURL "http://" must be an http or https URL with a host`,
+		},
+		{
+			name:    "proxy URL with the wrong scheme",
+			egress:  v1alpha1.OIDCEgress{ProxyURL: "socks5://proxy.example.com:1080"},
+			wantErr: `spec.egress.proxyURL "socks5://proxy.example.com:1080" must be an http or https URL with a host`,
+		},
+		{
+			name:    "proxy URL is not a URL",
+			egress:  v1alpha1.OIDCEgress{ProxyURL: "http://proxy.example.com:port"},
+			wantErr: `spec.egress.proxyURL is invalid: parse "http://proxy.example.com:port": invalid port ":port" after host`,
+		},
+		{
+			name: "proxy with no-proxy rules",
+			egress: v1alpha1.OIDCEgress{
+				ProxyURL: "http://proxy.example.com:3128",
+				NoProxy:  []string{"idp.example.com", ".internal.example.com", "10.0.0.0/8"},
+			},
+			wantProxyFor: map[string]string{
+				"https://other.example.com/.well-known/openid-configuration": "http://proxy.example.com:3128",
+				"https://idp.example.com/.well-known/openid-configuration":   "",
+				"https://sub.idp.example.com/token":                          "",
+				"https://internal.example.com/token":                         "http://proxy.example.com:3128",
+				"https://a.internal.example.com/token":                       "",
+				"https://10.1.2.3/token":                                     "",
+				"https://11.1.2.3/token":                                     "http://proxy.example.com:3128",
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			proxy, err := getProxy(&v1alpha1.OIDCIdentityProvider{Spec: v1alpha1.OIDCIdentityProviderSpec{Egress: tt.egress}})
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				require.Nil(t, proxy)
+				return
+			}
+			require.NoError(t, err)
+			if tt.wantNoProxy {
+				require.Nil(t, proxy)
+				return
+			}
+
+			for requestURL, wantProxy := range tt.wantProxyFor {
+				request, err := http.NewRequest(http.MethodGet, requestURL, nil)
+				require.NoError(t, err)
+				proxyURL, err := proxy(request)
+				require.NoError(t, err)
+				if wantProxy == "" {
+					require.Nil(t, proxyURL, requestURL)
+				} else {
+					require.Equal(t, wantProxy, proxyURL.String(), requestURL)
+				}
+			}
+		})
+	}
+}
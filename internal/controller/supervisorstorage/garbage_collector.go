@@ -1,37 +1,52 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package supervisorstorage
 
 import (
+	"context"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/sets"
 	corev1informers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
 
+	configinformers "go.pinniped.dev/generated/1.20/client/supervisor/informers/externalversions/config/v1alpha1"
+	idpinformers "go.pinniped.dev/generated/1.20/client/supervisor/informers/externalversions/idp/v1alpha1"
 	pinnipedcontroller "go.pinniped.dev/internal/controller"
 	"go.pinniped.dev/internal/controllerlib"
 	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/fositestorage"
 	"go.pinniped.dev/internal/plog"
 )
 
-const minimumRepeatInterval = 30 * time.Second
-
 type garbageCollectorController struct {
-	secretInformer        corev1informers.SecretInformer
-	kubeClient            kubernetes.Interface
-	clock                 clock.Clock
-	timeOfMostRecentSweep time.Time
+	secretInformer               corev1informers.SecretInformer
+	federationDomainInformer     configinformers.FederationDomainInformer
+	oidcIdentityProviderInformer idpinformers.OIDCIdentityProviderInformer
+	kubeClient                   kubernetes.Interface
+	clock                        clock.Clock
+	sweepInterval                time.Duration
+	batchSize                    int
+	timeOfMostRecentSweep        time.Time
 }
 
+// GarbageCollectorController deletes the Secrets of the session storage after they expire, and also deletes the
+// Secrets of sessions whose FederationDomain or upstream identity provider no longer exists. A sweep runs at most
+// once per sweepInterval and deletes at most batchSize Secrets. Any remaining Secrets are deleted by later sweeps.
+// The sessions of the SQL backend are deleted by the SQLGarbageCollector instead.
 func GarbageCollectorController(
 	clock clock.Clock,
 	kubeClient kubernetes.Interface,
 	secretInformer corev1informers.SecretInformer,
+	federationDomainInformer configinformers.FederationDomainInformer,
+	oidcIdentityProviderInformer idpinformers.OIDCIdentityProviderInformer,
+	sweepInterval time.Duration,
+	batchSize int,
 	withInformer pinnipedcontroller.WithInformerOptionFunc,
 ) controllerlib.Controller {
 	isSecretWithGCAnnotation := func(obj metav1.Object) bool {
@@ -42,13 +57,24 @@ func GarbageCollectorController(
 		_, ok = secret.Annotations[crud.SecretLifetimeAnnotationKey]
 		return ok
 	}
+	// Deleting a FederationDomain or an upstream identity provider may orphan some sessions.
+	onlyDeletes := controllerlib.FilterFuncs{
+		AddFunc:    func(obj metav1.Object) bool { return false },
+		UpdateFunc: func(oldObj, newObj metav1.Object) bool { return false },
+		DeleteFunc: func(obj metav1.Object) bool { return true },
+		ParentFunc: nil,
+	}
 	return controllerlib.New(
 		controllerlib.Config{
 			Name: "garbage-collector-controller",
 			Syncer: &garbageCollectorController{
-				secretInformer: secretInformer,
-				kubeClient:     kubeClient,
-				clock:          clock,
+				secretInformer:               secretInformer,
+				federationDomainInformer:     federationDomainInformer,
+				oidcIdentityProviderInformer: oidcIdentityProviderInformer,
+				kubeClient:                   kubeClient,
+				clock:                        clock,
+				sweepInterval:                sweepInterval,
+				batchSize:                    batchSize,
 			},
 		},
 		withInformer(
@@ -63,6 +89,16 @@ func GarbageCollectorController(
 			},
 			controllerlib.InformerOption{},
 		),
+		withInformer(
+			federationDomainInformer,
+			onlyDeletes,
+			controllerlib.InformerOption{},
+		),
+		withInformer(
+			oidcIdentityProviderInformer,
+			onlyDeletes,
+			controllerlib.InformerOption{},
+		),
 	)
 }
 
@@ -71,7 +107,7 @@ func (c *garbageCollectorController) Sync(ctx controllerlib.Context) error {
 	// controller too chatty, so it rate limits itself to a more reasonable interval.
 	// Note that even during a period when no secrets are changing, it will still run
 	// at the informer's full-resync interval (as long as there are some secrets).
-	if c.clock.Now().Sub(c.timeOfMostRecentSweep) < minimumRepeatInterval {
+	if c.clock.Now().Sub(c.timeOfMostRecentSweep) < c.sweepInterval {
 		return nil
 	}
 
@@ -83,6 +119,12 @@ func (c *garbageCollectorController) Sync(ctx controllerlib.Context) error {
 		return err
 	}
 
+	isOrphaned, err := c.orphanedSessionMatcher(listOfSecrets)
+	if err != nil {
+		return err
+	}
+
+	var expiredCount, orphanedCount, failedCount int
 	for i := range listOfSecrets {
 		secret := listOfSecrets[i]
 
@@ -97,19 +139,179 @@ func (c *garbageCollectorController) Sync(ctx controllerlib.Context) error {
 			continue
 		}
 
-		if garbageCollectAfterTime.Before(c.clock.Now()) {
-			err = c.kubeClient.CoreV1().Secrets(secret.Namespace).Delete(ctx.Context, secret.Name, metav1.DeleteOptions{})
-			if err != nil {
-				plog.WarningErr("failed to garbage collect resource", err, logKV(secret))
-				continue
-			}
+		expired := garbageCollectAfterTime.Before(c.clock.Now())
+		if !expired && !isOrphaned(secret) {
+			continue
+		}
+
+		if expiredCount+orphanedCount+failedCount >= c.batchSize {
+			plog.Info("storage garbage collection sweep reached its batch size, leaving the rest for the next sweep", "batchSize", c.batchSize)
+			break
+		}
+
+		err = c.kubeClient.CoreV1().Secrets(secret.Namespace).Delete(ctx.Context, secret.Name, metav1.DeleteOptions{})
+		if err != nil {
+			plog.WarningErr("failed to garbage collect resource", err, logKV(secret))
+			failedCount++
+			continue
+		}
+
+		if expired {
+			expiredCount++
 			plog.Info("storage garbage collector deleted resource", logKV(secret))
+		} else {
+			orphanedCount++
+			plog.Info("storage garbage collector deleted orphaned resource", logKV(secret))
 		}
 	}
 
+	plog.Info("finished storage garbage collection sweep",
+		"expiredDeleted", expiredCount,
+		"orphanedDeleted", orphanedCount,
+		"failedDeletes", failedCount,
+	)
+
 	return nil
 }
 
+// orphanedSessionMatcher returns a func which decides whether a session storage Secret belongs to a
+// FederationDomain or an upstream identity provider which no longer exists. Secrets which do not record
+// their FederationDomain or upstream identity provider are never considered to be orphaned. The Secrets
+// which hold additional parts of a large session are orphaned once the Secret holding its first part is gone.
+// Kubernetes also deletes them, because they are owned by that Secret, but this does not depend on it.
+func (c *garbageCollectorController) orphanedSessionMatcher(secrets []*v1.Secret) (func(secret *v1.Secret) bool, error) {
+	isOrphaned, err := orphanedLabelsMatcher(c.federationDomainInformer, c.oidcIdentityProviderInformer)
+	if err != nil {
+		return nil, err
+	}
+	knownSecrets := sets.NewString()
+	for _, secret := range secrets {
+		knownSecrets.Insert(secret.Namespace + "/" + crud.SecretPartOfLabelValue(secret.Name))
+	}
+
+	return func(secret *v1.Secret) bool {
+		if partOf, ok := secret.Labels[crud.SecretPartOfLabelKey]; ok && !knownSecrets.Has(secret.Namespace+"/"+partOf) {
+			return true
+		}
+		return isOrphaned(secret.Labels)
+	}, nil
+}
+
+// orphanedLabelsMatcher returns a func which decides whether session data with the given labels belongs to a
+// FederationDomain or an upstream identity provider which no longer exists.
+func orphanedLabelsMatcher(
+	federationDomainInformer configinformers.FederationDomainInformer,
+	oidcIdentityProviderInformer idpinformers.OIDCIdentityProviderInformer,
+) (func(sessionLabels map[string]string) bool, error) {
+	federationDomains, err := federationDomainInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	oidcIdentityProviders, err := oidcIdentityProviderInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	knownIssuers := sets.NewString()
+	for _, federationDomain := range federationDomains {
+		knownIssuers.Insert(fositestorage.IndexLabelValue(federationDomain.Spec.Issuer))
+		// The sessions which were started using an issuer alias are labeled with the alias.
+		for _, issuerAlias := range federationDomain.Spec.IssuerAliases {
+			knownIssuers.Insert(fositestorage.IndexLabelValue(issuerAlias))
+		}
+	}
+	knownUpstreamNames := sets.NewString()
+	for _, oidcIdentityProvider := range oidcIdentityProviders {
+		knownUpstreamNames.Insert(fositestorage.IndexLabelValue(oidcIdentityProvider.Name))
+	}
+	return func(sessionLabels map[string]string) bool {
+		if issuer, ok := sessionLabels[fositestorage.StorageFederationDomainLabelName]; ok && !knownIssuers.Has(issuer) {
+			return true
+		}
+		if upstreamName, ok := sessionLabels[fositestorage.StorageUpstreamNameLabelName]; ok && !knownUpstreamNames.Has(upstreamName) {
+			return true
+		}
+		return false
+	}, nil
+}
+
+// SQLGarbageCollector deletes the expired session data of the SQL session storage backend, and the session data
+// whose FederationDomain or upstream identity provider no longer exists, like the GarbageCollectorController does
+// for the session storage Secrets. The database cannot be watched, so Sweep must be called periodically. The
+// informers must be started and synced first.
+type SQLGarbageCollector struct {
+	backend                      *crud.SQLBackend
+	federationDomainInformer     configinformers.FederationDomainInformer
+	oidcIdentityProviderInformer idpinformers.OIDCIdentityProviderInformer
+	clock                        clock.Clock
+	batchSize                    int
+}
+
+// NewSQLGarbageCollector returns a SQLGarbageCollector whose sweeps delete at most batchSize orphaned sessions.
+// Expired sessions are deleted all at once, since the database can do that in one statement.
+func NewSQLGarbageCollector(
+	clock clock.Clock,
+	backend *crud.SQLBackend,
+	federationDomainInformer configinformers.FederationDomainInformer,
+	oidcIdentityProviderInformer idpinformers.OIDCIdentityProviderInformer,
+	batchSize int,
+) *SQLGarbageCollector {
+	return &SQLGarbageCollector{
+		backend:                      backend,
+		federationDomainInformer:     federationDomainInformer,
+		oidcIdentityProviderInformer: oidcIdentityProviderInformer,
+		clock:                        clock,
+		batchSize:                    batchSize,
+	}
+}
+
+// Sweep runs one sweep. Its errors are only logged, since the next sweep will try again.
+func (g *SQLGarbageCollector) Sweep(ctx context.Context) {
+	plog.Info("starting sql storage garbage collection sweep")
+
+	expiredCount, err := g.backend.DeleteExpired(ctx, g.clock.Now())
+	if err != nil {
+		plog.WarningErr("failed to delete expired sessions from sql storage", err)
+	}
+
+	isOrphaned, err := orphanedLabelsMatcher(g.federationDomainInformer, g.oidcIdentityProviderInformer)
+	if err != nil {
+		plog.WarningErr("failed to list the owners of the sessions in sql storage", err)
+		return
+	}
+	entries, err := g.backend.List(ctx, crud.Selector{})
+	if err != nil {
+		plog.WarningErr("failed to list the sessions in sql storage", err)
+		return
+	}
+
+	var orphanedCount, failedCount int
+	for _, entry := range entries {
+		if !isOrphaned(entry.Labels) {
+			continue
+		}
+
+		if orphanedCount+failedCount >= g.batchSize {
+			plog.Info("sql storage garbage collection sweep reached its batch size, leaving the rest for the next sweep", "batchSize", g.batchSize)
+			break
+		}
+
+		if err := g.backend.DeleteEntry(ctx, entry); err != nil {
+			plog.WarningErr("failed to garbage collect orphaned session", err, "resource", entry.Resource)
+			failedCount++
+			continue
+		}
+		orphanedCount++
+		plog.Info("storage garbage collector deleted orphaned session", "resource", entry.Resource)
+	}
+
+	plog.Info("finished sql storage garbage collection sweep",
+		"expiredDeleted", expiredCount,
+		"orphanedDeleted", orphanedCount,
+		"failedDeletes", failedCount,
+	)
+}
+
 func logKV(secret *v1.Secret) []interface{} {
 	return []interface{}{
 		"secretName", secret.Name,
@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package supervisorstorage
@@ -21,29 +21,47 @@ import (
 	kubernetesfake "k8s.io/client-go/kubernetes/fake"
 	kubetesting "k8s.io/client-go/testing"
 
+	configv1alpha1 "go.pinniped.dev/generated/1.20/apis/supervisor/config/v1alpha1"
+	idpv1alpha1 "go.pinniped.dev/generated/1.20/apis/supervisor/idp/v1alpha1"
+	pinnipedfake "go.pinniped.dev/generated/1.20/client/supervisor/clientset/versioned/fake"
+	pinnipedinformers "go.pinniped.dev/generated/1.20/client/supervisor/informers/externalversions"
 	"go.pinniped.dev/internal/controllerlib"
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/fositestorage"
 	"go.pinniped.dev/internal/testutil"
+	"go.pinniped.dev/internal/testutil/storagebackends"
 )
 
 func TestGarbageCollectorControllerInformerFilters(t *testing.T) {
 	spec.Run(t, "informer filters", func(t *testing.T, when spec.G, it spec.S) {
 		var (
-			r                            *require.Assertions
-			observableWithInformerOption *testutil.ObservableWithInformerOption
-			secretsInformerFilter        controllerlib.Filter
+			r                                  *require.Assertions
+			observableWithInformerOption       *testutil.ObservableWithInformerOption
+			secretsInformerFilter              controllerlib.Filter
+			federationDomainInformerFilter     controllerlib.Filter
+			oidcIdentityProviderInformerFilter controllerlib.Filter
 		)
 
 		it.Before(func() {
 			r = require.New(t)
 			observableWithInformerOption = testutil.NewObservableWithInformerOption()
 			secretsInformer := kubeinformers.NewSharedInformerFactory(nil, 0).Core().V1().Secrets()
+			pinnipedInformers := pinnipedinformers.NewSharedInformerFactory(nil, 0)
+			federationDomainInformer := pinnipedInformers.Config().V1alpha1().FederationDomains()
+			oidcIdentityProviderInformer := pinnipedInformers.IDP().V1alpha1().OIDCIdentityProviders()
 			_ = GarbageCollectorController(
 				clock.RealClock{},
 				nil,
 				secretsInformer,
+				federationDomainInformer,
+				oidcIdentityProviderInformer,
+				30*time.Second,
+				500,
 				observableWithInformerOption.WithInformer, // make it possible to observe the behavior of the Filters
 			)
 			secretsInformerFilter = observableWithInformerOption.GetFilterForInformer(secretsInformer)
+			federationDomainInformerFilter = observableWithInformerOption.GetFilterForInformer(federationDomainInformer)
+			oidcIdentityProviderInformerFilter = observableWithInformerOption.GetFilterForInformer(oidcIdentityProviderInformer)
 		})
 
 		when("watching Secret objects", func() {
@@ -92,6 +110,34 @@ func TestGarbageCollectorControllerInformerFilters(t *testing.T) {
 				})
 			})
 		})
+
+		when("watching FederationDomain and OIDCIdentityProvider objects", func() {
+			var (
+				federationDomain     *configv1alpha1.FederationDomain
+				oidcIdentityProvider *idpv1alpha1.OIDCIdentityProvider
+			)
+
+			it.Before(func() {
+				federationDomain = &configv1alpha1.FederationDomain{ObjectMeta: metav1.ObjectMeta{Name: "any-name", Namespace: "any-namespace"}}
+				oidcIdentityProvider = &idpv1alpha1.OIDCIdentityProvider{ObjectMeta: metav1.ObjectMeta{Name: "any-name", Namespace: "any-namespace"}}
+			})
+
+			when("any of them is deleted", func() {
+				it("returns true to trigger the sync function, because their sessions may have been orphaned", func() {
+					r.True(federationDomainInformerFilter.Delete(federationDomain))
+					r.True(oidcIdentityProviderInformerFilter.Delete(oidcIdentityProvider))
+				})
+			})
+
+			when("any of them is added or updated", func() {
+				it("returns false to skip the sync function", func() {
+					r.False(federationDomainInformerFilter.Add(federationDomain))
+					r.False(federationDomainInformerFilter.Update(federationDomain, federationDomain))
+					r.False(oidcIdentityProviderInformerFilter.Add(oidcIdentityProvider))
+					r.False(oidcIdentityProviderInformerFilter.Update(oidcIdentityProvider, oidcIdentityProvider))
+				})
+			})
+		})
 	}, spec.Parallel(), spec.Report(report.Terminal{}))
 }
 
@@ -108,16 +154,19 @@ func TestGarbageCollectorControllerSync(t *testing.T) {
 		)
 
 		var (
-			r                    *require.Assertions
-			subject              controllerlib.Controller
-			kubeInformerClient   *kubernetesfake.Clientset
-			kubeClient           *kubernetesfake.Clientset
-			kubeInformers        kubeinformers.SharedInformerFactory
-			timeoutContext       context.Context
-			timeoutContextCancel context.CancelFunc
-			syncContext          *controllerlib.Context
-			fakeClock            *clock.FakeClock
-			frozenNow            time.Time
+			r                      *require.Assertions
+			subject                controllerlib.Controller
+			kubeInformerClient     *kubernetesfake.Clientset
+			kubeClient             *kubernetesfake.Clientset
+			kubeInformers          kubeinformers.SharedInformerFactory
+			pinnipedInformerClient *pinnipedfake.Clientset
+			pinnipedInformers      pinnipedinformers.SharedInformerFactory
+			batchSize              int
+			timeoutContext         context.Context
+			timeoutContextCancel   context.CancelFunc
+			syncContext            *controllerlib.Context
+			fakeClock              *clock.FakeClock
+			frozenNow              time.Time
 		)
 
 		// Defer starting the informers until the last possible moment so that the
@@ -128,6 +177,10 @@ func TestGarbageCollectorControllerSync(t *testing.T) {
 				fakeClock,
 				kubeClient,
 				kubeInformers.Core().V1().Secrets(),
+				pinnipedInformers.Config().V1alpha1().FederationDomains(),
+				pinnipedInformers.IDP().V1alpha1().OIDCIdentityProviders(),
+				30*time.Second,
+				batchSize,
 				controllerlib.WithInformer,
 			)
 
@@ -143,6 +196,7 @@ func TestGarbageCollectorControllerSync(t *testing.T) {
 
 			// Must start informers before calling TestRunSynchronously()
 			kubeInformers.Start(timeoutContext.Done())
+			pinnipedInformers.Start(timeoutContext.Done())
 			controllerlib.TestRunSynchronously(t, subject)
 		}
 
@@ -154,6 +208,9 @@ func TestGarbageCollectorControllerSync(t *testing.T) {
 			kubeInformerClient = kubernetesfake.NewSimpleClientset()
 			kubeClient = kubernetesfake.NewSimpleClientset()
 			kubeInformers = kubeinformers.NewSharedInformerFactory(kubeInformerClient, 0)
+			pinnipedInformerClient = pinnipedfake.NewSimpleClientset()
+			pinnipedInformers = pinnipedinformers.NewSharedInformerFactory(pinnipedInformerClient, 0)
+			batchSize = 500
 			frozenNow = time.Now().UTC()
 			fakeClock = clock.NewFakeClock(frozenNow)
 
@@ -379,5 +436,205 @@ func TestGarbageCollectorControllerSync(t *testing.T) {
 				r.ElementsMatch([]string{"erroring secret", "some other unrelated secret"}, []string{list.Items[0].Name, list.Items[1].Name})
 			})
 		})
+
+		when("there are sessions whose FederationDomain or upstream identity provider was deleted", func() {
+			it.Before(func() {
+				r.NoError(pinnipedInformerClient.Tracker().Add(&configv1alpha1.FederationDomain{
+					ObjectMeta: metav1.ObjectMeta{Name: "existing-federation-domain", Namespace: installedInNamespace},
+					Spec: configv1alpha1.FederationDomainSpec{
+						Issuer:        "https://existing-issuer.com",
+						IssuerAliases: []string{"https://existing-issuer-alias.com"},
+					},
+				}))
+				r.NoError(pinnipedInformerClient.Tracker().Add(&idpv1alpha1.OIDCIdentityProvider{
+					ObjectMeta: metav1.ObjectMeta{Name: "existing-upstream", Namespace: installedInNamespace},
+				}))
+
+				unexpired := frozenNow.Add(time.Hour).Format(time.RFC3339)
+				for name, sessionLabels := range map[string]map[string]string{
+					"session of existing federation domain and upstream": {
+						"storage.pinniped.dev/federation-domain": fositestorage.IndexLabelValue("https://existing-issuer.com"),
+						"storage.pinniped.dev/upstream-name":     fositestorage.IndexLabelValue("existing-upstream"),
+					},
+					"session of existing federation domain alias": {
+						"storage.pinniped.dev/federation-domain": fositestorage.IndexLabelValue("https://existing-issuer-alias.com"),
+						"storage.pinniped.dev/upstream-name":     fositestorage.IndexLabelValue("existing-upstream"),
+					},
+					"session of deleted federation domain": {
+						"storage.pinniped.dev/federation-domain": fositestorage.IndexLabelValue("https://deleted-issuer.com"),
+						"storage.pinniped.dev/upstream-name":     fositestorage.IndexLabelValue("existing-upstream"),
+					},
+					"session of deleted upstream": {
+						"storage.pinniped.dev/federation-domain": fositestorage.IndexLabelValue("https://existing-issuer.com"),
+						"storage.pinniped.dev/upstream-name":     fositestorage.IndexLabelValue("deleted-upstream"),
+					},
+					"session which does not record its federation domain or upstream": {},
+					"part of existing session": {
+						"storage.pinniped.dev/part-of": crud.SecretPartOfLabelValue("session of existing federation domain and upstream"),
+					},
+					"part of deleted session": {
+						"storage.pinniped.dev/part-of": crud.SecretPartOfLabelValue("deleted session"),
+					},
+				} {
+					secret := &corev1.Secret{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      name,
+							Namespace: installedInNamespace,
+							Labels:    sessionLabels,
+							Annotations: map[string]string{
+								"storage.pinniped.dev/garbage-collect-after": unexpired,
+							},
+						},
+					}
+					r.NoError(kubeInformerClient.Tracker().Add(secret))
+					r.NoError(kubeClient.Tracker().Add(secret))
+				}
+			})
+
+			it("deletes the orphaned sessions before they expire", func() {
+				startInformersAndController()
+				r.NoError(controllerlib.TestSync(t, subject, *syncContext))
+
+				r.ElementsMatch(
+					[]kubetesting.Action{
+						kubetesting.NewDeleteAction(secretsGVR, installedInNamespace, "session of deleted federation domain"),
+						kubetesting.NewDeleteAction(secretsGVR, installedInNamespace, "session of deleted upstream"),
+						kubetesting.NewDeleteAction(secretsGVR, installedInNamespace, "part of deleted session"),
+					},
+					kubeClient.Actions(),
+				)
+				list, err := kubeClient.CoreV1().Secrets(installedInNamespace).List(context.Background(), metav1.ListOptions{})
+				r.NoError(err)
+				r.Len(list.Items, 5)
+				r.ElementsMatch(
+					[]string{"session of existing federation domain and upstream", "session of existing federation domain alias", "session which does not record its federation domain or upstream", "part of existing session", "some other unrelated secret"},
+					[]string{list.Items[0].Name, list.Items[1].Name, list.Items[2].Name, list.Items[3].Name, list.Items[4].Name},
+				)
+			})
+		})
+
+		when("there are more secrets to delete than the batch size", func() {
+			it.Before(func() {
+				batchSize = 2
+				for _, name := range []string{"expired secret 1", "expired secret 2", "expired secret 3"} {
+					expiredSecret := &corev1.Secret{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      name,
+							Namespace: installedInNamespace,
+							Annotations: map[string]string{
+								"storage.pinniped.dev/garbage-collect-after": frozenNow.Add(-time.Second).Format(time.RFC3339),
+							},
+						},
+					}
+					r.NoError(kubeInformerClient.Tracker().Add(expiredSecret))
+					r.NoError(kubeClient.Tracker().Add(expiredSecret))
+				}
+			})
+
+			it("deletes only one batch per sweep and leaves the rest for the next sweep", func() {
+				startInformersAndController()
+				r.NoError(controllerlib.TestSync(t, subject, *syncContext))
+				r.Len(kubeClient.Actions(), 2)
+
+				// The next sweep deletes the remaining secret. The informer cache has not observed the
+				// deletions of the fake client, so the first batch is deleted again, which is harmless.
+				fakeClock.Step(30*time.Second + time.Millisecond)
+				r.NoError(controllerlib.TestSync(t, subject, *syncContext))
+				r.Len(kubeClient.Actions(), 4)
+			})
+		})
 	}, spec.Parallel(), spec.Report(report.Terminal{}))
 }
+
+func TestSQLGarbageCollector(t *testing.T) {
+	const installedInNamespace = "some-namespace"
+
+	frozenNow := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	setup := func(t *testing.T, batchSize int) (*crud.SQLBackend, *SQLGarbageCollector) {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		pinnipedInformerClient := pinnipedfake.NewSimpleClientset()
+		require.NoError(t, pinnipedInformerClient.Tracker().Add(&configv1alpha1.FederationDomain{
+			ObjectMeta: metav1.ObjectMeta{Name: "existing-federation-domain", Namespace: installedInNamespace},
+			Spec:       configv1alpha1.FederationDomainSpec{Issuer: "https://existing-issuer.com"},
+		}))
+		require.NoError(t, pinnipedInformerClient.Tracker().Add(&idpv1alpha1.OIDCIdentityProvider{
+			ObjectMeta: metav1.ObjectMeta{Name: "existing-upstream", Namespace: installedInNamespace},
+		}))
+		pinnipedInformers := pinnipedinformers.NewSharedInformerFactory(pinnipedInformerClient, 0)
+		federationDomainInformer := pinnipedInformers.Config().V1alpha1().FederationDomains()
+		oidcIdentityProviderInformer := pinnipedInformers.IDP().V1alpha1().OIDCIdentityProviders()
+		// Request the informers before starting them, so that they are started.
+		federationDomainInformer.Informer()
+		oidcIdentityProviderInformer.Informer()
+		pinnipedInformers.Start(ctx.Done())
+		pinnipedInformers.WaitForCacheSync(ctx.Done())
+
+		backend := storagebackends.NewSQL(t)
+		return backend, NewSQLGarbageCollector(clock.NewFakeClock(frozenNow), backend, federationDomainInformer, oidcIdentityProviderInformer, batchSize)
+	}
+
+	create := func(t *testing.T, backend crud.Backend, signature string, createdAt time.Time, sessionLabels map[string]string) {
+		t.Helper()
+		storage := backend.Storage("some-resource", func() time.Time { return createdAt }, time.Hour)
+		_, err := storage.Create(context.Background(), signature, map[string]string{"some": "data"}, sessionLabels)
+		require.NoError(t, err)
+	}
+
+	remaining := func(t *testing.T, backend crud.Backend) []string {
+		t.Helper()
+		entries, err := backend.List(context.Background(), crud.Selector{})
+		require.NoError(t, err)
+		var signatures []string
+		for _, entry := range entries {
+			signatures = append(signatures, entry.Name)
+		}
+		return signatures
+	}
+
+	t.Run("deletes the expired and the orphaned sessions", func(t *testing.T) {
+		backend, subject := setup(t, 500)
+
+		existing := map[string]string{
+			"storage.pinniped.dev/federation-domain": fositestorage.IndexLabelValue("https://existing-issuer.com"),
+			"storage.pinniped.dev/upstream-name":     fositestorage.IndexLabelValue("existing-upstream"),
+		}
+		create(t, backend, "expired-session", frozenNow.Add(-2*time.Hour), existing)
+		create(t, backend, "session-of-existing-federation-domain-and-upstream", frozenNow, existing)
+		create(t, backend, "session-which-does-not-record-its-federation-domain-or-upstream", frozenNow, nil)
+		create(t, backend, "session-of-deleted-federation-domain", frozenNow, map[string]string{
+			"storage.pinniped.dev/federation-domain": fositestorage.IndexLabelValue("https://deleted-issuer.com"),
+			"storage.pinniped.dev/upstream-name":     fositestorage.IndexLabelValue("existing-upstream"),
+		})
+		create(t, backend, "session-of-deleted-upstream", frozenNow, map[string]string{
+			"storage.pinniped.dev/federation-domain": fositestorage.IndexLabelValue("https://existing-issuer.com"),
+			"storage.pinniped.dev/upstream-name":     fositestorage.IndexLabelValue("deleted-upstream"),
+		})
+
+		subject.Sweep(context.Background())
+
+		require.ElementsMatch(t, []string{
+			"session-of-existing-federation-domain-and-upstream",
+			"session-which-does-not-record-its-federation-domain-or-upstream",
+		}, remaining(t, backend))
+	})
+
+	t.Run("deletes only one batch of orphaned sessions per sweep", func(t *testing.T) {
+		backend, subject := setup(t, 2)
+
+		orphaned := map[string]string{
+			"storage.pinniped.dev/federation-domain": fositestorage.IndexLabelValue("https://deleted-issuer.com"),
+		}
+		create(t, backend, "orphaned-session-1", frozenNow, orphaned)
+		create(t, backend, "orphaned-session-2", frozenNow, orphaned)
+		create(t, backend, "orphaned-session-3", frozenNow, orphaned)
+
+		subject.Sweep(context.Background())
+		require.Len(t, remaining(t, backend), 1)
+
+		subject.Sweep(context.Background())
+		require.Empty(t, remaining(t, backend))
+	})
+}
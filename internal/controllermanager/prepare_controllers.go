@@ -8,22 +8,26 @@ package controllermanager
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"time"
 
 	"k8s.io/apimachinery/pkg/util/clock"
 	k8sinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/klog/v2/klogr"
 
 	loginv1alpha1 "go.pinniped.dev/generated/1.20/apis/concierge/login/v1alpha1"
 	pinnipedclientset "go.pinniped.dev/generated/1.20/client/concierge/clientset/versioned"
 	pinnipedinformers "go.pinniped.dev/generated/1.20/client/concierge/informers/externalversions"
+	"go.pinniped.dev/internal/concierge/impersonator"
 	"go.pinniped.dev/internal/config/concierge"
 	"go.pinniped.dev/internal/controller/apicerts"
 	"go.pinniped.dev/internal/controller/authenticator/authncache"
 	"go.pinniped.dev/internal/controller/authenticator/cachecleaner"
 	"go.pinniped.dev/internal/controller/authenticator/jwtcachefiller"
 	"go.pinniped.dev/internal/controller/authenticator/webhookcachefiller"
+	"go.pinniped.dev/internal/controller/impersonatorconfig"
 	"go.pinniped.dev/internal/controller/issuerconfig"
 	"go.pinniped.dev/internal/controller/kubecertagent"
 	"go.pinniped.dev/internal/controllerlib"
@@ -57,6 +61,10 @@ type Config struct {
 	// the kubecertagent package's controllers should manage the agent pods.
 	KubeCertAgentConfig *concierge.KubeCertAgentSpec
 
+	// ImpersonationProxyConfig comes from the Pinniped config API (see api.Config). It configures when
+	// and how the impersonation proxy runs.
+	ImpersonationProxyConfig *concierge.ImpersonationProxySpec
+
 	// DiscoveryURLOverride allows a caller to inject a hardcoded discovery URL into Pinniped
 	// discovery document.
 	DiscoveryURLOverride *string
@@ -66,6 +74,9 @@ type Config struct {
 	// DynamicSigningCertProvider provides a setter and a getter to the Pinniped API's
 	// signing cert, i.e., the cert that it uses to sign certs for Pinniped clients wishing to login.
 	DynamicSigningCertProvider dynamiccert.Provider
+	// ImpersonationSigningCertProvider provides a setter and a getter to the CA which issues the client
+	// certs that the impersonation proxy accepts. It is empty while the impersonation proxy is not running.
+	ImpersonationSigningCertProvider dynamiccert.Provider
 
 	// ServingCertDuration is the validity period, in seconds, of the API serving certificate.
 	ServingCertDuration time.Duration
@@ -84,7 +95,7 @@ type Config struct {
 // Prepare the controllers and their informers and return a function that will start them when called.
 //nolint:funlen // Eh, fair, it is a really long function...but it is wiring the world...so...
 func PrepareControllers(c *Config) (func(ctx context.Context), error) {
-	dref, _, err := deploymentref.New(c.ServerInstallationInfo)
+	dref, deployment, err := deploymentref.New(c.ServerInstallationInfo)
 	if err != nil {
 		return nil, fmt.Errorf("cannot create deployment ref: %w", err)
 	}
@@ -245,6 +256,7 @@ func PrepareControllers(c *Config) (func(ctx context.Context), error) {
 		WithController(
 			webhookcachefiller.New(
 				c.AuthenticatorCache,
+				client.PinnipedConcierge,
 				informers.installationNamespacePinniped.Authentication().V1alpha1().WebhookAuthenticators(),
 				klogr.New(),
 			),
@@ -253,6 +265,7 @@ func PrepareControllers(c *Config) (func(ctx context.Context), error) {
 		WithController(
 			jwtcachefiller.New(
 				c.AuthenticatorCache,
+				client.PinnipedConcierge,
 				informers.installationNamespacePinniped.Authentication().V1alpha1().JWTAuthenticators(),
 				klogr.New(),
 			),
@@ -266,6 +279,45 @@ func PrepareControllers(c *Config) (func(ctx context.Context), error) {
 				klogr.New(),
 			),
 			singletonWorker,
+		).
+
+		// The impersonation proxy controller is responsible for running the impersonation proxy when the
+		// kube-cert-agent cannot work on this cluster, and for reporting status on this integration strategy.
+		WithController(
+			impersonatorconfig.NewImpersonatorConfigController(
+				c.ServerInstallationInfo.Namespace,
+				c.NamesConfig.CredentialIssuer,
+				c.Labels,
+				c.ImpersonationProxyConfig.Mode,
+				c.ImpersonationProxyConfig.ExternalEndpoint,
+				c.NamesConfig.ImpersonationLoadBalancerService,
+				deployment.Spec.Selector.MatchLabels,
+				c.NamesConfig.ImpersonationTLSCertificateSecret,
+				c.NamesConfig.ImpersonationSignerSecret,
+				fmt.Sprintf(":%d", impersonatorconfig.ListenPort),
+				client.Kubernetes,
+				client.PinnipedConcierge,
+				informers.clusterScopedK8s.Core().V1().Nodes(),
+				informers.installationNamespaceK8s.Core().V1().Services(),
+				informers.installationNamespaceK8s.Core().V1().Secrets(),
+				controllerlib.WithInformer,
+				controllerlib.WithInitialEvent,
+				c.ImpersonationSigningCertProvider,
+				func() (http.Handler, error) {
+					restConfig, err := rest.InClusterConfig()
+					if err != nil {
+						return nil, fmt.Errorf("could not load in-cluster config: %w", err)
+					}
+					return impersonator.New(
+						c.AuthenticatorCache,
+						c.ImpersonationSigningCertProvider,
+						c.ServerInstallationInfo.Namespace,
+						restConfig,
+					)
+				},
+				clock.RealClock{},
+			),
+			singletonWorker,
 		)
 
 	// Return a function which starts the informers and controllers.
@@ -276,6 +328,7 @@ func PrepareControllers(c *Config) (func(ctx context.Context), error) {
 }
 
 type informers struct {
+	clusterScopedK8s              k8sinformers.SharedInformerFactory
 	kubePublicNamespaceK8s        k8sinformers.SharedInformerFactory
 	kubeSystemNamespaceK8s        k8sinformers.SharedInformerFactory
 	installationNamespaceK8s      k8sinformers.SharedInformerFactory
@@ -289,6 +342,7 @@ func createInformers(
 	pinnipedClient pinnipedclientset.Interface,
 ) *informers {
 	return &informers{
+		clusterScopedK8s: k8sinformers.NewSharedInformerFactory(k8sClient, defaultResyncInterval),
 		kubePublicNamespaceK8s: k8sinformers.NewSharedInformerFactoryWithOptions(
 			k8sClient,
 			defaultResyncInterval,
@@ -313,11 +367,13 @@ func createInformers(
 }
 
 func (i *informers) startAndWaitForSync(ctx context.Context) {
+	i.clusterScopedK8s.Start(ctx.Done())
 	i.kubePublicNamespaceK8s.Start(ctx.Done())
 	i.kubeSystemNamespaceK8s.Start(ctx.Done())
 	i.installationNamespaceK8s.Start(ctx.Done())
 	i.installationNamespacePinniped.Start(ctx.Done())
 
+	i.clusterScopedK8s.WaitForCacheSync(ctx.Done())
 	i.kubePublicNamespaceK8s.WaitForCacheSync(ctx.Done())
 	i.kubeSystemNamespaceK8s.WaitForCacheSync(ctx.Done())
 	i.installationNamespaceK8s.WaitForCacheSync(ctx.Done())
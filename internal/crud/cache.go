@@ -0,0 +1,60 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package crud
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+)
+
+// NewCachedSecretInterface returns a SecretInterface which serves Get requests for the Secrets of the given resources
+// from the informer cache behind lister, and which passes all other requests, including all writes, to secrets. The
+// informer only needs to watch the Secrets which have the SecretLabelKey label.
+//
+// A Secret which is not in the cache, for example because it was created so recently that the informer has not
+// observed it yet, is read from the API server instead. A Secret which is in the cache may be briefly out of date,
+// but this cannot cause lost updates, because Update requests include the resource version which was read, and the
+// API server rejects them when another writer got there first. It can however return data which was already deleted
+// or revoked, so the resources whose deletion or revocation must take effect right away must either not be cached,
+// like authorization codes, or be confirmed by an Update at the resource version which was read, like refresh tokens
+// during their rotation.
+func NewCachedSecretInterface(secrets corev1client.SecretInterface, lister corev1listers.SecretNamespaceLister, cachedResources []string) corev1client.SecretInterface {
+	namePrefixes := make([]string, 0, len(cachedResources))
+	for _, resource := range cachedResources {
+		namePrefixes = append(namePrefixes, fmt.Sprintf(secretNameFormat, resource, ""))
+	}
+	return &cachedSecrets{SecretInterface: secrets, lister: lister, namePrefixes: namePrefixes}
+}
+
+type cachedSecrets struct {
+	corev1client.SecretInterface
+	lister       corev1listers.SecretNamespaceLister
+	namePrefixes []string // of the Secrets of the cached resources, including the Secrets which hold their parts
+}
+
+func (c *cachedSecrets) Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.Secret, error) {
+	// A request for a specific resource version cannot be served from the cache.
+	if opts.ResourceVersion == "" && c.isCached(name) {
+		if secret, err := c.lister.Get(name); err == nil {
+			// The objects in the cache are shared, so never hand them out directly.
+			return secret.DeepCopy(), nil
+		}
+	}
+	return c.SecretInterface.Get(ctx, name, opts)
+}
+
+func (c *cachedSecrets) isCached(name string) bool {
+	for _, prefix := range c.namePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
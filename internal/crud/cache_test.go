@@ -0,0 +1,231 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package crud
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	coretesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+
+	"go.pinniped.dev/internal/testutil"
+)
+
+const cacheTestNamespace = "some-namespace"
+
+func TestCachedSecretInterface(t *testing.T) {
+	ctx := context.Background()
+	secretsGVR := corev1.SchemeGroupVersion.WithResource("secrets")
+
+	const (
+		cachedName            = "pinniped-storage-cached-resource-some-signature"
+		uncachedName          = "pinniped-storage-cached-resource-some-other-signature"
+		uncachedResourceName  = "pinniped-storage-uncached-resource-some-signature"
+		cachedPartName        = "pinniped-storage-cached-resource-some-signature-g1-part-1"
+		missingName           = "pinniped-storage-cached-resource-missing"
+		cachedResource        = "cached-resource"
+		staleResourceVersion  = "1"
+		latestResourceVersion = "2"
+	)
+	newSecret := func(name, resourceVersion string) *corev1.Secret {
+		return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: cacheTestNamespace, ResourceVersion: resourceVersion}}
+	}
+	newClient := func(t *testing.T) (*fake.Clientset, corev1client.SecretInterface) {
+		client := fake.NewSimpleClientset(
+			newSecret(cachedName, latestResourceVersion),
+			newSecret(uncachedName, latestResourceVersion),
+			newSecret(uncachedResourceName, latestResourceVersion),
+			newSecret(cachedPartName, latestResourceVersion),
+		)
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		require.NoError(t, indexer.Add(newSecret(cachedName, staleResourceVersion)))
+		require.NoError(t, indexer.Add(newSecret(uncachedResourceName, staleResourceVersion)))
+		require.NoError(t, indexer.Add(newSecret(cachedPartName, staleResourceVersion)))
+		lister := corev1listers.NewSecretLister(indexer).Secrets(cacheTestNamespace)
+		return client, NewCachedSecretInterface(client.CoreV1().Secrets(cacheTestNamespace), lister, []string{cachedResource})
+	}
+
+	t.Run("a cached secret of a cached resource is read from the cache", func(t *testing.T) {
+		client, subject := newClient(t)
+
+		secret, err := subject.Get(ctx, cachedName, metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, newSecret(cachedName, staleResourceVersion), secret)
+		secret, err = subject.Get(ctx, cachedPartName, metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, newSecret(cachedPartName, staleResourceVersion), secret)
+		require.Empty(t, client.Actions())
+
+		// The caller gets a copy, so changing it does not change the cache.
+		secret.Labels = map[string]string{"some-label": "some-value"}
+		secret, err = subject.Get(ctx, cachedPartName, metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Nil(t, secret.Labels)
+	})
+
+	t.Run("a secret which is not in the cache is read from the API server", func(t *testing.T) {
+		client, subject := newClient(t)
+
+		secret, err := subject.Get(ctx, uncachedName, metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, newSecret(uncachedName, latestResourceVersion), secret)
+		require.Equal(t, []coretesting.Action{
+			coretesting.NewGetAction(secretsGVR, cacheTestNamespace, uncachedName),
+		}, client.Actions())
+
+		_, err = subject.Get(ctx, missingName, metav1.GetOptions{})
+		require.True(t, apierrors.IsNotFound(err))
+		require.Len(t, client.Actions(), 2)
+	})
+
+	t.Run("a secret of a resource which is not cached is always read from the API server", func(t *testing.T) {
+		client, subject := newClient(t)
+
+		secret, err := subject.Get(ctx, uncachedResourceName, metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, newSecret(uncachedResourceName, latestResourceVersion), secret)
+		require.Equal(t, []coretesting.Action{
+			coretesting.NewGetAction(secretsGVR, cacheTestNamespace, uncachedResourceName),
+		}, client.Actions())
+	})
+
+	t.Run("a request for a specific resource version is sent to the API server", func(t *testing.T) {
+		client, subject := newClient(t)
+
+		_, err := subject.Get(ctx, cachedName, metav1.GetOptions{ResourceVersion: latestResourceVersion})
+		require.NoError(t, err)
+		require.Equal(t, []coretesting.Action{
+			coretesting.NewGetAction(secretsGVR, cacheTestNamespace, cachedName),
+		}, client.Actions())
+	})
+
+	t.Run("writes are sent to the API server", func(t *testing.T) {
+		client, subject := newClient(t)
+
+		_, err := subject.Update(ctx, newSecret(cachedName, latestResourceVersion), metav1.UpdateOptions{})
+		require.NoError(t, err)
+		require.NoError(t, subject.Delete(ctx, cachedName, metav1.DeleteOptions{}))
+		require.Equal(t, []coretesting.Action{
+			coretesting.NewUpdateAction(secretsGVR, cacheTestNamespace, newSecret(cachedName, latestResourceVersion)),
+			coretesting.NewDeleteAction(secretsGVR, cacheTestNamespace, cachedName),
+		}, client.Actions())
+	})
+}
+
+func TestCachedStorageWithConcurrentReplicas(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type testJSON struct {
+		Data string
+	}
+
+	// The fake clientset does not implement resource versions, so use one which is taught the optimistic concurrency of
+	// a real API server.
+	client := testutil.NewFakeClientsetWithSecretResourceVersions(cacheTestNamespace)
+
+	// Each replica has its own informer, so each one observes the writes of the other replica at its own pace. The
+	// informer of a replica stops watching when stop is closed, after which its cache stays out of date.
+	newReplica := func(stop <-chan struct{}) (corev1client.SecretInterface, corev1listers.SecretNamespaceLister) {
+		informers := kubeinformers.NewSharedInformerFactoryWithOptions(client, 0,
+			kubeinformers.WithNamespace(cacheTestNamespace),
+			kubeinformers.WithTweakListOptions(func(opts *metav1.ListOptions) { opts.LabelSelector = SecretLabelKey }),
+		)
+		lister := informers.Core().V1().Secrets().Lister().Secrets(cacheTestNamespace)
+		informers.Start(stop)
+		informers.WaitForCacheSync(stop)
+		return NewCachedSecretInterface(client.CoreV1().Secrets(cacheTestNamespace), lister, []string{"cached-resource"}), lister
+	}
+	secrets1, lister1 := newReplica(ctx.Done())
+	secrets2, lister2 := newReplica(ctx.Done())
+
+	requireEventuallyCached := func(lister corev1listers.SecretNamespaceLister, name string, resourceVersion string) {
+		require.Eventually(t, func() bool {
+			secret, err := lister.Get(name)
+			return err == nil && secret.ResourceVersion == resourceVersion
+		}, 10*time.Second, 10*time.Millisecond)
+	}
+
+	t.Run("updates of cached resources are protected by resource versions", func(t *testing.T) {
+		replica1 := New("cached-resource", secrets1, time.Now, time.Hour)
+		replica2 := New("cached-resource", secrets2, time.Now, time.Hour)
+
+		// A session which was just created by one replica can be read by the other replica right away, even when the
+		// other replica's informer has not observed it yet.
+		rv1, err := replica1.Create(ctx, "some-signature", &testJSON{Data: "first"}, nil)
+		require.NoError(t, err)
+		var got testJSON
+		rv, err := replica2.Get(ctx, "some-signature", &got)
+		require.NoError(t, err)
+		require.Equal(t, rv1, rv)
+		require.Equal(t, "first", got.Data)
+
+		name := replica1.(*secretsStorage).getName("some-signature")
+		requireEventuallyCached(lister1, name, rv1)
+		requireEventuallyCached(lister2, name, rv1)
+
+		// Both replicas read the session at the same resource version, and both try to update it. Only the first
+		// update wins, no matter whether the second replica's cache has observed the first update yet.
+		rvSeenBy1, err := replica1.Get(ctx, "some-signature", &got)
+		require.NoError(t, err)
+		rvSeenBy2, err := replica2.Get(ctx, "some-signature", &got)
+		require.NoError(t, err)
+		require.Equal(t, rvSeenBy1, rvSeenBy2)
+
+		rv2, err := replica1.Update(ctx, "some-signature", rvSeenBy1, &testJSON{Data: "second"})
+		require.NoError(t, err)
+		_, err = replica2.Update(ctx, "some-signature", rvSeenBy2, &testJSON{Data: "conflicting"})
+		require.Error(t, err)
+		require.True(t, apierrors.IsConflict(err), "expected a conflict error, got %v", err)
+
+		// Once the informer has observed the update, the other replica reads the new data and can update it.
+		requireEventuallyCached(lister2, name, rv2)
+		rv, err = replica2.Get(ctx, "some-signature", &got)
+		require.NoError(t, err)
+		require.Equal(t, rv2, rv)
+		require.Equal(t, "second", got.Data)
+		_, err = replica2.Update(ctx, "some-signature", rv, &testJSON{Data: "third"})
+		require.NoError(t, err)
+	})
+
+	t.Run("revoking or deleting a resource which is not cached takes effect on the other replica right away", func(t *testing.T) {
+		replica1 := New("uncached-resource", secrets1, time.Now, time.Hour)
+
+		rv1, err := replica1.Create(ctx, "some-token", &testJSON{Data: "token"}, map[string]string{"some-label": "some-value"})
+		require.NoError(t, err)
+		name := replica1.(*secretsStorage).getName("some-token")
+
+		// The informer of the other replica observes the new session, and then falls behind.
+		staleCtx, stopStaleInformer := context.WithCancel(ctx)
+		staleSecrets, staleLister := newReplica(staleCtx.Done())
+		requireEventuallyCached(staleLister, name, rv1)
+		stopStaleInformer()
+		replica2 := New("uncached-resource", staleSecrets, time.Now, time.Hour)
+
+		require.NoError(t, replica1.RevokeByLabel(ctx, "some-label", "some-value"))
+		var got testJSON
+		_, err = replica2.Get(ctx, "some-token", &got)
+		require.True(t, errors.Is(err, ErrSecretRevoked), "expected a revoked error, got %v", err)
+
+		require.NoError(t, replica1.Delete(ctx, "some-token"))
+		_, err = replica2.Get(ctx, "some-token", &got)
+		require.True(t, apierrors.IsNotFound(err), "expected a not found error, got %v", err)
+
+		// The cache of the other replica still has the session, which would have been returned if it were cached.
+		cached, err := staleLister.Get(name)
+		require.NoError(t, err)
+		require.Equal(t, rv1, cached.ResourceVersion)
+	})
+}
@@ -1,21 +1,30 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package crud
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"encoding/base32"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
 	"strings"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 
 	"go.pinniped.dev/internal/constable"
@@ -28,27 +37,188 @@ const (
 	SecretLifetimeAnnotationKey        = "storage.pinniped.dev/garbage-collect-after"
 	SecretLifetimeAnnotationDateFormat = time.RFC3339
 
-	secretNameFormat = "pinniped-storage-%s-%s"
-	secretTypeFormat = "storage.pinniped.dev/%s"
-	secretVersion    = "1"
-	secretDataKey    = "pinniped-storage-data"
-	secretVersionKey = "pinniped-storage-version"
+	SecretDataKey = "pinniped-storage-data"
 
-	ErrSecretTypeMismatch    = constable.Error("secret storage data has incorrect type")
-	ErrSecretLabelMismatch   = constable.Error("secret storage data has incorrect label")
-	ErrSecretVersionMismatch = constable.Error("secret storage data has incorrect version")
+	// SecretRevokedLabelKey marks secrets which were revoked by RevokeByLabel.
+	SecretRevokedLabelKey   = "storage.pinniped.dev/revoked"
+	secretRevokedLabelValue = "true"
+
+	// SecretPartOfLabelKey labels the Secrets which hold the additional parts of data which was too large to be
+	// stored in one Secret. Its value is SecretPartOfLabelValue of the name of the Secret which holds the first part,
+	// which also owns them. They also have the SecretLabelKey label of the first part, so that they are watched
+	// together with it.
+	SecretPartOfLabelKey = "storage.pinniped.dev/part-of"
+
+	secretNameFormat     = "pinniped-storage-%s-%s"
+	secretPartNameFormat = "%s-g%d-part-%d" // name of the first part, generation, index of the part
+	secretTypeFormat     = "storage.pinniped.dev/%s"
+	secretVersion        = "1"
+	secretVersionKey     = "pinniped-storage-version"
+
+	// These keys are only present when the data was compressed or split into parts, so that small data is stored
+	// exactly like it was before large data was supported.
+	secretEncodingKey   = "pinniped-storage-encoding"
+	secretPartsKey      = "pinniped-storage-parts"
+	secretGenerationKey = "pinniped-storage-parts-generation"
+	secretChecksumKey   = "pinniped-storage-checksum"
+	secretEncodingGzip  = "gzip"
+
+	// A Secret can hold at most 1 MiB, which has to include its metadata.
+	defaultCompressionThreshold = 64 * 1024
+	defaultMaxPartSize          = 512 * 1024
+
+	// maxDataSize is the size of the largest data which may be stored, before it is compressed. Reading compressed
+	// data stops at this size, so a small Secret can't decompress into an unbounded amount of memory.
+	maxDataSize = 16 * 1024 * 1024
+
+	ErrSecretTypeMismatch     = constable.Error("secret storage data has incorrect type")
+	ErrSecretLabelMismatch    = constable.Error("secret storage data has incorrect label")
+	ErrSecretVersionMismatch  = constable.Error("secret storage data has incorrect version")
+	ErrSecretRevoked          = constable.Error("secret storage data has been revoked")
+	ErrSecretChecksumMismatch = constable.Error("secret storage data has incorrect checksum")
 )
 
+// Storage stores one type of session data. Its methods return errors which can be checked using IsNotFound,
+// IsAlreadyExists and IsConflict from k8s.io/apimachinery/pkg/api/errors, regardless of the Backend which created it.
 type Storage interface {
 	Create(ctx context.Context, signature string, data JSON, additionalLabels map[string]string) (resourceVersion string, err error)
 	Get(ctx context.Context, signature string, data JSON) (resourceVersion string, err error)
 	Update(ctx context.Context, signature, resourceVersion string, data JSON) (newResourceVersion string, err error)
 	Delete(ctx context.Context, signature string) error
 	DeleteByLabel(ctx context.Context, labelName string, labelValue string) error
+	RevokeByLabel(ctx context.Context, labelName string, labelValue string) error
+	Migrate(ctx context.Context, migrate MigrateFunc) (migrated int, err error)
 }
 
+// MigrateFunc returns the new stored data for the given stored data, or nil when the stored data does not need to
+// change.
+type MigrateFunc func(data []byte) ([]byte, error)
+
 type JSON interface{} // document that we need valid JSON types
 
+// Backend creates the Storage for each type of session data. It also lists and deletes the stored session data of
+// every type, for the administrative tools and the garbage collection.
+type Backend interface {
+	Storage(resource string, clock func() time.Time, lifetime time.Duration) Storage
+
+	// List returns the stored session data which is selected by selector. It may include expired data which has not
+	// been deleted yet.
+	List(ctx context.Context, selector Selector) ([]Entry, error)
+
+	// DeleteEntry deletes stored session data which was returned by List.
+	DeleteEntry(ctx context.Context, entry Entry) error
+}
+
+// Selector selects the stored session data which is returned by Backend.List.
+type Selector struct {
+	// Resources are the types of session data to select. Every type is selected when it is empty.
+	Resources []string
+
+	// Labels are the labels which the selected data must have, as given to Storage.Create.
+	Labels map[string]string
+
+	// Unrevoked skips the data which was revoked by Storage.RevokeByLabel.
+	Unrevoked bool
+}
+
+// Entry is one piece of stored session data.
+type Entry struct {
+	// Resource is the type of the session data.
+	Resource string
+
+	// Name identifies the data in its Backend. It is the name of the Secret for the Secrets backend, and the signature
+	// for the SQL backend.
+	Name string
+
+	Labels  map[string]string
+	Data    []byte
+	Revoked bool
+
+	// CreatedAt is when the data was first stored, or zero when the Backend does not record it.
+	CreatedAt time.Time
+
+	// ExpiresAt is when the data expires, after which it may be deleted at any time.
+	ExpiresAt time.Time
+}
+
+// NewSecretsBackend returns a Backend which stores session data in Kubernetes Secrets. Expired Secrets are deleted
+// by the garbage collector controller. Large session data is compressed, and data which is still too large for one
+// Secret is split across several Secrets. The additional Secrets are owned by the first one, so Kubernetes deletes
+// them together with it.
+func NewSecretsBackend(secrets corev1client.SecretInterface) Backend {
+	return secretsBackend{secrets: secrets}
+}
+
+type secretsBackend struct {
+	secrets corev1client.SecretInterface
+}
+
+func (b secretsBackend) Storage(resource string, clock func() time.Time, lifetime time.Duration) Storage {
+	return New(resource, b.secrets, clock, lifetime)
+}
+
+func (b secretsBackend) List(ctx context.Context, selector Selector) ([]Entry, error) {
+	resourceRequirement, err := labels.NewRequirement(SecretLabelKey, selection.In, selector.Resources)
+	if len(selector.Resources) == 0 {
+		resourceRequirement, err = labels.NewRequirement(SecretLabelKey, selection.Exists, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector: %w", err)
+	}
+	notPartRequirement, _ := labels.NewRequirement(SecretPartOfLabelKey, selection.DoesNotExist, nil)
+	labelSelector := labels.NewSelector().Add(*resourceRequirement, *notPartRequirement)
+	if selector.Unrevoked {
+		unrevokedRequirement, _ := labels.NewRequirement(SecretRevokedLabelKey, selection.DoesNotExist, nil)
+		labelSelector = labelSelector.Add(*unrevokedRequirement)
+	}
+	// An invalid label must not select everything, since the selected data may be deleted.
+	labelsSelector, err := labels.ValidatedSelectorFromSet(selector.Labels)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector: %w", err)
+	}
+	labelRequirements, _ := labelsSelector.Requirements()
+	labelSelector = labelSelector.Add(labelRequirements...)
+
+	list, err := b.secrets.List(ctx, metav1.ListOptions{LabelSelector: labelSelector.String()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list secrets: %w", err)
+	}
+
+	entries := make([]Entry, 0, len(list.Items))
+	for i := range list.Items {
+		secret := &list.Items[i]
+		resource := secret.Labels[SecretLabelKey]
+		if secret.Type != corev1.SecretType(fmt.Sprintf(secretTypeFormat, resource)) {
+			continue
+		}
+		data, err := ReadSecretData(ctx, b.secrets, secret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secret %s: %w", secret.Name, err)
+		}
+		// An unparsable lifetime leaves ExpiresAt zero, like the garbage collector which never deletes such Secrets.
+		expiresAt, _ := time.Parse(SecretLifetimeAnnotationDateFormat, secret.Annotations[SecretLifetimeAnnotationKey])
+		entries = append(entries, Entry{
+			Resource:  resource,
+			Name:      secret.Name,
+			Labels:    secret.Labels,
+			Data:      data,
+			Revoked:   secret.Labels[SecretRevokedLabelKey] == secretRevokedLabelValue,
+			CreatedAt: secret.CreationTimestamp.Time,
+			ExpiresAt: expiresAt,
+		})
+	}
+	return entries, nil
+}
+
+// DeleteEntry deletes the Secret of the entry. Kubernetes also deletes the Secrets which hold its additional parts,
+// since they are owned by it.
+func (b secretsBackend) DeleteEntry(ctx context.Context, entry Entry) error {
+	if err := b.secrets.Delete(ctx, entry.Name, metav1.DeleteOptions{}); err != nil {
+		return fmt.Errorf("failed to delete secret %s: %w", entry.Name, err)
+	}
+	return nil
+}
+
 func New(resource string, secrets corev1client.SecretInterface, clock func() time.Time, lifetime time.Duration) Storage {
 	return &secretsStorage{
 		resource:      resource,
@@ -57,6 +227,9 @@ func New(resource string, secrets corev1client.SecretInterface, clock func() tim
 		secrets:       secrets,
 		clock:         clock,
 		lifetime:      lifetime,
+
+		compressionThreshold: defaultCompressionThreshold,
+		maxPartSize:          defaultMaxPartSize,
 	}
 }
 
@@ -67,20 +240,34 @@ type secretsStorage struct {
 	secrets       corev1client.SecretInterface
 	clock         func() time.Time
 	lifetime      time.Duration
+
+	// Data which is larger than compressionThreshold bytes is compressed, and compressed data which is still larger
+	// than maxPartSize bytes is split into parts.
+	compressionThreshold int
+	maxPartSize          int
 }
 
 func (s *secretsStorage) Create(ctx context.Context, signature string, data JSON, additionalLabels map[string]string) (string, error) {
-	secret, err := s.toSecret(signature, "", data, additionalLabels)
+	secret, parts, err := s.toSecret(signature, "", data, additionalLabels, 1)
 	if err != nil {
 		return "", err
 	}
+	// The parts are owned by the first part, so they can only be written once it exists. Nobody can read the data
+	// before Create returns, so it does not matter that the parts are missing for a moment.
 	secret, err = s.secrets.Create(ctx, secret, metav1.CreateOptions{})
 	if err != nil {
 		return "", fmt.Errorf("failed to create %s for signature %s: %w", s.resource, signature, err)
 	}
+	if err := s.writeParts(ctx, secret, secret, parts); err != nil {
+		// Deleting the first part also deletes the other parts which were already written.
+		_ = s.secrets.Delete(ctx, secret.Name, metav1.DeleteOptions{})
+		return "", fmt.Errorf("failed to create %s for signature %s: %w", s.resource, signature, err)
+	}
 	return secret.ResourceVersion, nil
 }
 
+// Get decodes the stored data into data. When the stored data was revoked by RevokeByLabel, Get still decodes
+// it but returns an error wrapping ErrSecretRevoked, so that callers can detect attempts to use revoked data.
 func (s *secretsStorage) Get(ctx context.Context, signature string, data JSON) (string, error) {
 	secret, err := s.secrets.Get(ctx, s.getName(signature), metav1.GetOptions{})
 	if err != nil {
@@ -89,9 +276,16 @@ func (s *secretsStorage) Get(ctx context.Context, signature string, data JSON) (
 	if err := s.validateSecret(secret); err != nil {
 		return "", err
 	}
-	if err := json.Unmarshal(secret.Data[secretDataKey], data); err != nil {
+	payload, err := ReadSecretData(ctx, s.secrets, secret)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s for signature %s: %w", s.resource, signature, err)
+	}
+	if err := json.Unmarshal(payload, data); err != nil {
 		return "", fmt.Errorf("failed to decode %s for signature %s: %w", s.resource, signature, err)
 	}
+	if secret.Labels[SecretRevokedLabelKey] == secretRevokedLabelValue {
+		return secret.ResourceVersion, fmt.Errorf("%w: %s for signature %s", ErrSecretRevoked, s.resource, signature)
+	}
 	return secret.ResourceVersion, nil
 }
 
@@ -108,18 +302,48 @@ func (s *secretsStorage) validateSecret(secret *corev1.Secret) error {
 	return nil
 }
 
+// Update replaces the stored data. Like the SQL backend, it keeps the labels of the data, so that it can still be
+// found by DeleteByLabel and RevokeByLabel. See replaceSecret for how the parts of large data are replaced.
 func (s *secretsStorage) Update(ctx context.Context, signature, resourceVersion string, data JSON) (string, error) {
-	secret, err := s.toSecret(signature, resourceVersion, data, nil)
+	oldSecret, err := s.secrets.Get(ctx, s.getName(signature), metav1.GetOptions{})
+	if err == nil && oldSecret.ResourceVersion != resourceVersion {
+		err = apierrors.NewConflict(corev1.Resource("secrets"), oldSecret.Name, fmt.Errorf("resource version is %s", oldSecret.ResourceVersion))
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to update %s for signature %s at resource version %s: %w", s.resource, signature, resourceVersion, err)
+	}
+	secret, parts, err := s.toSecret(signature, resourceVersion, data, oldSecret.Labels, partsGeneration(oldSecret)+1)
 	if err != nil {
 		return "", err
 	}
-	secret, err = s.secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	secret, err = s.replaceSecret(ctx, oldSecret, secret, parts)
 	if err != nil {
 		return "", fmt.Errorf("failed to update %s for signature %s at resource version %s: %w", s.resource, signature, resourceVersion, err)
 	}
 	return secret.ResourceVersion, nil
 }
 
+// replaceSecret replaces oldSecret by secret, which holds the first part of the data whose remaining parts are given.
+// The remaining parts are written first, under the new generation of secret, so that concurrent readers of
+// oldSecret still find the parts which belong to it. Then the first part is updated, so its resource version
+// protects all of the parts against concurrent updates. Finally, the parts of oldSecret are deleted. Parts which
+// could not be deleted are owned by the first part, so they are deleted together with it.
+func (s *secretsStorage) replaceSecret(ctx context.Context, oldSecret, secret *corev1.Secret, parts [][]byte) (*corev1.Secret, error) {
+	if err := s.writeParts(ctx, oldSecret, secret, parts); err != nil {
+		s.deleteParts(ctx, secret)
+		return nil, err
+	}
+	updated, err := s.secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	if err != nil {
+		s.deleteParts(ctx, secret)
+		return nil, err
+	}
+	if partsGeneration(oldSecret) != partsGeneration(secret) {
+		s.deleteParts(ctx, oldSecret)
+	}
+	return updated, nil
+}
+
 func (s *secretsStorage) Delete(ctx context.Context, signature string) error {
 	if err := s.secrets.Delete(ctx, s.getName(signature), metav1.DeleteOptions{}); err != nil {
 		return fmt.Errorf("failed to delete %s for signature %s: %w", s.resource, signature, err)
@@ -150,7 +374,81 @@ func (s *secretsStorage) DeleteByLabel(ctx context.Context, labelName string, la
 	return nil
 }
 
-//nolint: gochecknoglobals
+// RevokeByLabel marks all matching secrets which are not already revoked as revoked. Unlike DeleteByLabel, the
+// secrets are kept until they are garbage collected, so later attempts to use them can be detected by Get.
+func (s *secretsStorage) RevokeByLabel(ctx context.Context, labelName string, labelValue string) error {
+	selector := labels.Set{
+		SecretLabelKey: s.resource,
+		labelName:      labelValue,
+	}.String() + ",!" + SecretRevokedLabelKey
+	list, err := s.secrets.List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return fmt.Errorf(`failed to list secrets for resource "%s" matching label "%s=%s": %w`, s.resource, labelName, labelValue, err)
+	}
+	if len(list.Items) == 0 {
+		return fmt.Errorf(`failed to revoke secrets for resource "%s" matching label "%s=%s": none found`, s.resource, labelName, labelValue)
+	}
+	for i := range list.Items {
+		secret := list.Items[i].DeepCopy()
+		secret.Labels[SecretRevokedLabelKey] = secretRevokedLabelValue
+		if _, err := s.secrets.Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf(`failed to revoke secrets for resource "%s" matching label "%s=%s" with name %s: %w`, s.resource, labelName, labelValue, secret.Name, err)
+		}
+	}
+	return nil
+}
+
+// Migrate passes the stored data of each secret of this resource to migrate, and writes back the data which it
+// returns. Unlike Update, the labels and the lifetime of the secrets are kept. Secrets which are changed or deleted
+// concurrently are skipped, since they were presumably written in the current format. It returns how many secrets
+// were changed.
+func (s *secretsStorage) Migrate(ctx context.Context, migrate MigrateFunc) (int, error) {
+	list, err := s.secrets.List(ctx, metav1.ListOptions{
+		LabelSelector: labels.Set{SecretLabelKey: s.resource}.String() + ",!" + SecretPartOfLabelKey,
+	})
+	if err != nil {
+		return 0, fmt.Errorf(`failed to list secrets for resource "%s": %w`, s.resource, err)
+	}
+
+	migrated := 0
+	var errs []error
+	for i := range list.Items {
+		secret := list.Items[i].DeepCopy()
+		if err := s.validateSecret(secret); err != nil {
+			continue
+		}
+		payload, err := ReadSecretData(ctx, s.secrets, secret)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read secret %s: %w", secret.Name, err))
+			continue
+		}
+		data, err := migrate(payload)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to migrate secret %s: %w", secret.Name, err))
+			continue
+		}
+		if data == nil {
+			continue
+		}
+		parts, err := s.setData(secret, data, partsGeneration(&list.Items[i])+1)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to encode secret %s: %w", secret.Name, err))
+			continue
+		}
+		_, err = s.replaceSecret(ctx, &list.Items[i], secret, parts)
+		if apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to update secret %s: %w", secret.Name, err))
+			continue
+		}
+		migrated++
+	}
+	return migrated, utilerrors.NewAggregate(errs)
+}
+
+// nolint: gochecknoglobals
 var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
 
 func (s *secretsStorage) getName(signature string) string {
@@ -161,10 +459,11 @@ func (s *secretsStorage) getName(signature string) string {
 	return fmt.Sprintf(secretNameFormat, s.resource, signatureAsValidName)
 }
 
-func (s *secretsStorage) toSecret(signature, resourceVersion string, data JSON, additionalLabels map[string]string) (*corev1.Secret, error) {
+// toSecret returns the Secret which holds the first part of data, and the remaining parts of data, if any.
+func (s *secretsStorage) toSecret(signature, resourceVersion string, data JSON, additionalLabels map[string]string, generation int) (*corev1.Secret, [][]byte, error) {
 	buf, err := json.Marshal(data)
 	if err != nil {
-		return nil, fmt.Errorf("failed to encode secret data for %s: %w", s.getName(signature), err)
+		return nil, nil, fmt.Errorf("failed to encode secret data for %s: %w", s.getName(signature), err)
 	}
 
 	labelsToAdd := map[string]string{
@@ -174,7 +473,7 @@ func (s *secretsStorage) toSecret(signature, resourceVersion string, data JSON,
 		labelsToAdd[labelName] = labelValue
 	}
 
-	return &corev1.Secret{
+	secret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:            s.getName(signature),
 			ResourceVersion: resourceVersion,
@@ -184,12 +483,184 @@ func (s *secretsStorage) toSecret(signature, resourceVersion string, data JSON,
 			},
 			OwnerReferences: nil,
 		},
-		Data: map[string][]byte{
-			secretDataKey:    buf,
-			secretVersionKey: s.secretVersion,
-		},
 		Type: s.secretType,
-	}, nil
+	}
+	parts, err := s.setData(secret, buf, generation)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode secret data for %s: %w", secret.Name, err)
+	}
+	return secret, parts, nil
+}
+
+// setData stores the first part of data in secret, and returns the remaining parts of data, if any. The remaining
+// parts are stored under the given generation.
+func (s *secretsStorage) setData(secret *corev1.Secret, data []byte, generation int) ([][]byte, error) {
+	if len(data) > maxDataSize {
+		return nil, fmt.Errorf("data is larger than the maximum of %d bytes", maxDataSize)
+	}
+	secret.Data = map[string][]byte{
+		secretVersionKey: s.secretVersion,
+	}
+
+	encoded := data
+	if len(data) > s.compressionThreshold {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		encoded = buf.Bytes()
+		secret.Data[secretEncodingKey] = []byte(secretEncodingGzip)
+	}
+
+	var parts [][]byte
+	for len(encoded) > s.maxPartSize {
+		parts = append(parts, encoded[:s.maxPartSize])
+		encoded = encoded[s.maxPartSize:]
+	}
+	parts = append(parts, encoded)
+	secret.Data[SecretDataKey] = parts[0]
+
+	if len(parts) > 1 {
+		secret.Data[secretPartsKey] = []byte(strconv.Itoa(len(parts)))
+		secret.Data[secretGenerationKey] = []byte(strconv.Itoa(generation))
+	}
+	if len(parts) > 1 || len(data) > s.compressionThreshold {
+		secret.Data[secretChecksumKey] = checksum(parts)
+	}
+	return parts[1:], nil
+}
+
+// writeParts creates or replaces the Secrets which hold the given remaining parts of the data whose first part is
+// held by secret. Each of them has the same type and lifetime as secret, and is owned by owner, which is the stored
+// version of the first part.
+func (s *secretsStorage) writeParts(ctx context.Context, owner, secret *corev1.Secret, parts [][]byte) error {
+	generation := partsGeneration(secret)
+	for i, data := range parts {
+		part := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: partName(secret.Name, generation, i+1),
+				Labels: map[string]string{
+					SecretLabelKey:       s.resource,
+					SecretPartOfLabelKey: SecretPartOfLabelValue(secret.Name),
+				},
+				Annotations: map[string]string{
+					SecretLifetimeAnnotationKey: secret.Annotations[SecretLifetimeAnnotationKey],
+				},
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: "v1",
+					Kind:       "Secret",
+					Name:       owner.Name,
+					UID:        owner.UID,
+				}},
+			},
+			Data: map[string][]byte{
+				SecretDataKey:    data,
+				secretVersionKey: s.secretVersion,
+			},
+			Type: secret.Type,
+		}
+		_, err := s.secrets.Create(ctx, part, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			_, err = s.secrets.Update(ctx, part, metav1.UpdateOptions{})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write part %s: %w", part.Name, err)
+		}
+	}
+	return nil
+}
+
+// deleteParts deletes the Secrets which hold the remaining parts of the data whose first part is held by secret, if
+// any. Parts which cannot be deleted are left to be deleted together with the first part.
+func (s *secretsStorage) deleteParts(ctx context.Context, secret *corev1.Secret) {
+	count, _ := strconv.Atoi(string(secret.Data[secretPartsKey]))
+	generation := partsGeneration(secret)
+	for i := 1; i < count; i++ {
+		_ = s.secrets.Delete(ctx, partName(secret.Name, generation, i), metav1.DeleteOptions{})
+	}
+}
+
+// partsGeneration returns the generation of the remaining parts of the data whose first part is held by secret, or
+// zero when the data has no remaining parts.
+func partsGeneration(secret *corev1.Secret) int {
+	generation, _ := strconv.Atoi(string(secret.Data[secretGenerationKey]))
+	return generation
+}
+
+func partName(name string, generation, index int) string {
+	return fmt.Sprintf(secretPartNameFormat, name, generation, index)
+}
+
+// SecretPartOfLabelValue returns the value of the SecretPartOfLabelKey label of the Secrets which hold the
+// additional parts of the data whose first part is held by the Secret with the given name. Secret names may be
+// longer than label values, so the name is hashed.
+func SecretPartOfLabelValue(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return strings.ToLower(b32.EncodeToString(sum[:]))
+}
+
+// ReadSecretData returns the data stored by secret. When the data was split into parts, secret holds the first part
+// and the other parts are read using secrets. The data is decompressed, and its checksum is verified.
+func ReadSecretData(ctx context.Context, secrets corev1client.SecretInterface, secret *corev1.Secret) ([]byte, error) {
+	parts := [][]byte{secret.Data[SecretDataKey]}
+	if rawCount, ok := secret.Data[secretPartsKey]; ok {
+		count, err := strconv.Atoi(string(rawCount))
+		if err != nil || count < 1 {
+			return nil, fmt.Errorf("invalid number of parts %q", rawCount)
+		}
+		generation := partsGeneration(secret)
+		for i := 1; i < count; i++ {
+			name := partName(secret.Name, generation, i)
+			part, err := secrets.Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get part %s: %w", name, err)
+			}
+			if part.Type != secret.Type || part.Labels[SecretPartOfLabelKey] != SecretPartOfLabelValue(secret.Name) {
+				return nil, fmt.Errorf("%w: %s is not a part of %s", ErrSecretLabelMismatch, name, secret.Name)
+			}
+			parts = append(parts, part.Data[SecretDataKey])
+		}
+	}
+
+	encoding := string(secret.Data[secretEncodingKey])
+	if wantChecksum, ok := secret.Data[secretChecksumKey]; ok || len(parts) > 1 || encoding != "" {
+		if !bytes.Equal(wantChecksum, checksum(parts)) {
+			return nil, ErrSecretChecksumMismatch
+		}
+	}
+	data := bytes.Join(parts, nil)
+
+	switch encoding {
+	case "":
+		return data, nil
+	case secretEncodingGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress data: %w", err)
+		}
+		decompressed, err := ioutil.ReadAll(io.LimitReader(r, maxDataSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress data: %w", err)
+		}
+		if len(decompressed) > maxDataSize {
+			return nil, fmt.Errorf("failed to decompress data: data is larger than the maximum of %d bytes", maxDataSize)
+		}
+		return decompressed, nil
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", encoding)
+	}
+}
+
+func checksum(parts [][]byte) []byte {
+	h := sha256.New()
+	for _, part := range parts {
+		_, _ = h.Write(part)
+	}
+	return []byte(hex.EncodeToString(h.Sum(nil)))
 }
 
 func maybeBase64Decode(signature string) []byte {
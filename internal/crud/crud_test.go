@@ -1,25 +1,34 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package crud
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/ory/fosite/compose"
 	"github.com/stretchr/testify/require"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/validation"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/clock"
+	utilvalidation "k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes/fake"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	coretesting "k8s.io/client-go/testing"
 )
 
@@ -456,6 +465,7 @@ func TestStorage(t *testing.T) {
 			},
 			wantActions: []coretesting.Action{
 				coretesting.NewGetAction(secretsGVR, namespace, "pinniped-storage-stores-4wssc5gzt5mlln6iux6gl7hzz3klsirisydaxn7indnpvdnrs5ba"),
+				coretesting.NewGetAction(secretsGVR, namespace, "pinniped-storage-stores-4wssc5gzt5mlln6iux6gl7hzz3klsirisydaxn7indnpvdnrs5ba"), // Update reads the old parts
 				coretesting.NewUpdateAction(secretsGVR, namespace, &corev1.Secret{
 					ObjectMeta: metav1.ObjectMeta{
 						Name:            "pinniped-storage-stores-4wssc5gzt5mlln6iux6gl7hzz3klsirisydaxn7indnpvdnrs5ba",
@@ -759,6 +769,198 @@ func TestStorage(t *testing.T) {
 			},
 			wantErr: `failed to list secrets for resource "seals" matching label "additionalLabel=matching-value": some listing error`,
 		},
+		{
+			name:     "get revoked",
+			resource: "pandas-are-best",
+			mocks: func(t *testing.T, mock mocker) {
+				err := mock.Tracker().Add(&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "pinniped-storage-pandas-are-best-lvzgyywdc2dhjdbgf5jvzfyphosigvhnsh6qlse3blumogoqhqhq",
+						Namespace:       namespace,
+						ResourceVersion: "",
+						Labels: map[string]string{
+							"storage.pinniped.dev/type":    "pandas-are-best",
+							"storage.pinniped.dev/revoked": "true",
+						},
+						Annotations: map[string]string{
+							"storage.pinniped.dev/garbage-collect-after": fakeNowPlusLifetimeAsString,
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"snorlax"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/pandas-are-best",
+				})
+				require.NoError(t, err)
+			},
+			run: func(t *testing.T, storage Storage, fakeClock *clock.FakeClock) error {
+				signature := hmac.AuthorizeCodeSignature(authorizationCode2)
+				require.NotEmpty(t, signature)
+
+				out := &testJSON{}
+				_, err := storage.Get(ctx, signature, out)
+				require.True(t, errors.Is(err, ErrSecretRevoked))
+				require.Equal(t, &testJSON{Data: "snorlax"}, out) // the revoked data is still returned
+
+				return err
+			},
+			wantActions: []coretesting.Action{
+				coretesting.NewGetAction(secretsGVR, namespace, "pinniped-storage-pandas-are-best-lvzgyywdc2dhjdbgf5jvzfyphosigvhnsh6qlse3blumogoqhqhq"),
+			},
+			wantSecrets: []corev1.Secret{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "pinniped-storage-pandas-are-best-lvzgyywdc2dhjdbgf5jvzfyphosigvhnsh6qlse3blumogoqhqhq",
+						Namespace:       namespace,
+						ResourceVersion: "",
+						Labels: map[string]string{
+							"storage.pinniped.dev/type":    "pandas-are-best",
+							"storage.pinniped.dev/revoked": "true",
+						},
+						Annotations: map[string]string{
+							"storage.pinniped.dev/garbage-collect-after": fakeNowPlusLifetimeAsString,
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"snorlax"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/pandas-are-best",
+				},
+			},
+			wantErr: "secret storage data has been revoked: pandas-are-best for signature XXJsYsMWhnSMJi9TXJcPO6SDVO2R_QXImwroxxnQPA8",
+		},
+		{
+			name:     "revoke non-existent by label",
+			resource: "tokens",
+			mocks:    nil,
+			run: func(t *testing.T, storage Storage, fakeClock *clock.FakeClock) error {
+				return storage.RevokeByLabel(ctx, "additionalLabel", "matching-value")
+			},
+			wantActions: []coretesting.Action{
+				coretesting.NewListAction(secretsGVR, schema.GroupVersionKind{Group: "", Version: "v1", Kind: "Secret"}, namespace, metav1.ListOptions{
+					LabelSelector: "storage.pinniped.dev/type=tokens,additionalLabel=matching-value,!storage.pinniped.dev/revoked",
+				}),
+			},
+			wantSecrets: nil,
+			wantErr:     `failed to revoke secrets for resource "tokens" matching label "additionalLabel=matching-value": none found`,
+		},
+		{
+			name:     "revoke existing by label",
+			resource: "seals",
+			mocks: func(t *testing.T, mock mocker) {
+				require.NoError(t, mock.Tracker().Add(&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "pinniped-storage-seals-lvzgyywdc2dhjdbgf5jvzfyphosigvhnsh6qlse3blumogoqhqhq",
+						Namespace:       namespace,
+						ResourceVersion: "",
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "seals",
+							"additionalLabel":           "matching-value",
+						},
+						Annotations: map[string]string{
+							"storage.pinniped.dev/garbage-collect-after": fakeNowPlusLifetimeAsString,
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"sad-seal"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				}))
+				require.NoError(t, mock.Tracker().Add(&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "pinniped-storage-seals-12345wdc2dhjdbgf5jvzfyphosigvhnsh6qlse3blumogoqhqhq",
+						Namespace:       namespace,
+						ResourceVersion: "",
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "seals",              // same type as above
+							"additionalLabel":           "non-matching-value", // different value for the same label
+						},
+						Annotations: map[string]string{
+							"storage.pinniped.dev/garbage-collect-after": fakeNowPlusLifetimeAsString,
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"sad-seal2"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				}))
+			},
+			run: func(t *testing.T, storage Storage, fakeClock *clock.FakeClock) error {
+				return storage.RevokeByLabel(ctx, "additionalLabel", "matching-value")
+			},
+			wantActions: []coretesting.Action{
+				coretesting.NewListAction(secretsGVR, schema.GroupVersionKind{Group: "", Version: "v1", Kind: "Secret"}, namespace, metav1.ListOptions{
+					LabelSelector: "storage.pinniped.dev/type=seals,additionalLabel=matching-value,!storage.pinniped.dev/revoked",
+				}),
+				coretesting.NewUpdateAction(secretsGVR, namespace, &corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "pinniped-storage-seals-lvzgyywdc2dhjdbgf5jvzfyphosigvhnsh6qlse3blumogoqhqhq",
+						Namespace:       namespace,
+						ResourceVersion: "",
+						Labels: map[string]string{
+							"storage.pinniped.dev/type":    "seals",
+							"storage.pinniped.dev/revoked": "true",
+							"additionalLabel":              "matching-value",
+						},
+						Annotations: map[string]string{
+							"storage.pinniped.dev/garbage-collect-after": fakeNowPlusLifetimeAsString,
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"sad-seal"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				}),
+			},
+			wantSecrets: []corev1.Secret{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "pinniped-storage-seals-12345wdc2dhjdbgf5jvzfyphosigvhnsh6qlse3blumogoqhqhq",
+						Namespace:       namespace,
+						ResourceVersion: "",
+						Labels: map[string]string{
+							"storage.pinniped.dev/type": "seals",              // same type as above
+							"additionalLabel":           "non-matching-value", // different value for the same label
+						},
+						Annotations: map[string]string{
+							"storage.pinniped.dev/garbage-collect-after": fakeNowPlusLifetimeAsString,
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"sad-seal2"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				},
+				// the revoked secret is kept until it is garbage collected
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:            "pinniped-storage-seals-lvzgyywdc2dhjdbgf5jvzfyphosigvhnsh6qlse3blumogoqhqhq",
+						Namespace:       namespace,
+						ResourceVersion: "",
+						Labels: map[string]string{
+							"storage.pinniped.dev/type":    "seals",
+							"storage.pinniped.dev/revoked": "true",
+							"additionalLabel":              "matching-value",
+						},
+						Annotations: map[string]string{
+							"storage.pinniped.dev/garbage-collect-after": fakeNowPlusLifetimeAsString,
+						},
+					},
+					Data: map[string][]byte{
+						"pinniped-storage-data":    []byte(`{"Data":"sad-seal"}`),
+						"pinniped-storage-version": []byte("1"),
+					},
+					Type: "storage.pinniped.dev/seals",
+				},
+			},
+			wantErr: "",
+		},
 		{
 			name:     "invalid exiting secret type",
 			resource: "candies",
@@ -1067,6 +1269,35 @@ func assertValidName(t *testing.T, name string) {
 	require.Empty(t, validateSecretName(name, true)) // I do not think we actually care about this case
 }
 
+// requireParts requires that the Secrets which hold the additional parts of the data whose first part is held by the
+// Secret with the given name are exactly the ones which it refers to, and that they have the given generation.
+func requireParts(t *testing.T, secrets corev1client.SecretInterface, name string, wantGeneration int) {
+	t.Helper()
+
+	secret, err := secrets.Get(context.Background(), name, metav1.GetOptions{})
+	require.NoError(t, err)
+	count := 1
+	if rawCount, ok := secret.Data["pinniped-storage-parts"]; ok {
+		count, err = strconv.Atoi(string(rawCount))
+		require.NoError(t, err)
+		require.Equal(t, strconv.Itoa(wantGeneration), string(secret.Data["pinniped-storage-parts-generation"]))
+	} else {
+		require.NotContains(t, secret.Data, "pinniped-storage-parts-generation")
+	}
+	wantPartNames := []string{}
+	for i := 1; i < count; i++ {
+		wantPartNames = append(wantPartNames, fmt.Sprintf("%s-g%d-part-%d", name, wantGeneration, i))
+	}
+
+	list, err := secrets.List(context.Background(), metav1.ListOptions{LabelSelector: SecretPartOfLabelKey + "=" + SecretPartOfLabelValue(name)})
+	require.NoError(t, err)
+	partNames := make([]string, 0, len(list.Items))
+	for _, part := range list.Items {
+		partNames = append(partNames, part.Name)
+	}
+	require.ElementsMatch(t, wantPartNames, partNames)
+}
+
 func getName(t *testing.T, action coretesting.Action) string {
 	t.Helper()
 
@@ -1095,3 +1326,352 @@ func errString(err error) string {
 
 	return err.Error()
 }
+
+func TestSecretsStorageMigrate(t *testing.T) {
+	ctx := context.Background()
+	secretsGVR := corev1.SchemeGroupVersion.WithResource("secrets")
+	fakeNow := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	lifetime := time.Minute * 10
+
+	type testJSON struct {
+		Data string
+	}
+
+	client := fake.NewSimpleClientset()
+	secrets := client.CoreV1().Secrets("test-ns")
+	storage := New("test-resource", secrets, clock.NewFakeClock(fakeNow).Now, lifetime)
+	otherStorage := New("other-resource", secrets, clock.NewFakeClock(fakeNow).Now, lifetime)
+
+	for _, data := range []string{"old", "current", "bad", "conflict"} {
+		_, err := storage.Create(ctx, data, &testJSON{Data: data}, map[string]string{"some-label": data})
+		require.NoError(t, err)
+	}
+	_, err := otherStorage.Create(ctx, "other", &testJSON{Data: "old"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, storage.RevokeByLabel(ctx, "some-label", "old"))
+
+	oldSecret, err := secrets.Get(ctx, storage.(*secretsStorage).getName("old"), metav1.GetOptions{})
+	require.NoError(t, err)
+	client.PrependReactor("update", "secrets", func(action coretesting.Action) (bool, runtime.Object, error) {
+		secret := action.(coretesting.UpdateAction).GetObject().(*corev1.Secret)
+		if secret.Name == storage.(*secretsStorage).getName("conflict") {
+			return true, nil, apierrors.NewConflict(secretsGVR.GroupResource(), secret.Name, errors.New("some conflict"))
+		}
+		return false, nil, nil
+	})
+
+	migrated, err := storage.Migrate(ctx, func(data []byte) ([]byte, error) {
+		switch string(data) {
+		case `{"Data":"current"}`:
+			return nil, nil
+		case `{"Data":"bad"}`:
+			return nil, errors.New("some error")
+		default:
+			return []byte(`{"Data":"new"}`), nil
+		}
+	})
+	require.EqualError(t, err, "failed to migrate secret "+storage.(*secretsStorage).getName("bad")+": some error")
+	require.Equal(t, 1, migrated)
+
+	// Only the data was changed, so the secret is still revoked and will be garbage collected at the same time.
+	newSecret, err := secrets.Get(ctx, oldSecret.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	wantSecret := oldSecret.DeepCopy()
+	wantSecret.Data[SecretDataKey] = []byte(`{"Data":"new"}`)
+	require.Equal(t, wantSecret, newSecret)
+
+	var got testJSON
+	_, err = otherStorage.Get(ctx, "other", &got)
+	require.NoError(t, err)
+	require.Equal(t, "old", got.Data)
+}
+
+func TestSecretsStorageLargeData(t *testing.T) {
+	ctx := context.Background()
+	fakeNow := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	lifetime := time.Minute * 10
+
+	type testJSON struct {
+		Data string
+	}
+
+	// Hex encoded hashes do not compress well, so the compressed data is still split into several parts.
+	var largeData strings.Builder
+	sum := sha256.Sum256([]byte("seed"))
+	for largeData.Len() < 4096 {
+		sum = sha256.Sum256(sum[:])
+		largeData.WriteString(hex.EncodeToString(sum[:]))
+	}
+
+	setup := func(t *testing.T) (*fake.Clientset, corev1client.SecretInterface, *secretsStorage) {
+		client := fake.NewSimpleClientset()
+		secrets := client.CoreV1().Secrets("test-ns")
+		storage := New("test-resource", secrets, clock.NewFakeClock(fakeNow).Now, lifetime).(*secretsStorage)
+		storage.compressionThreshold = 256
+		storage.maxPartSize = 1024
+		return client, secrets, storage
+	}
+
+	t.Run("small data is stored as is", func(t *testing.T) {
+		_, secrets, storage := setup(t)
+		_, err := storage.Create(ctx, "small", &testJSON{Data: "small"}, nil)
+		require.NoError(t, err)
+
+		secret, err := secrets.Get(ctx, storage.getName("small"), metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, map[string][]byte{
+			"pinniped-storage-data":    []byte(`{"Data":"small"}`),
+			"pinniped-storage-version": []byte("1"),
+		}, secret.Data)
+	})
+
+	t.Run("compressible data is compressed", func(t *testing.T) {
+		_, secrets, storage := setup(t)
+		data := &testJSON{Data: strings.Repeat("a", 4096)}
+		_, err := storage.Create(ctx, "compressible", data, nil)
+		require.NoError(t, err)
+
+		secret, err := secrets.Get(ctx, storage.getName("compressible"), metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, "gzip", string(secret.Data["pinniped-storage-encoding"]))
+		require.NotContains(t, secret.Data, "pinniped-storage-parts")
+		require.NotEmpty(t, secret.Data["pinniped-storage-checksum"])
+		require.Less(t, len(secret.Data[SecretDataKey]), 256)
+
+		var got testJSON
+		_, err = storage.Get(ctx, "compressible", &got)
+		require.NoError(t, err)
+		require.Equal(t, data, &got)
+	})
+
+	t.Run("data which is still too large is split into parts", func(t *testing.T) {
+		_, secrets, storage := setup(t)
+		data := &testJSON{Data: largeData.String()}
+		_, err := storage.Create(ctx, "large", data, map[string]string{"some-label": "some-value"})
+		require.NoError(t, err)
+
+		name := storage.getName("large")
+		secret, err := secrets.Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, "gzip", string(secret.Data["pinniped-storage-encoding"]))
+		require.Equal(t, "3", string(secret.Data["pinniped-storage-parts"]))
+		require.Len(t, secret.Data[SecretDataKey], 1024)
+
+		list, err := secrets.List(ctx, metav1.ListOptions{LabelSelector: SecretPartOfLabelKey + "=" + SecretPartOfLabelValue(name)})
+		require.NoError(t, err)
+		require.Len(t, list.Items, 2)
+		for i, part := range list.Items {
+			require.Equal(t, fmt.Sprintf("%s-g1-part-%d", name, i+1), part.Name)
+			assertValidName(t, part.Name)
+			require.Equal(t, secret.Type, part.Type)
+			require.Equal(t, secret.Annotations, part.Annotations)
+			require.Equal(t, map[string]string{SecretLabelKey: "test-resource", SecretPartOfLabelKey: SecretPartOfLabelValue(name)}, part.Labels)
+			require.Equal(t, []metav1.OwnerReference{{APIVersion: "v1", Kind: "Secret", Name: name, UID: secret.UID}}, part.OwnerReferences)
+		}
+
+		var got testJSON
+		_, err = storage.Get(ctx, "large", &got)
+		require.NoError(t, err)
+		require.Equal(t, data, &got)
+
+		// The parts are not returned by the lists of the session data.
+		entries, err := NewSecretsBackend(secrets).List(ctx, Selector{Resources: []string{"test-resource"}})
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		require.Equal(t, name, entries[0].Name)
+		require.Equal(t, data, &testJSON{Data: strings.TrimSuffix(strings.TrimPrefix(string(entries[0].Data), `{"Data":"`), `"}`)})
+		require.NoError(t, storage.RevokeByLabel(ctx, "some-label", "some-value"))
+		got = testJSON{}
+		_, err = storage.Get(ctx, "large", &got)
+		require.True(t, errors.Is(err, ErrSecretRevoked))
+		require.Equal(t, data, &got)
+
+		// Updating the data rewrites the parts under a new generation, and keeps the labels.
+		secret, err = secrets.Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		data = &testJSON{Data: "updated" + largeData.String()}
+		_, err = storage.Update(ctx, "large", secret.ResourceVersion, data)
+		require.NoError(t, err)
+		got = testJSON{}
+		_, err = storage.Get(ctx, "large", &got)
+		require.True(t, errors.Is(err, ErrSecretRevoked))
+		require.Equal(t, data, &got)
+		requireParts(t, secrets, name, 2)
+
+		// Migrating the data rewrites the parts too.
+		migrated, err := storage.Migrate(ctx, func(data []byte) ([]byte, error) {
+			return []byte(strings.Replace(string(data), "updated", "migrated", 1)), nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 1, migrated)
+		got = testJSON{}
+		_, err = storage.Get(ctx, "large", &got)
+		require.True(t, errors.Is(err, ErrSecretRevoked))
+		require.Equal(t, &testJSON{Data: "migrated" + largeData.String()}, &got)
+		requireParts(t, secrets, name, 3)
+
+		// A part which does not belong to the data is detected by its checksum.
+		part, err := secrets.Get(ctx, name+"-g3-part-2", metav1.GetOptions{})
+		require.NoError(t, err)
+		part.Data[SecretDataKey] = []byte("corrupted")
+		_, err = secrets.Update(ctx, part, metav1.UpdateOptions{})
+		require.NoError(t, err)
+		_, err = storage.Get(ctx, "large", &got)
+		require.EqualError(t, err, "failed to read test-resource for signature large: secret storage data has incorrect checksum")
+
+		// A missing part is detected too.
+		require.NoError(t, secrets.Delete(ctx, name+"-g3-part-2", metav1.DeleteOptions{}))
+		_, err = storage.Get(ctx, "large", &got)
+		require.EqualError(t, err, "failed to read test-resource for signature large: failed to get part "+name+`-g3-part-2: secrets "`+name+`-g3-part-2" not found`)
+	})
+
+	t.Run("updates which grow and shrink the data replace its parts", func(t *testing.T) {
+		client, secrets, storage := setup(t)
+		name := storage.getName("changing")
+		rv, err := storage.Create(ctx, "changing", &testJSON{Data: "small"}, nil)
+		require.NoError(t, err)
+
+		partNames := func(secret *corev1.Secret) []string {
+			count, _ := strconv.Atoi(string(secret.Data["pinniped-storage-parts"]))
+			var names []string
+			for i := 1; i < count; i++ {
+				names = append(names, fmt.Sprintf("%s-g%s-part-%d", secret.Name, secret.Data["pinniped-storage-parts-generation"], i))
+			}
+			return names
+		}
+
+		// While the first part is updated, concurrent readers of its old version still find its old parts, and the
+		// new parts have already been written.
+		client.PrependReactor("update", "secrets", func(action coretesting.Action) (bool, runtime.Object, error) {
+			newSecret := action.(coretesting.UpdateAction).GetObject().(*corev1.Secret)
+			if newSecret.Name != name {
+				return false, nil, nil
+			}
+			oldSecret, err := client.Tracker().Get(corev1.SchemeGroupVersion.WithResource("secrets"), "test-ns", name)
+			require.NoError(t, err)
+			for _, partName := range append(partNames(oldSecret.(*corev1.Secret)), partNames(newSecret)...) {
+				_, err := client.Tracker().Get(corev1.SchemeGroupVersion.WithResource("secrets"), "test-ns", partName)
+				require.NoError(t, err, partName)
+			}
+			return false, nil, nil
+		})
+
+		update := func(data *testJSON, wantGeneration int) int {
+			rv, err = storage.Update(ctx, "changing", rv, data)
+			require.NoError(t, err)
+			requireParts(t, secrets, name, wantGeneration)
+			var got testJSON
+			_, err = storage.Get(ctx, "changing", &got)
+			require.NoError(t, err)
+			require.Equal(t, data, &got)
+
+			secret, err := secrets.Get(ctx, name, metav1.GetOptions{})
+			require.NoError(t, err)
+			return len(partNames(secret))
+		}
+
+		// Repeated data would compress well, so the grown data is made of different hashes.
+		var otherLargeData strings.Builder
+		otherSum := sha256.Sum256([]byte("other seed"))
+		for otherLargeData.Len() < 4096 {
+			otherSum = sha256.Sum256(otherSum[:])
+			otherLargeData.WriteString(hex.EncodeToString(otherSum[:]))
+		}
+		grownCount := update(&testJSON{Data: largeData.String() + otherLargeData.String()}, 1)
+		shrunkCount := update(&testJSON{Data: largeData.String()}, 2)
+		require.Less(t, shrunkCount, grownCount)
+		require.Greater(t, shrunkCount, 0)
+
+		// Small data is stored as is again, without any parts.
+		require.Zero(t, update(&testJSON{Data: "small again"}, 0))
+		secret, err := secrets.Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, map[string][]byte{
+			"pinniped-storage-data":    []byte(`{"Data":"small again"}`),
+			"pinniped-storage-version": []byte("1"),
+		}, secret.Data)
+
+		// An update at an old resource version does not write any parts.
+		_, err = storage.Update(ctx, "changing", "some-old-resource-version", &testJSON{Data: largeData.String()})
+		require.True(t, apierrors.IsConflict(err))
+		requireParts(t, secrets, name, 0)
+	})
+
+	t.Run("the parts of data stored for a real signature have valid names and labels", func(t *testing.T) {
+		_, secrets, storage := setup(t)
+		storage = New("pushed-authorization-request", secrets, storage.clock, lifetime).(*secretsStorage)
+		storage.compressionThreshold = 256
+		storage.maxPartSize = 1024
+
+		hmac := compose.NewOAuth2HMACStrategy(&compose.Config{}, []byte("super-secret-32-byte-for-testing"), nil)
+		_, signature, err := hmac.GenerateRefreshToken(ctx, nil)
+		require.NoError(t, err)
+		_, err = storage.Create(ctx, signature, &testJSON{Data: largeData.String()}, nil)
+		require.NoError(t, err)
+
+		name := storage.getName(signature)
+		list, err := secrets.List(ctx, metav1.ListOptions{LabelSelector: SecretPartOfLabelKey + "=" + SecretPartOfLabelValue(name)})
+		require.NoError(t, err)
+		require.Len(t, list.Items, 2)
+		for _, part := range list.Items {
+			assertValidName(t, part.Name)
+			for labelName, labelValue := range part.Labels {
+				require.Empty(t, utilvalidation.IsQualifiedName(labelName))
+				require.Empty(t, utilvalidation.IsValidLabelValue(labelValue))
+			}
+		}
+	})
+
+	t.Run("data which is larger than the maximum is not stored", func(t *testing.T) {
+		_, secrets, storage := setup(t)
+		_, err := storage.Create(ctx, "huge", &testJSON{Data: strings.Repeat("a", maxDataSize)}, nil)
+		name := storage.getName("huge")
+		require.EqualError(t, err, fmt.Sprintf("failed to encode secret data for %s: data is larger than the maximum of %d bytes", name, maxDataSize))
+
+		_, err = secrets.Get(ctx, name, metav1.GetOptions{})
+		require.True(t, apierrors.IsNotFound(err))
+	})
+
+	t.Run("compressed data which decompresses to more than the maximum is not read", func(t *testing.T) {
+		_, secrets, storage := setup(t)
+		_, err := storage.Create(ctx, "bomb", &testJSON{Data: strings.Repeat("a", 4096)}, nil)
+		require.NoError(t, err)
+
+		// A small Secret whose data decompresses into more than the maximum.
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err = w.Write(make([]byte, maxDataSize+1))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		require.Less(t, buf.Len(), 64*1024)
+
+		secret, err := secrets.Get(ctx, storage.getName("bomb"), metav1.GetOptions{})
+		require.NoError(t, err)
+		secret.Data[SecretDataKey] = buf.Bytes()
+		secret.Data["pinniped-storage-checksum"] = checksum([][]byte{buf.Bytes()})
+		_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+		require.NoError(t, err)
+
+		var got testJSON
+		_, err = storage.Get(ctx, "bomb", &got)
+		require.EqualError(t, err, fmt.Sprintf("failed to read test-resource for signature bomb: failed to decompress data: data is larger than the maximum of %d bytes", maxDataSize))
+	})
+
+	t.Run("when a part cannot be written, the data is not created", func(t *testing.T) {
+		client, secrets, storage := setup(t)
+		client.PrependReactor("create", "secrets", func(action coretesting.Action) (bool, runtime.Object, error) {
+			secret := action.(coretesting.CreateAction).GetObject().(*corev1.Secret)
+			if strings.HasSuffix(secret.Name, "-g1-part-2") {
+				return true, nil, errors.New("some create error")
+			}
+			return false, nil, nil
+		})
+		_, err := storage.Create(ctx, "large", &testJSON{Data: largeData.String()}, nil)
+		name := storage.getName("large")
+		require.EqualError(t, err, "failed to create test-resource for signature large: failed to write part "+name+"-g1-part-2: some create error")
+
+		// Kubernetes deletes the remaining parts, because they are owned by the deleted Secret.
+		_, err = secrets.Get(ctx, name, metav1.GetOptions{})
+		require.True(t, apierrors.IsNotFound(err))
+	})
+}
@@ -0,0 +1,569 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package crud
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+const defaultSQLListPageSize = 500
+
+// sqlSchema creates the tables of the SQL backend. It only uses SQL which is understood by both PostgreSQL and
+// SQLite. Timestamps are stored as Unix seconds so that they compare the same way in every database.
+//
+//nolint: gochecknoglobals
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS pinniped_sessions (
+		resource TEXT NOT NULL,
+		signature TEXT NOT NULL,
+		resource_version BIGINT NOT NULL,
+		data TEXT NOT NULL,
+		revoked BOOLEAN NOT NULL,
+		expires_at BIGINT NOT NULL,
+		PRIMARY KEY (resource, signature)
+	)`,
+	`CREATE INDEX IF NOT EXISTS pinniped_sessions_expires_at ON pinniped_sessions (expires_at)`,
+	`CREATE TABLE IF NOT EXISTS pinniped_session_labels (
+		resource TEXT NOT NULL,
+		signature TEXT NOT NULL,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (resource, signature, name)
+	)`,
+	`CREATE INDEX IF NOT EXISTS pinniped_session_labels_value ON pinniped_session_labels (resource, name, value)`,
+}
+
+// SQLBackend is a Backend which stores session data in a SQL database. Both PostgreSQL and SQLite are supported.
+// Unlike Kubernetes Secrets, expired session data is never returned by Get, and is deleted by DeleteExpired.
+type SQLBackend struct {
+	db *sql.DB
+
+	// listPageSize is the number of rows which List reads at once.
+	listPageSize int
+}
+
+var _ Backend = &SQLBackend{}
+
+// NewSQLBackend returns a SQLBackend which uses db. CreateSchema must be called before it is used.
+func NewSQLBackend(db *sql.DB) *SQLBackend {
+	return &SQLBackend{db: db, listPageSize: defaultSQLListPageSize}
+}
+
+// CreateSchema creates the tables of the backend, unless they already exist.
+func (b *SQLBackend) CreateSchema(ctx context.Context) error {
+	for _, statement := range sqlSchema {
+		if _, err := b.db.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("failed to create session storage schema: %w", err)
+		}
+	}
+	return nil
+}
+
+// DeleteExpired deletes all session data which expired before now, and returns how much was deleted.
+func (b *SQLBackend) DeleteExpired(ctx context.Context, now time.Time) (int64, error) {
+	var deleted int64
+	err := b.inTransaction(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx,
+			`DELETE FROM pinniped_session_labels WHERE (resource, signature) IN
+				(SELECT resource, signature FROM pinniped_sessions WHERE expires_at <= $1)`,
+			now.Unix(),
+		); err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, `DELETE FROM pinniped_sessions WHERE expires_at <= $1`, now.Unix())
+		if err != nil {
+			return err
+		}
+		deleted, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired sessions: %w", err)
+	}
+	return deleted, nil
+}
+
+// List selects the entries page by page, in the order of their primary key, so that neither the database nor the
+// Supervisor has to hold every row of a large table at once. The selector is applied by the database.
+func (b *SQLBackend) List(ctx context.Context, selector Selector) ([]Entry, error) {
+	var (
+		entries []Entry
+		after   *[2]string
+	)
+	for {
+		page, err := b.listPage(ctx, selector, after)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list sessions: %w", err)
+		}
+		entries = append(entries, page...)
+		if len(page) < b.listPageSize {
+			return entries, nil
+		}
+		last := page[len(page)-1]
+		after = &[2]string{last.Resource, last.Name}
+	}
+}
+
+// listPage returns at most listPageSize selected entries whose resource and signature come after the given ones, or
+// the first entries when after is nil.
+func (b *SQLBackend) listPage(ctx context.Context, selector Selector, after *[2]string) ([]Entry, error) {
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	// Each selected label must match a row of the labels table, so join it once per label.
+	query := `SELECT s.resource, s.signature, s.data, s.revoked, s.expires_at FROM pinniped_sessions s`
+	labelNames := make([]string, 0, len(selector.Labels))
+	for name := range selector.Labels {
+		labelNames = append(labelNames, name)
+	}
+	sort.Strings(labelNames)
+	for i, name := range labelNames {
+		l := "l" + strconv.Itoa(i)
+		query += fmt.Sprintf(` JOIN pinniped_session_labels %[1]s ON %[1]s.resource = s.resource AND %[1]s.signature = s.signature AND %[1]s.name = %[2]s AND %[1]s.value = %[3]s`,
+			l, arg(name), arg(selector.Labels[name]))
+	}
+
+	var where []string
+	if after != nil {
+		where = append(where, fmt.Sprintf("(s.resource, s.signature) > (%s, %s)", arg(after[0]), arg(after[1])))
+	}
+	if len(selector.Resources) > 0 {
+		placeholders := make([]string, 0, len(selector.Resources))
+		for _, resource := range selector.Resources {
+			placeholders = append(placeholders, arg(resource))
+		}
+		where = append(where, "s.resource IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	if selector.Unrevoked {
+		where = append(where, "NOT s.revoked")
+	}
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY s.resource, s.signature LIMIT " + arg(b.listPageSize)
+
+	var entries []Entry
+	err := b.inTransaction(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var (
+				entry     Entry
+				data      string
+				expiresAt int64
+			)
+			if err := rows.Scan(&entry.Resource, &entry.Name, &data, &entry.Revoked, &expiresAt); err != nil {
+				_ = rows.Close()
+				return err
+			}
+			entry.Data = []byte(data)
+			entry.ExpiresAt = time.Unix(expiresAt, 0).UTC()
+			entry.Labels = map[string]string{}
+			entries = append(entries, entry)
+		}
+		// Close the rows before the next query, because a database with a single connection cannot do both at once.
+		if err := rows.Close(); err != nil {
+			return err
+		}
+		if err := rows.Err(); err != nil || len(entries) == 0 {
+			return err
+		}
+
+		// Read the labels of the rows of the page, which are within the range of its first and last row.
+		first, last := entries[0], entries[len(entries)-1]
+		rows, err = tx.QueryContext(ctx,
+			`SELECT resource, signature, name, value FROM pinniped_session_labels
+				WHERE (resource, signature) >= ($1, $2) AND (resource, signature) <= ($3, $4)`,
+			first.Resource, first.Name, last.Resource, last.Name,
+		)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = rows.Close() }()
+		entriesByKey := make(map[[2]string]*Entry, len(entries))
+		for i := range entries {
+			entriesByKey[[2]string{entries[i].Resource, entries[i].Name}] = &entries[i]
+		}
+		for rows.Next() {
+			var resource, signature, name, value string
+			if err := rows.Scan(&resource, &signature, &name, &value); err != nil {
+				return err
+			}
+			if entry, ok := entriesByKey[[2]string{resource, signature}]; ok {
+				entry.Labels[name] = value
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (b *SQLBackend) DeleteEntry(ctx context.Context, entry Entry) error {
+	err := b.inTransaction(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx,
+			`DELETE FROM pinniped_sessions WHERE resource = $1 AND signature = $2`,
+			entry.Resource, entry.Name,
+		)
+		if err != nil {
+			return err
+		}
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if deleted == 0 {
+			return apierrors.NewNotFound(schema.GroupResource{Resource: entry.Resource}, entry.Name)
+		}
+		_, err = tx.ExecContext(ctx,
+			`DELETE FROM pinniped_session_labels WHERE resource = $1 AND signature = $2`,
+			entry.Resource, entry.Name,
+		)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %s for signature %s: %w", entry.Resource, entry.Name, err)
+	}
+	return nil
+}
+
+func (b *SQLBackend) Storage(resource string, clock func() time.Time, lifetime time.Duration) Storage {
+	return &sqlStorage{
+		backend:       b,
+		resource:      resource,
+		groupResource: schema.GroupResource{Resource: resource},
+		clock:         clock,
+		lifetime:      lifetime,
+	}
+}
+
+func (b *SQLBackend) inTransaction(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type sqlStorage struct {
+	backend       *SQLBackend
+	resource      string
+	groupResource schema.GroupResource
+	clock         func() time.Time
+	lifetime      time.Duration
+}
+
+func (s *sqlStorage) Create(ctx context.Context, signature string, data JSON, additionalLabels map[string]string) (string, error) {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode %s data for signature %s: %w", s.resource, signature, err)
+	}
+	now := s.clock()
+
+	err = s.backend.inTransaction(ctx, func(tx *sql.Tx) error {
+		// Expired data may not have been deleted yet, but it must not prevent new data from being created.
+		if _, err := s.deleteRow(ctx, tx, signature, true); err != nil {
+			return err
+		}
+
+		result, err := tx.ExecContext(ctx,
+			`INSERT INTO pinniped_sessions (resource, signature, resource_version, data, revoked, expires_at)
+				VALUES ($1, $2, 1, $3, $4, $5) ON CONFLICT DO NOTHING`,
+			s.resource, signature, string(buf), false, now.Add(s.lifetime).Unix(),
+		)
+		if err != nil {
+			return err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rows == 0 {
+			return apierrors.NewAlreadyExists(s.groupResource, signature)
+		}
+
+		for name, value := range additionalLabels {
+			if _, err := tx.ExecContext(ctx,
+				`INSERT INTO pinniped_session_labels (resource, signature, name, value) VALUES ($1, $2, $3, $4)`,
+				s.resource, signature, name, value,
+			); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s for signature %s: %w", s.resource, signature, err)
+	}
+	return "1", nil
+}
+
+// Get decodes the stored data into data. When the stored data was revoked by RevokeByLabel, Get still decodes
+// it but returns an error wrapping ErrSecretRevoked, so that callers can detect attempts to use revoked data.
+func (s *sqlStorage) Get(ctx context.Context, signature string, data JSON) (string, error) {
+	var (
+		resourceVersion int64
+		buf             string
+		revoked         bool
+	)
+	err := s.backend.db.QueryRowContext(ctx,
+		`SELECT resource_version, data, revoked FROM pinniped_sessions
+			WHERE resource = $1 AND signature = $2 AND expires_at > $3`,
+		s.resource, signature, s.clock().Unix(),
+	).Scan(&resourceVersion, &buf, &revoked)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = apierrors.NewNotFound(s.groupResource, signature)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get %s for signature %s: %w", s.resource, signature, err)
+	}
+	if err := json.Unmarshal([]byte(buf), data); err != nil {
+		return "", fmt.Errorf("failed to decode %s for signature %s: %w", s.resource, signature, err)
+	}
+	rv := strconv.FormatInt(resourceVersion, 10)
+	if revoked {
+		return rv, fmt.Errorf("%w: %s for signature %s", ErrSecretRevoked, s.resource, signature)
+	}
+	return rv, nil
+}
+
+func (s *sqlStorage) Update(ctx context.Context, signature, resourceVersion string, data JSON) (string, error) {
+	rv, err := strconv.ParseInt(resourceVersion, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("failed to update %s for signature %s: invalid resource version %q", s.resource, signature, resourceVersion)
+	}
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode %s data for signature %s: %w", s.resource, signature, err)
+	}
+	now := s.clock()
+
+	err = s.backend.inTransaction(ctx, func(tx *sql.Tx) error {
+		// Like the Secrets backend, every update extends the lifetime of the data.
+		result, err := tx.ExecContext(ctx,
+			`UPDATE pinniped_sessions SET data = $1, expires_at = $2, resource_version = resource_version + 1
+				WHERE resource = $3 AND signature = $4 AND resource_version = $5 AND expires_at > $6`,
+			string(buf), now.Add(s.lifetime).Unix(), s.resource, signature, rv, now.Unix(),
+		)
+		if err != nil {
+			return err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil || rows == 1 {
+			return err
+		}
+
+		// Nothing was updated, so either the data does not exist or it was changed by someone else.
+		var exists int
+		err = tx.QueryRowContext(ctx,
+			`SELECT 1 FROM pinniped_sessions WHERE resource = $1 AND signature = $2 AND expires_at > $3`,
+			s.resource, signature, now.Unix(),
+		).Scan(&exists)
+		if errors.Is(err, sql.ErrNoRows) {
+			return apierrors.NewNotFound(s.groupResource, signature)
+		}
+		if err != nil {
+			return err
+		}
+		return apierrors.NewConflict(s.groupResource, signature, errors.New("the object has been modified"))
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to update %s for signature %s at resource version %s: %w", s.resource, signature, resourceVersion, err)
+	}
+	return strconv.FormatInt(rv+1, 10), nil
+}
+
+func (s *sqlStorage) Delete(ctx context.Context, signature string) error {
+	var deleted int64
+	err := s.backend.inTransaction(ctx, func(tx *sql.Tx) error {
+		var err error
+		deleted, err = s.deleteRow(ctx, tx, signature, false)
+		return err
+	})
+	if err == nil && deleted == 0 {
+		err = apierrors.NewNotFound(s.groupResource, signature)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete %s for signature %s: %w", s.resource, signature, err)
+	}
+	return nil
+}
+
+func (s *sqlStorage) DeleteByLabel(ctx context.Context, labelName string, labelValue string) error {
+	err := s.backend.inTransaction(ctx, func(tx *sql.Tx) error {
+		signatures, err := s.signaturesWithLabel(ctx, tx, labelName, labelValue, false)
+		if err != nil {
+			return fmt.Errorf(`failed to list %s matching label "%s=%s": %w`, s.resource, labelName, labelValue, err)
+		}
+		if len(signatures) == 0 {
+			return fmt.Errorf(`failed to delete %s matching label "%s=%s": none found`, s.resource, labelName, labelValue)
+		}
+		for _, signature := range signatures {
+			if _, err := s.deleteRow(ctx, tx, signature, false); err != nil {
+				return fmt.Errorf(`failed to delete %s matching label "%s=%s" with signature %s: %w`, s.resource, labelName, labelValue, signature, err)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// RevokeByLabel marks all matching data which is not already revoked as revoked. Unlike DeleteByLabel, the data is
+// kept until it expires, so later attempts to use it can be detected by Get.
+func (s *sqlStorage) RevokeByLabel(ctx context.Context, labelName string, labelValue string) error {
+	err := s.backend.inTransaction(ctx, func(tx *sql.Tx) error {
+		signatures, err := s.signaturesWithLabel(ctx, tx, labelName, labelValue, true)
+		if err != nil {
+			return fmt.Errorf(`failed to list %s matching label "%s=%s": %w`, s.resource, labelName, labelValue, err)
+		}
+		if len(signatures) == 0 {
+			return fmt.Errorf(`failed to revoke %s matching label "%s=%s": none found`, s.resource, labelName, labelValue)
+		}
+		for _, signature := range signatures {
+			if _, err := tx.ExecContext(ctx,
+				`UPDATE pinniped_sessions SET revoked = $1, resource_version = resource_version + 1
+					WHERE resource = $2 AND signature = $3`,
+				true, s.resource, signature,
+			); err != nil {
+				return fmt.Errorf(`failed to revoke %s matching label "%s=%s" with signature %s: %w`, s.resource, labelName, labelValue, signature, err)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// Migrate passes the stored data of each unexpired entry of this resource to migrate, and writes back the data which
+// it returns. Unlike Update, the labels, the lifetime and the revocation of the entries are kept. Entries which are
+// changed or deleted concurrently are skipped, since they were presumably written in the current format. It returns
+// how many entries were changed.
+func (s *sqlStorage) Migrate(ctx context.Context, migrate MigrateFunc) (int, error) {
+	type entry struct {
+		signature       string
+		resourceVersion int64
+		data            string
+	}
+	rows, err := s.backend.db.QueryContext(ctx,
+		`SELECT signature, resource_version, data FROM pinniped_sessions WHERE resource = $1 AND expires_at > $2`,
+		s.resource, s.clock().Unix(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list %s: %w", s.resource, err)
+	}
+	var entries []entry
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.signature, &e.resourceVersion, &e.data); err != nil {
+			_ = rows.Close()
+			return 0, fmt.Errorf("failed to list %s: %w", s.resource, err)
+		}
+		entries = append(entries, e)
+	}
+	// Close the rows before writing, because a database with a single connection cannot do both at once.
+	if err := rows.Close(); err != nil {
+		return 0, fmt.Errorf("failed to list %s: %w", s.resource, err)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to list %s: %w", s.resource, err)
+	}
+
+	migrated := 0
+	var errs []error
+	for _, e := range entries {
+		data, err := migrate([]byte(e.data))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to migrate %s for signature %s: %w", s.resource, e.signature, err))
+			continue
+		}
+		if data == nil {
+			continue
+		}
+		result, err := s.backend.db.ExecContext(ctx,
+			`UPDATE pinniped_sessions SET data = $1, resource_version = resource_version + 1
+				WHERE resource = $2 AND signature = $3 AND resource_version = $4`,
+			string(data), s.resource, e.signature, e.resourceVersion,
+		)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to update %s for signature %s: %w", s.resource, e.signature, err))
+			continue
+		}
+		if rows, err := result.RowsAffected(); err == nil && rows == 1 {
+			migrated++
+		}
+	}
+	return migrated, utilerrors.NewAggregate(errs)
+}
+
+// signaturesWithLabel returns the signatures of the unexpired data which has the given label, optionally only
+// including data which is not revoked yet.
+func (s *sqlStorage) signaturesWithLabel(ctx context.Context, tx *sql.Tx, labelName, labelValue string, onlyUnrevoked bool) ([]string, error) {
+	query := `SELECT l.signature FROM pinniped_session_labels l
+		JOIN pinniped_sessions s ON s.resource = l.resource AND s.signature = l.signature
+		WHERE l.resource = $1 AND l.name = $2 AND l.value = $3 AND s.expires_at > $4`
+	if onlyUnrevoked {
+		query += ` AND NOT s.revoked`
+	}
+	rows, err := tx.QueryContext(ctx, query, s.resource, labelName, labelValue, s.clock().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var signatures []string
+	for rows.Next() {
+		var signature string
+		if err := rows.Scan(&signature); err != nil {
+			return nil, err
+		}
+		signatures = append(signatures, signature)
+	}
+	return signatures, rows.Err()
+}
+
+// deleteRow deletes the data with the given signature along with its labels, and returns how much was deleted.
+// Depending on expired, it only deletes the data when it is expired, or when it is not expired.
+func (s *sqlStorage) deleteRow(ctx context.Context, tx *sql.Tx, signature string, expired bool) (int64, error) {
+	query := `DELETE FROM pinniped_sessions WHERE resource = $1 AND signature = $2 AND expires_at > $3`
+	if expired {
+		query = `DELETE FROM pinniped_sessions WHERE resource = $1 AND signature = $2 AND expires_at <= $3`
+	}
+	result, err := tx.ExecContext(ctx, query, s.resource, signature, s.clock().Unix())
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil || deleted == 0 {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM pinniped_session_labels WHERE resource = $1 AND signature = $2`,
+		s.resource, signature,
+	); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
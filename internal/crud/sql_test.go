@@ -0,0 +1,392 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package crud
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSQLStorage(t *testing.T) {
+	ctx := context.Background()
+
+	type testJSON struct {
+		Data string
+	}
+
+	fakeNow := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	lifetime := time.Minute * 10
+
+	newSubject := func(t *testing.T) (*SQLBackend, *clock.FakeClock, Storage) {
+		db, err := sql.Open("sqlite3", ":memory:")
+		require.NoError(t, err)
+		t.Cleanup(func() { require.NoError(t, db.Close()) })
+		db.SetMaxOpenConns(1)
+
+		backend := NewSQLBackend(db)
+		require.NoError(t, backend.CreateSchema(ctx))
+		// Creating the schema again does nothing.
+		require.NoError(t, backend.CreateSchema(ctx))
+
+		fakeClock := clock.NewFakeClock(fakeNow)
+		return backend, fakeClock, backend.Storage("test-resource", fakeClock.Now, lifetime)
+	}
+
+	t.Run("create, get, update and delete", func(t *testing.T) {
+		_, _, storage := newSubject(t)
+
+		rv1, err := storage.Create(ctx, "sig-1", &testJSON{Data: "first"}, map[string]string{"some-label": "some-value"})
+		require.NoError(t, err)
+		require.Equal(t, "1", rv1)
+
+		var got testJSON
+		rv, err := storage.Get(ctx, "sig-1", &got)
+		require.NoError(t, err)
+		require.Equal(t, rv1, rv)
+		require.Equal(t, "first", got.Data)
+
+		rv2, err := storage.Update(ctx, "sig-1", rv1, &testJSON{Data: "second"})
+		require.NoError(t, err)
+		require.Equal(t, "2", rv2)
+
+		rv, err = storage.Get(ctx, "sig-1", &got)
+		require.NoError(t, err)
+		require.Equal(t, rv2, rv)
+		require.Equal(t, "second", got.Data)
+
+		require.NoError(t, storage.Delete(ctx, "sig-1"))
+		_, err = storage.Get(ctx, "sig-1", &got)
+		require.True(t, apierrors.IsNotFound(err), "expected a not found error, got %v", err)
+	})
+
+	t.Run("resources are stored separately", func(t *testing.T) {
+		backend, fakeClock, storage := newSubject(t)
+		otherStorage := backend.Storage("other-resource", fakeClock.Now, lifetime)
+
+		_, err := storage.Create(ctx, "sig-1", &testJSON{Data: "first"}, nil)
+		require.NoError(t, err)
+		_, err = otherStorage.Create(ctx, "sig-1", &testJSON{Data: "other"}, nil)
+		require.NoError(t, err)
+
+		var got testJSON
+		_, err = otherStorage.Get(ctx, "sig-1", &got)
+		require.NoError(t, err)
+		require.Equal(t, "other", got.Data)
+	})
+
+	t.Run("create when the data already exists", func(t *testing.T) {
+		_, _, storage := newSubject(t)
+
+		_, err := storage.Create(ctx, "sig-1", &testJSON{Data: "first"}, nil)
+		require.NoError(t, err)
+		_, err = storage.Create(ctx, "sig-1", &testJSON{Data: "second"}, nil)
+		require.EqualError(t, err, `failed to create test-resource for signature sig-1: test-resource "sig-1" already exists`)
+		require.True(t, apierrors.IsAlreadyExists(err))
+	})
+
+	t.Run("update at an old resource version", func(t *testing.T) {
+		_, _, storage := newSubject(t)
+
+		rv1, err := storage.Create(ctx, "sig-1", &testJSON{Data: "first"}, nil)
+		require.NoError(t, err)
+		_, err = storage.Update(ctx, "sig-1", rv1, &testJSON{Data: "second"})
+		require.NoError(t, err)
+
+		_, err = storage.Update(ctx, "sig-1", rv1, &testJSON{Data: "conflicting"})
+		require.EqualError(t, err, `failed to update test-resource for signature sig-1 at resource version 1: Operation cannot be fulfilled on test-resource "sig-1": the object has been modified`)
+		require.True(t, apierrors.IsConflict(err))
+	})
+
+	t.Run("update and delete when the data does not exist", func(t *testing.T) {
+		_, _, storage := newSubject(t)
+
+		_, err := storage.Update(ctx, "sig-1", "1", &testJSON{Data: "first"})
+		require.True(t, apierrors.IsNotFound(err), "expected a not found error, got %v", err)
+
+		_, err = storage.Update(ctx, "sig-1", "not-a-number", &testJSON{Data: "first"})
+		require.EqualError(t, err, `failed to update test-resource for signature sig-1: invalid resource version "not-a-number"`)
+
+		err = storage.Delete(ctx, "sig-1")
+		require.EqualError(t, err, `failed to delete test-resource for signature sig-1: test-resource "sig-1" not found`)
+		require.True(t, apierrors.IsNotFound(err))
+	})
+
+	t.Run("expired data is never returned and can be replaced", func(t *testing.T) {
+		_, fakeClock, storage := newSubject(t)
+
+		rv1, err := storage.Create(ctx, "sig-1", &testJSON{Data: "first"}, map[string]string{"some-label": "some-value"})
+		require.NoError(t, err)
+
+		// Updates extend the lifetime.
+		fakeClock.Step(lifetime - time.Second)
+		_, err = storage.Update(ctx, "sig-1", rv1, &testJSON{Data: "second"})
+		require.NoError(t, err)
+		fakeClock.Step(lifetime - time.Second)
+		var got testJSON
+		_, err = storage.Get(ctx, "sig-1", &got)
+		require.NoError(t, err)
+
+		fakeClock.Step(time.Second)
+		_, err = storage.Get(ctx, "sig-1", &got)
+		require.True(t, apierrors.IsNotFound(err), "expected a not found error, got %v", err)
+		_, err = storage.Update(ctx, "sig-1", "2", &testJSON{Data: "third"})
+		require.True(t, apierrors.IsNotFound(err), "expected a not found error, got %v", err)
+		err = storage.DeleteByLabel(ctx, "some-label", "some-value")
+		require.EqualError(t, err, `failed to delete test-resource matching label "some-label=some-value": none found`)
+
+		rv, err := storage.Create(ctx, "sig-1", &testJSON{Data: "new"}, nil)
+		require.NoError(t, err)
+		require.Equal(t, "1", rv)
+		_, err = storage.Get(ctx, "sig-1", &got)
+		require.NoError(t, err)
+		require.Equal(t, "new", got.Data)
+
+		// The labels of the expired data were deleted along with it.
+		err = storage.DeleteByLabel(ctx, "some-label", "some-value")
+		require.EqualError(t, err, `failed to delete test-resource matching label "some-label=some-value": none found`)
+	})
+
+	t.Run("delete expired", func(t *testing.T) {
+		backend, fakeClock, storage := newSubject(t)
+
+		_, err := storage.Create(ctx, "sig-1", &testJSON{Data: "first"}, map[string]string{"some-label": "some-value"})
+		require.NoError(t, err)
+		fakeClock.Step(time.Minute)
+		_, err = storage.Create(ctx, "sig-2", &testJSON{Data: "second"}, map[string]string{"some-label": "some-value"})
+		require.NoError(t, err)
+
+		deleted, err := backend.DeleteExpired(ctx, fakeNow.Add(lifetime))
+		require.NoError(t, err)
+		require.Equal(t, int64(1), deleted)
+
+		deleted, err = backend.DeleteExpired(ctx, fakeNow.Add(lifetime))
+		require.NoError(t, err)
+		require.Equal(t, int64(0), deleted)
+
+		var got testJSON
+		_, err = storage.Get(ctx, "sig-2", &got)
+		require.NoError(t, err)
+
+		var labels int
+		require.NoError(t, backend.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM pinniped_session_labels`).Scan(&labels))
+		require.Equal(t, 1, labels)
+	})
+
+	t.Run("delete by label", func(t *testing.T) {
+		_, _, storage := newSubject(t)
+
+		_, err := storage.Create(ctx, "sig-1", &testJSON{Data: "first"}, map[string]string{"some-label": "some-value"})
+		require.NoError(t, err)
+		_, err = storage.Create(ctx, "sig-2", &testJSON{Data: "second"}, map[string]string{"some-label": "some-value"})
+		require.NoError(t, err)
+		_, err = storage.Create(ctx, "sig-3", &testJSON{Data: "third"}, map[string]string{"some-label": "other-value"})
+		require.NoError(t, err)
+
+		require.NoError(t, storage.DeleteByLabel(ctx, "some-label", "some-value"))
+
+		var got testJSON
+		_, err = storage.Get(ctx, "sig-1", &got)
+		require.True(t, apierrors.IsNotFound(err), "expected a not found error, got %v", err)
+		_, err = storage.Get(ctx, "sig-2", &got)
+		require.True(t, apierrors.IsNotFound(err), "expected a not found error, got %v", err)
+		_, err = storage.Get(ctx, "sig-3", &got)
+		require.NoError(t, err)
+
+		err = storage.DeleteByLabel(ctx, "some-label", "some-value")
+		require.EqualError(t, err, `failed to delete test-resource matching label "some-label=some-value": none found`)
+	})
+
+	t.Run("revoke by label", func(t *testing.T) {
+		_, _, storage := newSubject(t)
+
+		rv1, err := storage.Create(ctx, "sig-1", &testJSON{Data: "first"}, map[string]string{"some-label": "some-value"})
+		require.NoError(t, err)
+		_, err = storage.Create(ctx, "sig-2", &testJSON{Data: "second"}, map[string]string{"some-label": "other-value"})
+		require.NoError(t, err)
+
+		require.NoError(t, storage.RevokeByLabel(ctx, "some-label", "some-value"))
+
+		// Revoked data can still be read, but the caller is told that it was revoked.
+		var got testJSON
+		rv, err := storage.Get(ctx, "sig-1", &got)
+		require.EqualError(t, err, "secret storage data has been revoked: test-resource for signature sig-1")
+		require.True(t, errors.Is(err, ErrSecretRevoked))
+		require.Equal(t, "first", got.Data)
+		require.NotEqual(t, rv1, rv)
+		_, err = storage.Get(ctx, "sig-2", &got)
+		require.NoError(t, err)
+
+		// Data which is already revoked is not revoked again.
+		err = storage.RevokeByLabel(ctx, "some-label", "some-value")
+		require.EqualError(t, err, `failed to revoke test-resource matching label "some-label=some-value": none found`)
+
+		// Revoked data can still be deleted.
+		require.NoError(t, storage.DeleteByLabel(ctx, "some-label", "some-value"))
+		_, err = storage.Get(ctx, "sig-1", &got)
+		require.True(t, apierrors.IsNotFound(err), "expected a not found error, got %v", err)
+	})
+	t.Run("migrate", func(t *testing.T) {
+		_, fakeClock, storage := newSubject(t)
+
+		_, err := storage.Create(ctx, "sig-1", &testJSON{Data: "old"}, map[string]string{"some-label": "some-value"})
+		require.NoError(t, err)
+		_, err = storage.Create(ctx, "sig-2", &testJSON{Data: "current"}, nil)
+		require.NoError(t, err)
+		require.NoError(t, storage.RevokeByLabel(ctx, "some-label", "some-value"))
+		fakeClock.Step(lifetime - time.Second)
+
+		migrated, err := storage.Migrate(ctx, func(data []byte) ([]byte, error) {
+			if string(data) == `{"Data":"old"}` {
+				return []byte(`{"Data":"new"}`), nil
+			}
+			return nil, nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 1, migrated)
+
+		// The data was changed, but it is still revoked and it still expires at the same time.
+		var got testJSON
+		_, err = storage.Get(ctx, "sig-1", &got)
+		require.True(t, errors.Is(err, ErrSecretRevoked))
+		require.Equal(t, "new", got.Data)
+		_, err = storage.Get(ctx, "sig-2", &got)
+		require.NoError(t, err)
+		require.Equal(t, "current", got.Data)
+
+		fakeClock.Step(time.Second)
+		_, err = storage.Get(ctx, "sig-1", &got)
+		require.True(t, apierrors.IsNotFound(err), "expected a not found error, got %v", err)
+
+		// Expired data is not migrated.
+		migrated, err = storage.Migrate(ctx, func(data []byte) ([]byte, error) {
+			return nil, errors.New("should not be called")
+		})
+		require.NoError(t, err)
+		require.Equal(t, 0, migrated)
+	})
+
+	t.Run("migrate when migrating some of the data fails", func(t *testing.T) {
+		_, _, storage := newSubject(t)
+
+		_, err := storage.Create(ctx, "sig-1", &testJSON{Data: "bad"}, nil)
+		require.NoError(t, err)
+		_, err = storage.Create(ctx, "sig-2", &testJSON{Data: "good"}, nil)
+		require.NoError(t, err)
+
+		migrated, err := storage.Migrate(ctx, func(data []byte) ([]byte, error) {
+			if string(data) == `{"Data":"bad"}` {
+				return nil, errors.New("some error")
+			}
+			return []byte(`{"Data":"migrated"}`), nil
+		})
+		require.EqualError(t, err, "failed to migrate test-resource for signature sig-1: some error")
+		require.Equal(t, 1, migrated)
+	})
+}
+
+func TestBackendListAndDeleteEntry(t *testing.T) {
+	ctx := context.Background()
+	fakeNow := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	lifetime := time.Minute * 10
+
+	newSQLBackend := func(t *testing.T) Backend {
+		db, err := sql.Open("sqlite3", ":memory:")
+		require.NoError(t, err)
+		t.Cleanup(func() { require.NoError(t, db.Close()) })
+		db.SetMaxOpenConns(1)
+		backend := NewSQLBackend(db)
+		require.NoError(t, backend.CreateSchema(ctx))
+		// Read several pages, including a last page which is empty.
+		backend.listPageSize = 2
+		return backend
+	}
+	newSecretsBackend := func(t *testing.T) Backend {
+		return NewSecretsBackend(fake.NewSimpleClientset().CoreV1().Secrets("some-namespace"))
+	}
+
+	for name, newBackend := range map[string]func(t *testing.T) Backend{"secrets": newSecretsBackend, "sql": newSQLBackend} {
+		newBackend := newBackend
+		t.Run(name, func(t *testing.T) {
+			backend := newBackend(t)
+			fakeClock := clock.NewFakeClock(fakeNow)
+			storageA := backend.Storage("resource-a", fakeClock.Now, lifetime)
+			storageB := backend.Storage("resource-b", fakeClock.Now, 2*lifetime)
+
+			_, err := storageA.Create(ctx, "sig-1", map[string]string{"data": "a1"}, map[string]string{"color": "red", "size": "big"})
+			require.NoError(t, err)
+			_, err = storageA.Create(ctx, "sig-2", map[string]string{"data": "a2"}, map[string]string{"color": "blue"})
+			require.NoError(t, err)
+			_, err = storageB.Create(ctx, "sig-3", map[string]string{"data": "b3"}, map[string]string{"color": "red"})
+			require.NoError(t, err)
+			require.NoError(t, storageA.RevokeByLabel(ctx, "color", "blue"))
+
+			list := func(t *testing.T, selector Selector) map[string]Entry {
+				t.Helper()
+				entries, err := backend.List(ctx, selector)
+				require.NoError(t, err)
+				byData := map[string]Entry{}
+				for _, entry := range entries {
+					var data map[string]string
+					require.NoError(t, json.Unmarshal(entry.Data, &data))
+					byData[data["data"]] = entry
+				}
+				require.Len(t, byData, len(entries))
+				return byData
+			}
+
+			all := list(t, Selector{})
+			require.Len(t, all, 3)
+			require.Equal(t, "resource-a", all["a1"].Resource)
+			require.Equal(t, "red", all["a1"].Labels["color"])
+			require.Equal(t, "big", all["a1"].Labels["size"])
+			require.False(t, all["a1"].Revoked)
+			require.True(t, all["a2"].Revoked)
+			require.Equal(t, "resource-b", all["b3"].Resource)
+			require.Equal(t, fakeNow.Add(lifetime), all["a1"].ExpiresAt)
+			require.Equal(t, fakeNow.Add(2*lifetime), all["b3"].ExpiresAt)
+
+			require.ElementsMatch(t, []string{"a1", "a2"}, keys(list(t, Selector{Resources: []string{"resource-a"}})))
+			require.ElementsMatch(t, []string{"a1", "a2", "b3"}, keys(list(t, Selector{Resources: []string{"resource-a", "resource-b"}})))
+			require.ElementsMatch(t, []string{"a1", "b3"}, keys(list(t, Selector{Unrevoked: true})))
+			require.ElementsMatch(t, []string{"a1", "b3"}, keys(list(t, Selector{Labels: map[string]string{"color": "red"}})))
+			require.ElementsMatch(t, []string{"a1"}, keys(list(t, Selector{Resources: []string{"resource-a"}, Labels: map[string]string{"color": "red"}})))
+			require.Empty(t, list(t, Selector{Labels: map[string]string{"color": "red", "size": "small"}}))
+			require.Empty(t, list(t, Selector{Resources: []string{"resource-c"}}))
+
+			_, err = backend.List(ctx, Selector{Labels: map[string]string{"color": "not a valid label value"}})
+			if name == "secrets" {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			require.NoError(t, backend.DeleteEntry(ctx, all["a1"]))
+			require.ElementsMatch(t, []string{"a2", "b3"}, keys(list(t, Selector{})))
+			var got map[string]string
+			_, err = storageA.Get(ctx, "sig-1", &got)
+			require.True(t, apierrors.IsNotFound(err), "expected a not found error, got %v", err)
+
+			err = backend.DeleteEntry(ctx, all["a1"])
+			require.True(t, apierrors.IsNotFound(err), "expected a not found error, got %v", err)
+		})
+	}
+}
+
+func keys(entries map[string]Entry) []string {
+	var k []string
+	for key := range entries {
+		k = append(k, key)
+	}
+	return k
+}
@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package accesstoken
@@ -10,13 +10,12 @@ import (
 
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/handler/oauth2"
-	"github.com/ory/fosite/handler/openid"
 	"k8s.io/apimachinery/pkg/api/errors"
-	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 
 	"go.pinniped.dev/internal/constable"
 	"go.pinniped.dev/internal/crud"
 	"go.pinniped.dev/internal/fositestorage"
+	"go.pinniped.dev/internal/psession"
 )
 
 const (
@@ -25,7 +24,8 @@ const (
 	ErrInvalidAccessTokenRequestVersion = constable.Error("access token request data has wrong version")
 	ErrInvalidAccessTokenRequestData    = constable.Error("access token request data must be present")
 
-	accessTokenStorageVersion = "1"
+	// The version of the stored sessions. Sessions which were stored in an older version are upgraded by Migrations.
+	accessTokenStorageVersion = "2"
 )
 
 type RevocationStorage interface {
@@ -44,8 +44,14 @@ type session struct {
 	Version string          `json:"version"`
 }
 
-func New(secrets corev1client.SecretInterface, clock func() time.Time, sessionStorageLifetime time.Duration) RevocationStorage {
-	return &accessTokenStorage{storage: crud.New(TypeLabelValue, secrets, clock, sessionStorageLifetime)}
+func New(backend crud.Backend, clock func() time.Time, sessionStorageLifetime time.Duration) RevocationStorage {
+	return &accessTokenStorage{storage: Migrations().Storage(backend.Storage(TypeLabelValue, clock, sessionStorageLifetime))}
+}
+
+// Migrations upgrades the sessions which were stored by older versions of the Supervisor.
+func Migrations() *fositestorage.Migrations {
+	return fositestorage.NewMigrations(TypeLabelValue, accessTokenStorageVersion).
+		Register("1", "2", fositestorage.MigrateRequestSessionToPinnipedSession)
 }
 
 func (a *accessTokenStorage) RevokeAccessToken(ctx context.Context, requestID string) error {
@@ -62,7 +68,7 @@ func (a *accessTokenStorage) CreateAccessTokenSession(ctx context.Context, signa
 		ctx,
 		signature,
 		&session{Request: request, Version: accessTokenStorageVersion},
-		map[string]string{fositestorage.StorageRequestIDLabelName: requester.GetID()},
+		fositestorage.SessionLabels(request),
 	)
 	return err
 }
@@ -109,7 +115,7 @@ func newValidEmptyAccessTokenSession() *session {
 	return &session{
 		Request: &fosite.Request{
 			Client:  &fosite.DefaultOpenIDConnectClient{},
-			Session: &openid.DefaultSession{},
+			Session: psession.NewPinnipedSession(),
 		},
 	}
 }
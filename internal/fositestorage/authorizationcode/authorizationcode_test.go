@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package authorizationcode
@@ -32,7 +32,10 @@ import (
 	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	kubetesting "k8s.io/client-go/testing"
 
+	"go.pinniped.dev/internal/crud"
 	"go.pinniped.dev/internal/fositestorage"
+	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/testutil/storagebackends"
 )
 
 const namespace = "test-ns"
@@ -54,33 +57,42 @@ func TestAuthorizationCodeStorage(t *testing.T) {
 				Name:            "pinniped-storage-authcode-pwu5zs7lekbhnln2w4",
 				ResourceVersion: "",
 				Labels: map[string]string{
-					"storage.pinniped.dev/type": "authcode",
+					"storage.pinniped.dev/type":          "authcode",
+					"storage.pinniped.dev/request-id":    "abcd-1",
+					"storage.pinniped.dev/subject":       "u7g7lucynm4si465btiizg5igmsaabviu4yqx6n4rpy257p25lnq",
+					"storage.pinniped.dev/username":      "uxvahoxcijvg7zqxahw4mv3nbzsjd2my7hntzm4m5fl4cfiwzz2a",
+					"storage.pinniped.dev/upstream-name": "gm2wpl7432tcwmpdkwhzlku7mn2xxeb4ovwmqcwndlmmbcyxpwfa",
 				},
 				Annotations: map[string]string{
 					"storage.pinniped.dev/garbage-collect-after": fakeNowPlusLifetimeAsString,
 				},
 			},
 			Data: map[string][]byte{
-				"pinniped-storage-data":    []byte(`{"active":true,"request":{"id":"abcd-1","requestedAt":"0001-01-01T00:00:00Z","client":{"id":"pinny","redirect_uris":null,"grant_types":null,"response_types":null,"scopes":null,"audience":null,"public":true,"jwks_uri":"where","jwks":null,"token_endpoint_auth_method":"something","request_uris":null,"request_object_signing_alg":"","token_endpoint_auth_signing_alg":""},"scopes":null,"grantedScopes":null,"form":{"key":["val"]},"session":{"Claims":null,"Headers":null,"ExpiresAt":null,"Username":"snorlax","Subject":"panda"},"requestedAudience":null,"grantedAudience":null},"version":"1"}`),
+				"pinniped-storage-data":    []byte(`{"active":true,"request":{"id":"abcd-1","requestedAt":"0001-01-01T00:00:00Z","client":{"id":"pinny","redirect_uris":null,"grant_types":null,"response_types":null,"scopes":null,"audience":null,"public":true,"jwks_uri":"where","jwks":null,"token_endpoint_auth_method":"something","request_uris":null,"request_object_signing_alg":"","token_endpoint_auth_signing_alg":""},"scopes":null,"grantedScopes":null,"form":{"key":["val"]},"session":{"fosite":{"Claims":null,"Headers":null,"ExpiresAt":null,"Username":"snorlax","Subject":"panda"},"custom":{"providerName":"fake-upstream-idp"}},"requestedAudience":null,"grantedAudience":null},"version":"2"}`),
 				"pinniped-storage-version": []byte("1"),
 			},
 			Type: "storage.pinniped.dev/authcode",
 		}),
 		kubetesting.NewGetAction(secretsGVR, namespace, "pinniped-storage-authcode-pwu5zs7lekbhnln2w4"),
 		kubetesting.NewGetAction(secretsGVR, namespace, "pinniped-storage-authcode-pwu5zs7lekbhnln2w4"),
+		kubetesting.NewGetAction(secretsGVR, namespace, "pinniped-storage-authcode-pwu5zs7lekbhnln2w4"),
 		kubetesting.NewUpdateAction(secretsGVR, namespace, &corev1.Secret{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:            "pinniped-storage-authcode-pwu5zs7lekbhnln2w4",
 				ResourceVersion: "",
 				Labels: map[string]string{
-					"storage.pinniped.dev/type": "authcode",
+					"storage.pinniped.dev/type":          "authcode",
+					"storage.pinniped.dev/request-id":    "abcd-1",
+					"storage.pinniped.dev/subject":       "u7g7lucynm4si465btiizg5igmsaabviu4yqx6n4rpy257p25lnq",
+					"storage.pinniped.dev/username":      "uxvahoxcijvg7zqxahw4mv3nbzsjd2my7hntzm4m5fl4cfiwzz2a",
+					"storage.pinniped.dev/upstream-name": "gm2wpl7432tcwmpdkwhzlku7mn2xxeb4ovwmqcwndlmmbcyxpwfa",
 				},
 				Annotations: map[string]string{
 					"storage.pinniped.dev/garbage-collect-after": fakeNowPlusLifetimeAsString,
 				},
 			},
 			Data: map[string][]byte{
-				"pinniped-storage-data":    []byte(`{"active":false,"request":{"id":"abcd-1","requestedAt":"0001-01-01T00:00:00Z","client":{"id":"pinny","redirect_uris":null,"grant_types":null,"response_types":null,"scopes":null,"audience":null,"public":true,"jwks_uri":"where","jwks":null,"token_endpoint_auth_method":"something","request_uris":null,"request_object_signing_alg":"","token_endpoint_auth_signing_alg":""},"scopes":null,"grantedScopes":null,"form":{"key":["val"]},"session":{"Claims":null,"Headers":null,"ExpiresAt":null,"Username":"snorlax","Subject":"panda"},"requestedAudience":null,"grantedAudience":null},"version":"1"}`),
+				"pinniped-storage-data":    []byte(`{"active":false,"request":{"id":"abcd-1","requestedAt":"0001-01-01T00:00:00Z","client":{"id":"pinny","redirect_uris":null,"grant_types":null,"response_types":null,"scopes":null,"audience":null,"public":true,"jwks_uri":"where","jwks":null,"token_endpoint_auth_method":"something","request_uris":null,"request_object_signing_alg":"","token_endpoint_auth_signing_alg":""},"scopes":null,"grantedScopes":null,"form":{"key":["val"]},"session":{"fosite":{"Claims":null,"Headers":null,"ExpiresAt":null,"Username":"snorlax","Subject":"panda"},"custom":{"providerName":"fake-upstream-idp"}},"requestedAudience":null,"grantedAudience":null},"version":"2"}`),
 				"pinniped-storage-version": []byte("1"),
 			},
 			Type: "storage.pinniped.dev/authcode",
@@ -113,12 +125,17 @@ func TestAuthorizationCodeStorage(t *testing.T) {
 		RequestedScope: nil,
 		GrantedScope:   nil,
 		Form:           url.Values{"key": []string{"val"}},
-		Session: &openid.DefaultSession{
-			Claims:    nil,
-			Headers:   nil,
-			ExpiresAt: nil,
-			Username:  "snorlax",
-			Subject:   "panda",
+		Session: &psession.PinnipedSession{
+			Fosite: &openid.DefaultSession{
+				Claims:    nil,
+				Headers:   nil,
+				ExpiresAt: nil,
+				Username:  "snorlax",
+				Subject:   "panda",
+			},
+			Custom: &psession.CustomSessionData{
+				ProviderName: "fake-upstream-idp",
+			},
 		},
 		RequestedAudience: nil,
 		GrantedAudience:   nil,
@@ -141,20 +158,105 @@ func TestAuthorizationCodeStorage(t *testing.T) {
 	require.Equal(t, "abcd-1", invalidatedRequest.GetID())
 }
 
-func TestGetNotFound(t *testing.T) {
-	ctx, _, _, storage := makeTestSubject()
+func TestAuthorizationCodeStorageWithAllBackends(t *testing.T) {
+	for _, backend := range storagebackends.All(t) {
+		backend := backend
+		t.Run(backend.Name, func(t *testing.T) {
+			ctx, storage := makeTestSubjectWithBackend(backend)
+
+			request := &fosite.Request{
+				ID: "abcd-1",
+				Client: &fosite.DefaultOpenIDConnectClient{
+					DefaultClient: &fosite.DefaultClient{ID: "pinny", Public: true},
+				},
+				Form: url.Values{"key": []string{"val"}},
+				Session: &psession.PinnipedSession{
+					Fosite: &openid.DefaultSession{Username: "snorlax", Subject: "panda"},
+					Custom: &psession.CustomSessionData{ProviderName: "fake-upstream-idp"},
+				},
+			}
+			require.NoError(t, storage.CreateAuthorizeCodeSession(ctx, "fancy-signature", request))
 
-	_, notFoundErr := storage.GetAuthorizeCodeSession(ctx, "non-existent-signature", nil)
-	require.EqualError(t, notFoundErr, "not_found")
-	require.True(t, errors.Is(notFoundErr, fosite.ErrNotFound))
+			newRequest, err := storage.GetAuthorizeCodeSession(ctx, "fancy-signature", nil)
+			require.NoError(t, err)
+			require.Equal(t, request, newRequest)
+
+			// An invalidated authorization code still returns its request, so that reuse can be detected.
+			require.NoError(t, storage.InvalidateAuthorizeCodeSession(ctx, "fancy-signature"))
+			invalidatedRequest, err := storage.GetAuthorizeCodeSession(ctx, "fancy-signature", nil)
+			require.True(t, errors.Is(err, fosite.ErrInvalidatedAuthorizeCode))
+			require.Equal(t, request, invalidatedRequest)
+		})
+	}
 }
 
-func TestInvalidateWhenNotFound(t *testing.T) {
-	ctx, _, _, storage := makeTestSubject()
+func TestUpgradeFromVersion1(t *testing.T) {
+	for _, backend := range storagebackends.All(t) {
+		backend := backend
+		t.Run(backend.Name, func(t *testing.T) {
+			ctx, storage := makeTestSubjectWithBackend(backend)
+
+			// Version 1 stored the fosite session directly instead of wrapping it in a PinnipedSession.
+			_, err := backend.Storage(TypeLabelValue, clock.NewFakeClock(fakeNow).Now, lifetime).Create(ctx, "fancy-signature",
+				json.RawMessage(`{"active":true,"request":{"id":"abcd-1","requestedAt":"0001-01-01T00:00:00Z","client":{"id":"pinny","redirect_uris":null,"grant_types":null,"response_types":null,"scopes":null,"audience":null,"public":true,"jwks_uri":"","jwks":null,"token_endpoint_auth_method":"","request_uris":null,"request_object_signing_alg":"","token_endpoint_auth_signing_alg":""},"scopes":null,"grantedScopes":null,"form":{"key":["val"]},"session":{"Claims":null,"Headers":null,"ExpiresAt":null,"Username":"snorlax","Subject":"panda"},"requestedAudience":null,"grantedAudience":null},"version":"1"}`),
+				map[string]string{fositestorage.StorageRequestIDLabelName: "abcd-1"},
+			)
+			require.NoError(t, err)
+
+			wantRequest := &fosite.Request{
+				ID: "abcd-1",
+				Client: &fosite.DefaultOpenIDConnectClient{
+					DefaultClient: &fosite.DefaultClient{ID: "pinny", Public: true},
+				},
+				Form: url.Values{"key": []string{"val"}},
+				Session: &psession.PinnipedSession{
+					Fosite: &openid.DefaultSession{Username: "snorlax", Subject: "panda"},
+					Custom: &psession.CustomSessionData{},
+				},
+			}
+
+			request, err := storage.GetAuthorizeCodeSession(ctx, "fancy-signature", nil)
+			require.NoError(t, err)
+			require.Equal(t, wantRequest, request)
 
-	notFoundErr := storage.InvalidateAuthorizeCodeSession(ctx, "non-existent-signature")
-	require.EqualError(t, notFoundErr, "not_found")
-	require.True(t, errors.Is(notFoundErr, fosite.ErrNotFound))
+			// Invalidating the authorization code writes the session in the current version.
+			require.NoError(t, storage.InvalidateAuthorizeCodeSession(ctx, "fancy-signature"))
+			request, err = storage.GetAuthorizeCodeSession(ctx, "fancy-signature", nil)
+			require.True(t, errors.Is(err, fosite.ErrInvalidatedAuthorizeCode))
+			require.Equal(t, wantRequest, request)
+
+			stored := NewValidEmptyAuthorizeCodeSession()
+			_, err = backend.Storage(TypeLabelValue, clock.NewFakeClock(fakeNow).Now, lifetime).Get(ctx, "fancy-signature", stored)
+			require.NoError(t, err)
+			require.Equal(t, authorizeCodeStorageVersion, stored.Version)
+		})
+	}
+}
+
+func TestGetNotFound(t *testing.T) {
+	for _, backend := range storagebackends.All(t) {
+		backend := backend
+		t.Run(backend.Name, func(t *testing.T) {
+			ctx, storage := makeTestSubjectWithBackend(backend)
+
+			_, notFoundErr := storage.GetAuthorizeCodeSession(ctx, "non-existent-signature", nil)
+			require.EqualError(t, notFoundErr, "not_found")
+			require.True(t, errors.Is(notFoundErr, fosite.ErrNotFound))
+		})
+	}
+}
+
+func TestInvalidateWhenNotFound(t *testing.T) {
+	for _, backend := range storagebackends.All(t) {
+		backend := backend
+		t.Run(backend.Name, func(t *testing.T) {
+			ctx, storage := makeTestSubjectWithBackend(backend)
+
+			notFoundErr := storage.InvalidateAuthorizeCodeSession(ctx, "non-existent-signature")
+			require.EqualError(t, notFoundErr, "not_found")
+			require.True(t, errors.Is(notFoundErr, fosite.ErrNotFound))
+		})
+	}
 }
 
 func TestInvalidateWhenConflictOnUpdateHappens(t *testing.T) {
@@ -170,7 +272,7 @@ func TestInvalidateWhenConflictOnUpdateHappens(t *testing.T) {
 	request := &fosite.Request{
 		ID:      "some-request-id",
 		Client:  &fosite.DefaultOpenIDConnectClient{},
-		Session: &openid.DefaultSession{},
+		Session: psession.NewPinnipedSession(),
 	}
 	err := storage.CreateAuthorizeCodeSession(ctx, "fancy-signature", request)
 	require.NoError(t, err)
@@ -190,7 +292,7 @@ func TestWrongVersion(t *testing.T) {
 			},
 		},
 		Data: map[string][]byte{
-			"pinniped-storage-data":    []byte(`{"request":{"id":"abcd-1","requestedAt":"0001-01-01T00:00:00Z","client":{"id":"pinny","redirect_uris":null,"grant_types":null,"response_types":null,"scopes":null,"audience":null,"public":true,"jwks_uri":"where","jwks":null,"token_endpoint_auth_method":"something","request_uris":null,"request_object_signing_alg":"","token_endpoint_auth_signing_alg":""},"scopes":null,"grantedScopes":null,"form":{"key":["val"]},"session":{"Claims":null,"Headers":null,"ExpiresAt":null,"Username":"snorlax","Subject":"panda"},"requestedAudience":null,"grantedAudience":null},"version":"not-the-right-version", "active": true}`),
+			"pinniped-storage-data":    []byte(`{"request":{"id":"abcd-1","requestedAt":"0001-01-01T00:00:00Z","client":{"id":"pinny","redirect_uris":null,"grant_types":null,"response_types":null,"scopes":null,"audience":null,"public":true,"jwks_uri":"where","jwks":null,"token_endpoint_auth_method":"something","request_uris":null,"request_object_signing_alg":"","token_endpoint_auth_signing_alg":""},"scopes":null,"grantedScopes":null,"form":{"key":["val"]},"session":{"fosite":{"Claims":null,"Headers":null,"ExpiresAt":null,"Username":"snorlax","Subject":"panda"},"custom":{"providerName":"fake-upstream-idp"}},"requestedAudience":null,"grantedAudience":null},"version":"not-the-right-version", "active": true}`),
 			"pinniped-storage-version": []byte("1"),
 		},
 		Type: "storage.pinniped.dev/authcode",
@@ -200,7 +302,7 @@ func TestWrongVersion(t *testing.T) {
 
 	_, err = storage.GetAuthorizeCodeSession(ctx, "fancy-signature", nil)
 
-	require.EqualError(t, err, "authorization request data has wrong version: authorization code session for fancy-signature has version not-the-right-version instead of 1")
+	require.EqualError(t, err, "authorization request data has wrong version: authorization code session for fancy-signature has version not-the-right-version instead of 2")
 }
 
 func TestNilSessionRequest(t *testing.T) {
@@ -215,7 +317,7 @@ func TestNilSessionRequest(t *testing.T) {
 			},
 		},
 		Data: map[string][]byte{
-			"pinniped-storage-data":    []byte(`{"nonsense-key": "nonsense-value", "version":"1", "active": true}`),
+			"pinniped-storage-data":    []byte(`{"nonsense-key": "nonsense-value", "version":"2", "active": true}`),
 			"pinniped-storage-version": []byte("1"),
 		},
 		Type: "storage.pinniped.dev/authcode",
@@ -229,34 +331,48 @@ func TestNilSessionRequest(t *testing.T) {
 }
 
 func TestCreateWithNilRequester(t *testing.T) {
-	ctx, _, _, storage := makeTestSubject()
-
-	err := storage.CreateAuthorizeCodeSession(ctx, "signature-doesnt-matter", nil)
-	require.EqualError(t, err, "requester must be of type fosite.Request")
+	for _, backend := range storagebackends.All(t) {
+		backend := backend
+		t.Run(backend.Name, func(t *testing.T) {
+			ctx, storage := makeTestSubjectWithBackend(backend)
+
+			err := storage.CreateAuthorizeCodeSession(ctx, "signature-doesnt-matter", nil)
+			require.EqualError(t, err, "requester must be of type fosite.Request")
+		})
+	}
 }
 
 func TestCreateWithWrongRequesterDataTypes(t *testing.T) {
-	ctx, _, _, storage := makeTestSubject()
-
-	request := &fosite.Request{
-		Session: nil,
-		Client:  &fosite.DefaultOpenIDConnectClient{},
-	}
-	err := storage.CreateAuthorizeCodeSession(ctx, "signature-doesnt-matter", request)
-	require.EqualError(t, err, "requester's session must be of type openid.DefaultSession")
+	for _, backend := range storagebackends.All(t) {
+		backend := backend
+		t.Run(backend.Name, func(t *testing.T) {
+			ctx, storage := makeTestSubjectWithBackend(backend)
+
+			request := &fosite.Request{
+				Session: nil,
+				Client:  &fosite.DefaultOpenIDConnectClient{},
+			}
+			err := storage.CreateAuthorizeCodeSession(ctx, "signature-doesnt-matter", request)
+			require.EqualError(t, err, "requester's session must be of type PinnipedSession")
 
-	request = &fosite.Request{
-		Session: &openid.DefaultSession{},
-		Client:  nil,
+			request = &fosite.Request{
+				Session: psession.NewPinnipedSession(),
+				Client:  nil,
+			}
+			err = storage.CreateAuthorizeCodeSession(ctx, "signature-doesnt-matter", request)
+			require.EqualError(t, err, "requester's client must be of type fosite.DefaultOpenIDConnectClient")
+		})
 	}
-	err = storage.CreateAuthorizeCodeSession(ctx, "signature-doesnt-matter", request)
-	require.EqualError(t, err, "requester's client must be of type fosite.DefaultOpenIDConnectClient")
 }
 
 func makeTestSubject() (context.Context, *fake.Clientset, corev1client.SecretInterface, oauth2.AuthorizeCodeStorage) {
 	client := fake.NewSimpleClientset()
 	secrets := client.CoreV1().Secrets(namespace)
-	return context.Background(), client, secrets, New(secrets, clock.NewFakeClock(fakeNow).Now, lifetime)
+	return context.Background(), client, secrets, New(crud.NewSecretsBackend(secrets), clock.NewFakeClock(fakeNow).Now, lifetime)
+}
+
+func makeTestSubjectWithBackend(backend crud.Backend) (context.Context, oauth2.AuthorizeCodeStorage) {
+	return context.Background(), New(backend, clock.NewFakeClock(fakeNow).Now, lifetime)
 }
 
 // TestFuzzAndJSONNewValidEmptyAuthorizeCodeSession asserts that we can correctly round trip our authorize code session.
@@ -271,7 +387,7 @@ func TestFuzzAndJSONNewValidEmptyAuthorizeCodeSession(t *testing.T) {
 
 	// checked above
 	defaultClient := validSession.Request.Client.(*fosite.DefaultOpenIDConnectClient)
-	defaultSession := validSession.Request.Session.(*openid.DefaultSession)
+	pinnipedSession := validSession.Request.Session.(*psession.PinnipedSession)
 
 	// makes it easier to use a raw string
 	replacer := strings.NewReplacer("`", "a")
@@ -294,12 +410,12 @@ func TestFuzzAndJSONNewValidEmptyAuthorizeCodeSession(t *testing.T) {
 			*fc = defaultClient
 		},
 		func(fs *fosite.Session, c fuzz.Continue) {
-			c.Fuzz(defaultSession)
-			*fs = defaultSession
+			c.Fuzz(pinnipedSession)
+			*fs = pinnipedSession
 		},
 
 		// these types contain an interface{} that we need to handle
-		// this is safe because we explicitly provide the openid.DefaultSession concrete type
+		// this is safe because we explicitly provide the psession.PinnipedSession concrete type
 		func(value *map[string]interface{}, c fuzz.Continue) {
 			// cover all the JSON data types just in case
 			*value = map[string]interface{}{
@@ -359,7 +475,7 @@ func TestFuzzAndJSONNewValidEmptyAuthorizeCodeSession(t *testing.T) {
 	const name = "fuzz" // value is irrelevant
 	ctx := context.Background()
 	secrets := fake.NewSimpleClientset().CoreV1().Secrets(name)
-	storage := New(secrets, func() time.Time { return fakeNow }, lifetime)
+	storage := New(crud.NewSecretsBackend(secrets), func() time.Time { return fakeNow }, lifetime)
 
 	// issue a create using the fuzzed request to confirm that marshalling works
 	err = storage.CreateAuthorizeCodeSession(ctx, name, validSession.Request)
@@ -379,7 +495,7 @@ func TestFuzzAndJSONNewValidEmptyAuthorizeCodeSession(t *testing.T) {
 
 	// set these to match CreateAuthorizeCodeSession so that .JSONEq works
 	validSession.Active = true
-	validSession.Version = "1"
+	validSession.Version = "2"
 
 	validSessionJSONBytes, err := json.MarshalIndent(validSession, "", "\t")
 	require.NoError(t, err)
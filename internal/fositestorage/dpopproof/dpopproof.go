@@ -0,0 +1,57 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package dpopproof
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"time"
+
+	"go.pinniped.dev/internal/crud"
+)
+
+const (
+	TypeLabelValue = "dpop-proof"
+
+	dpopProofStorageVersion = "1"
+)
+
+// Storage records the DPoP proofs which were already used, so that they cannot be replayed, as recommended by
+// https://datatracker.ietf.org/doc/html/rfc9449#section-11.1. It is backed by the session storage, so that a proof
+// which was used with one Supervisor pod is also rejected by the others.
+type Storage interface {
+	// CreateDPoPProof records the use of the proof with the given jti claim, which was signed by the key with the
+	// given JWK thumbprint. When the proof was already used, it returns an error for which IsAlreadyExists from
+	// k8s.io/apimachinery/pkg/api/errors returns true.
+	CreateDPoPProof(ctx context.Context, jkt string, jti string) error
+}
+
+var _ Storage = &dpopProofStorage{}
+
+type dpopProofStorage struct {
+	storage crud.Storage
+}
+
+type session struct {
+	Version string `json:"version"`
+}
+
+// New returns a Storage which remembers each proof for the given lifetime, which must be at least as long as a
+// proof is accepted.
+func New(backend crud.Backend, clock func() time.Time, lifetime time.Duration) Storage {
+	return &dpopProofStorage{storage: backend.Storage(TypeLabelValue, clock, lifetime)}
+}
+
+func (d *dpopProofStorage) CreateDPoPProof(ctx context.Context, jkt string, jti string) error {
+	_, err := d.storage.Create(ctx, signature(jkt, jti), &session{Version: dpopProofStorageVersion}, nil)
+	return err
+}
+
+// signature returns a fixed size signature for the proof, because the jti is chosen by the client. The jti only
+// needs to be unique for each key, so the thumbprint of the key is included.
+func signature(jkt string, jti string) string {
+	sum := sha256.Sum256([]byte(jkt + ":" + jti))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
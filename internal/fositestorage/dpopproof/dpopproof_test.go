@@ -0,0 +1,82 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package dpopproof
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/kubernetes/fake"
+	coretesting "k8s.io/client-go/testing"
+
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/testutil/storagebackends"
+)
+
+const namespace = "test-ns"
+
+var fakeNow = time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+var lifetime = time.Minute * 6
+var fakeNowPlusLifetimeAsString = metav1.Time{Time: fakeNow.Add(lifetime)}.Format(time.RFC3339)
+
+func TestDPoPProofStorage(t *testing.T) {
+	secretsGVR := schema.GroupVersionResource{
+		Group:    "",
+		Version:  "v1",
+		Resource: "secrets",
+	}
+
+	wantActions := []coretesting.Action{
+		coretesting.NewCreateAction(secretsGVR, namespace, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "pinniped-storage-dpop-proof-7h6cbrq5uwt447r2qpue4cx4x5rpju5pjkvbmycmkzryk7shm3ya",
+				ResourceVersion: "",
+				Labels: map[string]string{
+					"storage.pinniped.dev/type": "dpop-proof",
+				},
+				Annotations: map[string]string{
+					"storage.pinniped.dev/garbage-collect-after": fakeNowPlusLifetimeAsString,
+				},
+			},
+			Data: map[string][]byte{
+				"pinniped-storage-data":    []byte(`{"version":"1"}`),
+				"pinniped-storage-version": []byte("1"),
+			},
+			Type: "storage.pinniped.dev/dpop-proof",
+		}),
+	}
+
+	client := fake.NewSimpleClientset()
+	storage := New(crud.NewSecretsBackend(client.CoreV1().Secrets(namespace)), clock.NewFakeClock(fakeNow).Now, lifetime)
+
+	require.NoError(t, storage.CreateDPoPProof(context.Background(), "some-jkt", "some-jti"))
+	require.Equal(t, wantActions, client.Actions())
+}
+
+func TestCreateDPoPProofTwice(t *testing.T) {
+	for _, backend := range storagebackends.All(t) {
+		backend := backend
+		t.Run(backend.Name, func(t *testing.T) {
+			ctx := context.Background()
+			storage := New(backend, clock.NewFakeClock(fakeNow).Now, lifetime)
+
+			require.NoError(t, storage.CreateDPoPProof(ctx, "some-jkt", "some-jti"))
+
+			err := storage.CreateDPoPProof(ctx, "some-jkt", "some-jti")
+			require.Error(t, err)
+			require.True(t, apierrors.IsAlreadyExists(err), "wrong error: %v", err)
+
+			// The jti only needs to be unique for each key.
+			require.NoError(t, storage.CreateDPoPProof(ctx, "some-other-jkt", "some-jti"))
+			require.NoError(t, storage.CreateDPoPProof(ctx, "some-jkt", "some-other-jti"))
+		})
+	}
+}
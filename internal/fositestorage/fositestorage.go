@@ -1,20 +1,35 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package fositestorage
 
 import (
+	"crypto/sha256"
+	"encoding/base32"
+	"strings"
+
 	"github.com/ory/fosite"
-	"github.com/ory/fosite/handler/openid"
 
 	"go.pinniped.dev/internal/constable"
+	"go.pinniped.dev/internal/psession"
 )
 
 const (
 	ErrInvalidRequestType     = constable.Error("requester must be of type fosite.Request")
 	ErrInvalidClientType      = constable.Error("requester's client must be of type fosite.DefaultOpenIDConnectClient")
-	ErrInvalidSessionType     = constable.Error("requester's session must be of type openid.DefaultSession")
+	ErrInvalidSessionType     = constable.Error("requester's session must be of type PinnipedSession")
 	StorageRequestIDLabelName = "storage.pinniped.dev/request-id" //nolint:gosec // this is not a credential
+
+	// These labels index sessions by the identity that they represent. Their values are hashed with
+	// IndexLabelValue because the raw values are not guaranteed to be valid label values.
+	StorageSubjectLabelName          = "storage.pinniped.dev/subject"
+	StorageUsernameLabelName         = "storage.pinniped.dev/username"
+	StorageUpstreamIssuerLabelName   = "storage.pinniped.dev/upstream-issuer"
+	StorageFederationDomainLabelName = "storage.pinniped.dev/federation-domain"
+	StorageUpstreamNameLabelName     = "storage.pinniped.dev/upstream-name"
+
+	// The downstream subject is formatted as "<upstream issuer>?sub=<upstream subject>" by the callback endpoint.
+	downstreamSubjectUpstreamSubjectSeparator = "?sub="
 )
 
 func ValidateAndExtractAuthorizeRequest(requester fosite.Requester) (*fosite.Request, error) {
@@ -26,10 +41,57 @@ func ValidateAndExtractAuthorizeRequest(requester fosite.Requester) (*fosite.Req
 	if !ok2 {
 		return nil, ErrInvalidClientType
 	}
-	_, ok3 := request.Session.(*openid.DefaultSession)
+	_, ok3 := request.Session.(*psession.PinnipedSession)
 	if !ok3 {
 		return nil, ErrInvalidSessionType
 	}
 
 	return request, nil
 }
+
+// SessionLabels returns the labels which should be used to index a stored session. It always includes the
+// request ID, and includes the identity labels for any identity information that is present in the session.
+// The request must have already been validated by ValidateAndExtractAuthorizeRequest.
+func SessionLabels(request *fosite.Request) map[string]string {
+	labels := map[string]string{StorageRequestIDLabelName: request.GetID()}
+
+	session := request.Session.(*psession.PinnipedSession)
+	if session.Fosite != nil {
+		addIndexLabel(labels, StorageSubjectLabelName, session.Fosite.Subject)
+		addIndexLabel(labels, StorageUsernameLabelName, session.Fosite.Username)
+		addIndexLabel(labels, StorageUpstreamIssuerLabelName, UpstreamIssuerFromDownstreamSubject(session.Fosite.Subject))
+		if session.Fosite.Claims != nil {
+			addIndexLabel(labels, StorageFederationDomainLabelName, session.Fosite.Claims.Issuer)
+		}
+	}
+	if session.Custom != nil {
+		addIndexLabel(labels, StorageUpstreamNameLabelName, session.Custom.ProviderName)
+	}
+
+	return labels
+}
+
+func addIndexLabel(labels map[string]string, labelName, value string) {
+	if value != "" {
+		labels[labelName] = IndexLabelValue(value)
+	}
+}
+
+//nolint:gochecknoglobals
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// IndexLabelValue hashes an arbitrary string into a value that is always a valid label value.
+func IndexLabelValue(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return strings.ToLower(b32.EncodeToString(sum[:]))
+}
+
+// UpstreamIssuerFromDownstreamSubject returns the upstream issuer portion of a downstream subject,
+// or an empty string when the subject was not created by the callback endpoint.
+func UpstreamIssuerFromDownstreamSubject(subject string) string {
+	i := strings.Index(subject, downstreamSubjectUpstreamSubjectSeparator)
+	if i < 1 {
+		return ""
+	}
+	return subject[:i]
+}
@@ -0,0 +1,157 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package fositestorage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"go.pinniped.dev/internal/crud"
+)
+
+// MigrationFunc upgrades a stored session, which is a JSON object, from one storage version to the next by changing
+// its fields in place. It does not need to change the version field.
+type MigrationFunc func(session map[string]json.RawMessage) error
+
+// Migrations upgrades the stored sessions of one resource from older storage versions to its current storage
+// version, so that changing the format of a session does not invalidate all of the sessions which were stored by an
+// older version of the Supervisor. Sessions are upgraded when they are read, and can also be rewritten in the
+// current format ahead of time by Rewrite. Sessions with a version which has no registered migration, including
+// sessions which were stored by a newer version of the Supervisor, are left as they are.
+type Migrations struct {
+	resource       string
+	currentVersion string
+	steps          map[string]migrationStep
+}
+
+type migrationStep struct {
+	toVersion string
+	migrate   MigrationFunc
+}
+
+// NewMigrations returns the Migrations of the given resource, which stores its sessions in currentVersion.
+func NewMigrations(resource, currentVersion string) *Migrations {
+	return &Migrations{resource: resource, currentVersion: currentVersion, steps: map[string]migrationStep{}}
+}
+
+// Register registers the migration of sessions from fromVersion to toVersion. It returns m so that calls can be
+// chained.
+func (m *Migrations) Register(fromVersion, toVersion string, migrate MigrationFunc) *Migrations {
+	m.steps[fromVersion] = migrationStep{toVersion: toVersion, migrate: migrate}
+	return m
+}
+
+// Resource returns the resource whose sessions are upgraded by m.
+func (m *Migrations) Resource() string {
+	return m.resource
+}
+
+// Upgrade returns the given stored session upgraded to the current storage version, or nil when it does not need
+// to be upgraded.
+func (m *Migrations) Upgrade(data []byte) ([]byte, error) {
+	var session map[string]json.RawMessage
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	var version string
+	if rawVersion, ok := session["version"]; ok {
+		if err := json.Unmarshal(rawVersion, &version); err != nil {
+			return nil, fmt.Errorf("invalid version: %w", err)
+		}
+	}
+
+	upgraded := false
+	// Each step can be applied at most once, which also stops registration mistakes from looping forever.
+	for i := 0; i < len(m.steps) && version != m.currentVersion; i++ {
+		step, ok := m.steps[version]
+		if !ok {
+			break
+		}
+		if err := step.migrate(session); err != nil {
+			return nil, fmt.Errorf("failed to upgrade from version %s to version %s: %w", version, step.toVersion, err)
+		}
+		version = step.toVersion
+		upgraded = true
+	}
+	if !upgraded {
+		return nil, nil
+	}
+
+	rawVersion, err := json.Marshal(version)
+	if err != nil {
+		return nil, err
+	}
+	session["version"] = rawVersion
+	return json.Marshal(session)
+}
+
+// Storage returns a crud.Storage which upgrades the sessions which are read from storage.
+func (m *Migrations) Storage(storage crud.Storage) crud.Storage {
+	return &migratingStorage{Storage: storage, migrations: m}
+}
+
+// Rewrite rewrites all of the sessions in storage which are stored in an older storage version in the current
+// storage version, and returns how many sessions were rewritten. Afterwards, the migrations of the older versions
+// are not needed anymore for the sessions in storage.
+func (m *Migrations) Rewrite(ctx context.Context, storage crud.Storage) (int, error) {
+	return storage.Migrate(ctx, m.Upgrade)
+}
+
+type migratingStorage struct {
+	crud.Storage
+	migrations *Migrations
+}
+
+func (s *migratingStorage) Get(ctx context.Context, signature string, data crud.JSON) (string, error) {
+	var raw json.RawMessage
+	rv, err := s.Storage.Get(ctx, signature, &raw)
+	// Revoked sessions are still decoded, so that callers can detect attempts to use them.
+	if err != nil && !errors.Is(err, crud.ErrSecretRevoked) {
+		return rv, err
+	}
+
+	upgraded, upgradeErr := s.migrations.Upgrade(raw)
+	if upgradeErr != nil {
+		return "", fmt.Errorf("failed to upgrade %s for signature %s: %w", s.migrations.resource, signature, upgradeErr)
+	}
+	if upgraded != nil {
+		raw = upgraded
+	}
+	if decodeErr := json.Unmarshal(raw, data); decodeErr != nil {
+		return "", fmt.Errorf("failed to decode %s for signature %s: %w", s.migrations.resource, signature, decodeErr)
+	}
+	return rv, err
+}
+
+// MigrateRequestSessionToPinnipedSession upgrades a stored session whose request holds its session as a fosite
+// openid.DefaultSession, as stored by version 1 of the authorization code, PKCE, OIDC, access token and refresh
+// token storage, to a request which holds a psession.PinnipedSession, as stored by version 2. The custom session
+// data of the upgraded session is empty, because version 1 did not record it.
+func MigrateRequestSessionToPinnipedSession(session map[string]json.RawMessage) error {
+	var request map[string]json.RawMessage
+	if err := json.Unmarshal(session["request"], &request); err != nil {
+		return fmt.Errorf("invalid request: %w", err)
+	}
+	fositeSession, ok := request["session"]
+	if !ok || string(fositeSession) == "null" {
+		return nil
+	}
+	pinnipedSession, err := json.Marshal(map[string]json.RawMessage{
+		"fosite": fositeSession,
+		"custom": json.RawMessage(`{}`),
+	})
+	if err != nil {
+		return err
+	}
+	request["session"] = pinnipedSession
+
+	rawRequest, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	session["request"] = rawRequest
+	return nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package fositestorage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/testutil/storagebackends"
+)
+
+func TestMigrationsUpgrade(t *testing.T) {
+	addField := func(name string) MigrationFunc {
+		return func(session map[string]json.RawMessage) error {
+			session[name] = json.RawMessage(`true`)
+			return nil
+		}
+	}
+	migrations := NewMigrations("some-resource", "3").
+		Register("1", "2", addField("two")).
+		Register("2", "3", addField("three"))
+
+	tests := []struct {
+		name      string
+		data      string
+		want      string
+		wantError string
+	}{
+		{
+			name: "current version",
+			data: `{"version":"3"}`,
+		},
+		{
+			name: "one version behind",
+			data: `{"version":"2","data":"some-data"}`,
+			want: `{"version":"3","data":"some-data","three":true}`,
+		},
+		{
+			name: "two versions behind",
+			data: `{"version":"1","data":"some-data"}`,
+			want: `{"version":"3","data":"some-data","two":true,"three":true}`,
+		},
+		{
+			name: "unknown version",
+			data: `{"version":"4"}`,
+		},
+		{
+			name: "no version",
+			data: `{"data":"some-data"}`,
+		},
+		{
+			name:      "invalid version",
+			data:      `{"version":1}`,
+			wantError: "invalid version: json: cannot unmarshal number",
+		},
+		{
+			name:      "invalid session",
+			data:      `[]`,
+			wantError: "json: cannot unmarshal array",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := migrations.Upgrade([]byte(tt.data))
+			if tt.wantError != "" {
+				// The rest of the message depends on the version of Go.
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.wantError)
+				return
+			}
+			require.NoError(t, err)
+			if tt.want == "" {
+				require.Nil(t, got)
+				return
+			}
+			require.JSONEq(t, tt.want, string(got))
+		})
+	}
+
+	t.Run("failed migration", func(t *testing.T) {
+		failing := NewMigrations("some-resource", "2").Register("1", "2", func(map[string]json.RawMessage) error {
+			return errors.New("some error")
+		})
+		_, err := failing.Upgrade([]byte(`{"version":"1"}`))
+		require.EqualError(t, err, "failed to upgrade from version 1 to version 2: some error")
+	})
+
+	t.Run("migrations which loop", func(t *testing.T) {
+		looping := NewMigrations("some-resource", "3").
+			Register("1", "2", addField("two")).
+			Register("2", "1", addField("one"))
+		got, err := looping.Upgrade([]byte(`{"version":"1"}`))
+		require.NoError(t, err)
+		require.JSONEq(t, `{"version":"1","two":true,"one":true}`, string(got))
+	})
+}
+
+func TestMigrateRequestSessionToPinnipedSession(t *testing.T) {
+	session := map[string]json.RawMessage{
+		"request": json.RawMessage(`{"id":"abcd-1","session":{"Username":"snorlax","Subject":"panda"}}`),
+	}
+	require.NoError(t, MigrateRequestSessionToPinnipedSession(session))
+	require.JSONEq(t,
+		`{"id":"abcd-1","session":{"fosite":{"Username":"snorlax","Subject":"panda"},"custom":{}}}`,
+		string(session["request"]),
+	)
+
+	session = map[string]json.RawMessage{"request": json.RawMessage(`{"id":"abcd-1"}`)}
+	require.NoError(t, MigrateRequestSessionToPinnipedSession(session))
+	require.JSONEq(t, `{"id":"abcd-1"}`, string(session["request"]))
+
+	session = map[string]json.RawMessage{}
+	require.EqualError(t, MigrateRequestSessionToPinnipedSession(session), "invalid request: unexpected end of JSON input")
+}
+
+func TestMigrationsStorage(t *testing.T) {
+	type testSession struct {
+		Data    string `json:"data"`
+		New     string `json:"new"`
+		Version string `json:"version"`
+	}
+	migrations := NewMigrations("some-resource", "2").Register("1", "2", func(session map[string]json.RawMessage) error {
+		session["new"] = json.RawMessage(`"upgraded"`)
+		return nil
+	})
+	oldSession := json.RawMessage(`{"data":"some-data","version":"1"}`)
+	upgradedSession := testSession{Data: "some-data", New: "upgraded", Version: "2"}
+
+	for _, backend := range storagebackends.All(t) {
+		backend := backend
+		t.Run(backend.Name, func(t *testing.T) {
+			ctx := context.Background()
+			storage := backend.Storage(migrations.Resource(), time.Now, time.Hour)
+			subject := migrations.Storage(storage)
+
+			_, err := storage.Create(ctx, "old", oldSession, map[string]string{"some-label": "some-value"})
+			require.NoError(t, err)
+			_, err = storage.Create(ctx, "current", &testSession{Data: "current-data", Version: "2"}, nil)
+			require.NoError(t, err)
+
+			// Old sessions are upgraded when they are read, but they are not written back.
+			var got testSession
+			_, err = subject.Get(ctx, "old", &got)
+			require.NoError(t, err)
+			require.Equal(t, upgradedSession, got)
+
+			var raw json.RawMessage
+			_, err = storage.Get(ctx, "old", &raw)
+			require.NoError(t, err)
+			require.JSONEq(t, string(oldSession), string(raw))
+
+			got = testSession{}
+			_, err = subject.Get(ctx, "current", &got)
+			require.NoError(t, err)
+			require.Equal(t, testSession{Data: "current-data", Version: "2"}, got)
+
+			_, err = subject.Get(ctx, "missing", &got)
+			require.Error(t, err)
+
+			// Revoked sessions are upgraded too, so that callers can still inspect them.
+			require.NoError(t, storage.RevokeByLabel(ctx, "some-label", "some-value"))
+			got = testSession{}
+			_, err = subject.Get(ctx, "old", &got)
+			require.True(t, errors.Is(err, crud.ErrSecretRevoked))
+			require.Equal(t, upgradedSession, got)
+
+			// Rewriting writes back the old sessions in the current version and keeps their labels.
+			migrated, err := migrations.Rewrite(ctx, storage)
+			require.NoError(t, err)
+			require.Equal(t, 1, migrated)
+
+			raw = nil
+			_, err = storage.Get(ctx, "old", &raw)
+			require.True(t, errors.Is(err, crud.ErrSecretRevoked))
+			require.JSONEq(t, `{"data":"some-data","new":"upgraded","version":"2"}`, string(raw))
+
+			migrated, err = migrations.Rewrite(ctx, storage)
+			require.NoError(t, err)
+			require.Equal(t, 0, migrated)
+
+			require.NoError(t, storage.DeleteByLabel(ctx, "some-label", "some-value"))
+		})
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package pushedauthorizationrequest
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/ory/fosite"
+	"k8s.io/apimachinery/pkg/api/errors"
+
+	"go.pinniped.dev/internal/constable"
+	"go.pinniped.dev/internal/crud"
+)
+
+const (
+	TypeLabelValue = "pushed-authorization-request"
+
+	ErrInvalidPushedAuthorizationRequestVersion = constable.Error("pushed authorization request data has wrong version")
+	ErrInvalidPushedAuthorizationRequestData    = constable.Error("pushed authorization request data must be present")
+
+	pushedAuthorizationRequestStorageVersion = "1"
+)
+
+// Request is an authorization request which was pushed to the pushed authorization request endpoint, as defined by
+// https://datatracker.ietf.org/doc/html/rfc9126.
+type Request struct {
+	// ClientID is the ID of the client which pushed the request. Only this client may use the request.
+	ClientID string `json:"clientID"`
+
+	// Params are the parameters of the authorization request.
+	Params url.Values `json:"params"`
+
+	// ExpiresAt is the time after which the request may no longer be used.
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Storage stores pushed authorization requests. They are keyed by the reference in their request_uri.
+type Storage interface {
+	CreatePushedAuthorizationRequest(ctx context.Context, reference string, request *Request) error
+	GetPushedAuthorizationRequest(ctx context.Context, reference string) (*Request, error)
+	DeletePushedAuthorizationRequest(ctx context.Context, reference string) error
+}
+
+var _ Storage = &pushedAuthorizationRequestStorage{}
+
+type pushedAuthorizationRequestStorage struct {
+	storage crud.Storage
+}
+
+type session struct {
+	Request *Request `json:"request"`
+	Version string   `json:"version"`
+}
+
+func New(backend crud.Backend, clock func() time.Time, sessionStorageLifetime time.Duration) Storage {
+	return &pushedAuthorizationRequestStorage{storage: backend.Storage(TypeLabelValue, clock, sessionStorageLifetime)}
+}
+
+func (a *pushedAuthorizationRequestStorage) CreatePushedAuthorizationRequest(ctx context.Context, reference string, request *Request) error {
+	if request == nil || request.ClientID == "" {
+		return ErrInvalidPushedAuthorizationRequestData
+	}
+
+	_, err := a.storage.Create(ctx, reference, &session{Request: request, Version: pushedAuthorizationRequestStorageVersion}, nil)
+	return err
+}
+
+func (a *pushedAuthorizationRequestStorage) GetPushedAuthorizationRequest(ctx context.Context, reference string) (*Request, error) {
+	session := &session{}
+	_, err := a.storage.Get(ctx, reference, session)
+
+	if errors.IsNotFound(err) {
+		return nil, fosite.ErrNotFound.WithWrap(err).WithDebug(err.Error())
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pushed authorization request for %s: %w", reference, err)
+	}
+
+	if version := session.Version; version != pushedAuthorizationRequestStorageVersion {
+		return nil, fmt.Errorf("%w: pushed authorization request for %s has version %s instead of %s",
+			ErrInvalidPushedAuthorizationRequestVersion, reference, version, pushedAuthorizationRequestStorageVersion)
+	}
+
+	if session.Request == nil || session.Request.ClientID == "" {
+		return nil, fmt.Errorf("malformed pushed authorization request for %s: %w", reference, ErrInvalidPushedAuthorizationRequestData)
+	}
+
+	return session.Request, nil
+}
+
+func (a *pushedAuthorizationRequestStorage) DeletePushedAuthorizationRequest(ctx context.Context, reference string) error {
+	return a.storage.Delete(ctx, reference)
+}
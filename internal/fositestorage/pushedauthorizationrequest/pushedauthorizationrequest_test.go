@@ -0,0 +1,198 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package pushedauthorizationrequest
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/kubernetes/fake"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	coretesting "k8s.io/client-go/testing"
+
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/testutil/storagebackends"
+)
+
+const namespace = "test-ns"
+
+var fakeNow = time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+var lifetime = time.Minute * 6
+var fakeNowPlusLifetimeAsString = metav1.Time{Time: fakeNow.Add(lifetime)}.Format(time.RFC3339)
+
+func TestPushedAuthorizationRequestStorage(t *testing.T) {
+	secretsGVR := schema.GroupVersionResource{
+		Group:    "",
+		Version:  "v1",
+		Resource: "secrets",
+	}
+
+	wantActions := []coretesting.Action{
+		coretesting.NewCreateAction(secretsGVR, namespace, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "pinniped-storage-pushed-authorization-request-pwu5zs7lekbhnln2w4",
+				ResourceVersion: "",
+				Labels: map[string]string{
+					"storage.pinniped.dev/type": "pushed-authorization-request",
+				},
+				Annotations: map[string]string{
+					"storage.pinniped.dev/garbage-collect-after": fakeNowPlusLifetimeAsString,
+				},
+			},
+			Data: map[string][]byte{
+				"pinniped-storage-data":    []byte(`{"request":{"clientID":"pinny","params":{"client_id":["pinny"],"scope":["openid"]},"expiresAt":"2030-01-01T00:05:00Z"},"version":"1"}`),
+				"pinniped-storage-version": []byte("1"),
+			},
+			Type: "storage.pinniped.dev/pushed-authorization-request",
+		}),
+		coretesting.NewGetAction(secretsGVR, namespace, "pinniped-storage-pushed-authorization-request-pwu5zs7lekbhnln2w4"),
+		coretesting.NewDeleteAction(secretsGVR, namespace, "pinniped-storage-pushed-authorization-request-pwu5zs7lekbhnln2w4"),
+	}
+
+	ctx, client, _, storage := makeTestSubject()
+
+	request := &Request{
+		ClientID:  "pinny",
+		Params:    url.Values{"client_id": []string{"pinny"}, "scope": []string{"openid"}},
+		ExpiresAt: fakeNow.Add(5 * time.Minute),
+	}
+	err := storage.CreatePushedAuthorizationRequest(ctx, "fancy-signature", request)
+	require.NoError(t, err)
+
+	newRequest, err := storage.GetPushedAuthorizationRequest(ctx, "fancy-signature")
+	require.NoError(t, err)
+	require.Equal(t, request, newRequest)
+
+	err = storage.DeletePushedAuthorizationRequest(ctx, "fancy-signature")
+	require.NoError(t, err)
+
+	require.Equal(t, wantActions, client.Actions())
+}
+
+func TestPushedAuthorizationRequestStorageWithAllBackends(t *testing.T) {
+	for _, backend := range storagebackends.All(t) {
+		backend := backend
+		t.Run(backend.Name, func(t *testing.T) {
+			ctx, storage := makeTestSubjectWithBackend(backend)
+
+			request := &Request{
+				ClientID:  "pinny",
+				Params:    url.Values{"client_id": []string{"pinny"}, "scope": []string{"openid"}},
+				ExpiresAt: fakeNow.Add(5 * time.Minute),
+			}
+			require.NoError(t, storage.CreatePushedAuthorizationRequest(ctx, "fancy-signature", request))
+
+			newRequest, err := storage.GetPushedAuthorizationRequest(ctx, "fancy-signature")
+			require.NoError(t, err)
+			require.Equal(t, request, newRequest)
+
+			require.NoError(t, storage.DeletePushedAuthorizationRequest(ctx, "fancy-signature"))
+			_, err = storage.GetPushedAuthorizationRequest(ctx, "fancy-signature")
+			require.True(t, errors.Is(err, fosite.ErrNotFound))
+		})
+	}
+}
+
+func TestGetNotFound(t *testing.T) {
+	for _, backend := range storagebackends.All(t) {
+		backend := backend
+		t.Run(backend.Name, func(t *testing.T) {
+			ctx, storage := makeTestSubjectWithBackend(backend)
+
+			_, notFoundErr := storage.GetPushedAuthorizationRequest(ctx, "non-existent-signature")
+			require.EqualError(t, notFoundErr, "not_found")
+			require.True(t, errors.Is(notFoundErr, fosite.ErrNotFound))
+		})
+	}
+}
+
+func TestWrongVersion(t *testing.T) {
+	ctx, _, secrets, storage := makeTestSubject()
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "pinniped-storage-pushed-authorization-request-pwu5zs7lekbhnln2w4",
+			ResourceVersion: "",
+			Labels: map[string]string{
+				"storage.pinniped.dev/type": "pushed-authorization-request",
+			},
+			Annotations: map[string]string{
+				"storage.pinniped.dev/garbage-collect-after": fakeNowPlusLifetimeAsString,
+			},
+		},
+		Data: map[string][]byte{
+			"pinniped-storage-data":    []byte(`{"request":{"clientID":"pinny","params":{},"expiresAt":"2030-01-01T00:05:00Z"},"version":"not-the-right-version"}`),
+			"pinniped-storage-version": []byte("1"),
+		},
+		Type: "storage.pinniped.dev/pushed-authorization-request",
+	}
+	_, err := secrets.Create(ctx, secret, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	_, err = storage.GetPushedAuthorizationRequest(ctx, "fancy-signature")
+
+	require.EqualError(t, err, "pushed authorization request data has wrong version: pushed authorization request for fancy-signature has version not-the-right-version instead of 1")
+}
+
+func TestNilSessionRequest(t *testing.T) {
+	ctx, _, secrets, storage := makeTestSubject()
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "pinniped-storage-pushed-authorization-request-pwu5zs7lekbhnln2w4",
+			ResourceVersion: "",
+			Labels: map[string]string{
+				"storage.pinniped.dev/type": "pushed-authorization-request",
+			},
+			Annotations: map[string]string{
+				"storage.pinniped.dev/garbage-collect-after": fakeNowPlusLifetimeAsString,
+			},
+		},
+		Data: map[string][]byte{
+			"pinniped-storage-data":    []byte(`{"nonsense-key": "nonsense-value","version":"1"}`),
+			"pinniped-storage-version": []byte("1"),
+		},
+		Type: "storage.pinniped.dev/pushed-authorization-request",
+	}
+
+	_, err := secrets.Create(ctx, secret, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	_, err = storage.GetPushedAuthorizationRequest(ctx, "fancy-signature")
+	require.EqualError(t, err, "malformed pushed authorization request for fancy-signature: pushed authorization request data must be present")
+}
+
+func TestCreateWithoutClientID(t *testing.T) {
+	for _, backend := range storagebackends.All(t) {
+		backend := backend
+		t.Run(backend.Name, func(t *testing.T) {
+			ctx, storage := makeTestSubjectWithBackend(backend)
+
+			err := storage.CreatePushedAuthorizationRequest(ctx, "signature-doesnt-matter", nil)
+			require.EqualError(t, err, "pushed authorization request data must be present")
+
+			err = storage.CreatePushedAuthorizationRequest(ctx, "signature-doesnt-matter", &Request{Params: url.Values{}})
+			require.EqualError(t, err, "pushed authorization request data must be present")
+		})
+	}
+}
+
+func makeTestSubject() (context.Context, *fake.Clientset, corev1client.SecretInterface, Storage) {
+	client := fake.NewSimpleClientset()
+	secrets := client.CoreV1().Secrets(namespace)
+	return context.Background(), client, secrets, New(crud.NewSecretsBackend(secrets), clock.NewFakeClock(fakeNow).Now, lifetime)
+}
+
+func makeTestSubjectWithBackend(backend crud.Backend) (context.Context, Storage) {
+	return context.Background(), New(backend, clock.NewFakeClock(fakeNow).Now, lifetime)
+}
@@ -1,22 +1,22 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package refreshtoken
 
 import (
 	"context"
+	stderrors "errors"
 	"fmt"
 	"time"
 
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/handler/oauth2"
-	"github.com/ory/fosite/handler/openid"
 	"k8s.io/apimachinery/pkg/api/errors"
-	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 
 	"go.pinniped.dev/internal/constable"
 	"go.pinniped.dev/internal/crud"
 	"go.pinniped.dev/internal/fositestorage"
+	"go.pinniped.dev/internal/psession"
 )
 
 const (
@@ -24,8 +24,10 @@ const (
 
 	ErrInvalidRefreshTokenRequestVersion = constable.Error("refresh token request data has wrong version")
 	ErrInvalidRefreshTokenRequestData    = constable.Error("refresh token request data must be present")
+	ErrRefreshTokenReplayed              = constable.Error("refresh token was already used")
 
-	refreshTokenStorageVersion = "1"
+	// The version of the stored sessions. Sessions which were stored in an older version are upgraded by Migrations.
+	refreshTokenStorageVersion = "2"
 )
 
 type RevocationStorage interface {
@@ -44,12 +46,35 @@ type session struct {
 	Version string          `json:"version"`
 }
 
-func New(secrets corev1client.SecretInterface, clock func() time.Time, sessionStorageLifetime time.Duration) RevocationStorage {
-	return &refreshTokenStorage{storage: crud.New(TypeLabelValue, secrets, clock, sessionStorageLifetime)}
+func New(backend crud.Backend, clock func() time.Time, sessionStorageLifetime time.Duration) RevocationStorage {
+	return &refreshTokenStorage{storage: Migrations().Storage(backend.Storage(TypeLabelValue, clock, sessionStorageLifetime))}
 }
 
+// Migrations upgrades the sessions which were stored by older versions of the Supervisor.
+func Migrations() *fositestorage.Migrations {
+	return fositestorage.NewMigrations(TypeLabelValue, refreshTokenStorageVersion).
+		Register("1", "2", fositestorage.MigrateRequestSessionToPinnipedSession)
+}
+
+type rotationContextKey struct{}
+
+// WithRotation returns a context for the rotation of a refresh token. Within it, GetRefreshTokenSession confirms
+// that the refresh token has not changed since it was read, by writing it back at the resource version which was
+// read. The read may be served from a cache which is behind other replicas, so without this confirmation a refresh
+// token which was already rotated elsewhere could be rotated again, revoking the newer refresh token of the family.
+func WithRotation(ctx context.Context) context.Context {
+	return context.WithValue(ctx, rotationContextKey{}, true)
+}
+
+func isRotation(ctx context.Context) bool {
+	rotation, _ := ctx.Value(rotationContextKey{}).(bool)
+	return rotation
+}
+
+// RevokeRefreshToken revokes all refresh tokens of the request without deleting them. Fosite calls this whenever
+// it rotates a refresh token, so keeping the revoked tokens allows any later replay of them to be detected.
 func (a *refreshTokenStorage) RevokeRefreshToken(ctx context.Context, requestID string) error {
-	return a.storage.DeleteByLabel(ctx, fositestorage.StorageRequestIDLabelName, requestID)
+	return a.storage.RevokeByLabel(ctx, fositestorage.StorageRequestIDLabelName, requestID)
 }
 
 func (a *refreshTokenStorage) CreateRefreshTokenSession(ctx context.Context, signature string, requester fosite.Requester) error {
@@ -62,19 +87,37 @@ func (a *refreshTokenStorage) CreateRefreshTokenSession(ctx context.Context, sig
 		ctx,
 		signature,
 		&session{Request: request, Version: refreshTokenStorageVersion},
-		map[string]string{fositestorage.StorageRequestIDLabelName: requester.GetID()},
+		fositestorage.SessionLabels(request),
 	)
 	return err
 }
 
+// GetRefreshTokenSession returns the stored request of the refresh token. When the refresh token was already
+// revoked, it returns the stored request along with an error wrapping ErrRefreshTokenReplayed, so that the caller
+// can revoke the rest of the token family of the request. See WithRotation for the reads during a rotation.
 func (a *refreshTokenStorage) GetRefreshTokenSession(ctx context.Context, signature string, _ fosite.Session) (fosite.Requester, error) {
-	session, _, err := a.getSession(ctx, signature)
+	session, rv, err := a.getSession(ctx, signature)
+
+	if stderrors.Is(err, ErrRefreshTokenReplayed) {
+		return session.Request, err
+	}
 
 	if err != nil {
 		return nil, err
 	}
 
-	return session.Request, err
+	if isRotation(ctx) {
+		if _, err := a.storage.Update(ctx, signature, rv, session); err != nil {
+			if errors.IsConflict(err) || errors.IsNotFound(err) {
+				// Report this as concurrent access so that fosite rejects the request with an invalid_request error.
+				return nil, fmt.Errorf("%w: refresh token session for %s changed since it was read: %v",
+					fosite.ErrSerializationFailure, signature, err)
+			}
+			return nil, fmt.Errorf("failed to confirm refresh token session for %s: %w", signature, err)
+		}
+	}
+
+	return session.Request, nil
 }
 
 func (a *refreshTokenStorage) DeleteRefreshTokenSession(ctx context.Context, signature string) error {
@@ -89,7 +132,9 @@ func (a *refreshTokenStorage) getSession(ctx context.Context, signature string)
 		return nil, "", fosite.ErrNotFound.WithWrap(err).WithDebug(err.Error())
 	}
 
-	if err != nil {
+	revoked := stderrors.Is(err, crud.ErrSecretRevoked)
+
+	if err != nil && !revoked {
 		return nil, "", fmt.Errorf("failed to get refresh token session for %s: %w", signature, err)
 	}
 
@@ -102,6 +147,12 @@ func (a *refreshTokenStorage) getSession(ctx context.Context, signature string)
 		return nil, "", fmt.Errorf("malformed refresh token session for %s: %w", signature, ErrInvalidRefreshTokenRequestData)
 	}
 
+	if revoked {
+		// Report this as not found so that fosite rejects the request with an invalid_grant error.
+		replayErr := fmt.Errorf("%w: refresh token session for %s: %s", ErrRefreshTokenReplayed, signature, err.Error())
+		return session, rv, fosite.ErrNotFound.WithWrap(replayErr).WithDebug(replayErr.Error())
+	}
+
 	return session, rv, nil
 }
 
@@ -109,7 +160,7 @@ func newValidEmptyRefreshTokenSession() *session {
 	return &session{
 		Request: &fosite.Request{
 			Client:  &fosite.DefaultOpenIDConnectClient{},
-			Session: &openid.DefaultSession{},
+			Session: psession.NewPinnipedSession(),
 		},
 	}
 }
@@ -1,10 +1,11 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package refreshtoken
 
 import (
 	"context"
+	"encoding/json"
 	"net/url"
 	"testing"
 	"time"
@@ -20,6 +21,11 @@ import (
 	"k8s.io/client-go/kubernetes/fake"
 	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	coretesting "k8s.io/client-go/testing"
+
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/fositestorage"
+	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/testutil/storagebackends"
 )
 
 const namespace = "test-ns"
@@ -40,15 +46,18 @@ func TestRefreshTokenStorage(t *testing.T) {
 				Name:            "pinniped-storage-refresh-token-pwu5zs7lekbhnln2w4",
 				ResourceVersion: "",
 				Labels: map[string]string{
-					"storage.pinniped.dev/type":       "refresh-token",
-					"storage.pinniped.dev/request-id": "abcd-1",
+					"storage.pinniped.dev/type":          "refresh-token",
+					"storage.pinniped.dev/request-id":    "abcd-1",
+					"storage.pinniped.dev/subject":       "u7g7lucynm4si465btiizg5igmsaabviu4yqx6n4rpy257p25lnq",
+					"storage.pinniped.dev/username":      "uxvahoxcijvg7zqxahw4mv3nbzsjd2my7hntzm4m5fl4cfiwzz2a",
+					"storage.pinniped.dev/upstream-name": "gm2wpl7432tcwmpdkwhzlku7mn2xxeb4ovwmqcwndlmmbcyxpwfa",
 				},
 				Annotations: map[string]string{
 					"storage.pinniped.dev/garbage-collect-after": fakeNowPlusLifetimeAsString,
 				},
 			},
 			Data: map[string][]byte{
-				"pinniped-storage-data":    []byte(`{"request":{"id":"abcd-1","requestedAt":"0001-01-01T00:00:00Z","client":{"id":"pinny","redirect_uris":null,"grant_types":null,"response_types":null,"scopes":null,"audience":null,"public":true,"jwks_uri":"where","jwks":null,"token_endpoint_auth_method":"something","request_uris":null,"request_object_signing_alg":"","token_endpoint_auth_signing_alg":""},"scopes":null,"grantedScopes":null,"form":{"key":["val"]},"session":{"Claims":null,"Headers":null,"ExpiresAt":null,"Username":"snorlax","Subject":"panda"},"requestedAudience":null,"grantedAudience":null},"version":"1"}`),
+				"pinniped-storage-data":    []byte(`{"request":{"id":"abcd-1","requestedAt":"0001-01-01T00:00:00Z","client":{"id":"pinny","redirect_uris":null,"grant_types":null,"response_types":null,"scopes":null,"audience":null,"public":true,"jwks_uri":"where","jwks":null,"token_endpoint_auth_method":"something","request_uris":null,"request_object_signing_alg":"","token_endpoint_auth_signing_alg":""},"scopes":null,"grantedScopes":null,"form":{"key":["val"]},"session":{"fosite":{"Claims":null,"Headers":null,"ExpiresAt":null,"Username":"snorlax","Subject":"panda"},"custom":{"providerName":"fake-upstream-idp"}},"requestedAudience":null,"grantedAudience":null},"version":"2"}`),
 				"pinniped-storage-version": []byte("1"),
 			},
 			Type: "storage.pinniped.dev/refresh-token",
@@ -83,12 +92,17 @@ func TestRefreshTokenStorage(t *testing.T) {
 		RequestedScope: nil,
 		GrantedScope:   nil,
 		Form:           url.Values{"key": []string{"val"}},
-		Session: &openid.DefaultSession{
-			Claims:    nil,
-			Headers:   nil,
-			ExpiresAt: nil,
-			Username:  "snorlax",
-			Subject:   "panda",
+		Session: &psession.PinnipedSession{
+			Fosite: &openid.DefaultSession{
+				Claims:    nil,
+				Headers:   nil,
+				ExpiresAt: nil,
+				Username:  "snorlax",
+				Subject:   "panda",
+			},
+			Custom: &psession.CustomSessionData{
+				ProviderName: "fake-upstream-idp",
+			},
 		},
 		RequestedAudience: nil,
 		GrantedAudience:   nil,
@@ -107,29 +121,38 @@ func TestRefreshTokenStorage(t *testing.T) {
 }
 
 func TestRefreshTokenStorageRevocation(t *testing.T) {
-	wantActions := []coretesting.Action{
-		coretesting.NewCreateAction(secretsGVR, namespace, &corev1.Secret{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:            "pinniped-storage-refresh-token-pwu5zs7lekbhnln2w4",
-				ResourceVersion: "",
-				Labels: map[string]string{
-					"storage.pinniped.dev/type":       "refresh-token",
-					"storage.pinniped.dev/request-id": "abcd-1",
-				},
-				Annotations: map[string]string{
-					"storage.pinniped.dev/garbage-collect-after": fakeNowPlusLifetimeAsString,
-				},
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "pinniped-storage-refresh-token-pwu5zs7lekbhnln2w4",
+			ResourceVersion: "",
+			Labels: map[string]string{
+				"storage.pinniped.dev/type":          "refresh-token",
+				"storage.pinniped.dev/request-id":    "abcd-1",
+				"storage.pinniped.dev/subject":       "u7g7lucynm4si465btiizg5igmsaabviu4yqx6n4rpy257p25lnq",
+				"storage.pinniped.dev/username":      "uxvahoxcijvg7zqxahw4mv3nbzsjd2my7hntzm4m5fl4cfiwzz2a",
+				"storage.pinniped.dev/upstream-name": "gm2wpl7432tcwmpdkwhzlku7mn2xxeb4ovwmqcwndlmmbcyxpwfa",
 			},
-			Data: map[string][]byte{
-				"pinniped-storage-data":    []byte(`{"request":{"id":"abcd-1","requestedAt":"0001-01-01T00:00:00Z","client":{"id":"pinny","redirect_uris":null,"grant_types":null,"response_types":null,"scopes":null,"audience":null,"public":true,"jwks_uri":"where","jwks":null,"token_endpoint_auth_method":"something","request_uris":null,"request_object_signing_alg":"","token_endpoint_auth_signing_alg":""},"scopes":null,"grantedScopes":null,"form":{"key":["val"]},"session":{"Claims":null,"Headers":null,"ExpiresAt":null,"Username":"snorlax","Subject":"panda"},"requestedAudience":null,"grantedAudience":null},"version":"1"}`),
-				"pinniped-storage-version": []byte("1"),
+			Annotations: map[string]string{
+				"storage.pinniped.dev/garbage-collect-after": fakeNowPlusLifetimeAsString,
 			},
-			Type: "storage.pinniped.dev/refresh-token",
-		}),
+		},
+		Data: map[string][]byte{
+			"pinniped-storage-data":    []byte(`{"request":{"id":"abcd-1","requestedAt":"0001-01-01T00:00:00Z","client":{"id":"pinny","redirect_uris":null,"grant_types":null,"response_types":null,"scopes":null,"audience":null,"public":true,"jwks_uri":"where","jwks":null,"token_endpoint_auth_method":"something","request_uris":null,"request_object_signing_alg":"","token_endpoint_auth_signing_alg":""},"scopes":null,"grantedScopes":null,"form":{"key":["val"]},"session":{"fosite":{"Claims":null,"Headers":null,"ExpiresAt":null,"Username":"snorlax","Subject":"panda"},"custom":{"providerName":"fake-upstream-idp"}},"requestedAudience":null,"grantedAudience":null},"version":"2"}`),
+			"pinniped-storage-version": []byte("1"),
+		},
+		Type: "storage.pinniped.dev/refresh-token",
+	}
+	revokedSecret := secret.DeepCopy()
+	revokedSecret.Namespace = namespace
+	revokedSecret.Labels["storage.pinniped.dev/revoked"] = "true"
+
+	wantActions := []coretesting.Action{
+		coretesting.NewCreateAction(secretsGVR, namespace, secret),
 		coretesting.NewListAction(secretsGVR, schema.GroupVersionKind{Group: "", Version: "v1", Kind: "Secret"}, namespace, metav1.ListOptions{
-			LabelSelector: "storage.pinniped.dev/type=refresh-token,storage.pinniped.dev/request-id=abcd-1",
+			LabelSelector: "storage.pinniped.dev/request-id=abcd-1,storage.pinniped.dev/type=refresh-token,!storage.pinniped.dev/revoked",
 		}),
-		coretesting.NewDeleteAction(secretsGVR, namespace, "pinniped-storage-refresh-token-pwu5zs7lekbhnln2w4"),
+		coretesting.NewUpdateAction(secretsGVR, namespace, revokedSecret),
+		coretesting.NewGetAction(secretsGVR, namespace, "pinniped-storage-refresh-token-pwu5zs7lekbhnln2w4"),
 	}
 
 	ctx, client, _, storage := makeTestSubject()
@@ -146,9 +169,14 @@ func TestRefreshTokenStorageRevocation(t *testing.T) {
 			TokenEndpointAuthMethod: "something",
 		},
 		Form: url.Values{"key": []string{"val"}},
-		Session: &openid.DefaultSession{
-			Username: "snorlax",
-			Subject:  "panda",
+		Session: &psession.PinnipedSession{
+			Fosite: &openid.DefaultSession{
+				Username: "snorlax",
+				Subject:  "panda",
+			},
+			Custom: &psession.CustomSessionData{
+				ProviderName: "fake-upstream-idp",
+			},
 		},
 	}
 	err := storage.CreateRefreshTokenSession(ctx, "fancy-signature", request)
@@ -158,15 +186,103 @@ func TestRefreshTokenStorageRevocation(t *testing.T) {
 	err = storage.RevokeRefreshToken(ctx, "abcd-1")
 	require.NoError(t, err)
 
+	// Using the revoked refresh token again is reported as a replay, along with the request of the token family
+	replayedRequest, err := storage.GetRefreshTokenSession(ctx, "fancy-signature", nil)
+	require.EqualError(t, err, "not_found")
+	require.True(t, errors.Is(err, fosite.ErrNotFound))
+	require.True(t, errors.Is(err, ErrRefreshTokenReplayed))
+	require.Equal(t, request, replayedRequest)
+
 	require.Equal(t, wantActions, client.Actions())
 }
 
-func TestGetNotFound(t *testing.T) {
-	ctx, _, _, storage := makeTestSubject()
+func TestRefreshTokenStorageWithAllBackends(t *testing.T) {
+	for _, backend := range storagebackends.All(t) {
+		backend := backend
+		t.Run(backend.Name, func(t *testing.T) {
+			ctx, storage := makeTestSubjectWithBackend(backend)
+
+			request := &fosite.Request{
+				ID: "abcd-1",
+				Client: &fosite.DefaultOpenIDConnectClient{
+					DefaultClient: &fosite.DefaultClient{ID: "pinny", Public: true},
+				},
+				Form: url.Values{"key": []string{"val"}},
+				Session: &psession.PinnipedSession{
+					Fosite: &openid.DefaultSession{Username: "snorlax", Subject: "panda"},
+					Custom: &psession.CustomSessionData{ProviderName: "fake-upstream-idp"},
+				},
+			}
+			require.NoError(t, storage.CreateRefreshTokenSession(ctx, "fancy-signature", request))
+
+			newRequest, err := storage.GetRefreshTokenSession(ctx, "fancy-signature", nil)
+			require.NoError(t, err)
+			require.Equal(t, request, newRequest)
+
+			// Using a revoked refresh token again is reported as a replay.
+			require.NoError(t, storage.RevokeRefreshToken(ctx, "abcd-1"))
+			replayedRequest, err := storage.GetRefreshTokenSession(ctx, "fancy-signature", nil)
+			require.True(t, errors.Is(err, fosite.ErrNotFound))
+			require.True(t, errors.Is(err, ErrRefreshTokenReplayed))
+			require.Equal(t, request, replayedRequest)
+
+			require.NoError(t, storage.DeleteRefreshTokenSession(ctx, "fancy-signature"))
+			_, err = storage.GetRefreshTokenSession(ctx, "fancy-signature", nil)
+			require.True(t, errors.Is(err, fosite.ErrNotFound))
+			require.False(t, errors.Is(err, ErrRefreshTokenReplayed))
+		})
+	}
+}
+
+func TestUpgradeFromVersion1(t *testing.T) {
+	for _, backend := range storagebackends.All(t) {
+		backend := backend
+		t.Run(backend.Name, func(t *testing.T) {
+			ctx, storage := makeTestSubjectWithBackend(backend)
+
+			// Version 1 stored the fosite session directly instead of wrapping it in a PinnipedSession.
+			_, err := backend.Storage(TypeLabelValue, clock.NewFakeClock(fakeNow).Now, lifetime).Create(ctx, "fancy-signature",
+				json.RawMessage(`{"request":{"id":"abcd-1","requestedAt":"0001-01-01T00:00:00Z","client":{"id":"pinny","redirect_uris":null,"grant_types":null,"response_types":null,"scopes":null,"audience":null,"public":true,"jwks_uri":"","jwks":null,"token_endpoint_auth_method":"","request_uris":null,"request_object_signing_alg":"","token_endpoint_auth_signing_alg":""},"scopes":null,"grantedScopes":null,"form":{"key":["val"]},"session":{"Claims":null,"Headers":null,"ExpiresAt":null,"Username":"snorlax","Subject":"panda"},"requestedAudience":null,"grantedAudience":null},"version":"1"}`),
+				map[string]string{fositestorage.StorageRequestIDLabelName: "abcd-1"},
+			)
+			require.NoError(t, err)
+
+			wantRequest := &fosite.Request{
+				ID: "abcd-1",
+				Client: &fosite.DefaultOpenIDConnectClient{
+					DefaultClient: &fosite.DefaultClient{ID: "pinny", Public: true},
+				},
+				Form: url.Values{"key": []string{"val"}},
+				Session: &psession.PinnipedSession{
+					Fosite: &openid.DefaultSession{Username: "snorlax", Subject: "panda"},
+					Custom: &psession.CustomSessionData{},
+				},
+			}
+
+			request, err := storage.GetRefreshTokenSession(ctx, "fancy-signature", nil)
+			require.NoError(t, err)
+			require.Equal(t, wantRequest, request)
+
+			// The upgraded session can still be revoked, and its replay is still detected.
+			require.NoError(t, storage.RevokeRefreshToken(ctx, "abcd-1"))
+			request, err = storage.GetRefreshTokenSession(ctx, "fancy-signature", nil)
+			require.True(t, errors.Is(err, ErrRefreshTokenReplayed))
+			require.Equal(t, wantRequest, request)
+		})
+	}
+}
 
-	_, notFoundErr := storage.GetRefreshTokenSession(ctx, "non-existent-signature", nil)
-	require.EqualError(t, notFoundErr, "not_found")
-	require.True(t, errors.Is(notFoundErr, fosite.ErrNotFound))
+func TestGetNotFound(t *testing.T) {
+	for _, backend := range storagebackends.All(t) {
+		backend := backend
+		t.Run(backend.Name, func(t *testing.T) {
+			ctx, storage := makeTestSubjectWithBackend(backend)
+
+			_, notFoundErr := storage.GetRefreshTokenSession(ctx, "non-existent-signature", nil)
+			require.EqualError(t, notFoundErr, "not_found")
+			require.True(t, errors.Is(notFoundErr, fosite.ErrNotFound))
+		})
+	}
 }
 
 func TestWrongVersion(t *testing.T) {
@@ -184,7 +300,7 @@ func TestWrongVersion(t *testing.T) {
 			},
 		},
 		Data: map[string][]byte{
-			"pinniped-storage-data":    []byte(`{"request":{"id":"abcd-1","requestedAt":"0001-01-01T00:00:00Z","client":{"id":"pinny","redirect_uris":null,"grant_types":null,"response_types":null,"scopes":null,"audience":null,"public":true,"jwks_uri":"where","jwks":null,"token_endpoint_auth_method":"something","request_uris":null,"request_object_signing_alg":"","token_endpoint_auth_signing_alg":""},"scopes":null,"grantedScopes":null,"form":{"key":["val"]},"session":{"Claims":null,"Headers":null,"ExpiresAt":null,"Username":"snorlax","Subject":"panda"},"requestedAudience":null,"grantedAudience":null},"version":"not-the-right-version"}`),
+			"pinniped-storage-data":    []byte(`{"request":{"id":"abcd-1","requestedAt":"0001-01-01T00:00:00Z","client":{"id":"pinny","redirect_uris":null,"grant_types":null,"response_types":null,"scopes":null,"audience":null,"public":true,"jwks_uri":"where","jwks":null,"token_endpoint_auth_method":"something","request_uris":null,"request_object_signing_alg":"","token_endpoint_auth_signing_alg":""},"scopes":null,"grantedScopes":null,"form":{"key":["val"]},"session":{"fosite":{"Claims":null,"Headers":null,"ExpiresAt":null,"Username":"snorlax","Subject":"panda"},"custom":{"providerName":"fake-upstream-idp"}},"requestedAudience":null,"grantedAudience":null},"version":"not-the-right-version"}`),
 			"pinniped-storage-version": []byte("1"),
 		},
 		Type: "storage.pinniped.dev/refresh-token",
@@ -194,7 +310,7 @@ func TestWrongVersion(t *testing.T) {
 
 	_, err = storage.GetRefreshTokenSession(ctx, "fancy-signature", nil)
 
-	require.EqualError(t, err, "refresh token request data has wrong version: refresh token session for fancy-signature has version not-the-right-version instead of 1")
+	require.EqualError(t, err, "refresh token request data has wrong version: refresh token session for fancy-signature has version not-the-right-version instead of 2")
 }
 
 func TestNilSessionRequest(t *testing.T) {
@@ -212,7 +328,7 @@ func TestNilSessionRequest(t *testing.T) {
 			},
 		},
 		Data: map[string][]byte{
-			"pinniped-storage-data":    []byte(`{"nonsense-key": "nonsense-value","version":"1"}`),
+			"pinniped-storage-data":    []byte(`{"nonsense-key": "nonsense-value","version":"2"}`),
 			"pinniped-storage-version": []byte("1"),
 		},
 		Type: "storage.pinniped.dev/refresh-token",
@@ -226,28 +342,38 @@ func TestNilSessionRequest(t *testing.T) {
 }
 
 func TestCreateWithNilRequester(t *testing.T) {
-	ctx, _, _, storage := makeTestSubject()
-
-	err := storage.CreateRefreshTokenSession(ctx, "signature-doesnt-matter", nil)
-	require.EqualError(t, err, "requester must be of type fosite.Request")
+	for _, backend := range storagebackends.All(t) {
+		backend := backend
+		t.Run(backend.Name, func(t *testing.T) {
+			ctx, storage := makeTestSubjectWithBackend(backend)
+
+			err := storage.CreateRefreshTokenSession(ctx, "signature-doesnt-matter", nil)
+			require.EqualError(t, err, "requester must be of type fosite.Request")
+		})
+	}
 }
 
 func TestCreateWithWrongRequesterDataTypes(t *testing.T) {
-	ctx, _, _, storage := makeTestSubject()
-
-	request := &fosite.Request{
-		Session: nil,
-		Client:  &fosite.DefaultOpenIDConnectClient{},
+	for _, backend := range storagebackends.All(t) {
+		backend := backend
+		t.Run(backend.Name, func(t *testing.T) {
+			ctx, storage := makeTestSubjectWithBackend(backend)
+
+			request := &fosite.Request{
+				Session: nil,
+				Client:  &fosite.DefaultOpenIDConnectClient{},
+			}
+			err := storage.CreateRefreshTokenSession(ctx, "signature-doesnt-matter", request)
+			require.EqualError(t, err, "requester's session must be of type PinnipedSession")
+
+			request = &fosite.Request{
+				Session: psession.NewPinnipedSession(),
+				Client:  nil,
+			}
+			err = storage.CreateRefreshTokenSession(ctx, "signature-doesnt-matter", request)
+			require.EqualError(t, err, "requester's client must be of type fosite.DefaultOpenIDConnectClient")
+		})
 	}
-	err := storage.CreateRefreshTokenSession(ctx, "signature-doesnt-matter", request)
-	require.EqualError(t, err, "requester's session must be of type openid.DefaultSession")
-
-	request = &fosite.Request{
-		Session: &openid.DefaultSession{},
-		Client:  nil,
-	}
-	err = storage.CreateRefreshTokenSession(ctx, "signature-doesnt-matter", request)
-	require.EqualError(t, err, "requester's client must be of type fosite.DefaultOpenIDConnectClient")
 }
 
 func TestCreateWithoutRequesterID(t *testing.T) {
@@ -255,7 +381,7 @@ func TestCreateWithoutRequesterID(t *testing.T) {
 
 	request := &fosite.Request{
 		ID:      "", // empty ID
-		Session: &openid.DefaultSession{},
+		Session: psession.NewPinnipedSession(),
 		Client:  &fosite.DefaultOpenIDConnectClient{},
 	}
 	err := storage.CreateRefreshTokenSession(ctx, "signature-doesnt-matter", request)
@@ -275,5 +401,9 @@ func TestCreateWithoutRequesterID(t *testing.T) {
 func makeTestSubject() (context.Context, *fake.Clientset, corev1client.SecretInterface, RevocationStorage) {
 	client := fake.NewSimpleClientset()
 	secrets := client.CoreV1().Secrets(namespace)
-	return context.Background(), client, secrets, New(secrets, clock.NewFakeClock(fakeNow).Now, lifetime)
+	return context.Background(), client, secrets, New(crud.NewSecretsBackend(secrets), clock.NewFakeClock(fakeNow).Now, lifetime)
+}
+
+func makeTestSubjectWithBackend(backend crud.Backend) (context.Context, RevocationStorage) {
+	return context.Background(), New(backend, clock.NewFakeClock(fakeNow).Now, lifetime)
 }
@@ -0,0 +1,265 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package sessionadmin provides administrative operations for listing and revoking the downstream
+// sessions which are held in the Supervisor's session storage.
+package sessionadmin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ory/fosite"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"go.pinniped.dev/internal/constable"
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/fositestorage"
+	"go.pinniped.dev/internal/fositestorage/accesstoken"
+	"go.pinniped.dev/internal/fositestorage/authorizationcode"
+	"go.pinniped.dev/internal/fositestorage/openidconnect"
+	"go.pinniped.dev/internal/fositestorage/pkce"
+	"go.pinniped.dev/internal/fositestorage/refreshtoken"
+	"go.pinniped.dev/internal/psession"
+)
+
+const ErrEmptyRevocationFilter = constable.Error("refusing to revoke sessions without at least one filter")
+
+// Filter selects sessions. Empty fields match every session.
+type Filter struct {
+	RequestID              string
+	Subject                string
+	Username               string
+	UpstreamIssuer         string
+	UpstreamName           string
+	FederationDomainIssuer string
+}
+
+// IsEmpty returns true when the Filter would select every session.
+func (f Filter) IsEmpty() bool {
+	return f == Filter{}
+}
+
+// tokenResources are the resources which hold the tokens of a session.
+func tokenResources() []string {
+	return []string{accesstoken.TypeLabelValue, refreshtoken.TypeLabelValue}
+}
+
+// sessionResources are all of the resources which hold the state of a session. They are all labeled with the request
+// ID of the session and with the labels which index it by identity.
+func sessionResources() []string {
+	return []string{
+		authorizationcode.TypeLabelValue,
+		pkce.TypeLabelValue,
+		openidconnect.TypeLabelValue,
+		accesstoken.TypeLabelValue,
+		refreshtoken.TypeLabelValue,
+	}
+}
+
+func (f Filter) selector(resources []string) crud.Selector {
+	set := map[string]string{}
+	if f.RequestID != "" {
+		set[fositestorage.StorageRequestIDLabelName] = f.RequestID
+	}
+	for labelName, value := range map[string]string{
+		fositestorage.StorageSubjectLabelName:          f.Subject,
+		fositestorage.StorageUsernameLabelName:         f.Username,
+		fositestorage.StorageUpstreamIssuerLabelName:   f.UpstreamIssuer,
+		fositestorage.StorageUpstreamNameLabelName:     f.UpstreamName,
+		fositestorage.StorageFederationDomainLabelName: f.FederationDomainIssuer,
+	} {
+		if value != "" {
+			set[labelName] = fositestorage.IndexLabelValue(value)
+		}
+	}
+	return crud.Selector{
+		Resources: resources,
+		Labels:    set,
+	}
+}
+
+// activeSelector is like selector, but skips the tokens which have already been revoked.
+func (f Filter) activeSelector() crud.Selector {
+	selector := f.selector(tokenResources())
+	selector.Unrevoked = true
+	return selector
+}
+
+// Session describes one downstream session, which is the family of access and refresh tokens which were
+// issued from a single authorization.
+type Session struct {
+	RequestID              string
+	ClientID               string
+	Subject                string
+	Username               string
+	UpstreamIssuer         string
+	UpstreamName           string
+	FederationDomainIssuer string
+
+	// CreatedAt is the time at which the user authenticated with the upstream identity provider.
+	CreatedAt time.Time
+	// LastUsedAt is the time at which the newest token of the session was issued.
+	LastUsedAt time.Time
+	// ExpiresAt is the time after which none of the tokens of the session can be used anymore.
+	ExpiresAt time.Time
+}
+
+type Admin struct {
+	backend crud.Backend
+	clock   func() time.Time
+}
+
+// New returns an Admin for the sessions which are stored in backend. The tokens which expired before the time
+// returned by clock are ignored, even when they have not been garbage collected yet.
+func New(backend crud.Backend, clock func() time.Time) *Admin {
+	return &Admin{backend: backend, clock: clock}
+}
+
+// List returns the sessions selected by the filter which still have unrevoked tokens, sorted by creation time.
+func (a *Admin) List(ctx context.Context, filter Filter) ([]Session, error) {
+	entries, err := a.backend.List(ctx, filter.activeSelector())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+
+	now := a.clock()
+	sessionsByRequestID := map[string]*Session{}
+	for _, entry := range entries {
+		request, err := decodeRequest(entry)
+		if err != nil {
+			return nil, err
+		}
+		expiresAt := entryExpiration(entry, request)
+		if !expiresAt.IsZero() && !expiresAt.After(now) {
+			continue
+		}
+		session, ok := sessionsByRequestID[request.ID]
+		if !ok {
+			session = newSession(request)
+			sessionsByRequestID[request.ID] = session
+		}
+		session.merge(entry, request, expiresAt)
+	}
+
+	sessions := make([]Session, 0, len(sessionsByRequestID))
+	for _, session := range sessionsByRequestID {
+		if session.CreatedAt.IsZero() {
+			// The authentication time is unknown, so the best approximation is the newest token.
+			session.CreatedAt = session.LastUsedAt
+		}
+		sessions = append(sessions, *session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].CreatedAt.Equal(sessions[j].CreatedAt) {
+			return sessions[i].RequestID < sessions[j].RequestID
+		}
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+	return sessions, nil
+}
+
+// Revoke deletes all of the tokens, authorization codes, PKCE and OIDC sessions of the sessions selected by the
+// filter, and returns the number of sessions which were revoked. An empty filter is rejected to avoid accidentally
+// revoking every session.
+func (a *Admin) Revoke(ctx context.Context, filter Filter) (int, error) {
+	if filter.IsEmpty() {
+		return 0, ErrEmptyRevocationFilter
+	}
+
+	entries, err := a.backend.List(ctx, filter.selector(sessionResources()))
+	if err != nil {
+		return 0, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	requestIDs := sets.NewString()
+	for _, entry := range entries {
+		requestIDs.Insert(entry.Labels[fositestorage.StorageRequestIDLabelName])
+	}
+
+	revoked := 0
+	for _, requestID := range requestIDs.List() {
+		// Select by request ID too, so that nothing which was stored for the session is left behind, even when it
+		// is not labeled with the identity of the session.
+		sessionEntries, err := a.backend.List(ctx, Filter{RequestID: requestID}.selector(sessionResources()))
+		if err != nil {
+			return revoked, fmt.Errorf("failed to list session %s: %w", requestID, err)
+		}
+		for _, entry := range sessionEntries {
+			if err := a.backend.DeleteEntry(ctx, entry); err != nil {
+				return revoked, fmt.Errorf("failed to delete session %s: %w", entry.Name, err)
+			}
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+func decodeRequest(entry crud.Entry) (*fosite.Request, error) {
+	// Access token and refresh token sessions share the same storage format.
+	stored := struct {
+		Request *fosite.Request `json:"request"`
+	}{
+		Request: &fosite.Request{
+			Client:  &fosite.DefaultOpenIDConnectClient{},
+			Session: psession.NewPinnipedSession(),
+		},
+	}
+	if err := json.Unmarshal(entry.Data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to decode session %s: %w", entry.Name, err)
+	}
+	if stored.Request.ID == "" {
+		return nil, fmt.Errorf("malformed session %s: missing request ID", entry.Name)
+	}
+	return stored.Request, nil
+}
+
+func newSession(request *fosite.Request) *Session {
+	pinnipedSession := request.Session.(*psession.PinnipedSession)
+	session := &Session{
+		RequestID: request.ID,
+		ClientID:  request.Client.GetID(),
+	}
+	if pinnipedSession.Fosite != nil {
+		session.Subject = pinnipedSession.Fosite.Subject
+		session.Username = pinnipedSession.Fosite.Username
+		session.UpstreamIssuer = fositestorage.UpstreamIssuerFromDownstreamSubject(pinnipedSession.Fosite.Subject)
+		if pinnipedSession.Fosite.Claims != nil {
+			session.FederationDomainIssuer = pinnipedSession.Fosite.Claims.Issuer
+			session.CreatedAt = pinnipedSession.Fosite.Claims.AuthTime
+		}
+	}
+	if pinnipedSession.Custom != nil {
+		session.UpstreamName = pinnipedSession.Custom.ProviderName
+	}
+	return session
+}
+
+func (s *Session) merge(entry crud.Entry, request *fosite.Request, expiresAt time.Time) {
+	created := entry.CreatedAt
+	if created.IsZero() {
+		// Not every backend records when the token was stored, but it was stored right after it was requested.
+		created = request.RequestedAt
+	}
+	if created.After(s.LastUsedAt) {
+		s.LastUsedAt = created
+	}
+	if expiresAt.After(s.ExpiresAt) {
+		s.ExpiresAt = expiresAt
+	}
+}
+
+func entryExpiration(entry crud.Entry, request *fosite.Request) time.Time {
+	tokenType := fosite.AccessToken
+	if entry.Resource == refreshtoken.TypeLabelValue {
+		tokenType = fosite.RefreshToken
+	}
+	if expiresAt := request.Session.GetExpiresAt(tokenType); !expiresAt.IsZero() {
+		return expiresAt
+	}
+
+	// Fall back to the time after which the stored token may be deleted.
+	return entry.ExpiresAt
+}
@@ -0,0 +1,180 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package sessionadmin
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/ory/fosite/token/jwt"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/clock"
+
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/fositestorage/accesstoken"
+	"go.pinniped.dev/internal/fositestorage/authorizationcode"
+	"go.pinniped.dev/internal/fositestorage/openidconnect"
+	"go.pinniped.dev/internal/fositestorage/pkce"
+	"go.pinniped.dev/internal/fositestorage/refreshtoken"
+	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/testutil/storagebackends"
+)
+
+var (
+	fakeNow      = time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	fakeAuthTime = fakeNow.Add(-time.Hour)
+	lifetime     = 10 * time.Minute
+)
+
+func newRequest(id, username, subject, issuer, upstreamName string) *fosite.Request {
+	session := &psession.PinnipedSession{
+		Fosite: &openid.DefaultSession{
+			Claims: &jwt.IDTokenClaims{
+				Issuer:   issuer,
+				Subject:  subject,
+				AuthTime: fakeAuthTime,
+			},
+			Username: username,
+			Subject:  subject,
+		},
+		Custom: &psession.CustomSessionData{ProviderName: upstreamName},
+	}
+	session.SetExpiresAt(fosite.AccessToken, fakeNow.Add(15*time.Minute))
+	session.SetExpiresAt(fosite.RefreshToken, fakeNow.Add(9*time.Hour))
+	return &fosite.Request{
+		ID: id,
+		Client: &fosite.DefaultOpenIDConnectClient{
+			DefaultClient: &fosite.DefaultClient{ID: "pinniped-cli", Public: true},
+		},
+		Session: session,
+	}
+}
+
+func TestListAndRevoke(t *testing.T) {
+	for _, backend := range storagebackends.All(t) {
+		backend := backend
+		t.Run(backend.Name, func(t *testing.T) {
+			testListAndRevoke(t, backend)
+		})
+	}
+}
+
+func testListAndRevoke(t *testing.T, backend crud.Backend) {
+	ctx := context.Background()
+	accessTokens := accesstoken.New(backend, clock.NewFakeClock(fakeNow).Now, lifetime)
+	refreshTokens := refreshtoken.New(backend, clock.NewFakeClock(fakeNow).Now, lifetime)
+	authorizeCodes := authorizationcode.New(backend, clock.NewFakeClock(fakeNow).Now, lifetime)
+	pkces := pkce.New(backend, clock.NewFakeClock(fakeNow).Now, lifetime)
+	oidcs := openidconnect.New(backend, clock.NewFakeClock(fakeNow).Now, lifetime)
+
+	createLogin := func(r *fosite.Request) {
+		require.NoError(t, authorizeCodes.CreateAuthorizeCodeSession(ctx, r.ID+"-authcode-signature", r))
+		require.NoError(t, pkces.CreatePKCERequestSession(ctx, r.ID+"-authcode-signature", r))
+		require.NoError(t, oidcs.CreateOpenIDConnectSession(ctx, "authcode."+r.ID+"-authcode-signature", r))
+	}
+
+	expired := newRequest("request-4", "alice", "https://upstream-a.com?sub=alice-guid", "https://fd-1.com", "upstream-a")
+	expired.Session.(*psession.PinnipedSession).SetExpiresAt(fosite.AccessToken, fakeNow.Add(-time.Minute))
+	expired.Session.(*psession.PinnipedSession).SetExpiresAt(fosite.RefreshToken, fakeNow.Add(-time.Minute))
+
+	for _, r := range []*fosite.Request{
+		newRequest("request-1", "alice", "https://upstream-a.com?sub=alice-guid", "https://fd-1.com", "upstream-a"),
+		newRequest("request-2", "alice", "https://upstream-a.com?sub=alice-guid", "https://fd-2.com", "upstream-a"),
+		newRequest("request-3", "bob", "https://upstream-b.com?sub=bob-guid", "https://fd-1.com", "upstream-b"),
+		expired,
+	} {
+		createLogin(r)
+		require.NoError(t, accessTokens.CreateAccessTokenSession(ctx, r.ID+"-access-signature", r))
+		require.NoError(t, refreshTokens.CreateRefreshTokenSession(ctx, r.ID+"-refresh-signature", r))
+	}
+
+	// A login which has not exchanged its authorization code for tokens yet.
+	createLogin(newRequest("request-5", "alice", "https://upstream-a.com?sub=alice-guid", "https://fd-1.com", "upstream-a"))
+
+	subject := New(backend, clock.NewFakeClock(fakeNow).Now)
+
+	all, err := subject.List(ctx, Filter{})
+	require.NoError(t, err)
+	require.Len(t, all, 3)
+	require.Equal(t, Session{
+		RequestID:              "request-1",
+		ClientID:               "pinniped-cli",
+		Subject:                "https://upstream-a.com?sub=alice-guid",
+		Username:               "alice",
+		UpstreamIssuer:         "https://upstream-a.com",
+		UpstreamName:           "upstream-a",
+		FederationDomainIssuer: "https://fd-1.com",
+		CreatedAt:              fakeAuthTime,
+		ExpiresAt:              fakeNow.Add(9 * time.Hour),
+	}, all[0])
+
+	alice, err := subject.List(ctx, Filter{Username: "alice"})
+	require.NoError(t, err)
+	require.Len(t, alice, 2)
+	require.Equal(t, "request-1", alice[0].RequestID)
+	require.Equal(t, "request-2", alice[1].RequestID)
+
+	fd1, err := subject.List(ctx, Filter{FederationDomainIssuer: "https://fd-1.com"})
+	require.NoError(t, err)
+	require.Len(t, fd1, 2)
+	require.Equal(t, "request-1", fd1[0].RequestID)
+	require.Equal(t, "request-3", fd1[1].RequestID)
+
+	upstreamB, err := subject.List(ctx, Filter{UpstreamIssuer: "https://upstream-b.com"})
+	require.NoError(t, err)
+	require.Len(t, upstreamB, 1)
+	require.Equal(t, "bob", upstreamB[0].Username)
+
+	upstreamA, err := subject.List(ctx, Filter{UpstreamName: "upstream-a"})
+	require.NoError(t, err)
+	require.Len(t, upstreamA, 2)
+	require.Equal(t, "alice", upstreamA[0].Username)
+	require.Equal(t, "alice", upstreamA[1].Username)
+
+	revoked, err := subject.Revoke(ctx, Filter{})
+	require.EqualError(t, err, "refusing to revoke sessions without at least one filter")
+	require.Zero(t, revoked)
+
+	// The expired session and the login without tokens are not listed, but they are still revoked.
+	revoked, err = subject.Revoke(ctx, Filter{Username: "alice"})
+	require.NoError(t, err)
+	require.Equal(t, 4, revoked)
+
+	remaining, err := backend.List(ctx, crud.Selector{})
+	require.NoError(t, err)
+	require.Len(t, remaining, 5)
+	for _, entry := range remaining {
+		require.Equal(t, "request-3", entry.Labels["storage.pinniped.dev/request-id"])
+	}
+
+	// Nothing which was stored for a revoked session can be used anymore.
+	for _, requestID := range []string{"request-1", "request-5"} {
+		_, err = authorizeCodes.GetAuthorizeCodeSession(ctx, requestID+"-authcode-signature", nil)
+		require.True(t, errors.Is(err, fosite.ErrNotFound))
+		_, err = pkces.GetPKCERequestSession(ctx, requestID+"-authcode-signature", nil)
+		require.True(t, errors.Is(err, fosite.ErrNotFound))
+		_, err = oidcs.GetOpenIDConnectSession(ctx, "authcode."+requestID+"-authcode-signature", nil)
+		require.True(t, errors.Is(err, fosite.ErrNotFound))
+	}
+	_, err = accessTokens.GetAccessTokenSession(ctx, "request-1-access-signature", nil)
+	require.True(t, errors.Is(err, fosite.ErrNotFound))
+	_, err = refreshTokens.GetRefreshTokenSession(ctx, "request-1-refresh-signature", nil)
+	require.True(t, errors.Is(err, fosite.ErrNotFound))
+
+	revoked, err = subject.Revoke(ctx, Filter{RequestID: "request-3"})
+	require.NoError(t, err)
+	require.Equal(t, 1, revoked)
+
+	remaining, err = backend.List(ctx, crud.Selector{})
+	require.NoError(t, err)
+	require.Empty(t, remaining)
+
+	all, err = subject.List(ctx, Filter{})
+	require.NoError(t, err)
+	require.Empty(t, all)
+}
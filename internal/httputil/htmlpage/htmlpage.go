@@ -0,0 +1,150 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package htmlpage renders the branded HTML pages which Pinniped shows to end users in web browsers, both from the
+// Supervisor and from the localhost callback of the CLI. Clients which do not ask for HTML get the same information
+// as JSON.
+package htmlpage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"go.pinniped.dev/internal/plog"
+)
+
+const (
+	successHeading = "Login succeeded"
+	successMessage = "You have been logged in and may now close this window."
+)
+
+//nolint:gochecknoglobals
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Branding.Title}}</title>
+<style>{{.Style}}</style>
+</head>
+<body>
+<main>
+{{if .Branding.LogoURL}}<img class="logo" src="{{.Branding.LogoURL}}" alt="{{.Branding.Title}}">
+{{end}}<h1>{{.Heading}}</h1>
+<p>{{.Message}}</p>
+{{if .ErrorID}}<p class="error-id">Error ID: <code>{{.ErrorID}}</code></p>
+{{end}}<p class="help">{{if .Branding.HelpURL}}<a href="{{.Branding.HelpURL}}">{{.Branding.HelpText}}</a>{{else}}{{.Branding.HelpText}}{{end}}</p>
+</main>
+</body>
+</html>
+`))
+
+// Branding holds the customizable parts of the HTML pages which are shown in web browsers. The colors and URLs
+// must have been validated before they are used to render a page.
+type Branding struct {
+	Title           string
+	LogoURL         string
+	PrimaryColor    string
+	BackgroundColor string
+	HelpURL         string
+	HelpText        string
+}
+
+// DefaultBranding returns the branding which is used when none is configured.
+func DefaultBranding() *Branding {
+	return &Branding{
+		Title:           "Pinniped",
+		PrimaryColor:    "#1a5e9a",
+		BackgroundColor: "#f5f6f7",
+		HelpText:        "Contact your administrator for help.",
+	}
+}
+
+type pageData struct {
+	Branding *Branding
+	Style    template.CSS
+	Heading  string
+	Message  string
+	ErrorID  string
+}
+
+type successResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// WriteSuccess writes the page which tells the end user that the login succeeded and that they may close the
+// window. A nil branding means the default branding.
+func WriteSuccess(w http.ResponseWriter, req *http.Request, branding *Branding) {
+	if !WantsHTML(req) {
+		WriteJSON(w, http.StatusOK, &successResponse{Status: "success", Message: successMessage})
+		return
+	}
+	if branding == nil {
+		branding = DefaultBranding()
+	}
+	WriteHTML(w, http.StatusOK, branding, successHeading, successMessage, "")
+}
+
+// WantsHTML returns true for requests from web browsers, which always list text/html in their Accept header.
+func WantsHTML(req *http.Request) bool {
+	for _, accept := range req.Header.Values("Accept") {
+		if strings.Contains(strings.ToLower(accept), "text/html") {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteJSON writes the body as JSON, for clients which did not ask for HTML.
+func WriteJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// WriteHTML writes a page with the branding, which shows the heading and the message, and the error ID when it is
+// not empty.
+func WriteHTML(w http.ResponseWriter, code int, branding *Branding, heading, msg, errorID string) {
+	style := pageStyle(branding)
+
+	var buf bytes.Buffer
+	if err := pageTemplate.Execute(&buf, &pageData{
+		Branding: branding,
+		Style:    template.CSS(style), //nolint:gosec // the colors were validated when the branding was loaded
+		Heading:  heading,
+		Message:  msg,
+		ErrorID:  errorID,
+	}); err != nil {
+		plog.Error("could not render page", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Relax the Content-Security-Policy only as much as the page needs: its own inline style and the logo image.
+	styleHash := sha256.Sum256([]byte(style))
+	w.Header().Set("Content-Security-Policy", fmt.Sprintf(
+		"default-src 'none'; style-src 'sha256-%s'; img-src https:; frame-ancestors 'none'",
+		base64.StdEncoding.EncodeToString(styleHash[:]),
+	))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	_, _ = w.Write(buf.Bytes())
+}
+
+func pageStyle(branding *Branding) string {
+	return fmt.Sprintf(
+		"body{margin:0;font-family:sans-serif;background:%s;color:#1f2933}"+
+			"main{max-width:36em;margin:4em auto;padding:2em;background:#fff;border-top:4px solid %s}"+
+			"h1{color:%s;font-size:1.5em}"+
+			".logo{max-height:4em}"+
+			".error-id,.help{color:#52606d;font-size:0.9em}",
+		branding.BackgroundColor, branding.PrimaryColor, branding.PrimaryColor,
+	)
+}
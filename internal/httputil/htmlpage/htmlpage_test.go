@@ -0,0 +1,92 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package htmlpage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/testutil"
+)
+
+const browserAccept = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+
+func TestWriteSuccess(t *testing.T) {
+	branding := &Branding{
+		Title:           "Acme <Login>",
+		LogoURL:         "https://acme.example.com/logo.png",
+		PrimaryColor:    "#ff0000",
+		BackgroundColor: "#ffffff",
+		HelpText:        "Ask the Acme help desk",
+	}
+
+	tests := []struct {
+		name            string
+		branding        *Branding
+		accept          string
+		wantContentType string
+		wantBody        string
+		wantBodyRegexps []string
+	}{
+		{
+			name:            "success for an API client",
+			branding:        branding,
+			wantContentType: "application/json; charset=utf-8",
+			wantBody:        `{"status":"success","message":"You have been logged in and may now close this window."}` + "\n",
+		},
+		{
+			name:            "success for a browser",
+			branding:        branding,
+			accept:          browserAccept,
+			wantContentType: "text/html; charset=utf-8",
+			wantBodyRegexps: []string{
+				`<title>Acme &lt;Login&gt;</title>`,
+				`<img class="logo" src="https://acme.example.com/logo.png" alt="Acme &lt;Login&gt;">`,
+				`<h1>Login succeeded</h1>`,
+				`<p>You have been logged in and may now close this window.</p>`,
+				`<p class="help">Ask the Acme help desk</p>`,
+				`border-top:4px solid #ff0000`,
+			},
+		},
+		{
+			name:            "success for a browser with the default branding",
+			accept:          browserAccept,
+			wantContentType: "text/html; charset=utf-8",
+			wantBodyRegexps: []string{
+				`<title>Pinniped</title>`,
+				`<h1>Login succeeded</h1>`,
+				`<p>You have been logged in and may now close this window.</p>`,
+				`Contact your administrator for help.`,
+			},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/callback", nil)
+			if test.accept != "" {
+				req.Header.Set("Accept", test.accept)
+			}
+			rsp := httptest.NewRecorder()
+			WriteSuccess(rsp, req, test.branding)
+
+			require.Equal(t, http.StatusOK, rsp.Code)
+			require.Equal(t, test.wantContentType, rsp.Header().Get("Content-Type"))
+			require.NotContains(t, rsp.Body.String(), "Error ID")
+			if test.wantBody != "" {
+				require.Equal(t, test.wantBody, rsp.Body.String())
+			}
+			for _, want := range test.wantBodyRegexps {
+				require.Regexp(t, regexp.QuoteMeta(want), rsp.Body.String())
+			}
+			if test.accept != "" {
+				testutil.RequireStyleAllowedByCSP(t, rsp)
+			}
+		})
+	}
+}
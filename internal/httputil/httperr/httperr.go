@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package httperr contains some helpers for nicer error handling in http.Handler implementations.
@@ -15,6 +15,13 @@ type Responder interface {
 	Respond(http.ResponseWriter)
 }
 
+// StatusResponder is a Responder which also reports its HTTP status code and message, so that it can be
+// rendered in formats other than text/plain. The message does not include the internal cause of the error.
+type StatusResponder interface {
+	Responder
+	Status() (code int, msg string)
+}
+
 // New returns a Responder that emits the given HTTP status code and message.
 func New(code int, msg string) error {
 	return httpErr{code: code, msg: msg}
@@ -48,6 +55,10 @@ func (e httpErr) Respond(w http.ResponseWriter) {
 	http.Error(w, http.StatusText(e.code)+": "+e.msg, e.code)
 }
 
+func (e httpErr) Status() (int, string) {
+	return e.code, e.msg
+}
+
 func (e httpErr) Unwrap() error {
 	return e.cause
 }
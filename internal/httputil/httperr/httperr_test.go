@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package httperr
@@ -43,6 +43,14 @@ func TestHTTPErrs(t *testing.T) {
 			"X-Content-Type-Options": []string{"nosniff"},
 		}, rec.Header())
 	})
+
+	t.Run("status", func(t *testing.T) {
+		err := Wrap(http.StatusForbidden, "boring public bits", fmt.Errorf("some secret internal bits"))
+		require.Implements(t, (*StatusResponder)(nil), err)
+		code, msg := err.(StatusResponder).Status()
+		require.Equal(t, http.StatusForbidden, code)
+		require.Equal(t, "boring public bits", msg)
+	})
 }
 
 func TestHandlerFunc(t *testing.T) {
@@ -83,12 +83,13 @@ func (m *MockTokenCredentialRequestAuthenticator) EXPECT() *MockTokenCredentialR
 }
 
 // AuthenticateTokenCredentialRequest mocks base method
-func (m *MockTokenCredentialRequestAuthenticator) AuthenticateTokenCredentialRequest(arg0 context.Context, arg1 *login.TokenCredentialRequest) (user.Info, error) {
+func (m *MockTokenCredentialRequestAuthenticator) AuthenticateTokenCredentialRequest(arg0 context.Context, arg1 *login.TokenCredentialRequest) (user.Info, time.Duration, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "AuthenticateTokenCredentialRequest", arg0, arg1)
 	ret0, _ := ret[0].(user.Info)
-	ret1, _ := ret[1].(error)
-	return ret0, ret1
+	ret1, _ := ret[1].(time.Duration)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
 }
 
 // AuthenticateTokenCredentialRequest indicates an expected call of AuthenticateTokenCredentialRequest
@@ -10,6 +10,7 @@ package mocksecrethelper
 
 import (
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 	v1 "k8s.io/api/core/v1"
@@ -98,6 +99,20 @@ func (mr *MockSecretHelperMockRecorder) NamePrefix() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NamePrefix", reflect.TypeOf((*MockSecretHelper)(nil).NamePrefix))
 }
 
+// NextKeyRotationCheck mocks base method
+func (m *MockSecretHelper) NextKeyRotationCheck(arg0 *v1.Secret) time.Duration {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NextKeyRotationCheck", arg0)
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+// NextKeyRotationCheck indicates an expected call of NextKeyRotationCheck
+func (mr *MockSecretHelperMockRecorder) NextKeyRotationCheck(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NextKeyRotationCheck", reflect.TypeOf((*MockSecretHelper)(nil).NextKeyRotationCheck), arg0)
+}
+
 // ObserveActiveSecretAndUpdateParentFederationDomain mocks base method
 func (m *MockSecretHelper) ObserveActiveSecretAndUpdateParentFederationDomain(arg0 *v1alpha1.FederationDomain, arg1 *v1.Secret) *v1alpha1.FederationDomain {
 	m.ctrl.T.Helper()
@@ -111,3 +126,17 @@ func (mr *MockSecretHelperMockRecorder) ObserveActiveSecretAndUpdateParentFedera
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ObserveActiveSecretAndUpdateParentFederationDomain", reflect.TypeOf((*MockSecretHelper)(nil).ObserveActiveSecretAndUpdateParentFederationDomain), arg0, arg1)
 }
+
+// RotateKey mocks base method
+func (m *MockSecretHelper) RotateKey(arg0, arg1 *v1.Secret) *v1.Secret {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RotateKey", arg0, arg1)
+	ret0, _ := ret[0].(*v1.Secret)
+	return ret0
+}
+
+// RotateKey indicates an expected call of RotateKey
+func (mr *MockSecretHelperMockRecorder) RotateKey(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RotateKey", reflect.TypeOf((*MockSecretHelper)(nil).RotateKey), arg0, arg1)
+}
@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 //
 
@@ -57,6 +57,20 @@ func (mr *MockUpstreamOIDCIdentityProviderIMockRecorder) ExchangeAuthcodeAndVali
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExchangeAuthcodeAndValidateTokens", reflect.TypeOf((*MockUpstreamOIDCIdentityProviderI)(nil).ExchangeAuthcodeAndValidateTokens), arg0, arg1, arg2, arg3, arg4)
 }
 
+// GetAdditionalClaims mocks base method
+func (m *MockUpstreamOIDCIdentityProviderI) GetAdditionalClaims() map[string]string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAdditionalClaims")
+	ret0, _ := ret[0].(map[string]string)
+	return ret0
+}
+
+// GetAdditionalClaims indicates an expected call of GetAdditionalClaims
+func (mr *MockUpstreamOIDCIdentityProviderIMockRecorder) GetAdditionalClaims() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAdditionalClaims", reflect.TypeOf((*MockUpstreamOIDCIdentityProviderI)(nil).GetAdditionalClaims))
+}
+
 // GetAuthorizationURL mocks base method
 func (m *MockUpstreamOIDCIdentityProviderI) GetAuthorizationURL() *url.URL {
 	m.ctrl.T.Helper()
@@ -113,6 +127,34 @@ func (mr *MockUpstreamOIDCIdentityProviderIMockRecorder) GetName() *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetName", reflect.TypeOf((*MockUpstreamOIDCIdentityProviderI)(nil).GetName))
 }
 
+// GetRequiredACRValues mocks base method
+func (m *MockUpstreamOIDCIdentityProviderI) GetRequiredACRValues() []string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRequiredACRValues")
+	ret0, _ := ret[0].([]string)
+	return ret0
+}
+
+// GetRequiredACRValues indicates an expected call of GetRequiredACRValues
+func (mr *MockUpstreamOIDCIdentityProviderIMockRecorder) GetRequiredACRValues() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRequiredACRValues", reflect.TypeOf((*MockUpstreamOIDCIdentityProviderI)(nil).GetRequiredACRValues))
+}
+
+// GetRequiredAMRValues mocks base method
+func (m *MockUpstreamOIDCIdentityProviderI) GetRequiredAMRValues() []string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRequiredAMRValues")
+	ret0, _ := ret[0].([]string)
+	return ret0
+}
+
+// GetRequiredAMRValues indicates an expected call of GetRequiredAMRValues
+func (mr *MockUpstreamOIDCIdentityProviderIMockRecorder) GetRequiredAMRValues() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRequiredAMRValues", reflect.TypeOf((*MockUpstreamOIDCIdentityProviderI)(nil).GetRequiredAMRValues))
+}
+
 // GetScopes mocks base method
 func (m *MockUpstreamOIDCIdentityProviderI) GetScopes() []string {
 	m.ctrl.T.Helper()
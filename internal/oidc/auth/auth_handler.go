@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package auth provides a handler for the OIDC authorization endpoint.
@@ -7,6 +7,7 @@ package auth
 import (
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
@@ -15,12 +16,15 @@ import (
 	"github.com/ory/fosite/token/jwt"
 	"golang.org/x/oauth2"
 
+	"go.pinniped.dev/internal/fositestorage/pushedauthorizationrequest"
 	"go.pinniped.dev/internal/httputil/httperr"
 	"go.pinniped.dev/internal/httputil/securityheader"
 	"go.pinniped.dev/internal/oidc"
 	"go.pinniped.dev/internal/oidc/csrftoken"
+	"go.pinniped.dev/internal/oidc/pages"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/psession"
 	"go.pinniped.dev/pkg/oidcclient/nonce"
 	"go.pinniped.dev/pkg/oidcclient/pkce"
 )
@@ -29,13 +33,15 @@ func NewHandler(
 	downstreamIssuer string,
 	idpListGetter oidc.IDPListGetter,
 	oauthHelper fosite.OAuth2Provider,
+	pushedAuthorizationRequests pushedauthorizationrequest.Storage,
 	generateCSRF func() (csrftoken.CSRFToken, error),
 	generatePKCE func() (pkce.Code, error),
 	generateNonce func() (nonce.Nonce, error),
 	upstreamStateEncoder oidc.Encoder,
 	cookieCodec oidc.Codec,
+	renderer *pages.Renderer,
 ) http.Handler {
-	return securityheader.Wrap(httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+	return securityheader.Wrap(renderer.Wrap(func(w http.ResponseWriter, r *http.Request) error {
 		if r.Method != http.MethodPost && r.Method != http.MethodGet {
 			// https://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
 			// Authorization Servers MUST support the use of the HTTP GET and POST methods defined in
@@ -45,6 +51,12 @@ func NewHandler(
 
 		csrfFromCookie := readCSRFCookie(r, cookieCodec)
 
+		if err := usePushedAuthorizationRequest(r, pushedAuthorizationRequests); err != nil {
+			plog.Info("authorize request error", oidc.FositeErrorForLog(err)...)
+			oauthHelper.WriteAuthorizeError(w, fosite.NewAuthorizeRequest(), err)
+			return nil
+		}
+
 		authorizeRequester, err := oauthHelper.NewAuthorizeRequest(r.Context(), r)
 		if err != nil {
 			plog.Info("authorize request error", oidc.FositeErrorForLog(err)...)
@@ -68,12 +80,14 @@ func NewHandler(
 		oidc.GrantScopeIfRequested(authorizeRequester, "pinniped:request-audience")
 
 		now := time.Now()
-		_, err = oauthHelper.NewAuthorizeResponse(r.Context(), authorizeRequester, &openid.DefaultSession{
-			Claims: &jwt.IDTokenClaims{
-				// Temporary claim values to allow `NewAuthorizeResponse` to perform other OIDC validations.
-				Subject:     "none",
-				AuthTime:    now,
-				RequestedAt: now,
+		_, err = oauthHelper.NewAuthorizeResponse(r.Context(), authorizeRequester, &psession.PinnipedSession{
+			Fosite: &openid.DefaultSession{
+				Claims: &jwt.IDTokenClaims{
+					// Temporary claim values to allow `NewAuthorizeResponse` to perform other OIDC validations.
+					Subject:     "none",
+					AuthTime:    now,
+					RequestedAt: now,
+				},
 			},
 		})
 		if err != nil {
@@ -134,6 +148,10 @@ func NewHandler(
 			authCodeOptions = append(authCodeOptions, oauth2.SetAuthURLParam("prompt", promptParam))
 		}
 
+		if requiredACRValues := upstreamIDP.GetRequiredACRValues(); len(requiredACRValues) > 0 {
+			authCodeOptions = append(authCodeOptions, oauth2.SetAuthURLParam("acr_values", strings.Join(requiredACRValues, " ")))
+		}
+
 		http.Redirect(w, r,
 			upstreamOAuthConfig.AuthCodeURL(
 				encodedStateParamValue,
@@ -146,6 +164,42 @@ func NewHandler(
 	}))
 }
 
+// usePushedAuthorizationRequest replaces the parameters of the request with the parameters of the pushed authorization
+// request which is referred to by its request_uri, if any. Each pushed authorization request can only be used once.
+// See https://datatracker.ietf.org/doc/html/rfc9126#section-4.
+func usePushedAuthorizationRequest(r *http.Request, storage pushedauthorizationrequest.Storage) error {
+	if err := r.ParseForm(); err != nil {
+		return fosite.ErrInvalidRequest.
+			WithHint("Unable to parse HTTP body, make sure to send a properly formatted form request body.").
+			WithWrap(err).WithDebug(err.Error())
+	}
+
+	requestURI := r.Form.Get("request_uri")
+	if !strings.HasPrefix(requestURI, oidc.PushedAuthorizationRequestURIPrefix) {
+		// Not a request_uri of a pushed authorization request, so leave it for fosite to handle.
+		return nil
+	}
+	reference := strings.TrimPrefix(requestURI, oidc.PushedAuthorizationRequestURIPrefix)
+
+	pushedRequest, err := storage.GetPushedAuthorizationRequest(r.Context(), reference)
+	if err != nil {
+		return fosite.ErrInvalidRequestURI.WithHint("The request_uri is unknown or has already been used.").WithWrap(err).WithDebug(err.Error())
+	}
+	if err := storage.DeletePushedAuthorizationRequest(r.Context(), reference); err != nil {
+		// Another request may have used the request_uri concurrently.
+		return fosite.ErrInvalidRequestURI.WithHint("The request_uri is unknown or has already been used.").WithWrap(err).WithDebug(err.Error())
+	}
+	if time.Now().After(pushedRequest.ExpiresAt) {
+		return fosite.ErrInvalidRequestURI.WithHint("The request_uri has expired.")
+	}
+	if r.Form.Get("client_id") != pushedRequest.ClientID {
+		return fosite.ErrInvalidRequestURI.WithHint("The request_uri was not pushed by the client identified by the client_id parameter.")
+	}
+
+	r.Form = pushedRequest.Params
+	return nil
+}
+
 func readCSRFCookie(r *http.Request, codec oidc.Decoder) csrftoken.CSRFToken {
 	receivedCSRFCookie, err := r.Cookie(oidc.CSRFCookieName)
 	if err != nil {
@@ -1,9 +1,10 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package auth
 
 import (
+	"context"
 	"fmt"
 	"html"
 	"net/http"
@@ -12,15 +13,19 @@ import (
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/securecookie"
+	"github.com/ory/fosite"
 	"github.com/stretchr/testify/require"
 
+	"go.pinniped.dev/internal/fositestorage/pushedauthorizationrequest"
 	"go.pinniped.dev/internal/here"
 	"go.pinniped.dev/internal/oidc"
 	"go.pinniped.dev/internal/oidc/csrftoken"
 	"go.pinniped.dev/internal/oidc/jwks"
 	"go.pinniped.dev/internal/oidc/oidctestutil"
+	"go.pinniped.dev/internal/oidc/pages"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/testutil"
 	"go.pinniped.dev/pkg/oidcclient/nonce"
@@ -52,6 +57,27 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			}
 		`)
 
+		unknownRequestURIErrorBody = here.Doc(`
+			{
+				"error":             "invalid_request_uri",
+				"error_description": "The request_uri in the Authorization Request returns an error or contains invalid data. The request_uri is unknown or has already been used."
+			}
+		`)
+
+		expiredRequestURIErrorBody = here.Doc(`
+			{
+				"error":             "invalid_request_uri",
+				"error_description": "The request_uri in the Authorization Request returns an error or contains invalid data. The request_uri has expired."
+			}
+		`)
+
+		wrongClientRequestURIErrorBody = here.Doc(`
+			{
+				"error":             "invalid_request_uri",
+				"error_description": "The request_uri in the Authorization Request returns an error or contains invalid data. The request_uri was not pushed by the client identified by the client_id parameter."
+			}
+		`)
+
 		fositePromptHasNoneAndOtherValueErrorQuery = map[string]string{
 			"error":             "invalid_request",
 			"error_description": "The request is missing a required parameter, includes an invalid parameter value, includes a parameter more than once, or is otherwise malformed. Parameter 'prompt' was set to 'none', but contains other values as well which is not allowed.",
@@ -111,12 +137,15 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		Scopes:           []string{"scope1", "scope2"}, // the scopes to request when starting the upstream authorization flow
 	}
 
+	upstreamOIDCIdentityProviderRequiringACRValues := upstreamOIDCIdentityProvider
+	upstreamOIDCIdentityProviderRequiringACRValues.RequiredACRValues = []string{"phrh", "phr"}
+
 	// Configure fosite the same way that the production code would, using NullStorage to turn off storage.
 	oauthStore := oidc.NullStorage{}
 	hmacSecretFunc := func() []byte { return []byte("some secret - must have at least 32 bytes") }
 	require.GreaterOrEqual(t, len(hmacSecretFunc()), 32, "fosite requires that hmac secrets have at least 32 bytes")
 	jwksProviderIsUnused := jwks.NewDynamicJWKSProvider()
-	oauthHelper := oidc.FositeOauth2Helper(oauthStore, downstreamIssuer, hmacSecretFunc, jwksProviderIsUnused, oidc.DefaultOIDCTimeoutsConfiguration())
+	oauthHelper := oidc.FositeOauth2Helper(oauthStore, downstreamIssuer, hmacSecretFunc, jwksProviderIsUnused, oidc.DefaultOIDCTimeoutsConfiguration(), nil, nil, nil)
 
 	happyCSRF := "test-csrf"
 	happyPKCE := "test-pkce"
@@ -175,6 +204,21 @@ func TestAuthorizationEndpoint(t *testing.T) {
 
 	happyGetRequestPath := pathWithQuery("/some/path", happyGetRequestQueryMap)
 
+	happyPushedAuthorizationRequest := func(clientID string, expiresAt time.Time) map[string]*pushedauthorizationrequest.Request {
+		params := url.Values{}
+		for k, v := range happyGetRequestQueryMap {
+			params.Set(k, v)
+		}
+		return map[string]*pushedauthorizationrequest.Request{
+			"some-reference": {ClientID: clientID, Params: params, ExpiresAt: expiresAt},
+		}
+	}
+
+	happyRequestURIPath := pathWithQuery("/some/path", map[string]string{
+		"client_id":   "pinniped-cli",
+		"request_uri": "urn:ietf:params:oauth:request_uri:some-reference",
+	})
+
 	modifiedHappyGetRequestQueryMap := func(queryOverrides map[string]string) map[string]string {
 		copyOfHappyGetRequestQueryMap := map[string]string{}
 		for k, v := range happyGetRequestQueryMap {
@@ -236,6 +280,15 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		return urlWithQuery(upstreamAuthURL.String(), query)
 	}
 
+	expectedRedirectLocationWithACRValues := func(expectedUpstreamState string, expectedACRValues string) string {
+		location, err := url.Parse(expectedRedirectLocation(expectedUpstreamState, ""))
+		require.NoError(t, err)
+		query := location.Query()
+		query.Set("acr_values", expectedACRValues)
+		location.RawQuery = query.Encode()
+		return location.String()
+	}
+
 	incomingCookieCSRFValue := "csrf-value-from-cookie"
 	encodedIncomingCookieCSRFValue, err := happyCookieEncoder.Encode("csrf", incomingCookieCSRFValue)
 	require.NoError(t, err)
@@ -256,6 +309,8 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		body          string
 		csrfCookie    string
 
+		pushedAuthorizationRequests map[string]*pushedauthorizationrequest.Request
+
 		wantStatus                  int
 		wantContentType             string
 		wantBodyString              string
@@ -285,6 +340,72 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantUpstreamStateParamInLocationHeader: true,
 			wantBodyStringWithLocationInHref:       true,
 		},
+		{
+			name:                                   "happy path using the request_uri of a pushed authorization request",
+			issuer:                                 downstreamIssuer,
+			idpListGetter:                          oidctestutil.NewIDPListGetter(&upstreamOIDCIdentityProvider),
+			generateCSRF:                           happyCSRFGenerator,
+			generatePKCE:                           happyPKCEGenerator,
+			generateNonce:                          happyNonceGenerator,
+			stateEncoder:                           happyStateEncoder,
+			cookieEncoder:                          happyCookieEncoder,
+			method:                                 http.MethodGet,
+			path:                                   happyRequestURIPath,
+			pushedAuthorizationRequests:            happyPushedAuthorizationRequest("pinniped-cli", time.Now().Add(time.Minute)),
+			wantStatus:                             http.StatusFound,
+			wantContentType:                        "text/html; charset=utf-8",
+			wantCSRFValueInCookieHeader:            happyCSRF,
+			wantLocationHeader:                     expectedRedirectLocation(expectedUpstreamStateParam(nil, "", ""), ""),
+			wantUpstreamStateParamInLocationHeader: true,
+			wantBodyStringWithLocationInHref:       true,
+		},
+		{
+			name:            "request_uri of a pushed authorization request is unknown or was already used",
+			issuer:          downstreamIssuer,
+			idpListGetter:   oidctestutil.NewIDPListGetter(&upstreamOIDCIdentityProvider),
+			generateCSRF:    happyCSRFGenerator,
+			generatePKCE:    happyPKCEGenerator,
+			generateNonce:   happyNonceGenerator,
+			stateEncoder:    happyStateEncoder,
+			cookieEncoder:   happyCookieEncoder,
+			method:          http.MethodGet,
+			path:            happyRequestURIPath,
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/json; charset=utf-8",
+			wantBodyJSON:    unknownRequestURIErrorBody,
+		},
+		{
+			name:                        "request_uri of a pushed authorization request has expired",
+			issuer:                      downstreamIssuer,
+			idpListGetter:               oidctestutil.NewIDPListGetter(&upstreamOIDCIdentityProvider),
+			generateCSRF:                happyCSRFGenerator,
+			generatePKCE:                happyPKCEGenerator,
+			generateNonce:               happyNonceGenerator,
+			stateEncoder:                happyStateEncoder,
+			cookieEncoder:               happyCookieEncoder,
+			method:                      http.MethodGet,
+			path:                        happyRequestURIPath,
+			pushedAuthorizationRequests: happyPushedAuthorizationRequest("pinniped-cli", time.Now().Add(-time.Second)),
+			wantStatus:                  http.StatusBadRequest,
+			wantContentType:             "application/json; charset=utf-8",
+			wantBodyJSON:                expiredRequestURIErrorBody,
+		},
+		{
+			name:                        "request_uri of a pushed authorization request was pushed by another client",
+			issuer:                      downstreamIssuer,
+			idpListGetter:               oidctestutil.NewIDPListGetter(&upstreamOIDCIdentityProvider),
+			generateCSRF:                happyCSRFGenerator,
+			generatePKCE:                happyPKCEGenerator,
+			generateNonce:               happyNonceGenerator,
+			stateEncoder:                happyStateEncoder,
+			cookieEncoder:               happyCookieEncoder,
+			method:                      http.MethodGet,
+			path:                        happyRequestURIPath,
+			pushedAuthorizationRequests: happyPushedAuthorizationRequest("some-other-client", time.Now().Add(time.Minute)),
+			wantStatus:                  http.StatusBadRequest,
+			wantContentType:             "application/json; charset=utf-8",
+			wantBodyJSON:                wrongClientRequestURIErrorBody,
+		},
 		{
 			name:                                   "happy path using GET with a CSRF cookie",
 			issuer:                                 downstreamIssuer,
@@ -323,6 +444,24 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			wantLocationHeader:                     expectedRedirectLocation(expectedUpstreamStateParam(nil, "", ""), ""),
 			wantUpstreamStateParamInLocationHeader: true,
 		},
+		{
+			name:                                   "happy path when the upstream IDP requires acr values, which are requested in order of preference",
+			issuer:                                 downstreamIssuer,
+			idpListGetter:                          oidctestutil.NewIDPListGetter(&upstreamOIDCIdentityProviderRequiringACRValues),
+			generateCSRF:                           happyCSRFGenerator,
+			generatePKCE:                           happyPKCEGenerator,
+			generateNonce:                          happyNonceGenerator,
+			stateEncoder:                           happyStateEncoder,
+			cookieEncoder:                          happyCookieEncoder,
+			method:                                 http.MethodGet,
+			path:                                   happyGetRequestPath,
+			wantStatus:                             http.StatusFound,
+			wantContentType:                        "text/html; charset=utf-8",
+			wantCSRFValueInCookieHeader:            happyCSRF,
+			wantLocationHeader:                     expectedRedirectLocationWithACRValues(expectedUpstreamStateParam(nil, "", ""), "phrh phr"),
+			wantUpstreamStateParamInLocationHeader: true,
+			wantBodyStringWithLocationInHref:       true,
+		},
 		{
 			name:                                   "happy path with prompt param login passed through to redirect uri",
 			issuer:                                 downstreamIssuer,
@@ -631,8 +770,8 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			method:          http.MethodGet,
 			path:            happyGetRequestPath,
 			wantStatus:      http.StatusInternalServerError,
-			wantContentType: "text/plain; charset=utf-8",
-			wantBodyString:  "Internal Server Error: error encoding upstream state param\n",
+			wantContentType: "application/json; charset=utf-8",
+			wantBodyJSON:    `{"error":"Internal Server Error","error_description":"error encoding upstream state param","error_id":"fake-error-id"}`,
 		},
 		{
 			name:            "error while encoding CSRF cookie value for new cookie",
@@ -646,8 +785,8 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			method:          http.MethodGet,
 			path:            happyGetRequestPath,
 			wantStatus:      http.StatusInternalServerError,
-			wantContentType: "text/plain; charset=utf-8",
-			wantBodyString:  "Internal Server Error: error encoding CSRF cookie\n",
+			wantContentType: "application/json; charset=utf-8",
+			wantBodyJSON:    `{"error":"Internal Server Error","error_description":"error encoding CSRF cookie","error_id":"fake-error-id"}`,
 		},
 		{
 			name:            "error while generating CSRF token",
@@ -661,8 +800,8 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			method:          http.MethodGet,
 			path:            happyGetRequestPath,
 			wantStatus:      http.StatusInternalServerError,
-			wantContentType: "text/plain; charset=utf-8",
-			wantBodyString:  "Internal Server Error: error generating CSRF token\n",
+			wantContentType: "application/json; charset=utf-8",
+			wantBodyJSON:    `{"error":"Internal Server Error","error_description":"error generating CSRF token","error_id":"fake-error-id"}`,
 		},
 		{
 			name:            "error while generating nonce",
@@ -676,8 +815,8 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			method:          http.MethodGet,
 			path:            happyGetRequestPath,
 			wantStatus:      http.StatusInternalServerError,
-			wantContentType: "text/plain; charset=utf-8",
-			wantBodyString:  "Internal Server Error: error generating nonce param\n",
+			wantContentType: "application/json; charset=utf-8",
+			wantBodyJSON:    `{"error":"Internal Server Error","error_description":"error generating nonce param","error_id":"fake-error-id"}`,
 		},
 		{
 			name:            "error while generating PKCE",
@@ -691,8 +830,8 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			method:          http.MethodGet,
 			path:            happyGetRequestPath,
 			wantStatus:      http.StatusInternalServerError,
-			wantContentType: "text/plain; charset=utf-8",
-			wantBodyString:  "Internal Server Error: error generating PKCE param\n",
+			wantContentType: "application/json; charset=utf-8",
+			wantBodyJSON:    `{"error":"Internal Server Error","error_description":"error generating PKCE param","error_id":"fake-error-id"}`,
 		},
 		{
 			name:            "no upstream providers are configured",
@@ -701,8 +840,8 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			method:          http.MethodGet,
 			path:            happyGetRequestPath,
 			wantStatus:      http.StatusUnprocessableEntity,
-			wantContentType: "text/plain; charset=utf-8",
-			wantBodyString:  "Unprocessable Entity: No upstream providers are configured\n",
+			wantContentType: "application/json; charset=utf-8",
+			wantBodyJSON:    `{"error":"Unprocessable Entity","error_description":"No upstream providers are configured","error_id":"fake-error-id"}`,
 		},
 		{
 			name:            "too many upstream providers are configured",
@@ -711,8 +850,8 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			method:          http.MethodGet,
 			path:            happyGetRequestPath,
 			wantStatus:      http.StatusUnprocessableEntity,
-			wantContentType: "text/plain; charset=utf-8",
-			wantBodyString:  "Unprocessable Entity: Too many upstream providers are configured (support for multiple upstreams is not yet implemented)\n",
+			wantContentType: "application/json; charset=utf-8",
+			wantBodyJSON:    `{"error":"Unprocessable Entity","error_description":"Too many upstream providers are configured (support for multiple upstreams is not yet implemented)","error_id":"fake-error-id"}`,
 		},
 		{
 			name:            "PUT is a bad method",
@@ -721,8 +860,8 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			method:          http.MethodPut,
 			path:            "/some/path",
 			wantStatus:      http.StatusMethodNotAllowed,
-			wantContentType: "text/plain; charset=utf-8",
-			wantBodyString:  "Method Not Allowed: PUT (try GET or POST)\n",
+			wantContentType: "application/json; charset=utf-8",
+			wantBodyJSON:    `{"error":"Method Not Allowed","error_description":"PUT (try GET or POST)","error_id":"fake-error-id"}`,
 		},
 		{
 			name:            "PATCH is a bad method",
@@ -731,8 +870,8 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			method:          http.MethodPatch,
 			path:            "/some/path",
 			wantStatus:      http.StatusMethodNotAllowed,
-			wantContentType: "text/plain; charset=utf-8",
-			wantBodyString:  "Method Not Allowed: PATCH (try GET or POST)\n",
+			wantContentType: "application/json; charset=utf-8",
+			wantBodyJSON:    `{"error":"Method Not Allowed","error_description":"PATCH (try GET or POST)","error_id":"fake-error-id"}`,
 		},
 		{
 			name:            "DELETE is a bad method",
@@ -741,8 +880,8 @@ func TestAuthorizationEndpoint(t *testing.T) {
 			method:          http.MethodDelete,
 			path:            "/some/path",
 			wantStatus:      http.StatusMethodNotAllowed,
-			wantContentType: "text/plain; charset=utf-8",
-			wantBodyString:  "Method Not Allowed: DELETE (try GET or POST)\n",
+			wantContentType: "application/json; charset=utf-8",
+			wantBodyJSON:    `{"error":"Method Not Allowed","error_description":"DELETE (try GET or POST)","error_id":"fake-error-id"}`,
 		},
 	}
 
@@ -800,11 +939,15 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		}
 	}
 
+	renderer := pages.NewRenderer(downstreamIssuer, nil, func() (string, error) { return "fake-error-id", nil })
+
 	for _, test := range tests {
 		test := test
 		t.Run(test.name, func(t *testing.T) {
-			subject := NewHandler(test.issuer, test.idpListGetter, oauthHelper, test.generateCSRF, test.generatePKCE, test.generateNonce, test.stateEncoder, test.cookieEncoder)
+			pushedAuthorizationRequests := &fakePushedAuthorizationRequestStorage{requests: test.pushedAuthorizationRequests}
+			subject := NewHandler(test.issuer, test.idpListGetter, oauthHelper, pushedAuthorizationRequests, test.generateCSRF, test.generatePKCE, test.generateNonce, test.stateEncoder, test.cookieEncoder, renderer)
 			runOneTestCase(t, test, subject)
+			require.Empty(t, pushedAuthorizationRequests.requests, "pushed authorization requests should only be used once")
 		})
 	}
 
@@ -812,7 +955,7 @@ func TestAuthorizationEndpoint(t *testing.T) {
 		test := tests[0]
 		require.Equal(t, "happy path using GET without a CSRF cookie", test.name) // re-use the happy path test case
 
-		subject := NewHandler(test.issuer, test.idpListGetter, oauthHelper, test.generateCSRF, test.generatePKCE, test.generateNonce, test.stateEncoder, test.cookieEncoder)
+		subject := NewHandler(test.issuer, test.idpListGetter, oauthHelper, &fakePushedAuthorizationRequestStorage{}, test.generateCSRF, test.generatePKCE, test.generateNonce, test.stateEncoder, test.cookieEncoder, renderer)
 
 		runOneTestCase(t, test, subject)
 
@@ -852,6 +995,30 @@ func TestAuthorizationEndpoint(t *testing.T) {
 	})
 }
 
+type fakePushedAuthorizationRequestStorage struct {
+	requests map[string]*pushedauthorizationrequest.Request
+}
+
+func (s *fakePushedAuthorizationRequestStorage) CreatePushedAuthorizationRequest(_ context.Context, _ string, _ *pushedauthorizationrequest.Request) error {
+	return fmt.Errorf("should not be called")
+}
+
+func (s *fakePushedAuthorizationRequestStorage) GetPushedAuthorizationRequest(_ context.Context, reference string) (*pushedauthorizationrequest.Request, error) {
+	request, ok := s.requests[reference]
+	if !ok {
+		return nil, fosite.ErrNotFound
+	}
+	return request, nil
+}
+
+func (s *fakePushedAuthorizationRequestStorage) DeletePushedAuthorizationRequest(_ context.Context, reference string) error {
+	if _, ok := s.requests[reference]; !ok {
+		return fosite.ErrNotFound
+	}
+	delete(s.requests, reference)
+	return nil
+}
+
 type errorReturningEncoder struct {
 	oidc.Codec
 }
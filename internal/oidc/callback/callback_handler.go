@@ -15,13 +15,16 @@ import (
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/handler/openid"
 	"github.com/ory/fosite/token/jwt"
+	"k8s.io/apimachinery/pkg/util/sets"
 
 	"go.pinniped.dev/internal/httputil/httperr"
 	"go.pinniped.dev/internal/httputil/securityheader"
 	"go.pinniped.dev/internal/oidc"
 	"go.pinniped.dev/internal/oidc/csrftoken"
+	"go.pinniped.dev/internal/oidc/pages"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/psession"
 )
 
 const (
@@ -30,15 +33,23 @@ const (
 
 	// The name of the email_verified claim from https://openid.net/specs/openid-connect-core-1_0.html#StandardClaims
 	emailVerifiedClaimName = "email_verified"
+
+	// The name of the acr claim from https://openid.net/specs/openid-connect-core-1_0.html#IDToken
+	acrClaimName = "acr"
+
+	// The name of the amr claim from https://openid.net/specs/openid-connect-core-1_0.html#IDToken
+	amrClaimName = "amr"
 )
 
 func NewHandler(
+	downstreamIssuer string,
 	idpListGetter oidc.IDPListGetter,
 	oauthHelper fosite.OAuth2Provider,
 	stateDecoder, cookieDecoder oidc.Decoder,
 	redirectURI string,
+	renderer *pages.Renderer,
 ) http.Handler {
-	return securityheader.Wrap(httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+	return securityheader.Wrap(renderer.Wrap(func(w http.ResponseWriter, r *http.Request) error {
 		state, err := validateRequest(r, stateDecoder, cookieDecoder)
 		if err != nil {
 			return err
@@ -91,7 +102,22 @@ func NewHandler(
 			return err
 		}
 
-		openIDSession := makeDownstreamSession(subject, username, groups)
+		acr, amr, err := getAuthenticationStrengthFromUpstreamIDToken(upstreamIDPConfig, token.IDToken.Claims)
+		if err != nil {
+			return err
+		}
+
+		openIDSession := makeDownstreamSession(downstreamIssuer, upstreamIDPConfig.GetName(), subject, username, groups)
+		if acr != "" {
+			openIDSession.Fosite.Claims.AuthenticationContextClassReference = acr
+		}
+		if amr != nil {
+			// Fosite can only render the amr claim as a string, but the spec says that it is an array of strings.
+			openIDSession.Fosite.Claims.Extra[amrClaimName] = amr
+		}
+		for claimName, claimValue := range getAdditionalClaimsFromUpstreamIDToken(upstreamIDPConfig, token.IDToken.Claims) {
+			openIDSession.Fosite.Claims.Extra[claimName] = claimValue
+		}
 		authorizeResponder, err := oauthHelper.NewAuthorizeResponse(r.Context(), authorizeRequester, openIDSession)
 		if err != nil {
 			plog.WarningErr("error while generating and saving authcode", err, "upstreamName", upstreamIDPConfig.GetName())
@@ -314,6 +340,79 @@ func getGroupsFromUpstreamIDToken(
 	return groupsAsArray, nil
 }
 
+// getAuthenticationStrengthFromUpstreamIDToken checks the acr and amr claims against the required values
+// of the upstream provider, and returns them so they can be copied into the downstream ID token.
+func getAuthenticationStrengthFromUpstreamIDToken(
+	upstreamIDPConfig provider.UpstreamOIDCIdentityProviderI,
+	idTokenClaims map[string]interface{},
+) (string, []string, error) {
+	var acr string
+	if acrAsInterface, ok := idTokenClaims[acrClaimName]; ok {
+		if acr, ok = acrAsInterface.(string); !ok {
+			plog.Warning(
+				"acr claim in upstream ID token has invalid format",
+				"upstreamName", upstreamIDPConfig.GetName(),
+			)
+			return "", nil, httperr.New(http.StatusUnprocessableEntity, "acr claim in upstream ID token has invalid format")
+		}
+	}
+
+	var amr []string
+	if amrAsInterface, ok := idTokenClaims[amrClaimName]; ok {
+		if amr, ok = extractGroups(amrAsInterface); !ok {
+			plog.Warning(
+				"amr claim in upstream ID token has invalid format",
+				"upstreamName", upstreamIDPConfig.GetName(),
+			)
+			return "", nil, httperr.New(http.StatusUnprocessableEntity, "amr claim in upstream ID token has invalid format")
+		}
+	}
+
+	if requiredACRValues := upstreamIDPConfig.GetRequiredACRValues(); len(requiredACRValues) > 0 && !sets.NewString(requiredACRValues...).Has(acr) {
+		plog.Warning(
+			"acr claim in upstream ID token is not one of the required values",
+			"upstreamName", upstreamIDPConfig.GetName(),
+			"acrClaim", acr,
+			"requiredACRValues", requiredACRValues,
+		)
+		return "", nil, httperr.New(http.StatusForbidden, "upstream authentication does not satisfy the required authentication context class")
+	}
+
+	if requiredAMRValues := upstreamIDPConfig.GetRequiredAMRValues(); !sets.NewString(amr...).HasAll(requiredAMRValues...) {
+		plog.Warning(
+			"amr claim in upstream ID token does not contain the required values",
+			"upstreamName", upstreamIDPConfig.GetName(),
+			"amrClaim", amr,
+			"requiredAMRValues", requiredAMRValues,
+		)
+		return "", nil, httperr.New(http.StatusForbidden, "upstream authentication does not satisfy the required authentication methods")
+	}
+
+	return acr, amr, nil
+}
+
+// getAdditionalClaimsFromUpstreamIDToken returns the upstream claims which are configured to be copied into the
+// downstream ID token, keyed by the name of the downstream claim. The claims which are missing upstream are left out.
+func getAdditionalClaimsFromUpstreamIDToken(
+	upstreamIDPConfig provider.UpstreamOIDCIdentityProviderI,
+	idTokenClaims map[string]interface{},
+) map[string]interface{} {
+	additionalClaims := make(map[string]interface{})
+	for downstreamClaimName, upstreamClaimName := range upstreamIDPConfig.GetAdditionalClaims() {
+		claimValue, ok := idTokenClaims[upstreamClaimName]
+		if !ok {
+			plog.Debug(
+				"additional claim missing from upstream ID token",
+				"upstreamName", upstreamIDPConfig.GetName(),
+				"upstreamClaim", upstreamClaimName,
+			)
+			continue
+		}
+		additionalClaims[downstreamClaimName] = claimValue
+	}
+	return additionalClaims
+}
+
 func extractGroups(groupsAsInterface interface{}) ([]string, bool) {
 	groupsAsString, okAsString := groupsAsInterface.(string)
 	if okAsString {
@@ -344,21 +443,33 @@ func extractGroups(groupsAsInterface interface{}) ([]string, bool) {
 	return groupsAsStrings, true
 }
 
-func makeDownstreamSession(subject string, username string, groups []string) *openid.DefaultSession {
+func makeDownstreamSession(downstreamIssuer string, upstreamName string, subject string, username string, groups []string) *psession.PinnipedSession {
 	now := time.Now().UTC()
-	openIDSession := &openid.DefaultSession{
+	fositeSession := &openid.DefaultSession{
 		Claims: &jwt.IDTokenClaims{
+			// Setting the issuer here instead of letting fosite fill it in at the token endpoint allows
+			// the session storage to record which FederationDomain the session belongs to.
+			Issuer:      downstreamIssuer,
 			Subject:     subject,
 			RequestedAt: now,
 			AuthTime:    now,
 		},
+		// These are used by the session storage to index sessions by user.
+		Subject:  subject,
+		Username: username,
 	}
 	if groups == nil {
 		groups = []string{}
 	}
-	openIDSession.Claims.Extra = map[string]interface{}{
+	fositeSession.Claims.Extra = map[string]interface{}{
 		oidc.DownstreamUsernameClaim: username,
 		oidc.DownstreamGroupsClaim:   groups,
 	}
-	return openIDSession
+	return &psession.PinnipedSession{
+		Fosite: fositeSession,
+		Custom: &psession.CustomSessionData{
+			// This allows the session storage to record which upstream provider the session belongs to.
+			ProviderName: upstreamName,
+		},
+	}
 }
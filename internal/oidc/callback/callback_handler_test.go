@@ -16,7 +16,6 @@ import (
 
 	"github.com/gorilla/securecookie"
 	"github.com/ory/fosite"
-	"github.com/ory/fosite/handler/openid"
 	"github.com/stretchr/testify/require"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes/fake"
@@ -28,6 +27,8 @@ import (
 	"go.pinniped.dev/internal/oidc"
 	"go.pinniped.dev/internal/oidc/jwks"
 	"go.pinniped.dev/internal/oidc/oidctestutil"
+	"go.pinniped.dev/internal/oidc/pages"
+	"go.pinniped.dev/internal/psession"
 	"go.pinniped.dev/internal/testutil"
 	"go.pinniped.dev/pkg/oidcclient/nonce"
 	"go.pinniped.dev/pkg/oidcclient/oidctypes"
@@ -135,6 +136,9 @@ func TestCallbackEndpoint(t *testing.T) {
 		wantDownstreamIDTokenSubject      string
 		wantDownstreamIDTokenUsername     string
 		wantDownstreamIDTokenGroups       []string
+		wantDownstreamIDTokenACR          string
+		wantDownstreamIDTokenAMR          []string
+		wantDownstreamIDTokenExtraClaims  map[string]interface{}
 		wantDownstreamRequestedScopes     []string
 		wantDownstreamNonce               string
 		wantDownstreamPKCEChallenge       string
@@ -252,7 +256,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			path:                              newRequestPath().WithState(happyState).String(),
 			csrfCookie:                        happyCSRFCookie,
 			wantStatus:                        http.StatusUnprocessableEntity,
-			wantBody:                          "Unprocessable Entity: email_verified claim in upstream ID token has invalid format\n",
+			wantBody:                          "{\"error\":\"Unprocessable Entity\",\"error_description\":\"email_verified claim in upstream ID token has invalid format\",\"error_id\":\"fake-error-id\"}\n",
 			wantExchangeAndValidateTokensCall: happyExchangeAndValidateTokensArgs,
 		},
 		{
@@ -264,7 +268,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			path:                              newRequestPath().WithState(happyState).String(),
 			csrfCookie:                        happyCSRFCookie,
 			wantStatus:                        http.StatusUnprocessableEntity,
-			wantBody:                          "Unprocessable Entity: email_verified claim in upstream ID token has false value\n",
+			wantBody:                          "{\"error\":\"Unprocessable Entity\",\"error_description\":\"email_verified claim in upstream ID token has false value\",\"error_id\":\"fake-error-id\"}\n",
 			wantExchangeAndValidateTokensCall: happyExchangeAndValidateTokensArgs,
 		},
 		{
@@ -324,6 +328,128 @@ func TestCallbackEndpoint(t *testing.T) {
 			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
 			wantExchangeAndValidateTokensCall: happyExchangeAndValidateTokensArgs,
 		},
+		{
+			name: "upstream IDP requires acr and amr values and the upstream ID token satisfies them, so they are copied into the downstream ID token",
+			idp: happyUpstream().WithRequiredACRValues("phr", "phrh").WithRequiredAMRValues("mfa").
+				WithIDTokenClaim("acr", "phrh").
+				WithIDTokenClaim("amr", []interface{}{"pwd", "otp", "mfa"}).Build(),
+			method:                            http.MethodGet,
+			path:                              newRequestPath().WithState(happyState).String(),
+			csrfCookie:                        happyCSRFCookie,
+			wantStatus:                        http.StatusFound,
+			wantRedirectLocationRegexp:        happyDownstreamRedirectLocationRegexp,
+			wantBody:                          "",
+			wantDownstreamIDTokenSubject:      upstreamIssuer + "?sub=" + upstreamSubject,
+			wantDownstreamIDTokenUsername:     upstreamUsername,
+			wantDownstreamIDTokenGroups:       upstreamGroupMembership,
+			wantDownstreamIDTokenACR:          "phrh",
+			wantDownstreamIDTokenAMR:          []string{"pwd", "otp", "mfa"},
+			wantDownstreamRequestedScopes:     happyDownstreamScopesRequested,
+			wantDownstreamGrantedScopes:       happyDownstreamScopesGranted,
+			wantDownstreamNonce:               downstreamNonce,
+			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
+			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
+			wantExchangeAndValidateTokensCall: happyExchangeAndValidateTokensArgs,
+		},
+		{
+			name: "upstream IDP has additional claims, so the ones which are present upstream are copied into the downstream ID token",
+			idp: happyUpstream().
+				WithAdditionalClaim("email", "email").
+				WithAdditionalClaim("display_name", "name").
+				WithAdditionalClaim("employee_id", "employeeNumber").
+				WithIDTokenClaim("email", "joe@example.com").
+				WithIDTokenClaim("name", "Joe Smith").
+				WithIDTokenClaim("address", map[string]interface{}{"country": "NZ"}).Build(),
+			method:                            http.MethodGet,
+			path:                              newRequestPath().WithState(happyState).String(),
+			csrfCookie:                        happyCSRFCookie,
+			wantStatus:                        http.StatusFound,
+			wantRedirectLocationRegexp:        happyDownstreamRedirectLocationRegexp,
+			wantBody:                          "",
+			wantDownstreamIDTokenSubject:      upstreamIssuer + "?sub=" + upstreamSubject,
+			wantDownstreamIDTokenUsername:     upstreamUsername,
+			wantDownstreamIDTokenGroups:       upstreamGroupMembership,
+			wantDownstreamIDTokenExtraClaims:  map[string]interface{}{"email": "joe@example.com", "display_name": "Joe Smith"},
+			wantDownstreamRequestedScopes:     happyDownstreamScopesRequested,
+			wantDownstreamGrantedScopes:       happyDownstreamScopesGranted,
+			wantDownstreamNonce:               downstreamNonce,
+			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
+			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
+			wantExchangeAndValidateTokensCall: happyExchangeAndValidateTokensArgs,
+		},
+		{
+			name: "upstream IDP does not require acr or amr values, but they are still copied into the downstream ID token",
+			idp: happyUpstream().
+				WithIDTokenClaim("acr", "some-acr").
+				WithIDTokenClaim("amr", []interface{}{"pwd"}).Build(),
+			method:                            http.MethodGet,
+			path:                              newRequestPath().WithState(happyState).String(),
+			csrfCookie:                        happyCSRFCookie,
+			wantStatus:                        http.StatusFound,
+			wantRedirectLocationRegexp:        happyDownstreamRedirectLocationRegexp,
+			wantBody:                          "",
+			wantDownstreamIDTokenSubject:      upstreamIssuer + "?sub=" + upstreamSubject,
+			wantDownstreamIDTokenUsername:     upstreamUsername,
+			wantDownstreamIDTokenGroups:       upstreamGroupMembership,
+			wantDownstreamIDTokenACR:          "some-acr",
+			wantDownstreamIDTokenAMR:          []string{"pwd"},
+			wantDownstreamRequestedScopes:     happyDownstreamScopesRequested,
+			wantDownstreamGrantedScopes:       happyDownstreamScopesGranted,
+			wantDownstreamNonce:               downstreamNonce,
+			wantDownstreamPKCEChallenge:       downstreamPKCEChallenge,
+			wantDownstreamPKCEChallengeMethod: downstreamPKCEChallengeMethod,
+			wantExchangeAndValidateTokensCall: happyExchangeAndValidateTokensArgs,
+		},
+		{
+			name:                              "upstream IDP requires acr values and the upstream ID token has a different acr claim",
+			idp:                               happyUpstream().WithRequiredACRValues("phr").WithIDTokenClaim("acr", "pwd-only").Build(),
+			method:                            http.MethodGet,
+			path:                              newRequestPath().WithState(happyState).String(),
+			csrfCookie:                        happyCSRFCookie,
+			wantStatus:                        http.StatusForbidden,
+			wantBody:                          "{\"error\":\"Forbidden\",\"error_description\":\"upstream authentication does not satisfy the required authentication context class\",\"error_id\":\"fake-error-id\"}\n",
+			wantExchangeAndValidateTokensCall: happyExchangeAndValidateTokensArgs,
+		},
+		{
+			name:                              "upstream IDP requires acr values and the upstream ID token has no acr claim",
+			idp:                               happyUpstream().WithRequiredACRValues("phr").Build(),
+			method:                            http.MethodGet,
+			path:                              newRequestPath().WithState(happyState).String(),
+			csrfCookie:                        happyCSRFCookie,
+			wantStatus:                        http.StatusForbidden,
+			wantBody:                          "{\"error\":\"Forbidden\",\"error_description\":\"upstream authentication does not satisfy the required authentication context class\",\"error_id\":\"fake-error-id\"}\n",
+			wantExchangeAndValidateTokensCall: happyExchangeAndValidateTokensArgs,
+		},
+		{
+			name:                              "upstream IDP requires amr values and the upstream ID token is missing one of them",
+			idp:                               happyUpstream().WithRequiredAMRValues("pwd", "hwk").WithIDTokenClaim("amr", []interface{}{"pwd", "otp"}).Build(),
+			method:                            http.MethodGet,
+			path:                              newRequestPath().WithState(happyState).String(),
+			csrfCookie:                        happyCSRFCookie,
+			wantStatus:                        http.StatusForbidden,
+			wantBody:                          "{\"error\":\"Forbidden\",\"error_description\":\"upstream authentication does not satisfy the required authentication methods\",\"error_id\":\"fake-error-id\"}\n",
+			wantExchangeAndValidateTokensCall: happyExchangeAndValidateTokensArgs,
+		},
+		{
+			name:                              "upstream ID token has an acr claim with an invalid format",
+			idp:                               happyUpstream().WithIDTokenClaim("acr", 42).Build(),
+			method:                            http.MethodGet,
+			path:                              newRequestPath().WithState(happyState).String(),
+			csrfCookie:                        happyCSRFCookie,
+			wantStatus:                        http.StatusUnprocessableEntity,
+			wantBody:                          "{\"error\":\"Unprocessable Entity\",\"error_description\":\"acr claim in upstream ID token has invalid format\",\"error_id\":\"fake-error-id\"}\n",
+			wantExchangeAndValidateTokensCall: happyExchangeAndValidateTokensArgs,
+		},
+		{
+			name:                              "upstream ID token has an amr claim with an invalid format",
+			idp:                               happyUpstream().WithIDTokenClaim("amr", []interface{}{"pwd", 42}).Build(),
+			method:                            http.MethodGet,
+			path:                              newRequestPath().WithState(happyState).String(),
+			csrfCookie:                        happyCSRFCookie,
+			wantStatus:                        http.StatusUnprocessableEntity,
+			wantBody:                          "{\"error\":\"Unprocessable Entity\",\"error_description\":\"amr claim in upstream ID token has invalid format\",\"error_id\":\"fake-error-id\"}\n",
+			wantExchangeAndValidateTokensCall: happyExchangeAndValidateTokensArgs,
+		},
 
 		// Pre-upstream-exchange verification
 		{
@@ -331,28 +457,28 @@ func TestCallbackEndpoint(t *testing.T) {
 			method:     http.MethodPut,
 			path:       newRequestPath().String(),
 			wantStatus: http.StatusMethodNotAllowed,
-			wantBody:   "Method Not Allowed: PUT (try GET)\n",
+			wantBody:   "{\"error\":\"Method Not Allowed\",\"error_description\":\"PUT (try GET)\",\"error_id\":\"fake-error-id\"}\n",
 		},
 		{
 			name:       "POST method is invalid",
 			method:     http.MethodPost,
 			path:       newRequestPath().String(),
 			wantStatus: http.StatusMethodNotAllowed,
-			wantBody:   "Method Not Allowed: POST (try GET)\n",
+			wantBody:   "{\"error\":\"Method Not Allowed\",\"error_description\":\"POST (try GET)\",\"error_id\":\"fake-error-id\"}\n",
 		},
 		{
 			name:       "PATCH method is invalid",
 			method:     http.MethodPatch,
 			path:       newRequestPath().String(),
 			wantStatus: http.StatusMethodNotAllowed,
-			wantBody:   "Method Not Allowed: PATCH (try GET)\n",
+			wantBody:   "{\"error\":\"Method Not Allowed\",\"error_description\":\"PATCH (try GET)\",\"error_id\":\"fake-error-id\"}\n",
 		},
 		{
 			name:       "DELETE method is invalid",
 			method:     http.MethodDelete,
 			path:       newRequestPath().String(),
 			wantStatus: http.StatusMethodNotAllowed,
-			wantBody:   "Method Not Allowed: DELETE (try GET)\n",
+			wantBody:   "{\"error\":\"Method Not Allowed\",\"error_description\":\"DELETE (try GET)\",\"error_id\":\"fake-error-id\"}\n",
 		},
 		{
 			name:       "code param was not included on request",
@@ -360,7 +486,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			path:       newRequestPath().WithState(happyState).WithoutCode().String(),
 			csrfCookie: happyCSRFCookie,
 			wantStatus: http.StatusBadRequest,
-			wantBody:   "Bad Request: code param not found\n",
+			wantBody:   "{\"error\":\"Bad Request\",\"error_description\":\"code param not found\",\"error_id\":\"fake-error-id\"}\n",
 		},
 		{
 			name:       "state param was not included on request",
@@ -368,7 +494,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			path:       newRequestPath().WithoutState().String(),
 			csrfCookie: happyCSRFCookie,
 			wantStatus: http.StatusBadRequest,
-			wantBody:   "Bad Request: state param not found\n",
+			wantBody:   "{\"error\":\"Bad Request\",\"error_description\":\"state param not found\",\"error_id\":\"fake-error-id\"}\n",
 		},
 		{
 			name:       "state param was not signed correctly, has expired, or otherwise cannot be decoded for any reason",
@@ -377,7 +503,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			path:       newRequestPath().WithState("this-will-not-decode").String(),
 			csrfCookie: happyCSRFCookie,
 			wantStatus: http.StatusBadRequest,
-			wantBody:   "Bad Request: error reading state\n",
+			wantBody:   "{\"error\":\"Bad Request\",\"error_description\":\"error reading state\",\"error_id\":\"fake-error-id\"}\n",
 		},
 		{
 			// This shouldn't happen in practice because the authorize endpoint should have already run the same
@@ -393,7 +519,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			csrfCookie:                        happyCSRFCookie,
 			wantExchangeAndValidateTokensCall: happyExchangeAndValidateTokensArgs,
 			wantStatus:                        http.StatusInternalServerError,
-			wantBody:                          "Internal Server Error: error while generating and saving authcode\n",
+			wantBody:                          "{\"error\":\"Internal Server Error\",\"error_description\":\"error while generating and saving authcode\",\"error_id\":\"fake-error-id\"}\n",
 		},
 		{
 			name:       "state's internal version does not match what we want",
@@ -402,7 +528,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			path:       newRequestPath().WithState(happyUpstreamStateParam().WithStateVersion("wrong-state-version").Build(t, happyStateCodec)).String(),
 			csrfCookie: happyCSRFCookie,
 			wantStatus: http.StatusUnprocessableEntity,
-			wantBody:   "Unprocessable Entity: state format version is invalid\n",
+			wantBody:   "{\"error\":\"Unprocessable Entity\",\"error_description\":\"state format version is invalid\",\"error_id\":\"fake-error-id\"}\n",
 		},
 		{
 			name:   "state's downstream auth params element is invalid",
@@ -413,7 +539,7 @@ func TestCallbackEndpoint(t *testing.T) {
 				Build(t, happyStateCodec)).String(),
 			csrfCookie: happyCSRFCookie,
 			wantStatus: http.StatusBadRequest,
-			wantBody:   "Bad Request: error reading state downstream auth params\n",
+			wantBody:   "{\"error\":\"Bad Request\",\"error_description\":\"error reading state downstream auth params\",\"error_id\":\"fake-error-id\"}\n",
 		},
 		{
 			name:   "state's downstream auth params are missing required value (e.g., client_id)",
@@ -426,7 +552,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			).String(),
 			csrfCookie: happyCSRFCookie,
 			wantStatus: http.StatusBadRequest,
-			wantBody:   "Bad Request: error using state downstream auth params\n",
+			wantBody:   "{\"error\":\"Bad Request\",\"error_description\":\"error using state downstream auth params\",\"error_id\":\"fake-error-id\"}\n",
 		},
 		{
 			name:   "state's downstream auth params does not contain openid scope",
@@ -480,7 +606,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			path:       newRequestPath().WithState(happyState).String(),
 			csrfCookie: happyCSRFCookie,
 			wantStatus: http.StatusUnprocessableEntity,
-			wantBody:   "Unprocessable Entity: upstream provider not found\n",
+			wantBody:   "{\"error\":\"Unprocessable Entity\",\"error_description\":\"upstream provider not found\",\"error_id\":\"fake-error-id\"}\n",
 		},
 		{
 			name:       "the CSRF cookie does not exist on request",
@@ -488,7 +614,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			method:     http.MethodGet,
 			path:       newRequestPath().WithState(happyState).String(),
 			wantStatus: http.StatusForbidden,
-			wantBody:   "Forbidden: CSRF cookie is missing\n",
+			wantBody:   "{\"error\":\"Forbidden\",\"error_description\":\"CSRF cookie is missing\",\"error_id\":\"fake-error-id\"}\n",
 		},
 		{
 			name:       "cookie was not signed correctly, has expired, or otherwise cannot be decoded for any reason",
@@ -497,7 +623,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			path:       newRequestPath().WithState(happyState).String(),
 			csrfCookie: "__Host-pinniped-csrf=this-value-was-not-signed-by-pinniped",
 			wantStatus: http.StatusForbidden,
-			wantBody:   "Forbidden: error reading CSRF cookie\n",
+			wantBody:   "{\"error\":\"Forbidden\",\"error_description\":\"error reading CSRF cookie\",\"error_id\":\"fake-error-id\"}\n",
 		},
 		{
 			name:       "cookie csrf value does not match state csrf value",
@@ -506,7 +632,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			path:       newRequestPath().WithState(happyUpstreamStateParam().WithCSRF("wrong-csrf-value").Build(t, happyStateCodec)).String(),
 			csrfCookie: happyCSRFCookie,
 			wantStatus: http.StatusForbidden,
-			wantBody:   "Forbidden: CSRF value does not match\n",
+			wantBody:   "{\"error\":\"Forbidden\",\"error_description\":\"CSRF value does not match\",\"error_id\":\"fake-error-id\"}\n",
 		},
 
 		// Upstream exchange
@@ -517,7 +643,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			path:                              newRequestPath().WithState(happyState).String(),
 			csrfCookie:                        happyCSRFCookie,
 			wantStatus:                        http.StatusBadGateway,
-			wantBody:                          "Bad Gateway: error exchanging and validating upstream tokens\n",
+			wantBody:                          "{\"error\":\"Bad Gateway\",\"error_description\":\"error exchanging and validating upstream tokens\",\"error_id\":\"fake-error-id\"}\n",
 			wantExchangeAndValidateTokensCall: happyExchangeAndValidateTokensArgs,
 		},
 		{
@@ -527,7 +653,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			path:                              newRequestPath().WithState(happyState).String(),
 			csrfCookie:                        happyCSRFCookie,
 			wantStatus:                        http.StatusUnprocessableEntity,
-			wantBody:                          "Unprocessable Entity: no username claim in upstream ID token\n",
+			wantBody:                          "{\"error\":\"Unprocessable Entity\",\"error_description\":\"no username claim in upstream ID token\",\"error_id\":\"fake-error-id\"}\n",
 			wantExchangeAndValidateTokensCall: happyExchangeAndValidateTokensArgs,
 		},
 		{
@@ -556,7 +682,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			path:                              newRequestPath().WithState(happyState).String(),
 			csrfCookie:                        happyCSRFCookie,
 			wantStatus:                        http.StatusUnprocessableEntity,
-			wantBody:                          "Unprocessable Entity: username claim in upstream ID token has invalid format\n",
+			wantBody:                          "{\"error\":\"Unprocessable Entity\",\"error_description\":\"username claim in upstream ID token has invalid format\",\"error_id\":\"fake-error-id\"}\n",
 			wantExchangeAndValidateTokensCall: happyExchangeAndValidateTokensArgs,
 		},
 		{
@@ -566,7 +692,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			path:                              newRequestPath().WithState(happyState).String(),
 			csrfCookie:                        happyCSRFCookie,
 			wantStatus:                        http.StatusUnprocessableEntity,
-			wantBody:                          "Unprocessable Entity: issuer claim in upstream ID token missing\n",
+			wantBody:                          "{\"error\":\"Unprocessable Entity\",\"error_description\":\"issuer claim in upstream ID token missing\",\"error_id\":\"fake-error-id\"}\n",
 			wantExchangeAndValidateTokensCall: happyExchangeAndValidateTokensArgs,
 		},
 		{
@@ -576,7 +702,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			path:                              newRequestPath().WithState(happyState).String(),
 			csrfCookie:                        happyCSRFCookie,
 			wantStatus:                        http.StatusUnprocessableEntity,
-			wantBody:                          "Unprocessable Entity: issuer claim in upstream ID token has invalid format\n",
+			wantBody:                          "{\"error\":\"Unprocessable Entity\",\"error_description\":\"issuer claim in upstream ID token has invalid format\",\"error_id\":\"fake-error-id\"}\n",
 			wantExchangeAndValidateTokensCall: happyExchangeAndValidateTokensArgs,
 		},
 		{
@@ -586,7 +712,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			path:                              newRequestPath().WithState(happyState).String(),
 			csrfCookie:                        happyCSRFCookie,
 			wantStatus:                        http.StatusUnprocessableEntity,
-			wantBody:                          "Unprocessable Entity: groups claim in upstream ID token has invalid format\n",
+			wantBody:                          "{\"error\":\"Unprocessable Entity\",\"error_description\":\"groups claim in upstream ID token has invalid format\",\"error_id\":\"fake-error-id\"}\n",
 			wantExchangeAndValidateTokensCall: happyExchangeAndValidateTokensArgs,
 		},
 		{
@@ -596,7 +722,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			path:                              newRequestPath().WithState(happyState).String(),
 			csrfCookie:                        happyCSRFCookie,
 			wantStatus:                        http.StatusUnprocessableEntity,
-			wantBody:                          "Unprocessable Entity: groups claim in upstream ID token has invalid format\n",
+			wantBody:                          "{\"error\":\"Unprocessable Entity\",\"error_description\":\"groups claim in upstream ID token has invalid format\",\"error_id\":\"fake-error-id\"}\n",
 			wantExchangeAndValidateTokensCall: happyExchangeAndValidateTokensArgs,
 		},
 		{
@@ -606,7 +732,7 @@ func TestCallbackEndpoint(t *testing.T) {
 			path:                              newRequestPath().WithState(happyState).String(),
 			csrfCookie:                        happyCSRFCookie,
 			wantStatus:                        http.StatusUnprocessableEntity,
-			wantBody:                          "Unprocessable Entity: groups claim in upstream ID token has invalid format\n",
+			wantBody:                          "{\"error\":\"Unprocessable Entity\",\"error_description\":\"groups claim in upstream ID token has invalid format\",\"error_id\":\"fake-error-id\"}\n",
 			wantExchangeAndValidateTokensCall: happyExchangeAndValidateTokensArgs,
 		},
 	}
@@ -620,14 +746,15 @@ func TestCallbackEndpoint(t *testing.T) {
 			// Configure fosite the same way that the production code would.
 			// Inject this into our test subject at the last second so we get a fresh storage for every test.
 			timeoutsConfiguration := oidc.DefaultOIDCTimeoutsConfiguration()
-			oauthStore := oidc.NewKubeStorage(secrets, timeoutsConfiguration)
+			oauthStore := oidc.NewKubeStorage(crud.NewSecretsBackend(secrets), timeoutsConfiguration)
 			hmacSecretFunc := func() []byte { return []byte("some secret - must have at least 32 bytes") }
 			require.GreaterOrEqual(t, len(hmacSecretFunc()), 32, "fosite requires that hmac secrets have at least 32 bytes")
 			jwksProviderIsUnused := jwks.NewDynamicJWKSProvider()
-			oauthHelper := oidc.FositeOauth2Helper(oauthStore, downstreamIssuer, hmacSecretFunc, jwksProviderIsUnused, timeoutsConfiguration)
+			oauthHelper := oidc.FositeOauth2Helper(oauthStore, downstreamIssuer, hmacSecretFunc, jwksProviderIsUnused, timeoutsConfiguration, nil, nil, nil)
 
 			idpListGetter := oidctestutil.NewIDPListGetter(&test.idp)
-			subject := NewHandler(idpListGetter, oauthHelper, happyStateCodec, happyCookieCodec, happyUpstreamRedirectURI)
+			renderer := pages.NewRenderer(downstreamIssuer, nil, func() (string, error) { return "fake-error-id", nil })
+			subject := NewHandler(downstreamIssuer, idpListGetter, oauthHelper, happyStateCodec, happyCookieCodec, happyUpstreamRedirectURI, renderer)
 			req := httptest.NewRequest(test.method, test.path, nil)
 			if test.csrfCookie != "" {
 				req.Header.Set("Cookie", test.csrfCookie)
@@ -686,6 +813,9 @@ func TestCallbackEndpoint(t *testing.T) {
 					test.wantDownstreamIDTokenSubject,
 					test.wantDownstreamIDTokenUsername,
 					test.wantDownstreamIDTokenGroups,
+					test.wantDownstreamIDTokenACR,
+					test.wantDownstreamIDTokenAMR,
+					test.wantDownstreamIDTokenExtraClaims,
 					test.wantDownstreamRequestedScopes,
 				)
 
@@ -819,9 +949,11 @@ func (b *upstreamStateParamBuilder) WithStateVersion(version string) *upstreamSt
 }
 
 type upstreamOIDCIdentityProviderBuilder struct {
-	idToken                    map[string]interface{}
-	usernameClaim, groupsClaim string
-	authcodeExchangeErr        error
+	idToken                              map[string]interface{}
+	usernameClaim, groupsClaim           string
+	requiredACRValues, requiredAMRValues []string
+	additionalClaims                     map[string]string
+	authcodeExchangeErr                  error
 }
 
 func happyUpstream() *upstreamOIDCIdentityProviderBuilder {
@@ -853,6 +985,24 @@ func (u *upstreamOIDCIdentityProviderBuilder) WithoutGroupsClaim() *upstreamOIDC
 	return u
 }
 
+func (u *upstreamOIDCIdentityProviderBuilder) WithRequiredACRValues(values ...string) *upstreamOIDCIdentityProviderBuilder {
+	u.requiredACRValues = values
+	return u
+}
+
+func (u *upstreamOIDCIdentityProviderBuilder) WithRequiredAMRValues(values ...string) *upstreamOIDCIdentityProviderBuilder {
+	u.requiredAMRValues = values
+	return u
+}
+
+func (u *upstreamOIDCIdentityProviderBuilder) WithAdditionalClaim(downstream, upstream string) *upstreamOIDCIdentityProviderBuilder {
+	if u.additionalClaims == nil {
+		u.additionalClaims = map[string]string{}
+	}
+	u.additionalClaims[downstream] = upstream
+	return u
+}
+
 func (u *upstreamOIDCIdentityProviderBuilder) WithIDTokenClaim(name string, value interface{}) *upstreamOIDCIdentityProviderBuilder {
 	u.idToken[name] = value
 	return u
@@ -870,11 +1020,14 @@ func (u *upstreamOIDCIdentityProviderBuilder) WithoutUpstreamAuthcodeExchangeErr
 
 func (u *upstreamOIDCIdentityProviderBuilder) Build() oidctestutil.TestUpstreamOIDCIdentityProvider {
 	return oidctestutil.TestUpstreamOIDCIdentityProvider{
-		Name:          happyUpstreamIDPName,
-		ClientID:      "some-client-id",
-		UsernameClaim: u.usernameClaim,
-		GroupsClaim:   u.groupsClaim,
-		Scopes:        []string{"scope1", "scope2"},
+		Name:              happyUpstreamIDPName,
+		ClientID:          "some-client-id",
+		UsernameClaim:     u.usernameClaim,
+		GroupsClaim:       u.groupsClaim,
+		AdditionalClaims:  u.additionalClaims,
+		RequiredACRValues: u.requiredACRValues,
+		RequiredAMRValues: u.requiredAMRValues,
+		Scopes:            []string{"scope1", "scope2"},
 		ExchangeAuthcodeAndValidateTokensFunc: func(ctx context.Context, authcode string, pkceCodeVerifier oidcpkce.Code, expectedIDTokenNonce nonce.Nonce) (*oidctypes.Token, error) {
 			if u.authcodeExchangeErr != nil {
 				return nil, u.authcodeExchangeErr
@@ -907,8 +1060,11 @@ func validateAuthcodeStorage(
 	wantDownstreamIDTokenSubject string,
 	wantDownstreamIDTokenUsername string,
 	wantDownstreamIDTokenGroups []string,
+	wantDownstreamIDTokenACR string,
+	wantDownstreamIDTokenAMR []string,
+	wantDownstreamIDTokenExtraClaims map[string]interface{},
 	wantDownstreamRequestedScopes []string,
-) (*fosite.Request, *openid.DefaultSession) {
+) (*fosite.Request, *psession.PinnipedSession) {
 	t.Helper()
 
 	// Get the authcode session back from storage so we can require that it was stored correctly.
@@ -930,26 +1086,45 @@ func validateAuthcodeStorage(
 	require.Equal(t, url.Values{"redirect_uri": []string{downstreamRedirectURI}}, storedRequestFromAuthcode.Form)
 	testutil.RequireTimeInDelta(t, time.Now(), storedRequestFromAuthcode.RequestedAt, timeComparisonFudgeFactor)
 
-	// We're not using these fields yet, so confirm that we did not set them (for now).
-	require.Empty(t, storedSessionFromAuthcode.Subject)
-	require.Empty(t, storedSessionFromAuthcode.Username)
-	require.Empty(t, storedSessionFromAuthcode.Headers)
+	// The session storage uses these fields to index sessions by user.
+	require.Equal(t, wantDownstreamIDTokenSubject, storedSessionFromAuthcode.Fosite.Subject)
+	require.Equal(t, wantDownstreamIDTokenUsername, storedSessionFromAuthcode.Fosite.Username)
+
+	// The session remembers which upstream provider resource authenticated the user.
+	require.Equal(t, &psession.CustomSessionData{ProviderName: happyUpstreamIDPName}, storedSessionFromAuthcode.Custom)
+
+	// We're not using this field yet, so confirm that we did not set it (for now).
+	require.Empty(t, storedSessionFromAuthcode.Fosite.Headers)
 
 	// The authcode that we are issuing should be good for the length of time that we declare in the fosite config.
-	testutil.RequireTimeInDelta(t, time.Now().Add(authCodeExpirationSeconds*time.Second), storedSessionFromAuthcode.ExpiresAt[fosite.AuthorizeCode], timeComparisonFudgeFactor)
-	require.Len(t, storedSessionFromAuthcode.ExpiresAt, 1)
+	testutil.RequireTimeInDelta(t, time.Now().Add(authCodeExpirationSeconds*time.Second), storedSessionFromAuthcode.Fosite.ExpiresAt[fosite.AuthorizeCode], timeComparisonFudgeFactor)
+	require.Len(t, storedSessionFromAuthcode.Fosite.ExpiresAt, 1)
 
 	// Now confirm the ID token claims.
-	actualClaims := storedSessionFromAuthcode.Claims
+	actualClaims := storedSessionFromAuthcode.Fosite.Claims
 
 	// Check the user's identity, which are put into the downstream ID token's subject, username and groups claims.
 	require.Equal(t, wantDownstreamIDTokenSubject, actualClaims.Subject)
 	require.Equal(t, wantDownstreamIDTokenUsername, actualClaims.Extra["username"])
-	require.Len(t, actualClaims.Extra, 2)
 	actualDownstreamIDTokenGroups := actualClaims.Extra["groups"]
 	require.NotNil(t, actualDownstreamIDTokenGroups)
 	require.ElementsMatch(t, wantDownstreamIDTokenGroups, actualDownstreamIDTokenGroups)
 
+	// Check how the user authenticated with the upstream IDP, which is put into the downstream ID token's acr and amr claims.
+	require.Equal(t, wantDownstreamIDTokenACR, actualClaims.AuthenticationContextClassReference)
+	wantExtraLen := 2
+	if wantDownstreamIDTokenAMR != nil {
+		require.ElementsMatch(t, wantDownstreamIDTokenAMR, actualClaims.Extra["amr"])
+		wantExtraLen++
+	}
+
+	// Check the additional claims which were copied from the upstream ID token.
+	for claimName, claimValue := range wantDownstreamIDTokenExtraClaims {
+		require.Equal(t, claimValue, actualClaims.Extra[claimName])
+	}
+	wantExtraLen += len(wantDownstreamIDTokenExtraClaims)
+	require.Len(t, actualClaims.Extra, wantExtraLen)
+
 	// Check the rest of the downstream ID token's claims. Fosite wants us to set these (in UTC time).
 	testutil.RequireTimeInDelta(t, time.Now().UTC(), actualClaims.RequestedAt, timeComparisonFudgeFactor)
 	testutil.RequireTimeInDelta(t, time.Now().UTC(), actualClaims.AuthTime, timeComparisonFudgeFactor)
@@ -958,10 +1133,12 @@ func validateAuthcodeStorage(
 	authTimeZone, _ := actualClaims.AuthTime.Zone()
 	require.Equal(t, "UTC", authTimeZone)
 
+	// The issuer is set by the callback endpoint so that the session storage can record the FederationDomain.
+	require.Equal(t, downstreamIssuer, actualClaims.Issuer)
+
 	// Fosite will set these fields for us in the token endpoint based on the store session
 	// information. Therefore, we assert that they are empty because we want the library to do the
 	// lifting for us.
-	require.Empty(t, actualClaims.Issuer)
 	require.Nil(t, actualClaims.Audience)
 	require.Empty(t, actualClaims.Nonce)
 	require.Zero(t, actualClaims.ExpiresAt)
@@ -971,7 +1148,6 @@ func validateAuthcodeStorage(
 	require.Empty(t, actualClaims.JTI)
 	require.Empty(t, actualClaims.CodeHash)
 	require.Empty(t, actualClaims.AccessTokenHash)
-	require.Empty(t, actualClaims.AuthenticationContextClassReference)
 	require.Empty(t, actualClaims.AuthenticationMethodsReference)
 
 	return storedRequestFromAuthcode, storedSessionFromAuthcode
@@ -982,7 +1158,7 @@ func validatePKCEStorage(
 	oauthStore *oidc.KubeStorage,
 	storeKey string,
 	storedRequestFromAuthcode *fosite.Request,
-	storedSessionFromAuthcode *openid.DefaultSession,
+	storedSessionFromAuthcode *psession.PinnipedSession,
 	wantDownstreamPKCEChallenge, wantDownstreamPKCEChallengeMethod string,
 ) {
 	t.Helper()
@@ -1007,7 +1183,7 @@ func validateIDSessionStorage(
 	oauthStore *oidc.KubeStorage,
 	storeKey string,
 	storedRequestFromAuthcode *fosite.Request,
-	storedSessionFromAuthcode *openid.DefaultSession,
+	storedSessionFromAuthcode *psession.PinnipedSession,
 	wantDownstreamNonce string,
 ) {
 	t.Helper()
@@ -1026,13 +1202,13 @@ func validateIDSessionStorage(
 	require.Equal(t, wantDownstreamNonce, storedRequestFromIDSession.Form.Get("nonce"))
 }
 
-func castStoredAuthorizeRequest(t *testing.T, storedAuthorizeRequest fosite.Requester) (*fosite.Request, *openid.DefaultSession) {
+func castStoredAuthorizeRequest(t *testing.T, storedAuthorizeRequest fosite.Requester) (*fosite.Request, *psession.PinnipedSession) {
 	t.Helper()
 
 	storedRequest, ok := storedAuthorizeRequest.(*fosite.Request)
 	require.Truef(t, ok, "could not cast %T to %T", storedAuthorizeRequest, &fosite.Request{})
-	storedSession, ok := storedAuthorizeRequest.GetSession().(*openid.DefaultSession)
-	require.Truef(t, ok, "could not cast %T to %T", storedAuthorizeRequest.GetSession(), &openid.DefaultSession{})
+	storedSession, ok := storedAuthorizeRequest.GetSession().(*psession.PinnipedSession)
+	require.Truef(t, ok, "could not cast %T to %T", storedAuthorizeRequest.GetSession(), &psession.PinnipedSession{})
 
 	return storedRequest, storedSession
 }
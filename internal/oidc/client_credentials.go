@@ -0,0 +1,164 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package oidc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/compose"
+	"github.com/ory/fosite/handler/oauth2"
+	"github.com/pkg/errors"
+
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/psession"
+)
+
+const (
+	grantTypeClientCredentials = "client_credentials"
+	grantTypeTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+	// clientIDSubjectParam is used in the downstream subject of the tokens of a confidential client,
+	// similar to how the "sub" param is used in the downstream subject of users from an upstream IDP.
+	clientIDSubjectParam = "client_id"
+)
+
+// ConfidentialOIDCClient returns the fosite client for a confidential client of a FederationDomain.
+func ConfidentialOIDCClient(client *provider.Client) *fosite.DefaultOpenIDConnectClient {
+	grantTypes := []string{grantTypeClientCredentials}
+	scopes := client.AllowedScopes
+	if client.SectorIdentifier == "" {
+		// Allow the token exchange too, so the access tokens can be exchanged for cluster-scoped ID tokens.
+		grantTypes = append(grantTypes, grantTypeTokenExchange)
+	} else {
+		// The cluster-scoped ID tokens have the public subjects of the users, so a client with pairwise subjects may
+		// neither exchange its tokens itself nor get tokens which any other client could exchange.
+		scopes = withoutScope(scopes, pinnipedTokenExchangeScope)
+	}
+	if len(client.RedirectURIs) > 0 {
+		// A client with redirect URIs may also log in users, like the Pinniped CLI.
+		grantTypes = append(grantTypes, "authorization_code", "refresh_token")
+	}
+	return &fosite.DefaultOpenIDConnectClient{
+		DefaultClient: &fosite.DefaultClient{
+			ID:            client.ID,
+			Secret:        client.SecretHash,
+			RedirectURIs:  client.RedirectURIs,
+			ResponseTypes: []string{"code"},
+			Public:        false,
+			GrantTypes:    grantTypes,
+			Scopes:        scopes,
+			Audience:      client.AllowedAudiences,
+		},
+		TokenEndpointAuthMethod: "client_secret_basic",
+	}
+}
+
+func withoutScope(scopes []string, scope string) []string {
+	result := make([]string, 0, len(scopes))
+	for _, s := range scopes {
+		if s != scope {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// clientManager looks up the confidential clients of a FederationDomain, and delegates the lookup of all
+// other clients to the storage.
+type clientManager struct {
+	fosite.Storage
+	clients map[string]*provider.Client
+}
+
+func newClientManager(storage fosite.Storage, clients []*provider.Client) *clientManager {
+	clientsByID := make(map[string]*provider.Client, len(clients))
+	for _, client := range clients {
+		clientsByID[client.ID] = client
+	}
+	return &clientManager{Storage: storage, clients: clientsByID}
+}
+
+func (m *clientManager) GetClient(ctx context.Context, id string) (fosite.Client, error) {
+	if client, ok := m.clients[id]; ok {
+		return ConfidentialOIDCClient(client), nil
+	}
+	return m.Storage.GetClient(ctx, id)
+}
+
+// ClientCredentialsFactory returns a compose.Factory for the client credentials grant handler. The access
+// tokens which it issues represent the fixed service identity of the given clients.
+func ClientCredentialsFactory(clients []*provider.Client) compose.Factory {
+	clientsByID := make(map[string]*provider.Client, len(clients))
+	for _, client := range clients {
+		clientsByID[client.ID] = client
+	}
+	return func(config *compose.Config, storage interface{}, strategy interface{}) interface{} {
+		return &ClientCredentialsHandler{
+			ClientCredentialsGrantHandler: compose.OAuth2ClientCredentialsGrantFactory(config, storage, strategy).(*oauth2.ClientCredentialsGrantHandler),
+			issuer:                        config.IDTokenIssuer,
+			clients:                       clientsByID,
+		}
+	}
+}
+
+// ClientCredentialsHandler extends the fosite client credentials grant handler to fill in the session
+// of the service identity of the client, and to grant the requested scopes and audiences, or all allowed
+// audiences when none were requested. Fosite has already checked that they are allowed for the client.
+type ClientCredentialsHandler struct {
+	*oauth2.ClientCredentialsGrantHandler
+	issuer  string
+	clients map[string]*provider.Client
+}
+
+func (h *ClientCredentialsHandler) HandleTokenEndpointRequest(ctx context.Context, requester fosite.AccessRequester) error {
+	if err := h.ClientCredentialsGrantHandler.HandleTokenEndpointRequest(ctx, requester); err != nil {
+		return err
+	}
+
+	client, ok := h.clients[requester.GetClient().GetID()]
+	if !ok {
+		return errors.WithStack(fosite.ErrUnauthorizedClient.WithHintf("The OAuth 2.0 Client is not allowed to use authorization grant %q.", grantTypeClientCredentials))
+	}
+	session, ok := requester.GetSession().(*psession.PinnipedSession)
+	if !ok {
+		return errors.WithStack(fosite.ErrServerError.WithHint("unexpected session type"))
+	}
+
+	subject := clientServiceSubject(h.issuer, client.ID)
+	groups := client.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	now := time.Now().UTC()
+	session.Fosite.Subject = subject
+	session.Fosite.Username = client.Username
+	session.Fosite.Claims.Subject = subject
+	session.Fosite.Claims.RequestedAt = now
+	session.Fosite.Claims.AuthTime = now
+	session.Fosite.Claims.Extra = map[string]interface{}{
+		DownstreamUsernameClaim: client.Username,
+		DownstreamGroupsClaim:   groups,
+	}
+
+	for _, scope := range requester.GetRequestedScopes() {
+		requester.GrantScope(scope)
+	}
+	audiences := requester.GetRequestedAudience()
+	if len(audiences) == 0 {
+		// Always record the audiences of the token, so that the token exchange can't get tokens for any other audience.
+		audiences = client.AllowedAudiences
+	}
+	for _, audience := range audiences {
+		requester.GrantAudience(audience)
+	}
+	return nil
+}
+
+// clientServiceSubject returns the downstream subject of the service identity of a confidential client.
+func clientServiceSubject(issuer string, clientID string) string {
+	return fmt.Sprintf("%s?%s=%s", issuer, clientIDSubjectParam, clientID)
+}
@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package discovery provides a handler for the OIDC discovery endpoint.
@@ -7,8 +7,10 @@ package discovery
 import (
 	"encoding/json"
 	"net/http"
+	"sort"
 
 	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/dpop"
 )
 
 // Metadata holds all fields (that we care about) from the OpenID Provider Metadata section in the
@@ -35,11 +37,18 @@ type Metadata struct {
 	ScopesSupported                   []string `json:"scopes_supported"`
 	ClaimsSupported                   []string `json:"claims_supported"`
 
+	// PushedAuthorizationRequestEndpoint is defined by https://datatracker.ietf.org/doc/html/rfc9126#section-5.
+	PushedAuthorizationRequestEndpoint string `json:"pushed_authorization_request_endpoint,omitempty"`
+
+	// DPoPSigningAlgValuesSupported is defined by https://datatracker.ietf.org/doc/html/rfc9449#section-5.1.
+	DPoPSigningAlgValuesSupported []string `json:"dpop_signing_alg_values_supported,omitempty"`
+
 	// ^^^ Optional ^^^
 }
 
-// NewHandler returns an http.Handler that serves an OIDC discovery endpoint.
-func NewHandler(issuerURL string) http.Handler {
+// NewHandler returns an http.Handler that serves an OIDC discovery endpoint. The advertised claims include the
+// additional claims which are copied from the upstream providers returned by idpListGetter.
+func NewHandler(issuerURL string, idpListGetter oidc.IDPListGetter) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
@@ -54,14 +63,33 @@ func NewHandler(issuerURL string) http.Handler {
 			TokenEndpoint:                     issuerURL + oidc.TokenEndpointPath,
 			JWKSURI:                           issuerURL + oidc.JWKSEndpointPath,
 			ResponseTypesSupported:            []string{"code"},
-			SubjectTypesSupported:             []string{"public"},
+			SubjectTypesSupported:             []string{"public", "pairwise"},
 			IDTokenSigningAlgValuesSupported:  []string{"ES256"},
 			TokenEndpointAuthMethodsSupported: []string{"client_secret_basic"},
 			ScopesSupported:                   []string{"openid", "offline"},
-			ClaimsSupported:                   []string{"groups"},
+			ClaimsSupported:                   claimsSupported(idpListGetter),
+
+			PushedAuthorizationRequestEndpoint: issuerURL + oidc.PushedAuthorizationRequestEndpointPath,
+			DPoPSigningAlgValuesSupported:      dpop.SupportedAlgorithms,
 		}
 		if err := json.NewEncoder(w).Encode(&oidcConfig); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 	})
 }
+
+func claimsSupported(idpListGetter oidc.IDPListGetter) []string {
+	claims := []string{oidc.DownstreamGroupsClaim}
+	seen := map[string]bool{oidc.DownstreamGroupsClaim: true}
+	var additionalClaims []string
+	for _, upstream := range idpListGetter.GetIDPList() {
+		for claim := range upstream.GetAdditionalClaims() {
+			if !seen[claim] {
+				seen[claim] = true
+				additionalClaims = append(additionalClaims, claim)
+			}
+		}
+	}
+	sort.Strings(additionalClaims)
+	return append(claims, additionalClaims...)
+}
@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package discovery
@@ -12,15 +12,17 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/oidctestutil"
 )
 
 func TestDiscovery(t *testing.T) {
 	tests := []struct {
 		name string
 
-		issuer string
-		method string
-		path   string
+		issuer    string
+		upstreams []*oidctestutil.TestUpstreamOIDCIdentityProvider
+		method    string
+		path      string
 
 		wantStatus      int
 		wantContentType string
@@ -40,11 +42,42 @@ func TestDiscovery(t *testing.T) {
 				TokenEndpoint:                     "https://some-issuer.com/some/path/oauth2/token",
 				JWKSURI:                           "https://some-issuer.com/some/path/jwks.json",
 				ResponseTypesSupported:            []string{"code"},
-				SubjectTypesSupported:             []string{"public"},
+				SubjectTypesSupported:             []string{"public", "pairwise"},
 				IDTokenSigningAlgValuesSupported:  []string{"ES256"},
 				TokenEndpointAuthMethodsSupported: []string{"client_secret_basic"},
 				ScopesSupported:                   []string{"openid", "offline"},
 				ClaimsSupported:                   []string{"groups"},
+
+				PushedAuthorizationRequestEndpoint: "https://some-issuer.com/some/path/oauth2/par",
+				DPoPSigningAlgValuesSupported:      []string{"ES256", "ES384", "ES512", "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "EdDSA"},
+			},
+		},
+		{
+			name:   "upstreams with additional claims",
+			issuer: "https://some-issuer.com/some/path",
+			upstreams: []*oidctestutil.TestUpstreamOIDCIdentityProvider{
+				{Name: "upstream-1", AdditionalClaims: map[string]string{"email": "mail", "name": "name"}},
+				{Name: "upstream-2"},
+				{Name: "upstream-3", AdditionalClaims: map[string]string{"employee_id": "employeeNumber", "email": "email"}},
+			},
+			method:          http.MethodGet,
+			path:            "/some/path" + oidc.WellKnownEndpointPath,
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+			wantBodyJSON: &Metadata{
+				Issuer:                            "https://some-issuer.com/some/path",
+				AuthorizationEndpoint:             "https://some-issuer.com/some/path/oauth2/authorize",
+				TokenEndpoint:                     "https://some-issuer.com/some/path/oauth2/token",
+				JWKSURI:                           "https://some-issuer.com/some/path/jwks.json",
+				ResponseTypesSupported:            []string{"code"},
+				SubjectTypesSupported:             []string{"public", "pairwise"},
+				IDTokenSigningAlgValuesSupported:  []string{"ES256"},
+				TokenEndpointAuthMethodsSupported: []string{"client_secret_basic"},
+				ScopesSupported:                   []string{"openid", "offline"},
+				ClaimsSupported:                   []string{"groups", "email", "employee_id", "name"},
+
+				PushedAuthorizationRequestEndpoint: "https://some-issuer.com/some/path/oauth2/par",
+				DPoPSigningAlgValuesSupported:      []string{"ES256", "ES384", "ES512", "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "EdDSA"},
 			},
 		},
 		{
@@ -60,7 +93,7 @@ func TestDiscovery(t *testing.T) {
 	for _, test := range tests {
 		test := test
 		t.Run(test.name, func(t *testing.T) {
-			handler := NewHandler(test.issuer)
+			handler := NewHandler(test.issuer, oidctestutil.NewIDPListGetter(test.upstreams...))
 			req := httptest.NewRequest(test.method, test.path, nil)
 			rsp := httptest.NewRecorder()
 			handler.ServeHTTP(rsp, req)
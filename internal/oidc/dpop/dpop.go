@@ -0,0 +1,230 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package dpop validates the OAuth 2.0 Demonstrating Proof of Possession (DPoP) proofs which clients send to the
+// Supervisor's token endpoint, as defined by https://datatracker.ietf.org/doc/html/rfc9449.
+package dpop
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ory/fosite"
+	"gopkg.in/square/go-jose.v2"
+	josejwt "gopkg.in/square/go-jose.v2/jwt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"go.pinniped.dev/internal/fositestorage/dpopproof"
+	clientdpop "go.pinniped.dev/pkg/oidcclient/dpop"
+)
+
+const (
+	// nonceLifetime is how long each nonce is issued for. A nonce is accepted for up to twice this long, so that a
+	// client which got a nonce right before a new one was issued does not immediately need another one.
+	nonceLifetime = 5 * time.Minute
+
+	// maxProofAge is how long after its iat a DPoP proof is accepted. This only needs to allow for slow networks.
+	maxProofAge = 5 * time.Minute
+
+	// maxClockSkew is how far in the future the iat of a DPoP proof may be.
+	maxClockSkew = 1 * time.Minute
+
+	// ProofLifetime is how long the used DPoP proofs must be remembered to prevent their replay. A proof whose iat is
+	// as far in the future as allowed is accepted until maxProofAge after its iat.
+	ProofLifetime = maxProofAge + maxClockSkew
+)
+
+//nolint:gochecknoglobals
+var (
+	// SupportedAlgorithms are the JWS algorithms of the DPoP proofs which are accepted.
+	SupportedAlgorithms = []string{
+		string(jose.ES256), string(jose.ES384), string(jose.ES512),
+		string(jose.RS256), string(jose.RS384), string(jose.RS512),
+		string(jose.PS256), string(jose.PS384), string(jose.PS512),
+		string(jose.EdDSA),
+	}
+
+	// ErrInvalidDPoPProof is returned when a DPoP proof is invalid, or when a DPoP proof is required but missing.
+	ErrInvalidDPoPProof = &fosite.RFC6749Error{
+		ErrorField:       "invalid_dpop_proof",
+		DescriptionField: "The DPoP proof is missing or invalid.",
+		CodeField:        http.StatusBadRequest,
+	}
+
+	// ErrUseDPoPNonce is returned when a DPoP proof does not have a current nonce. The response must include a
+	// current nonce in the DPoP-Nonce header.
+	ErrUseDPoPNonce = &fosite.RFC6749Error{
+		ErrorField:       "use_dpop_nonce",
+		DescriptionField: "The DPoP proof must include the nonce which was provided by the authorization server.",
+		CodeField:        http.StatusBadRequest,
+	}
+)
+
+// Validator validates DPoP proofs and issues the nonces which the proofs must include. The nonces are derived from
+// a key and the current time, so that every Supervisor pod which shares the key accepts the same nonces. Each proof
+// is only accepted once, which every Supervisor pod which shares the proof storage enforces together.
+type Validator struct {
+	nonceKey func() []byte
+	proofs   dpopproof.Storage
+	now      func() time.Time
+}
+
+// NewValidator returns a Validator which derives its nonces from the key returned by nonceKey, and which records
+// the used proofs in proofs. The proofs must be stored for at least ProofLifetime.
+func NewValidator(nonceKey func() []byte, proofs dpopproof.Storage) *Validator {
+	return &Validator{nonceKey: nonceKey, proofs: proofs, now: time.Now}
+}
+
+// Nonce returns the current nonce, which should be sent to clients in the DPoP-Nonce response header.
+func (v *Validator) Nonce() string {
+	return v.nonceForPeriod(v.currentNoncePeriod())
+}
+
+// Validate validates the DPoP proof of a request to the given URL, and returns the JWK thumbprint of the key which
+// signed the proof. It returns an empty string when the request does not have a DPoP proof.
+func (v *Validator) Validate(r *http.Request, targetURL string) (string, error) {
+	proofs := r.Header.Values(clientdpop.HeaderName)
+	if len(proofs) == 0 {
+		return "", nil
+	}
+	if len(proofs) > 1 {
+		return "", ErrInvalidDPoPProof.WithHint("The request must not have more than one DPoP header.")
+	}
+
+	jws, err := jose.ParseSigned(proofs[0])
+	if err != nil {
+		return "", ErrInvalidDPoPProof.WithHint("The DPoP proof is not a valid JWS.").WithWrap(err).WithDebug(err.Error())
+	}
+	if len(jws.Signatures) != 1 {
+		return "", ErrInvalidDPoPProof.WithHint("The DPoP proof must have exactly one signature.")
+	}
+	header := jws.Signatures[0].Protected
+	if typ, _ := header.ExtraHeaders[jose.HeaderType].(string); typ != clientdpop.ProofType {
+		return "", ErrInvalidDPoPProof.WithHintf("The DPoP proof must have the typ header %q.", clientdpop.ProofType)
+	}
+	if !contains(SupportedAlgorithms, header.Algorithm) {
+		return "", ErrInvalidDPoPProof.WithHintf("The DPoP proof must be signed using one of the algorithms %s.", strings.Join(SupportedAlgorithms, ", "))
+	}
+	jwk := header.JSONWebKey
+	if jwk == nil || !jwk.Valid() || !jwk.IsPublic() {
+		return "", ErrInvalidDPoPProof.WithHint("The DPoP proof must have a public key in its jwk header.")
+	}
+
+	payload, err := jws.Verify(jwk)
+	if err != nil {
+		return "", ErrInvalidDPoPProof.WithHint("The signature of the DPoP proof is invalid.").WithWrap(err).WithDebug(err.Error())
+	}
+
+	var claims struct {
+		JTI   string               `json:"jti"`
+		HTM   string               `json:"htm"`
+		HTU   string               `json:"htu"`
+		IAT   *josejwt.NumericDate `json:"iat"`
+		Nonce string               `json:"nonce"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", ErrInvalidDPoPProof.WithHint("The claims of the DPoP proof are invalid.").WithWrap(err).WithDebug(err.Error())
+	}
+	if claims.JTI == "" {
+		return "", ErrInvalidDPoPProof.WithHint("The DPoP proof must have a jti claim.")
+	}
+	if claims.HTM != r.Method {
+		return "", ErrInvalidDPoPProof.WithHint("The htm claim of the DPoP proof does not match the method of the request.")
+	}
+	if !sameURL(claims.HTU, targetURL) {
+		return "", ErrInvalidDPoPProof.WithHint("The htu claim of the DPoP proof does not match the URL of the request.")
+	}
+	if claims.IAT == nil {
+		return "", ErrInvalidDPoPProof.WithHint("The DPoP proof must have an iat claim.")
+	}
+	now := v.now()
+	if iat := claims.IAT.Time(); iat.Before(now.Add(-maxProofAge)) || iat.After(now.Add(maxClockSkew)) {
+		return "", ErrInvalidDPoPProof.WithHint("The iat claim of the DPoP proof is too far from the current time.")
+	}
+	if !v.validNonce(claims.Nonce) {
+		return "", ErrUseDPoPNonce
+	}
+
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", ErrInvalidDPoPProof.WithHint("The public key of the DPoP proof is invalid.").WithWrap(err).WithDebug(err.Error())
+	}
+	jkt := base64.RawURLEncoding.EncodeToString(thumbprint)
+
+	// Only remember the proofs which are otherwise valid, so that invalid proofs do not fill up the storage.
+	if err := v.proofs.CreateDPoPProof(r.Context(), jkt, claims.JTI); err != nil {
+		if apierrors.IsAlreadyExists(err) {
+			return "", ErrInvalidDPoPProof.WithHint("The DPoP proof was already used.")
+		}
+		return "", fosite.ErrServerError.WithHint("Failed to record the use of the DPoP proof.").WithWrap(err).WithDebug(err.Error())
+	}
+	return jkt, nil
+}
+
+func (v *Validator) validNonce(nonce string) bool {
+	if nonce == "" {
+		return false
+	}
+	period := v.currentNoncePeriod()
+	return hmac.Equal([]byte(nonce), []byte(v.nonceForPeriod(period))) ||
+		hmac.Equal([]byte(nonce), []byte(v.nonceForPeriod(period-1)))
+}
+
+func (v *Validator) currentNoncePeriod() int64 {
+	return v.now().Unix() / int64(nonceLifetime/time.Second)
+}
+
+func (v *Validator) nonceForPeriod(period int64) string {
+	mac := hmac.New(sha256.New, v.nonceKey())
+	_, _ = fmt.Fprintf(mac, "dpop-nonce:%d", period)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sameURL compares the htu claim of a DPoP proof to the URL of the request, ignoring any query and fragment.
+// See https://datatracker.ietf.org/doc/html/rfc9449#section-4.3.
+func sameURL(htu string, targetURL string) bool {
+	parsedHTU, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+	parsedTargetURL, err := url.Parse(targetURL)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(parsedHTU.Scheme, parsedTargetURL.Scheme) &&
+		strings.EqualFold(parsedHTU.Host, parsedTargetURL.Host) &&
+		parsedHTU.Path == parsedTargetURL.Path
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+type contextKey struct{}
+
+// NewContext returns a context which carries the JWK thumbprint of the key which signed the DPoP proof of a
+// token request, so that the grant handlers can check it against the key to which a presented token is bound.
+func NewContext(ctx context.Context, jkt string) context.Context {
+	return context.WithValue(ctx, contextKey{}, jkt)
+}
+
+// FromContext returns the JWK thumbprint which was stored by NewContext, or an empty string when the token request
+// did not have a DPoP proof.
+func FromContext(ctx context.Context) string {
+	jkt, _ := ctx.Value(contextKey{}).(string)
+	return jkt
+}
@@ -0,0 +1,343 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package dpop
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/fositestorage/dpopproof"
+	"go.pinniped.dev/internal/testutil/storagebackends"
+	clientdpop "go.pinniped.dev/pkg/oidcclient/dpop"
+)
+
+func TestValidate(t *testing.T) {
+	const targetURL = "https://some-issuer.com/some-path/oauth2/token"
+
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	nonceKey := func() []byte { return []byte("some secret - must have at least 32 bytes") }
+	validator := NewValidator(nonceKey, newProofStorage(crud.NewSecretsBackend(fake.NewSimpleClientset().CoreV1().Secrets("some-namespace")), now))
+	validator.now = func() time.Time { return now }
+	previousNonce := validator.nonceForPeriod(validator.currentNoncePeriod() - 1)
+	tooOldNonce := validator.nonceForPeriod(validator.currentNoncePeriod() - 2)
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	thumbprint, err := (&jose.JSONWebKey{Key: privateKey.Public()}).Thumbprint(crypto.SHA256)
+	require.NoError(t, err)
+	wantJKT := base64.RawURLEncoding.EncodeToString(thumbprint)
+
+	// Each proof is only accepted once, so give every proof its own jti.
+	jtiCount := 0
+	happyClaims := func() map[string]interface{} {
+		jtiCount++
+		return map[string]interface{}{
+			"jti":   fmt.Sprintf("some-jti-%d", jtiCount),
+			"htm":   http.MethodPost,
+			"htu":   targetURL,
+			"iat":   now.Unix(),
+			"nonce": validator.Nonce(),
+		}
+	}
+	modifiedClaims := func(overrides map[string]interface{}) map[string]interface{} {
+		claims := happyClaims()
+		for k, v := range overrides {
+			if v == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = v
+			}
+		}
+		return claims
+	}
+
+	sign := func(t *testing.T, claims map[string]interface{}, opts *jose.SignerOptions) string {
+		t.Helper()
+		if opts == nil {
+			opts = (&jose.SignerOptions{EmbedJWK: true}).WithType(clientdpop.ProofType)
+		}
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: privateKey}, opts)
+		require.NoError(t, err)
+		payload, err := json.Marshal(claims)
+		require.NoError(t, err)
+		jws, err := signer.Sign(payload)
+		require.NoError(t, err)
+		proof, err := jws.CompactSerialize()
+		require.NoError(t, err)
+		return proof
+	}
+
+	tests := []struct {
+		name     string
+		proofs   func(t *testing.T) []string
+		wantJKT  string
+		wantErr  *fosite.RFC6749Error
+		wantHint string
+	}{
+		{
+			name:   "no DPoP proof",
+			proofs: func(t *testing.T) []string { return nil },
+		},
+		{
+			name:    "happy path",
+			proofs:  func(t *testing.T) []string { return []string{sign(t, happyClaims(), nil)} },
+			wantJKT: wantJKT,
+		},
+		{
+			name: "happy path with the previous nonce",
+			proofs: func(t *testing.T) []string {
+				return []string{sign(t, modifiedClaims(map[string]interface{}{"nonce": previousNonce}), nil)}
+			},
+			wantJKT: wantJKT,
+		},
+		{
+			name: "happy path with a query in the htu and a different case of the host",
+			proofs: func(t *testing.T) []string {
+				return []string{sign(t, modifiedClaims(map[string]interface{}{"htu": "https://SOME-issuer.com/some-path/oauth2/token?foo=bar"}), nil)}
+			},
+			wantJKT: wantJKT,
+		},
+		{
+			name:     "more than one DPoP proof",
+			proofs:   func(t *testing.T) []string { return []string{sign(t, happyClaims(), nil), sign(t, happyClaims(), nil)} },
+			wantErr:  ErrInvalidDPoPProof,
+			wantHint: "The request must not have more than one DPoP header.",
+		},
+		{
+			name:     "DPoP proof is not a JWS",
+			proofs:   func(t *testing.T) []string { return []string{"not-a-jws"} },
+			wantErr:  ErrInvalidDPoPProof,
+			wantHint: "The DPoP proof is not a valid JWS.",
+		},
+		{
+			name: "DPoP proof has the wrong typ",
+			proofs: func(t *testing.T) []string {
+				return []string{sign(t, happyClaims(), (&jose.SignerOptions{EmbedJWK: true}).WithType("JWT"))}
+			},
+			wantErr:  ErrInvalidDPoPProof,
+			wantHint: `The DPoP proof must have the typ header "dpop+jwt".`,
+		},
+		{
+			name: "DPoP proof has no jwk",
+			proofs: func(t *testing.T) []string {
+				return []string{sign(t, happyClaims(), (&jose.SignerOptions{}).WithType(clientdpop.ProofType))}
+			},
+			wantErr:  ErrInvalidDPoPProof,
+			wantHint: "The DPoP proof must have a public key in its jwk header.",
+		},
+		{
+			name: "DPoP proof has no jti",
+			proofs: func(t *testing.T) []string {
+				return []string{sign(t, modifiedClaims(map[string]interface{}{"jti": nil}), nil)}
+			},
+			wantErr:  ErrInvalidDPoPProof,
+			wantHint: "The DPoP proof must have a jti claim.",
+		},
+		{
+			name: "DPoP proof is for another method",
+			proofs: func(t *testing.T) []string {
+				return []string{sign(t, modifiedClaims(map[string]interface{}{"htm": http.MethodGet}), nil)}
+			},
+			wantErr:  ErrInvalidDPoPProof,
+			wantHint: "The htm claim of the DPoP proof does not match the method of the request.",
+		},
+		{
+			name: "DPoP proof is for another URL",
+			proofs: func(t *testing.T) []string {
+				return []string{sign(t, modifiedClaims(map[string]interface{}{"htu": "https://some-issuer.com/other-path/oauth2/token"}), nil)}
+			},
+			wantErr:  ErrInvalidDPoPProof,
+			wantHint: "The htu claim of the DPoP proof does not match the URL of the request.",
+		},
+		{
+			name: "DPoP proof has no iat",
+			proofs: func(t *testing.T) []string {
+				return []string{sign(t, modifiedClaims(map[string]interface{}{"iat": nil}), nil)}
+			},
+			wantErr:  ErrInvalidDPoPProof,
+			wantHint: "The DPoP proof must have an iat claim.",
+		},
+		{
+			name: "DPoP proof is too old",
+			proofs: func(t *testing.T) []string {
+				return []string{sign(t, modifiedClaims(map[string]interface{}{"iat": now.Add(-6 * time.Minute).Unix()}), nil)}
+			},
+			wantErr:  ErrInvalidDPoPProof,
+			wantHint: "The iat claim of the DPoP proof is too far from the current time.",
+		},
+		{
+			name: "DPoP proof is from the future",
+			proofs: func(t *testing.T) []string {
+				return []string{sign(t, modifiedClaims(map[string]interface{}{"iat": now.Add(2 * time.Minute).Unix()}), nil)}
+			},
+			wantErr:  ErrInvalidDPoPProof,
+			wantHint: "The iat claim of the DPoP proof is too far from the current time.",
+		},
+		{
+			name: "DPoP proof has no nonce",
+			proofs: func(t *testing.T) []string {
+				return []string{sign(t, modifiedClaims(map[string]interface{}{"nonce": nil}), nil)}
+			},
+			wantErr: ErrUseDPoPNonce,
+		},
+		{
+			name: "DPoP proof has an expired nonce",
+			proofs: func(t *testing.T) []string {
+				return []string{sign(t, modifiedClaims(map[string]interface{}{"nonce": tooOldNonce}), nil)}
+			},
+			wantErr: ErrUseDPoPNonce,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/some-path/oauth2/token", nil)
+			for _, proof := range test.proofs(t) {
+				req.Header.Add("DPoP", proof)
+			}
+
+			jkt, err := validator.Validate(req, targetURL)
+			if test.wantErr != nil {
+				require.True(t, errors.Is(err, test.wantErr), "wrong error: %v", err)
+				var rfc6749Error *fosite.RFC6749Error
+				require.True(t, errors.As(err, &rfc6749Error))
+				require.Equal(t, test.wantHint, rfc6749Error.HintField)
+				require.Empty(t, jkt)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.wantJKT, jkt)
+		})
+	}
+}
+
+func TestValidateReplayedProof(t *testing.T) {
+	const targetURL = "https://some-issuer.com/some-path/oauth2/token"
+
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	nonceKey := func() []byte { return []byte("some secret - must have at least 32 bytes") }
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherPrivateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	for _, backend := range storagebackends.All(t) {
+		backend := backend
+		t.Run(backend.Name, func(t *testing.T) {
+			// Two validators which share the storage, like the Supervisor pods do.
+			validator := NewValidator(nonceKey, newProofStorage(backend, now))
+			validator.now = func() time.Time { return now }
+			otherValidator := NewValidator(nonceKey, newProofStorage(backend, now))
+			otherValidator.now = func() time.Time { return now }
+
+			sign := func(t *testing.T, key *ecdsa.PrivateKey, jti string) string {
+				t.Helper()
+				signer, err := jose.NewSigner(
+					jose.SigningKey{Algorithm: jose.ES256, Key: key},
+					(&jose.SignerOptions{EmbedJWK: true}).WithType(clientdpop.ProofType),
+				)
+				require.NoError(t, err)
+				payload, err := json.Marshal(map[string]interface{}{
+					"jti":   jti,
+					"htm":   http.MethodPost,
+					"htu":   targetURL,
+					"iat":   now.Unix(),
+					"nonce": validator.Nonce(),
+				})
+				require.NoError(t, err)
+				jws, err := signer.Sign(payload)
+				require.NoError(t, err)
+				proof, err := jws.CompactSerialize()
+				require.NoError(t, err)
+				return proof
+			}
+			validate := func(v *Validator, proof string) (string, error) {
+				req := httptest.NewRequest(http.MethodPost, "/some-path/oauth2/token", nil)
+				req.Header.Set("DPoP", proof)
+				return v.Validate(req, targetURL)
+			}
+			requireReplayed := func(t *testing.T, jkt string, err error) {
+				t.Helper()
+				require.True(t, errors.Is(err, ErrInvalidDPoPProof), "wrong error: %v", err)
+				var rfc6749Error *fosite.RFC6749Error
+				require.True(t, errors.As(err, &rfc6749Error))
+				require.Equal(t, "invalid_dpop_proof", rfc6749Error.ErrorField)
+				require.Equal(t, "The DPoP proof was already used.", rfc6749Error.HintField)
+				require.Empty(t, jkt)
+			}
+
+			proof := sign(t, privateKey, "some-jti")
+			jkt, err := validate(validator, proof)
+			require.NoError(t, err)
+			require.NotEmpty(t, jkt)
+
+			// The same proof is rejected the second time, also by another Supervisor pod.
+			jkt, err = validate(validator, proof)
+			requireReplayed(t, jkt, err)
+			jkt, err = validate(otherValidator, proof)
+			requireReplayed(t, jkt, err)
+
+			// Another proof with the same jti and the same key is also a replay.
+			jkt, err = validate(otherValidator, sign(t, privateKey, "some-jti"))
+			requireReplayed(t, jkt, err)
+
+			// The jti only needs to be unique for each key.
+			jkt, err = validate(otherValidator, sign(t, otherPrivateKey, "some-jti"))
+			require.NoError(t, err)
+			require.NotEmpty(t, jkt)
+			jkt, err = validate(otherValidator, sign(t, privateKey, "some-other-jti"))
+			require.NoError(t, err)
+			require.NotEmpty(t, jkt)
+		})
+	}
+}
+
+func TestNonce(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	validator := NewValidator(func() []byte { return []byte("some secret - must have at least 32 bytes") }, nil)
+	validator.now = func() time.Time { return now }
+	nonce := validator.Nonce()
+	require.NotEmpty(t, nonce)
+
+	// The nonce is the same within a period, and is still accepted during the next period.
+	validator.now = func() time.Time { return now.Add(nonceLifetime - time.Second) }
+	require.Equal(t, nonce, validator.Nonce())
+	validator.now = func() time.Time { return now.Add(nonceLifetime) }
+	require.NotEqual(t, nonce, validator.Nonce())
+	require.True(t, validator.validNonce(nonce))
+	validator.now = func() time.Time { return now.Add(2 * nonceLifetime) }
+	require.False(t, validator.validNonce(nonce))
+
+	// Another key gives other nonces.
+	otherValidator := NewValidator(func() []byte { return []byte("some other secret - must have at least 32 bytes") }, nil)
+	otherValidator.now = func() time.Time { return now }
+	require.NotEqual(t, nonce, otherValidator.Nonce())
+	require.False(t, otherValidator.validNonce(nonce))
+}
+
+func TestContext(t *testing.T) {
+	require.Empty(t, FromContext(context.Background()))
+	require.Equal(t, "some-jkt", FromContext(NewContext(context.Background(), "some-jkt")))
+}
+
+func newProofStorage(backend crud.Backend, now time.Time) dpopproof.Storage {
+	return dpopproof.New(backend, func() time.Time { return now }, ProofLifetime)
+}
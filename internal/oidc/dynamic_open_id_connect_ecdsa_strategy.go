@@ -5,8 +5,13 @@ package oidc
 
 import (
 	"context"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/elliptic"
+	"net/url"
 	"reflect"
+	"strconv"
+	"time"
 
 	"go.pinniped.dev/internal/constable"
 	"go.pinniped.dev/internal/plog"
@@ -14,6 +19,7 @@ import (
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/compose"
 	"github.com/ory/fosite/handler/openid"
+	"github.com/ory/fosite/token/jwt"
 
 	"go.pinniped.dev/internal/oidc/jwks"
 )
@@ -52,7 +58,14 @@ func (s *dynamicOpenIDConnectECDSAStrategy) GenerateIDToken(
 		plog.Debug("no JWK found for issuer", "issuer", s.fositeConfig.IDTokenIssuer)
 		return "", fosite.ErrTemporarilyUnavailable.WithWrap(constable.Error("no JWK found for issuer"))
 	}
-	key, ok := activeJwk.Key.(*ecdsa.PrivateKey)
+	// The key may be a private key which was loaded from a Secret, or any other crypto.Signer, such as a key
+	// which is held by a signing plugin.
+	signer, ok := activeJwk.Key.(crypto.Signer)
+	var publicKey *ecdsa.PublicKey
+	if ok {
+		publicKey, ok = signer.Public().(*ecdsa.PublicKey)
+		ok = ok && publicKey.Curve == elliptic.P256()
+	}
 	if !ok {
 		actualType := "nil"
 		if t := reflect.TypeOf(activeJwk.Key); t != nil {
@@ -68,5 +81,124 @@ func (s *dynamicOpenIDConnectECDSAStrategy) GenerateIDToken(
 		return "", fosite.ErrServerError.WithWrap(constable.Error("JWK must be of type ecdsa"))
 	}
 
-	return compose.NewOpenIDConnectECDSAStrategy(s.fositeConfig, key).GenerateIDToken(ctx, requester)
+	return generateIDToken(requester, newSignerJWTStrategy(signer, publicKey), s.fositeConfig)
+}
+
+// generateIDToken completes the ID token claims of the session of requester, and signs them with jwtStrategy. This
+// is the same as what openid.DefaultStrategy does, except that openid.DefaultStrategy can only sign with a
+// jwt.JWTStrategy, which needs a private key.
+func generateIDToken(requester fosite.Requester, jwtStrategy *signerJWTStrategy, config *compose.Config) (string, error) {
+	session, ok := requester.GetSession().(openid.Session)
+	if !ok {
+		return "", fosite.ErrServerError.WithDebug("Failed to generate id token because session must be of type fosite/handler/openid.Session.")
+	}
+
+	claims := session.IDTokenClaims()
+	if claims.Subject == "" {
+		return "", fosite.ErrServerError.WithDebug("Failed to generate id token because subject is an empty string.")
+	}
+
+	form := requester.GetRequestForm()
+	if form.Get("grant_type") != "refresh_token" {
+		if err := validateIDTokenAuthorizeParams(form, claims, jwtStrategy); err != nil {
+			return "", err
+		}
+	}
+
+	now := time.Now().UTC()
+	if claims.ExpiresAt.IsZero() {
+		claims.ExpiresAt = now.Add(config.GetIDTokenLifespan())
+	}
+	if claims.ExpiresAt.Before(now) {
+		return "", fosite.ErrServerError.WithDebug("Failed to generate id token because expiry claim can not be in the past.")
+	}
+	if claims.AuthTime.IsZero() {
+		claims.AuthTime = now.Truncate(time.Second)
+	}
+	if claims.Issuer == "" {
+		claims.Issuer = config.IDTokenIssuer
+	}
+
+	// The nonce is optional, but when it is given it must be unguessable.
+	if nonce := form.Get("nonce"); len(nonce) > 0 {
+		if len(nonce) < config.GetMinParameterEntropy() {
+			return "", fosite.ErrInsufficientEntropy.WithHintf("Parameter 'nonce' is set but does not satisfy the minimum entropy of %d characters.", config.GetMinParameterEntropy())
+		}
+		claims.Nonce = nonce
+	}
+
+	audience := make([]string, 0, len(claims.Audience)+1)
+	seen := map[string]bool{}
+	for _, aud := range append(claims.Audience, requester.GetClient().GetID()) {
+		if !seen[aud] {
+			seen[aud] = true
+			audience = append(audience, aud)
+		}
+	}
+	claims.Audience = audience
+	claims.IssuedAt = now
+
+	token, err := jwtStrategy.Generate(claims.ToMap(), session.IDTokenHeaders().ToMap())
+	if err != nil {
+		return "", fosite.ErrServerError.WithWrap(err).WithDebug(err.Error())
+	}
+	return token, nil
+}
+
+// validateIDTokenAuthorizeParams checks the ID token claims against the max_age, prompt, acr_values and
+// id_token_hint parameters of the authorization request, like openid.DefaultStrategy does.
+func validateIDTokenAuthorizeParams(form url.Values, claims *jwt.IDTokenClaims, jwtStrategy *signerJWTStrategy) error {
+	// Allow for a bit of clock skew.
+	if claims.AuthTime.After(time.Now().UTC().Add(5 * time.Second)) {
+		return fosite.ErrServerError.WithDebug("Failed to validate OpenID Connect request because authentication time is in the future.")
+	}
+
+	if maxAge, _ := strconv.ParseInt(form.Get("max_age"), 10, 64); maxAge > 0 {
+		switch {
+		case claims.AuthTime.IsZero():
+			return fosite.ErrServerError.WithDebug("Failed to generate id token because authentication time claim is required when max_age is set.")
+		case claims.RequestedAt.IsZero():
+			return fosite.ErrServerError.WithDebug("Failed to generate id token because requested at claim is required when max_age is set.")
+		case claims.AuthTime.Add(time.Duration(maxAge) * time.Second).Before(claims.RequestedAt):
+			return fosite.ErrServerError.WithDebug("Failed to generate id token because authentication time does not satisfy max_age time.")
+		}
+	}
+
+	prompt := form.Get("prompt")
+	if prompt != "" && claims.AuthTime.IsZero() {
+		return fosite.ErrServerError.WithDebug("Unable to determine validity of prompt parameter because auth_time is missing in id token claims.")
+	}
+	switch prompt {
+	case "none":
+		if claims.AuthTime.After(claims.RequestedAt) {
+			return fosite.ErrServerError.WithDebugf("Failed to generate id token because prompt was set to 'none' but auth_time ('%s') happened after the authorization request ('%s') was registered, indicating that the user was logged in during this request which is not allowed.", claims.AuthTime, claims.RequestedAt)
+		}
+	case "login":
+		if claims.AuthTime.Before(claims.RequestedAt) {
+			return fosite.ErrServerError.WithDebugf("Failed to generate id token because prompt was set to 'login' but auth_time ('%s') happened before the authorization request ('%s') was registered, indicating that the user was not re-authenticated which is forbidden.", claims.AuthTime, claims.RequestedAt)
+		}
+	}
+
+	// When acr_values was requested but no acr was set, fall back to level 0, which means the least confidence in
+	// the authentication.
+	if form.Get("acr_values") != "" && claims.AuthenticationContextClassReference == "" {
+		claims.AuthenticationContextClassReference = "0"
+	}
+
+	// Expired ID tokens are allowed as hints, and Decode does not check the expiry.
+	if tokenHint := form.Get("id_token_hint"); tokenHint != "" {
+		hintClaims, err := jwtStrategy.Decode(tokenHint)
+		if err != nil {
+			return fosite.ErrServerError.WithWrap(err).WithDebugf("Unable to decode id token from 'id_token_hint' parameter because %s.", err.Error())
+		}
+		hintSubject, _ := hintClaims["sub"].(string)
+		if hintSubject == "" {
+			return fosite.ErrServerError.WithDebug("Provided id token from 'id_token_hint' does not have a subject.")
+		}
+		if hintSubject != claims.Subject {
+			return fosite.ErrServerError.WithDebug("Subject from authorization mismatches id token subject from 'id_token_hint'.")
+		}
+	}
+
+	return nil
 }
@@ -5,6 +5,7 @@ package oidc
 
 import (
 	"context"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -12,6 +13,7 @@ import (
 	"errors"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/compose"
@@ -22,6 +24,8 @@ import (
 
 	"go.pinniped.dev/internal/oidc/jwks"
 	"go.pinniped.dev/internal/oidc/oidctestutil"
+	"go.pinniped.dev/internal/signer/plugin"
+	"go.pinniped.dev/internal/testutil/fakekms"
 )
 
 func TestDynamicOpenIDConnectECDSAStrategy(t *testing.T) {
@@ -39,6 +43,13 @@ func TestDynamicOpenIDConnectECDSAStrategy(t *testing.T) {
 	rsaPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	require.NoError(t, err)
 
+	p384PrivateKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+
+	kmsSocket := fakekms.New(map[string]crypto.Signer{"some-key": ecPrivateKey}).Start(t)
+	pluginSigner, err := plugin.NewSigner(context.Background(), kmsSocket, "some-key")
+	require.NoError(t, err)
+
 	tests := []struct {
 		name           string
 		issuer         string
@@ -64,6 +75,23 @@ func TestDynamicOpenIDConnectECDSAStrategy(t *testing.T) {
 				Key: ecPrivateKey,
 			},
 		},
+		{
+			name:   "jwks provider contains a signer held by a signing plugin for issuer",
+			issuer: goodIssuer,
+			jwksProvider: func(provider jwks.DynamicJWKSProvider) {
+				provider.SetIssuerToJWKSMap(
+					nil,
+					map[string]*jose.JSONWebKey{
+						goodIssuer: {
+							Key: pluginSigner,
+						},
+					},
+				)
+			},
+			wantSigningJWK: &jose.JSONWebKey{
+				Key: ecPrivateKey,
+			},
+		},
 		{
 			name:           "jwks provider does not contain signing key for issuer",
 			issuer:         goodIssuer,
@@ -86,6 +114,22 @@ func TestDynamicOpenIDConnectECDSAStrategy(t *testing.T) {
 			wantErrorType:  fosite.ErrServerError,
 			wantErrorCause: "JWK must be of type ecdsa",
 		},
+		{
+			name:   "jwks provider contains signing key with wrong curve for issuer",
+			issuer: goodIssuer,
+			jwksProvider: func(provider jwks.DynamicJWKSProvider) {
+				provider.SetIssuerToJWKSMap(
+					nil,
+					map[string]*jose.JSONWebKey{
+						goodIssuer: {
+							Key: p384PrivateKey,
+						},
+					},
+				)
+			},
+			wantErrorType:  fosite.ErrServerError,
+			wantErrorCause: "JWK must be of type ecdsa",
+		},
 	}
 	for _, test := range tests {
 		test := test
@@ -134,3 +178,122 @@ func TestDynamicOpenIDConnectECDSAStrategy(t *testing.T) {
 		})
 	}
 }
+
+func TestGenerateIDToken(t *testing.T) {
+	const (
+		issuer   = "https://some-issuer.com"
+		clientID = "some-client-id"
+		subject  = "some-subject"
+	)
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	strategy := newSignerJWTStrategy(privateKey, &privateKey.PublicKey)
+
+	requestedAt := time.Now().UTC().Add(-time.Minute).Truncate(time.Second)
+	hint := func(sub string) string {
+		token, err := strategy.Generate(map[string]interface{}{"sub": sub, "exp": float64(time.Now().Add(-time.Hour).Unix())}, nil)
+		require.NoError(t, err)
+		return token
+	}
+
+	tests := []struct {
+		name      string
+		claims    jwt.IDTokenClaims
+		form      url.Values
+		wantErr   *fosite.RFC6749Error
+		wantDebug string
+		wantToken func(t *testing.T, claims map[string]interface{})
+	}{
+		{
+			name:   "the claims are completed",
+			claims: jwt.IDTokenClaims{Subject: subject, Audience: []string{clientID, "other", clientID}},
+			form:   url.Values{"nonce": {"some-nonce-value-with-enough-bytes-to-exceed-min-allowed"}, "acr_values": {"1"}},
+			wantToken: func(t *testing.T, claims map[string]interface{}) {
+				require.Equal(t, issuer, claims["iss"])
+				require.Equal(t, []interface{}{clientID, "other"}, claims["aud"])
+				require.Equal(t, "some-nonce-value-with-enough-bytes-to-exceed-min-allowed", claims["nonce"])
+				require.Equal(t, "0", claims["acr"])
+				require.InDelta(t, float64(time.Now().Add(time.Hour).Unix()), claims["exp"], 5)
+				require.NotZero(t, claims["auth_time"])
+			},
+		},
+		{
+			name:      "subject is missing",
+			claims:    jwt.IDTokenClaims{},
+			wantErr:   fosite.ErrServerError,
+			wantDebug: "Failed to generate id token because subject is an empty string.",
+		},
+		{
+			name:    "nonce is too short",
+			claims:  jwt.IDTokenClaims{Subject: subject},
+			form:    url.Values{"nonce": {"short"}},
+			wantErr: fosite.ErrInsufficientEntropy,
+		},
+		{
+			name:      "authentication is older than max_age",
+			claims:    jwt.IDTokenClaims{Subject: subject, AuthTime: requestedAt.Add(-time.Hour), RequestedAt: requestedAt},
+			form:      url.Values{"max_age": {"60"}},
+			wantErr:   fosite.ErrServerError,
+			wantDebug: "Failed to generate id token because authentication time does not satisfy max_age time.",
+		},
+		{
+			name:    "user was not authenticated again after prompt=login",
+			claims:  jwt.IDTokenClaims{Subject: subject, AuthTime: requestedAt.Add(-time.Hour), RequestedAt: requestedAt},
+			form:    url.Values{"prompt": {"login"}},
+			wantErr: fosite.ErrServerError,
+		},
+		{
+			name:   "the checks of the authorization request are skipped during refresh",
+			claims: jwt.IDTokenClaims{Subject: subject, AuthTime: requestedAt.Add(-time.Hour), RequestedAt: requestedAt},
+			form:   url.Values{"grant_type": {"refresh_token"}, "prompt": {"login"}},
+			wantToken: func(t *testing.T, claims map[string]interface{}) {
+				require.Equal(t, subject, claims["sub"])
+			},
+		},
+		{
+			name:   "an expired id_token_hint for the same subject is allowed",
+			claims: jwt.IDTokenClaims{Subject: subject},
+			form:   url.Values{"id_token_hint": {hint(subject)}},
+			wantToken: func(t *testing.T, claims map[string]interface{}) {
+				require.Equal(t, subject, claims["sub"])
+			},
+		},
+		{
+			name:      "id_token_hint is for another subject",
+			claims:    jwt.IDTokenClaims{Subject: subject},
+			form:      url.Values{"id_token_hint": {hint("other-subject")}},
+			wantErr:   fosite.ErrServerError,
+			wantDebug: "Subject from authorization mismatches id token subject from 'id_token_hint'.",
+		},
+		{
+			name:    "id_token_hint was not issued by this issuer",
+			claims:  jwt.IDTokenClaims{Subject: subject},
+			form:    url.Values{"id_token_hint": {"not-a-jwt"}},
+			wantErr: fosite.ErrServerError,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			claims := test.claims
+			requester := &fosite.Request{
+				Client:  &fosite.DefaultClient{ID: clientID},
+				Session: &openid.DefaultSession{Claims: &claims},
+				Form:    test.form,
+			}
+			idToken, err := generateIDToken(requester, strategy, &compose.Config{IDTokenIssuer: issuer})
+			if test.wantErr != nil {
+				require.True(t, errors.Is(err, test.wantErr), "wanted %v, got %v", test.wantErr, err)
+				if test.wantDebug != "" {
+					require.Equal(t, test.wantDebug, err.(*fosite.RFC6749Error).DebugField)
+				}
+				return
+			}
+			require.NoError(t, err)
+			tokenClaims, err := strategy.Decode(idToken)
+			require.NoError(t, err)
+			test.wantToken(t, tokenClaims)
+		})
+	}
+}
@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package dynamiccodec provides a type that can encode information using a just-in-time signing and
@@ -6,6 +6,7 @@
 package dynamiccodec
 
 import (
+	"sync"
 	"time"
 
 	"github.com/gorilla/securecookie"
@@ -15,44 +16,85 @@ import (
 
 var _ oidc.Codec = &Codec{}
 
-// KeyFunc returns a single key: a symmetric key.
-type KeyFunc func() []byte
+// KeyRingFunc returns a ring of symmetric keys, newest first. The newest key is used to encode, and all of the keys
+// are accepted when decoding, so that values which were encoded before a key rotation can still be decoded.
+type KeyRingFunc func() [][]byte
 
-// Codec can dynamically encode and decode information by using a KeyFunc to get its keys
+// Codec can dynamically encode and decode information by using KeyRingFuncs to get its keys
 // just-in-time.
 type Codec struct {
-	lifespan          time.Duration
-	signingKeyFunc    KeyFunc
-	encryptionKeyFunc KeyFunc
+	lifespan              time.Duration
+	signingKeyRingFunc    KeyRingFunc
+	encryptionKeyRingFunc KeyRingFunc
+
+	mu sync.Mutex
+	// codecs holds a securecookie.SecureCookie for each pair of signing and encryption keys which is currently in use,
+	// so that they are not constructed again for every call to Encode or Decode.
+	codecs map[codecKey]*securecookie.SecureCookie
 }
 
-// New creates a new Codec that will use the provided keyFuncs for its key source, and
+type codecKey struct{ signingKey, encryptionKey string }
+
+// New creates a new Codec that will use the provided KeyRingFuncs for its key source, and
 // use the securecookie.JSONEncoder. The securecookie.JSONEncoder is used because the default
 // securecookie.GobEncoder is less compact and more difficult to make forward compatible.
 //
+// The signing and encryption keys may be rotated independently, so values are decoded by trying every combination
+// of a signing key and an encryption key. An empty encryption key ring means that the values are not encrypted.
+//
 // The returned Codec will make ensure that the encoded values will only be valid for the provided
 // lifespan.
-func New(lifespan time.Duration, signingKeyFunc, encryptionKeyFunc KeyFunc) *Codec {
+func New(lifespan time.Duration, signingKeyRingFunc, encryptionKeyRingFunc KeyRingFunc) *Codec {
 	return &Codec{
-		lifespan:          lifespan,
-		signingKeyFunc:    signingKeyFunc,
-		encryptionKeyFunc: encryptionKeyFunc,
+		lifespan:              lifespan,
+		signingKeyRingFunc:    signingKeyRingFunc,
+		encryptionKeyRingFunc: encryptionKeyRingFunc,
 	}
 }
 
 // Encode implements oidc.Encode().
 func (c *Codec) Encode(name string, value interface{}) (string, error) {
-	return c.delegate().Encode(name, value)
+	return c.delegates()[0].Encode(name, value)
 }
 
 // Decode implements oidc.Decode().
 func (c *Codec) Decode(name string, value string, into interface{}) error {
-	return c.delegate().Decode(name, value, into)
+	return securecookie.DecodeMulti(name, value, into, c.delegates()...)
+}
+
+// delegates returns a codec for each combination of the current keys, starting with the codec of the newest keys.
+func (c *Codec) delegates() []securecookie.Codec {
+	signingKeys := nonEmptyKeyRing(c.signingKeyRingFunc())
+	encryptionKeys := nonEmptyKeyRing(c.encryptionKeyRingFunc())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Only keep the codecs of the current keys, so that the codecs of keys which were rotated out are released.
+	codecs := make(map[codecKey]*securecookie.SecureCookie, len(signingKeys)*len(encryptionKeys))
+	delegates := make([]securecookie.Codec, 0, len(signingKeys)*len(encryptionKeys))
+	for _, signingKey := range signingKeys {
+		for _, encryptionKey := range encryptionKeys {
+			key := codecKey{signingKey: string(signingKey), encryptionKey: string(encryptionKey)}
+			codec, ok := c.codecs[key]
+			if !ok {
+				codec = securecookie.New(signingKey, encryptionKey)
+				codec.MaxAge(int(c.lifespan.Seconds()))
+				codec.SetSerializer(securecookie.JSONEncoder{})
+			}
+			codecs[key] = codec
+			delegates = append(delegates, codec)
+		}
+	}
+	c.codecs = codecs
+
+	return delegates
 }
 
-func (c *Codec) delegate() *securecookie.SecureCookie {
-	codec := securecookie.New(c.signingKeyFunc(), c.encryptionKeyFunc())
-	codec.MaxAge(int(c.lifespan.Seconds()))
-	codec.SetSerializer(securecookie.JSONEncoder{})
-	return codec
+// nonEmptyKeyRing returns the provided key ring, or a key ring which holds a single nil key when it is empty.
+func nonEmptyKeyRing(keys [][]byte) [][]byte {
+	if len(keys) == 0 {
+		return [][]byte{nil}
+	}
+	return keys
 }
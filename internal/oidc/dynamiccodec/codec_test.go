@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package dynamiccodec
@@ -95,8 +95,7 @@ func TestCodec(t *testing.T) {
 				lifespan = time.Hour
 			}
 
-			encoder := New(lifespan, func() []byte { return encoderSigningKey },
-				func() []byte { return encoderEncryptionKey })
+			encoder := New(lifespan, keyRing(encoderSigningKey), keyRing(encoderEncryptionKey))
 
 			encoded, err := encoder.Encode("some-name", "some-message")
 			if test.wantEncoderErrorPrefix != "" {
@@ -109,8 +108,7 @@ func TestCodec(t *testing.T) {
 				time.Sleep(test.lifespan + time.Second)
 			}
 
-			decoder := New(lifespan, func() []byte { return decoderSigningKey },
-				func() []byte { return decoderEncryptionKey })
+			decoder := New(lifespan, keyRing(decoderSigningKey), keyRing(decoderEncryptionKey))
 
 			var decoded string
 			err = decoder.Decode("some-name", encoded, &decoded)
@@ -125,3 +123,68 @@ func TestCodec(t *testing.T) {
 		})
 	}
 }
+
+func TestCodecKeyRotation(t *testing.T) {
+	var (
+		oldSigningKey    = []byte("some-old-signing-key")
+		oldEncryptionKey = []byte("16-byte-old--key")
+		newSigningKey    = []byte("some-new-signing-key")
+		newEncryptionKey = []byte("16-byte-new--key")
+	)
+
+	oldCodec := New(time.Hour, keyRing(oldSigningKey), keyRing(oldEncryptionKey))
+	encodedWithOldKeys, err := oldCodec.Encode("some-name", "some-old-message")
+	require.NoError(t, err)
+
+	// Only the signing key has been rotated.
+	signingKeyRotatedCodec := New(time.Hour, keyRing(newSigningKey, oldSigningKey), keyRing(oldEncryptionKey))
+	encodedWithNewSigningKey, err := signingKeyRotatedCodec.Encode("some-name", "some-new-message")
+	require.NoError(t, err)
+
+	// Both keys have been rotated.
+	rotatedCodec := New(time.Hour, keyRing(newSigningKey, oldSigningKey), keyRing(newEncryptionKey, oldEncryptionKey))
+	encodedWithNewKeys, err := rotatedCodec.Encode("some-name", "some-new-message")
+	require.NoError(t, err)
+
+	for _, encoded := range []string{encodedWithOldKeys, encodedWithNewSigningKey, encodedWithNewKeys} {
+		var decoded string
+		require.NoError(t, rotatedCodec.Decode("some-name", encoded, &decoded))
+	}
+
+	// Values are encoded with the newest keys.
+	newCodec := New(time.Hour, keyRing(newSigningKey), keyRing(newEncryptionKey))
+	var decoded string
+	require.NoError(t, newCodec.Decode("some-name", encodedWithNewKeys, &decoded))
+	require.Equal(t, "some-new-message", decoded)
+
+	// Once the old keys are dropped from the key ring, the values which were encoded with them cannot be decoded.
+	err = newCodec.Decode("some-name", encodedWithOldKeys, &decoded)
+	require.EqualError(t, err, "securecookie: the value is not valid")
+	err = newCodec.Decode("some-name", encodedWithNewSigningKey, &decoded)
+	require.Error(t, err)
+}
+
+func TestCodecCachesDelegates(t *testing.T) {
+	keys := [][]byte{[]byte("some-signing-key")}
+	codec := New(time.Hour, func() [][]byte { return keys }, keyRing())
+
+	first := codec.delegates()
+	require.Len(t, first, 1)
+	require.Same(t, first[0], codec.delegates()[0])
+
+	// After a rotation, the codec of the previous key is reused and the codec of the new key is added.
+	keys = [][]byte{[]byte("some-new-signing-key"), []byte("some-signing-key")}
+	rotated := codec.delegates()
+	require.Len(t, rotated, 2)
+	require.NotSame(t, first[0], rotated[0])
+	require.Same(t, first[0], rotated[1])
+
+	// Once the previous key is dropped, its codec is released.
+	keys = [][]byte{[]byte("some-new-signing-key")}
+	require.Same(t, rotated[0], codec.delegates()[0])
+	require.Len(t, codec.codecs, 1)
+}
+
+func keyRing(keys ...[]byte) KeyRingFunc {
+	return func() [][]byte { return keys }
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package jwks
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/base64"
+	"fmt"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+type signerJWKSProvider struct {
+	DynamicJWKSProvider
+	issuerToSignerJWK map[string]signerJWK
+}
+
+type signerJWK struct {
+	publicJWK jose.JSONWebKey
+	activeJWK *jose.JSONWebKey
+}
+
+// NewSignerJWKSProvider returns a DynamicJWKSProvider which makes each issuer in issuerToSigner sign with its signer
+// instead of with an active key of provider. The JWKS of such an issuer contains the public key of its signer in
+// addition to the keys which provider may still have for it, so that the tokens which were signed before the signer
+// was configured can still be verified. The other issuers of provider are left alone.
+func NewSignerJWKSProvider(provider DynamicJWKSProvider, issuerToSigner map[string]crypto.Signer) (DynamicJWKSProvider, error) {
+	issuerToSignerJWK := make(map[string]signerJWK, len(issuerToSigner))
+	for issuerName, signer := range issuerToSigner {
+		jwk, err := newSignerJWK(signer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signer for issuer %s: %w", issuerName, err)
+		}
+		issuerToSignerJWK[issuerName] = jwk
+	}
+	return &signerJWKSProvider{
+		DynamicJWKSProvider: provider,
+		issuerToSignerJWK:   issuerToSignerJWK,
+	}, nil
+}
+
+func newSignerJWK(signer crypto.Signer) (signerJWK, error) {
+	// The ID tokens are signed with ES256.
+	publicKey, ok := signer.Public().(*ecdsa.PublicKey)
+	if !ok || publicKey.Curve != elliptic.P256() {
+		return signerJWK{}, fmt.Errorf("signing key must be an ECDSA P-256 key, but it is a %T", signer.Public())
+	}
+	publicJWK := jose.JSONWebKey{
+		Key:       publicKey,
+		Algorithm: string(jose.ES256),
+		Use:       "sig",
+	}
+	thumbprint, err := publicJWK.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return signerJWK{}, fmt.Errorf("could not compute key ID of signing key: %w", err)
+	}
+	publicJWK.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+
+	return signerJWK{
+		publicJWK: publicJWK,
+		activeJWK: &jose.JSONWebKey{
+			Key:       signer,
+			KeyID:     publicJWK.KeyID,
+			Algorithm: publicJWK.Algorithm,
+			Use:       publicJWK.Use,
+		},
+	}, nil
+}
+
+func (p *signerJWKSProvider) GetJWKS(issuerName string) (*jose.JSONWebKeySet, *jose.JSONWebKey) {
+	jwks, activeJWK := p.DynamicJWKSProvider.GetJWKS(issuerName)
+	signer, ok := p.issuerToSignerJWK[issuerName]
+	if !ok {
+		return jwks, activeJWK
+	}
+	// No keys are generated for an issuer with a signer, but it may still have the keys which were generated for it
+	// before its signer was configured.
+	keys := []jose.JSONWebKey{signer.publicJWK}
+	if jwks != nil {
+		keys = append(keys, jwks.Keys...)
+	}
+	return &jose.JSONWebKeySet{Keys: keys}, signer.activeJWK
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package jwks
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestSignerJWKSProvider(t *testing.T) {
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	generatedKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	generatedPublicJWK := jose.JSONWebKey{Key: &generatedKey.PublicKey, KeyID: "generated-key", Algorithm: "ES256", Use: "sig"}
+
+	otherSigner, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	generatedActiveJWK := &jose.JSONWebKey{Key: generatedKey, KeyID: "generated-key"}
+
+	delegate := NewDynamicJWKSProvider()
+	delegate.SetIssuerToJWKSMap(
+		map[string]*jose.JSONWebKeySet{
+			"https://some-issuer.com":      {Keys: []jose.JSONWebKey{generatedPublicJWK}},
+			"https://generated-issuer.com": {Keys: []jose.JSONWebKey{generatedPublicJWK}},
+		},
+		map[string]*jose.JSONWebKey{
+			"https://some-issuer.com":      generatedActiveJWK,
+			"https://generated-issuer.com": generatedActiveJWK,
+		},
+	)
+
+	provider, err := NewSignerJWKSProvider(delegate, map[string]crypto.Signer{
+		"https://some-issuer.com":  signer,
+		"https://other-issuer.com": otherSigner,
+	})
+	require.NoError(t, err)
+
+	thumbprint, err := (&jose.JSONWebKey{Key: &signer.PublicKey}).Thumbprint(crypto.SHA256)
+	require.NoError(t, err)
+	keyID := base64.RawURLEncoding.EncodeToString(thumbprint)
+
+	jwks, activeJWK := provider.GetJWKS("https://some-issuer.com")
+	require.Equal(t, &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &signer.PublicKey, KeyID: keyID, Algorithm: "ES256", Use: "sig"},
+		generatedPublicJWK,
+	}}, jwks)
+	require.Equal(t, &jose.JSONWebKey{Key: signer, KeyID: keyID, Algorithm: "ES256", Use: "sig"}, activeJWK)
+
+	// An issuer with a signer does not need any generated keys.
+	otherThumbprint, err := (&jose.JSONWebKey{Key: &otherSigner.PublicKey}).Thumbprint(crypto.SHA256)
+	require.NoError(t, err)
+	otherKeyID := base64.RawURLEncoding.EncodeToString(otherThumbprint)
+	jwks, activeJWK = provider.GetJWKS("https://other-issuer.com")
+	require.Equal(t, &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &otherSigner.PublicKey, KeyID: otherKeyID, Algorithm: "ES256", Use: "sig"},
+	}}, jwks)
+	require.Equal(t, &jose.JSONWebKey{Key: otherSigner, KeyID: otherKeyID, Algorithm: "ES256", Use: "sig"}, activeJWK)
+
+	// Issuers without a signer still sign with their generated keys.
+	jwks, activeJWK = provider.GetJWKS("https://generated-issuer.com")
+	require.Equal(t, &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{generatedPublicJWK}}, jwks)
+	require.Equal(t, generatedActiveJWK, activeJWK)
+
+	// Issuers without a signer which are not ready yet are still not ready.
+	jwks, activeJWK = provider.GetJWKS("https://not-ready-issuer.com")
+	require.Nil(t, jwks)
+	require.Nil(t, activeJWK)
+
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, err = NewSignerJWKSProvider(delegate, map[string]crypto.Signer{"https://some-issuer.com": ed25519Key})
+	require.EqualError(t, err, "invalid signer for issuer https://some-issuer.com: signing key must be an ECDSA P-256 key, but it is a ed25519.PublicKey")
+
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	_, err = NewSignerJWKSProvider(delegate, map[string]crypto.Signer{"https://some-issuer.com": p384Key})
+	require.EqualError(t, err, "invalid signer for issuer https://some-issuer.com: signing key must be an ECDSA P-256 key, but it is a *ecdsa.PublicKey")
+}
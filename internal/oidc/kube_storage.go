@@ -1,24 +1,29 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package oidc
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/handler/oauth2"
 	"github.com/ory/fosite/handler/openid"
 	fositepkce "github.com/ory/fosite/handler/pkce"
-	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 
 	"go.pinniped.dev/internal/constable"
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/fositestorage"
 	"go.pinniped.dev/internal/fositestorage/accesstoken"
 	"go.pinniped.dev/internal/fositestorage/authorizationcode"
 	"go.pinniped.dev/internal/fositestorage/openidconnect"
 	"go.pinniped.dev/internal/fositestorage/pkce"
+	"go.pinniped.dev/internal/fositestorage/pushedauthorizationrequest"
 	"go.pinniped.dev/internal/fositestorage/refreshtoken"
+	"go.pinniped.dev/internal/plog"
 )
 
 const errKubeStorageNotImplemented = constable.Error("KubeStorage does not implement this method. It should not have been called.")
@@ -29,19 +34,45 @@ type KubeStorage struct {
 	oidcStorage              openid.OpenIDConnectRequestStorage
 	accessTokenStorage       accesstoken.RevocationStorage
 	refreshTokenStorage      refreshtoken.RevocationStorage
+	parStorage               pushedauthorizationrequest.Storage
 }
 
-func NewKubeStorage(secrets corev1client.SecretInterface, timeoutsConfiguration TimeoutsConfiguration) *KubeStorage {
+// NewKubeStorage returns a KubeStorage which stores all sessions in the given Backend. Despite its name, the Backend
+// does not have to keep the sessions in Kubernetes.
+func NewKubeStorage(backend crud.Backend, timeoutsConfiguration TimeoutsConfiguration) *KubeStorage {
 	nowFunc := time.Now
 	return &KubeStorage{
-		authorizationCodeStorage: authorizationcode.New(secrets, nowFunc, timeoutsConfiguration.AuthorizationCodeSessionStorageLifetime),
-		pkceStorage:              pkce.New(secrets, nowFunc, timeoutsConfiguration.PKCESessionStorageLifetime),
-		oidcStorage:              openidconnect.New(secrets, nowFunc, timeoutsConfiguration.OIDCSessionStorageLifetime),
-		accessTokenStorage:       accesstoken.New(secrets, nowFunc, timeoutsConfiguration.AccessTokenSessionStorageLifetime),
-		refreshTokenStorage:      refreshtoken.New(secrets, nowFunc, timeoutsConfiguration.RefreshTokenSessionStorageLifetime),
+		authorizationCodeStorage: authorizationcode.New(backend, nowFunc, timeoutsConfiguration.AuthorizationCodeSessionStorageLifetime),
+		pkceStorage:              pkce.New(backend, nowFunc, timeoutsConfiguration.PKCESessionStorageLifetime),
+		oidcStorage:              openidconnect.New(backend, nowFunc, timeoutsConfiguration.OIDCSessionStorageLifetime),
+		accessTokenStorage:       accesstoken.New(backend, nowFunc, timeoutsConfiguration.AccessTokenSessionStorageLifetime),
+		refreshTokenStorage:      refreshtoken.New(backend, nowFunc, timeoutsConfiguration.RefreshTokenSessionStorageLifetime),
+		parStorage:               pushedauthorizationrequest.New(backend, nowFunc, timeoutsConfiguration.PushedAuthorizationRequestSessionStorageLifetime),
 	}
 }
 
+// MigrateStoredSessions rewrites all of the sessions in backend which were stored in an older storage version in the
+// current storage version, and returns how many sessions were rewritten.
+func MigrateStoredSessions(ctx context.Context, backend crud.Backend) (int, error) {
+	migrated := 0
+	var errs []error
+	for _, migrations := range []*fositestorage.Migrations{
+		authorizationcode.Migrations(),
+		pkce.Migrations(),
+		openidconnect.Migrations(),
+		accesstoken.Migrations(),
+		refreshtoken.Migrations(),
+	} {
+		// The lifetime does not matter, because rewriting a session does not change its lifetime.
+		n, err := migrations.Rewrite(ctx, backend.Storage(migrations.Resource(), time.Now, 0))
+		migrated += n
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return migrated, utilerrors.NewAggregate(errs)
+}
+
 //
 // Authorization Code sessions:
 //
@@ -160,13 +191,22 @@ func (k KubeStorage) RevokeAccessToken(ctx context.Context, requestID string) er
 // that was previously handed out for that authcode. If a user stops coming back to refresh their tokens, then that
 // refresh token will never be deleted.
 //
+// Revoked refresh tokens are kept in storage until they are garbage collected. If a revoked refresh token is used
+// again, then either it was stolen and replayed or it was used by concurrent requests. Either way, we revoke every
+// access and refresh token of the whole token family, so a stolen token cannot be used to keep a session alive.
+//
 
 func (k KubeStorage) CreateRefreshTokenSession(ctx context.Context, signatureOfRefreshToken string, request fosite.Requester) (err error) {
 	return k.refreshTokenStorage.CreateRefreshTokenSession(ctx, signatureOfRefreshToken, request)
 }
 
 func (k KubeStorage) GetRefreshTokenSession(ctx context.Context, signatureOfRefreshToken string, session fosite.Session) (request fosite.Requester, err error) {
-	return k.refreshTokenStorage.GetRefreshTokenSession(ctx, signatureOfRefreshToken, session)
+	request, err = k.refreshTokenStorage.GetRefreshTokenSession(ctx, signatureOfRefreshToken, session)
+	if errors.Is(err, refreshtoken.ErrRefreshTokenReplayed) {
+		k.revokeTokenFamily(ctx, request)
+		return nil, err
+	}
+	return request, err
 }
 
 func (k KubeStorage) DeleteRefreshTokenSession(ctx context.Context, signatureOfRefreshToken string) (err error) {
@@ -177,6 +217,64 @@ func (k KubeStorage) RevokeRefreshToken(ctx context.Context, requestID string) e
 	return k.refreshTokenStorage.RevokeRefreshToken(ctx, requestID)
 }
 
+// BeginTX is called by fosite before it rotates the tokens of a refresh or an authcode redemption. The Backend does
+// not support transactions, so this only marks the context, so that the refresh token which is being rotated is
+// confirmed by a write at the resource version which was read. See refreshtoken.WithRotation.
+func (KubeStorage) BeginTX(ctx context.Context) (context.Context, error) {
+	return refreshtoken.WithRotation(ctx), nil
+}
+
+// Commit has nothing to do, because BeginTX did not begin a transaction.
+func (KubeStorage) Commit(_ context.Context) error {
+	return nil
+}
+
+// Rollback has nothing to do, because BeginTX did not begin a transaction. Tokens which were already revoked stay
+// revoked.
+func (KubeStorage) Rollback(_ context.Context) error {
+	return nil
+}
+
+func (k KubeStorage) revokeTokenFamily(ctx context.Context, request fosite.Requester) {
+	requestID := request.GetID()
+	plog.Warning("refresh token replay detected, revoking all tokens of the authorization",
+		"auditEvent", "RefreshTokenReplayDetected",
+		"requestID", requestID,
+		"clientID", request.GetClient().GetID(),
+		"subject", request.GetSession().GetSubject(),
+		"username", request.GetSession().GetUsername(),
+	)
+	// Some or all of the tokens may have already been revoked, so failing to find any of them is not an error.
+	if err := k.accessTokenStorage.RevokeAccessToken(ctx, requestID); err != nil {
+		plog.Debug("did not revoke access tokens of replayed refresh token", "requestID", requestID, "err", err)
+	}
+	if err := k.refreshTokenStorage.RevokeRefreshToken(ctx, requestID); err != nil {
+		plog.Debug("did not revoke refresh tokens of replayed refresh token", "requestID", requestID, "err", err)
+	}
+}
+
+//
+// Pushed authorization requests:
+//
+// These are keyed by the reference in the request_uri which was returned for them.
+//
+// Fosite does not know about these. They are created by the pushed authorization request endpoint, and the authorize
+// endpoint deletes them when it uses them, so that each request_uri can only be used once. If the client never uses
+// the request_uri, then they will never be deleted.
+//
+
+func (k KubeStorage) CreatePushedAuthorizationRequest(ctx context.Context, reference string, request *pushedauthorizationrequest.Request) error {
+	return k.parStorage.CreatePushedAuthorizationRequest(ctx, reference, request)
+}
+
+func (k KubeStorage) GetPushedAuthorizationRequest(ctx context.Context, reference string) (*pushedauthorizationrequest.Request, error) {
+	return k.parStorage.GetPushedAuthorizationRequest(ctx, reference)
+}
+
+func (k KubeStorage) DeletePushedAuthorizationRequest(ctx context.Context, reference string) error {
+	return k.parStorage.DeletePushedAuthorizationRequest(ctx, reference)
+}
+
 //
 // OAuth client definitions:
 //
@@ -0,0 +1,163 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package oidc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeinformers "k8s.io/client-go/informers"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	coretesting "k8s.io/client-go/testing"
+
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/fositestorage/accesstoken"
+	"go.pinniped.dev/internal/fositestorage/refreshtoken"
+	"go.pinniped.dev/internal/psession"
+	"go.pinniped.dev/internal/testutil"
+)
+
+func TestKubeStorageCachedTokensWithConcurrentReplicas(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const namespace = "some-namespace"
+	secretsGVR := corev1.SchemeGroupVersion.WithResource("secrets")
+
+	client := testutil.NewFakeClientsetWithSecretResourceVersions(namespace)
+
+	// Each replica reads the tokens from its own informer, like the Supervisor does when its read cache is enabled.
+	// The informer of a replica stops watching when stop is closed, after which its cache stays out of date.
+	newReplica := func(stop <-chan struct{}) (*KubeStorage, corev1listers.SecretNamespaceLister) {
+		informers := kubeinformers.NewSharedInformerFactoryWithOptions(client, 0,
+			kubeinformers.WithNamespace(namespace),
+			kubeinformers.WithTweakListOptions(func(opts *metav1.ListOptions) { opts.LabelSelector = crud.SecretLabelKey }),
+		)
+		lister := informers.Core().V1().Secrets().Lister().Secrets(namespace)
+		informers.Start(stop)
+		informers.WaitForCacheSync(stop)
+		secrets := crud.NewCachedSecretInterface(client.CoreV1().Secrets(namespace), lister, []string{
+			accesstoken.TypeLabelValue,
+			refreshtoken.TypeLabelValue,
+		})
+		return NewKubeStorage(crud.NewSecretsBackend(secrets), DefaultOIDCTimeoutsConfiguration()), lister
+	}
+	newStaleReplica := func() (*KubeStorage, corev1listers.SecretNamespaceLister) {
+		staleCtx, stopStaleInformer := context.WithCancel(ctx)
+		defer stopStaleInformer()
+		return newReplica(staleCtx.Done())
+	}
+	requireEventuallyCached := func(lister corev1listers.SecretNamespaceLister, name string) {
+		require.Eventually(t, func() bool {
+			_, err := lister.Get(name)
+			return err == nil
+		}, 10*time.Second, 10*time.Millisecond)
+	}
+	lastCreatedName := func() string {
+		actions := client.Actions()
+		for i := len(actions) - 1; i >= 0; i-- {
+			if create, ok := actions[i].(coretesting.CreateAction); ok {
+				return create.GetObject().(*corev1.Secret).Name
+			}
+		}
+		t.Fatal("no secret was created")
+		return ""
+	}
+	newRequest := func(id string) *fosite.Request {
+		return &fosite.Request{
+			ID: id,
+			Client: &fosite.DefaultOpenIDConnectClient{
+				DefaultClient: &fosite.DefaultClient{ID: "pinniped-cli", Public: true},
+			},
+			Session: &psession.PinnipedSession{
+				Fosite: &openid.DefaultSession{Username: "snorlax", Subject: "panda"},
+				Custom: &psession.CustomSessionData{ProviderName: "fake-upstream-idp"},
+			},
+		}
+	}
+
+	replica1, lister1 := newReplica(ctx.Done())
+
+	t.Run("tokens which were just created by one replica can be read by another replica before its informer observes them", func(t *testing.T) {
+		// The informer of this replica never observes any new tokens.
+		replica2, _ := newStaleReplica()
+		client.ClearActions()
+
+		require.NoError(t, replica1.CreateAccessTokenSession(ctx, "new-access-token", newRequest("new-request")))
+		accessTokenName := lastCreatedName()
+		require.NoError(t, replica1.CreateRefreshTokenSession(ctx, "new-refresh-token", newRequest("new-request")))
+		refreshTokenName := lastCreatedName()
+
+		accessTokenRequest, err := replica2.GetAccessTokenSession(ctx, "new-access-token", nil)
+		require.NoError(t, err)
+		require.Equal(t, "new-request", accessTokenRequest.GetID())
+		refreshTokenRequest, err := replica2.GetRefreshTokenSession(ctx, "new-refresh-token", nil)
+		require.NoError(t, err)
+		require.Equal(t, "new-request", refreshTokenRequest.GetID())
+
+		// Both cache misses were read from the API server.
+		actions := client.Actions()
+		require.Len(t, actions, 4)
+		require.Equal(t, coretesting.NewGetAction(secretsGVR, namespace, accessTokenName), actions[2])
+		require.Equal(t, coretesting.NewGetAction(secretsGVR, namespace, refreshTokenName), actions[3])
+	})
+
+	t.Run("a replica whose cache is stale cannot rotate a refresh token which was already rotated", func(t *testing.T) {
+		require.NoError(t, replica1.CreateRefreshTokenSession(ctx, "first-refresh-token", newRequest("rotated-request")))
+
+		// The informer of the other replica observes the refresh token, and then falls behind.
+		replica2, _ := newStaleReplica()
+
+		// The first replica rotates the refresh token, like fosite does during a refresh.
+		rotationCtx, err := replica1.BeginTX(ctx)
+		require.NoError(t, err)
+		_, err = replica1.GetRefreshTokenSession(rotationCtx, "first-refresh-token", nil)
+		require.NoError(t, err)
+		require.NoError(t, replica1.RevokeRefreshToken(rotationCtx, "rotated-request"))
+		require.NoError(t, replica1.CreateRefreshTokenSession(rotationCtx, "second-refresh-token", newRequest("rotated-request")))
+		secondRefreshTokenName := lastCreatedName()
+		require.NoError(t, replica1.Commit(rotationCtx))
+
+		// The other replica still reads the first refresh token from its cache as if it was not revoked.
+		_, err = replica2.GetRefreshTokenSession(ctx, "first-refresh-token", nil)
+		require.NoError(t, err)
+
+		// But it cannot rotate it, so it cannot revoke the second refresh token.
+		rotationCtx, err = replica2.BeginTX(ctx)
+		require.NoError(t, err)
+		_, err = replica2.GetRefreshTokenSession(rotationCtx, "first-refresh-token", nil)
+		require.Error(t, err)
+		require.True(t, errors.Is(err, fosite.ErrSerializationFailure), "expected a serialization failure, got %v", err)
+		require.NoError(t, replica2.Rollback(rotationCtx))
+
+		_, err = replica1.GetRefreshTokenSession(ctx, "second-refresh-token", nil)
+		require.NoError(t, err)
+
+		// Once the informer of the first replica has observed the second refresh token, and so also the revocation of
+		// the first one, it detects the replay of the first refresh token.
+		requireEventuallyCached(lister1, secondRefreshTokenName)
+		_, err = replica1.GetRefreshTokenSession(ctx, "first-refresh-token", nil)
+		require.True(t, errors.Is(err, refreshtoken.ErrRefreshTokenReplayed), "expected a replay error, got %v", err)
+	})
+
+	t.Run("an access token which was revoked by one replica is rejected by the other replicas once their informers observe it", func(t *testing.T) {
+		replica2, lister2 := newReplica(ctx.Done())
+		require.NoError(t, replica1.CreateAccessTokenSession(ctx, "revoked-access-token", newRequest("revoked-request")))
+		requireEventuallyCached(lister2, lastCreatedName())
+		_, err := replica2.GetAccessTokenSession(ctx, "revoked-access-token", nil)
+		require.NoError(t, err)
+
+		require.NoError(t, replica1.RevokeAccessToken(ctx, "revoked-request"))
+		require.Eventually(t, func() bool {
+			_, err := replica2.GetAccessTokenSession(ctx, "revoked-access-token", nil)
+			return errors.Is(err, fosite.ErrNotFound)
+		}, 10*time.Second, 10*time.Millisecond)
+	})
+}
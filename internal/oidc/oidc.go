@@ -1,10 +1,11 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package oidc contains common OIDC functionality needed by Pinniped.
 package oidc
 
 import (
+	"fmt"
 	"time"
 
 	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
@@ -24,6 +25,8 @@ const (
 	TokenEndpointPath         = "/oauth2/token" //nolint:gosec // ignore lint warning that this is a credential
 	CallbackEndpointPath      = "/callback"
 	JWKSEndpointPath          = "/jwks.json"
+
+	PushedAuthorizationRequestEndpointPath = "/oauth2/par"
 )
 
 const (
@@ -60,6 +63,10 @@ const (
 	// information.
 	DownstreamGroupsClaim = "groups"
 
+	// PushedAuthorizationRequestURIPrefix is the prefix of the request_uri values which are returned by the pushed
+	// authorization request endpoint, as defined by https://datatracker.ietf.org/doc/html/rfc9126#section-2.2.
+	PushedAuthorizationRequestURIPrefix = "urn:ietf:params:oauth:request_uri:"
+
 	// CSRFCookieLifespan is the length of time that the CSRF cookie is valid. After this time, the
 	// Supervisor's authorization endpoint should give the browser a new CSRF cookie. We set it to
 	// a week so that it is unlikely to expire during a login.
@@ -120,6 +127,11 @@ type TimeoutsConfiguration struct {
 	// the browser is sitting at the upstream IDP's login page.
 	UpstreamStateParamLifespan time.Duration
 
+	// How long a request_uri issued by the pushed authorization request endpoint is valid. The client is expected to
+	// send the end user's browser to the authorize endpoint right after pushing its authorization request, so this
+	// can be short.
+	PushedAuthorizationRequestLifespan time.Duration
+
 	// How long an authcode issued by the callback endpoint is valid. This determines how much time the end user
 	// has to come back to exchange the authcode for tokens at the token endpoint.
 	AuthorizeCodeLifespan time.Duration
@@ -148,6 +160,12 @@ type TimeoutsConfiguration struct {
 	// the sum of the AuthorizeCodeLifespan and the RefreshTokenLifespan.
 	AuthorizationCodeSessionStorageLifetime time.Duration
 
+	// PushedAuthorizationRequestSessionStorageLifetime is the length of time after which a pushed authorization request
+	// is allowed to be garbage collected from storage. Pushed authorization requests are deleted when they are used by
+	// the authorize endpoint, but requests which are never used are not explicitly deleted. They are not needed after
+	// they have expired, so this can be just slightly longer than the PushedAuthorizationRequestLifespan.
+	PushedAuthorizationRequestSessionStorageLifetime time.Duration
+
 	// PKCESessionStorageLifetime is the length of time after which PKCE data is allowed to be garbage collected from
 	// storage. PKCE sessions are closely related to authorization code sessions. After the authcode is successfully
 	// redeemed, the PKCE session is explicitly deleted. After the authcode expires, the PKCE session is no longer needed,
@@ -189,18 +207,21 @@ func DefaultOIDCTimeoutsConfiguration() TimeoutsConfiguration {
 	accessTokenLifespan := 15 * time.Minute
 	authorizationCodeLifespan := 10 * time.Minute
 	refreshTokenLifespan := 9 * time.Hour
+	pushedAuthorizationRequestLifespan := 5 * time.Minute
 
 	return TimeoutsConfiguration{
-		UpstreamStateParamLifespan:              90 * time.Minute,
-		AuthorizeCodeLifespan:                   authorizationCodeLifespan,
-		AccessTokenLifespan:                     accessTokenLifespan,
-		IDTokenLifespan:                         accessTokenLifespan,
-		RefreshTokenLifespan:                    refreshTokenLifespan,
-		AuthorizationCodeSessionStorageLifetime: authorizationCodeLifespan + refreshTokenLifespan,
-		PKCESessionStorageLifetime:              authorizationCodeLifespan + (1 * time.Minute),
-		OIDCSessionStorageLifetime:              authorizationCodeLifespan + (1 * time.Minute),
-		AccessTokenSessionStorageLifetime:       accessTokenLifespan + (1 * time.Minute),
-		RefreshTokenSessionStorageLifetime:      refreshTokenLifespan + accessTokenLifespan,
+		UpstreamStateParamLifespan:                       90 * time.Minute,
+		PushedAuthorizationRequestLifespan:               pushedAuthorizationRequestLifespan,
+		AuthorizeCodeLifespan:                            authorizationCodeLifespan,
+		AccessTokenLifespan:                              accessTokenLifespan,
+		IDTokenLifespan:                                  accessTokenLifespan,
+		RefreshTokenLifespan:                             refreshTokenLifespan,
+		AuthorizationCodeSessionStorageLifetime:          authorizationCodeLifespan + refreshTokenLifespan,
+		PushedAuthorizationRequestSessionStorageLifetime: pushedAuthorizationRequestLifespan + (1 * time.Minute),
+		PKCESessionStorageLifetime:                       authorizationCodeLifespan + (1 * time.Minute),
+		OIDCSessionStorageLifetime:                       authorizationCodeLifespan + (1 * time.Minute),
+		AccessTokenSessionStorageLifetime:                accessTokenLifespan + (1 * time.Minute),
+		RefreshTokenSessionStorageLifetime:               refreshTokenLifespan + accessTokenLifespan,
 	}
 }
 
@@ -210,6 +231,9 @@ func FositeOauth2Helper(
 	hmacSecretOfLengthAtLeast32Func func() []byte,
 	jwksProvider jwks.DynamicJWKSProvider,
 	timeoutsConfiguration TimeoutsConfiguration,
+	tokenExchangeAudiences provider.TokenExchangeAudiences,
+	trustedJWTIssuers []*provider.TrustedJWTIssuer,
+	clients []*provider.Client,
 ) fosite.OAuth2Provider {
 	oauthConfig := &compose.Config{
 		IDTokenIssuer: issuer,
@@ -235,13 +259,17 @@ func FositeOauth2Helper(
 		MinParameterEntropy: fosite.MinParameterEntropy,
 	}
 
-	return compose.Compose(
+	oauth2Provider := compose.Compose(
 		oauthConfig,
 		oauthStore,
 		&compose.CommonStrategy{
 			// Note that Fosite requires the HMAC secret to be at least 32 bytes.
-			CoreStrategy:               newDynamicOauth2HMACStrategy(oauthConfig, hmacSecretOfLengthAtLeast32Func),
-			OpenIDConnectTokenStrategy: newDynamicOpenIDConnectECDSAStrategy(oauthConfig, jwksProvider),
+			CoreStrategy: newDynamicOauth2HMACStrategy(oauthConfig, hmacSecretOfLengthAtLeast32Func),
+			OpenIDConnectTokenStrategy: newPairwiseSubjectStrategy(
+				newDynamicOpenIDConnectECDSAStrategy(oauthConfig, jwksProvider),
+				hmacSecretOfLengthAtLeast32Func,
+				clients,
+			),
 		},
 		nil, // hasher, defaults to using BCrypt when nil. Used for hashing client secrets.
 		compose.OAuth2AuthorizeExplicitFactory,
@@ -249,19 +277,26 @@ func FositeOauth2Helper(
 		compose.OpenIDConnectExplicitFactory,
 		compose.OpenIDConnectRefreshFactory,
 		compose.OAuth2PKCEFactory,
-		TokenExchangeFactory,
-	)
+		TokenExchangeFactory(tokenExchangeAudiences, trustedJWTIssuers),
+		ClientCredentialsFactory(clients),
+	).(*fosite.Fosite)
+
+	// Fosite looks up clients in its Store, so make it aware of the confidential clients of this FederationDomain.
+	oauth2Provider.Store = newClientManager(oauth2Provider.Store, clients)
+
+	return oauth2Provider
 }
 
 // FositeErrorForLog generates a list of information about the provided Fosite error that can be
 // passed to a plog function (e.g., plog.Info()).
 //
 // Sample usage:
-//   err := someFositeLibraryFunction()
-//   if err != nil {
-//     	plog.Info("some error", FositeErrorForLog(err)...)
-//      ...
-//    }
+//
+//	err := someFositeLibraryFunction()
+//	if err != nil {
+//	  	plog.Info("some error", FositeErrorForLog(err)...)
+//	   ...
+//	 }
 func FositeErrorForLog(err error) []interface{} {
 	rfc6749Error := fosite.ErrorToRFC6749Error(err)
 	keysAndValues := make([]interface{}, 0)
@@ -274,6 +309,18 @@ func FositeErrorForLog(err error) []interface{} {
 	return keysAndValues
 }
 
+// IsReservedDownstreamClaim returns whether the given claim of the downstream ID token is set by the Supervisor
+// itself, in which case it must not be copied from an upstream ID token.
+func IsReservedDownstreamClaim(name string) bool {
+	switch name {
+	case IDTokenIssuerClaim, IDTokenSubjectClaim, DownstreamUsernameClaim, DownstreamGroupsClaim,
+		"aud", "exp", "iat", "nbf", "jti", "nonce", "auth_time", "rat", "acr", "amr", "azp", "at_hash", "c_hash", "sid", "cnf":
+		return true
+	default:
+		return false
+	}
+}
+
 type IDPListGetter interface {
 	GetIDPList() []provider.UpstreamOIDCIdentityProviderI
 }
@@ -292,3 +339,49 @@ func ScopeWasRequested(authorizeRequester fosite.AuthorizeRequester, scopeName s
 	}
 	return false
 }
+
+// downstreamSubject returns the subject of the downstream tokens of a user of an external issuer. The spec says the
+// "sub" claim is only unique per issuer, so the issuer is prepended to make it globally unique.
+func downstreamSubject(upstreamIssuer string, upstreamSubject string) string {
+	return fmt.Sprintf("%s?%s=%s", upstreamIssuer, IDTokenSubjectClaim, upstreamSubject)
+}
+
+// extractGroups returns the value of a groups claim of an external token, which may be either a single string or an
+// array of strings. Empty strings are left out. It returns false when the claim has any other format.
+func extractGroups(groupsAsInterface interface{}) ([]string, bool) {
+	groupsAsString, okAsString := groupsAsInterface.(string)
+	if okAsString {
+		return withoutEmptyGroups([]string{groupsAsString}), true
+	}
+
+	groupsAsStringArray, okAsStringArray := groupsAsInterface.([]string)
+	if okAsStringArray {
+		return withoutEmptyGroups(groupsAsStringArray), true
+	}
+
+	groupsAsInterfaceArray, okAsArray := groupsAsInterface.([]interface{})
+	if !okAsArray {
+		return nil, false
+	}
+
+	groupsAsStrings := make([]string, 0, len(groupsAsInterfaceArray))
+	for _, groupAsInterface := range groupsAsInterfaceArray {
+		groupAsString, okAsString := groupAsInterface.(string)
+		if !okAsString {
+			return nil, false
+		}
+		groupsAsStrings = append(groupsAsStrings, groupAsString)
+	}
+
+	return withoutEmptyGroups(groupsAsStrings), true
+}
+
+func withoutEmptyGroups(groups []string) []string {
+	var nonEmptyGroups []string
+	for _, group := range groups {
+		if group != "" {
+			nonEmptyGroups = append(nonEmptyGroups, group)
+		}
+	}
+	return nonEmptyGroups
+}
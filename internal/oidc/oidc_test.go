@@ -0,0 +1,37 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package oidc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractGroups(t *testing.T) {
+	tests := []struct {
+		name       string
+		claim      interface{}
+		wantGroups []string
+		wantOK     bool
+	}{
+		{name: "string", claim: "group1", wantGroups: []string{"group1"}, wantOK: true},
+		{name: "empty string", claim: "", wantGroups: nil, wantOK: true},
+		{name: "string array", claim: []string{"group1", "", "group2"}, wantGroups: []string{"group1", "group2"}, wantOK: true},
+		{name: "array", claim: []interface{}{"group1", "", "group2"}, wantGroups: []string{"group1", "group2"}, wantOK: true},
+		{name: "array of empty strings", claim: []interface{}{"", ""}, wantGroups: nil, wantOK: true},
+		{name: "empty array", claim: []interface{}{}, wantGroups: nil, wantOK: true},
+		{name: "array with a number", claim: []interface{}{"group1", 42}, wantOK: false},
+		{name: "number", claim: 42, wantOK: false},
+		{name: "null", claim: nil, wantOK: false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			groups, ok := extractGroups(tt.claim)
+			require.Equal(t, tt.wantOK, ok)
+			require.Equal(t, tt.wantGroups, groups)
+		})
+	}
+}
@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package oidctestutil
@@ -40,6 +40,9 @@ type TestUpstreamOIDCIdentityProvider struct {
 	AuthorizationURL                      url.URL
 	UsernameClaim                         string
 	GroupsClaim                           string
+	AdditionalClaims                      map[string]string
+	RequiredACRValues                     []string
+	RequiredAMRValues                     []string
 	Scopes                                []string
 	ExchangeAuthcodeAndValidateTokensFunc func(
 		ctx context.Context,
@@ -76,6 +79,18 @@ func (u *TestUpstreamOIDCIdentityProvider) GetGroupsClaim() string {
 	return u.GroupsClaim
 }
 
+func (u *TestUpstreamOIDCIdentityProvider) GetAdditionalClaims() map[string]string {
+	return u.AdditionalClaims
+}
+
+func (u *TestUpstreamOIDCIdentityProvider) GetRequiredACRValues() []string {
+	return u.RequiredACRValues
+}
+
+func (u *TestUpstreamOIDCIdentityProvider) GetRequiredAMRValues() []string {
+	return u.RequiredAMRValues
+}
+
 func (u *TestUpstreamOIDCIdentityProvider) ExchangeAuthcodeAndValidateTokens(
 	ctx context.Context,
 	authcode string,
@@ -0,0 +1,95 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package pages
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sync"
+
+	"go.pinniped.dev/internal/httputil/htmlpage"
+)
+
+// The keys of a branding ConfigMap.
+const (
+	BrandingTitleKey           = "title"
+	BrandingLogoURLKey         = "logoURL"
+	BrandingPrimaryColorKey    = "primaryColor"
+	BrandingBackgroundColorKey = "backgroundColor"
+	BrandingHelpURLKey         = "helpURL"
+	BrandingHelpTextKey        = "helpText"
+)
+
+//nolint:gochecknoglobals
+var hexColorRegexp = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// BrandingFromConfigMapData validates the data of a branding ConfigMap. Keys which are not present in the data
+// keep their default values.
+func BrandingFromConfigMapData(data map[string]string) (*htmlpage.Branding, error) {
+	branding := htmlpage.DefaultBranding()
+	if title, ok := data[BrandingTitleKey]; ok && title != "" {
+		branding.Title = title
+	}
+	if helpText, ok := data[BrandingHelpTextKey]; ok && helpText != "" {
+		branding.HelpText = helpText
+	}
+	for key, dest := range map[string]*string{
+		BrandingPrimaryColorKey:    &branding.PrimaryColor,
+		BrandingBackgroundColorKey: &branding.BackgroundColor,
+	} {
+		if value, ok := data[key]; ok && value != "" {
+			if !hexColorRegexp.MatchString(value) {
+				return nil, fmt.Errorf("%s must be a hex color such as #1a2b3c, but was %q", key, value)
+			}
+			*dest = value
+		}
+	}
+	for key, dest := range map[string]*string{
+		BrandingLogoURLKey: &branding.LogoURL,
+		BrandingHelpURLKey: &branding.HelpURL,
+	} {
+		if value, ok := data[key]; ok && value != "" {
+			parsed, err := url.Parse(value)
+			if err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+				return nil, fmt.Errorf("%s must be an https URL, but was %q", key, value)
+			}
+			*dest = value
+		}
+	}
+	return branding, nil
+}
+
+// DynamicBrandingProvider is an in-memory cache of the branding of each FederationDomain issuer.
+type DynamicBrandingProvider interface {
+	SetIssuerToBrandingMap(issuerToBrandingMap map[string]*htmlpage.Branding)
+	GetBranding(issuer string) *htmlpage.Branding
+}
+
+type dynamicBrandingProvider struct {
+	issuerToBrandingMap map[string]*htmlpage.Branding
+	mutex               sync.RWMutex
+}
+
+func NewDynamicBrandingProvider() DynamicBrandingProvider {
+	return &dynamicBrandingProvider{
+		issuerToBrandingMap: map[string]*htmlpage.Branding{},
+	}
+}
+
+func (p *dynamicBrandingProvider) SetIssuerToBrandingMap(issuerToBrandingMap map[string]*htmlpage.Branding) {
+	p.mutex.Lock() // acquire a write lock
+	defer p.mutex.Unlock()
+	p.issuerToBrandingMap = issuerToBrandingMap
+}
+
+// GetBranding returns the branding of the issuer, or the default branding when the issuer has none.
+func (p *dynamicBrandingProvider) GetBranding(issuer string) *htmlpage.Branding {
+	p.mutex.RLock() // acquire a read lock
+	defer p.mutex.RUnlock()
+	if branding, ok := p.issuerToBrandingMap[issuer]; ok && branding != nil {
+		return branding
+	}
+	return htmlpage.DefaultBranding()
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package pages renders the error pages which browser-facing endpoints show to end users, using the branding of
+// the FederationDomain. Clients which do not ask for HTML get the same information as JSON.
+package pages
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"go.pinniped.dev/internal/httputil/htmlpage"
+	"go.pinniped.dev/internal/httputil/httperr"
+	"go.pinniped.dev/internal/plog"
+)
+
+const (
+	unknownErrorMessage = "An unexpected error occurred."
+	unknownErrorID      = "unknown"
+)
+
+type errorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+	ErrorID          string `json:"error_id"`
+}
+
+// GenerateErrorID generates a new random ID which ties an error page to its log line.
+func GenerateErrorID() (string, error) { return generateErrorID(rand.Reader) }
+
+func generateErrorID(rand io.Reader) (string, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(rand, buf[:]); err != nil {
+		return "", fmt.Errorf("could not generate error ID: %w", err)
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// Renderer writes the error pages of a single FederationDomain.
+type Renderer struct {
+	issuer           string
+	brandingProvider DynamicBrandingProvider
+	generateErrorID  func() (string, error)
+}
+
+// NewRenderer returns a Renderer for the issuer. The brandingProvider may be nil, in which case the default
+// branding is always used.
+func NewRenderer(issuer string, brandingProvider DynamicBrandingProvider, generateErrorID func() (string, error)) *Renderer {
+	return &Renderer{issuer: issuer, brandingProvider: brandingProvider, generateErrorID: generateErrorID}
+}
+
+// Wrap is like httperr.HandlerFunc, but renders any returned error as an error page.
+func (r *Renderer) Wrap(f httperr.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		err := f(w, req)
+		if err == nil {
+			return
+		}
+		code, msg := http.StatusInternalServerError, ""
+		var statusErr httperr.StatusResponder
+		if errors.As(err, &statusErr) {
+			code, msg = statusErr.Status()
+		}
+		r.WriteError(w, req, code, msg, err)
+	})
+}
+
+// WriteError logs the cause under a new error ID and writes an error page which shows that ID. The msg is shown
+// to the end user, so it must not contain any internal details.
+func (r *Renderer) WriteError(w http.ResponseWriter, req *http.Request, code int, msg string, cause error) {
+	errorID, err := r.generateErrorID()
+	if err != nil {
+		plog.WarningErr("could not generate error ID", err)
+		errorID = unknownErrorID
+	}
+
+	plog.WarningErr("browser-facing request failed", cause,
+		"errorID", errorID,
+		"issuer", r.issuer,
+		"method", req.Method,
+		"path", req.URL.Path,
+		"status", code,
+	)
+
+	if !htmlpage.WantsHTML(req) {
+		htmlpage.WriteJSON(w, code, &errorResponse{Error: http.StatusText(code), ErrorDescription: msg, ErrorID: errorID})
+		return
+	}
+	if msg == "" {
+		msg = unknownErrorMessage
+	}
+	htmlpage.WriteHTML(w, code, r.branding(), http.StatusText(code), msg, errorID)
+}
+
+func (r *Renderer) branding() *htmlpage.Branding {
+	if r.brandingProvider == nil {
+		return htmlpage.DefaultBranding()
+	}
+	return r.brandingProvider.GetBranding(r.issuer)
+}
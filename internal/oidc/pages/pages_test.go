@@ -0,0 +1,215 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package pages
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/httputil/htmlpage"
+	"go.pinniped.dev/internal/httputil/httperr"
+	"go.pinniped.dev/internal/testutil"
+)
+
+const browserAccept = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+
+func fakeErrorID() (string, error) { return "fake-error-id", nil }
+
+func TestBrandingFromConfigMapData(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         map[string]string
+		wantBranding *htmlpage.Branding
+		wantErr      string
+	}{
+		{
+			name:         "empty data uses the defaults",
+			data:         map[string]string{},
+			wantBranding: htmlpage.DefaultBranding(),
+		},
+		{
+			name: "all keys",
+			data: map[string]string{
+				"title":           "Acme Login",
+				"logoURL":         "https://acme.example.com/logo.png",
+				"primaryColor":    "#ff0000",
+				"backgroundColor": "#FFF",
+				"helpURL":         "https://acme.example.com/help",
+				"helpText":        "Ask the Acme help desk",
+			},
+			wantBranding: &htmlpage.Branding{
+				Title:           "Acme Login",
+				LogoURL:         "https://acme.example.com/logo.png",
+				PrimaryColor:    "#ff0000",
+				BackgroundColor: "#FFF",
+				HelpURL:         "https://acme.example.com/help",
+				HelpText:        "Ask the Acme help desk",
+			},
+		},
+		{
+			name:    "invalid color",
+			data:    map[string]string{"primaryColor": "red;}body{display:none"},
+			wantErr: `primaryColor must be a hex color such as #1a2b3c, but was "red;}body{display:none"`,
+		},
+		{
+			name:    "insecure URL",
+			data:    map[string]string{"logoURL": "http://acme.example.com/logo.png"},
+			wantErr: `logoURL must be an https URL, but was "http://acme.example.com/logo.png"`,
+		},
+		{
+			name:    "script URL",
+			data:    map[string]string{"helpURL": "javascript:alert(1)"},
+			wantErr: `helpURL must be an https URL, but was "javascript:alert(1)"`,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			branding, err := BrandingFromConfigMapData(test.data)
+			if test.wantErr != "" {
+				require.EqualError(t, err, test.wantErr)
+				require.Nil(t, branding)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.wantBranding, branding)
+		})
+	}
+}
+
+func TestDynamicBrandingProvider(t *testing.T) {
+	provider := NewDynamicBrandingProvider()
+	require.Equal(t, htmlpage.DefaultBranding(), provider.GetBranding("https://issuer.com"))
+
+	branding := &htmlpage.Branding{Title: "Acme Login"}
+	provider.SetIssuerToBrandingMap(map[string]*htmlpage.Branding{"https://issuer.com": branding})
+	require.Same(t, branding, provider.GetBranding("https://issuer.com"))
+	require.Equal(t, htmlpage.DefaultBranding(), provider.GetBranding("https://other-issuer.com"))
+}
+
+func TestRenderer(t *testing.T) {
+	brandingProvider := NewDynamicBrandingProvider()
+	brandingProvider.SetIssuerToBrandingMap(map[string]*htmlpage.Branding{
+		"https://issuer.com": {
+			Title:           "Acme <Login>",
+			LogoURL:         "https://acme.example.com/logo.png",
+			PrimaryColor:    "#ff0000",
+			BackgroundColor: "#ffffff",
+			HelpURL:         "https://acme.example.com/help",
+			HelpText:        "Ask the Acme help desk",
+		},
+	})
+	subject := NewRenderer("https://issuer.com", brandingProvider, fakeErrorID)
+
+	handler := func(err error) http.Handler {
+		return subject.Wrap(func(w http.ResponseWriter, r *http.Request) error { return err })
+	}
+
+	tests := []struct {
+		name            string
+		handler         http.Handler
+		accept          string
+		wantStatus      int
+		wantContentType string
+		wantBody        string
+		wantBodyRegexps []string
+	}{
+		{
+			name:            "httperr for an API client",
+			handler:         handler(httperr.Wrap(http.StatusUnprocessableEntity, "email_verified claim in upstream ID token has false value", errors.New("some secret internal bits"))),
+			wantStatus:      http.StatusUnprocessableEntity,
+			wantContentType: "application/json; charset=utf-8",
+			wantBody:        `{"error":"Unprocessable Entity","error_description":"email_verified claim in upstream ID token has false value","error_id":"fake-error-id"}` + "\n",
+		},
+		{
+			name:            "other error for an API client",
+			handler:         handler(errors.New("some secret internal bits")),
+			wantStatus:      http.StatusInternalServerError,
+			wantContentType: "application/json; charset=utf-8",
+			wantBody:        `{"error":"Internal Server Error","error_id":"fake-error-id"}` + "\n",
+		},
+		{
+			name:            "httperr for a browser",
+			handler:         handler(httperr.Wrap(http.StatusUnprocessableEntity, "email_verified claim in upstream ID token has false value", errors.New("some secret internal bits"))),
+			accept:          browserAccept,
+			wantStatus:      http.StatusUnprocessableEntity,
+			wantContentType: "text/html; charset=utf-8",
+			wantBodyRegexps: []string{
+				`<title>Acme &lt;Login&gt;</title>`,
+				`<img class="logo" src="https://acme.example.com/logo.png" alt="Acme &lt;Login&gt;">`,
+				`<h1>Unprocessable Entity</h1>`,
+				`<p>email_verified claim in upstream ID token has false value</p>`,
+				`Error ID: <code>fake-error-id</code>`,
+				`<a href="https://acme.example.com/help">Ask the Acme help desk</a>`,
+				`background:#ffffff`,
+				`border-top:4px solid #ff0000`,
+			},
+		},
+		{
+			name:            "other error for a browser",
+			handler:         handler(errors.New("some secret internal bits")),
+			accept:          browserAccept,
+			wantStatus:      http.StatusInternalServerError,
+			wantContentType: "text/html; charset=utf-8",
+			wantBodyRegexps: []string{
+				`<h1>Internal Server Error</h1>`,
+				`<p>An unexpected error occurred.</p>`,
+				`Error ID: <code>fake-error-id</code>`,
+			},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/callback", nil)
+			if test.accept != "" {
+				req.Header.Set("Accept", test.accept)
+			}
+			rsp := httptest.NewRecorder()
+			test.handler.ServeHTTP(rsp, req)
+
+			require.Equal(t, test.wantStatus, rsp.Code)
+			require.Equal(t, test.wantContentType, rsp.Header().Get("Content-Type"))
+			require.NotContains(t, rsp.Body.String(), "some secret internal bits")
+			if test.wantBody != "" {
+				require.Equal(t, test.wantBody, rsp.Body.String())
+			}
+			for _, want := range test.wantBodyRegexps {
+				require.Regexp(t, regexp.QuoteMeta(want), rsp.Body.String())
+			}
+			if test.accept != "" {
+				testutil.RequireStyleAllowedByCSP(t, rsp)
+			}
+		})
+	}
+}
+
+func TestWriteErrorWithDefaultBranding(t *testing.T) {
+	subject := NewRenderer("https://issuer.com", nil, fakeErrorID)
+	req := httptest.NewRequest(http.MethodGet, "/callback", nil)
+	req.Header.Set("Accept", browserAccept)
+	rsp := httptest.NewRecorder()
+	subject.WriteError(rsp, req, http.StatusBadRequest, "some message", errors.New("some cause"))
+
+	require.Equal(t, http.StatusBadRequest, rsp.Code)
+	require.Contains(t, rsp.Body.String(), "<title>Pinniped</title>")
+	require.Contains(t, rsp.Body.String(), "Contact your administrator for help.")
+	require.NotContains(t, rsp.Body.String(), "<img")
+	testutil.RequireStyleAllowedByCSP(t, rsp)
+}
+
+func TestGenerateErrorID(t *testing.T) {
+	id, err := generateErrorID(bytes.NewReader([]byte("12345678")))
+	require.NoError(t, err)
+	require.Equal(t, "3132333435363738", id)
+
+	_, err = generateErrorID(bytes.NewReader([]byte("1234")))
+	require.EqualError(t, err, "could not generate error ID: unexpected EOF")
+}
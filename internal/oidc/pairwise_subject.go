@@ -0,0 +1,107 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package oidc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/openid"
+
+	"go.pinniped.dev/internal/constable"
+	"go.pinniped.dev/internal/oidc/provider"
+)
+
+// pairwiseSubjectContext separates the HMACs of the pairwise subjects from the other uses of the HMAC key of the
+// FederationDomain.
+const pairwiseSubjectContext = "pinniped-pairwise-subject"
+
+// PairwiseSubject returns the pairwise subject identifier of the user with the given public subject for the clients
+// with the given sector identifier, as described in https://openid.net/specs/openid-connect-core-1_0.html#PairwiseAlg.
+// It is stable for as long as the key does not change.
+func PairwiseSubject(key []byte, sectorIdentifier, publicSubject string) string {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(pairwiseSubjectContext))
+	// The length prefixes keep different pairs of sector identifier and public subject from having the same input.
+	for _, field := range []string{sectorIdentifier, publicSubject} {
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], uint64(len(field)))
+		_, _ = mac.Write(length[:])
+		_, _ = mac.Write([]byte(field))
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// pairwiseSubjectStrategy is an openid.OpenIDConnectTokenStrategy which replaces the public subject of the ID
+// tokens which are issued to clients with pairwise subjects by their pairwise subject. Only the ID tokens of the
+// authorization code and refresh token grants are changed, which are issued to the client itself. The session
+// keeps the public subject, so that the sessions of a user can still be found by the public subject.
+type pairwiseSubjectStrategy struct {
+	openid.OpenIDConnectTokenStrategy
+	keyFunc           func() []byte
+	sectorIdentifiers map[string]string // by client ID, only for the clients with pairwise subjects
+}
+
+var _ openid.OpenIDConnectTokenStrategy = &pairwiseSubjectStrategy{}
+
+func newPairwiseSubjectStrategy(
+	delegate openid.OpenIDConnectTokenStrategy,
+	keyFunc func() []byte,
+	clients []*provider.Client,
+) *pairwiseSubjectStrategy {
+	sectorIdentifiers := map[string]string{}
+	for _, client := range clients {
+		if client.SectorIdentifier != "" {
+			sectorIdentifiers[client.ID] = client.SectorIdentifier
+		}
+	}
+	return &pairwiseSubjectStrategy{
+		OpenIDConnectTokenStrategy: delegate,
+		keyFunc:                    keyFunc,
+		sectorIdentifiers:          sectorIdentifiers,
+	}
+}
+
+func (s *pairwiseSubjectStrategy) GenerateIDToken(ctx context.Context, requester fosite.Requester) (string, error) {
+	sectorIdentifier, ok := s.sectorIdentifiers[requester.GetClient().GetID()]
+	if !ok || !isLoginGrant(requester) {
+		return s.OpenIDConnectTokenStrategy.GenerateIDToken(ctx, requester)
+	}
+
+	session, ok := requester.GetSession().(openid.Session)
+	if !ok {
+		return "", fosite.ErrServerError.WithHint("unexpected session type")
+	}
+	key := s.keyFunc()
+	if len(key) == 0 {
+		return "", fosite.ErrTemporarilyUnavailable.WithWrap(constable.Error("no HMAC key found for pairwise subjects"))
+	}
+
+	// Fosite generates the ID token from the claims of the session, so change the subject only while the ID token
+	// is generated.
+	claims := session.IDTokenClaims()
+	publicSubject := claims.Subject
+	claims.Subject = PairwiseSubject(key, sectorIdentifier, publicSubject)
+	defer func() { claims.Subject = publicSubject }()
+	return s.OpenIDConnectTokenStrategy.GenerateIDToken(ctx, requester)
+}
+
+// isLoginGrant returns whether the request is for the authorization code or refresh token grant, which log in a
+// user. The client credentials grant also issues ID tokens, but their subject is the client itself rather than a
+// user. The token exchange issues ID tokens with public subjects to other audiences, which is why clients with
+// pairwise subjects may not use it, nor get the scope which allows other clients to exchange their tokens.
+func isLoginGrant(requester fosite.Requester) bool {
+	accessRequester, ok := requester.(fosite.AccessRequester)
+	if !ok {
+		// Fosite generates the ID token of the authorization code grant from the stored authorize request rather
+		// than from the access request.
+		return true
+	}
+	grantTypes := accessRequester.GetGrantTypes()
+	return grantTypes.ExactOne("authorization_code") || grantTypes.ExactOne("refresh_token")
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package oidc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/ory/fosite/token/jwt"
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/oidc/provider"
+)
+
+func TestPairwiseSubject(t *testing.T) {
+	key := []byte("some-key-of-at-least-32-bytes-length")
+
+	subject := PairwiseSubject(key, "some-sector", "https://issuer?sub=some-subject")
+	require.NotEmpty(t, subject)
+	require.Equal(t, subject, PairwiseSubject(key, "some-sector", "https://issuer?sub=some-subject"))
+
+	require.NotEqual(t, subject, PairwiseSubject(key, "some-other-sector", "https://issuer?sub=some-subject"))
+	require.NotEqual(t, subject, PairwiseSubject(key, "some-sector", "https://issuer?sub=some-other-subject"))
+	require.NotEqual(t, subject, PairwiseSubject([]byte("some-other-key-of-at-least-32-bytes"), "some-sector", "https://issuer?sub=some-subject"))
+
+	// The length prefixes keep the boundary between the sector identifier and the public subject from moving.
+	require.NotEqual(t, PairwiseSubject(key, "a", "b\x00c"), PairwiseSubject(key, "a\x00b", "c"))
+}
+
+type subjectRecordingStrategy struct {
+	subjects []string
+}
+
+func (s *subjectRecordingStrategy) GenerateIDToken(_ context.Context, requester fosite.Requester) (string, error) {
+	subject := requester.GetSession().(openid.Session).IDTokenClaims().Subject
+	s.subjects = append(s.subjects, subject)
+	return "token for " + subject, nil
+}
+
+func TestPairwiseSubjectStrategy(t *testing.T) {
+	const publicSubject = "https://issuer?sub=some-subject"
+	key := []byte("some-key-of-at-least-32-bytes-length")
+
+	clients := []*provider.Client{
+		{ID: "public-client"},
+		{ID: "pairwise-client", SectorIdentifier: "some-sector"},
+	}
+
+	tests := []struct {
+		name             string
+		clientID         string
+		authorizeRequest bool
+		grantTypes       fosite.Arguments
+		key              []byte
+
+		wantSubject string
+		wantErr     string
+	}{
+		{
+			name:        "authorization code grant of a client with pairwise subjects",
+			clientID:    "pairwise-client",
+			grantTypes:  fosite.Arguments{"authorization_code"},
+			key:         key,
+			wantSubject: PairwiseSubject(key, "some-sector", publicSubject),
+		},
+		{
+			name:             "stored authorize request of the authorization code grant of a client with pairwise subjects",
+			clientID:         "pairwise-client",
+			authorizeRequest: true,
+			key:              key,
+			wantSubject:      PairwiseSubject(key, "some-sector", publicSubject),
+		},
+		{
+			name:        "refresh token grant of a client with pairwise subjects",
+			clientID:    "pairwise-client",
+			grantTypes:  fosite.Arguments{"refresh_token"},
+			key:         key,
+			wantSubject: PairwiseSubject(key, "some-sector", publicSubject),
+		},
+		{
+			name:        "token exchange of a client with pairwise subjects",
+			clientID:    "pairwise-client",
+			grantTypes:  fosite.Arguments{"urn:ietf:params:oauth:grant-type:token-exchange"},
+			key:         key,
+			wantSubject: publicSubject,
+		},
+		{
+			name:        "authorization code grant of a client with public subjects",
+			clientID:    "public-client",
+			grantTypes:  fosite.Arguments{"authorization_code"},
+			key:         key,
+			wantSubject: publicSubject,
+		},
+		{
+			name:       "no HMAC key",
+			clientID:   "pairwise-client",
+			grantTypes: fosite.Arguments{"authorization_code"},
+			wantErr:    "temporarily_unavailable",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			delegate := &subjectRecordingStrategy{}
+			strategy := newPairwiseSubjectStrategy(delegate, func() []byte { return test.key }, clients)
+
+			session := &openid.DefaultSession{Claims: &jwt.IDTokenClaims{Subject: publicSubject}}
+			var requester fosite.Requester
+			if test.authorizeRequest {
+				authorizeRequester := fosite.NewRequest()
+				authorizeRequester.Client = &fosite.DefaultClient{ID: test.clientID}
+				authorizeRequester.Session = session
+				requester = authorizeRequester
+			} else {
+				accessRequester := fosite.NewAccessRequest(session)
+				accessRequester.Client = &fosite.DefaultClient{ID: test.clientID}
+				accessRequester.GrantTypes = test.grantTypes
+				requester = accessRequester
+			}
+
+			token, err := strategy.GenerateIDToken(context.Background(), requester)
+			if test.wantErr != "" {
+				require.EqualError(t, err, test.wantErr)
+				require.Empty(t, delegate.subjects)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, "token for "+test.wantSubject, token)
+				require.Equal(t, []string{test.wantSubject}, delegate.subjects)
+			}
+
+			// The session always keeps the public subject.
+			require.Equal(t, publicSubject, session.Claims.Subject)
+		})
+	}
+}
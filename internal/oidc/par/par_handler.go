@@ -0,0 +1,114 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package par provides a handler for the OAuth 2.0 pushed authorization request endpoint, as defined by
+// https://datatracker.ietf.org/doc/html/rfc9126.
+package par
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ory/fosite"
+
+	"go.pinniped.dev/internal/fositestorage/pushedauthorizationrequest"
+	"go.pinniped.dev/internal/httputil/httperr"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/plog"
+)
+
+type response struct {
+	RequestURI string `json:"request_uri"`
+	ExpiresIn  int64  `json:"expires_in"`
+}
+
+// NewHandler returns an http.Handler which validates and stores the authorization requests which are pushed to it,
+// and returns a request_uri which the authorization endpoint accepts in place of the parameters of the request.
+func NewHandler(
+	oauthHelper fosite.OAuth2Provider,
+	storage pushedauthorizationrequest.Storage,
+	generateReference func() (string, error),
+	lifespan time.Duration,
+) http.Handler {
+	return httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method != http.MethodPost {
+			return httperr.Newf(http.StatusMethodNotAllowed, "%s (try POST)", r.Method)
+		}
+
+		if err := r.ParseForm(); err != nil {
+			err = fosite.ErrInvalidRequest.
+				WithHint("Unable to parse HTTP body, make sure to send a properly formatted form request body.").
+				WithWrap(err).WithDebug(err.Error())
+			plog.Info("pushed authorization request error", oidc.FositeErrorForLog(err)...)
+			oauthHelper.WriteAccessError(w, nil, err)
+			return nil
+		}
+
+		// The request_uri parameter must not be pushed, since it would refer to another authorization request.
+		// See https://datatracker.ietf.org/doc/html/rfc9126#section-2.1.
+		if r.Form.Get("request_uri") != "" {
+			err := fosite.ErrInvalidRequest.WithHint("The request_uri parameter must not be used in a pushed authorization request.")
+			plog.Info("pushed authorization request error", oidc.FositeErrorForLog(err)...)
+			oauthHelper.WriteAccessError(w, nil, err)
+			return nil
+		}
+
+		// Validate the pushed request in the same way that the authorization endpoint validates its requests, so that
+		// the client learns about an invalid request before it sends the end user's browser to the authorization endpoint.
+		authorizeRequester, err := oauthHelper.NewAuthorizeRequest(r.Context(), r)
+		if err != nil {
+			plog.Info("pushed authorization request error", oidc.FositeErrorForLog(err)...)
+			oauthHelper.WriteAccessError(w, nil, err)
+			return nil
+		}
+
+		reference, err := generateReference()
+		if err != nil {
+			plog.Error("pushed authorization request generate error", err)
+			return httperr.Wrap(http.StatusInternalServerError, "error generating request_uri", err)
+		}
+
+		if err := storage.CreatePushedAuthorizationRequest(r.Context(), reference, &pushedauthorizationrequest.Request{
+			ClientID:  authorizeRequester.GetClient().GetID(),
+			Params:    copyParams(r.Form),
+			ExpiresAt: time.Now().Add(lifespan),
+		}); err != nil {
+			plog.Error("pushed authorization request storage error", err)
+			return httperr.Wrap(http.StatusInternalServerError, "error storing pushed authorization request", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Pragma", "no-cache")
+		w.WriteHeader(http.StatusCreated)
+		return json.NewEncoder(w).Encode(&response{
+			RequestURI: oidc.PushedAuthorizationRequestURIPrefix + reference,
+			ExpiresIn:  int64(lifespan.Seconds()),
+		})
+	})
+}
+
+// GenerateReference generates a random reference for the request_uri of a pushed authorization request.
+func GenerateReference() (string, error) { return generateReference(rand.Reader) }
+
+func generateReference(rand io.Reader) (string, error) {
+	var buf [32]byte
+	if _, err := io.ReadFull(rand, buf[:]); err != nil {
+		return "", fmt.Errorf("could not generate pushed authorization request reference: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf[:]), nil
+}
+
+func copyParams(params url.Values) url.Values {
+	copied := make(url.Values, len(params))
+	for key, values := range params {
+		copied[key] = append([]string(nil), values...)
+	}
+	return copied
+}
@@ -0,0 +1,210 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package par
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/fositestorage/pushedauthorizationrequest"
+	"go.pinniped.dev/internal/here"
+	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/jwks"
+)
+
+func TestPushedAuthorizationRequestEndpoint(t *testing.T) {
+	const (
+		downstreamIssuer = "https://my-downstream-issuer.com/some-path"
+		lifespan         = 2 * time.Minute
+	)
+
+	happyParams := url.Values{
+		"response_type":         []string{"code"},
+		"scope":                 []string{"openid profile email"},
+		"client_id":             []string{"pinniped-cli"},
+		"state":                 []string{"some-state-value"},
+		"nonce":                 []string{"some-nonce-value"},
+		"code_challenge":        []string{"some-challenge"},
+		"code_challenge_method": []string{"S256"},
+		"redirect_uri":          []string{"http://127.0.0.1:12345/callback"},
+	}
+
+	modifiedHappyParams := func(overrides map[string]string) url.Values {
+		params := url.Values{}
+		for k, v := range happyParams {
+			params[k] = v
+		}
+		for k, v := range overrides {
+			if v == "" {
+				params.Del(k)
+			} else {
+				params.Set(k, v)
+			}
+		}
+		return params
+	}
+
+	hmacSecretFunc := func() []byte { return []byte("some secret - must have at least 32 bytes") }
+	oauthHelper := oidc.FositeOauth2Helper(oidc.NullStorage{}, downstreamIssuer, hmacSecretFunc, jwks.NewDynamicJWKSProvider(), oidc.DefaultOIDCTimeoutsConfiguration(), nil, nil, nil)
+
+	happyGenerateReference := func() (string, error) { return "some-reference", nil }
+
+	tests := []struct {
+		name              string
+		method            string
+		body              url.Values
+		generateReference func() (string, error)
+		createError       error
+
+		wantStatus      int
+		wantContentType string
+		wantBodyJSON    string
+		wantBodyString  string
+		wantStored      *pushedauthorizationrequest.Request
+	}{
+		{
+			name:            "happy path",
+			method:          http.MethodPost,
+			body:            happyParams,
+			wantStatus:      http.StatusCreated,
+			wantContentType: "application/json",
+			wantBodyJSON:    `{"request_uri":"urn:ietf:params:oauth:request_uri:some-reference","expires_in":120}`,
+			wantStored:      &pushedauthorizationrequest.Request{ClientID: "pinniped-cli", Params: happyParams},
+		},
+		{
+			name:            "GET is a bad method",
+			method:          http.MethodGet,
+			wantStatus:      http.StatusMethodNotAllowed,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBodyString:  "Method Not Allowed: GET (try POST)\n",
+		},
+		{
+			name:            "request_uri is pushed",
+			method:          http.MethodPost,
+			body:            modifiedHappyParams(map[string]string{"request_uri": "urn:ietf:params:oauth:request_uri:some-other-reference"}),
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/json;charset=UTF-8",
+			wantBodyJSON: here.Doc(`
+				{
+					"error":             "invalid_request",
+					"error_description": "The request is missing a required parameter, includes an invalid parameter value, includes a parameter more than once, or is otherwise malformed. The request_uri parameter must not be used in a pushed authorization request."
+				}
+			`),
+		},
+		{
+			name:            "client id is unknown",
+			method:          http.MethodPost,
+			body:            modifiedHappyParams(map[string]string{"client_id": "invalid-client"}),
+			wantStatus:      http.StatusUnauthorized,
+			wantContentType: "application/json;charset=UTF-8",
+			wantBodyJSON: here.Doc(`
+				{
+					"error":             "invalid_client",
+					"error_description": "Client authentication failed (e.g., unknown client, no client authentication included, or unsupported authentication method). The requested OAuth 2.0 Client does not exist."
+				}
+			`),
+		},
+		{
+			name:            "redirect uri is not registered",
+			method:          http.MethodPost,
+			body:            modifiedHappyParams(map[string]string{"redirect_uri": "http://127.0.0.1/not-the-callback"}),
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/json;charset=UTF-8",
+			wantBodyJSON: here.Doc(`
+				{
+					"error":             "invalid_request",
+					"error_description": "The request is missing a required parameter, includes an invalid parameter value, includes a parameter more than once, or is otherwise malformed. The 'redirect_uri' parameter does not match any of the OAuth 2.0 Client's pre-registered redirect urls."
+				}
+			`),
+		},
+		{
+			name:              "generating the reference fails",
+			method:            http.MethodPost,
+			body:              happyParams,
+			generateReference: func() (string, error) { return "", errors.New("some generate error") },
+			wantStatus:        http.StatusInternalServerError,
+			wantContentType:   "text/plain; charset=utf-8",
+			wantBodyString:    "Internal Server Error: error generating request_uri\n",
+		},
+		{
+			name:            "storing the request fails",
+			method:          http.MethodPost,
+			body:            happyParams,
+			createError:     errors.New("some create error"),
+			wantStatus:      http.StatusInternalServerError,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBodyString:  "Internal Server Error: error storing pushed authorization request\n",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			storage := &recordingStorage{
+				Storage:     pushedauthorizationrequest.New(crud.NewSecretsBackend(fake.NewSimpleClientset().CoreV1().Secrets("some-namespace")), time.Now, lifespan),
+				createError: test.createError,
+			}
+			generateReference := happyGenerateReference
+			if test.generateReference != nil {
+				generateReference = test.generateReference
+			}
+			subject := NewHandler(oauthHelper, storage, generateReference, lifespan)
+
+			req := httptest.NewRequest(test.method, "/some-path/oauth2/par", strings.NewReader(test.body.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rsp := httptest.NewRecorder()
+			subject.ServeHTTP(rsp, req)
+			t.Logf("response body: %q", rsp.Body.String())
+
+			require.Equal(t, test.wantStatus, rsp.Code)
+			require.Equal(t, test.wantContentType, rsp.Header().Get("Content-Type"))
+			if test.wantBodyJSON != "" {
+				require.JSONEq(t, test.wantBodyJSON, rsp.Body.String())
+			} else {
+				require.Equal(t, test.wantBodyString, rsp.Body.String())
+			}
+
+			stored, err := storage.GetPushedAuthorizationRequest(context.Background(), "some-reference")
+			if test.wantStored == nil {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "no-store", rsp.Header().Get("Cache-Control"))
+			require.Equal(t, test.wantStored.ClientID, stored.ClientID)
+			require.Equal(t, test.wantStored.Params, stored.Params)
+			require.WithinDuration(t, time.Now().Add(lifespan), stored.ExpiresAt, 10*time.Second)
+		})
+	}
+}
+
+func TestGenerateReference(t *testing.T) {
+	reference, err := generateReference(strings.NewReader("0123456789abcdef0123456789abcdef"))
+	require.NoError(t, err)
+	require.Equal(t, "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY", reference)
+
+	_, err = generateReference(strings.NewReader("too short"))
+	require.EqualError(t, err, "could not generate pushed authorization request reference: unexpected EOF")
+}
+
+type recordingStorage struct {
+	pushedauthorizationrequest.Storage
+	createError error
+}
+
+func (s *recordingStorage) CreatePushedAuthorizationRequest(ctx context.Context, reference string, request *pushedauthorizationrequest.Request) error {
+	if s.createError != nil {
+		return s.createError
+	}
+	return s.Storage.CreatePushedAuthorizationRequest(ctx, reference, request)
+}
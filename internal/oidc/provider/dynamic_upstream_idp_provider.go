@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package provider
@@ -35,6 +35,18 @@ type UpstreamOIDCIdentityProviderI interface {
 	// ID Token groups claim name. May return empty string, in which case we won't try to read groups from the upstream provider.
 	GetGroupsClaim() string
 
+	// Upstream claims to copy into the downstream ID token, keyed by the name of the downstream claim. May return
+	// nil, in which case no additional claims are copied.
+	GetAdditionalClaims() map[string]string
+
+	// Authentication context class references of which the upstream ID token's acr claim must be one. These are
+	// also requested from the upstream provider. May return nil, in which case the acr claim is not checked.
+	GetRequiredACRValues() []string
+
+	// Authentication methods which the upstream ID token's amr claim must contain. May return nil, in which case
+	// the amr claim is not checked.
+	GetRequiredAMRValues() []string
+
 	// Performs upstream OIDC authorization code exchange and token validation.
 	// Returns the validated raw tokens as well as the parsed claims of the ID token.
 	ExchangeAuthcodeAndValidateTokens(
@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package provider
@@ -11,12 +11,54 @@ import (
 	"go.pinniped.dev/internal/constable"
 )
 
+// pinnipedCLIClientID is the ID of the built-in client which is used by the Pinniped CLI.
+const pinnipedCLIClientID = "pinniped-cli"
+
+// TokenExchangeAudiences maps each audience for which access tokens and downscoped ID tokens may be requested
+// during a token exchange to the scopes which may be granted to those tokens.
+type TokenExchangeAudiences map[string][]string
+
+// TrustedJWTIssuer describes an external issuer whose JWTs may be exchanged for ID tokens during a token exchange.
+type TrustedJWTIssuer struct {
+	Issuer          string
+	JWKSURL         string
+	CABundle        []byte // PEM, or nil to use the system's trusted certificate authorities
+	Audience        string
+	UsernameClaim   string
+	GroupsClaim     string
+	UsernamePrefix  string // prepended to the usernames which are read from the UsernameClaim
+	GroupsPrefix    string // prepended to the groups which are read from the GroupsClaim
+	AllowedSubjects []string
+}
+
+// Client describes a confidential client which may use the client credentials grant to get tokens which
+// represent a fixed service identity, and which may also log in users when it has redirect URIs.
+type Client struct {
+	ID               string
+	SecretHash       []byte // bcrypt
+	Username         string
+	Groups           []string
+	AllowedScopes    []string
+	AllowedAudiences []string
+	RequireDPoP      bool
+	RedirectURIs     []string
+	SectorIdentifier string // of the pairwise subjects of the client, or empty when the client gets public subjects
+}
+
 // FederationDomainIssuer represents all of the settings and state for a downstream OIDC provider
 // as defined by a FederationDomain.
 type FederationDomainIssuer struct {
 	issuer     string
 	issuerHost string
 	issuerPath string
+
+	aliases                []*FederationDomainIssuer
+	tokenExchangeAudiences TokenExchangeAudiences
+	trustedJWTIssuers      []*TrustedJWTIssuer
+	clients                []*Client
+	identityProviderNames  []string
+
+	pinnipedCLIClientRequiresDPoP bool
 }
 
 func NewFederationDomainIssuer(issuer string) (*FederationDomainIssuer, error) {
@@ -75,3 +117,64 @@ func (p *FederationDomainIssuer) IssuerHost() string {
 func (p *FederationDomainIssuer) IssuerPath() string {
 	return p.issuerPath
 }
+
+func (p *FederationDomainIssuer) TokenExchangeAudiences() TokenExchangeAudiences {
+	return p.tokenExchangeAudiences
+}
+
+func (p *FederationDomainIssuer) SetTokenExchangeAudiences(tokenExchangeAudiences TokenExchangeAudiences) {
+	p.tokenExchangeAudiences = tokenExchangeAudiences
+}
+
+func (p *FederationDomainIssuer) TrustedJWTIssuers() []*TrustedJWTIssuer {
+	return p.trustedJWTIssuers
+}
+
+func (p *FederationDomainIssuer) SetTrustedJWTIssuers(trustedJWTIssuers []*TrustedJWTIssuer) {
+	p.trustedJWTIssuers = trustedJWTIssuers
+}
+
+func (p *FederationDomainIssuer) Clients() []*Client {
+	return p.clients
+}
+
+func (p *FederationDomainIssuer) SetClients(clients []*Client) {
+	p.clients = clients
+}
+
+// SetPinnipedCLIClientRequiresDPoP sets whether the Pinniped CLI client must send DPoP proofs to the token endpoint.
+func (p *FederationDomainIssuer) SetPinnipedCLIClientRequiresDPoP(requiresDPoP bool) {
+	p.pinnipedCLIClientRequiresDPoP = requiresDPoP
+}
+
+// RequiresDPoP returns whether the client with the given ID must send DPoP proofs to the token endpoint.
+func (p *FederationDomainIssuer) RequiresDPoP(clientID string) bool {
+	if clientID == pinnipedCLIClientID {
+		return p.pinnipedCLIClientRequiresDPoP
+	}
+	for _, client := range p.clients {
+		if client.ID == clientID {
+			return client.RequireDPoP
+		}
+	}
+	return false
+}
+
+// Aliases returns the alias issuers of this FederationDomain, which share all of its other settings and state.
+func (p *FederationDomainIssuer) Aliases() []*FederationDomainIssuer {
+	return p.aliases
+}
+
+func (p *FederationDomainIssuer) SetAliases(aliases []*FederationDomainIssuer) {
+	p.aliases = aliases
+}
+
+// IdentityProviderNames returns the names of the upstream identity providers which may be used to log in to this
+// FederationDomain. When it is nil, then all of the upstream identity providers may be used.
+func (p *FederationDomainIssuer) IdentityProviderNames() []string {
+	return p.identityProviderNames
+}
+
+func (p *FederationDomainIssuer) SetIdentityProviderNames(identityProviderNames []string) {
+	p.identityProviderNames = identityProviderNames
+}
@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package manager
@@ -7,19 +7,26 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"k8s.io/apimachinery/pkg/util/sets"
 
 	"go.pinniped.dev/internal/secret"
 
 	"go.pinniped.dev/internal/oidc/dynamiccodec"
 
-	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
-
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/fositestorage/dpopproof"
 	"go.pinniped.dev/internal/oidc"
 	"go.pinniped.dev/internal/oidc/auth"
 	"go.pinniped.dev/internal/oidc/callback"
 	"go.pinniped.dev/internal/oidc/csrftoken"
 	"go.pinniped.dev/internal/oidc/discovery"
+	"go.pinniped.dev/internal/oidc/dpop"
 	"go.pinniped.dev/internal/oidc/jwks"
+	"go.pinniped.dev/internal/oidc/pages"
+	"go.pinniped.dev/internal/oidc/par"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/oidc/token"
 	"go.pinniped.dev/internal/plog"
@@ -31,34 +38,39 @@ import (
 //
 // It is thread-safe.
 type Manager struct {
-	mu                  sync.RWMutex
-	providers           []*provider.FederationDomainIssuer
-	providerHandlers    map[string]http.Handler  // map of all routes for all providers
-	nextHandler         http.Handler             // the next handler in a chain, called when this manager didn't know how to handle a request
-	dynamicJWKSProvider jwks.DynamicJWKSProvider // in-memory cache of per-issuer JWKS data
-	idpListGetter       oidc.IDPListGetter       // in-memory cache of upstream IDPs
-	secretCache         *secret.Cache            // in-memory cache of cryptographic material
-	secretsClient       corev1client.SecretInterface
+	mu                      sync.RWMutex
+	providers               []*provider.FederationDomainIssuer
+	providerHandlers        map[string]http.Handler       // map of all routes for all providers
+	nextHandler             http.Handler                  // the next handler in a chain, called when this manager didn't know how to handle a request
+	dynamicJWKSProvider     jwks.DynamicJWKSProvider      // in-memory cache of per-issuer JWKS data
+	dynamicBrandingProvider pages.DynamicBrandingProvider // in-memory cache of per-issuer branding of HTML pages
+	idpListGetter           oidc.IDPListGetter            // in-memory cache of upstream IDPs
+	secretCache             *secret.Cache                 // in-memory cache of cryptographic material
+	storageBackend          crud.Backend                  // storage of the downstream sessions
 }
 
 // NewManager returns an empty Manager.
 // nextHandler will be invoked for any requests that could not be handled by this manager's providers.
 // dynamicJWKSProvider will be used as an in-memory cache for per-issuer JWKS data.
+// dynamicBrandingProvider will be used as an in-memory cache for per-issuer branding of HTML pages.
 // idpListGetter will be used as an in-memory cache of currently configured upstream IDPs.
+// storageBackend will be used to store the downstream sessions.
 func NewManager(
 	nextHandler http.Handler,
 	dynamicJWKSProvider jwks.DynamicJWKSProvider,
+	dynamicBrandingProvider pages.DynamicBrandingProvider,
 	idpListGetter oidc.IDPListGetter,
 	secretCache *secret.Cache,
-	secretsClient corev1client.SecretInterface,
+	storageBackend crud.Backend,
 ) *Manager {
 	return &Manager{
-		providerHandlers:    make(map[string]http.Handler),
-		nextHandler:         nextHandler,
-		dynamicJWKSProvider: dynamicJWKSProvider,
-		idpListGetter:       idpListGetter,
-		secretCache:         secretCache,
-		secretsClient:       secretsClient,
+		providerHandlers:        make(map[string]http.Handler),
+		nextHandler:             nextHandler,
+		dynamicJWKSProvider:     dynamicJWKSProvider,
+		dynamicBrandingProvider: dynamicBrandingProvider,
+		idpListGetter:           idpListGetter,
+		secretCache:             secretCache,
+		storageBackend:          storageBackend,
 	}
 }
 
@@ -79,59 +91,97 @@ func (m *Manager) SetProviders(federationDomains ...*provider.FederationDomainIs
 
 	var csrfCookieEncoder = dynamiccodec.New(
 		oidc.CSRFCookieLifespan,
-		m.secretCache.GetCSRFCookieEncoderHashKey,
-		func() []byte { return nil },
+		m.secretCache.GetCSRFCookieEncoderHashKeys,
+		func() [][]byte { return nil },
 	)
 
 	for _, incomingProvider := range federationDomains {
-		issuer := incomingProvider.Issuer()
-		issuerHostWithPath := strings.ToLower(incomingProvider.IssuerHost()) + "/" + incomingProvider.IssuerPath()
+		// All of the alias issuers share the signing keys, the storage, and the other settings of the FederationDomain,
+		// so they are all looked up using the primary issuer. Only the handler routes and the "iss" of the issued tokens
+		// and of the discovery document differ for each alias.
+		primaryIssuer := incomingProvider.Issuer()
 
-		tokenHMACKeyGetter := wrapGetter(incomingProvider.Issuer(), m.secretCache.GetTokenHMACKey)
+		tokenHMACKeyGetter := wrapGetter(primaryIssuer, m.secretCache.GetTokenHMACKey)
 
 		timeoutsConfiguration := oidc.DefaultOIDCTimeoutsConfiguration()
 
-		// Use NullStorage for the authorize endpoint because we do not actually want to store anything until
-		// the upstream callback endpoint is called later.
-		oauthHelperWithNullStorage := oidc.FositeOauth2Helper(oidc.NullStorage{}, issuer, tokenHMACKeyGetter, nil, timeoutsConfiguration)
-
-		// For all the other endpoints, make another oauth helper with exactly the same settings except use real storage.
-		oauthHelperWithKubeStorage := oidc.FositeOauth2Helper(oidc.NewKubeStorage(m.secretsClient, timeoutsConfiguration), issuer, tokenHMACKeyGetter, m.dynamicJWKSProvider, timeoutsConfiguration)
-
 		var upstreamStateEncoder = dynamiccodec.New(
 			timeoutsConfiguration.UpstreamStateParamLifespan,
-			wrapGetter(incomingProvider.Issuer(), m.secretCache.GetStateEncoderHashKey),
-			wrapGetter(incomingProvider.Issuer(), m.secretCache.GetStateEncoderBlockKey),
+			wrapKeyRingGetter(primaryIssuer, m.secretCache.GetStateEncoderHashKeys),
+			wrapKeyRingGetter(primaryIssuer, m.secretCache.GetStateEncoderBlockKeys),
 		)
 
-		m.providerHandlers[(issuerHostWithPath + oidc.WellKnownEndpointPath)] = discovery.NewHandler(issuer)
-
-		m.providerHandlers[(issuerHostWithPath + oidc.JWKSEndpointPath)] = jwks.NewHandler(issuer, m.dynamicJWKSProvider)
-
-		m.providerHandlers[(issuerHostWithPath + oidc.AuthorizationEndpointPath)] = auth.NewHandler(
-			issuer,
-			m.idpListGetter,
-			oauthHelperWithNullStorage,
-			csrftoken.Generate,
-			pkce.Generate,
-			nonce.Generate,
-			upstreamStateEncoder,
-			csrfCookieEncoder,
-		)
-
-		m.providerHandlers[(issuerHostWithPath + oidc.CallbackEndpointPath)] = callback.NewHandler(
-			m.idpListGetter,
-			oauthHelperWithKubeStorage,
-			upstreamStateEncoder,
-			csrfCookieEncoder,
-			issuer+oidc.CallbackEndpointPath,
-		)
-
-		m.providerHandlers[(issuerHostWithPath + oidc.TokenEndpointPath)] = token.NewHandler(
-			oauthHelperWithKubeStorage,
-		)
-
-		plog.Debug("oidc provider manager added or updated issuer", "issuer", issuer)
+		// The DPoP nonces are derived from the token HMAC key, and the used DPoP proofs are recorded in the session
+		// storage, so that every Supervisor pod accepts the same nonces and rejects the same replayed proofs.
+		dpopValidator := dpop.NewValidator(tokenHMACKeyGetter, dpopproof.New(m.storageBackend, time.Now, dpop.ProofLifetime))
+
+		renderer := pages.NewRenderer(primaryIssuer, m.dynamicBrandingProvider, pages.GenerateErrorID)
+
+		jwksProvider := &primaryIssuerJWKSProvider{DynamicJWKSProvider: m.dynamicJWKSProvider, primaryIssuer: primaryIssuer}
+
+		idpListGetter := m.idpListGetter
+		if incomingProvider.IdentityProviderNames() != nil {
+			idpListGetter = &filteredIDPListGetter{
+				IDPListGetter: m.idpListGetter,
+				names:         sets.NewString(incomingProvider.IdentityProviderNames()...),
+			}
+		}
+
+		for _, issuerOrAlias := range append([]*provider.FederationDomainIssuer{incomingProvider}, incomingProvider.Aliases()...) {
+			issuer := issuerOrAlias.Issuer()
+			issuerHostWithPath := strings.ToLower(issuerOrAlias.IssuerHost()) + "/" + issuerOrAlias.IssuerPath()
+
+			// Use NullStorage for the authorize endpoint because we do not actually want to store anything until
+			// the upstream callback endpoint is called later.
+			oauthHelperWithNullStorage := oidc.FositeOauth2Helper(oidc.NullStorage{}, issuer, tokenHMACKeyGetter, nil, timeoutsConfiguration, incomingProvider.TokenExchangeAudiences(), incomingProvider.TrustedJWTIssuers(), incomingProvider.Clients())
+
+			// For all the other endpoints, make another oauth helper with exactly the same settings except use real storage.
+			kubeStorage := oidc.NewKubeStorage(m.storageBackend, timeoutsConfiguration)
+			oauthHelperWithKubeStorage := oidc.FositeOauth2Helper(kubeStorage, issuer, tokenHMACKeyGetter, jwksProvider, timeoutsConfiguration, incomingProvider.TokenExchangeAudiences(), incomingProvider.TrustedJWTIssuers(), incomingProvider.Clients())
+
+			m.providerHandlers[(issuerHostWithPath + oidc.WellKnownEndpointPath)] = discovery.NewHandler(issuer, idpListGetter)
+
+			m.providerHandlers[(issuerHostWithPath + oidc.JWKSEndpointPath)] = jwks.NewHandler(issuer, jwksProvider)
+
+			m.providerHandlers[(issuerHostWithPath + oidc.AuthorizationEndpointPath)] = auth.NewHandler(
+				issuer,
+				idpListGetter,
+				oauthHelperWithNullStorage,
+				kubeStorage,
+				csrftoken.Generate,
+				pkce.Generate,
+				nonce.Generate,
+				upstreamStateEncoder,
+				csrfCookieEncoder,
+				renderer,
+			)
+
+			m.providerHandlers[(issuerHostWithPath + oidc.CallbackEndpointPath)] = callback.NewHandler(
+				issuer,
+				idpListGetter,
+				oauthHelperWithKubeStorage,
+				upstreamStateEncoder,
+				csrfCookieEncoder,
+				issuer+oidc.CallbackEndpointPath,
+				renderer,
+			)
+
+			m.providerHandlers[(issuerHostWithPath + oidc.TokenEndpointPath)] = token.NewHandler(
+				oauthHelperWithKubeStorage,
+				dpopValidator,
+				issuer+oidc.TokenEndpointPath,
+				incomingProvider.RequiresDPoP,
+			)
+
+			m.providerHandlers[(issuerHostWithPath + oidc.PushedAuthorizationRequestEndpointPath)] = par.NewHandler(
+				oauthHelperWithNullStorage,
+				kubeStorage,
+				par.GenerateReference,
+				timeoutsConfiguration.PushedAuthorizationRequestLifespan,
+			)
+
+			plog.Debug("oidc provider manager added or updated issuer", "issuer", issuer, "primaryIssuer", primaryIssuer)
+		}
 	}
 }
 
@@ -165,3 +215,36 @@ func wrapGetter(issuer string, getter func(string) []byte) func() []byte {
 		return getter(issuer)
 	}
 }
+
+func wrapKeyRingGetter(issuer string, getter func(string) [][]byte) func() [][]byte {
+	return func() [][]byte {
+		return getter(issuer)
+	}
+}
+
+// primaryIssuerJWKSProvider looks up the JWKS of the primary issuer of a FederationDomain for all of its alias
+// issuers, so that the tokens of all of the aliases are signed by the same keys.
+type primaryIssuerJWKSProvider struct {
+	jwks.DynamicJWKSProvider
+	primaryIssuer string
+}
+
+func (p *primaryIssuerJWKSProvider) GetJWKS(_ string) (*jose.JSONWebKeySet, *jose.JSONWebKey) {
+	return p.DynamicJWKSProvider.GetJWKS(p.primaryIssuer)
+}
+
+// filteredIDPListGetter returns only those upstream IDPs which may be used to log in to a FederationDomain.
+type filteredIDPListGetter struct {
+	oidc.IDPListGetter
+	names sets.String
+}
+
+func (g *filteredIDPListGetter) GetIDPList() []provider.UpstreamOIDCIdentityProviderI {
+	var filtered []provider.UpstreamOIDCIdentityProviderI
+	for _, idp := range g.IDPListGetter.GetIDPList() {
+		if g.names.Has(idp.GetName()) {
+			filtered = append(filtered, idp)
+		}
+	}
+	return filtered
+}
@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package manager
@@ -21,11 +21,13 @@ import (
 	"gopkg.in/square/go-jose.v2"
 	"k8s.io/client-go/kubernetes/fake"
 
+	"go.pinniped.dev/internal/crud"
 	"go.pinniped.dev/internal/here"
 	"go.pinniped.dev/internal/oidc"
 	"go.pinniped.dev/internal/oidc/discovery"
 	"go.pinniped.dev/internal/oidc/jwks"
 	"go.pinniped.dev/internal/oidc/oidctestutil"
+	"go.pinniped.dev/internal/oidc/pages"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/testutil"
 	"go.pinniped.dev/pkg/oidcclient/nonce"
@@ -48,6 +50,7 @@ func TestManager(t *testing.T) {
 			issuer1                      = "https://example.com/some/path"
 			issuer1DifferentCaseHostname = "https://eXamPle.coM/some/path"
 			issuer1KeyID                 = "issuer1-key"
+			issuer1Alias                 = "https://alias.example.com/some/other/path"
 			issuer2                      = "https://example.com/some/path/more/deeply/nested/path" // note that this is a sub-path of the other issuer url
 			issuer2DifferentCaseHostname = "https://exAmPlE.Com/some/path/more/deeply/nested/path"
 			issuer2KeyID                 = "issuer2-key"
@@ -189,7 +192,7 @@ func TestManager(t *testing.T) {
 			oidctestutil.VerifyECDSAIDToken(t, jwkIssuer, downstreamClientID, privateKey, idToken)
 
 			// Make sure that we wired up the callback endpoint to use kube storage for fosite sessions.
-			r.Equal(len(kubeClient.Actions()), numberOfKubeActionsBeforeThisRequest+8,
+			r.Equal(len(kubeClient.Actions()), numberOfKubeActionsBeforeThisRequest+9,
 				"did not perform any kube actions during the callback request, but should have")
 		}
 
@@ -244,17 +247,17 @@ func TestManager(t *testing.T) {
 			secretsClient := kubeClient.CoreV1().Secrets("some-namespace")
 
 			cache := secret.Cache{}
-			cache.SetCSRFCookieEncoderHashKey([]byte("fake-csrf-hash-secret"))
+			cache.SetCSRFCookieEncoderHashKeys([][]byte{[]byte("fake-csrf-hash-secret")})
 
 			cache.SetTokenHMACKey(issuer1, []byte("some secret 1 - must have at least 32 bytes"))
-			cache.SetStateEncoderHashKey(issuer1, []byte("some-state-encoder-hash-key-1"))
-			cache.SetStateEncoderBlockKey(issuer1, []byte("16-bytes-STATE01"))
+			cache.SetStateEncoderHashKeys(issuer1, [][]byte{[]byte("some-state-encoder-hash-key-1")})
+			cache.SetStateEncoderBlockKeys(issuer1, [][]byte{[]byte("16-bytes-STATE01")})
 
 			cache.SetTokenHMACKey(issuer2, []byte("some secret 2 - must have at least 32 bytes"))
-			cache.SetStateEncoderHashKey(issuer2, []byte("some-state-encoder-hash-key-2"))
-			cache.SetStateEncoderBlockKey(issuer2, []byte("16-bytes-STATE02"))
+			cache.SetStateEncoderHashKeys(issuer2, [][]byte{[]byte("some-state-encoder-hash-key-2")})
+			cache.SetStateEncoderBlockKeys(issuer2, [][]byte{[]byte("16-bytes-STATE02")})
 
-			subject = NewManager(nextHandler, dynamicJWKSProvider, idpListGetter, &cache, secretsClient)
+			subject = NewManager(nextHandler, dynamicJWKSProvider, pages.NewDynamicBrandingProvider(), idpListGetter, &cache, crud.NewSecretsBackend(secretsClient))
 		})
 
 		when("given no providers via SetProviders()", func() {
@@ -412,5 +415,91 @@ func TestManager(t *testing.T) {
 				requireRoutesMatchingRequestsToAppropriateProvider()
 			})
 		})
+
+		when("given a provider with alias issuers via SetProviders()", func() {
+			it.Before(func() {
+				p1, err := provider.NewFederationDomainIssuer(issuer1)
+				r.NoError(err)
+				alias, err := provider.NewFederationDomainIssuer(issuer1Alias)
+				r.NoError(err)
+				p1.SetAliases([]*provider.FederationDomainIssuer{alias})
+				subject.SetProviders(p1)
+
+				jwksMap := map[string]*jose.JSONWebKeySet{
+					issuer1: {Keys: []jose.JSONWebKey{*newTestJWK(issuer1KeyID)}},
+				}
+				activeJWK := map[string]*jose.JSONWebKey{
+					issuer1: newTestJWK(issuer1KeyID),
+				}
+				dynamicJWKSProvider.SetIssuerToJWKSMap(jwksMap, activeJWK)
+			})
+
+			it("routes requests for the alias to the provider using the alias as the issuer and the keys of the provider", func() {
+				requireDiscoveryRequestToBeHandled(issuer1, "", issuer1)
+				requireDiscoveryRequestToBeHandled(issuer1Alias, "", issuer1Alias)
+
+				issuer1JWKS := requireJWKSRequestToBeHandled(issuer1, "", issuer1KeyID)
+				requireJWKSRequestToBeHandled(issuer1Alias, "", issuer1KeyID)
+
+				authRequestParams := "?" + url.Values{
+					"response_type":         []string{"code"},
+					"scope":                 []string{"openid profile email"},
+					"client_id":             []string{downstreamClientID},
+					"state":                 []string{"some-state-value-with-enough-bytes-to-exceed-min-allowed"},
+					"nonce":                 []string{"some-nonce-value-with-enough-bytes-to-exceed-min-allowed"},
+					"code_challenge":        []string{testutil.SHA256(downstreamPKCECodeVerifier)},
+					"code_challenge_method": []string{"S256"},
+					"redirect_uri":          []string{downstreamRedirectURL},
+				}.Encode()
+
+				csrfCookieValue, upstreamStateParam :=
+					requireAuthorizationRequestToBeHandled(issuer1Alias, authRequestParams, upstreamIDPAuthorizationURL)
+				callbackRequestParams := "?" + url.Values{
+					"code":  []string{"some-fake-code"},
+					"state": []string{upstreamStateParam},
+				}.Encode()
+
+				downstreamAuthCode1 := requireCallbackRequestToBeHandled(issuer1Alias, callbackRequestParams, csrfCookieValue)
+				requireTokenRequestToBeHandled(issuer1Alias, downstreamAuthCode1, issuer1JWKS, issuer1Alias)
+
+				// The alias shares the storage and the keys of the provider, so the sessions which were started
+				// using the alias can be continued using the issuer of the provider.
+				downstreamAuthCode2 := requireCallbackRequestToBeHandled(issuer1Alias, callbackRequestParams, csrfCookieValue)
+				requireTokenRequestToBeHandled(issuer1, downstreamAuthCode2, issuer1JWKS, issuer1Alias)
+			})
+		})
+
+		when("given providers which select their upstream IDPs via SetProviders()", func() {
+			it.Before(func() {
+				p1, err := provider.NewFederationDomainIssuer(issuer1)
+				r.NoError(err)
+				p1.SetIdentityProviderNames([]string{"test-idp"})
+				p2, err := provider.NewFederationDomainIssuer(issuer2)
+				r.NoError(err)
+				p2.SetIdentityProviderNames([]string{"some-other-idp"})
+				subject.SetProviders(p1, p2)
+			})
+
+			it("lets each provider use only the upstream IDPs which it selected", func() {
+				authRequestParams := "?" + url.Values{
+					"response_type":         []string{"code"},
+					"scope":                 []string{"openid profile email"},
+					"client_id":             []string{downstreamClientID},
+					"state":                 []string{"some-state-value-with-enough-bytes-to-exceed-min-allowed"},
+					"nonce":                 []string{"some-nonce-value-with-enough-bytes-to-exceed-min-allowed"},
+					"code_challenge":        []string{testutil.SHA256(downstreamPKCECodeVerifier)},
+					"code_challenge_method": []string{"S256"},
+					"redirect_uri":          []string{downstreamRedirectURL},
+				}.Encode()
+
+				requireAuthorizationRequestToBeHandled(issuer1, authRequestParams, upstreamIDPAuthorizationURL)
+
+				recorder := httptest.NewRecorder()
+				subject.ServeHTTP(recorder, newGetRequest(issuer2+oidc.AuthorizationEndpointPath+authRequestParams))
+				r.False(fallbackHandlerWasCalled)
+				r.Equal(http.StatusUnprocessableEntity, recorder.Code)
+				r.Contains(recorder.Body.String(), "No upstream providers are configured")
+			})
+		})
 	})
 }
@@ -0,0 +1,110 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// signerJWTStrategy signs ES256 JWTs with a crypto.Signer instead of an *ecdsa.PrivateKey, so that the private key
+// does not need to be held by the Supervisor, and verifies them with the public key of the crypto.Signer.
+type signerJWTStrategy struct {
+	signer *ecdsaOpaqueSigner
+}
+
+// newSignerJWTStrategy returns a signerJWTStrategy for a signer whose public key is publicKey, which must be a P-256
+// key.
+func newSignerJWTStrategy(signer crypto.Signer, publicKey *ecdsa.PublicKey) *signerJWTStrategy {
+	return &signerJWTStrategy{signer: &ecdsaOpaqueSigner{signer: signer, publicKey: publicKey}}
+}
+
+// Generate returns a JWT of claims, which has the given additional headers.
+func (s *signerJWTStrategy) Generate(claims map[string]interface{}, headers map[string]interface{}) (string, error) {
+	opts := (&jose.SignerOptions{}).WithType("JWT")
+	for name, value := range headers {
+		opts = opts.WithHeader(jose.HeaderKey(name), value)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: s.signer}, opts)
+	if err != nil {
+		return "", fmt.Errorf("could not create JWT signer: %w", err)
+	}
+	// The claims are encoded by encoding/json rather than by go-jose, whose encoding of the float64 timestamps of
+	// fosite's claims uses exponents.
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("could not encode JWT claims: %w", err)
+	}
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		return "", fmt.Errorf("could not sign JWT: %w", err)
+	}
+	return jws.CompactSerialize()
+}
+
+// Decode returns the claims of a JWT which was signed by the crypto.Signer. Only the signature is verified, so the
+// claims may have expired.
+func (s *signerJWTStrategy) Decode(token string) (map[string]interface{}, error) {
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse JWT: %w", err)
+	}
+	claims := map[string]interface{}{}
+	if err := parsed.Claims(s.signer.publicKey, &claims); err != nil {
+		return nil, fmt.Errorf("could not verify JWT: %w", err)
+	}
+	return claims, nil
+}
+
+// ecdsaOpaqueSigner is a jose.OpaqueSigner which signs ES256 JWSs with a crypto.Signer.
+type ecdsaOpaqueSigner struct {
+	signer    crypto.Signer
+	publicKey *ecdsa.PublicKey
+}
+
+var _ jose.OpaqueSigner = &ecdsaOpaqueSigner{}
+
+func (s *ecdsaOpaqueSigner) Public() *jose.JSONWebKey {
+	return &jose.JSONWebKey{Key: s.publicKey, Algorithm: string(jose.ES256), Use: "sig"}
+}
+
+func (s *ecdsaOpaqueSigner) Algs() []jose.SignatureAlgorithm {
+	return []jose.SignatureAlgorithm{jose.ES256}
+}
+
+func (s *ecdsaOpaqueSigner) SignPayload(payload []byte, alg jose.SignatureAlgorithm) ([]byte, error) {
+	if alg != jose.ES256 {
+		return nil, fmt.Errorf("unsupported signature algorithm %q", alg)
+	}
+
+	digest := sha256.Sum256(payload)
+	asn1Signature, err := s.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("could not sign JWS: %w", err)
+	}
+
+	// crypto.Signer returns ECDSA signatures in ASN.1 form, but JWS needs the concatenation of the fixed-size R and S.
+	var parsed struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(asn1Signature, &parsed); err != nil {
+		return nil, fmt.Errorf("could not parse ECDSA signature: %w", err)
+	}
+	const size = 32 // the size of P-256 values
+	r, sBytes := parsed.R.Bytes(), parsed.S.Bytes()
+	if len(r) > size || len(sBytes) > size {
+		return nil, fmt.Errorf("ECDSA signature is too large for ES256")
+	}
+	rawSignature := make([]byte, 2*size)
+	copy(rawSignature[size-len(r):size], r)
+	copy(rawSignature[2*size-len(sBytes):], sBytes)
+	return rawSignature, nil
+}
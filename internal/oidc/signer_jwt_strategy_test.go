@@ -0,0 +1,83 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+
+	"go.pinniped.dev/internal/signer/plugin"
+	"go.pinniped.dev/internal/testutil/fakekms"
+)
+
+func TestSignerJWTStrategy(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherPrivateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	kmsSocket := fakekms.New(map[string]crypto.Signer{"some-key": privateKey}).Start(t)
+	pluginSigner, err := plugin.NewSigner(context.Background(), kmsSocket, "some-key")
+	require.NoError(t, err)
+
+	expired := float64(time.Now().Add(-time.Hour).Unix())
+	claims := map[string]interface{}{"sub": "some-subject", "exp": expired, "extra": []string{"a", "b"}}
+	headers := map[string]interface{}{"some-header": "some-value"}
+
+	for _, tt := range []struct {
+		name   string
+		signer crypto.Signer
+	}{
+		{name: "private key", signer: privateKey},
+		{name: "signing plugin", signer: pluginSigner},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			strategy := newSignerJWTStrategy(tt.signer, &privateKey.PublicKey)
+
+			token, err := strategy.Generate(claims, headers)
+			require.NoError(t, err)
+
+			jws, err := jose.ParseSigned(token)
+			require.NoError(t, err)
+			require.Len(t, jws.Signatures, 1)
+			header := jws.Signatures[0].Protected
+			require.Equal(t, "ES256", header.Algorithm)
+			require.Equal(t, "JWT", header.ExtraHeaders[jose.HeaderType])
+			require.Equal(t, "some-value", header.ExtraHeaders["some-header"])
+			payload, err := jws.Verify(&privateKey.PublicKey)
+			require.NoError(t, err)
+			// The timestamps are encoded without exponents, like other JWT libraries encode them.
+			require.JSONEq(t, `{"sub":"some-subject","exp":`+jsonNumber(t, expired)+`,"extra":["a","b"]}`, string(payload))
+
+			// The claims of expired JWTs can be decoded too.
+			decoded, err := strategy.Decode(token)
+			require.NoError(t, err)
+			require.Equal(t, map[string]interface{}{"sub": "some-subject", "exp": expired, "extra": []interface{}{"a", "b"}}, decoded)
+
+			_, err = newSignerJWTStrategy(otherPrivateKey, &otherPrivateKey.PublicKey).Decode(token)
+			require.EqualError(t, err, "could not verify JWT: square/go-jose: error in cryptographic primitive")
+
+			_, err = strategy.Decode("not-a-jwt")
+			require.Error(t, err)
+		})
+	}
+}
+
+func jsonNumber(t *testing.T, f float64) string {
+	t.Helper()
+	b, err := json.Marshal(f)
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "e+")
+	return string(b)
+}
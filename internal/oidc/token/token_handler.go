@@ -1,41 +1,99 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 // Package token provides a handler for the OIDC token endpoint.
 package token
 
 import (
+	"errors"
 	"net/http"
+	"strings"
 
 	"github.com/ory/fosite"
-	"github.com/ory/fosite/handler/openid"
 
 	"go.pinniped.dev/internal/httputil/httperr"
 	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/dpop"
 	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/psession"
+	clientdpop "go.pinniped.dev/pkg/oidcclient/dpop"
 )
 
+// NewHandler returns an http.Handler for the token endpoint. Tokens are bound to the key of the DPoP proof of the
+// request which issued them, when there is one, and tokens which are bound to a key may only be used along with a
+// DPoP proof signed by that key. Clients for which requiresDPoP returns true must always send a DPoP proof.
 func NewHandler(
 	oauthHelper fosite.OAuth2Provider,
+	dpopValidator *dpop.Validator,
+	tokenEndpointURL string,
+	requiresDPoP func(clientID string) bool,
 ) http.Handler {
 	return httperr.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
-		var session openid.DefaultSession
-		accessRequest, err := oauthHelper.NewAccessRequest(r.Context(), r, &session)
+		jkt, err := dpopValidator.Validate(r, tokenEndpointURL)
+		if err != nil {
+			plog.Info("token request dpop error", oidc.FositeErrorForLog(err)...)
+			if errors.Is(err, dpop.ErrUseDPoPNonce) {
+				w.Header().Set(clientdpop.NonceHeaderName, dpopValidator.Nonce())
+			}
+			oauthHelper.WriteAccessError(w, nil, err)
+			return nil
+		}
+		ctx := dpop.NewContext(r.Context(), jkt)
+
+		session := psession.NewPinnipedSession()
+		accessRequest, err := oauthHelper.NewAccessRequest(ctx, r, session)
 		if err != nil {
 			plog.Info("token request error", oidc.FositeErrorForLog(err)...)
 			oauthHelper.WriteAccessError(w, accessRequest, err)
 			return nil
 		}
 
-		accessResponse, err := oauthHelper.NewAccessResponse(r.Context(), accessRequest)
+		if err := bindToDPoPKey(accessRequest, jkt, requiresDPoP); err != nil {
+			plog.Info("token request dpop error", oidc.FositeErrorForLog(err)...)
+			oauthHelper.WriteAccessError(w, accessRequest, err)
+			return nil
+		}
+
+		accessResponse, err := oauthHelper.NewAccessResponse(ctx, accessRequest)
 		if err != nil {
 			plog.Info("token response error", oidc.FositeErrorForLog(err)...)
 			oauthHelper.WriteAccessError(w, accessRequest, err)
 			return nil
 		}
 
+		if jkt != "" {
+			// Access tokens which were issued to a DPoP proof are DPoP-bound rather than bearer tokens.
+			if strings.EqualFold(accessResponse.GetTokenType(), "bearer") {
+				accessResponse.SetTokenType(clientdpop.TokenType)
+			}
+			// Give the client the nonce for its next DPoP proof, so that it does not need an extra round trip.
+			w.Header().Set(clientdpop.NonceHeaderName, dpopValidator.Nonce())
+		}
+
 		oauthHelper.WriteAccessResponse(w, accessRequest, accessResponse)
 
 		return nil
 	})
 }
+
+// bindToDPoPKey checks that a token request which presents a DPoP-bound authorization grant has a DPoP proof signed
+// by the same key, and binds the session of the newly issued tokens to the key of the DPoP proof. Token exchanges
+// check the binding of their subject token themselves, since fosite does not load it until the response is created.
+func bindToDPoPKey(accessRequest fosite.AccessRequester, jkt string, requiresDPoP func(clientID string) bool) error {
+	if jkt == "" && requiresDPoP(accessRequest.GetClient().GetID()) {
+		return dpop.ErrInvalidDPoPProof.WithHint("The client must send a DPoP proof.")
+	}
+
+	session, ok := accessRequest.GetSession().(*psession.PinnipedSession)
+	if !ok {
+		return fosite.ErrServerError.WithHint("unexpected session type")
+	}
+	if session.Custom == nil {
+		session.Custom = &psession.CustomSessionData{}
+	}
+	if session.Custom.DPoPJKT != "" && session.Custom.DPoPJKT != jkt {
+		return dpop.ErrInvalidDPoPProof.WithHint("The DPoP proof must be signed by the key to which the grant is bound.")
+	}
+	session.Custom.DPoPJKT = jkt
+	return nil
+}
@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package token
@@ -27,6 +27,7 @@ import (
 	"github.com/ory/fosite/token/jwt"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/square/go-jose.v2"
 	josejwt "gopkg.in/square/go-jose.v2/jwt"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -37,14 +38,19 @@ import (
 	"go.pinniped.dev/internal/crud"
 	"go.pinniped.dev/internal/fositestorage/accesstoken"
 	"go.pinniped.dev/internal/fositestorage/authorizationcode"
+	"go.pinniped.dev/internal/fositestorage/dpopproof"
 	"go.pinniped.dev/internal/fositestorage/openidconnect"
 	storagepkce "go.pinniped.dev/internal/fositestorage/pkce"
 	"go.pinniped.dev/internal/fositestorage/refreshtoken"
 	"go.pinniped.dev/internal/here"
 	"go.pinniped.dev/internal/oidc"
+	"go.pinniped.dev/internal/oidc/dpop"
 	"go.pinniped.dev/internal/oidc/jwks"
 	"go.pinniped.dev/internal/oidc/oidctestutil"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/psession"
 	"go.pinniped.dev/internal/testutil"
+	clientdpop "go.pinniped.dev/pkg/oidcclient/dpop"
 )
 
 const (
@@ -56,6 +62,7 @@ const (
 	goodSubject          = "https://issuer?sub=some-subject"
 	goodUsername         = "some-username"
 	goodGroups           = "group1,groups2"
+	goodUpstreamName     = "some-upstream-idp-name"
 
 	hmacSecret = "this needs to be at least 32 characters to meet entropy requirements"
 
@@ -74,6 +81,11 @@ var (
 		return []byte(hmacSecret)
 	}
 
+	goodTokenExchangeAudiences = provider.TokenExchangeAudiences{
+		"some-api":                     {"openid", "pinniped:request-audience"},
+		"https://some-api.example.com": {"openid"},
+	}
+
 	fositeInvalidMethodErrorBody = func(actual string) string {
 		return here.Docf(`
 			{
@@ -584,13 +596,13 @@ func TestTokenEndpointWhenAuthcodeIsUsedTwice(t *testing.T) {
 			requireValidOIDCStorage(t, parsedResponseBody, authCode, oauthStore,
 				test.authcodeExchange.want.wantRequestedScopes, test.authcodeExchange.want.wantGrantedScopes)
 
-			// Check that the access token and refresh token storage were both deleted, and the number of other storage objects did not change.
+			// Check that the access token storage was deleted, the refresh token storage was revoked, and the number of other storage objects did not change.
 			testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: authorizationcode.TypeLabelValue}, 1)
 			testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: openidconnect.TypeLabelValue}, 1)
 			testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: accesstoken.TypeLabelValue}, 0)
-			testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: refreshtoken.TypeLabelValue}, 0)
+			testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: refreshtoken.TypeLabelValue, crud.SecretRevokedLabelKey: "true"}, 1)
 			testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: storagepkce.TypeLabelValue}, 0)
-			testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{}, 2)
+			testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{}, 3)
 		})
 	}
 }
@@ -619,6 +631,8 @@ func TestTokenExchange(t *testing.T) {
 
 		wantStatus               int
 		wantResponseBodyContains string
+		wantAccessToken          bool
+		wantScope                string
 	}{
 		{
 			name:              "happy path",
@@ -668,10 +682,141 @@ func TestTokenExchange(t *testing.T) {
 			authcodeExchange:  doValidAuthCodeExchange,
 			requestedAudience: "some-workload-cluster",
 			modifyRequestParams: func(t *testing.T, params url.Values) {
-				params.Set("resource", "some-resource-parameter-value")
+				params.Set("actor_token", "some-actor-token-parameter-value")
+			},
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `unsupported parameter actor_token`,
+		},
+		{
+			name:              "happy path with resource instead of audience",
+			authcodeExchange:  doValidAuthCodeExchange,
+			requestedAudience: "https://some-workload-cluster.example.com",
+			modifyRequestParams: func(t *testing.T, params url.Values) {
+				params.Set("resource", params.Get("audience"))
+				params.Del("audience")
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:              "happy path with equal resource and audience",
+			authcodeExchange:  doValidAuthCodeExchange,
+			requestedAudience: "https://some-workload-cluster.example.com",
+			modifyRequestParams: func(t *testing.T, params url.Values) {
+				params.Set("resource", params.Get("audience"))
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:              "different resource and audience",
+			authcodeExchange:  doValidAuthCodeExchange,
+			requestedAudience: "some-workload-cluster",
+			modifyRequestParams: func(t *testing.T, params url.Values) {
+				params.Set("resource", "https://some-other-workload-cluster.example.com")
 			},
 			wantStatus:               http.StatusBadRequest,
-			wantResponseBodyContains: `unsupported parameter resource`,
+			wantResponseBodyContains: `audience and resource parameters must be equal when both are sent`,
+		},
+		{
+			name:              "resource is not an absolute URI",
+			authcodeExchange:  doValidAuthCodeExchange,
+			requestedAudience: "",
+			modifyRequestParams: func(t *testing.T, params url.Values) {
+				params.Set("resource", "some-workload-cluster")
+			},
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `resource parameter must be an absolute URI without a fragment`,
+		},
+		{
+			name:              "resource has a fragment",
+			authcodeExchange:  doValidAuthCodeExchange,
+			requestedAudience: "",
+			modifyRequestParams: func(t *testing.T, params url.Values) {
+				params.Set("resource", "https://some-workload-cluster.example.com#fragment")
+			},
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `resource parameter must be an absolute URI without a fragment`,
+		},
+		{
+			name:              "downscoped ID token for a configured audience with all allowed scopes",
+			authcodeExchange:  doValidAuthCodeExchange,
+			requestedAudience: "some-api",
+			wantStatus:        http.StatusOK,
+			wantScope:         "openid pinniped:request-audience",
+		},
+		{
+			name:              "downscoped ID token for a configured audience with requested scopes",
+			authcodeExchange:  doValidAuthCodeExchange,
+			requestedAudience: "some-api",
+			modifyRequestParams: func(t *testing.T, params url.Values) {
+				params.Set("scope", "openid")
+			},
+			wantStatus: http.StatusOK,
+			wantScope:  "openid",
+		},
+		{
+			name:              "scopes requested for an audience which is not configured",
+			authcodeExchange:  doValidAuthCodeExchange,
+			requestedAudience: "some-workload-cluster",
+			modifyRequestParams: func(t *testing.T, params url.Values) {
+				params.Set("scope", "openid")
+			},
+			wantStatus:               http.StatusForbidden,
+			wantResponseBodyContains: `does not allow access tokens or scopes`,
+		},
+		{
+			name:              "requested scope was not granted to the subject_token",
+			authcodeExchange:  doValidAuthCodeExchange,
+			requestedAudience: "some-api",
+			modifyRequestParams: func(t *testing.T, params url.Values) {
+				params.Set("scope", "openid offline_access")
+			},
+			wantStatus:               http.StatusForbidden,
+			wantResponseBodyContains: `the subject_token was not granted the 'offline_access' scope`,
+		},
+		{
+			name:              "requested scope is not allowed for the audience",
+			authcodeExchange:  doValidAuthCodeExchange,
+			requestedAudience: "https://some-api.example.com",
+			modifyRequestParams: func(t *testing.T, params url.Values) {
+				params.Set("scope", "openid pinniped:request-audience")
+			},
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `the 'pinniped:request-audience' scope is not allowed for audience 'https://some-api.example.com'`,
+		},
+		{
+			name:              "access token for a configured audience",
+			authcodeExchange:  doValidAuthCodeExchange,
+			requestedAudience: "some-api",
+			modifyRequestParams: func(t *testing.T, params url.Values) {
+				params.Set("requested_token_type", "urn:ietf:params:oauth:token-type:access_token")
+			},
+			wantStatus:      http.StatusOK,
+			wantAccessToken: true,
+			wantScope:       "openid pinniped:request-audience",
+		},
+		{
+			name:              "access token for a configured resource with requested scopes",
+			authcodeExchange:  doValidAuthCodeExchange,
+			requestedAudience: "https://some-api.example.com",
+			modifyRequestParams: func(t *testing.T, params url.Values) {
+				params.Set("resource", params.Get("audience"))
+				params.Del("audience")
+				params.Set("scope", "openid")
+				params.Set("requested_token_type", "urn:ietf:params:oauth:token-type:access_token")
+			},
+			wantStatus:      http.StatusOK,
+			wantAccessToken: true,
+			wantScope:       "openid",
+		},
+		{
+			name:              "access token for an audience which is not configured",
+			authcodeExchange:  doValidAuthCodeExchange,
+			requestedAudience: "some-workload-cluster",
+			modifyRequestParams: func(t *testing.T, params url.Values) {
+				params.Set("requested_token_type", "urn:ietf:params:oauth:token-type:access_token")
+			},
+			wantStatus:               http.StatusForbidden,
+			wantResponseBodyContains: `does not allow access tokens or scopes`,
 		},
 		{
 			name:              "bogus access token",
@@ -798,6 +943,35 @@ func TestTokenExchange(t *testing.T) {
 			require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &responseBody))
 
 			require.Contains(t, responseBody, "access_token")
+			if test.wantScope != "" {
+				require.Equal(t, test.wantScope, responseBody["scope"])
+			} else {
+				require.NotContains(t, responseBody, "scope")
+			}
+
+			if test.wantAccessToken {
+				require.Equal(t, "Bearer", responseBody["token_type"])
+				require.Equal(t, "urn:ietf:params:oauth:token-type:access_token", responseBody["issued_token_type"])
+				require.InDelta(t, accessTokenExpirationSeconds, responseBody["expires_in"], timeComparisonFudgeSeconds)
+
+				// Assert that only the new access token was added to storage.
+				newSecrets, err := secrets.List(context.Background(), metav1.ListOptions{})
+				require.NoError(t, err)
+				require.Len(t, newSecrets.Items, len(existingSecrets.Items)+1)
+				testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: accesstoken.TypeLabelValue}, 2)
+
+				// The new access token carries its granted scopes and audience, and shares the request ID of the
+				// original session so that it is revoked along with it.
+				newAccessTokenRequester, err := storage.GetAccessTokenSession(context.Background(), getFositeDataSignature(t, responseBody["access_token"].(string)), nil)
+				require.NoError(t, err)
+				originalAccessTokenRequester, err := storage.GetAccessTokenSession(context.Background(), getFositeDataSignature(t, parsedAuthcodeExchangeResponseBody["access_token"].(string)), nil)
+				require.NoError(t, err)
+				require.Equal(t, originalAccessTokenRequester.GetID(), newAccessTokenRequester.GetID())
+				require.Equal(t, strings.Split(test.wantScope, " "), []string(newAccessTokenRequester.GetGrantedScopes()))
+				require.Equal(t, []string{test.requestedAudience}, []string(newAccessTokenRequester.GetGrantedAudience()))
+				return
+			}
+
 			require.Equal(t, "N_A", responseBody["token_type"])
 			require.Equal(t, "urn:ietf:params:oauth:token-type:jwt", responseBody["issued_token_type"])
 
@@ -847,11 +1021,678 @@ func TestTokenExchange(t *testing.T) {
 	}
 }
 
+func TestTokenExchangeOfDownscopedAccessToken(t *testing.T) {
+	subject, rsp, _, _, _, _ := exchangeAuthcodeForTokens(t, authcodeExchangeInputs{
+		modifyAuthRequest: func(authRequest *http.Request) {
+			authRequest.Form.Set("scope", "openid pinniped:request-audience")
+		},
+		want: tokenEndpointResponseExpectedValues{
+			wantStatus:            http.StatusOK,
+			wantSuccessBodyFields: []string{"id_token", "access_token", "token_type", "expires_in", "scope"},
+			wantRequestedScopes:   []string{"openid", "pinniped:request-audience"},
+			wantGrantedScopes:     []string{"openid", "pinniped:request-audience"},
+		},
+	})
+	var responseBody map[string]interface{}
+	require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &responseBody))
+
+	exchange := func(subjectToken, audience, requestedTokenType string) (int, map[string]interface{}) {
+		request := happyTokenExchangeRequest(audience, subjectToken)
+		request.Form.Set("requested_token_type", requestedTokenType)
+		req := httptest.NewRequest("POST", "/path/shouldn't/matter", body(request.Form).ReadCloser())
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rsp := httptest.NewRecorder()
+		subject.ServeHTTP(rsp, req)
+		t.Logf("response body: %q", rsp.Body.String())
+		var responseBody map[string]interface{}
+		require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &responseBody))
+		return rsp.Code, responseBody
+	}
+
+	// The access token for "some-api" is granted the pinniped:request-audience scope, because that audience allows it.
+	status, downscoped := exchange(responseBody["access_token"].(string), "some-api", "urn:ietf:params:oauth:token-type:access_token")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "openid pinniped:request-audience", downscoped["scope"])
+	downscopedAccessToken := downscoped["access_token"].(string)
+
+	// It still may not be exchanged for tokens for any other audience.
+	for _, test := range []struct {
+		audience           string
+		requestedTokenType string
+	}{
+		{audience: "https://some-api.example.com", requestedTokenType: "urn:ietf:params:oauth:token-type:access_token"},
+		{audience: "https://some-api.example.com", requestedTokenType: "urn:ietf:params:oauth:token-type:jwt"},
+		{audience: "some-workload-cluster", requestedTokenType: "urn:ietf:params:oauth:token-type:jwt"},
+	} {
+		status, responseBody := exchange(downscopedAccessToken, test.audience, test.requestedTokenType)
+		require.Equal(t, http.StatusForbidden, status, test.audience)
+		require.Equal(t, "access_denied", responseBody["error"])
+		require.Contains(t, responseBody["error_description"], "the subject_token was not issued for audience '"+test.audience+"'")
+	}
+
+	// It may be exchanged for an ID token for its own audience.
+	status, responseBody = exchange(downscopedAccessToken, "some-api", "urn:ietf:params:oauth:token-type:jwt")
+	require.Equal(t, http.StatusOK, status)
+	parsedJWT, err := jose.ParseSigned(responseBody["access_token"].(string))
+	require.NoError(t, err)
+	var claims map[string]interface{}
+	require.NoError(t, json.Unmarshal(parsedJWT.UnsafePayloadWithoutVerification(), &claims))
+	require.Equal(t, []interface{}{"some-api"}, claims["aud"])
+}
+
+func TestTokenExchangeWithTrustedJWTIssuer(t *testing.T) {
+	const (
+		externalIssuer   = "https://ci.example.com"
+		externalAudience = "pinniped-supervisor"
+		externalKeyID    = "some-external-key-id"
+	)
+
+	externalSigningKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherSigningKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	caBundle, jwksServerURL := testutil.TLSTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/jwks.json", r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+			Key:       &externalSigningKey.PublicKey,
+			KeyID:     externalKeyID,
+			Algorithm: string(jose.ES256),
+			Use:       "sig",
+		}}}))
+	})
+
+	trustedJWTIssuer := provider.TrustedJWTIssuer{
+		Issuer:          externalIssuer,
+		JWKSURL:         jwksServerURL + "/jwks.json",
+		CABundle:        []byte(caBundle),
+		Audience:        externalAudience,
+		UsernameClaim:   "actor",
+		GroupsClaim:     "teams",
+		UsernamePrefix:  "ci:",
+		GroupsPrefix:    "ci-team:",
+		AllowedSubjects: []string{"repo:acme/app:*", "some-exact-subject"},
+	}
+
+	signJWT := func(t *testing.T, key *ecdsa.PrivateKey, claims map[string]interface{}) string {
+		signer, err := jose.NewSigner(
+			jose.SigningKey{Algorithm: jose.ES256, Key: key},
+			(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", externalKeyID),
+		)
+		require.NoError(t, err)
+		token, err := josejwt.Signed(signer).Claims(claims).CompactSerialize()
+		require.NoError(t, err)
+		return token
+	}
+
+	happyClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":   externalIssuer,
+			"sub":   "repo:acme/app:ref:refs/heads/main",
+			"aud":   externalAudience,
+			"iat":   time.Now().Unix(),
+			"exp":   time.Now().Add(5 * time.Minute).Unix(),
+			"actor": "some-ci-bot",
+			"teams": []string{"some-team", "some-other-team"},
+		}
+	}
+
+	tests := []struct {
+		name                   string
+		signingKey             *ecdsa.PrivateKey
+		modifyClaims           func(claims map[string]interface{})
+		modifyRequestParams    func(params url.Values)
+		modifyTrustedJWTIssuer func(issuer *provider.TrustedJWTIssuer)
+
+		wantStatus               int
+		wantResponseBodyContains string
+		wantSubject              string
+		wantUsername             string
+		wantGroups               []interface{}
+	}{
+		{
+			name:         "happy path with a subject which matches a prefix",
+			wantStatus:   http.StatusOK,
+			wantSubject:  externalIssuer + "?sub=repo:acme/app:ref:refs/heads/main",
+			wantUsername: "ci:some-ci-bot",
+			wantGroups:   []interface{}{"ci-team:some-team", "ci-team:some-other-team"},
+		},
+		{
+			name: "happy path without prefixes",
+			modifyTrustedJWTIssuer: func(issuer *provider.TrustedJWTIssuer) {
+				issuer.UsernamePrefix = ""
+				issuer.GroupsPrefix = ""
+			},
+			wantStatus:   http.StatusOK,
+			wantSubject:  externalIssuer + "?sub=repo:acme/app:ref:refs/heads/main",
+			wantUsername: "some-ci-bot",
+			wantGroups:   []interface{}{"some-team", "some-other-team"},
+		},
+		{
+			name: "happy path without a username claim",
+			modifyTrustedJWTIssuer: func(issuer *provider.TrustedJWTIssuer) {
+				issuer.UsernameClaim = ""
+			},
+			wantStatus:   http.StatusOK,
+			wantSubject:  externalIssuer + "?sub=repo:acme/app:ref:refs/heads/main",
+			wantUsername: externalIssuer + "?sub=repo:acme/app:ref:refs/heads/main",
+			wantGroups:   []interface{}{"ci-team:some-team", "ci-team:some-other-team"},
+		},
+		{
+			name: "happy path with a subject which matches exactly and without groups",
+			modifyClaims: func(claims map[string]interface{}) {
+				claims["sub"] = "some-exact-subject"
+				delete(claims, "teams")
+			},
+			wantStatus:   http.StatusOK,
+			wantSubject:  externalIssuer + "?sub=some-exact-subject",
+			wantUsername: "ci:some-ci-bot",
+			wantGroups:   []interface{}{},
+		},
+		{
+			name: "subject is not allowed",
+			modifyClaims: func(claims map[string]interface{}) {
+				claims["sub"] = "repo:acme/other-app:ref:refs/heads/main"
+			},
+			wantStatus:               http.StatusForbidden,
+			wantResponseBodyContains: `the subject 'repo:acme/other-app:ref:refs/heads/main' of the subject_token is not allowed`,
+		},
+		{
+			name: "issuer is not trusted",
+			modifyClaims: func(claims map[string]interface{}) {
+				claims["iss"] = "https://untrusted.example.com"
+			},
+			wantStatus:               http.StatusForbidden,
+			wantResponseBodyContains: `the issuer 'https://untrusted.example.com' of the subject_token is not trusted`,
+		},
+		{
+			name: "wrong audience",
+			modifyClaims: func(claims map[string]interface{}) {
+				claims["aud"] = "some-other-audience"
+			},
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `invalid subject_token`,
+		},
+		{
+			name: "expired",
+			modifyClaims: func(claims map[string]interface{}) {
+				claims["exp"] = time.Now().Add(-1 * time.Minute).Unix()
+			},
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `invalid subject_token`,
+		},
+		{
+			name:                     "signed by an unknown key",
+			signingKey:               otherSigningKey,
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `invalid subject_token`,
+		},
+		{
+			name: "missing username claim",
+			modifyClaims: func(claims map[string]interface{}) {
+				delete(claims, "actor")
+			},
+			wantStatus:               http.StatusForbidden,
+			wantResponseBodyContains: `the subject_token is missing the 'actor' username claim`,
+		},
+		{
+			name: "groups claim has invalid format",
+			modifyClaims: func(claims map[string]interface{}) {
+				claims["teams"] = 42
+			},
+			wantStatus:               http.StatusForbidden,
+			wantResponseBodyContains: `the 'teams' groups claim of the subject_token has invalid format`,
+		},
+		{
+			name: "not a JWT",
+			modifyRequestParams: func(params url.Values) {
+				params.Set("subject_token", "some-bogus-value")
+			},
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `invalid subject_token`,
+		},
+		{
+			name: "access token requested",
+			modifyRequestParams: func(params url.Values) {
+				params.Set("requested_token_type", "urn:ietf:params:oauth:token-type:access_token")
+			},
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `requested_token_type must be 'urn:ietf:params:oauth:token-type:jwt'`,
+		},
+		{
+			name: "scopes requested",
+			modifyRequestParams: func(params url.Values) {
+				params.Set("scope", "openid")
+			},
+			wantStatus:               http.StatusBadRequest,
+			wantResponseBodyContains: `scope parameter is not supported`,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			trustedJWTIssuer := trustedJWTIssuer
+			if test.modifyTrustedJWTIssuer != nil {
+				test.modifyTrustedJWTIssuer(&trustedJWTIssuer)
+			}
+
+			secrets := fake.NewSimpleClientset().CoreV1().Secrets("some-namespace")
+			_, jwkProvider := generateJWTSigningKeyAndJWKSProvider(t, goodIssuer)
+			oauthHelper := oidc.FositeOauth2Helper(
+				oidc.NewKubeStorage(crud.NewSecretsBackend(secrets), oidc.DefaultOIDCTimeoutsConfiguration()),
+				goodIssuer,
+				hmacSecretFunc,
+				jwkProvider,
+				oidc.DefaultOIDCTimeoutsConfiguration(),
+				goodTokenExchangeAudiences,
+				[]*provider.TrustedJWTIssuer{&trustedJWTIssuer},
+				nil,
+			)
+			subject := newHandlerWithoutRequiredDPoP(oauthHelper)
+
+			claims := happyClaims()
+			if test.modifyClaims != nil {
+				test.modifyClaims(claims)
+			}
+			signingKey := externalSigningKey
+			if test.signingKey != nil {
+				signingKey = test.signingKey
+			}
+			request := happyTokenExchangeRequest("some-workload-cluster", signJWT(t, signingKey, claims))
+			request.Form.Set("subject_token_type", "urn:ietf:params:oauth:token-type:jwt")
+			if test.modifyRequestParams != nil {
+				test.modifyRequestParams(request.Form)
+			}
+
+			req := httptest.NewRequest("POST", "/path/shouldn't/matter", body(request.Form).ReadCloser())
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rsp := httptest.NewRecorder()
+
+			subject.ServeHTTP(rsp, req)
+			t.Logf("response: %#v", rsp)
+			t.Logf("response body: %q", rsp.Body.String())
+
+			require.Equal(t, test.wantStatus, rsp.Code)
+			testutil.RequireEqualContentType(t, rsp.Header().Get("Content-Type"), "application/json")
+			if test.wantResponseBodyContains != "" {
+				require.Contains(t, rsp.Body.String(), test.wantResponseBodyContains)
+			}
+
+			// Nothing is ever stored for an externally-issued JWT.
+			testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{}, 0)
+
+			if rsp.Code != http.StatusOK {
+				return
+			}
+
+			var responseBody map[string]interface{}
+			require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &responseBody))
+			require.Equal(t, "N_A", responseBody["token_type"])
+			require.Equal(t, "urn:ietf:params:oauth:token-type:jwt", responseBody["issued_token_type"])
+
+			parsedJWT, err := jose.ParseSigned(responseBody["access_token"].(string))
+			require.NoError(t, err)
+			var tokenClaims map[string]interface{}
+			require.NoError(t, json.Unmarshal(parsedJWT.UnsafePayloadWithoutVerification(), &tokenClaims))
+
+			require.Equal(t, goodIssuer, tokenClaims["iss"])
+			require.Equal(t, []interface{}{"some-workload-cluster"}, tokenClaims["aud"])
+			require.Equal(t, test.wantSubject, tokenClaims["sub"])
+			require.Equal(t, test.wantUsername, tokenClaims["username"])
+			require.Equal(t, test.wantGroups, tokenClaims["groups"])
+			require.NotEmpty(t, tokenClaims["exp"])
+			require.NotEmpty(t, tokenClaims["iat"])
+			require.NotEmpty(t, tokenClaims["jti"])
+		})
+	}
+}
+
 type refreshRequestInputs struct {
 	modifyTokenRequest func(tokenRequest *http.Request, refreshToken string, accessToken string)
 	want               tokenEndpointResponseExpectedValues
 }
 
+func TestClientCredentialsGrant(t *testing.T) {
+	const (
+		clientID     = "some-automation-client"
+		clientSecret = "some-client-secret"
+	)
+
+	secretHash, err := bcrypt.GenerateFromPassword([]byte(clientSecret), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	clients := []*provider.Client{{
+		ID:               clientID,
+		SecretHash:       secretHash,
+		Username:         "some-service-account",
+		Groups:           []string{"automation", "deployers"},
+		AllowedScopes:    []string{"openid", "pinniped:request-audience", "some-api-scope"},
+		AllowedAudiences: []string{"some-api"},
+	}}
+
+	tests := []struct {
+		name         string
+		clientID     string
+		clientSecret string
+		params       url.Values
+
+		wantStatus               int
+		wantErrorType            string
+		wantResponseBodyContains string
+		wantScope                string
+	}{
+		{
+			name:         "happy path",
+			clientID:     clientID,
+			clientSecret: clientSecret,
+			params:       url.Values{"grant_type": {"client_credentials"}, "scope": {"openid pinniped:request-audience"}},
+			wantStatus:   http.StatusOK,
+			wantScope:    "openid pinniped:request-audience",
+		},
+		{
+			name:         "happy path with an allowed audience",
+			clientID:     clientID,
+			clientSecret: clientSecret,
+			params:       url.Values{"grant_type": {"client_credentials"}, "scope": {"some-api-scope"}, "audience": {"some-api"}},
+			wantStatus:   http.StatusOK,
+			wantScope:    "some-api-scope",
+		},
+		{
+			name:          "scope is not allowed for the client",
+			clientID:      clientID,
+			clientSecret:  clientSecret,
+			params:        url.Values{"grant_type": {"client_credentials"}, "scope": {"openid offline_access"}},
+			wantStatus:    http.StatusBadRequest,
+			wantErrorType: "invalid_scope",
+		},
+		{
+			name:                     "audience is not allowed for the client",
+			clientID:                 clientID,
+			clientSecret:             clientSecret,
+			params:                   url.Values{"grant_type": {"client_credentials"}, "audience": {"some-other-api"}},
+			wantStatus:               http.StatusBadRequest,
+			wantErrorType:            "invalid_request",
+			wantResponseBodyContains: "some-other-api",
+		},
+		{
+			name:          "wrong client secret",
+			clientID:      clientID,
+			clientSecret:  "some-wrong-secret",
+			params:        url.Values{"grant_type": {"client_credentials"}},
+			wantStatus:    http.StatusUnauthorized,
+			wantErrorType: "invalid_client",
+		},
+		{
+			name:          "unknown client",
+			clientID:      "some-unknown-client",
+			clientSecret:  clientSecret,
+			params:        url.Values{"grant_type": {"client_credentials"}},
+			wantStatus:    http.StatusUnauthorized,
+			wantErrorType: "invalid_client",
+		},
+		{
+			name:          "public client",
+			params:        url.Values{"grant_type": {"client_credentials"}, "client_id": {goodClient}},
+			wantStatus:    http.StatusBadRequest,
+			wantErrorType: "invalid_grant",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			secrets := fake.NewSimpleClientset().CoreV1().Secrets("some-namespace")
+			_, jwkProvider := generateJWTSigningKeyAndJWKSProvider(t, goodIssuer)
+			oauthHelper := oidc.FositeOauth2Helper(
+				oidc.NewKubeStorage(crud.NewSecretsBackend(secrets), oidc.DefaultOIDCTimeoutsConfiguration()),
+				goodIssuer,
+				hmacSecretFunc,
+				jwkProvider,
+				oidc.DefaultOIDCTimeoutsConfiguration(),
+				goodTokenExchangeAudiences,
+				nil,
+				clients,
+			)
+			subject := newHandlerWithoutRequiredDPoP(oauthHelper)
+
+			req := httptest.NewRequest("POST", "/path/shouldn't/matter", strings.NewReader(test.params.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if test.clientID != "" {
+				req.SetBasicAuth(url.QueryEscape(test.clientID), url.QueryEscape(test.clientSecret))
+			}
+			rsp := httptest.NewRecorder()
+
+			subject.ServeHTTP(rsp, req)
+			t.Logf("response: %#v", rsp)
+			t.Logf("response body: %q", rsp.Body.String())
+
+			require.Equal(t, test.wantStatus, rsp.Code)
+			testutil.RequireEqualContentType(t, rsp.Header().Get("Content-Type"), "application/json")
+
+			var responseBody map[string]interface{}
+			require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &responseBody))
+
+			if rsp.Code != http.StatusOK {
+				require.Equal(t, test.wantErrorType, responseBody["error"])
+				if test.wantResponseBodyContains != "" {
+					require.Contains(t, rsp.Body.String(), test.wantResponseBodyContains)
+				}
+				testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{}, 0)
+				return
+			}
+
+			require.Equal(t, "bearer", responseBody["token_type"])
+			require.Equal(t, test.wantScope, responseBody["scope"])
+			require.NotEmpty(t, responseBody["access_token"])
+			require.NotContains(t, responseBody, "refresh_token")
+			require.NotContains(t, responseBody, "id_token")
+			testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: accesstoken.TypeLabelValue}, 1)
+			testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{}, 1)
+
+			if !strings.Contains(test.wantScope, "pinniped:request-audience") {
+				return
+			}
+
+			// The access token cannot be exchanged for an audience which the client is not allowed to request, even
+			// though it was issued without any audience.
+			request := happyTokenExchangeRequest("some-workload-cluster", responseBody["access_token"].(string))
+			req = httptest.NewRequest("POST", "/path/shouldn't/matter", body(request.Form).ReadCloser())
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rsp = httptest.NewRecorder()
+			subject.ServeHTTP(rsp, req)
+			t.Logf("token exchange response body: %q", rsp.Body.String())
+			require.Equal(t, http.StatusForbidden, rsp.Code)
+			require.Contains(t, rsp.Body.String(), `the subject_token was not issued for audience 'some-workload-cluster'`)
+
+			// The access token can be exchanged for an ID token for an allowed audience, which represents the service
+			// identity of the client.
+			request = happyTokenExchangeRequest("some-api", responseBody["access_token"].(string))
+			req = httptest.NewRequest("POST", "/path/shouldn't/matter", body(request.Form).ReadCloser())
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rsp = httptest.NewRecorder()
+			subject.ServeHTTP(rsp, req)
+			t.Logf("token exchange response body: %q", rsp.Body.String())
+			require.Equal(t, http.StatusOK, rsp.Code)
+
+			var exchangeResponseBody map[string]interface{}
+			require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &exchangeResponseBody))
+			parsedJWT, err := jose.ParseSigned(exchangeResponseBody["access_token"].(string))
+			require.NoError(t, err)
+			var tokenClaims map[string]interface{}
+			require.NoError(t, json.Unmarshal(parsedJWT.UnsafePayloadWithoutVerification(), &tokenClaims))
+
+			require.Equal(t, goodIssuer, tokenClaims["iss"])
+			require.Equal(t, []interface{}{"some-api"}, tokenClaims["aud"])
+			require.Equal(t, goodIssuer+"?client_id="+clientID, tokenClaims["sub"])
+			require.Equal(t, "some-service-account", tokenClaims["username"])
+			require.Equal(t, []interface{}{"automation", "deployers"}, tokenClaims["groups"])
+		})
+	}
+}
+
+func TestAuthcodeGrantForConfidentialClients(t *testing.T) {
+	const clientSecret = "some-client-secret"
+
+	secretHash, err := bcrypt.GenerateFromPassword([]byte(clientSecret), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	clients := []*provider.Client{
+		{
+			ID:            "some-web-app",
+			SecretHash:    secretHash,
+			RedirectURIs:  []string{"https://some-web-app.com/callback"},
+			AllowedScopes: []string{"openid", "offline_access", "pinniped:request-audience"},
+		},
+		{
+			ID:               "some-pairwise-web-app",
+			SecretHash:       secretHash,
+			RedirectURIs:     []string{"https://some-pairwise-web-app.com/callback"},
+			AllowedScopes:    []string{"openid", "offline_access", "pinniped:request-audience"},
+			SectorIdentifier: "some-sector",
+		},
+	}
+
+	tests := []struct {
+		name        string
+		client      *provider.Client
+		scope       string
+		wantSubject string
+
+		wantTokenExchangeStatus    int
+		wantTokenExchangeErrorType string
+	}{
+		{
+			name:                    "client with public subjects",
+			client:                  clients[0],
+			scope:                   "openid offline_access pinniped:request-audience",
+			wantSubject:             goodSubject,
+			wantTokenExchangeStatus: http.StatusOK,
+		},
+		{
+			name:                       "client with pairwise subjects",
+			client:                     clients[1],
+			scope:                      "openid offline_access",
+			wantSubject:                oidc.PairwiseSubject(hmacSecretFunc(), "some-sector", goodSubject),
+			wantTokenExchangeStatus:    http.StatusBadRequest,
+			wantTokenExchangeErrorType: "unauthorized_client",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			secrets := fake.NewSimpleClientset().CoreV1().Secrets("some-namespace")
+			_, jwkProvider := generateJWTSigningKeyAndJWKSProvider(t, goodIssuer)
+			oauthHelper := oidc.FositeOauth2Helper(
+				oidc.NewKubeStorage(crud.NewSecretsBackend(secrets), oidc.DefaultOIDCTimeoutsConfiguration()),
+				goodIssuer,
+				hmacSecretFunc,
+				jwkProvider,
+				oidc.DefaultOIDCTimeoutsConfiguration(),
+				goodTokenExchangeAudiences,
+				nil,
+				clients,
+			)
+			subject := newHandlerWithoutRequiredDPoP(oauthHelper)
+
+			post := func(form url.Values, clientID string) (int, map[string]interface{}) {
+				req := httptest.NewRequest("POST", "/path/shouldn't/matter", strings.NewReader(form.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				if clientID != "" {
+					req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+				}
+				rsp := httptest.NewRecorder()
+				subject.ServeHTTP(rsp, req)
+				t.Logf("response body: %q", rsp.Body.String())
+				var responseBody map[string]interface{}
+				require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &responseBody))
+				return rsp.Code, responseBody
+			}
+			requireIDTokenClaims := func(idToken string) {
+				parsedJWT, err := jose.ParseSigned(idToken)
+				require.NoError(t, err)
+				var claims map[string]interface{}
+				require.NoError(t, json.Unmarshal(parsedJWT.UnsafePayloadWithoutVerification(), &claims))
+				require.Equal(t, test.wantSubject, claims["sub"])
+				require.Equal(t, []interface{}{test.client.ID}, claims["aud"])
+				require.Equal(t, goodUsername, claims["username"])
+			}
+
+			authRequest := deepCopyRequestForm(happyAuthRequest)
+			authRequest.Form.Set("client_id", test.client.ID)
+			authRequest.Form.Set("redirect_uri", test.client.RedirectURIs[0])
+			authRequest.Form.Set("scope", test.scope)
+			authCode := simulateAuthEndpointHavingAlreadyRun(t, authRequest, oauthHelper).GetCode()
+
+			authcodeRequest := url.Values(happyAuthcodeRequestBody(authCode).WithClientID("").WithRedirectURI(test.client.RedirectURIs[0]))
+
+			// The client must authenticate.
+			status, responseBody := post(authcodeRequest, "")
+			require.Equal(t, http.StatusBadRequest, status)
+			require.Equal(t, "invalid_request", responseBody["error"])
+
+			status, responseBody = post(authcodeRequest, test.client.ID)
+			require.Equal(t, http.StatusOK, status)
+			require.Equal(t, test.scope, responseBody["scope"])
+			requireIDTokenClaims(responseBody["id_token"].(string))
+
+			status, responseBody = post(url.Values(happyRefreshRequestBody(responseBody["refresh_token"].(string)).WithClientID("")), test.client.ID)
+			require.Equal(t, http.StatusOK, status)
+			requireIDTokenClaims(responseBody["id_token"].(string))
+			accessToken := responseBody["access_token"].(string)
+
+			// The ID tokens of the token exchange have the public subject.
+			tokenExchangeRequest := happyTokenExchangeRequest("some-workload-cluster", accessToken).Form
+			tokenExchangeRequest.Del("client_id")
+			status, responseBody = post(tokenExchangeRequest, test.client.ID)
+			require.Equal(t, test.wantTokenExchangeStatus, status)
+			if test.wantTokenExchangeErrorType != "" {
+				require.Equal(t, test.wantTokenExchangeErrorType, responseBody["error"])
+
+				// Another client may not exchange the tokens of the client either, since they cannot have the scope.
+				status, responseBody = post(happyTokenExchangeRequest("some-workload-cluster", accessToken).Form, "")
+				require.Equal(t, http.StatusForbidden, status)
+				require.Equal(t, "access_denied", responseBody["error"])
+				return
+			}
+			parsedJWT, err := jose.ParseSigned(responseBody["access_token"].(string))
+			require.NoError(t, err)
+			var claims map[string]interface{}
+			require.NoError(t, json.Unmarshal(parsedJWT.UnsafePayloadWithoutVerification(), &claims))
+			require.Equal(t, goodSubject, claims["sub"])
+			require.Equal(t, []interface{}{"some-workload-cluster"}, claims["aud"])
+		})
+	}
+
+	t.Run("client with pairwise subjects may not request the pinniped:request-audience scope", func(t *testing.T) {
+		t.Parallel()
+
+		_, jwkProvider := generateJWTSigningKeyAndJWKSProvider(t, goodIssuer)
+		oauthHelper := oidc.FositeOauth2Helper(oidc.NullStorage{}, goodIssuer, hmacSecretFunc, jwkProvider, oidc.DefaultOIDCTimeoutsConfiguration(), goodTokenExchangeAudiences, nil, clients)
+
+		authRequest := deepCopyRequestForm(happyAuthRequest)
+		authRequest.Form.Set("client_id", clients[1].ID)
+		authRequest.Form.Set("redirect_uri", clients[1].RedirectURIs[0])
+		authRequest.Form.Set("scope", "openid pinniped:request-audience")
+		_, err := oauthHelper.NewAuthorizeRequest(context.Background(), authRequest)
+		require.EqualError(t, err, "invalid_scope")
+
+		subject := newHandlerWithoutRequiredDPoP(oauthHelper)
+		req := httptest.NewRequest("POST", "/path/shouldn't/matter", strings.NewReader(url.Values{"grant_type": {"client_credentials"}, "scope": {"openid pinniped:request-audience"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(clients[1].ID, clientSecret)
+		rsp := httptest.NewRecorder()
+		subject.ServeHTTP(rsp, req)
+		require.Equal(t, http.StatusBadRequest, rsp.Code)
+		require.Contains(t, rsp.Body.String(), "invalid_scope")
+	})
+}
+
 func TestRefreshGrant(t *testing.T) {
 	tests := []struct {
 		name             string
@@ -1057,7 +1898,9 @@ func TestRefreshGrant(t *testing.T) {
 			wantAtHashClaimInIDToken := true
 			// Refreshed ID tokens do not include the nonce from the original auth request
 			wantNonceValueInIDToken := false
-			requireTokenEndpointBehavior(t, test.refreshRequest.want, wantAtHashClaimInIDToken, wantNonceValueInIDToken, refreshResponse, authCode, oauthStore, jwtSigningKey, secrets)
+			// The refresh token which was used for the refresh has been revoked.
+			wantRevokedRefreshTokenSessions := 1
+			requireTokenEndpointBehavior(t, test.refreshRequest.want, wantAtHashClaimInIDToken, wantNonceValueInIDToken, refreshResponse, authCode, oauthStore, jwtSigningKey, secrets, wantRevokedRefreshTokenSessions)
 
 			if test.refreshRequest.want.wantStatus == http.StatusOK {
 				wantIDToken := contains(test.refreshRequest.want.wantSuccessBodyFields, "id_token")
@@ -1105,6 +1948,269 @@ func TestRefreshGrant(t *testing.T) {
 	}
 }
 
+func TestRefreshTokenReplay(t *testing.T) {
+	authcodeExchange := authcodeExchangeInputs{
+		modifyAuthRequest: func(r *http.Request) { r.Form.Set("scope", "openid offline_access") },
+		want: tokenEndpointResponseExpectedValues{
+			wantStatus:            http.StatusOK,
+			wantSuccessBodyFields: []string{"id_token", "refresh_token", "access_token", "token_type", "expires_in", "scope"},
+			wantRequestedScopes:   []string{"openid", "offline_access"},
+			wantGrantedScopes:     []string{"openid", "offline_access"},
+		},
+	}
+
+	refresh := func(t *testing.T, subject http.Handler, refreshToken string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/path/shouldn't/matter", happyRefreshRequestBody(refreshToken).ReadCloser())
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rsp := httptest.NewRecorder()
+		subject.ServeHTTP(rsp, req)
+		t.Logf("refresh response body: %q", rsp.Body.String())
+		return rsp
+	}
+
+	requireWholeTokenFamilyRevoked := func(t *testing.T, secrets v1.SecretInterface) {
+		testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: accesstoken.TypeLabelValue}, 0)
+		testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: refreshtoken.TypeLabelValue}, 2)
+		testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: refreshtoken.TypeLabelValue, crud.SecretRevokedLabelKey: "true"}, 2)
+	}
+
+	t.Run("replaying a rotated refresh token revokes all tokens of the authorization", func(t *testing.T) {
+		t.Parallel()
+
+		subject, rsp, _, _, secrets, _ := exchangeAuthcodeForTokens(t, authcodeExchange)
+		var parsedAuthcodeExchangeResponseBody map[string]interface{}
+		require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &parsedAuthcodeExchangeResponseBody))
+		firstRefreshToken := parsedAuthcodeExchangeResponseBody["refresh_token"].(string)
+
+		// The legitimate client rotates its refresh token.
+		refreshResponse := refresh(t, subject, firstRefreshToken)
+		require.Equal(t, http.StatusOK, refreshResponse.Code)
+		var parsedRefreshResponseBody map[string]interface{}
+		require.NoError(t, json.Unmarshal(refreshResponse.Body.Bytes(), &parsedRefreshResponseBody))
+		secondRefreshToken := parsedRefreshResponseBody["refresh_token"].(string)
+
+		// Someone else replays the old refresh token.
+		replayResponse := refresh(t, subject, firstRefreshToken)
+		require.Equal(t, http.StatusBadRequest, replayResponse.Code)
+		require.JSONEq(t, fositeInvalidAuthCodeErrorBody, replayResponse.Body.String())
+		requireWholeTokenFamilyRevoked(t, secrets)
+
+		// The newest refresh token of the family cannot be used anymore either.
+		newestRefreshTokenResponse := refresh(t, subject, secondRefreshToken)
+		require.Equal(t, http.StatusBadRequest, newestRefreshTokenResponse.Code)
+		require.JSONEq(t, fositeInvalidAuthCodeErrorBody, newestRefreshTokenResponse.Body.String())
+		requireWholeTokenFamilyRevoked(t, secrets)
+	})
+
+	t.Run("the loser of concurrent refreshes using the same refresh token revokes all tokens of the authorization", func(t *testing.T) {
+		t.Parallel()
+
+		// Capture the oauth helper so we can interleave the steps of the two requests.
+		var oauthHelper fosite.OAuth2Provider
+		concurrentAuthcodeExchange := authcodeExchange
+		concurrentAuthcodeExchange.makeOathHelper = func(
+			t *testing.T,
+			authRequest *http.Request,
+			store interface {
+				oauth2.TokenRevocationStorage
+				oauth2.CoreStorage
+				openid.OpenIDConnectRequestStorage
+				pkce.PKCERequestStorage
+				fosite.ClientManager
+			},
+		) (fosite.OAuth2Provider, string, *ecdsa.PrivateKey) {
+			var authCode string
+			var jwtSigningKey *ecdsa.PrivateKey
+			oauthHelper, authCode, jwtSigningKey = makeHappyOauthHelper(t, authRequest, store)
+			return oauthHelper, authCode, jwtSigningKey
+		}
+
+		_, rsp, _, _, secrets, _ := exchangeAuthcodeForTokens(t, concurrentAuthcodeExchange)
+		var parsedAuthcodeExchangeResponseBody map[string]interface{}
+		require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &parsedAuthcodeExchangeResponseBody))
+		firstRefreshToken := parsedAuthcodeExchangeResponseBody["refresh_token"].(string)
+
+		newAccessRequest := func() fosite.AccessRequester {
+			req := httptest.NewRequest("POST", "/path/shouldn't/matter", happyRefreshRequestBody(firstRefreshToken).ReadCloser())
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			accessRequest, err := oauthHelper.NewAccessRequest(req.Context(), req, psession.NewPinnipedSession())
+			require.NoError(t, err)
+			return accessRequest
+		}
+
+		// Both requests validate the refresh token before either of them rotates it.
+		firstAccessRequest := newAccessRequest()
+		secondAccessRequest := newAccessRequest()
+
+		_, err := oauthHelper.NewAccessResponse(context.Background(), firstAccessRequest)
+		require.NoError(t, err)
+		_, err = oauthHelper.NewAccessResponse(context.Background(), secondAccessRequest)
+		require.EqualError(t, err, "invalid_request")
+		requireWholeTokenFamilyRevoked(t, secrets)
+	})
+}
+
+func TestDPoP(t *testing.T) {
+	tokenEndpointURL := goodIssuer + oidc.TokenEndpointPath
+	dpopValidator := newDPoPValidator()
+
+	setup := func(t *testing.T, requiresDPoP bool) (http.Handler, string, *oidc.KubeStorage) {
+		authRequest := deepCopyRequestForm(happyAuthRequest)
+		authRequest.Form.Set("scope", "openid offline_access pinniped:request-audience")
+		storage := oidc.NewKubeStorage(crud.NewSecretsBackend(fake.NewSimpleClientset().CoreV1().Secrets("some-namespace")), oidc.DefaultOIDCTimeoutsConfiguration())
+		oauthHelper, authCode, _ := makeHappyOauthHelper(t, authRequest, storage)
+		subject := NewHandler(oauthHelper, dpopValidator, tokenEndpointURL, func(clientID string) bool {
+			return requiresDPoP && clientID == goodClient
+		})
+		return subject, authCode, storage
+	}
+
+	post := func(t *testing.T, subject http.Handler, params body, proof string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		req := httptest.NewRequest("POST", "/path/shouldn't/matter", params.ReadCloser())
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if proof != "" {
+			req.Header.Set("DPoP", proof)
+		}
+		rsp := httptest.NewRecorder()
+		subject.ServeHTTP(rsp, req)
+		t.Logf("response body: %q", rsp.Body.String())
+		var parsedBody map[string]interface{}
+		require.NoError(t, json.Unmarshal(rsp.Body.Bytes(), &parsedBody))
+		return rsp, parsedBody
+	}
+
+	newKey := func(t *testing.T) (*clientdpop.Key, string) {
+		key, err := clientdpop.Generate()
+		require.NoError(t, err)
+		jkt, err := key.Thumbprint()
+		require.NoError(t, err)
+		return key, jkt
+	}
+
+	proof := func(t *testing.T, key *clientdpop.Key, nonce string) string {
+		proof, err := key.Proof(http.MethodPost, tokenEndpointURL, nonce)
+		require.NoError(t, err)
+		return proof
+	}
+
+	requireBoundSession := func(t *testing.T, storage *oidc.KubeStorage, accessToken string, wantJKT string) {
+		requester, err := storage.GetAccessTokenSession(context.Background(), getFositeDataSignature(t, accessToken), nil)
+		require.NoError(t, err)
+		require.Equal(t, wantJKT, requester.GetSession().(*psession.PinnipedSession).Custom.DPoPJKT)
+	}
+
+	t.Run("a DPoP proof without the current nonce gets the current nonce", func(t *testing.T) {
+		t.Parallel()
+		subject, authCode, _ := setup(t, false)
+		key, _ := newKey(t)
+
+		rsp, parsedBody := post(t, subject, happyAuthcodeRequestBody(authCode), proof(t, key, ""))
+		require.Equal(t, http.StatusBadRequest, rsp.Code)
+		require.Equal(t, "use_dpop_nonce", parsedBody["error"])
+		nonce := rsp.Header().Get("DPoP-Nonce")
+		require.Equal(t, dpopValidator.Nonce(), nonce)
+
+		rsp, parsedBody = post(t, subject, happyAuthcodeRequestBody(authCode), proof(t, key, "some-wrong-nonce"))
+		require.Equal(t, http.StatusBadRequest, rsp.Code)
+		require.Equal(t, "use_dpop_nonce", parsedBody["error"])
+
+		// The authcode was not used up by the requests which had no nonce.
+		rsp, parsedBody = post(t, subject, happyAuthcodeRequestBody(authCode), proof(t, key, nonce))
+		require.Equal(t, http.StatusOK, rsp.Code)
+		require.Equal(t, "DPoP", parsedBody["token_type"])
+	})
+
+	t.Run("tokens are bound to the key of the DPoP proof of the request which issued them", func(t *testing.T) {
+		t.Parallel()
+		subject, authCode, storage := setup(t, false)
+		key, jkt := newKey(t)
+		otherKey, _ := newKey(t)
+		nonce := dpopValidator.Nonce()
+
+		rsp, parsedBody := post(t, subject, happyAuthcodeRequestBody(authCode), proof(t, key, nonce))
+		require.Equal(t, http.StatusOK, rsp.Code)
+		require.Equal(t, "DPoP", parsedBody["token_type"])
+		require.Equal(t, nonce, rsp.Header().Get("DPoP-Nonce"))
+		requireBoundSession(t, storage, parsedBody["access_token"].(string), jkt)
+		refreshToken := parsedBody["refresh_token"].(string)
+
+		// The refresh token may not be used without a DPoP proof, or with a DPoP proof signed by another key.
+		rsp, parsedBody = post(t, subject, happyRefreshRequestBody(refreshToken), "")
+		require.Equal(t, http.StatusBadRequest, rsp.Code)
+		require.Equal(t, "invalid_dpop_proof", parsedBody["error"])
+		rsp, parsedBody = post(t, subject, happyRefreshRequestBody(refreshToken), proof(t, otherKey, nonce))
+		require.Equal(t, http.StatusBadRequest, rsp.Code)
+		require.Equal(t, "invalid_dpop_proof", parsedBody["error"])
+		require.Equal(t, "The DPoP proof is missing or invalid. The DPoP proof must be signed by the key to which the grant is bound.", parsedBody["error_description"])
+
+		rsp, parsedBody = post(t, subject, happyRefreshRequestBody(refreshToken), proof(t, key, nonce))
+		require.Equal(t, http.StatusOK, rsp.Code)
+		require.Equal(t, "DPoP", parsedBody["token_type"])
+		requireBoundSession(t, storage, parsedBody["access_token"].(string), jkt)
+		accessToken := parsedBody["access_token"].(string)
+
+		// The access token may not be exchanged without a DPoP proof, or with a DPoP proof signed by another key.
+		exchangeBody := body(happyTokenExchangeRequest("some-workload-cluster", accessToken).Form)
+		rsp, parsedBody = post(t, subject, exchangeBody, "")
+		require.Equal(t, http.StatusBadRequest, rsp.Code)
+		require.Equal(t, "invalid_dpop_proof", parsedBody["error"])
+		rsp, parsedBody = post(t, subject, exchangeBody, proof(t, otherKey, nonce))
+		require.Equal(t, http.StatusBadRequest, rsp.Code)
+		require.Equal(t, "invalid_dpop_proof", parsedBody["error"])
+		require.Equal(t, "The DPoP proof is missing or invalid. The DPoP proof must be signed by the key to which the subject_token is bound.", parsedBody["error_description"])
+
+		// The JWT from the token exchange confirms the key.
+		rsp, parsedBody = post(t, subject, exchangeBody, proof(t, key, nonce))
+		require.Equal(t, http.StatusOK, rsp.Code)
+		require.Equal(t, "N_A", parsedBody["token_type"])
+		parsedJWT, err := jose.ParseSigned(parsedBody["access_token"].(string))
+		require.NoError(t, err)
+		var tokenClaims map[string]interface{}
+		require.NoError(t, json.Unmarshal(parsedJWT.UnsafePayloadWithoutVerification(), &tokenClaims))
+		require.Equal(t, map[string]interface{}{"jkt": jkt}, tokenClaims["cnf"])
+	})
+
+	t.Run("bearer tokens are issued to requests without a DPoP proof", func(t *testing.T) {
+		t.Parallel()
+		subject, authCode, storage := setup(t, false)
+
+		rsp, parsedBody := post(t, subject, happyAuthcodeRequestBody(authCode), "")
+		require.Equal(t, http.StatusOK, rsp.Code)
+		require.Equal(t, "bearer", parsedBody["token_type"])
+		require.Empty(t, rsp.Header().Get("DPoP-Nonce"))
+		requireBoundSession(t, storage, parsedBody["access_token"].(string), "")
+	})
+
+	t.Run("a client which requires DPoP must send a DPoP proof", func(t *testing.T) {
+		t.Parallel()
+		subject, authCode, _ := setup(t, true)
+
+		rsp, parsedBody := post(t, subject, happyAuthcodeRequestBody(authCode), "")
+		require.Equal(t, http.StatusBadRequest, rsp.Code)
+		require.Equal(t, "invalid_dpop_proof", parsedBody["error"])
+		require.Equal(t, "The DPoP proof is missing or invalid. The client must send a DPoP proof.", parsedBody["error_description"])
+	})
+
+	t.Run("an invalid DPoP proof is rejected", func(t *testing.T) {
+		t.Parallel()
+		subject, authCode, _ := setup(t, false)
+
+		rsp, parsedBody := post(t, subject, happyAuthcodeRequestBody(authCode), "not-a-jwt")
+		require.Equal(t, http.StatusBadRequest, rsp.Code)
+		require.Equal(t, "invalid_dpop_proof", parsedBody["error"])
+		require.Equal(t, "The DPoP proof is missing or invalid. The DPoP proof is not a valid JWS.", parsedBody["error_description"])
+	})
+}
+
+func newHandlerWithoutRequiredDPoP(oauthHelper fosite.OAuth2Provider) http.Handler {
+	return NewHandler(oauthHelper, newDPoPValidator(), goodIssuer+oidc.TokenEndpointPath, func(string) bool { return false })
+}
+
+func newDPoPValidator() *dpop.Validator {
+	proofs := dpopproof.New(crud.NewSecretsBackend(fake.NewSimpleClientset().CoreV1().Secrets("some-namespace")), time.Now, dpop.ProofLifetime)
+	return dpop.NewValidator(hmacSecretFunc, proofs)
+}
+
 func requireClaimsAreNotEqual(t *testing.T, claimName string, claimsOfTokenA map[string]interface{}, claimsOfTokenB map[string]interface{}) {
 	require.NotEmpty(t, claimsOfTokenA[claimName])
 	require.NotEmpty(t, claimsOfTokenB[claimName])
@@ -1135,7 +2241,7 @@ func exchangeAuthcodeForTokens(t *testing.T, test authcodeExchangeInputs) (
 
 	var oauthHelper fosite.OAuth2Provider
 
-	oauthStore = oidc.NewKubeStorage(secrets, oidc.DefaultOIDCTimeoutsConfiguration())
+	oauthStore = oidc.NewKubeStorage(crud.NewSecretsBackend(secrets), oidc.DefaultOIDCTimeoutsConfiguration())
 	if test.makeOathHelper != nil {
 		oauthHelper, authCode, jwtSigningKey = test.makeOathHelper(t, authRequest, oauthStore)
 	} else {
@@ -1145,7 +2251,7 @@ func exchangeAuthcodeForTokens(t *testing.T, test authcodeExchangeInputs) (
 	if test.modifyStorage != nil {
 		test.modifyStorage(t, oauthStore, authCode)
 	}
-	subject = NewHandler(oauthHelper)
+	subject = newHandlerWithoutRequiredDPoP(oauthHelper)
 
 	authorizeEndpointGrantedOpenIDScope := strings.Contains(authRequest.Form.Get("scope"), "openid")
 	expectedNumberOfIDSessionsStored := 0
@@ -1171,7 +2277,7 @@ func exchangeAuthcodeForTokens(t *testing.T, test authcodeExchangeInputs) (
 
 	wantAtHashClaimInIDToken := false // due to a bug in fosite, the at_hash claim is not filled in during authcode exchange
 	wantNonceValueInIDToken := true   // ID tokens returned by the authcode exchange must include the nonce from the auth request (unliked refreshed ID tokens)
-	requireTokenEndpointBehavior(t, test.want, wantAtHashClaimInIDToken, wantNonceValueInIDToken, rsp, authCode, oauthStore, jwtSigningKey, secrets)
+	requireTokenEndpointBehavior(t, test.want, wantAtHashClaimInIDToken, wantNonceValueInIDToken, rsp, authCode, oauthStore, jwtSigningKey, secrets, 0)
 
 	return subject, rsp, authCode, jwtSigningKey, secrets, oauthStore
 }
@@ -1186,6 +2292,7 @@ func requireTokenEndpointBehavior(
 	oauthStore *oidc.KubeStorage,
 	jwtSigningKey *ecdsa.PrivateKey,
 	secrets v1.SecretInterface,
+	wantRevokedRefreshTokenSessions int,
 ) {
 	testutil.RequireEqualContentType(t, tokenEndpointResponse.Header().Get("Content-Type"), "application/json")
 	require.Equal(t, test.wantStatus, tokenEndpointResponse.Code)
@@ -1221,9 +2328,11 @@ func requireTokenEndpointBehavior(
 		testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: authorizationcode.TypeLabelValue}, 1)
 		testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: accesstoken.TypeLabelValue}, 1)
 		testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: storagepkce.TypeLabelValue}, 0)
-		testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: refreshtoken.TypeLabelValue}, expectedNumberOfRefreshTokenSessionsStored)
+		// Refresh tokens which were already used are kept as revoked until they are garbage collected.
+		testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: refreshtoken.TypeLabelValue}, expectedNumberOfRefreshTokenSessionsStored+wantRevokedRefreshTokenSessions)
+		testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: refreshtoken.TypeLabelValue, crud.SecretRevokedLabelKey: "true"}, wantRevokedRefreshTokenSessions)
 		testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{crud.SecretLabelKey: openidconnect.TypeLabelValue}, expectedNumberOfIDSessionsStored)
-		testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{}, 2+expectedNumberOfRefreshTokenSessionsStored+expectedNumberOfIDSessionsStored)
+		testutil.RequireNumberOfSecretsMatchingLabelSelector(t, secrets, labels.Set{}, 2+expectedNumberOfRefreshTokenSessionsStored+wantRevokedRefreshTokenSessions+expectedNumberOfIDSessionsStored)
 	} else {
 		require.NotNil(t, test.wantErrorResponseBody, "problem with test table setup: wanted failure but did not specify failure response body")
 
@@ -1326,7 +2435,7 @@ func makeHappyOauthHelper(
 	t.Helper()
 
 	jwtSigningKey, jwkProvider := generateJWTSigningKeyAndJWKSProvider(t, goodIssuer)
-	oauthHelper := oidc.FositeOauth2Helper(store, goodIssuer, hmacSecretFunc, jwkProvider, oidc.DefaultOIDCTimeoutsConfiguration())
+	oauthHelper := oidc.FositeOauth2Helper(store, goodIssuer, hmacSecretFunc, jwkProvider, oidc.DefaultOIDCTimeoutsConfiguration(), goodTokenExchangeAudiences, nil, nil)
 	authResponder := simulateAuthEndpointHavingAlreadyRun(t, authRequest, oauthHelper)
 	return oauthHelper, authResponder.GetCode(), jwtSigningKey
 }
@@ -1358,7 +2467,7 @@ func makeOauthHelperWithJWTKeyThatWorksOnlyOnce(
 	t.Helper()
 
 	jwtSigningKey, jwkProvider := generateJWTSigningKeyAndJWKSProvider(t, goodIssuer)
-	oauthHelper := oidc.FositeOauth2Helper(store, goodIssuer, hmacSecretFunc, &singleUseJWKProvider{DynamicJWKSProvider: jwkProvider}, oidc.DefaultOIDCTimeoutsConfiguration())
+	oauthHelper := oidc.FositeOauth2Helper(store, goodIssuer, hmacSecretFunc, &singleUseJWKProvider{DynamicJWKSProvider: jwkProvider}, oidc.DefaultOIDCTimeoutsConfiguration(), goodTokenExchangeAudiences, nil, nil)
 	authResponder := simulateAuthEndpointHavingAlreadyRun(t, authRequest, oauthHelper)
 	return oauthHelper, authResponder.GetCode(), jwtSigningKey
 }
@@ -1377,7 +2486,7 @@ func makeOauthHelperWithNilPrivateJWTSigningKey(
 	t.Helper()
 
 	jwkProvider := jwks.NewDynamicJWKSProvider() // empty provider which contains no signing key for this issuer
-	oauthHelper := oidc.FositeOauth2Helper(store, goodIssuer, hmacSecretFunc, jwkProvider, oidc.DefaultOIDCTimeoutsConfiguration())
+	oauthHelper := oidc.FositeOauth2Helper(store, goodIssuer, hmacSecretFunc, jwkProvider, oidc.DefaultOIDCTimeoutsConfiguration(), goodTokenExchangeAudiences, nil, nil)
 	authResponder := simulateAuthEndpointHavingAlreadyRun(t, authRequest, oauthHelper)
 	return oauthHelper, authResponder.GetCode(), nil
 }
@@ -1386,18 +2495,23 @@ func makeOauthHelperWithNilPrivateJWTSigningKey(
 func simulateAuthEndpointHavingAlreadyRun(t *testing.T, authRequest *http.Request, oauthHelper fosite.OAuth2Provider) fosite.AuthorizeResponder {
 	// We only set the fields in the session that Fosite wants us to set.
 	ctx := context.Background()
-	session := &openid.DefaultSession{
-		Claims: &jwt.IDTokenClaims{
-			Subject:     goodSubject,
-			RequestedAt: goodRequestedAtTime,
-			AuthTime:    goodAuthTime,
-			Extra: map[string]interface{}{
-				oidc.DownstreamUsernameClaim: goodUsername,
-				oidc.DownstreamGroupsClaim:   goodGroups,
-			},
-		},
-		Subject:  "", // not used, note that callback_handler.go does not set this
-		Username: "", // not used, note that callback_handler.go does not set this
+	session := &psession.PinnipedSession{
+		Fosite: &openid.DefaultSession{
+			Claims: &jwt.IDTokenClaims{
+				Subject:     goodSubject,
+				RequestedAt: goodRequestedAtTime,
+				AuthTime:    goodAuthTime,
+				Extra: map[string]interface{}{
+					oidc.DownstreamUsernameClaim: goodUsername,
+					oidc.DownstreamGroupsClaim:   goodGroups,
+				},
+			},
+			Subject:  "", // not used, note that callback_handler.go does not set this
+			Username: "", // not used, note that callback_handler.go does not set this
+		},
+		Custom: &psession.CustomSessionData{
+			ProviderName: goodUpstreamName,
+		},
 	}
 	authRequester, err := oauthHelper.NewAuthorizeRequest(ctx, authRequest)
 	require.NoError(t, err)
@@ -1607,8 +2721,12 @@ func requireValidStoredRequest(
 	require.Equal(t, wantRequestForm, request.GetRequestForm()) // Fosite stores access token request without form
 
 	// Cast session to the type we think it should be.
-	session, ok := request.GetSession().(*openid.DefaultSession)
-	require.Truef(t, ok, "could not cast %T to %T", request.GetSession(), &openid.DefaultSession{})
+	pinnipedSession, ok := request.GetSession().(*psession.PinnipedSession)
+	require.Truef(t, ok, "could not cast %T to %T", request.GetSession(), &psession.PinnipedSession{})
+
+	// The custom session data from the callback endpoint should be carried along with every stored token.
+	require.Equal(t, &psession.CustomSessionData{ProviderName: goodUpstreamName}, pinnipedSession.Custom)
+	session := pinnipedSession.Fosite
 
 	// Assert that the session claims are what we think they should be, but only if we are doing OIDC.
 	if contains(wantGrantedScopes, "openid") {
@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package oidc
@@ -6,6 +6,8 @@ package oidc
 import (
 	"context"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/ory/fosite"
@@ -13,6 +15,10 @@ import (
 	"github.com/ory/fosite/handler/oauth2"
 	"github.com/ory/fosite/handler/openid"
 	"github.com/pkg/errors"
+
+	"go.pinniped.dev/internal/oidc/dpop"
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/psession"
 )
 
 const (
@@ -22,15 +28,28 @@ const (
 )
 
 type stsParams struct {
-	subjectAccessToken string
+	subjectToken       string
+	subjectTokenType   string
 	requestedAudience  string
+	requestedTokenType string
+	requestedScopes    fosite.Arguments // nil when the scope parameter was not sent
 }
 
-func TokenExchangeFactory(config *compose.Config, storage interface{}, strategy interface{}) interface{} {
-	return &TokenExchangeHandler{
-		idTokenStrategy:     strategy.(openid.OpenIDConnectTokenStrategy),
-		accessTokenStrategy: strategy.(oauth2.AccessTokenStrategy),
-		accessTokenStorage:  storage.(oauth2.AccessTokenStorage),
+// TokenExchangeFactory returns a compose.Factory for the token exchange handler. Access tokens and
+// downscoped ID tokens may only be requested for the given audiences. JWTs from the given trusted issuers
+// may be exchanged for ID tokens.
+func TokenExchangeFactory(audiences provider.TokenExchangeAudiences, trustedIssuers []*provider.TrustedJWTIssuer) compose.Factory {
+	jwtIssuers := newTrustedJWTIssuers(trustedIssuers)
+	return func(config *compose.Config, storage interface{}, strategy interface{}) interface{} {
+		return &TokenExchangeHandler{
+			idTokenStrategy:     strategy.(openid.OpenIDConnectTokenStrategy),
+			accessTokenStrategy: strategy.(oauth2.AccessTokenStrategy),
+			accessTokenStorage:  storage.(oauth2.AccessTokenStorage),
+			accessTokenLifespan: config.GetAccessTokenLifespan(),
+			issuer:              config.IDTokenIssuer,
+			audiences:           audiences,
+			trustedJWTIssuers:   jwtIssuers,
+		}
 	}
 }
 
@@ -38,10 +57,14 @@ type TokenExchangeHandler struct {
 	idTokenStrategy     openid.OpenIDConnectTokenStrategy
 	accessTokenStrategy oauth2.AccessTokenStrategy
 	accessTokenStorage  oauth2.AccessTokenStorage
+	accessTokenLifespan time.Duration
+	issuer              string
+	audiences           provider.TokenExchangeAudiences
+	trustedJWTIssuers   trustedJWTIssuers
 }
 
 func (t *TokenExchangeHandler) HandleTokenEndpointRequest(ctx context.Context, requester fosite.AccessRequester) error {
-	if !(requester.GetGrantTypes().ExactOne("urn:ietf:params:oauth:grant-type:token-exchange")) {
+	if !(requester.GetGrantTypes().ExactOne(grantTypeTokenExchange)) {
 		return errors.WithStack(fosite.ErrUnknownRequest)
 	}
 	return nil
@@ -53,18 +76,42 @@ func (t *TokenExchangeHandler) PopulateTokenEndpointResponse(ctx context.Context
 		return errors.WithStack(err)
 	}
 
+	// Fosite leaves it to the handler of each grant type to check that the client may use it.
+	if !requester.GetClient().GetGrantTypes().Has(grantTypeTokenExchange) {
+		return errors.WithStack(fosite.ErrUnauthorizedClient.WithHintf("The OAuth 2.0 Client is not allowed to use authorization grant %q.", grantTypeTokenExchange))
+	}
+
 	// Validate the basic RFC8693 parameters we support.
 	params, err := t.validateParams(requester.GetRequestForm())
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
+	if params.subjectTokenType == tokenTypeJWT {
+		return t.exchangeTrustedJWT(ctx, params, responder)
+	}
+
 	// Validate the incoming access token and lookup the information about the original authorize request.
-	originalRequester, err := t.validateAccessToken(ctx, requester, params.subjectAccessToken)
+	originalRequester, err := t.validateAccessToken(ctx, requester, params.subjectToken)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
+	// Require that a DPoP-bound access token is presented along with a DPoP proof signed by the same key.
+	if err := requireDPoPBinding(ctx, originalRequester); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// An access token which was issued for certain audiences, like the downscoped access tokens of an earlier token
+	// exchange, may only be exchanged for tokens for the same audiences. Otherwise, it could be used to get the
+	// scopes of any other audience. The access tokens of the service identity of a client are always limited to the
+	// audiences which the client is allowed to request, even when that is none.
+	grantedAudience := originalRequester.GetGrantedAudience()
+	isClientService := originalRequester.GetSession().GetSubject() == clientServiceSubject(t.issuer, originalRequester.GetClient().GetID())
+	if (len(grantedAudience) > 0 || isClientService) && !grantedAudience.Has(params.requestedAudience) {
+		return errors.WithStack(fosite.ErrAccessDenied.WithHintf("the subject_token was not issued for audience %q", params.requestedAudience))
+	}
+
 	// Require that the incoming access token has the pinniped:request-audience and OpenID scopes.
 	if !originalRequester.GetGrantedScopes().Has(pinnipedTokenExchangeScope) {
 		return errors.WithStack(fosite.ErrAccessDenied.WithHintf("missing the %q scope", pinnipedTokenExchangeScope))
@@ -73,6 +120,29 @@ func (t *TokenExchangeHandler) PopulateTokenEndpointResponse(ctx context.Context
 		return errors.WithStack(fosite.ErrAccessDenied.WithHintf("missing the %q scope", oidc.ScopeOpenID))
 	}
 
+	// Decide which of the originally granted scopes may be granted to the new token.
+	scopes, err := t.downscope(originalRequester, params)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if params.requestedTokenType == tokenTypeAccessToken {
+		// Use the original authorize request information, along with the requested audience and scopes, to mint
+		// a new access token.
+		responseToken, err := t.mintAccessToken(ctx, originalRequester, params.requestedAudience, scopes)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		// Format the response parameters according to RFC8693.
+		responder.SetAccessToken(responseToken)
+		responder.SetTokenType("Bearer") // the token endpoint changes this to "DPoP" when the token is DPoP-bound
+		responder.SetExpiresIn(t.accessTokenLifespan)
+		responder.SetScopes(scopes)
+		responder.SetExtra("issued_token_type", tokenTypeAccessToken)
+		return nil
+	}
+
 	// Use the original authorize request information, along with the requested audience, to mint a new JWT.
 	responseToken, err := t.mintJWT(ctx, originalRequester, params.requestedAudience)
 	if err != nil {
@@ -82,41 +152,189 @@ func (t *TokenExchangeHandler) PopulateTokenEndpointResponse(ctx context.Context
 	// Format the response parameters according to RFC8693.
 	responder.SetAccessToken(responseToken)
 	responder.SetTokenType("N_A")
+	if scopes != nil {
+		responder.SetScopes(scopes)
+	}
 	responder.SetExtra("issued_token_type", tokenTypeJWT)
 	return nil
 }
 
+// exchangeTrustedJWT mints an ID token for the subject of a JWT which was issued by a trusted external issuer.
+func (t *TokenExchangeHandler) exchangeTrustedJWT(ctx context.Context, params *stsParams, responder fosite.AccessResponder) error {
+	// There is no stored session behind an externally-issued JWT, so there are no scopes to downscope from.
+	if params.requestedTokenType != tokenTypeJWT {
+		return errors.WithStack(fosite.ErrInvalidRequest.WithHintf("requested_token_type must be %q when subject_token_type is %q", tokenTypeJWT, tokenTypeJWT))
+	}
+	if params.requestedScopes != nil {
+		return errors.WithStack(fosite.ErrInvalidRequest.WithHintf("scope parameter is not supported when subject_token_type is %q", tokenTypeJWT))
+	}
+
+	session, err := t.trustedJWTIssuers.validate(ctx, params.subjectToken)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	externalRequester := fosite.NewRequest()
+	externalRequester.SetSession(session)
+	responseToken, err := t.mintJWT(ctx, externalRequester, params.requestedAudience)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// Format the response parameters according to RFC8693.
+	responder.SetAccessToken(responseToken)
+	responder.SetTokenType("N_A")
+	responder.SetExtra("issued_token_type", tokenTypeJWT)
+	return nil
+}
+
+// downscope returns the scopes of the new token. It returns nil for an ID token which was requested without any
+// scopes for an audience which is not configured, which is always allowed for backwards compatibility.
+func (t *TokenExchangeHandler) downscope(originalRequester fosite.Requester, params *stsParams) (fosite.Arguments, error) {
+	allowedScopes, audienceIsConfigured := t.audiences[params.requestedAudience]
+	if !audienceIsConfigured {
+		if params.requestedTokenType == tokenTypeAccessToken || params.requestedScopes != nil {
+			return nil, fosite.ErrAccessDenied.WithHintf("audience %q does not allow access tokens or scopes", params.requestedAudience)
+		}
+		return nil, nil
+	}
+
+	allowed := fosite.Arguments(allowedScopes)
+	granted := originalRequester.GetGrantedScopes()
+
+	if params.requestedScopes == nil {
+		// Grant every originally granted scope which is allowed for this audience.
+		scopes := fosite.Arguments{}
+		for _, scope := range granted {
+			if allowed.Has(scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+		return scopes, nil
+	}
+
+	for _, scope := range params.requestedScopes {
+		if !granted.Has(scope) {
+			return nil, fosite.ErrAccessDenied.WithHintf("the subject_token was not granted the %q scope", scope)
+		}
+		if !allowed.Has(scope) {
+			return nil, fosite.ErrInvalidScope.WithHintf("the %q scope is not allowed for audience %q", scope, params.requestedAudience)
+		}
+	}
+	return params.requestedScopes, nil
+}
+
+func (t *TokenExchangeHandler) mintAccessToken(ctx context.Context, requester fosite.Requester, audience string, scopes fosite.Arguments) (string, error) {
+	downscoped := fosite.NewRequest()
+	// Keep the ID of the original request, so the new access token is revoked along with the rest of the session.
+	downscoped.SetID(requester.GetID())
+	downscoped.Client = requester.GetClient()
+	downscoped.SetRequestedAudience(fosite.Arguments{audience})
+	downscoped.GrantAudience(audience)
+	downscoped.SetRequestedScopes(scopes)
+	for _, scope := range scopes {
+		downscoped.GrantScope(scope)
+	}
+	session, ok := requester.GetSession().Clone().(*psession.PinnipedSession)
+	if !ok {
+		return "", errors.WithStack(fosite.ErrServerError.WithHint("unexpected session type"))
+	}
+	session.SetExpiresAt(fosite.AccessToken, time.Now().UTC().Add(t.accessTokenLifespan).Round(time.Second))
+	if jkt := dpop.FromContext(ctx); jkt != "" {
+		// Bind the new access token to the key of the DPoP proof of the token exchange request.
+		if session.Custom == nil {
+			session.Custom = &psession.CustomSessionData{}
+		}
+		session.Custom.DPoPJKT = jkt
+	}
+	downscoped.SetSession(session)
+
+	token, signature, err := t.accessTokenStrategy.GenerateAccessToken(ctx, downscoped)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if err := t.accessTokenStorage.CreateAccessTokenSession(ctx, signature, downscoped.Sanitize([]string{})); err != nil {
+		return "", fosite.ErrServerError.WithWrap(err).WithDebug(err.Error())
+	}
+	return token, nil
+}
+
 func (t *TokenExchangeHandler) mintJWT(ctx context.Context, requester fosite.Requester, audience string) (string, error) {
-	downscoped := fosite.NewAccessRequest(requester.GetSession())
+	session := requester.GetSession()
+	if jkt := dpop.FromContext(ctx); jkt != "" {
+		// Confirm the key of the DPoP proof in the JWT, so that its audience may require proof of possession too.
+		// See https://datatracker.ietf.org/doc/html/rfc9449#section-6.1.
+		pinnipedSession, ok := session.Clone().(*psession.PinnipedSession)
+		if !ok {
+			return "", errors.WithStack(fosite.ErrServerError.WithHint("unexpected session type"))
+		}
+		extra := make(map[string]interface{}, len(pinnipedSession.Fosite.Claims.Extra)+1)
+		for k, v := range pinnipedSession.Fosite.Claims.Extra {
+			extra[k] = v
+		}
+		extra["cnf"] = map[string]interface{}{"jkt": jkt}
+		pinnipedSession.Fosite.Claims.Extra = extra
+		session = pinnipedSession
+	}
+	downscoped := fosite.NewAccessRequest(session)
 	downscoped.Client.(*fosite.DefaultClient).ID = audience
 	return t.idTokenStrategy.GenerateIDToken(ctx, downscoped)
 }
 
+// requireDPoPBinding checks that the DPoP proof of the token request was signed by the key to which the session of
+// the subject token is bound, if it is bound to one.
+func requireDPoPBinding(ctx context.Context, originalRequester fosite.Requester) error {
+	session, ok := originalRequester.GetSession().(*psession.PinnipedSession)
+	if !ok {
+		return fosite.ErrServerError.WithHint("unexpected session type")
+	}
+	if session.Custom != nil && session.Custom.DPoPJKT != "" && session.Custom.DPoPJKT != dpop.FromContext(ctx) {
+		return dpop.ErrInvalidDPoPProof.WithHint("The DPoP proof must be signed by the key to which the subject_token is bound.")
+	}
+	return nil
+}
+
 func (t *TokenExchangeHandler) validateParams(params url.Values) (*stsParams, error) {
 	var result stsParams
 
-	// Validate some required parameters.
-	result.requestedAudience = params.Get("audience")
+	// Validate some required parameters. The audience may be sent as either the audience or the RFC8707 resource
+	// parameter, but only one audience is supported.
+	audience, resource := params.Get("audience"), params.Get("resource")
+	if resource != "" {
+		resourceURL, err := url.Parse(resource)
+		if err != nil || !resourceURL.IsAbs() || resourceURL.Fragment != "" {
+			return nil, fosite.ErrInvalidRequest.WithHint("resource parameter must be an absolute URI without a fragment")
+		}
+		if audience != "" && audience != resource {
+			return nil, fosite.ErrInvalidRequest.WithHint("audience and resource parameters must be equal when both are sent")
+		}
+		audience = resource
+	}
+	result.requestedAudience = audience
 	if result.requestedAudience == "" {
 		return nil, fosite.ErrInvalidRequest.WithHint("missing audience parameter")
 	}
-	result.subjectAccessToken = params.Get("subject_token")
-	if result.subjectAccessToken == "" {
+	result.subjectToken = params.Get("subject_token")
+	if result.subjectToken == "" {
 		return nil, fosite.ErrInvalidRequest.WithHint("missing subject_token parameter")
 	}
 
 	// Validate some parameters with hardcoded values we support.
-	if params.Get("subject_token_type") != tokenTypeAccessToken {
-		return nil, fosite.ErrInvalidRequest.WithHintf("unsupported subject_token_type parameter value, must be %q", tokenTypeAccessToken)
+	result.subjectTokenType = params.Get("subject_token_type")
+	if result.subjectTokenType != tokenTypeAccessToken && result.subjectTokenType != tokenTypeJWT {
+		return nil, fosite.ErrInvalidRequest.WithHintf("unsupported subject_token_type parameter value, must be %q or %q", tokenTypeAccessToken, tokenTypeJWT)
 	}
-	if params.Get("requested_token_type") != tokenTypeJWT {
-		return nil, fosite.ErrInvalidRequest.WithHintf("unsupported requested_token_type parameter value, must be %q", tokenTypeJWT)
+	result.requestedTokenType = params.Get("requested_token_type")
+	if result.requestedTokenType != tokenTypeJWT && result.requestedTokenType != tokenTypeAccessToken {
+		return nil, fosite.ErrInvalidRequest.WithHintf("unsupported requested_token_type parameter value, must be %q or %q", tokenTypeJWT, tokenTypeAccessToken)
+	}
+
+	if scope := params.Get("scope"); scope != "" {
+		result.requestedScopes = fosite.RemoveEmpty(strings.Split(scope, " "))
 	}
 
 	// Validate that none of these unsupported parameters were sent. These are optional and we do not currently support them.
 	for _, param := range []string{
-		"resource",
-		"scope",
 		"actor_token",
 		"actor_token_type",
 	} {
@@ -0,0 +1,152 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package oidc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"strings"
+	"time"
+
+	coreosoidc "github.com/coreos/go-oidc/v3/oidc"
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/ory/fosite/token/jwt"
+	josejwt "gopkg.in/square/go-jose.v2/jwt"
+
+	"go.pinniped.dev/internal/oidc/provider"
+	"go.pinniped.dev/internal/plog"
+	"go.pinniped.dev/internal/psession"
+)
+
+// trustedJWTIssuerRequestTimeout limits each request for the keys of a trusted issuer, so a slow or unresponsive
+// issuer can't hold up token exchange requests indefinitely.
+const trustedJWTIssuerRequestTimeout = 30 * time.Second
+
+// trustedJWTIssuer verifies the JWTs of one external issuer and maps them into downstream sessions.
+type trustedJWTIssuer struct {
+	config   *provider.TrustedJWTIssuer
+	verifier *coreosoidc.IDTokenVerifier
+}
+
+// trustedJWTIssuers holds a trustedJWTIssuer for each configured issuer, keyed by the issuer.
+type trustedJWTIssuers map[string]*trustedJWTIssuer
+
+func newTrustedJWTIssuers(configs []*provider.TrustedJWTIssuer) trustedJWTIssuers {
+	result := make(trustedJWTIssuers, len(configs))
+	for _, config := range configs {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if len(config.CABundle) > 0 {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			tlsConfig.RootCAs.AppendCertsFromPEM(config.CABundle)
+		}
+		httpClient := &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			Timeout:   trustedJWTIssuerRequestTimeout,
+		}
+
+		// The key set caches the keys, and fetches them again when it sees a JWT signed by an unknown key.
+		keySet := coreosoidc.NewRemoteKeySet(coreosoidc.ClientContext(context.Background(), httpClient), config.JWKSURL)
+		result[config.Issuer] = &trustedJWTIssuer{
+			config: config,
+			verifier: coreosoidc.NewVerifier(config.Issuer, keySet, &coreosoidc.Config{
+				ClientID: config.Audience,
+				SupportedSigningAlgs: []string{
+					coreosoidc.RS256, coreosoidc.RS384, coreosoidc.RS512,
+					coreosoidc.ES256, coreosoidc.ES384, coreosoidc.ES512,
+					coreosoidc.PS256, coreosoidc.PS384, coreosoidc.PS512,
+				},
+			}),
+		}
+	}
+	return result
+}
+
+// validate verifies an externally-issued JWT and returns the downstream session of its subject.
+func (t trustedJWTIssuers) validate(ctx context.Context, token string) (*psession.PinnipedSession, error) {
+	// Read the issuer without verifying the signature, only to decide which verifier to use.
+	parsed, err := josejwt.ParseSigned(token)
+	if err != nil {
+		return nil, fosite.ErrInvalidRequest.WithHint("invalid subject_token").WithWrap(err).WithDebug(err.Error())
+	}
+	var unverifiedClaims josejwt.Claims
+	if err := parsed.UnsafeClaimsWithoutVerification(&unverifiedClaims); err != nil {
+		return nil, fosite.ErrInvalidRequest.WithHint("invalid subject_token").WithWrap(err).WithDebug(err.Error())
+	}
+	issuer, ok := t[unverifiedClaims.Issuer]
+	if !ok {
+		return nil, fosite.ErrAccessDenied.WithHintf("the issuer %q of the subject_token is not trusted", unverifiedClaims.Issuer)
+	}
+
+	idToken, err := issuer.verifier.Verify(ctx, token)
+	if err != nil {
+		plog.Info("could not verify externally-issued subject_token", "issuer", issuer.config.Issuer, "err", err)
+		return nil, fosite.ErrInvalidRequest.WithHint("invalid subject_token").WithWrap(err).WithDebug(err.Error())
+	}
+	if !issuer.subjectIsAllowed(idToken.Subject) {
+		return nil, fosite.ErrAccessDenied.WithHintf("the subject %q of the subject_token is not allowed", idToken.Subject)
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fosite.ErrInvalidRequest.WithHint("invalid subject_token").WithWrap(err).WithDebug(err.Error())
+	}
+
+	// Like the callback endpoint, prepend the issuer to make the subject globally unique.
+	subject := downstreamSubject(issuer.config.Issuer, idToken.Subject)
+	username := subject
+	if issuer.config.UsernameClaim != "" {
+		claimedUsername, ok := claims[issuer.config.UsernameClaim].(string)
+		if !ok || claimedUsername == "" {
+			return nil, fosite.ErrAccessDenied.WithHintf("the subject_token is missing the %q username claim", issuer.config.UsernameClaim)
+		}
+		username = issuer.config.UsernamePrefix + claimedUsername
+	}
+	groups := []string{}
+	if issuer.config.GroupsClaim != "" {
+		if groupsAsInterface, ok := claims[issuer.config.GroupsClaim]; ok {
+			claimedGroups, ok := extractGroups(groupsAsInterface)
+			if !ok {
+				return nil, fosite.ErrAccessDenied.WithHintf("the %q groups claim of the subject_token has invalid format", issuer.config.GroupsClaim)
+			}
+			for _, group := range claimedGroups {
+				groups = append(groups, issuer.config.GroupsPrefix+group)
+			}
+		}
+	}
+
+	now := time.Now().UTC()
+	return &psession.PinnipedSession{
+		Fosite: &openid.DefaultSession{
+			Claims: &jwt.IDTokenClaims{
+				Subject:     subject,
+				RequestedAt: now,
+				AuthTime:    now,
+				Extra: map[string]interface{}{
+					DownstreamUsernameClaim: username,
+					DownstreamGroupsClaim:   groups,
+				},
+			},
+			Headers:  &jwt.Headers{},
+			Subject:  subject,
+			Username: username,
+		},
+		Custom: &psession.CustomSessionData{},
+	}, nil
+}
+
+func (t *trustedJWTIssuer) subjectIsAllowed(subject string) bool {
+	for _, allowed := range t.config.AllowedSubjects {
+		if strings.HasSuffix(allowed, "*") {
+			if strings.HasPrefix(subject, strings.TrimSuffix(allowed, "*")) {
+				return true
+			}
+		} else if subject == allowed {
+			return true
+		}
+	}
+	return false
+}
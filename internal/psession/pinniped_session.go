@@ -0,0 +1,87 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package psession contains the session type which the Supervisor stores for each downstream session.
+package psession
+
+import (
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/ory/fosite/token/jwt"
+)
+
+// PinnipedSession is a session container which can be used with fosite, and which can also
+// hold Pinniped-specific data about the downstream session.
+type PinnipedSession struct {
+	// Delegate most things to the fosite session.
+	Fosite *openid.DefaultSession `json:"fosite,omitempty"`
+
+	// Custom Pinniped extensions to the session data.
+	Custom *CustomSessionData `json:"custom,omitempty"`
+}
+
+var _ openid.Session = &PinnipedSession{}
+
+// CustomSessionData is the custom session data needed by Pinniped.
+type CustomSessionData struct {
+	// The Kubernetes resource name of the identity provider resource for the upstream IDP used to start this session.
+	// This can be empty for sessions that are created through mechanisms other than an upstream IDP.
+	ProviderName string `json:"providerName"`
+
+	// The JWK thumbprint of the DPoP key to which the tokens of this session are bound, as the "jkt" member of the
+	// "cnf" claim in https://datatracker.ietf.org/doc/html/rfc9449#section-6. Empty when the tokens are bearer tokens.
+	DPoPJKT string `json:"dpopJKT,omitempty"`
+}
+
+// NewPinnipedSession returns an empty session, which is ready to be filled in by fosite or by decoding stored JSON.
+func NewPinnipedSession() *PinnipedSession {
+	return &PinnipedSession{
+		Fosite: &openid.DefaultSession{
+			Claims:  &jwt.IDTokenClaims{},
+			Headers: &jwt.Headers{},
+		},
+		Custom: &CustomSessionData{},
+	}
+}
+
+func (s *PinnipedSession) Clone() fosite.Session {
+	if s == nil {
+		return nil
+	}
+	clone := &PinnipedSession{}
+	if s.Fosite != nil {
+		clone.Fosite = s.Fosite.Clone().(*openid.DefaultSession)
+	}
+	if s.Custom != nil {
+		// CustomSessionData only holds values, so a shallow copy is a deep copy.
+		custom := *s.Custom
+		clone.Custom = &custom
+	}
+	return clone
+}
+
+func (s *PinnipedSession) SetExpiresAt(key fosite.TokenType, exp time.Time) {
+	s.Fosite.SetExpiresAt(key, exp)
+}
+
+func (s *PinnipedSession) GetExpiresAt(key fosite.TokenType) time.Time {
+	return s.Fosite.GetExpiresAt(key)
+}
+
+func (s *PinnipedSession) GetUsername() string {
+	return s.Fosite.GetUsername()
+}
+
+func (s *PinnipedSession) GetSubject() string {
+	return s.Fosite.GetSubject()
+}
+
+func (s *PinnipedSession) IDTokenHeaders() *jwt.Headers {
+	return s.Fosite.IDTokenHeaders()
+}
+
+func (s *PinnipedSession) IDTokenClaims() *jwt.IDTokenClaims {
+	return s.Fosite.IDTokenClaims()
+}
@@ -0,0 +1,35 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package credentialrequest
+
+import (
+	"crypto/x509/pkix"
+	"errors"
+	"time"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// CertIssuers is a CertIssuer which issues certs with the first of its CertIssuers which can issue them, e.g. the
+// CA of the cluster when the kube-cert-agent could read it, and otherwise the CA of the impersonation proxy.
+type CertIssuers []CertIssuer
+
+var _ CertIssuer = CertIssuers{}
+
+func (c CertIssuers) IssuePEM(subject pkix.Name, dnsNames []string, ttl time.Duration) ([]byte, []byte, error) {
+	errs := make([]error, 0, len(c))
+	for _, issuer := range c {
+		certPEM, keyPEM, err := issuer.IssuePEM(subject, dnsNames, ttl)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return certPEM, keyPEM, nil
+	}
+
+	if err := utilerrors.NewAggregate(errs); err != nil {
+		return nil, nil, err
+	}
+	return nil, nil, errors.New("no cert issuers configured")
+}
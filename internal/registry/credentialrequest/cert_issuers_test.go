@@ -0,0 +1,87 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package credentialrequest
+
+import (
+	"crypto/x509/pkix"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/mocks/credentialrequestmocks"
+)
+
+func TestCertIssuers(t *testing.T) {
+	subject := pkix.Name{CommonName: "some-user", Organization: []string{"some-group"}}
+	ttl := 5 * time.Minute
+
+	failingIssuer := func(ctrl *gomock.Controller, message string) CertIssuer {
+		issuer := credentialrequestmocks.NewMockCertIssuer(ctrl)
+		issuer.EXPECT().IssuePEM(subject, []string{}, ttl).Return(nil, nil, errors.New(message))
+		return issuer
+	}
+	succeedingIssuer := func(ctrl *gomock.Controller, cert string) CertIssuer {
+		issuer := credentialrequestmocks.NewMockCertIssuer(ctrl)
+		issuer.EXPECT().IssuePEM(subject, []string{}, ttl).Return([]byte(cert), []byte("key of "+cert), nil)
+		return issuer
+	}
+	unusedIssuer := func(ctrl *gomock.Controller) CertIssuer {
+		return credentialrequestmocks.NewMockCertIssuer(ctrl)
+	}
+
+	tests := []struct {
+		name     string
+		issuers  func(ctrl *gomock.Controller) CertIssuers
+		wantCert string
+		wantErr  string
+	}{
+		{
+			name: "the first issuer succeeds",
+			issuers: func(ctrl *gomock.Controller) CertIssuers {
+				return CertIssuers{succeedingIssuer(ctrl, "first-cert"), unusedIssuer(ctrl)}
+			},
+			wantCert: "first-cert",
+		},
+		{
+			name: "a later issuer succeeds",
+			issuers: func(ctrl *gomock.Controller) CertIssuers {
+				return CertIssuers{failingIssuer(ctrl, "first error"), succeedingIssuer(ctrl, "second-cert")}
+			},
+			wantCert: "second-cert",
+		},
+		{
+			name: "all issuers fail",
+			issuers: func(ctrl *gomock.Controller) CertIssuers {
+				return CertIssuers{failingIssuer(ctrl, "first error"), failingIssuer(ctrl, "second error")}
+			},
+			wantErr: "[first error, second error]",
+		},
+		{
+			name:    "no issuers",
+			issuers: func(ctrl *gomock.Controller) CertIssuers { return CertIssuers{} },
+			wantErr: "no cert issuers configured",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			certPEM, keyPEM, err := test.issuers(ctrl).IssuePEM(subject, []string{}, ttl)
+			if test.wantErr != "" {
+				require.EqualError(t, err, test.wantErr)
+				require.Nil(t, certPEM)
+				require.Nil(t, keyPEM)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.wantCert, string(certPEM))
+			require.Equal(t, "key of "+test.wantCert, string(keyPEM))
+		})
+	}
+}
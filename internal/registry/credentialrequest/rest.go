@@ -6,7 +6,9 @@ package credentialrequest
 
 import (
 	"context"
+	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
 	"time"
 
@@ -23,29 +25,42 @@ import (
 	loginapi "go.pinniped.dev/generated/1.20/apis/concierge/login"
 )
 
-// clientCertificateTTL is the TTL for short-lived client certificates returned by this API.
-const clientCertificateTTL = 5 * time.Minute
+// defaultClientCertificateTTL is the TTL for short-lived client certificates returned by this API, unless the
+// authenticator of the request asks for another TTL.
+const defaultClientCertificateTTL = 5 * time.Minute
 
 type CertIssuer interface {
 	IssuePEM(subject pkix.Name, dnsNames []string, ttl time.Duration) ([]byte, []byte, error)
 }
 
+// TokenCredentialRequestAuthenticator authenticates the token of a TokenCredentialRequest. Along with the user, it
+// returns how long the client certificates for the authenticator of the request should be valid. A zero TTL means the
+// default TTL.
 type TokenCredentialRequestAuthenticator interface {
-	AuthenticateTokenCredentialRequest(ctx context.Context, req *loginapi.TokenCredentialRequest) (user.Info, error)
+	AuthenticateTokenCredentialRequest(ctx context.Context, req *loginapi.TokenCredentialRequest) (user.Info, time.Duration, error)
 }
 
-func NewREST(authenticator TokenCredentialRequestAuthenticator, issuer CertIssuer, resource schema.GroupResource) *REST {
+// NewREST returns the storage of TokenCredentialRequests. The TTL of the client certificates which it issues is
+// capped at maxClientCertificateTTL.
+func NewREST(
+	authenticator TokenCredentialRequestAuthenticator,
+	issuer CertIssuer,
+	maxClientCertificateTTL time.Duration,
+	resource schema.GroupResource,
+) *REST {
 	return &REST{
-		authenticator:  authenticator,
-		issuer:         issuer,
-		tableConvertor: rest.NewDefaultTableConvertor(resource),
+		authenticator:           authenticator,
+		issuer:                  issuer,
+		maxClientCertificateTTL: maxClientCertificateTTL,
+		tableConvertor:          rest.NewDefaultTableConvertor(resource),
 	}
 }
 
 type REST struct {
-	authenticator  TokenCredentialRequestAuthenticator
-	issuer         CertIssuer
-	tableConvertor rest.TableConvertor
+	authenticator           TokenCredentialRequestAuthenticator
+	issuer                  CertIssuer
+	maxClientCertificateTTL time.Duration
+	tableConvertor          rest.TableConvertor
 }
 
 // Assert that our *REST implements all the optional interfaces that we expect it to implement.
@@ -99,7 +114,7 @@ func (r *REST) Create(ctx context.Context, obj runtime.Object, createValidation
 		return nil, err
 	}
 
-	user, err := r.authenticator.AuthenticateTokenCredentialRequest(ctx, credentialRequest)
+	user, authenticatorTTL, err := r.authenticator.AuthenticateTokenCredentialRequest(ctx, credentialRequest)
 	if err != nil {
 		traceFailureWithError(t, "token authentication", err)
 		return failureResponse(), nil
@@ -115,19 +130,24 @@ func (r *REST) Create(ctx context.Context, obj runtime.Object, createValidation
 			Organization: user.GetGroups(),
 		},
 		[]string{},
-		clientCertificateTTL,
+		r.clientCertificateTTL(authenticatorTTL),
 	)
 	if err != nil {
 		traceFailureWithError(t, "cert issuer", err)
 		return failureResponse(), nil
 	}
+	notAfter, err := certificateNotAfter(certPEM)
+	if err != nil {
+		traceFailureWithError(t, "cert issuer", err)
+		return failureResponse(), nil
+	}
 
 	traceSuccess(t, user, true)
 
 	return &loginapi.TokenCredentialRequest{
 		Status: loginapi.TokenCredentialRequestStatus{
 			Credential: &loginapi.ClusterCredential{
-				ExpirationTimestamp:   metav1.NewTime(time.Now().UTC().Add(clientCertificateTTL)),
+				ExpirationTimestamp:   metav1.NewTime(notAfter.UTC()),
 				ClientCertificateData: string(certPEM),
 				ClientKeyData:         string(keyPEM),
 			},
@@ -135,6 +155,33 @@ func (r *REST) Create(ctx context.Context, obj runtime.Object, createValidation
 	}, nil
 }
 
+// clientCertificateTTL returns the TTL which the authenticator of the request asks for, or the default TTL, capped at
+// the maximum TTL.
+func (r *REST) clientCertificateTTL(authenticatorTTL time.Duration) time.Duration {
+	ttl := defaultClientCertificateTTL
+	if authenticatorTTL > 0 {
+		ttl = authenticatorTTL
+	}
+	if r.maxClientCertificateTTL > 0 && ttl > r.maxClientCertificateTTL {
+		ttl = r.maxClientCertificateTTL
+	}
+	return ttl
+}
+
+// certificateNotAfter returns the expiration time of a PEM encoded certificate, so that the response tells the client
+// exactly when its certificate expires.
+func certificateNotAfter(certPEM []byte) (time.Time, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return time.Time{}, fmt.Errorf("issued certificate is not PEM encoded")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse issued certificate: %w", err)
+	}
+	return cert.NotAfter, nil
+}
+
 func validateRequest(ctx context.Context, obj runtime.Object, createValidation rest.ValidateObjectFunc, options *metav1.CreateOptions, t *trace.Trace) (*loginapi.TokenCredentialRequest, error) {
 	credentialRequest, ok := obj.(*loginapi.TokenCredentialRequest)
 	if !ok {
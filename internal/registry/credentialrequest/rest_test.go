@@ -24,12 +24,13 @@ import (
 	"k8s.io/klog/v2"
 
 	loginapi "go.pinniped.dev/generated/1.20/apis/concierge/login"
+	"go.pinniped.dev/internal/certauthority"
 	"go.pinniped.dev/internal/mocks/credentialrequestmocks"
 	"go.pinniped.dev/internal/testutil"
 )
 
 func TestNew(t *testing.T) {
-	r := NewREST(nil, nil, schema.GroupResource{Group: "bears", Resource: "panda"})
+	r := NewREST(nil, nil, time.Hour, schema.GroupResource{Group: "bears", Resource: "panda"})
 	require.NotNil(t, r)
 	require.True(t, r.NamespaceScoped())
 	require.Equal(t, []string{"pinniped"}, r.Categories())
@@ -86,8 +87,9 @@ func TestCreate(t *testing.T) {
 					Name:   "test-user",
 					UID:    "test-user-uid",
 					Groups: []string{"test-group-1", "test-group-2"},
-				}, nil)
+				}, time.Duration(0), nil)
 
+			certPEM, notAfter := testCertPEM(t, 5*time.Minute)
 			issuer := credentialrequestmocks.NewMockCertIssuer(ctrl)
 			issuer.EXPECT().IssuePEM(
 				pkix.Name{
@@ -95,25 +97,20 @@ func TestCreate(t *testing.T) {
 					Organization: []string{"test-group-1", "test-group-2"}},
 				[]string{},
 				5*time.Minute,
-			).Return([]byte("test-cert"), []byte("test-key"), nil)
+			).Return(certPEM, []byte("test-key"), nil)
 
-			storage := NewREST(requestAuthenticator, issuer, schema.GroupResource{})
+			storage := NewREST(requestAuthenticator, issuer, time.Hour, schema.GroupResource{})
 
 			response, err := callCreate(context.Background(), storage, req)
 
 			r.NoError(err)
 			r.IsType(&loginapi.TokenCredentialRequest{}, response)
 
-			expires := response.(*loginapi.TokenCredentialRequest).Status.Credential.ExpirationTimestamp
-			r.NotNil(expires)
-			r.InDelta(time.Now().Add(5*time.Minute).Unix(), expires.Unix(), 5)
-			response.(*loginapi.TokenCredentialRequest).Status.Credential.ExpirationTimestamp = metav1.Time{}
-
 			r.Equal(response, &loginapi.TokenCredentialRequest{
 				Status: loginapi.TokenCredentialRequestStatus{
 					Credential: &loginapi.ClusterCredential{
-						ExpirationTimestamp:   metav1.Time{},
-						ClientCertificateData: "test-cert",
+						ExpirationTimestamp:   metav1.NewTime(notAfter),
+						ClientCertificateData: string(certPEM),
 						ClientKeyData:         "test-key",
 					},
 				},
@@ -121,6 +118,47 @@ func TestCreate(t *testing.T) {
 			requireOneLogStatement(r, logger, `"success" userID:test-user-uid,authenticated:true`)
 		})
 
+		when("the authenticator or the configuration ask for another client certificate TTL", func() {
+			var req *loginapi.TokenCredentialRequest
+
+			it.Before(func() {
+				req = validCredentialRequest()
+			})
+
+			createWithTTLs := func(authenticatorTTL, maxTTL, wantTTL time.Duration) {
+				requestAuthenticator := credentialrequestmocks.NewMockTokenCredentialRequestAuthenticator(ctrl)
+				requestAuthenticator.EXPECT().AuthenticateTokenCredentialRequest(gomock.Any(), req).
+					Return(&user.DefaultInfo{Name: "test-user", UID: "test-user-uid"}, authenticatorTTL, nil)
+
+				certPEM, notAfter := testCertPEM(t, wantTTL)
+				issuer := credentialrequestmocks.NewMockCertIssuer(ctrl)
+				issuer.EXPECT().IssuePEM(pkix.Name{CommonName: "test-user"}, []string{}, wantTTL).
+					Return(certPEM, []byte("test-key"), nil)
+
+				storage := NewREST(requestAuthenticator, issuer, maxTTL, schema.GroupResource{})
+
+				response, err := callCreate(context.Background(), storage, req)
+				r.NoError(err)
+				r.Equal(metav1.NewTime(notAfter), response.(*loginapi.TokenCredentialRequest).Status.Credential.ExpirationTimestamp)
+			}
+
+			it("uses the TTL of the authenticator", func() {
+				createWithTTLs(30*time.Minute, time.Hour, 30*time.Minute)
+			})
+
+			it("uses the default TTL when the authenticator does not ask for a TTL", func() {
+				createWithTTLs(0, time.Hour, 5*time.Minute)
+			})
+
+			it("caps the TTL of the authenticator at the maximum TTL", func() {
+				createWithTTLs(2*time.Hour, time.Hour, time.Hour)
+			})
+
+			it("caps the default TTL at the maximum TTL", func() {
+				createWithTTLs(0, time.Minute, time.Minute)
+			})
+		})
+
 		it("CreateFailsWithValidTokenWhenCertIssuerFails", func() {
 			req := validCredentialRequest()
 
@@ -129,27 +167,46 @@ func TestCreate(t *testing.T) {
 				Return(&user.DefaultInfo{
 					Name:   "test-user",
 					Groups: []string{"test-group-1", "test-group-2"},
-				}, nil)
+				}, time.Duration(0), nil)
 
 			issuer := credentialrequestmocks.NewMockCertIssuer(ctrl)
 			issuer.EXPECT().
 				IssuePEM(gomock.Any(), gomock.Any(), gomock.Any()).
 				Return(nil, nil, fmt.Errorf("some certificate authority error"))
 
-			storage := NewREST(requestAuthenticator, issuer, schema.GroupResource{})
+			storage := NewREST(requestAuthenticator, issuer, time.Hour, schema.GroupResource{})
 
 			response, err := callCreate(context.Background(), storage, req)
 			requireSuccessfulResponseWithAuthenticationFailureMessage(t, err, response)
 			requireOneLogStatement(r, logger, `"failure" failureType:cert issuer,msg:some certificate authority error`)
 		})
 
+		it("CreateFailsWhenTheCertIssuerReturnsAnInvalidCertificate", func() {
+			req := validCredentialRequest()
+
+			requestAuthenticator := credentialrequestmocks.NewMockTokenCredentialRequestAuthenticator(ctrl)
+			requestAuthenticator.EXPECT().AuthenticateTokenCredentialRequest(gomock.Any(), req).
+				Return(&user.DefaultInfo{Name: "test-user"}, time.Duration(0), nil)
+
+			issuer := credentialrequestmocks.NewMockCertIssuer(ctrl)
+			issuer.EXPECT().
+				IssuePEM(gomock.Any(), gomock.Any(), gomock.Any()).
+				Return([]byte("not a certificate"), []byte("test-key"), nil)
+
+			storage := NewREST(requestAuthenticator, issuer, time.Hour, schema.GroupResource{})
+
+			response, err := callCreate(context.Background(), storage, req)
+			requireSuccessfulResponseWithAuthenticationFailureMessage(t, err, response)
+			requireOneLogStatement(r, logger, `"failure" failureType:cert issuer,msg:issued certificate is not PEM encoded`)
+		})
+
 		it("CreateSucceedsWithAnUnauthenticatedStatusWhenGivenATokenAndTheWebhookReturnsNilUser", func() {
 			req := validCredentialRequest()
 
 			requestAuthenticator := credentialrequestmocks.NewMockTokenCredentialRequestAuthenticator(ctrl)
-			requestAuthenticator.EXPECT().AuthenticateTokenCredentialRequest(gomock.Any(), req).Return(nil, nil)
+			requestAuthenticator.EXPECT().AuthenticateTokenCredentialRequest(gomock.Any(), req).Return(nil, time.Duration(0), nil)
 
-			storage := NewREST(requestAuthenticator, nil, schema.GroupResource{})
+			storage := NewREST(requestAuthenticator, nil, time.Hour, schema.GroupResource{})
 
 			response, err := callCreate(context.Background(), storage, req)
 
@@ -162,9 +219,9 @@ func TestCreate(t *testing.T) {
 
 			requestAuthenticator := credentialrequestmocks.NewMockTokenCredentialRequestAuthenticator(ctrl)
 			requestAuthenticator.EXPECT().AuthenticateTokenCredentialRequest(gomock.Any(), req).
-				Return(nil, errors.New("some webhook error"))
+				Return(nil, time.Duration(0), errors.New("some webhook error"))
 
-			storage := NewREST(requestAuthenticator, nil, schema.GroupResource{})
+			storage := NewREST(requestAuthenticator, nil, time.Hour, schema.GroupResource{})
 
 			response, err := callCreate(context.Background(), storage, req)
 
@@ -177,9 +234,9 @@ func TestCreate(t *testing.T) {
 
 			requestAuthenticator := credentialrequestmocks.NewMockTokenCredentialRequestAuthenticator(ctrl)
 			requestAuthenticator.EXPECT().AuthenticateTokenCredentialRequest(gomock.Any(), req).
-				Return(&user.DefaultInfo{Name: ""}, nil)
+				Return(&user.DefaultInfo{Name: ""}, time.Duration(0), nil)
 
-			storage := NewREST(requestAuthenticator, nil, schema.GroupResource{})
+			storage := NewREST(requestAuthenticator, nil, time.Hour, schema.GroupResource{})
 
 			response, err := callCreate(context.Background(), storage, req)
 
@@ -189,7 +246,7 @@ func TestCreate(t *testing.T) {
 
 		it("CreateFailsWhenGivenTheWrongInputType", func() {
 			notACredentialRequest := runtime.Unknown{}
-			response, err := NewREST(nil, nil, schema.GroupResource{}).Create(
+			response, err := NewREST(nil, nil, time.Hour, schema.GroupResource{}).Create(
 				genericapirequest.NewContext(),
 				&notACredentialRequest,
 				rest.ValidateAllObjectFunc,
@@ -200,7 +257,7 @@ func TestCreate(t *testing.T) {
 		})
 
 		it("CreateFailsWhenTokenValueIsEmptyInRequest", func() {
-			storage := NewREST(nil, nil, schema.GroupResource{})
+			storage := NewREST(nil, nil, time.Hour, schema.GroupResource{})
 			response, err := callCreate(context.Background(), storage, credentialRequest(loginapi.TokenCredentialRequestSpec{
 				Token: "",
 			}))
@@ -211,7 +268,7 @@ func TestCreate(t *testing.T) {
 		})
 
 		it("CreateFailsWhenValidationFails", func() {
-			storage := NewREST(nil, nil, schema.GroupResource{})
+			storage := NewREST(nil, nil, time.Hour, schema.GroupResource{})
 			response, err := storage.Create(
 				context.Background(),
 				validCredentialRequest(),
@@ -229,9 +286,9 @@ func TestCreate(t *testing.T) {
 
 			requestAuthenticator := credentialrequestmocks.NewMockTokenCredentialRequestAuthenticator(ctrl)
 			requestAuthenticator.EXPECT().AuthenticateTokenCredentialRequest(gomock.Any(), req.DeepCopy()).
-				Return(&user.DefaultInfo{Name: "test-user"}, nil)
+				Return(&user.DefaultInfo{Name: "test-user"}, time.Duration(0), nil)
 
-			storage := NewREST(requestAuthenticator, successfulIssuer(ctrl), schema.GroupResource{})
+			storage := NewREST(requestAuthenticator, successfulIssuer(t, ctrl), time.Hour, schema.GroupResource{})
 			response, err := storage.Create(
 				context.Background(),
 				req,
@@ -250,9 +307,9 @@ func TestCreate(t *testing.T) {
 
 			requestAuthenticator := credentialrequestmocks.NewMockTokenCredentialRequestAuthenticator(ctrl)
 			requestAuthenticator.EXPECT().AuthenticateTokenCredentialRequest(gomock.Any(), req.DeepCopy()).
-				Return(&user.DefaultInfo{Name: "test-user"}, nil)
+				Return(&user.DefaultInfo{Name: "test-user"}, time.Duration(0), nil)
 
-			storage := NewREST(requestAuthenticator, successfulIssuer(ctrl), schema.GroupResource{})
+			storage := NewREST(requestAuthenticator, successfulIssuer(t, ctrl), time.Hour, schema.GroupResource{})
 			validationFunctionWasCalled := false
 			var validationFunctionSawTokenValue string
 			response, err := storage.Create(
@@ -272,7 +329,7 @@ func TestCreate(t *testing.T) {
 		})
 
 		it("CreateFailsWhenRequestOptionsDryRunIsNotEmpty", func() {
-			response, err := NewREST(nil, nil, schema.GroupResource{}).Create(
+			response, err := NewREST(nil, nil, time.Hour, schema.GroupResource{}).Create(
 				genericapirequest.NewContext(),
 				validCredentialRequest(),
 				rest.ValidateAllObjectFunc,
@@ -342,11 +399,24 @@ func requireSuccessfulResponseWithAuthenticationFailureMessage(t *testing.T, err
 	})
 }
 
-func successfulIssuer(ctrl *gomock.Controller) CertIssuer {
+// testCertPEM returns a real certificate which is valid for ttl, and its expiration time.
+func testCertPEM(t *testing.T, ttl time.Duration) ([]byte, time.Time) {
+	t.Helper()
+	ca, err := certauthority.New(pkix.Name{CommonName: "test-ca"}, time.Hour)
+	require.NoError(t, err)
+	cert, err := ca.Issue(pkix.Name{CommonName: "test-user"}, nil, nil, ttl)
+	require.NoError(t, err)
+	certPEM, _, err := certauthority.ToPEM(cert)
+	require.NoError(t, err)
+	return certPEM, cert.Leaf.NotAfter.UTC()
+}
+
+func successfulIssuer(t *testing.T, ctrl *gomock.Controller) CertIssuer {
+	certPEM, _ := testCertPEM(t, 5*time.Minute)
 	issuer := credentialrequestmocks.NewMockCertIssuer(ctrl)
 	issuer.EXPECT().
 		IssuePEM(gomock.Any(), gomock.Any(), gomock.Any()).
-		Return([]byte("test-cert"), []byte("test-key"), nil)
+		Return(certPEM, []byte("test-key"), nil)
 	return issuer
 }
 
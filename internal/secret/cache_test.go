@@ -1,4 +1,4 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package secret
@@ -18,44 +18,44 @@ const (
 )
 
 var (
-	csrfCookieEncoderHashKey = []byte("csrf-cookie-encoder-hash-key")
-	tokenHMACKey             = []byte("token-hmac-key")
-	stateEncoderHashKey      = []byte("state-encoder-hash-key")
-	otherStateEncoderHashKey = []byte("other-state-encoder-hash-key")
-	stateEncoderBlockKey     = []byte("state-encoder-block-key")
+	csrfCookieEncoderHashKeys = [][]byte{[]byte("csrf-cookie-encoder-hash-key"), []byte("previous-csrf-cookie-encoder-hash-key")}
+	tokenHMACKey              = []byte("token-hmac-key")
+	stateEncoderHashKeys      = [][]byte{[]byte("state-encoder-hash-key")}
+	otherStateEncoderHashKeys = [][]byte{[]byte("other-state-encoder-hash-key"), []byte("state-encoder-hash-key")}
+	stateEncoderBlockKeys     = [][]byte{[]byte("state-encoder-block-key")}
 )
 
 func TestCache(t *testing.T) {
 	c := New()
 
 	// Validate we get a nil return value when stuff does not exist.
-	require.Nil(t, c.GetCSRFCookieEncoderHashKey())
+	require.Nil(t, c.GetCSRFCookieEncoderHashKeys())
 	require.Nil(t, c.GetTokenHMACKey(issuer))
-	require.Nil(t, c.GetStateEncoderHashKey(issuer))
-	require.Nil(t, c.GetStateEncoderBlockKey(issuer))
+	require.Nil(t, c.GetStateEncoderHashKeys(issuer))
+	require.Nil(t, c.GetStateEncoderBlockKeys(issuer))
 
 	// Validate we get some nil and non-nil values when some stuff exists.
-	c.SetCSRFCookieEncoderHashKey(csrfCookieEncoderHashKey)
-	require.Equal(t, csrfCookieEncoderHashKey, c.GetCSRFCookieEncoderHashKey())
+	c.SetCSRFCookieEncoderHashKeys(csrfCookieEncoderHashKeys)
+	require.Equal(t, csrfCookieEncoderHashKeys, c.GetCSRFCookieEncoderHashKeys())
 	require.Nil(t, c.GetTokenHMACKey(issuer))
-	c.SetStateEncoderHashKey(issuer, stateEncoderHashKey)
-	require.Equal(t, stateEncoderHashKey, c.GetStateEncoderHashKey(issuer))
-	require.Nil(t, c.GetStateEncoderBlockKey(issuer))
+	c.SetStateEncoderHashKeys(issuer, stateEncoderHashKeys)
+	require.Equal(t, stateEncoderHashKeys, c.GetStateEncoderHashKeys(issuer))
+	require.Nil(t, c.GetStateEncoderBlockKeys(issuer))
 
 	// Validate we get non-nil values when all stuff exists.
-	c.SetCSRFCookieEncoderHashKey(csrfCookieEncoderHashKey)
+	c.SetCSRFCookieEncoderHashKeys(csrfCookieEncoderHashKeys)
 	c.SetTokenHMACKey(issuer, tokenHMACKey)
-	c.SetStateEncoderHashKey(issuer, otherStateEncoderHashKey)
-	c.SetStateEncoderBlockKey(issuer, stateEncoderBlockKey)
-	require.Equal(t, csrfCookieEncoderHashKey, c.GetCSRFCookieEncoderHashKey())
+	c.SetStateEncoderHashKeys(issuer, otherStateEncoderHashKeys)
+	c.SetStateEncoderBlockKeys(issuer, stateEncoderBlockKeys)
+	require.Equal(t, csrfCookieEncoderHashKeys, c.GetCSRFCookieEncoderHashKeys())
 	require.Equal(t, tokenHMACKey, c.GetTokenHMACKey(issuer))
-	require.Equal(t, otherStateEncoderHashKey, c.GetStateEncoderHashKey(issuer))
-	require.Equal(t, stateEncoderBlockKey, c.GetStateEncoderBlockKey(issuer))
+	require.Equal(t, otherStateEncoderHashKeys, c.GetStateEncoderHashKeys(issuer))
+	require.Equal(t, stateEncoderBlockKeys, c.GetStateEncoderBlockKeys(issuer))
 
 	// Validate that stuff is still nil for an unknown issuer.
 	require.Nil(t, c.GetTokenHMACKey(otherIssuer))
-	require.Nil(t, c.GetStateEncoderHashKey(otherIssuer))
-	require.Nil(t, c.GetStateEncoderBlockKey(otherIssuer))
+	require.Nil(t, c.GetStateEncoderHashKeys(otherIssuer))
+	require.Nil(t, c.GetStateEncoderBlockKeys(otherIssuer))
 }
 
 // TestCacheSynchronized should mimic the behavior of an FederationDomain: multiple goroutines
@@ -63,10 +63,10 @@ func TestCache(t *testing.T) {
 func TestCacheSynchronized(t *testing.T) {
 	c := New()
 
-	c.SetCSRFCookieEncoderHashKey(csrfCookieEncoderHashKey)
+	c.SetCSRFCookieEncoderHashKeys(csrfCookieEncoderHashKeys)
 	c.SetTokenHMACKey(issuer, tokenHMACKey)
-	c.SetStateEncoderHashKey(issuer, stateEncoderHashKey)
-	c.SetStateEncoderBlockKey(issuer, stateEncoderBlockKey)
+	c.SetStateEncoderHashKeys(issuer, stateEncoderHashKeys)
+	c.SetStateEncoderBlockKeys(issuer, stateEncoderBlockKeys)
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
 	defer cancel()
@@ -75,20 +75,20 @@ func TestCacheSynchronized(t *testing.T) {
 
 	eg.Go(func() error {
 		for i := 0; i < 100; i++ {
-			require.Equal(t, csrfCookieEncoderHashKey, c.GetCSRFCookieEncoderHashKey())
+			require.Equal(t, csrfCookieEncoderHashKeys, c.GetCSRFCookieEncoderHashKeys())
 			require.Equal(t, tokenHMACKey, c.GetTokenHMACKey(issuer))
-			require.Equal(t, stateEncoderHashKey, c.GetStateEncoderHashKey(issuer))
-			require.Equal(t, stateEncoderBlockKey, c.GetStateEncoderBlockKey(issuer))
+			require.Equal(t, stateEncoderHashKeys, c.GetStateEncoderHashKeys(issuer))
+			require.Equal(t, stateEncoderBlockKeys, c.GetStateEncoderBlockKeys(issuer))
 		}
 		return nil
 	})
 
 	eg.Go(func() error {
 		for i := 0; i < 100; i++ {
-			require.Equal(t, csrfCookieEncoderHashKey, c.GetCSRFCookieEncoderHashKey())
+			require.Equal(t, csrfCookieEncoderHashKeys, c.GetCSRFCookieEncoderHashKeys())
 			require.Equal(t, tokenHMACKey, c.GetTokenHMACKey(issuer))
-			require.Equal(t, stateEncoderHashKey, c.GetStateEncoderHashKey(issuer))
-			require.Equal(t, stateEncoderBlockKey, c.GetStateEncoderBlockKey(issuer))
+			require.Equal(t, stateEncoderHashKeys, c.GetStateEncoderHashKeys(issuer))
+			require.Equal(t, stateEncoderBlockKeys, c.GetStateEncoderBlockKeys(issuer))
 		}
 		return nil
 	})
@@ -96,8 +96,8 @@ func TestCacheSynchronized(t *testing.T) {
 	eg.Go(func() error {
 		for i := 0; i < 100; i++ {
 			require.Nil(t, c.GetTokenHMACKey(otherIssuer))
-			require.Nil(t, c.GetStateEncoderHashKey(otherIssuer))
-			require.Nil(t, c.GetStateEncoderBlockKey(otherIssuer))
+			require.Nil(t, c.GetStateEncoderHashKeys(otherIssuer))
+			require.Nil(t, c.GetStateEncoderBlockKeys(otherIssuer))
 		}
 		return nil
 	})
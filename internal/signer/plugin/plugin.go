@@ -0,0 +1,207 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package plugin implements the gRPC API between Pinniped and the signing plugins which hold its signing keys, for
+// example in an external key management service. A plugin runs next to Pinniped, for example as a sidecar
+// container, and serves the API on a Unix socket which is shared with Pinniped.
+//
+// The messages are encoded as JSON, so that plugins can be written without generating code from a protobuf
+// definition. The API has two unary methods in the pinniped.signer.v1alpha1.Signer service:
+//
+//	PublicKey({"keyID": string}) returns {"publicKey": base64 PKIX DER}
+//	Sign({"keyID": string, "digest": base64, "hash": "SHA256"|"SHA384"|"SHA512"|""}) returns {"signature": base64}
+//
+// The signature is in the same format as the one returned by the crypto.Signer of the key, for example ASN.1 DER
+// for ECDSA keys.
+package plugin
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+const (
+	serviceName = "pinniped.signer.v1alpha1.Signer"
+
+	publicKeyMethod = "/" + serviceName + "/PublicKey"
+	signMethod      = "/" + serviceName + "/Sign"
+
+	// signTimeout bounds each signing request, since crypto.Signer does not take a context.
+	signTimeout = 30 * time.Second
+)
+
+// KeyStore is implemented by signing plugins.
+type KeyStore interface {
+	// PublicKey returns the public key of the key with the given ID.
+	PublicKey(ctx context.Context, keyID string) (crypto.PublicKey, error)
+
+	// Sign signs digest, which is the output of hash, with the key with the given ID. The hash is zero when the
+	// message was not hashed, for example for ed25519 keys.
+	Sign(ctx context.Context, keyID string, digest []byte, hash crypto.Hash) ([]byte, error)
+}
+
+type publicKeyRequest struct {
+	KeyID string `json:"keyID"`
+}
+
+type publicKeyResponse struct {
+	PublicKey []byte `json:"publicKey"`
+}
+
+type signRequest struct {
+	KeyID  string `json:"keyID"`
+	Digest []byte `json:"digest"`
+	Hash   string `json:"hash"`
+}
+
+type signResponse struct {
+	Signature []byte `json:"signature"`
+}
+
+//nolint: gochecknoglobals
+var hashNames = map[crypto.Hash]string{
+	0:             "",
+	crypto.SHA256: "SHA256",
+	crypto.SHA384: "SHA384",
+	crypto.SHA512: "SHA512",
+}
+
+func hashName(hash crypto.Hash) (string, error) {
+	name, ok := hashNames[hash]
+	if !ok {
+		return "", fmt.Errorf("unsupported hash function %d", hash)
+	}
+	return name, nil
+}
+
+func hashByName(name string) (crypto.Hash, error) {
+	for hash, hashName := range hashNames {
+		if hashName == name {
+			return hash, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported hash function %q", name)
+}
+
+// jsonCodec encodes the gRPC messages as JSON. It is both a grpc.Codec, for the server, and an encoding.Codec, for
+// the client.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return "json" }
+func (jsonCodec) String() string                             { return "json" }
+
+// NewServer returns a gRPC server which serves the signing plugin API using keys. The caller is responsible for
+// serving it on a Unix socket, and for stopping it.
+func NewServer(keys KeyStore) *grpc.Server {
+	server := grpc.NewServer(grpc.CustomCodec(jsonCodec{})) //nolint: staticcheck // the replacement is not available in our version of gRPC
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: serviceName,
+		HandlerType: (*KeyStore)(nil),
+		Methods: []grpc.MethodDesc{
+			{MethodName: "PublicKey", Handler: handlePublicKey},
+			{MethodName: "Sign", Handler: handleSign},
+		},
+	}, keys)
+	return server
+}
+
+func handlePublicKey(srv interface{}, ctx context.Context, decode func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) { //nolint: golint // the signature is defined by gRPC
+	var request publicKeyRequest
+	if err := decode(&request); err != nil {
+		return nil, err
+	}
+	publicKey, err := srv.(KeyStore).PublicKey(ctx, request.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &publicKeyResponse{PublicKey: der}, nil
+}
+
+func handleSign(srv interface{}, ctx context.Context, decode func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) { //nolint: golint // the signature is defined by gRPC
+	var request signRequest
+	if err := decode(&request); err != nil {
+		return nil, err
+	}
+	hash, err := hashByName(request.Hash)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := srv.(KeyStore).Sign(ctx, request.KeyID, request.Digest, hash)
+	if err != nil {
+		return nil, err
+	}
+	return &signResponse{Signature: signature}, nil
+}
+
+// NewSigner connects to the signing plugin which serves its API on the given Unix socket, and returns a
+// crypto.Signer which signs with the key with the given ID.
+func NewSigner(ctx context.Context, socket, keyID string) (crypto.Signer, error) {
+	conn, err := grpc.DialContext(ctx, socket,
+		grpc.WithInsecure(), // the plugin is reached through a local Unix socket
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", addr)
+		}),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(jsonCodec{})),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to signing plugin at %s: %w", socket, err)
+	}
+
+	var response publicKeyResponse
+	if err := conn.Invoke(ctx, publicKeyMethod, &publicKeyRequest{KeyID: keyID}, &response); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("could not get public key %q from signing plugin at %s: %w", keyID, socket, err)
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(response.PublicKey)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("could not parse public key %q from signing plugin at %s: %w", keyID, socket, err)
+	}
+	return &pluginSigner{conn: conn, keyID: keyID, publicKey: publicKey}, nil
+}
+
+type pluginSigner struct {
+	conn      *grpc.ClientConn
+	keyID     string
+	publicKey crypto.PublicKey
+}
+
+func (s *pluginSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign asks the plugin to sign digest. The rand argument is ignored, since the plugin has its own source of
+// randomness.
+func (s *pluginSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		return nil, fmt.Errorf("signing plugins do not support RSA-PSS signatures")
+	}
+	hash, err := hashName(opts.HashFunc())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), signTimeout)
+	defer cancel()
+	var response signResponse
+	if err := s.conn.Invoke(ctx, signMethod, &signRequest{KeyID: s.keyID, Digest: digest, Hash: hash}, &response); err != nil {
+		return nil, fmt.Errorf("signing plugin could not sign with key %q: %w", s.keyID, err)
+	}
+	return response.Signature, nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package plugin_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/signer/plugin"
+	"go.pinniped.dev/internal/testutil/fakekms"
+)
+
+func TestPluginSigner(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	kms := fakekms.New(map[string]crypto.Signer{"ec-key": ecKey, "rsa-key": rsaKey})
+	socket := kms.Start(t)
+	ctx := context.Background()
+
+	t.Run("ecdsa", func(t *testing.T) {
+		signer, err := plugin.NewSigner(ctx, socket, "ec-key")
+		require.NoError(t, err)
+		require.Equal(t, &ecKey.PublicKey, signer.Public())
+
+		digest := sha256.Sum256([]byte("some message"))
+		signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+		require.NoError(t, err)
+
+		var parsed struct{ R, S *big.Int }
+		_, err = asn1.Unmarshal(signature, &parsed)
+		require.NoError(t, err)
+		require.True(t, ecdsa.Verify(&ecKey.PublicKey, digest[:], parsed.R, parsed.S))
+		require.Equal(t, 1, kms.Signatures("ec-key"))
+	})
+
+	t.Run("rsa", func(t *testing.T) {
+		signer, err := plugin.NewSigner(ctx, socket, "rsa-key")
+		require.NoError(t, err)
+		require.Equal(t, &rsaKey.PublicKey, signer.Public())
+
+		digest := sha512.Sum384([]byte("some message"))
+		signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA384)
+		require.NoError(t, err)
+		require.NoError(t, rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA384, digest[:], signature))
+
+		_, err = signer.Sign(rand.Reader, digest[:], &rsa.PSSOptions{Hash: crypto.SHA384})
+		require.EqualError(t, err, "signing plugins do not support RSA-PSS signatures")
+
+		_, err = signer.Sign(rand.Reader, digest[:], crypto.SHA1)
+		require.EqualError(t, err, "unsupported hash function 3")
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		_, err := plugin.NewSigner(ctx, socket, "other-key")
+		require.EqualError(t, err, `could not get public key "other-key" from signing plugin at `+socket+`: rpc error: code = Unknown desc = key "other-key" not found`)
+	})
+}
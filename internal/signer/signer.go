@@ -0,0 +1,113 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package signer loads the crypto.Signer which is referred to by a Reference, so that signing keys can be kept in a
+// file, such as a mounted Secret, or in an external key management service which is reached through a signing
+// plugin.
+package signer
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+
+	"go.pinniped.dev/internal/constable"
+	"go.pinniped.dev/internal/signer/plugin"
+)
+
+// Reference refers to a signing key. Exactly one of its fields must be set.
+type Reference struct {
+	// File is the path of a PEM-encoded private key, which is usually mounted from a Secret.
+	File string `json:"file,omitempty"`
+
+	// Plugin refers to a key which is held by a signing plugin.
+	Plugin *PluginReference `json:"plugin,omitempty"`
+}
+
+// PluginReference refers to a key which is held by a signing plugin, for example a plugin which forwards the
+// signing requests to an external key management service.
+type PluginReference struct {
+	// Socket is the path of the Unix socket on which the plugin serves its gRPC API.
+	Socket string `json:"socket"`
+
+	// KeyID identifies the key within the plugin.
+	KeyID string `json:"keyID"`
+}
+
+// Validate returns an error when ref does not refer to exactly one signing key.
+func (ref *Reference) Validate() error {
+	switch {
+	case ref.File != "" && ref.Plugin != nil:
+		return constable.Error("only one of file or plugin may be set")
+	case ref.File != "":
+		return nil
+	case ref.Plugin != nil:
+		if ref.Plugin.Socket == "" {
+			return constable.Error("plugin.socket is required")
+		}
+		if ref.Plugin.KeyID == "" {
+			return constable.Error("plugin.keyID is required")
+		}
+		return nil
+	default:
+		return constable.Error("one of file or plugin must be set")
+	}
+}
+
+// New returns the crypto.Signer which is referred to by ref. A plugin must already be running, since New asks it
+// for the public key.
+func New(ctx context.Context, ref *Reference) (crypto.Signer, error) {
+	if err := ref.Validate(); err != nil {
+		return nil, err
+	}
+	if ref.Plugin != nil {
+		return plugin.NewSigner(ctx, ref.Plugin.Socket, ref.Plugin.KeyID)
+	}
+	return FromFile(ref.File)
+}
+
+// FromFile returns the private key in the given PEM file.
+func FromFile(path string) (crypto.Signer, error) {
+	keyPEM, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read signing key: %w", err)
+	}
+	key, err := FromPEM(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("could not load signing key from %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// FromPEM returns the private key in keyPEM, which may be in PKCS #8, SEC 1 EC or PKCS #1 RSA form.
+func FromPEM(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, constable.Error("no PEM block found")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package signer
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/testutil"
+	"go.pinniped.dev/internal/testutil/fakekms"
+)
+
+func TestReferenceValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		ref     Reference
+		wantErr string
+	}{
+		{
+			name: "file",
+			ref:  Reference{File: "/some/key.pem"},
+		},
+		{
+			name: "plugin",
+			ref:  Reference{Plugin: &PluginReference{Socket: "/some/plugin.sock", KeyID: "some-key"}},
+		},
+		{
+			name:    "nothing",
+			ref:     Reference{},
+			wantErr: "one of file or plugin must be set",
+		},
+		{
+			name:    "both",
+			ref:     Reference{File: "/some/key.pem", Plugin: &PluginReference{Socket: "/some/plugin.sock", KeyID: "some-key"}},
+			wantErr: "only one of file or plugin may be set",
+		},
+		{
+			name:    "plugin without socket",
+			ref:     Reference{Plugin: &PluginReference{KeyID: "some-key"}},
+			wantErr: "plugin.socket is required",
+		},
+		{
+			name:    "plugin without key ID",
+			ref:     Reference{Plugin: &PluginReference{Socket: "/some/plugin.sock"}},
+			wantErr: "plugin.keyID is required",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.ref.Validate()
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestFromPEM(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pkcs8DER, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		pem     []byte
+		want    crypto.Signer
+		wantErr string
+	}{
+		{
+			name: "EC private key",
+			pem:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}),
+			want: ecKey,
+		},
+		{
+			name: "RSA private key",
+			pem:  pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}),
+			want: rsaKey,
+		},
+		{
+			name: "PKCS #8 private key",
+			pem:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8DER}),
+			want: rsaKey,
+		},
+		{
+			name:    "not PEM",
+			pem:     []byte("some key"),
+			wantErr: "no PEM block found",
+		},
+		{
+			name:    "certificate",
+			pem:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("some cert")}),
+			wantErr: `unsupported PEM block type "CERTIFICATE"`,
+		},
+		{
+			name:    "invalid key",
+			pem:     pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte("some key")}),
+			wantErr: "x509: failed to parse EC private key",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FromPEM(tt.pem)
+			if tt.wantErr != "" {
+				// The rest of the message depends on the version of Go.
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	ctx := context.Background()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	t.Run("file", func(t *testing.T) {
+		der, err := x509.MarshalECPrivateKey(key)
+		require.NoError(t, err)
+		path := filepath.Join(testutil.TempDir(t), "key.pem")
+		require.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+
+		got, err := New(ctx, &Reference{File: path})
+		require.NoError(t, err)
+		require.Equal(t, key, got)
+
+		_, err = New(ctx, &Reference{File: path + "-missing"})
+		require.EqualError(t, err, "could not read signing key: open "+path+"-missing: no such file or directory")
+	})
+
+	t.Run("plugin", func(t *testing.T) {
+		socket := fakekms.New(map[string]crypto.Signer{"some-key": key}).Start(t)
+		got, err := New(ctx, &Reference{Plugin: &PluginReference{Socket: socket, KeyID: "some-key"}})
+		require.NoError(t, err)
+		require.Equal(t, &key.PublicKey, got.Public())
+	})
+
+	t.Run("invalid reference", func(t *testing.T) {
+		_, err := New(ctx, &Reference{})
+		require.EqualError(t, err, "one of file or plugin must be set")
+	})
+}
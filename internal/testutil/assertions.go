@@ -1,12 +1,15 @@
-// Copyright 2020 the Pinniped contributors. All Rights Reserved.
+// Copyright 2020-2021 the Pinniped contributors. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
 package testutil
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"mime"
 	"net/http/httptest"
+	"regexp"
 	"testing"
 	"time"
 
@@ -67,3 +70,16 @@ func RequireSecurityHeaders(t *testing.T, response *httptest.ResponseRecorder) {
 	// This check is more relaxed since Fosite can override the base header we set.
 	require.Contains(t, response.Header().Get("Cache-Control"), "no-store")
 }
+
+// RequireStyleAllowedByCSP asserts that the inline style of an HTML page is the only style allowed by the
+// Content-Security-Policy, so that browsers apply it.
+func RequireStyleAllowedByCSP(t *testing.T, rsp *httptest.ResponseRecorder) {
+	t.Helper()
+	submatches := regexp.MustCompile(`<style>(.*)</style>`).FindStringSubmatch(rsp.Body.String())
+	require.Len(t, submatches, 2)
+	styleHash := sha256.Sum256([]byte(submatches[1]))
+	require.Equal(t,
+		"default-src 'none'; style-src 'sha256-"+base64.StdEncoding.EncodeToString(styleHash[:])+"'; img-src https:; frame-ancestors 'none'",
+		rsp.Header().Get("Content-Security-Policy"),
+	)
+}
@@ -0,0 +1,78 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package fakekms provides a signing plugin which keeps its keys in memory, so that it can stand in for a signing
+// plugin of an external key management service in tests.
+package fakekms
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pinniped.dev/internal/signer/plugin"
+	"go.pinniped.dev/internal/testutil"
+)
+
+// KMS is a plugin.KeyStore which keeps its keys in memory and records how many signatures each key made.
+type KMS struct {
+	keys map[string]crypto.Signer
+
+	mutex      sync.Mutex
+	signatures map[string]int
+}
+
+var _ plugin.KeyStore = &KMS{}
+
+// New returns a KMS which holds the given keys by their IDs.
+func New(keys map[string]crypto.Signer) *KMS {
+	return &KMS{keys: keys, signatures: map[string]int{}}
+}
+
+// Start serves the signing plugin API of k on a new Unix socket until the test finishes, and returns the path of
+// the socket.
+func (k *KMS) Start(t *testing.T) string {
+	t.Helper()
+
+	socket := filepath.Join(testutil.TempDir(t), "kms.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	server := plugin.NewServer(k)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+	return socket
+}
+
+// Signatures returns how many signatures were made with the key with the given ID.
+func (k *KMS) Signatures(keyID string) int {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.signatures[keyID]
+}
+
+func (k *KMS) PublicKey(_ context.Context, keyID string) (crypto.PublicKey, error) {
+	key, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("key %q not found", keyID)
+	}
+	return key.Public(), nil
+}
+
+func (k *KMS) Sign(_ context.Context, keyID string, digest []byte, hash crypto.Hash) ([]byte, error) {
+	key, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("key %q not found", keyID)
+	}
+	k.mutex.Lock()
+	k.signatures[keyID]++
+	k.mutex.Unlock()
+	return key.Sign(rand.Reader, digest, hash)
+}
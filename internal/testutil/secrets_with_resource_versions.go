@@ -0,0 +1,55 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package testutil
+
+import (
+	"strconv"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	coretesting "k8s.io/client-go/testing"
+)
+
+// NewFakeClientsetWithSecretResourceVersions returns a fake clientset which implements the optimistic concurrency of
+// a real API server for the Secrets in namespace, which the fake clientset does not implement by itself: every write
+// gets a new resource version, and updates at an old resource version are rejected with a conflict error.
+func NewFakeClientsetWithSecretResourceVersions(namespace string) *fake.Clientset {
+	secretsGVR := corev1.SchemeGroupVersion.WithResource("secrets")
+	client := fake.NewSimpleClientset()
+
+	var lock sync.Mutex
+	nextResourceVersion := 0
+	write := func(secret *corev1.Secret) *corev1.Secret {
+		nextResourceVersion++
+		secret = secret.DeepCopy()
+		secret.ResourceVersion = strconv.Itoa(nextResourceVersion)
+		return secret
+	}
+
+	client.PrependReactor("create", "secrets", func(action coretesting.Action) (bool, runtime.Object, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		secret := write(action.(coretesting.CreateAction).GetObject().(*corev1.Secret))
+		return true, secret, client.Tracker().Create(secretsGVR, secret, namespace)
+	})
+	client.PrependReactor("update", "secrets", func(action coretesting.Action) (bool, runtime.Object, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		secret := action.(coretesting.UpdateAction).GetObject().(*corev1.Secret)
+		current, err := client.Tracker().Get(secretsGVR, namespace, secret.Name)
+		if err != nil {
+			return true, nil, err
+		}
+		if current.(*corev1.Secret).ResourceVersion != secret.ResourceVersion {
+			return true, nil, apierrors.NewConflict(secretsGVR.GroupResource(), secret.Name, nil)
+		}
+		secret = write(secret)
+		return true, secret, client.Tracker().Update(secretsGVR, secret, namespace)
+	})
+
+	return client
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package storagebackends provides each of the session storage backends, so that the tests of the session storage
+// can be run against all of them.
+//
+// The SQL backend is tested against SQLite, whose driver requires cgo. It must only ever be imported by tests: the
+// Supervisor itself only supports PostgreSQL, using the pure Go lib/pq driver, so that it can still be built with
+// CGO_ENABLED=0.
+package storagebackends
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3" // register the "sqlite3" driver, which requires cgo, for tests only
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"go.pinniped.dev/internal/crud"
+)
+
+// Backend is a session storage backend with a name which can be used as the name of a subtest.
+type Backend struct {
+	Name string
+	crud.Backend
+}
+
+// All returns a new, empty instance of each session storage backend.
+func All(t *testing.T) []Backend {
+	t.Helper()
+	return []Backend{
+		{Name: "secrets", Backend: crud.NewSecretsBackend(fake.NewSimpleClientset().CoreV1().Secrets("some-namespace"))},
+		{Name: "sql", Backend: NewSQL(t)},
+	}
+}
+
+// NewSQL returns a SQL backend which stores the sessions in a new in-memory SQLite database. The database is closed
+// when the test finishes.
+func NewSQL(t *testing.T) *crud.SQLBackend {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, db.Close()) })
+
+	// Every connection to ":memory:" opens a different database, so only ever use one connection.
+	db.SetMaxOpenConns(1)
+
+	backend := crud.NewSQLBackend(db)
+	require.NoError(t, backend.CreateSchema(context.Background()))
+	return backend
+}
@@ -28,11 +28,14 @@ func New(config *oauth2.Config, provider *coreosoidc.Provider, client *http.Clie
 
 // ProviderConfig holds the active configuration of an upstream OIDC provider.
 type ProviderConfig struct {
-	Name          string
-	UsernameClaim string
-	GroupsClaim   string
-	Config        *oauth2.Config
-	Provider      interface {
+	Name              string
+	UsernameClaim     string
+	GroupsClaim       string
+	AdditionalClaims  map[string]string
+	RequiredACRValues []string
+	RequiredAMRValues []string
+	Config            *oauth2.Config
+	Provider          interface {
 		Verifier(*coreosoidc.Config) *coreosoidc.IDTokenVerifier
 		UserInfo(ctx context.Context, tokenSource oauth2.TokenSource) (*coreosoidc.UserInfo, error)
 	}
@@ -64,6 +67,18 @@ func (p *ProviderConfig) GetGroupsClaim() string {
 	return p.GroupsClaim
 }
 
+func (p *ProviderConfig) GetAdditionalClaims() map[string]string {
+	return p.AdditionalClaims
+}
+
+func (p *ProviderConfig) GetRequiredACRValues() []string {
+	return p.RequiredACRValues
+}
+
+func (p *ProviderConfig) GetRequiredAMRValues() []string {
+	return p.RequiredAMRValues
+}
+
 func (p *ProviderConfig) ExchangeAuthcodeAndValidateTokens(ctx context.Context, authcode string, pkceCodeVerifier pkce.Code, expectedIDTokenNonce nonce.Nonce, redirectURI string) (*oidctypes.Token, error) {
 	tok, err := p.Config.Exchange(
 		coreosoidc.ClientContext(ctx, p.Client),
@@ -0,0 +1,132 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package dpop implements the client side of OAuth 2.0 Demonstrating Proof of Possession (DPoP), as defined by
+// https://datatracker.ietf.org/doc/html/rfc9449.
+package dpop
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	// HeaderName is the name of the HTTP request header which carries a DPoP proof.
+	HeaderName = "DPoP"
+
+	// NonceHeaderName is the name of the HTTP response header in which a server provides a nonce for DPoP proofs.
+	NonceHeaderName = "DPoP-Nonce"
+
+	// ProofType is the typ header of DPoP proof JWTs.
+	ProofType = "dpop+jwt"
+
+	// TokenType is the token_type of DPoP-bound access tokens.
+	TokenType = "DPoP"
+
+	pemType = "PRIVATE KEY"
+)
+
+// Key is the private key of a DPoP session, which signs the DPoP proofs of the session. The tokens which are issued
+// to the session are bound to this key, so the key must be kept for as long as the tokens are.
+type Key struct {
+	privateKey *ecdsa.PrivateKey
+}
+
+// Generate generates a new random DPoP key.
+func Generate() (*Key, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate DPoP key: %w", err)
+	}
+	return &Key{privateKey: privateKey}, nil
+}
+
+// Parse parses a DPoP key which was encoded by Encode.
+func Parse(encoded string) (*Key, error) {
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil || block.Type != pemType {
+		return nil, fmt.Errorf("could not parse DPoP key: no %q PEM block found", pemType)
+	}
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse DPoP key: %w", err)
+	}
+	ecdsaPrivateKey, ok := privateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("could not parse DPoP key: unsupported key type %T", privateKey)
+	}
+	return &Key{privateKey: ecdsaPrivateKey}, nil
+}
+
+// Encode encodes the key as a PEM block, so that it can be stored by a key store.
+func (k *Key) Encode() (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(k.privateKey)
+	if err != nil {
+		return "", fmt.Errorf("could not encode DPoP key: %w", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: der})), nil
+}
+
+// Thumbprint returns the base64url encoded SHA-256 JWK thumbprint of the public key, as defined by
+// https://datatracker.ietf.org/doc/html/rfc7638. This is the jkt to which the tokens of the session are bound.
+func (k *Key) Thumbprint() (string, error) {
+	thumbprint, err := (&jose.JSONWebKey{Key: k.privateKey.Public()}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("could not calculate DPoP key thumbprint: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
+// Proof returns a new DPoP proof for an HTTP request with the given method and URL. The nonce is the most recent
+// nonce which was provided by the server, or an empty string when the server has not provided one yet.
+func (k *Key) Proof(method string, targetURL string, nonce string) (string, error) {
+	return k.proof(rand.Reader, time.Now(), method, targetURL, nonce)
+}
+
+func (k *Key) proof(rand io.Reader, now time.Time, method string, targetURL string, nonce string) (string, error) {
+	var jti [16]byte
+	if _, err := io.ReadFull(rand, jti[:]); err != nil {
+		return "", fmt.Errorf("could not generate DPoP proof ID: %w", err)
+	}
+
+	payload, err := json.Marshal(&struct {
+		JTI   string `json:"jti"`
+		HTM   string `json:"htm"`
+		HTU   string `json:"htu"`
+		IAT   int64  `json:"iat"`
+		Nonce string `json:"nonce,omitempty"`
+	}{
+		JTI:   base64.RawURLEncoding.EncodeToString(jti[:]),
+		HTM:   method,
+		HTU:   targetURL,
+		IAT:   now.Unix(),
+		Nonce: nonce,
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not encode DPoP proof: %w", err)
+	}
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.ES256, Key: k.privateKey},
+		(&jose.SignerOptions{EmbedJWK: true}).WithType(ProofType),
+	)
+	if err != nil {
+		return "", fmt.Errorf("could not create DPoP proof signer: %w", err)
+	}
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		return "", fmt.Errorf("could not sign DPoP proof: %w", err)
+	}
+	return jws.CompactSerialize()
+}
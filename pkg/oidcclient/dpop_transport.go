@@ -0,0 +1,99 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package oidcclient
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"go.pinniped.dev/pkg/oidcclient/dpop"
+)
+
+// dpopTransport is an http.RoundTripper which adds a DPoP proof to the requests to the token endpoint of a provider
+// which supports DPoP (see https://datatracker.ietf.org/doc/html/rfc9449), so that the issued tokens are bound to
+// the DPoP key of the session. Other requests are passed through unchanged.
+type dpopTransport struct {
+	base     http.RoundTripper
+	tokenURL string
+
+	lock  sync.Mutex
+	key   *dpop.Key
+	nonce string
+}
+
+func (t *dpopTransport) setKey(key *dpop.Key) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.key = key
+}
+
+func (t *dpopTransport) setNonce(nonce string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.nonce = nonce
+}
+
+func (t *dpopTransport) current() (*dpop.Key, string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.key, t.nonce
+}
+
+func (t *dpopTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, nonce := t.current()
+	if key == nil || req.Method != http.MethodPost || req.URL.String() != t.tokenURL {
+		return t.baseTransport().RoundTrip(req)
+	}
+
+	resp, err := t.roundTripWithProof(req, req.Body, key, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	// The provider rejects a proof which does not include its current nonce, and provides the nonce to use instead.
+	// Retry once with the new nonce, as described by https://datatracker.ietf.org/doc/html/rfc9449#section-8.
+	newNonce := resp.Header.Get(dpop.NonceHeaderName)
+	if resp.StatusCode != http.StatusBadRequest || newNonce == "" || newNonce == nonce || req.GetBody == nil {
+		return resp, nil
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, fmt.Errorf("could not rewind request body to retry with DPoP nonce: %w", err)
+	}
+	return t.roundTripWithProof(req, body, key, newNonce)
+}
+
+func (t *dpopTransport) roundTripWithProof(req *http.Request, body io.ReadCloser, key *dpop.Key, nonce string) (*http.Response, error) {
+	proof, err := key.Proof(req.Method, t.tokenURL, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	// A RoundTripper must not modify the request which it was given, so send a copy with the proof.
+	reqWithProof := req.Clone(req.Context())
+	reqWithProof.Body = body
+	reqWithProof.Header.Set(dpop.HeaderName, proof)
+
+	resp, err := t.baseTransport().RoundTrip(reqWithProof)
+	if err != nil {
+		return nil, err
+	}
+	if newNonce := resp.Header.Get(dpop.NonceHeaderName); newNonce != "" {
+		t.setNonce(newNonce)
+	}
+	return resp, nil
+}
+
+func (t *dpopTransport) baseTransport() http.RoundTripper {
+	if t.base == nil {
+		return http.DefaultTransport
+	}
+	return t.base
+}
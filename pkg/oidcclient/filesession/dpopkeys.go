@@ -0,0 +1,84 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package filesession
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"go.pinniped.dev/pkg/oidcclient/dpop"
+)
+
+// dpopKeysDirName is the name of the directory next to the session cache file which holds the DPoP key files.
+const dpopKeysDirName = "dpop-keys"
+
+// thumbprintRegexp matches a base64url encoded SHA-256 thumbprint, which is also safe to use as a file name.
+var thumbprintRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+
+// GetDPoPKey reads the DPoP key with the given thumbprint from its key file. It may return nil if the key is not found
+// or is not usable.
+func (c *Cache) GetDPoPKey(thumbprint string) *dpop.Key {
+	path, ok := c.dpopKeyPath(thumbprint)
+	if !ok {
+		return nil
+	}
+
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			c.errReporter(fmt.Errorf("could not read DPoP key file: %w", err))
+		}
+		return nil
+	}
+	key, err := dpop.Parse(string(encoded))
+	if err != nil {
+		c.errReporter(fmt.Errorf("invalid DPoP key file: %w", err))
+		return nil
+	}
+	if actual, err := key.Thumbprint(); err != nil || actual != thumbprint {
+		c.errReporter(fmt.Errorf("invalid DPoP key file: the key does not match its thumbprint"))
+		return nil
+	}
+	return key
+}
+
+// PutDPoPKey writes the DPoP key into its own key file, which only the current user may read, in a directory next to
+// the session cache file. The session cache file itself only records the thumbprints of the keys. It does not return
+// an error but may silently fail to store the key.
+func (c *Cache) PutDPoPKey(key *dpop.Key) {
+	thumbprint, err := key.Thumbprint()
+	if err != nil {
+		c.errReporter(err)
+		return
+	}
+	path, ok := c.dpopKeyPath(thumbprint)
+	if !ok {
+		c.errReporter(fmt.Errorf("invalid DPoP key thumbprint %q", thumbprint))
+		return
+	}
+	encoded, err := key.Encode()
+	if err != nil {
+		c.errReporter(err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil && !errors.Is(err, os.ErrExist) {
+		c.errReporter(fmt.Errorf("could not create DPoP key directory: %w", err))
+		return
+	}
+	if err := ioutil.WriteFile(path, []byte(encoded), 0600); err != nil {
+		c.errReporter(fmt.Errorf("could not write DPoP key file: %w", err))
+	}
+}
+
+func (c *Cache) dpopKeyPath(thumbprint string) (string, bool) {
+	if !thumbprintRegexp.MatchString(thumbprint) {
+		return "", false
+	}
+	return filepath.Join(filepath.Dir(c.path), dpopKeysDirName, thumbprint+".pem"), true
+}
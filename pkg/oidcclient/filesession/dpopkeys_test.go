@@ -0,0 +1,123 @@
+// Copyright 2021 the Pinniped contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package filesession
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"go.pinniped.dev/internal/testutil"
+	"go.pinniped.dev/pkg/oidcclient"
+	"go.pinniped.dev/pkg/oidcclient/dpop"
+	"go.pinniped.dev/pkg/oidcclient/oidctypes"
+)
+
+func TestDPoPKeys(t *testing.T) {
+	t.Parallel()
+
+	key, err := dpop.Generate()
+	require.NoError(t, err)
+	thumbprint, err := key.Thumbprint()
+	require.NoError(t, err)
+	encoded, err := key.Encode()
+	require.NoError(t, err)
+
+	otherKey, err := dpop.Generate()
+	require.NoError(t, err)
+	otherThumbprint, err := otherKey.Thumbprint()
+	require.NoError(t, err)
+
+	t.Run("round trip", func(t *testing.T) {
+		t.Parallel()
+		tmp := testutil.TempDir(t) + "/sessions.yaml"
+		var errors []string
+		c := New(tmp, WithErrorReporter(func(err error) { errors = append(errors, err.Error()) }))
+
+		require.Nil(t, c.GetDPoPKey(thumbprint))
+		c.PutDPoPKey(key)
+		require.Empty(t, errors)
+
+		got := c.GetDPoPKey(thumbprint)
+		require.NotNil(t, got)
+		gotThumbprint, err := got.Thumbprint()
+		require.NoError(t, err)
+		require.Equal(t, thumbprint, gotThumbprint)
+		require.Nil(t, c.GetDPoPKey(otherThumbprint))
+
+		// The key file may only be read by the current user.
+		info, err := os.Stat(filepath.Join(filepath.Dir(tmp), "dpop-keys", thumbprint+".pem"))
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+		require.Empty(t, errors)
+	})
+
+	t.Run("invalid thumbprints", func(t *testing.T) {
+		t.Parallel()
+		tmp := testutil.TempDir(t) + "/sessions.yaml"
+		c := New(tmp, WithErrorReporter(func(err error) { require.Fail(t, "unexpected error", err.Error()) }))
+
+		require.Nil(t, c.GetDPoPKey(""))
+		require.Nil(t, c.GetDPoPKey("../sessions"))
+	})
+
+	t.Run("key file with the wrong key", func(t *testing.T) {
+		t.Parallel()
+		tmp := testutil.TempDir(t) + "/sessions.yaml"
+		var errors []string
+		c := New(tmp, WithErrorReporter(func(err error) { errors = append(errors, err.Error()) }))
+
+		require.NoError(t, os.MkdirAll(filepath.Join(filepath.Dir(tmp), "dpop-keys"), 0700))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(filepath.Dir(tmp), "dpop-keys", otherThumbprint+".pem"), []byte(encoded), 0600))
+		require.Nil(t, c.GetDPoPKey(otherThumbprint))
+		require.Equal(t, []string{"invalid DPoP key file: the key does not match its thumbprint"}, errors)
+	})
+
+	t.Run("fail to create directory", func(t *testing.T) {
+		t.Parallel()
+		tmp := testutil.TempDir(t) + "/sessions.yaml"
+		var errors []string
+		c := New(tmp, WithErrorReporter(func(err error) { errors = append(errors, err.Error()) }))
+
+		require.NoError(t, ioutil.WriteFile(filepath.Join(filepath.Dir(tmp), "dpop-keys"), []byte{}, 0600))
+		c.PutDPoPKey(key)
+		require.Equal(t, []string{
+			fmt.Sprintf("could not create DPoP key directory: mkdir %s: not a directory", filepath.Join(filepath.Dir(tmp), "dpop-keys")),
+		}, errors)
+	})
+
+	t.Run("the session cache file contains no private key material", func(t *testing.T) {
+		t.Parallel()
+		tmp := testutil.TempDir(t) + "/sessions.yaml"
+		c := New(tmp, WithErrorReporter(func(err error) { require.Fail(t, "unexpected error", err.Error()) }))
+
+		c.PutDPoPKey(key)
+		c.PutToken(oidcclient.SessionCacheKey{Issuer: "test-issuer", ClientID: "test-client-id"}, &oidctypes.Token{
+			AccessToken:  &oidctypes.AccessToken{Token: "some-access-token", Type: "DPoP", Expiry: metav1.NewTime(time.Now().Add(time.Hour))},
+			RefreshToken: &oidctypes.RefreshToken{Token: "some-refresh-token"},
+			DPoPKey:      &oidctypes.DPoPKey{Thumbprint: thumbprint},
+		})
+
+		sessionFile, err := ioutil.ReadFile(tmp)
+		require.NoError(t, err)
+		block, _ := pem.Decode([]byte(encoded))
+		require.NotNil(t, block)
+		require.NotContains(t, string(sessionFile), "PRIVATE KEY")
+		require.NotContains(t, string(sessionFile), base64.StdEncoding.EncodeToString(block.Bytes)[:64])
+		require.Contains(t, string(sessionFile), thumbprint)
+
+		// The key of the cached session can still be found.
+		cached := c.GetToken(oidcclient.SessionCacheKey{Issuer: "test-issuer", ClientID: "test-client-id"})
+		require.NotNil(t, cached)
+		require.NotNil(t, c.GetDPoPKey(cached.DPoPKey.Thumbprint))
+	})
+}
@@ -23,8 +23,10 @@ import (
 
 	"go.pinniped.dev/internal/httputil/httperr"
 	"go.pinniped.dev/internal/httputil/securityheader"
+	"go.pinniped.dev/internal/httputil/htmlpage"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/upstreamoidc"
+	"go.pinniped.dev/pkg/oidcclient/dpop"
 	"go.pinniped.dev/pkg/oidcclient/nonce"
 	"go.pinniped.dev/pkg/oidcclient/oidctypes"
 	"go.pinniped.dev/pkg/oidcclient/pkce"
@@ -53,6 +55,7 @@ type handlerState struct {
 	clientID string
 	scopes   []string
 	cache    SessionCache
+	keyStore DPoPKeyStore
 
 	requestedAudience string
 
@@ -69,6 +72,15 @@ type handlerState struct {
 	nonce        nonce.Nonce
 	pkce         pkce.Code
 
+	// pushedAuthorizationRequestURL is the pushed authorization request endpoint from OIDC discovery, if the provider
+	// advertises one (see https://datatracker.ietf.org/doc/html/rfc9126).
+	pushedAuthorizationRequestURL string
+
+	// dpopTransport adds DPoP proofs to the token requests when the provider supports DPoP (see
+	// https://datatracker.ietf.org/doc/html/rfc9449), and dpopKey is the key to which the tokens are then bound.
+	dpopTransport *dpopTransport
+	dpopKey       *oidctypes.DPoPKey
+
 	// External calls for things.
 	generateState   func() (state.State, error)
 	generatePKCE    func() (pkce.Code, error)
@@ -151,6 +163,22 @@ func WithSessionCache(cache SessionCache) Option {
 	}
 }
 
+// DPoPKeyStore stores the private keys to which the tokens of sessions are bound using DPoP. The keys are kept apart
+// from the SessionCache, which only records the thumbprint of the key of each session.
+type DPoPKeyStore interface {
+	GetDPoPKey(thumbprint string) *dpop.Key
+	PutDPoPKey(key *dpop.Key)
+}
+
+// WithDPoPKeyStore sets the backend for storing and retrieving the private keys to which cached DPoP-bound tokens are
+// bound. Without it, a cached DPoP-bound refresh token cannot be used, so a fresh login is needed instead.
+func WithDPoPKeyStore(keyStore DPoPKeyStore) Option {
+	return func(h *handlerState) error {
+		h.keyStore = keyStore
+		return nil
+	}
+}
+
 // WithClient sets the HTTP client used to make CLI-to-provider requests.
 func WithClient(httpClient *http.Client) Option {
 	return func(h *handlerState) error {
@@ -173,6 +201,12 @@ type nopCache struct{}
 func (*nopCache) GetToken(SessionCacheKey) *oidctypes.Token  { return nil }
 func (*nopCache) PutToken(SessionCacheKey, *oidctypes.Token) {}
 
+// nopKeyStore is a DPoPKeyStore that doesn't actually do anything.
+type nopKeyStore struct{}
+
+func (*nopKeyStore) GetDPoPKey(string) *dpop.Key { return nil }
+func (*nopKeyStore) PutDPoPKey(*dpop.Key)        {}
+
 // Login performs an OAuth2/OIDC authorization code login using a localhost listener.
 func Login(issuer string, clientID string, opts ...Option) (*oidctypes.Token, error) {
 	h := handlerState{
@@ -181,6 +215,7 @@ func Login(issuer string, clientID string, opts ...Option) (*oidctypes.Token, er
 		listenAddr:   "localhost:0",
 		scopes:       []string{oidc.ScopeOfflineAccess, oidc.ScopeOpenID, "email", "profile"},
 		cache:        &nopCache{},
+		keyStore:     &nopKeyStore{},
 		callbackPath: "/callback",
 		ctx:          context.Background(),
 		callbacks:    make(chan callbackResult),
@@ -268,6 +303,14 @@ func (h *handlerState) baseLogin() (*oidctypes.Token, error) {
 		return nil, err
 	}
 
+	// If the provider supports DPoP, bind the tokens to a DPoP key. A cached refresh token can only be used with the
+	// key to which it is already bound, so reuse the cached key if there is one.
+	if h.dpopTransport != nil {
+		if err := h.initDPoPKey(cached); err != nil {
+			return nil, err
+		}
+	}
+
 	// If there was a cached refresh token, attempt to use the refresh flow instead of a fresh login.
 	if cached != nil && cached.RefreshToken != nil && cached.RefreshToken.Token != "" {
 		freshToken, err := h.handleRefresh(h.ctx, cached.RefreshToken)
@@ -276,6 +319,7 @@ func (h *handlerState) baseLogin() (*oidctypes.Token, error) {
 		}
 		// If we got a fresh token, we can update the cache and return it. Otherwise we fall through to the full refresh flow.
 		if freshToken != nil {
+			freshToken = h.withDPoPKey(freshToken)
 			h.cache.PutToken(cacheKey, freshToken)
 			return freshToken, nil
 		}
@@ -304,6 +348,16 @@ func (h *handlerState) baseLogin() (*oidctypes.Token, error) {
 		h.pkce.Challenge(),
 		h.pkce.Method(),
 	)
+
+	// If the provider supports pushed authorization requests, push the parameters of the authorization request
+	// directly to the provider so that they are not included in the URL which is opened in the browser.
+	if h.pushedAuthorizationRequestURL != "" {
+		authorizeURL, err = h.pushAuthorizationRequest(authorizeURL)
+		if err != nil {
+			return nil, fmt.Errorf("could not push authorization request: %w", err)
+		}
+	}
+
 	if err := h.openURL(authorizeURL); err != nil {
 		return nil, fmt.Errorf("could not open browser: %w", err)
 	}
@@ -316,8 +370,9 @@ func (h *handlerState) baseLogin() (*oidctypes.Token, error) {
 		if callback.err != nil {
 			return nil, fmt.Errorf("error handling callback: %w", callback.err)
 		}
-		h.cache.PutToken(cacheKey, callback.token)
-		return callback.token, nil
+		token := h.withDPoPKey(callback.token)
+		h.cache.PutToken(cacheKey, token)
+		return token, nil
 	}
 }
 
@@ -339,15 +394,133 @@ func (h *handlerState) initOIDCDiscovery() error {
 		Endpoint: h.provider.Endpoint(),
 		Scopes:   h.scopes,
 	}
+
+	// Check whether the provider supports pushed authorization requests and DPoP.
+	var discoveryClaims struct {
+		PushedAuthorizationRequestEndpoint string   `json:"pushed_authorization_request_endpoint"`
+		DPoPSigningAlgValuesSupported      []string `json:"dpop_signing_alg_values_supported"`
+	}
+	if err := h.provider.Claims(&discoveryClaims); err != nil {
+		return fmt.Errorf("could not decode OIDC discovery claims for %q: %w", h.issuer, err)
+	}
+	h.pushedAuthorizationRequestURL = discoveryClaims.PushedAuthorizationRequestEndpoint
+
+	// Our DPoP proofs are always signed using ES256, so only use DPoP when the provider accepts ES256. The transport
+	// is installed into our own copy of the HTTP client, which is also the client used by the oauth2 library.
+	for _, alg := range discoveryClaims.DPoPSigningAlgValuesSupported {
+		if alg == "ES256" {
+			h.dpopTransport = &dpopTransport{base: h.httpClient.Transport, tokenURL: h.oauth2Config.Endpoint.TokenURL}
+			h.httpClient.Transport = h.dpopTransport
+			break
+		}
+	}
+	return nil
+}
+
+// initDPoPKey sets the DPoP key of the login, which is the key of the cached session when the key store has it, or
+// otherwise a newly generated key, which is then saved in the key store.
+func (h *handlerState) initDPoPKey(cached *oidctypes.Token) error {
+	if cached != nil && cached.DPoPKey != nil {
+		if key := h.keyStore.GetDPoPKey(cached.DPoPKey.Thumbprint); key != nil {
+			h.dpopTransport.setKey(key)
+			h.dpopKey = cached.DPoPKey
+			return nil
+		}
+	}
+
+	key, err := dpop.Generate()
+	if err != nil {
+		return err
+	}
+	thumbprint, err := key.Thumbprint()
+	if err != nil {
+		return err
+	}
+	h.keyStore.PutDPoPKey(key)
+	h.dpopTransport.setKey(key)
+	h.dpopKey = &oidctypes.DPoPKey{Thumbprint: thumbprint}
 	return nil
 }
 
+// withDPoPKey returns a copy of the token which identifies the DPoP key to which it is bound, if any, so that the
+// key can be found in the key store when the token is read back from the session cache.
+func (h *handlerState) withDPoPKey(token *oidctypes.Token) *oidctypes.Token {
+	if h.dpopKey == nil {
+		return token
+	}
+	tokenWithKey := *token
+	tokenWithKey.DPoPKey = h.dpopKey
+	return &tokenWithKey
+}
+
+// pushAuthorizationRequest pushes the parameters of the authorization request in authorizeURL to the provider's pushed
+// authorization request endpoint, and returns an authorize URL which refers to the pushed request by its request_uri.
+func (h *handlerState) pushAuthorizationRequest(authorizeURL string) (string, error) {
+	parsedAuthorizeURL, err := url.Parse(authorizeURL)
+	if err != nil {
+		return "", fmt.Errorf("could not parse authorize URL: %w", err)
+	}
+
+	// Form the HTTP POST request with the parameters of the authorization request, as specified by RFC9126.
+	reqBody := strings.NewReader(parsedAuthorizeURL.Query().Encode())
+	req, err := http.NewRequestWithContext(h.ctx, http.MethodPost, h.pushedAuthorizationRequestURL, reqBody)
+	if err != nil {
+		return "", fmt.Errorf("could not build request: %w", err)
+	}
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+
+	// Perform the request.
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	// Expect an HTTP 201 response with "application/json" content type.
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("unexpected HTTP response status %d", resp.StatusCode)
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("content-type"))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode content-type header: %w", err)
+	}
+	if mediaType != "application/json" {
+		return "", fmt.Errorf("unexpected HTTP response content type %q", mediaType)
+	}
+
+	// Decode the JSON response body.
+	var respBody struct {
+		RequestURI string `json:"request_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+	if respBody.RequestURI == "" {
+		return "", fmt.Errorf("response did not include a request_uri")
+	}
+
+	// The authorize URL now only needs to identify the client and the pushed request.
+	parsedAuthorizeURL.RawQuery = url.Values{
+		"client_id":   []string{h.clientID},
+		"request_uri": []string{respBody.RequestURI},
+	}.Encode()
+	return parsedAuthorizeURL.String(), nil
+}
+
 func (h *handlerState) tokenExchangeRFC8693(baseToken *oidctypes.Token) (*oidctypes.Token, error) {
 	// Perform OIDC discovery. This may have already been performed if there was not a cached base token.
 	if err := h.initOIDCDiscovery(); err != nil {
 		return nil, err
 	}
 
+	// A DPoP-bound access token can only be exchanged along with a DPoP proof signed by the key to which it is bound.
+	// The key may not have been loaded yet if the base token came straight from the cache.
+	if h.dpopTransport != nil && h.dpopKey == nil {
+		if err := h.initDPoPKey(baseToken); err != nil {
+			return nil, err
+		}
+	}
+
 	// Form the HTTP POST request with the parameters specified by RFC8693.
 	reqBody := strings.NewReader(url.Values{
 		"client_id":            []string{h.clientID},
@@ -465,7 +638,7 @@ func (h *handlerState) handleAuthCodeCallback(w http.ResponseWriter, r *http.Req
 	}
 
 	h.callbacks <- callbackResult{token: token}
-	_, _ = w.Write([]byte("you have been logged in and may now close this tab"))
+	htmlpage.WriteSuccess(w, r, nil)
 	return nil
 }
 
@@ -6,6 +6,7 @@ package oidcclient
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -19,11 +20,16 @@ import (
 	"github.com/stretchr/testify/require"
 	"golang.org/x/oauth2"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 
+	"go.pinniped.dev/internal/crud"
+	"go.pinniped.dev/internal/fositestorage/dpopproof"
 	"go.pinniped.dev/internal/httputil/httperr"
 	"go.pinniped.dev/internal/mocks/mockupstreamoidcidentityprovider"
+	serverdpop "go.pinniped.dev/internal/oidc/dpop"
 	"go.pinniped.dev/internal/oidc/provider"
 	"go.pinniped.dev/internal/testutil"
+	"go.pinniped.dev/pkg/oidcclient/dpop"
 	"go.pinniped.dev/pkg/oidcclient/nonce"
 	"go.pinniped.dev/pkg/oidcclient/oidctypes"
 	"go.pinniped.dev/pkg/oidcclient/pkce"
@@ -51,6 +57,21 @@ func (m *mockSessionCache) PutToken(key SessionCacheKey, token *oidctypes.Token)
 	m.sawPutTokens = append(m.sawPutTokens, token)
 }
 
+type mockDPoPKeyStore struct {
+	t          *testing.T
+	keys       map[string]*dpop.Key
+	sawPutKeys []*dpop.Key
+}
+
+func (m *mockDPoPKeyStore) GetDPoPKey(thumbprint string) *dpop.Key {
+	m.t.Logf("saw mock DPoP key store GetDPoPKey() with thumbprint %s", thumbprint)
+	return m.keys[thumbprint]
+}
+
+func (m *mockDPoPKeyStore) PutDPoPKey(key *dpop.Key) {
+	m.sawPutKeys = append(m.sawPutKeys, key)
+}
+
 func TestLogin(t *testing.T) {
 	time1 := time.Date(2035, 10, 12, 13, 14, 15, 16, time.UTC)
 	time1Unix := int64(2075807775)
@@ -198,6 +219,170 @@ func TestLogin(t *testing.T) {
 		require.NoError(t, json.NewEncoder(w).Encode(&response))
 	})
 
+	// Start a test server that returns a discovery document which advertises a pushed authorization request endpoint.
+	parMux := http.NewServeMux()
+	parServer := httptest.NewServer(parMux)
+	t.Cleanup(parServer.Close)
+	parMux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		type providerJSON struct {
+			Issuer   string `json:"issuer"`
+			AuthURL  string `json:"authorization_endpoint"`
+			TokenURL string `json:"token_endpoint"`
+			JWKSURL  string `json:"jwks_uri"`
+			PARURL   string `json:"pushed_authorization_request_endpoint"`
+		}
+		_ = json.NewEncoder(w).Encode(&providerJSON{
+			Issuer:   parServer.URL,
+			AuthURL:  parServer.URL + "/authorize",
+			TokenURL: parServer.URL + "/token",
+			JWKSURL:  parServer.URL + "/keys",
+			PARURL:   parServer.URL + "/par",
+		})
+	})
+	parMux.HandleFunc("/par", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch r.Form.Get("state") {
+		case "test-state-produce-http-400":
+			http.Error(w, "some server error", http.StatusBadRequest)
+			return
+		case "test-state-produce-invalid-content-type":
+			w.Header().Set("content-type", "invalid/invalid;=")
+			w.WriteHeader(http.StatusCreated)
+			return
+		case "test-state-produce-wrong-content-type":
+			w.Header().Set("content-type", "invalid")
+			w.WriteHeader(http.StatusCreated)
+			return
+		case "test-state-produce-invalid-json":
+			w.Header().Set("content-type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{`))
+			return
+		case "test-state-produce-missing-request-uri":
+			w.Header().Set("content-type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"expires_in":60}`))
+			return
+		}
+
+		// This is the PKCE challenge which is calculated as base64(sha256("test-pkce")).
+		require.Equal(t, "VVaezYqum7reIhoavCHD1n2d-piN3r_mywoYj7fCR7g", r.Form.Get("code_challenge"))
+		require.Equal(t, "test-nonce", r.Form.Get("nonce"))
+		require.Equal(t, "test-client-id", r.Form.Get("client_id"))
+		require.Contains(t, r.Form.Get("redirect_uri"), "http://127.0.0.1:")
+
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"request_uri":"urn:ietf:params:oauth:request_uri:test-reference","expires_in":60}`))
+	})
+
+	// Start a test server that returns a discovery document which advertises DPoP support, and which requires a
+	// DPoP proof with its current nonce for each token request.
+	testDPoPKey, err := dpop.Generate()
+	require.NoError(t, err)
+	testDPoPJKT, err := testDPoPKey.Thumbprint()
+	require.NoError(t, err)
+	dpopValidator := serverdpop.NewValidator(
+		func() []byte { return []byte("some secret - must have at least 32 bytes") },
+		dpopproof.New(crud.NewSecretsBackend(fake.NewSimpleClientset().CoreV1().Secrets("some-namespace")), time.Now, serverdpop.ProofLifetime),
+	)
+	dpopMux := http.NewServeMux()
+	dpopServer := httptest.NewServer(dpopMux)
+	t.Cleanup(dpopServer.Close)
+	dpopMux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		type providerJSON struct {
+			Issuer        string   `json:"issuer"`
+			AuthURL       string   `json:"authorization_endpoint"`
+			TokenURL      string   `json:"token_endpoint"`
+			JWKSURL       string   `json:"jwks_uri"`
+			DPoPAlgValues []string `json:"dpop_signing_alg_values_supported"`
+		}
+		_ = json.NewEncoder(w).Encode(&providerJSON{
+			Issuer:        dpopServer.URL,
+			AuthURL:       dpopServer.URL + "/authorize",
+			TokenURL:      dpopServer.URL + "/token",
+			JWKSURL:       dpopServer.URL + "/keys",
+			DPoPAlgValues: []string{"ES256"},
+		})
+	})
+	dpopMux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		jkt, err := dpopValidator.Validate(r, dpopServer.URL+"/token")
+		if errors.Is(err, serverdpop.ErrUseDPoPNonce) {
+			w.Header().Set("DPoP-Nonce", dpopValidator.Nonce())
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if jkt == "" {
+			http.Error(w, "expected a DPoP proof", http.StatusBadRequest)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var response struct {
+			oauth2.Token
+			IDToken         string `json:"id_token,omitempty"`
+			ExpiresIn       int64  `json:"expires_in"`
+			IssuedTokenType string `json:"issued_token_type,omitempty"`
+		}
+		switch r.Form.Get("grant_type") {
+		case "refresh_token":
+			// A bound refresh token may only be used with its own key, while an unbound refresh token gets bound to
+			// whichever key signed the proof.
+			if r.Form.Get("refresh_token") == "test-refresh-token-bound-to-dpop-key" && jkt != testDPoPJKT {
+				http.Error(w, "wrong DPoP key for refresh token", http.StatusBadRequest)
+				return
+			}
+			response.TokenType = "DPoP"
+			response.AccessToken = testToken.AccessToken.Token
+			response.ExpiresIn = int64(time.Until(testToken.AccessToken.Expiry.Time).Seconds())
+			response.RefreshToken = testToken.RefreshToken.Token
+			response.IDToken = testToken.IDToken.Token
+		case "urn:ietf:params:oauth:grant-type:token-exchange":
+			if r.Form.Get("subject_token") == "test-access-token-bound-to-dpop-key" && jkt != testDPoPJKT {
+				http.Error(w, "wrong DPoP key for subject token", http.StatusBadRequest)
+				return
+			}
+			response.TokenType = "N_A"
+			response.IssuedTokenType = "urn:ietf:params:oauth:token-type:jwt"
+			response.AccessToken = testExchangedToken.IDToken.Token
+		default:
+			http.Error(w, fmt.Sprintf("invalid grant_type %q", r.Form.Get("grant_type")), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("DPoP-Nonce", dpopValidator.Nonce())
+		w.Header().Set("content-type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(&response))
+	})
+
+	parErrorOption := func(wantState state.State) func(t *testing.T) Option {
+		return func(t *testing.T) Option {
+			return func(h *handlerState) error {
+				h.generateState = func() (state.State, error) { return wantState, nil }
+				h.openURL = func(_ string) error {
+					t.Fatal("expected the browser not to be opened")
+					return nil
+				}
+				return nil
+			}
+		}
+	}
+
 	tests := []struct {
 		name      string
 		opt       func(t *testing.T) Option
@@ -512,6 +697,63 @@ func TestLogin(t *testing.T) {
 			issuer:    successServer.URL,
 			wantToken: &testToken,
 		},
+		{
+			name:     "pushed authorization request returns non-201",
+			clientID: "test-client-id",
+			issuer:   parServer.URL,
+			opt:      parErrorOption("test-state-produce-http-400"),
+			wantErr:  "could not push authorization request: unexpected HTTP response status 400",
+		},
+		{
+			name:     "pushed authorization request returns invalid content-type header",
+			clientID: "test-client-id",
+			issuer:   parServer.URL,
+			opt:      parErrorOption("test-state-produce-invalid-content-type"),
+			wantErr:  "could not push authorization request: failed to decode content-type header: mime: invalid media parameter",
+		},
+		{
+			name:     "pushed authorization request returns wrong content-type",
+			clientID: "test-client-id",
+			issuer:   parServer.URL,
+			opt:      parErrorOption("test-state-produce-wrong-content-type"),
+			wantErr:  `could not push authorization request: unexpected HTTP response content type "invalid"`,
+		},
+		{
+			name:     "pushed authorization request returns invalid JSON",
+			clientID: "test-client-id",
+			issuer:   parServer.URL,
+			opt:      parErrorOption("test-state-produce-invalid-json"),
+			wantErr:  "could not push authorization request: failed to decode response: unexpected EOF",
+		},
+		{
+			name:     "pushed authorization request returns no request_uri",
+			clientID: "test-client-id",
+			issuer:   parServer.URL,
+			opt:      parErrorOption("test-state-produce-missing-request-uri"),
+			wantErr:  "could not push authorization request: response did not include a request_uri",
+		},
+		{
+			name:     "pushed authorization request succeeds and callback returns success",
+			clientID: "test-client-id",
+			opt: func(t *testing.T) Option {
+				return func(h *handlerState) error {
+					h.generateState = func() (state.State, error) { return "test-state", nil }
+					h.generatePKCE = func() (pkce.Code, error) { return "test-pkce", nil }
+					h.generateNonce = func() (nonce.Nonce, error) { return "test-nonce", nil }
+
+					h.openURL = func(actualURL string) error {
+						require.Equal(t, parServer.URL+"/authorize?client_id=test-client-id&request_uri=urn%3Aietf%3Aparams%3Aoauth%3Arequest_uri%3Atest-reference", actualURL)
+						go func() {
+							h.callbacks <- callbackResult{token: &testToken}
+						}()
+						return nil
+					}
+					return nil
+				}
+			},
+			issuer:    parServer.URL,
+			wantToken: &testToken,
+		},
 		{
 			name:     "with requested audience, session cache hit with valid token, but discovery fails",
 			clientID: "test-client-id",
@@ -818,6 +1060,109 @@ func TestLogin(t *testing.T) {
 			},
 			wantToken: &testExchangedToken,
 		},
+		{
+			name:     "with DPoP, session cache hit with refreshable token bound to a DPoP key",
+			issuer:   dpopServer.URL,
+			clientID: "test-client-id",
+			opt: func(t *testing.T) Option {
+				return func(h *handlerState) error {
+					cache := &mockSessionCache{t: t, getReturnsToken: &oidctypes.Token{
+						IDToken: &oidctypes.IDToken{
+							Token:  "expired-test-id-token",
+							Expiry: metav1.Now(), // less than Now() + minIDTokenValidity
+						},
+						RefreshToken: &oidctypes.RefreshToken{Token: "test-refresh-token-bound-to-dpop-key"},
+						DPoPKey:      &oidctypes.DPoPKey{Thumbprint: testDPoPJKT},
+					}}
+					keyStore := &mockDPoPKeyStore{t: t, keys: map[string]*dpop.Key{testDPoPJKT: testDPoPKey}}
+					t.Cleanup(func() {
+						require.Len(t, cache.sawPutTokens, 1)
+						require.Equal(t, testToken.IDToken.Token, cache.sawPutTokens[0].IDToken.Token)
+						require.Equal(t, &oidctypes.DPoPKey{Thumbprint: testDPoPJKT}, cache.sawPutTokens[0].DPoPKey)
+						require.Empty(t, keyStore.sawPutKeys)
+					})
+					h.cache = cache
+					require.NoError(t, WithDPoPKeyStore(keyStore)(h))
+
+					h.getProvider = func(_ *oauth2.Config, _ *oidc.Provider, _ *http.Client) provider.UpstreamOIDCIdentityProviderI {
+						mock := mockUpstream(t)
+						mock.EXPECT().
+							ValidateToken(gomock.Any(), HasAccessToken(testToken.AccessToken.Token), nonce.Nonce("")).
+							Return(&testToken, nil)
+						return mock
+					}
+					return nil
+				}
+			},
+			wantToken: &testToken,
+		},
+		{
+			name:     "with DPoP, session cache hit with refreshable token which is not bound to a DPoP key",
+			issuer:   dpopServer.URL,
+			clientID: "test-client-id",
+			opt: func(t *testing.T) Option {
+				return func(h *handlerState) error {
+					cache := &mockSessionCache{t: t, getReturnsToken: &oidctypes.Token{
+						IDToken: &oidctypes.IDToken{
+							Token:  "expired-test-id-token",
+							Expiry: metav1.Now(), // less than Now() + minIDTokenValidity
+						},
+						RefreshToken: &oidctypes.RefreshToken{Token: "test-refresh-token"},
+					}}
+					keyStore := &mockDPoPKeyStore{t: t}
+					t.Cleanup(func() {
+						require.Len(t, cache.sawPutTokens, 1)
+						require.NotNil(t, cache.sawPutTokens[0].DPoPKey)
+						require.Len(t, keyStore.sawPutKeys, 1)
+						newJKT, err := keyStore.sawPutKeys[0].Thumbprint()
+						require.NoError(t, err)
+						require.NotEqual(t, testDPoPJKT, newJKT)
+						require.Equal(t, &oidctypes.DPoPKey{Thumbprint: newJKT}, cache.sawPutTokens[0].DPoPKey)
+						require.Nil(t, testToken.DPoPKey, "the token returned by the provider should not be modified")
+					})
+					h.cache = cache
+					require.NoError(t, WithDPoPKeyStore(keyStore)(h))
+
+					h.getProvider = func(_ *oauth2.Config, _ *oidc.Provider, _ *http.Client) provider.UpstreamOIDCIdentityProviderI {
+						mock := mockUpstream(t)
+						mock.EXPECT().
+							ValidateToken(gomock.Any(), HasAccessToken(testToken.AccessToken.Token), nonce.Nonce("")).
+							Return(&testToken, nil)
+						return mock
+					}
+					return nil
+				}
+			},
+			wantToken: &testToken,
+		},
+		{
+			name:     "with DPoP and requested audience, session cache hit with valid token bound to a DPoP key, and token exchange request succeeds",
+			issuer:   dpopServer.URL,
+			clientID: "test-client-id",
+			opt: func(t *testing.T) Option {
+				return func(h *handlerState) error {
+					cache := &mockSessionCache{t: t, getReturnsToken: &oidctypes.Token{
+						AccessToken: &oidctypes.AccessToken{Token: "test-access-token-bound-to-dpop-key", Type: "DPoP"},
+						IDToken:     testToken.IDToken,
+						DPoPKey:     &oidctypes.DPoPKey{Thumbprint: testDPoPJKT},
+					}}
+					t.Cleanup(func() {
+						require.Empty(t, cache.sawPutTokens)
+					})
+					require.NoError(t, WithSessionCache(cache)(h))
+					require.NoError(t, WithDPoPKeyStore(&mockDPoPKeyStore{t: t, keys: map[string]*dpop.Key{testDPoPJKT: testDPoPKey}})(h))
+					require.NoError(t, WithRequestAudience("test-audience")(h))
+
+					h.validateIDToken = func(ctx context.Context, provider *oidc.Provider, audience string, token string) (*oidc.IDToken, error) {
+						require.Equal(t, "test-audience", audience)
+						require.Equal(t, "test-id-token-with-requested-audience", token)
+						return &oidc.IDToken{Expiry: testExchangedToken.IDToken.Expiry.Time}, nil
+					}
+					return nil
+				}
+			},
+			wantToken: &testExchangedToken,
+		},
 	}
 	for _, tt := range tests {
 		tt := tt
@@ -871,6 +1216,7 @@ func TestHandleAuthCodeCallback(t *testing.T) {
 		opt            func(t *testing.T) Option
 		wantErr        string
 		wantHTTPStatus int
+		wantBody       string
 	}{
 		{
 			name:           "wrong method",
@@ -926,6 +1272,7 @@ func TestHandleAuthCodeCallback(t *testing.T) {
 					return nil
 				}
 			},
+			wantBody: `{"status":"success","message":"You have been logged in and may now close this window."}` + "\n",
 		},
 	}
 	for _, tt := range tests {
@@ -962,6 +1309,8 @@ func TestHandleAuthCodeCallback(t *testing.T) {
 				}
 			} else {
 				require.NoError(t, err)
+				require.Equal(t, http.StatusOK, resp.Code)
+				require.Equal(t, tt.wantBody, resp.Body.String())
 			}
 
 			select {
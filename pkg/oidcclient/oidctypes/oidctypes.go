@@ -36,6 +36,13 @@ type IDToken struct {
 	Claims map[string]interface{} `json:"claims,omitempty"`
 }
 
+// DPoPKey identifies the key to which the tokens of an OIDC session are bound using DPoP. The private key itself is
+// not part of the session, so that it is never written into a session cache.
+type DPoPKey struct {
+	// Thumbprint is the JWK SHA-256 thumbprint of the key.
+	Thumbprint string `json:"jkt"`
+}
+
 // Token contains the elements of an OIDC session.
 type Token struct {
 	// AccessToken is the token that authorizes and authenticates the requests.
@@ -48,4 +55,7 @@ type Token struct {
 
 	// IDToken is an OpenID Connect ID token.
 	IDToken *IDToken `json:"id,omitempty"`
+
+	// DPoPKey is the optional key to which the access token and refresh token are bound.
+	DPoPKey *DPoPKey `json:"dpop,omitempty"`
 }
@@ -293,13 +293,12 @@ func runPinnipedLoginOIDC(
 	callbackURLPattern := regexp.MustCompile(`\A` + regexp.QuoteMeta(env.CLITestUpstream.CallbackURL) + `\?.+\z`)
 	browsertest.WaitForURL(t, page, callbackURLPattern)
 
-	// Wait for the "pre" element that gets rendered for a `text/plain` page, and
-	// assert that it contains the success message.
+	// Wait for the heading of the success page, and assert that it contains the success message.
 	t.Logf("verifying success page")
-	browsertest.WaitForVisibleElements(t, page, "pre")
-	msg, err := page.First("pre").Text()
+	browsertest.WaitForVisibleElements(t, page, "h1")
+	msg, err := page.First("h1").Text()
 	require.NoError(t, err)
-	require.Equal(t, "you have been logged in and may now close this tab", msg)
+	require.Equal(t, "Login succeeded", msg)
 
 	// Expect the CLI to output an ExecCredential in JSON format.
 	t.Logf("waiting for CLI to output ExecCredential JSON")
@@ -44,9 +44,15 @@ func TestCredentialIssuer(t *testing.T) {
 		require.Equal(t, env.ConciergeAppName, actualConfig.Labels["app"])
 
 		// Verify the cluster strategy status based on what's expected of the test cluster's ability to share signing keys.
+		// The impersonation proxy reports its own strategy next to the one of the kube-cert-agent.
 		actualStatusStrategies := actualConfigList.Items[0].Status.Strategies
-		require.Len(t, actualStatusStrategies, 1)
-		actualStatusStrategy := actualStatusStrategies[0]
+		require.Len(t, actualStatusStrategies, 2)
+		var actualStatusStrategy configv1alpha1.CredentialIssuerStrategy
+		for _, strategy := range actualStatusStrategies {
+			if strategy.Type == configv1alpha1.KubeClusterSigningCertificateStrategyType {
+				actualStatusStrategy = strategy
+			}
+		}
 		require.Equal(t, configv1alpha1.KubeClusterSigningCertificateStrategyType, actualStatusStrategy.Type)
 
 		if env.HasCapability(library.ClusterSigningKeyIsAvailable) {
@@ -252,13 +252,12 @@ func TestE2EFullIntegration(t *testing.T) {
 	t.Logf("waiting for redirect to callback")
 	browsertest.WaitForURL(t, page, regexp.MustCompile(`\Ahttp://127\.0\.0\.1:[0-9]+/callback\?.+\z`))
 
-	// Wait for the "pre" element that gets rendered for a `text/plain` page, and
-	// assert that it contains the success message.
+	// Wait for the heading of the success page, and assert that it contains the success message.
 	t.Logf("verifying success page")
-	browsertest.WaitForVisibleElements(t, page, "pre")
-	msg, err := page.First("pre").Text()
+	browsertest.WaitForVisibleElements(t, page, "h1")
+	msg, err := page.First("h1").Text()
 	require.NoError(t, err)
-	require.Equal(t, "you have been logged in and may now close this tab", msg)
+	require.Equal(t, "Login succeeded", msg)
 
 	// Expect the CLI to output a list of namespaces in JSON format.
 	t.Logf("waiting for kubectl to output namespace list JSON")
@@ -484,10 +484,12 @@ func requireWellKnownEndpointIsWorking(t *testing.T, supervisorScheme, superviso
       "scopes_supported": ["openid", "offline"],
       "response_types_supported": ["code"],
       "claims_supported": ["groups"],
-      "subject_types_supported": ["public"],
-      "id_token_signing_alg_values_supported": ["ES256"]
+      "subject_types_supported": ["public", "pairwise"],
+      "id_token_signing_alg_values_supported": ["ES256"],
+      "pushed_authorization_request_endpoint": "%s/oauth2/par",
+      "dpop_signing_alg_values_supported": ["ES256", "ES384", "ES512", "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "EdDSA"]
     }`)
-	expectedJSON := fmt.Sprintf(expectedResultTemplate, issuerName, issuerName, issuerName, issuerName)
+	expectedJSON := fmt.Sprintf(expectedResultTemplate, issuerName, issuerName, issuerName, issuerName, issuerName)
 
 	require.Equal(t, "application/json", response.Header.Get("content-type"))
 	require.JSONEq(t, expectedJSON, responseBody)